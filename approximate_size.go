@@ -0,0 +1,199 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+)
+
+// Range is the key range [Start, Limit).
+type Range struct {
+	Start []byte
+	Limit []byte
+}
+
+// ApproximateOffsetOf returns the approximate offset of the data for the
+// specified key within the DB: the total size of the sstable data for keys
+// less than key. The estimate is computed from sstable metadata and index
+// blocks, without reading any data blocks. Data in the memtables is not
+// included.
+func (d *DB) ApproximateOffsetOf(key []byte) (uint64, error) {
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	current.ref()
+	d.mu.Unlock()
+	defer current.unref()
+
+	return d.approximateOffsetOf(current, key)
+}
+
+// GetApproximateSizes returns the approximate number of bytes of sstable data
+// used by each of the specified key ranges. The sizes are computed as the
+// difference between the ApproximateOffsetOf the range's limit and start
+// keys, and as such are only as accurate as the granularity of the sstable
+// data blocks. An empty or inverted range has a size of 0. Data in the
+// memtables is not included.
+func (d *DB) GetApproximateSizes(ranges []Range) ([]uint64, error) {
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	current.ref()
+	d.mu.Unlock()
+	defer current.unref()
+
+	sizes := make([]uint64, len(ranges))
+	for i, r := range ranges {
+		start, err := d.approximateOffsetOf(current, r.Start)
+		if err != nil {
+			return nil, err
+		}
+		limit, err := d.approximateOffsetOf(current, r.Limit)
+		if err != nil {
+			return nil, err
+		}
+		if limit > start {
+			sizes[i] = limit - start
+		}
+	}
+	return sizes, nil
+}
+
+func (d *DB) approximateOffsetOf(v *version, key []byte) (uint64, error) {
+	var result uint64
+	for level := range v.files {
+		files := v.files[level]
+		for i := range files {
+			f := &files[i]
+			if d.cmp(f.largest.UserKey, key) < 0 {
+				// The entire file is before key.
+				result += f.size
+				continue
+			}
+			if d.cmp(f.smallest.UserKey, key) > 0 {
+				// The entire file is after key. The files in levels other than L0
+				// are sorted and non-overlapping, so the remaining files in the
+				// level are also after key.
+				if level > 0 {
+					break
+				}
+				continue
+			}
+			err := d.tableCache.withReader(f, func(r *sstable.Reader) error {
+				offset, err := r.ApproximateOffsetOf(key)
+				if err != nil {
+					return err
+				}
+				if f.backingFileNum != 0 {
+					// The offset is within the backing table, which may contain data
+					// before the start of the virtual table.
+					start, err := r.ApproximateOffsetOf(f.smallest.UserKey)
+					if err != nil {
+						return err
+					}
+					offset -= start
+					if offset > f.size {
+						offset = 0
+					}
+				}
+				result += offset
+				return nil
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// EstimateCount returns an estimate of the number of live keys in the range
+// [start, end). The number of entries in each sstable overlapping the range
+// is interpolated from the table's NumEntries property and the offsets of the
+// range's bounds in its index block, without reading any data blocks. The
+// entries in the memtables are counted exactly.
+//
+// Each deletion is assumed to delete an older entry, which is subtracted from
+// the count. Overwritten keys whose older versions have not yet been compacted
+// away are counted once per version, so the estimate errs on the high side
+// for workloads which overwrite keys.
+func (d *DB) EstimateCount(start, end []byte) (uint64, error) {
+	if d.cmp(start, end) >= 0 {
+		return 0, nil
+	}
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	current.ref()
+	memtables := d.mu.mem.queue
+	d.mu.Unlock()
+	defer current.unref()
+
+	var count float64
+	for _, mem := range memtables {
+		iter := mem.NewIter(nil)
+		for iter.SeekGE(start); iter.Valid() && d.cmp(iter.Key().UserKey, end) < 0; iter.Next() {
+			switch iter.Key().Kind() {
+			case db.InternalKeyKindSet, db.InternalKeyKindMerge:
+				count++
+			case db.InternalKeyKindDelete:
+				count--
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return 0, err
+		}
+	}
+
+	for level := range current.files {
+		for i := range current.files[level] {
+			f := &current.files[level][i]
+			if d.cmp(f.largest.UserKey, start) < 0 || d.cmp(f.smallest.UserKey, end) >= 0 {
+				continue
+			}
+			err := d.tableCache.withReader(f, func(r *sstable.Reader) error {
+				p := &r.Properties
+				if p.DataSize == 0 {
+					return nil
+				}
+				lower := start
+				if d.cmp(lower, f.smallest.UserKey) < 0 {
+					lower = f.smallest.UserKey
+				}
+				lo, err := r.ApproximateOffsetOf(lower)
+				if err != nil {
+					return err
+				}
+				var hi uint64
+				if d.cmp(end, f.largest.UserKey) > 0 {
+					// The range extends past the end of the table, which for a virtual
+					// table may precede the end of the backing table.
+					size, err := r.EstimateDiskUsage(lower, f.largest.UserKey)
+					if err != nil {
+						return err
+					}
+					hi = lo + size
+				} else if hi, err = r.ApproximateOffsetOf(end); err != nil {
+					return err
+				}
+				if hi > p.DataSize {
+					hi = p.DataSize
+				}
+				if hi <= lo {
+					return nil
+				}
+				pointDeletions := p.NumDeletions - p.NumRangeDeletions
+				live := float64(p.NumEntries-p.NumDeletions) - float64(pointDeletions)
+				count += live * float64(hi-lo) / float64(p.DataSize)
+				return nil
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if count < 0 {
+		return 0, nil
+	}
+	return uint64(count + 0.5), nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestApproximateSizes(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Levels: []db.LevelOptions{{
+			BlockSize:   1024,
+			Compression: db.NoCompression,
+		}},
+		Logger:  discardLogger{},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%05d", i))
+	}
+	value := make([]byte, 100)
+
+	// Write two overlapping L0 tables.
+	const count = 1000
+	for _, step := range []int{1, 2} {
+		for i := 0; i < count; i += step {
+			if err := d.Set(key(i), value, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tables, err := d.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total uint64
+	for _, level := range tables {
+		for _, info := range level {
+			total += info.Size
+		}
+	}
+
+	offset := func(k []byte) uint64 {
+		t.Helper()
+		v, err := d.ApproximateOffsetOf(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	if v := offset(nil); v != 0 {
+		t.Fatalf("expected offset 0, but found %d", v)
+	}
+	if v := offset([]byte("z")); v != total {
+		t.Fatalf("expected offset %d, but found %d", total, v)
+	}
+	var prev uint64
+	for i := 0; i < count; i += 100 {
+		v := offset(key(i))
+		if v < prev {
+			t.Fatalf("%s: offset %d is less than the offset of the previous key %d", key(i), v, prev)
+		}
+		prev = v
+	}
+
+	sizes, err := d.GetApproximateSizes([]Range{
+		{Start: key(0), Limit: key(count / 2)},
+		{Start: key(count / 2), Limit: key(count)},
+		{Start: key(0), Limit: []byte("z")},
+		{Start: key(count / 2), Limit: key(0)},
+		{Start: []byte("x"), Limit: []byte("z")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The data is evenly distributed, so each half of the key space should
+	// account for roughly half of the data.
+	for i := 0; i < 2; i++ {
+		if sizes[i] < total/3 || sizes[i] > 2*total/3 {
+			t.Fatalf("%d: expected approximately %d, but found %d", i, total/2, sizes[i])
+		}
+	}
+	if sizes[2] != total {
+		t.Fatalf("expected %d, but found %d", total, sizes[2])
+	}
+	for i := 3; i < len(sizes); i++ {
+		if sizes[i] != 0 {
+			t.Fatalf("%d: expected 0, but found %d", i, sizes[i])
+		}
+	}
+}
+
+func TestEstimateCount(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Levels: []db.LevelOptions{{
+			BlockSize:   1024,
+			Compression: db.NoCompression,
+		}},
+		Logger:  discardLogger{},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%05d", i))
+	}
+	value := make([]byte, 100)
+	const count = 1000
+	for i := 0; i < count; i++ {
+		if err := d.Set(key(i), value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// The memtable deletes the first 100 keys and adds 100 more.
+	for i := 0; i < 100; i++ {
+		if err := d.Delete(key(i), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Set(key(count+i), value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		start, end []byte
+		expected   uint64
+	}{
+		{key(0), []byte("z"), count},
+		{key(300), key(500), 200},
+		{key(900), key(count + 50), 150},
+		{key(0), key(100), 0},
+		{key(500), key(300), 0},
+		{[]byte("x"), []byte("z"), 0},
+	}
+	for _, c := range testCases {
+		n, err := d.EstimateCount(c.start, c.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The estimate is accurate to the granularity of the data blocks, which
+		// hold 9 entries each.
+		if n+10 < c.expected || n > c.expected+10 {
+			t.Fatalf("[%s, %s): expected approximately %d, but found %d", c.start, c.end, c.expected, n)
+		}
+	}
+}
@@ -26,27 +26,31 @@ import (
 
 // Arena should be lock-free.
 type Arena struct {
-	n   uint32
+	// The allocation high-water mark. Must be the first field to ensure 64-bit
+	// alignment for atomic operations.
+	n   uint64
 	buf []byte
 
 	extValues struct {
-		threshold uint32
-		size      uint32
+		threshold uint64
+		size      uint64
 		sync.RWMutex
 		vals [][]byte
 	}
 }
 
 const (
-	align4 = 3
+	align8 = 7
 )
 
 var (
 	ErrArenaFull = errors.New("allocation failed because arena is full")
 )
 
-// NewArena allocates a new arena of the specified size and returns it.
-func NewArena(size, extValueThreshold uint32) *Arena {
+// NewArena allocates a new arena of the specified size and returns it. Offsets
+// within an arena are 64-bit, so the size of an arena is only limited by the
+// memory available.
+func NewArena(size, extValueThreshold uint64) *Arena {
 	// Don't store data at position 0 in order to reserve offset=0 as a kind
 	// of nil pointer.
 	out := &Arena{
@@ -64,34 +68,40 @@ func NewArena(size, extValueThreshold uint32) *Arena {
 	return out
 }
 
-func (a *Arena) Size() uint32 {
-	return atomic.LoadUint32(&a.n) + atomic.LoadUint32(&a.extValues.size)
+func (a *Arena) Size() uint64 {
+	n := atomic.LoadUint64(&a.n)
+	if n > uint64(len(a.buf)) {
+		// Failed allocations continue to bump the high-water mark past the end of
+		// the buffer.
+		n = uint64(len(a.buf))
+	}
+	return n + atomic.LoadUint64(&a.extValues.size)
 }
 
-func (a *Arena) Capacity() uint32 {
-	return uint32(len(a.buf))
+func (a *Arena) Capacity() uint64 {
+	return uint64(len(a.buf))
 }
 
 func (a *Arena) reset() {
-	atomic.StoreUint32(&a.n, 1)
+	atomic.StoreUint64(&a.n, 1)
 }
 
-func (a *Arena) alloc(size, align uint32) (uint32, error) {
+func (a *Arena) alloc(size uint64, align uint64) (uint64, error) {
 	// Pad the allocation with enough bytes to ensure the requested alignment.
-	padded := uint32(size) + align
+	padded := size + align
 
-	newSize := atomic.AddUint32(&a.n, padded)
-	if int(newSize) > len(a.buf) {
+	newSize := atomic.AddUint64(&a.n, padded)
+	if newSize > uint64(len(a.buf)) {
 		return 0, ErrArenaFull
 	}
 
 	// Return the aligned offset.
-	offset := (newSize - padded + uint32(align)) & ^uint32(align)
+	offset := (newSize - padded + align) & ^align
 	return offset, nil
 }
 
 func (a *Arena) allocExtValue(size uint32) int32 {
-	atomic.AddUint32(&a.extValues.size, size)
+	atomic.AddUint64(&a.extValues.size, uint64(size))
 	v := make([]byte, size)
 	a.extValues.Lock()
 	i := int32(len(a.extValues.vals))
@@ -100,25 +110,26 @@ func (a *Arena) allocExtValue(size uint32) int32 {
 	return i
 }
 
-func (a *Arena) getBytes(offset uint32, size uint32) []byte {
+func (a *Arena) getBytes(offset uint64, size uint32) []byte {
 	if offset == 0 {
 		return nil
 	}
-	return a.buf[offset : offset+size : offset+size]
+	end := offset + uint64(size)
+	return a.buf[offset:end:end]
 }
 
-func (a *Arena) getPointer(offset uint32) unsafe.Pointer {
+func (a *Arena) getPointer(offset uint64) unsafe.Pointer {
 	if offset == 0 {
 		return nil
 	}
 	return unsafe.Pointer(&a.buf[offset])
 }
 
-func (a *Arena) getPointerOffset(ptr unsafe.Pointer) uint32 {
+func (a *Arena) getPointerOffset(ptr unsafe.Pointer) uint64 {
 	if ptr == nil {
 		return 0
 	}
-	return uint32(uintptr(ptr) - uintptr(unsafe.Pointer(&a.buf[0])))
+	return uint64(uintptr(ptr) - uintptr(unsafe.Pointer(&a.buf[0])))
 }
 
 func (a *Arena) getExtValue(i int32) []byte {
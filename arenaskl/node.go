@@ -27,23 +27,23 @@ import (
 
 // MaxNodeSize returns the maximum space needed for a node with the specified
 // key and value sizes.
-func MaxNodeSize(keySize, valueSize uint32) uint32 {
-	return uint32(maxNodeSize) + keySize + valueSize + align4
+func MaxNodeSize(keySize, valueSize uint64) uint64 {
+	return uint64(maxNodeSize) + keySize + valueSize + align8
 }
 
 type links struct {
-	nextOffset uint32
-	prevOffset uint32
+	nextOffset uint64
+	prevOffset uint64
 }
 
-func (l *links) init(prevOffset, nextOffset uint32) {
+func (l *links) init(prevOffset, nextOffset uint64) {
 	l.nextOffset = nextOffset
 	l.prevOffset = prevOffset
 }
 
 type node struct {
 	// Immutable fields, so no need to lock to access key.
-	keyOffset uint32
+	keyOffset uint64
 	keySize   uint32
 	// If valueSize is negative, the value is stored separately from the node in
 	// arena.extValues.
@@ -88,14 +88,14 @@ func newRawNode(arena *Arena, height uint32, keySize, valueSize uint32) (nd *nod
 	// Compute the amount of the tower that will never be used, since the height
 	// is less than maxHeight.
 	unusedSize := (maxHeight - int(height)) * linksSize
-	nodeSize := uint32(maxNodeSize - unusedSize)
+	nodeSize := uint64(maxNodeSize - unusedSize)
 	valueIndex := int32(valueSize)
-	if valueSize >= arena.extValues.threshold {
+	if uint64(valueSize) >= arena.extValues.threshold {
 		valueIndex = -(arena.allocExtValue(valueSize) + 1)
 		valueSize = 0
 	}
 
-	nodeOffset, err := arena.alloc(nodeSize+keySize+valueSize, align4)
+	nodeOffset, err := arena.alloc(nodeSize+uint64(keySize)+uint64(valueSize), align8)
 	if err != nil {
 		return
 	}
@@ -133,21 +133,21 @@ func (n *node) getValue(arena *Arena) []byte {
 	if n.valueSize < 0 {
 		return arena.getExtValue(-n.valueSize - 1)
 	}
-	return arena.getBytes(n.keyOffset+n.keySize, uint32(n.valueSize))
+	return arena.getBytes(n.keyOffset+uint64(n.keySize), uint32(n.valueSize))
 }
 
-func (n *node) nextOffset(h int) uint32 {
-	return atomic.LoadUint32(&n.tower[h].nextOffset)
+func (n *node) nextOffset(h int) uint64 {
+	return atomic.LoadUint64(&n.tower[h].nextOffset)
 }
 
-func (n *node) prevOffset(h int) uint32 {
-	return atomic.LoadUint32(&n.tower[h].prevOffset)
+func (n *node) prevOffset(h int) uint64 {
+	return atomic.LoadUint64(&n.tower[h].prevOffset)
 }
 
-func (n *node) casNextOffset(h int, old, val uint32) bool {
-	return atomic.CompareAndSwapUint32(&n.tower[h].nextOffset, old, val)
+func (n *node) casNextOffset(h int, old, val uint64) bool {
+	return atomic.CompareAndSwapUint64(&n.tower[h].nextOffset, old, val)
 }
 
-func (n *node) casPrevOffset(h int, old, val uint32) bool {
-	return atomic.CompareAndSwapUint32(&n.tower[h].prevOffset, old, val)
+func (n *node) casPrevOffset(h int, old, val uint64) bool {
+	return atomic.CompareAndSwapUint64(&n.tower[h].prevOffset, old, val)
 }
@@ -157,7 +157,7 @@ func (s *Skiplist) Height() uint32 { return atomic.LoadUint32(&s.height) }
 func (s *Skiplist) Arena() *Arena { return s.arena }
 
 // Size returns the number of bytes that have allocated from the arena.
-func (s *Skiplist) Size() uint32 { return s.arena.Size() }
+func (s *Skiplist) Size() uint64 { return s.arena.Size() }
 
 // Add adds a new key if it does not yet exist. If the key already exists, then
 // Add returns ErrRecordExists. If there isn't enough room in the arena, then
@@ -367,12 +367,12 @@ func (s *Skiplist) findSpliceForLevel(
 }
 
 func (s *Skiplist) getNext(nd *node, h int) *node {
-	offset := atomic.LoadUint32(&nd.tower[h].nextOffset)
+	offset := atomic.LoadUint64(&nd.tower[h].nextOffset)
 	return (*node)(s.arena.getPointer(offset))
 }
 
 func (s *Skiplist) getPrev(nd *node, h int) *node {
-	offset := atomic.LoadUint32(&nd.tower[h].prevOffset)
+	offset := atomic.LoadUint64(&nd.tower[h].prevOffset)
 	return (*node)(s.arena.getPointer(offset))
 }
 
@@ -108,6 +108,33 @@ func TestFull(t *testing.T) {
 	require.Equal(t, ErrArenaFull, err)
 }
 
+// TestLargeArena verifies that nodes can be allocated beyond the 4GB offset
+// of an arena.
+func TestLargeArena(t *testing.T) {
+	if ^uint(0)>>32 == 0 {
+		t.Skip("64-bit offsets require a 64-bit platform")
+	}
+	// The pages of the arena are only touched by the nodes allocated near the
+	// 4GB offset, so the arena does not consume 4GB of memory.
+	a := NewArena(4<<30+64<<10, 0)
+	l := NewSkiplist(a, bytes.Compare)
+	a.n = 4<<30 - 1000
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, l.Add(makeIntKey(i), makeValue(i)))
+	}
+	require.True(t, a.Size() > 4<<30)
+
+	it := l.NewIter()
+	i := 0
+	for it.First(); it.Valid(); it.Next() {
+		require.EqualValues(t, makeIntKey(i).UserKey, it.Key().UserKey)
+		require.EqualValues(t, makeValue(i), it.Value())
+		i++
+	}
+	require.Equal(t, 100, i)
+}
+
 // TestBasic tests single-threaded seeks and adds.
 func TestBasic(t *testing.T) {
 	l := NewSkiplist(NewArena(arenaSize, 0), bytes.Compare)
@@ -465,7 +492,7 @@ func TestIteratorSeekLT(t *testing.T) {
 }
 
 func TestExtValue(t *testing.T) {
-	l := NewSkiplist(NewArena(1000, 5), bytes.Compare)
+	l := NewSkiplist(NewArena(2000, 5), bytes.Compare)
 	l.Add(makeIkey("a"), []byte("aaaaa"))
 	l.Add(makeIkey("b"), []byte("bbbbb"))
 	l.Add(makeIkey("c"), []byte("cccc"))
@@ -501,7 +528,7 @@ func BenchmarkReadWrite(b *testing.B) {
 	for i := 0; i <= 10; i++ {
 		readFrac := float32(i) / 10.0
 		b.Run(fmt.Sprintf("frac_%d", i*10), func(b *testing.B) {
-			l := NewSkiplist(NewArena(uint32((b.N+2)*maxNodeSize), 0), bytes.Compare)
+			l := NewSkiplist(NewArena(uint64((b.N+2)*maxNodeSize), 0), bytes.Compare)
 			b.ResetTimer()
 			var count int
 			b.RunParallel(func(pb *testing.PB) {
@@ -534,7 +561,7 @@ func BenchmarkOrderedWrite(b *testing.B) {
 		binary.BigEndian.PutUint64(buf, uint64(i))
 		if err := l.Add(db.InternalKey{UserKey: buf}, nil); err == ErrArenaFull {
 			b.StopTimer()
-			l = NewSkiplist(NewArena(uint32((b.N+2)*maxNodeSize), 0), bytes.Compare)
+			l = NewSkiplist(NewArena(uint64((b.N+2)*maxNodeSize), 0), bytes.Compare)
 			b.StartTimer()
 		}
 	}
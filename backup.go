@@ -0,0 +1,372 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/record"
+	"github.com/petermattis/pebble/storage"
+)
+
+const (
+	// backupTablesDirname is the subdirectory of a backup directory holding the
+	// sstables, which are shared by the backups.
+	backupTablesDirname = "tables"
+	// backupCatalogFilename is the file of a backup directory listing the
+	// backups, one per line.
+	backupCatalogFilename = "CATALOG"
+)
+
+// BackupInfo describes a backup of a DB.
+type BackupInfo struct {
+	// ID identifies the backup within its backup directory. IDs are assigned in
+	// increasing order.
+	ID uint64
+	// Time is the time at which the backup was taken.
+	Time time.Time
+	// LastSequence is the sequence number of the last write contained in the
+	// backup.
+	LastSequence uint64
+	// Tables is the number of sstables in the backup, and Size the total size
+	// of its sstables and WALs.
+	Tables int
+	Size   uint64
+	// CopiedSize is the number of bytes copied by the backup. The sstables
+	// which were copied by a previous backup are shared with it rather than
+	// copied again.
+	CopiedSize uint64
+}
+
+// Backup takes a backup of the DB into the backup directory backupDir, which
+// is created if it does not exist, and returns its description. The backup
+// contains every write which was committed before Backup was called, and is
+// restored with RestoreBackup.
+//
+// Backups are incremental: the sstables of the DB are immutable and are shared
+// by the backups, so a backup copies only the sstables which were added to the
+// DB since the previous backup, along with the WALs holding the writes which
+// are not yet in an sstable and a MANIFEST describing the LSM. Every backup in
+// the directory remains restorable, providing point-in-time restores. Writes
+// to the DB are blocked while the WALs are copied.
+//
+// A backup directory must only hold the backups of a single DB. Backing up a
+// DB with keyspaces is not supported.
+func (d *DB) Backup(backupDir string) (*BackupInfo, error) {
+	if d.parent != nil {
+		return nil, errors.New("pebble: keyspaces cannot be backed up")
+	}
+	fs := d.opts.Storage
+	tablesDir := filepath.Join(backupDir, backupTablesDirname)
+	if err := fs.MkdirAll(tablesDir, 0755); err != nil {
+		return nil, err
+	}
+	backups, err := readBackupCatalog(fs, backupDir)
+	if err != nil {
+		return nil, err
+	}
+	info := &BackupInfo{ID: 1, Time: time.Now()}
+	if n := len(backups); n > 0 {
+		info.ID = backups[n-1].ID + 1
+	}
+	dirname := backupDirname(backupDir, info.ID)
+	if err := fs.MkdirAll(dirname, 0755); err != nil {
+		return nil, err
+	}
+
+	// Copy the live WALs and snapshot the LSM while holding d.mu, which keeps
+	// them consistent with each other. The sstables of the snapshot are copied
+	// once d.mu is released, and are kept from becoming obsolete by the
+	// reference to the current version.
+	d.mu.Lock()
+	if len(d.mu.keyspaces) > 0 {
+		d.mu.Unlock()
+		return nil, errors.New("pebble: a DB with keyspaces cannot be backed up")
+	}
+	for d.mu.mem.switching {
+		d.mu.mem.cond.Wait()
+	}
+	logs, err := d.copyLiveLogs(dirname)
+	if err != nil {
+		d.mu.Unlock()
+		return nil, err
+	}
+	manifestFileNum := d.mu.versions.nextFileNum()
+	ve := d.mu.versions.snapshot()
+	info.LastSequence = ve.lastSequence - 1
+	current := d.mu.versions.currentVersion()
+	current.ref()
+	d.mu.Unlock()
+	defer current.unref()
+
+	for _, filename := range logs {
+		stat, err := fs.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		info.Size += uint64(stat.Size())
+		info.CopiedSize += uint64(stat.Size())
+	}
+
+	copied := make(map[uint64]bool)
+	for _, files := range current.files {
+		for i := range files {
+			fileNum := files[i].diskFileNum()
+			if copied[fileNum] {
+				continue
+			}
+			copied[fileNum] = true
+			n, size, err := d.backupTable(tablesDir, fileNum)
+			if err != nil {
+				return nil, err
+			}
+			info.Tables++
+			info.Size += size
+			info.CopiedSize += n
+		}
+	}
+	if err := syncDir(fs, tablesDir); err != nil {
+		return nil, err
+	}
+
+	if err := writeManifest(fs, dirname, manifestFileNum, &ve); err != nil {
+		return nil, err
+	}
+	if err := syncDir(fs, dirname); err != nil {
+		return nil, err
+	}
+	// The backup is only restorable once it is recorded in the catalog.
+	if err := writeBackupCatalog(fs, backupDir, append(backups, *info)); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// backupTable copies the sstable fileNum to tablesDir, unless it was copied by
+// a previous backup. It returns the number of bytes copied, and the size of
+// the sstable.
+func (d *DB) backupTable(tablesDir string, fileNum uint64) (n, size uint64, err error) {
+	fs := d.opts.Storage
+	filename := dbFilename(d.dirname, fileTypeTable, fileNum)
+	stat, err := fs.Stat(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	size = uint64(stat.Size())
+	backupFilename := dbFilename(tablesDir, fileTypeTable, fileNum)
+	if stat, err := fs.Stat(backupFilename); err == nil && uint64(stat.Size()) == size {
+		return 0, size, nil
+	}
+	// The sstable is copied to a temporary file and renamed, so that a partial
+	// copy is never mistaken for a backed up sstable.
+	tmpFilename := backupFilename + ".tmp"
+	if err := copyFile(fs, filename, tmpFilename, -1); err != nil {
+		return 0, 0, err
+	}
+	if err := fs.Rename(tmpFilename, backupFilename); err != nil {
+		fs.Remove(tmpFilename)
+		return 0, 0, err
+	}
+	return size, size, nil
+}
+
+// ListBackups returns the backups in the backup directory backupDir, in
+// increasing ID order.
+func ListBackups(backupDir string, opts *db.Options) ([]BackupInfo, error) {
+	opts = opts.EnsureDefaults()
+	return readBackupCatalog(opts.Storage, backupDir)
+}
+
+// RestoreBackup restores the backup with the specified ID from the backup
+// directory backupDir into the directory dirname, which is created if it does
+// not exist and must not already contain a DB. The restored DB is opened with
+// Open, which replays the WALs of the backup.
+func RestoreBackup(backupDir string, id uint64, dirname string, opts *db.Options) (err error) {
+	opts = opts.EnsureDefaults()
+	fs := opts.Storage
+	backups, err := readBackupCatalog(fs, backupDir)
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range backups {
+		found = found || backups[i].ID == id
+	}
+	if !found {
+		return fmt.Errorf("pebble: backup %d not found in %q", id, backupDir)
+	}
+
+	if err := fs.MkdirAll(dirname, 0755); err != nil {
+		return err
+	}
+	if _, err := fs.Stat(dbFilename(dirname, fileTypeCurrent, 0)); err == nil {
+		return fmt.Errorf("pebble: DB already exists in %q", dirname)
+	}
+
+	// The files created in dirname are removed if the restore fails.
+	var created []string
+	defer func() {
+		if err != nil {
+			for _, filename := range created {
+				fs.Remove(filename)
+			}
+		}
+	}()
+	restore := func(src string, fileType fileType, fileNum uint64) error {
+		filename := dbFilename(dirname, fileType, fileNum)
+		if err := copyFile(fs, src, filename, -1); err != nil {
+			return err
+		}
+		created = append(created, filename)
+		return nil
+	}
+
+	srcDir := backupDirname(backupDir, id)
+	list, err := fs.List(srcDir)
+	if err != nil {
+		return err
+	}
+	var manifestFileNum uint64
+	for _, filename := range list {
+		fileType, fileNum, ok := parseDBFilename(filename)
+		if !ok {
+			continue
+		}
+		switch fileType {
+		case fileTypeLog:
+			if err := restore(filepath.Join(srcDir, filename), fileType, fileNum); err != nil {
+				return err
+			}
+		case fileTypeManifest:
+			manifestFileNum = fileNum
+		}
+	}
+	if manifestFileNum == 0 {
+		return fmt.Errorf("pebble: backup %d in %q has no MANIFEST", id, backupDir)
+	}
+	ve, err := readBackupManifest(fs, dbFilename(srcDir, fileTypeManifest, manifestFileNum))
+	if err != nil {
+		return err
+	}
+
+	tablesDir := filepath.Join(backupDir, backupTablesDirname)
+	restored := make(map[uint64]bool)
+	for _, nf := range ve.newFiles {
+		fileNum := nf.meta.diskFileNum()
+		if restored[fileNum] {
+			continue
+		}
+		restored[fileNum] = true
+		src := dbFilename(tablesDir, fileTypeTable, fileNum)
+		if err := restore(src, fileTypeTable, fileNum); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(fs, dirname); err != nil {
+		return err
+	}
+
+	if err := writeManifest(fs, dirname, manifestFileNum, ve); err != nil {
+		return err
+	}
+	created = append(created, dbFilename(dirname, fileTypeManifest, manifestFileNum))
+	return setCurrentFile(dirname, fs, manifestFileNum)
+}
+
+// backupDirname returns the directory of the backup with the specified ID.
+func backupDirname(backupDir string, id uint64) string {
+	return filepath.Join(backupDir, fmt.Sprintf("%06d", id))
+}
+
+// readBackupManifest reads the snapshot of the LSM in the MANIFEST of a
+// backup.
+func readBackupManifest(fs storage.Storage, filename string) (*versionEdit, error) {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := record.NewReader(f).Next()
+	if err != nil {
+		return nil, fmt.Errorf("pebble: could not read %q: %v", filename, err)
+	}
+	ve := &versionEdit{}
+	if err := ve.decode(r); err != nil {
+		return nil, fmt.Errorf("pebble: could not read %q: %v", filename, err)
+	}
+	return ve, nil
+}
+
+// readBackupCatalog reads the backups listed in the catalog of backupDir. A
+// missing catalog lists no backups.
+func readBackupCatalog(fs storage.Storage, backupDir string) ([]BackupInfo, error) {
+	filename := filepath.Join(backupDir, backupCatalogFilename)
+	f, err := fs.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []BackupInfo
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var b BackupInfo
+		var nanos int64
+		if _, err := fmt.Sscanf(string(line), "%d %d %d %d %d %d",
+			&b.ID, &nanos, &b.LastSequence, &b.Tables, &b.Size, &b.CopiedSize); err != nil {
+			return nil, fmt.Errorf("pebble: malformed backup catalog %q: %q", filename, line)
+		}
+		b.Time = time.Unix(0, nanos)
+		backups = append(backups, b)
+	}
+	return backups, nil
+}
+
+// writeBackupCatalog replaces the catalog of backupDir with one listing
+// backups. The new catalog is written to a temporary file which is renamed
+// over the old one, so that the catalog is never partially written.
+func writeBackupCatalog(fs storage.Storage, backupDir string, backups []BackupInfo) error {
+	filename := filepath.Join(backupDir, backupCatalogFilename)
+	tmpFilename := filename + ".tmp"
+	f, err := fs.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, b := range backups {
+		fmt.Fprintf(&buf, "%d %d %d %d %d %d\n",
+			b.ID, b.Time.UnixNano(), b.LastSequence, b.Tables, b.Size, b.CopiedSize)
+	}
+	_, err = io.Copy(f, &buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	err = firstError(err, f.Close())
+	if err == nil {
+		err = fs.Rename(tmpFilename, filename)
+	}
+	if err != nil {
+		fs.Remove(tmpFilename)
+		return err
+	}
+	return syncDir(fs, backupDir)
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestBackup(t *testing.T) {
+	opts := &db.Options{
+		Logger:  discardLogger{},
+		Storage: storage.NewMem(),
+	}
+	d, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := func(keys ...string) {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	backup := func() *BackupInfo {
+		info, err := d.Backup("backup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	// The first backup copies the sstable and the WAL.
+	set("a", "b")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	b1 := backup()
+	if b1.ID != 1 || b1.Tables != 1 || b1.CopiedSize != b1.Size {
+		t.Fatalf("unexpected first backup %+v", b1)
+	}
+
+	// The second backup shares the sstable with the first, and only copies the
+	// WAL holding the new write.
+	set("c")
+	b2 := backup()
+	if b2.ID != 2 || b2.Tables != 1 || b2.CopiedSize >= b2.Size || b2.LastSequence <= b1.LastSequence {
+		t.Fatalf("unexpected incremental backup %+v after %+v", b2, b1)
+	}
+
+	set("d")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	b3 := backup()
+	if b3.ID != 3 || b3.Tables != 2 || b3.CopiedSize >= b3.Size {
+		t.Fatalf("unexpected incremental backup %+v", b3)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := ListBackups("backup", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 3 {
+		t.Fatalf("expected 3 backups, but found %+v", backups)
+	}
+	for i, b := range []*BackupInfo{b1, b2, b3} {
+		if backups[i].ID != b.ID || backups[i].LastSequence != b.LastSequence ||
+			!backups[i].Time.Equal(b.Time) {
+			t.Fatalf("expected backup %+v, but found %+v", *b, backups[i])
+		}
+	}
+
+	// Each backup restores the DB as of the time it was taken.
+	testCases := []struct {
+		id       uint64
+		expected string
+	}{
+		{1, "a b"},
+		{2, "a b c"},
+		{3, "a b c d"},
+	}
+	for _, c := range testCases {
+		dirname := "restore" + string('0'+byte(c.id))
+		if err := RestoreBackup("backup", c.id, dirname, opts); err != nil {
+			t.Fatal(err)
+		}
+		r, err := Open(dirname, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		iter := r.NewIter(nil)
+		for iter.First(); iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if s := strings.Join(keys, " "); s != c.expected {
+			t.Fatalf("backup %d: expected %q, but found %q", c.id, c.expected, s)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RestoreBackup("backup", 1, "restore1", opts); err == nil ||
+		!strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected error restoring into an existing DB, but found %v", err)
+	}
+	if err := RestoreBackup("backup", 4, "restore4", opts); err == nil ||
+		!strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected error restoring a missing backup, but found %v", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"unsafe"
 
@@ -27,6 +28,12 @@ var ErrNotIndexed = errors.New("pebble: batch not indexed")
 // ErrInvalidBatch indicates that a batch is invalid or otherwise corrupted.
 var ErrInvalidBatch = errors.New("pebble: invalid batch")
 
+// ErrBatchTooLarge indicates that a batch cannot be committed because its
+// entries do not fit in an empty memtable, and the batch cannot be spilled to
+// an sstable as it contains the entries of a keyspace or a transaction
+// marker. See Options.MemTableSize and Options.BatchSpillThreshold.
+var ErrBatchTooLarge = errors.New("pebble: batch too large for memtable")
+
 type batchStorage struct {
 	// Data is the wire format of a batch's log entry:
 	//   - 8 bytes for a sequence number of the first batch element,
@@ -37,6 +44,11 @@ type batchStorage struct {
 	//     - one byte for the kind
 	//     - the varint-string user key,
 	//     - the varint-string value (if kind != delete).
+	//   Interspersed with the elements are any log data records, which consist
+	//   of a kind and a varint-string, and are not included in the count.
+	//   Batches written to the WAL by the two-phase commit methods of DB begin
+	//   with a transaction marker, which has the same form as log data. The
+	//   entries of keyspaces are preceded by a keyspace marker of the same form.
 	// The sequence number and count are stored in little-endian order.
 	data      []byte
 	cmp       db.Compare
@@ -44,7 +56,7 @@ type batchStorage struct {
 }
 
 // Get implements Storage.Get, as documented in the pebble/batchskl package.
-func (s *batchStorage) Get(offset uint32) db.InternalKey {
+func (s *batchStorage) Get(offset uint64) db.InternalKey {
 	kind := db.InternalKeyKind(s.data[offset])
 	_, key, ok := batchDecodeStr(s.data[offset+1:])
 	if !ok {
@@ -61,7 +73,7 @@ func (s *batchStorage) InlineKey(key []byte) uint64 {
 
 // Compare implements Storage.Compare, as documented in the pebble/batchskl
 // package.
-func (s *batchStorage) Compare(a []byte, b uint32) int {
+func (s *batchStorage) Compare(a []byte, b uint64) int {
 	// The key "a" is always the search key or the newer key being inserted. If
 	// it is equal to the existing key consider it smaller so that it sorts
 	// first.
@@ -72,21 +84,73 @@ func (s *batchStorage) Compare(a []byte, b uint32) int {
 }
 
 // Batch is a sequence of Sets and/or Deletes that are applied atomically.
+//
+// A batch whose entries need more than Options.BatchSpillThreshold bytes of
+// memtable space is spilled when it is committed: its entries are written to
+// an sstable which is ingested into the DB, so that a large atomic write,
+// such as a bulk import, does not fill up the memtables. All of the entries of
+// a spilled batch are assigned the same sequence number.
 type Batch struct {
 	batchStorage
 
-	memTableSize uint32
+	memTableSize uint64
 
 	// The db to which the batch will be committed.
 	db *DB
 
 	// An optional skiplist keyed by offset into data of the entry.
 	index *batchskl.Skiplist
+	// An optional skiplist of the range deletion tombstones in the batch, keyed
+	// by offset into data of the entry. Range deletions are indexed separately
+	// from point entries as they are not returned by batch iterators but
+	// instead hide the older point entries they cover.
+	rangeDelIndex *batchskl.Skiplist
+	// The fragments of the tombstones in rangeDelIndex, which are built by
+	// rangeDeleted and discarded when a tombstone is added. See
+	// fragmentRangeDels.
+	rangeDelFrags      []batchRangeDelFrag
+	rangeDelFragsValid bool
+
+	// The keyspace of the entries most recently added to the batch, or empty
+	// for the default keyspace. The entries of other keyspaces are preceded by
+	// a keyspace marker, and are added by applying a keyspace's batch.
+	keyspace string
+	// The keyspaces, other than the default keyspace, which have entries in the
+	// batch, and the memtable space needed by those entries. memTableSize only
+	// accounts for the entries of the default keyspace.
+	keyspaces []batchKeyspace
+
+	// An optional callback invoked after the batch has been committed. See
+	// Batch.OnCommit.
+	onCommit func(seqNum uint64, err error)
+	// An optional callback invoked with DB.mu held before the batch is
+	// assigned a sequence number. The batch is not committed if it returns an
+	// error. See Tx.Commit.
+	validate func() error
 
 	commit  sync.WaitGroup
 	applied uint32 // updated atomically
 }
 
+// batchRangeDelFrag is a fragment of the range deletion tombstones of an
+// indexed batch: a key range which is covered by the same set of tombstones.
+type batchRangeDelFrag struct {
+	start, end []byte
+	// The offset of the newest tombstone covering the fragment, which is the
+	// largest such offset.
+	offset uint64
+}
+
+// batchKeyspace describes the entries of a batch which belong to a keyspace.
+type batchKeyspace struct {
+	name         string
+	memTableSize uint64
+	// The DB of the keyspace, and the memtable the entries are applied to. Set
+	// while the batch is being committed.
+	d   *DB
+	mem *memTable
+}
+
 var _ Reader = (*Batch)(nil)
 var _ Writer = (*Batch)(nil)
 
@@ -97,8 +161,9 @@ var batchPool = sync.Pool{
 }
 
 type indexedBatch struct {
-	batch Batch
-	index batchskl.Skiplist
+	batch         Batch
+	index         batchskl.Skiplist
+	rangeDelIndex batchskl.Skiplist
 }
 
 var indexedBatchPool = sync.Pool{
@@ -120,6 +185,8 @@ func newIndexedBatch(db *DB, comparer *db.Comparer) *Batch {
 	i.batch.db = db
 	i.batch.index = &i.index
 	i.batch.index.Reset(&i.batch.batchStorage, 0)
+	i.batch.rangeDelIndex = &i.rangeDelIndex
+	i.batch.rangeDelIndex.Reset(&i.batch.batchStorage, 0)
 	return &i.batch
 }
 
@@ -129,62 +196,137 @@ func (b *Batch) release() {
 		batchPool.Put(b)
 	} else {
 		*b.index = batchskl.Skiplist{}
+		*b.rangeDelIndex = batchskl.Skiplist{}
 		*b = Batch{}
-		indexedBatchPool.Put(b)
+		// The batch is the first field of its indexedBatch, so the pointer to
+		// the batch is also a pointer to the indexedBatch.
+		indexedBatchPool.Put((*indexedBatch)(unsafe.Pointer(b)))
 	}
 }
 
 func (b *Batch) refreshMemTableSize() {
 	b.memTableSize = 0
+	b.keyspace = ""
+	b.keyspaces = b.keyspaces[:0]
 	for iter := b.iter(); ; {
-		_, key, value, ok := iter.next()
+		kind, key, value, ok := iter.next()
 		if !ok {
 			break
 		}
-		b.memTableSize += memTableEntrySize(len(key), len(value))
+		switch kind {
+		case db.InternalKeyKindLogData, db.InternalKeyKindCommitXID, db.InternalKeyKindRollbackXID:
+			continue
+		case db.InternalKeyKindKeyspace:
+			b.keyspace = string(key)
+			continue
+		}
+		b.addMemTableSize(memTableEntrySize(len(key), len(value)))
+	}
+}
+
+// addMemTableSize accounts for the memtable space needed by an entry of the
+// batch's current keyspace.
+func (b *Batch) addMemTableSize(size uint64) {
+	if b.keyspace == "" {
+		b.memTableSize += size
+		return
+	}
+	for i := range b.keyspaces {
+		if b.keyspaces[i].name == b.keyspace {
+			b.keyspaces[i].memTableSize += size
+			return
+		}
+	}
+	b.keyspaces = append(b.keyspaces, batchKeyspace{name: b.keyspace, memTableSize: size})
+}
+
+// setKeyspace sets the keyspace of the entries subsequently added to the
+// batch, appending a keyspace marker if it differs from the current keyspace.
+func (b *Batch) setKeyspace(name string) {
+	if b.keyspace == name {
+		return
 	}
+	b.appendMarker(db.InternalKeyKindKeyspace, []byte(name))
+	b.keyspace = name
 }
 
 // Apply the operations contained in the batch to the receiver batch.
 //
 // It is safe to modify the contents of the arguments after Apply returns.
 func (b *Batch) Apply(batch *Batch, _ *db.WriteOptions) error {
+	// The entries of the batch of a keyspace belong to that keyspace, unless
+	// they are being applied to another batch of the same keyspace.
+	var keyspace string
+	if k := batch.db; k != nil && k.parent != nil && k != b.db {
+		keyspace = k.keyspaceName
+	}
+	return b.apply(batch, keyspace)
+}
+
+// apply appends the entries of batch to the receiver batch as entries of the
+// specified keyspace, or of the default keyspace if the name is empty.
+func (b *Batch) apply(batch *Batch, keyspace string) error {
 	if len(batch.data) == 0 {
 		return nil
 	}
 	if len(batch.data) < batchHeaderLen {
 		return errors.New("pebble: invalid batch")
 	}
+	if keyspace != "" && len(batch.keyspaces) > 0 {
+		return errors.New("pebble: cannot apply the entries of other keyspaces to a keyspace")
+	}
+	if keyspace != "" || len(batch.keyspaces) > 0 {
+		if b.index != nil {
+			return errors.New("pebble: cannot apply the entries of a keyspace to an indexed batch")
+		}
+		if b.db != nil && b.db.parent != nil {
+			return errors.New("pebble: cannot apply the entries of another keyspace to the batch of a keyspace")
+		}
+	}
 
-	offset := len(b.data)
-	if offset == 0 {
-		b.init(offset)
-		offset = batchHeaderLen
+	if len(b.data) == 0 {
+		b.init(len(batch.data))
 	}
+	b.setKeyspace(keyspace)
+	offset := len(b.data)
 	b.data = append(b.data, batch.data[batchHeaderLen:]...)
 
 	count := binary.LittleEndian.Uint32(batch.data[8:12])
 	b.setCount(b.count() + count)
 
-	start := batchReader(b.data[offset:])
-	for iter := batchReader(start); ; {
-		_, key, value, ok := iter.next()
+	for iter := batchReader(b.data[offset:]); len(iter) > 0; {
+		offset := uintptr(unsafe.Pointer(&iter[0])) - uintptr(unsafe.Pointer(&b.data[0]))
+		kind, key, value, ok := iter.next()
 		if !ok {
 			break
 		}
+		switch kind {
+		case db.InternalKeyKindLogData:
+			continue
+		case db.InternalKeyKindKeyspace:
+			b.keyspace = string(key)
+			continue
+		}
 		if b.index != nil {
-			offset := uintptr(unsafe.Pointer(&iter[0])) - uintptr(unsafe.Pointer(&start[0]))
-			if err := b.index.Add(uint32(offset)); err != nil {
+			index := b.index
+			if kind == db.InternalKeyKindRangeDelete {
+				index = b.rangeDelIndex
+				b.rangeDelFragsValid = false
+			}
+			if err := index.Add(uint64(offset)); err != nil {
 				panic(err)
 			}
 		}
-		b.memTableSize += memTableEntrySize(len(key), len(value))
+		b.addMemTableSize(memTableEntrySize(len(key), len(value)))
 	}
 	return nil
 }
 
-// Get gets the value for the given key. It returns ErrNotFound if the DB
-// does not contain the key.
+// Get gets the value for the given key. It returns ErrNotFound if the batch
+// does not contain the key. Merge operands in the batch are merged with each
+// other and with an older value for the key in the batch using the merge
+// operator of the batch's DB (or the default merge operator if the batch is
+// not associated with a DB). Only the contents of the batch are consulted.
 //
 // The caller should not modify the contents of the returned slice, but
 // it is safe to modify the contents of the argument after Get returns.
@@ -192,25 +334,137 @@ func (b *Batch) Get(key []byte) (value []byte, err error) {
 	if b.index == nil {
 		return nil, ErrNotIndexed
 	}
+	merge := db.DefaultMerger
+	if b.db != nil {
+		merge = b.db.merge
+	}
+
 	// Loop over the entries with keys >= the target key. The indexing of the
 	// entries returns equal keys in reverse order of insertion. That is, the
-	// last key added will be seen firsi.
+	// last key added will be seen first.
+	var merging bool
+	var operands mergeOperands
 	iter := b.index.NewIter()
 	iter.SeekGE(key)
 	for ; iter.Valid(); iter.Next() {
-		_, ekey, value, ok := b.decode(iter.KeyOffset())
+		kind, ekey, evalue, ok := b.decode(iter.KeyOffset())
 		if !ok {
 			return nil, fmt.Errorf("corrupted batch")
 		}
-		if b.cmp(key, ekey) > 0 {
+		if b.cmp(key, ekey) != 0 {
 			break
 		}
-		// Invariant: b.cmp(key, ekey) == 0.
-		return value, nil
+		if b.rangeDeleted(key, iter.KeyOffset()) {
+			break
+		}
+		if !merging {
+			if kind != db.InternalKeyKindMerge {
+				return evalue, nil
+			}
+			operands.init(merge, key, evalue)
+			merging = true
+			continue
+		}
+		switch kind {
+		case db.InternalKeyKindDelete:
+			// A deletion tombstone ends the merge chain.
+			return operands.finish(nil), nil
+		case db.InternalKeyKindSet:
+			return operands.finish(evalue), nil
+		case db.InternalKeyKindMerge:
+			operands.add(evalue)
+		}
+	}
+	if merging {
+		return operands.finish(nil), nil
 	}
 	return nil, db.ErrNotFound
 }
 
+// rangeDeleted returns true if the specified key is covered by a range
+// deletion tombstone in the batch that is newer than the entry at the
+// specified offset. The fragment of the tombstones containing the key is
+// found by a binary search.
+func (b *Batch) rangeDeleted(key []byte, offset uint64) bool {
+	if b.rangeDelIndex == nil {
+		return false
+	}
+	if !b.rangeDelFragsValid {
+		b.fragmentRangeDels()
+	}
+	frags := b.rangeDelFrags
+	i := sort.Search(len(frags), func(i int) bool {
+		return b.cmp(key, frags[i].end) < 0
+	})
+	return i < len(frags) && b.cmp(frags[i].start, key) <= 0 && frags[i].offset > offset
+}
+
+// fragmentRangeDels splits the tombstones in rangeDelIndex, which are ordered
+// by start key, into non-overlapping fragments ordered by key. Each fragment
+// records the newest tombstone covering it.
+func (b *Batch) fragmentRangeDels() {
+	type tombstone struct {
+		end    []byte
+		offset uint64
+	}
+	var active []tombstone
+	var pos []byte
+	frags := b.rangeDelFrags[:0]
+	add := func(end []byte) {
+		if b.cmp(pos, end) >= 0 {
+			return
+		}
+		f := batchRangeDelFrag{start: pos, end: end}
+		for _, t := range active {
+			if f.offset < t.offset {
+				f.offset = t.offset
+			}
+		}
+		frags = append(frags, f)
+		pos = end
+	}
+	// flush adds the fragments preceding limit, or all of the remaining
+	// fragments if limit is nil, and retires the tombstones ending before
+	// them.
+	flush := func(limit []byte) {
+		for len(active) > 0 {
+			end := active[0].end
+			for _, t := range active[1:] {
+				if b.cmp(t.end, end) < 0 {
+					end = t.end
+				}
+			}
+			if limit != nil && b.cmp(limit, end) < 0 {
+				add(limit)
+				return
+			}
+			add(end)
+			j := 0
+			for _, t := range active {
+				if b.cmp(t.end, end) > 0 {
+					active[j] = t
+					j++
+				}
+			}
+			active = active[:j]
+		}
+	}
+
+	iter := b.rangeDelIndex.NewIter()
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, start, end, ok := b.decode(iter.KeyOffset())
+		if !ok {
+			break
+		}
+		flush(start)
+		pos = start
+		active = append(active, tombstone{end: end, offset: iter.KeyOffset()})
+	}
+	flush(nil)
+	b.rangeDelFrags = frags
+	b.rangeDelFragsValid = true
+}
+
 // Set adds an action to the batch that sets the key to map to the value.
 //
 // It is safe to modify the contents of the arguments after Set returns.
@@ -218,10 +472,11 @@ func (b *Batch) Set(key, value []byte, _ *db.WriteOptions) error {
 	if len(b.data) == 0 {
 		b.init(len(key) + len(value) + 2*binary.MaxVarintLen64 + batchHeaderLen)
 	}
+	b.setKeyspace("")
 	if !b.increment() {
 		return ErrInvalidBatch
 	}
-	offset := uint32(len(b.data))
+	offset := uint64(len(b.data))
 	b.data = append(b.data, byte(db.InternalKeyKindSet))
 	b.appendStr(key)
 	b.appendStr(value)
@@ -244,10 +499,11 @@ func (b *Batch) Merge(key, value []byte, _ *db.WriteOptions) error {
 	if len(b.data) == 0 {
 		b.init(len(key) + len(value) + 2*binary.MaxVarintLen64 + batchHeaderLen)
 	}
+	b.setKeyspace("")
 	if !b.increment() {
 		return ErrInvalidBatch
 	}
-	offset := uint32(len(b.data))
+	offset := uint64(len(b.data))
 	b.data = append(b.data, byte(db.InternalKeyKindMerge))
 	b.appendStr(key)
 	b.appendStr(value)
@@ -268,10 +524,11 @@ func (b *Batch) Delete(key []byte, _ *db.WriteOptions) error {
 	if len(b.data) == 0 {
 		b.init(len(key) + binary.MaxVarintLen64 + batchHeaderLen)
 	}
+	b.setKeyspace("")
 	if !b.increment() {
 		return ErrInvalidBatch
 	}
-	offset := uint32(len(b.data))
+	offset := uint64(len(b.data))
 	b.data = append(b.data, byte(db.InternalKeyKindDelete))
 	b.appendStr(key)
 	if b.index != nil {
@@ -293,29 +550,97 @@ func (b *Batch) DeleteRange(start, end []byte, _ *db.WriteOptions) error {
 	if len(b.data) == 0 {
 		b.init(len(start) + len(end) + 2*binary.MaxVarintLen64 + batchHeaderLen)
 	}
+	b.setKeyspace("")
 	if !b.increment() {
 		return ErrInvalidBatch
 	}
-	offset := uint32(len(b.data))
+	offset := uint64(len(b.data))
 	b.data = append(b.data, byte(db.InternalKeyKindRangeDelete))
 	b.appendStr(start)
 	b.appendStr(end)
 	if b.index != nil {
-		if err := b.index.Add(offset); err != nil {
+		if err := b.rangeDelIndex.Add(offset); err != nil {
 			// We never add duplicate entries, so an error should never occur.
 			panic(err)
 		}
+		b.rangeDelFragsValid = false
 	}
 	b.memTableSize += memTableEntrySize(len(start), len(end))
 	return nil
 }
 
+// LogData adds the specified data to the batch. The data will be written to
+// the WAL when the batch is committed, but is not added to the memtable or
+// sstables, is not visible to reads and does not consume a sequence number.
+// Log data allows markers to be recorded in the WAL in order with the
+// surrounding writes, for consumption by tools which read the WAL directly.
+//
+// It is safe to modify the contents of the arguments after LogData returns.
+func (b *Batch) LogData(data []byte, _ *db.WriteOptions) error {
+	if len(b.data) == 0 {
+		b.init(len(data) + binary.MaxVarintLen64 + batchHeaderLen)
+	}
+	b.data = append(b.data, byte(db.InternalKeyKindLogData))
+	b.appendStr(data)
+	return nil
+}
+
+// appendMarker appends a transaction marker of the specified kind for the
+// transaction xid. Like log data, markers are not included in the count.
+func (b *Batch) appendMarker(kind db.InternalKeyKind, xid []byte) {
+	if len(b.data) == 0 {
+		b.init(len(xid) + binary.MaxVarintLen64 + batchHeaderLen)
+	}
+	b.data = append(b.data, byte(kind))
+	b.appendStr(xid)
+}
+
 // Repr returns the underlying batch representation. It is not safe to modify
-// the contents.
+// the contents. The representation is a 12-byte header followed by the batch
+// entries:
+//
+//   - 8 bytes for the little-endian sequence number of the first entry, or
+//     zeroes if the batch has not been committed,
+//   - 4 bytes for the little-endian count of entries in the batch,
+//   - count entries, each consisting of a one byte kind, the varint-prefixed
+//     user key and, for kinds other than delete, the varint-prefixed value.
+//     The value of a range deletion is its exclusive end key. Log data
+//     entries consist of a kind and the varint-prefixed data, and are not
+//     included in the count.
+//
+// An empty batch has an empty representation.
 func (b *Batch) Repr() []byte {
 	return b.data
 }
 
+// Count returns the number of entries in the batch, excluding log data.
+func (b *Batch) Count() uint32 {
+	if len(b.data) == 0 {
+		return 0
+	}
+	return b.count()
+}
+
+// Len returns the size in bytes of the batch representation.
+func (b *Batch) Len() int {
+	return len(b.data)
+}
+
+// Empty returns true if the batch does not contain any entries.
+func (b *Batch) Empty() bool {
+	return len(b.data) <= batchHeaderLen
+}
+
+// SeqNum returns the sequence number assigned to the first entry in the batch
+// when it was committed. Subsequent entries are assigned consecutive sequence
+// numbers. Returns zero if the batch has not been committed.
+func (b *Batch) SeqNum() uint64 {
+	if len(b.data) == 0 {
+		return 0
+	}
+	return b.seqNum()
+}
+
 // NewIter returns an iterator that is unpositioned (Iterator.Valid() will
 // return false). The iterator can be positioned via a call to SeekGE, SeekLT,
 // First or Last. Only indexed batches support iterators.
@@ -323,7 +648,7 @@ func (b *Batch) NewIter(o *db.IterOptions) db.Iterator {
 	if b.index == nil {
 		return &dbIter{err: ErrNotIndexed}
 	}
-	return b.db.newIterInternal(b.newInternalIter(o), o)
+	return b.db.newIterInternal(b, nil, o)
 }
 
 // newInternalIter creates a new InternalIterator that iterates over the
@@ -344,6 +669,19 @@ func (b *Batch) Commit(o *db.WriteOptions) error {
 	return b.db.Apply(b, o)
 }
 
+// OnCommit registers a callback to be invoked when the batch is committed to a
+// DB. On success, the callback is invoked with the sequence number assigned to
+// the first entry in the batch after the batch's mutations have become
+// visible for reading. On failure, including a batch rejected before
+// entering the commit pipeline, the callback is invoked with a sequence
+// number of zero and the error returned by the commit. The callback is
+// invoked on the goroutine committing the batch and callbacks for
+// concurrently committed batches may be invoked in any order. Use the
+// sequence number to establish the commit order.
+func (b *Batch) OnCommit(fn func(seqNum uint64, err error)) {
+	b.onCommit = fn
+}
+
 // Close implements DB.Close, as documented in the pebble/db package.
 func (b *Batch) Close() error {
 	return nil
@@ -418,7 +756,7 @@ func (b *Batch) iter() batchReader {
 	return b.data[batchHeaderLen:]
 }
 
-func (b *Batch) decode(offset uint32) (kind db.InternalKeyKind, ukey []byte, value []byte, ok bool) {
+func (b *Batch) decode(offset uint64) (kind db.InternalKeyKind, ukey []byte, value []byte, ok bool) {
 	p := b.data[offset:]
 	if len(p) == 0 {
 		return 0, nil, nil, false
@@ -473,7 +811,9 @@ func (r *batchReader) next() (kind db.InternalKeyKind, ukey []byte, value []byte
 		return 0, nil, nil, false
 	}
 	switch kind {
-	case db.InternalKeyKindSet, db.InternalKeyKindRangeDelete:
+	case db.InternalKeyKindSet,
+		db.InternalKeyKindMerge,
+		db.InternalKeyKindRangeDelete:
 		value, ok = r.nextStr()
 		if !ok {
 			return 0, nil, nil, false
@@ -520,7 +860,12 @@ func (i *batchIter) clearPrevCache() {
 func (i *batchIter) initPrevStart(key db.InternalKey) {
 	i.reverse = true
 	i.prevStart = i.iter
-	for {
+	for n := 0; ; n++ {
+		if n == maxPrevSteps {
+			// See memTableIter.initPrevStart.
+			i.prevStart.SeekGE(key.UserKey)
+			break
+		}
 		iter := i.prevStart
 		if !iter.Prev() {
 			break
@@ -548,9 +893,42 @@ func (i *batchIter) initPrevEnd(key db.InternalKey) {
 	}
 }
 
+// covered returns true if the current entry is covered by a newer range
+// deletion tombstone in the batch.
+func (i *batchIter) covered() bool {
+	return i.iter.Valid() && i.batch.rangeDeleted(i.iter.Key().UserKey, i.iter.KeyOffset())
+}
+
+// skipForward advances the iterator past any entries covered by a range
+// deletion tombstone.
+func (i *batchIter) skipForward() bool {
+	for i.covered() {
+		if !i.iter.Next() {
+			return false
+		}
+	}
+	return i.iter.Valid()
+}
+
+// skipBackward moves the iterator backward past any entries covered by a
+// range deletion tombstone.
+func (i *batchIter) skipBackward() bool {
+	for i.covered() {
+		if !i.prev() {
+			return false
+		}
+	}
+	return i.iter.Valid()
+}
+
 func (i *batchIter) SeekGE(key []byte) {
 	i.clearPrevCache()
 	i.iter.SeekGE(key)
+	i.skipForward()
+}
+
+func (i *batchIter) SeekPrefixGE(prefix, key []byte) {
+	i.SeekGE(key)
 }
 
 func (i *batchIter) SeekLT(key []byte) {
@@ -562,11 +940,13 @@ func (i *batchIter) SeekLT(key []byte) {
 		i.initPrevEnd(key)
 		i.iter = i.prevStart
 	}
+	i.skipBackward()
 }
 
 func (i *batchIter) First() {
 	i.clearPrevCache()
 	i.iter.First()
+	i.skipForward()
 }
 
 func (i *batchIter) Last() {
@@ -578,11 +958,15 @@ func (i *batchIter) Last() {
 		i.prevEnd = i.iter
 		i.iter = i.prevStart
 	}
+	i.skipBackward()
 }
 
 func (i *batchIter) Next() bool {
 	i.clearPrevCache()
-	return i.iter.Next()
+	if !i.iter.Next() {
+		return false
+	}
+	return i.skipForward()
 }
 
 func (i *batchIter) NextUserKey() bool {
@@ -592,18 +976,27 @@ func (i *batchIter) NextUserKey() bool {
 	}
 	if i.iter.Head() {
 		i.iter.First()
-		return i.iter.Valid()
+		return i.skipForward()
 	}
 	key := i.iter.Key()
 	for i.iter.Next() {
 		if i.cmp(key.UserKey, i.Key().UserKey) < 0 {
-			return true
+			// If the newest entry for the user key is covered by a range deletion,
+			// the older entries are covered as well.
+			return i.skipForward()
 		}
 	}
 	return false
 }
 
 func (i *batchIter) Prev() bool {
+	if !i.prev() {
+		return false
+	}
+	return i.skipBackward()
+}
+
+func (i *batchIter) prev() bool {
 	// Reverse iteration is a bit funky in that it returns entries for identical
 	// user-keys from larger to smaller sequence number even though they are not
 	// stored that way in the skiplist. For example, the following shows the
@@ -628,7 +1021,7 @@ func (i *batchIter) Prev() bool {
 		return false
 	}
 	if i.iter.Tail() {
-		return i.PrevUserKey()
+		return i.prevUserKey()
 	}
 	if !i.reverse {
 		key := i.iter.Key()
@@ -654,6 +1047,13 @@ func (i *batchIter) Prev() bool {
 }
 
 func (i *batchIter) PrevUserKey() bool {
+	if !i.prevUserKey() {
+		return false
+	}
+	return i.skipBackward()
+}
+
+func (i *batchIter) prevUserKey() bool {
 	if i.iter.Head() {
 		return false
 	}
@@ -5,13 +5,16 @@
 package pebble
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math/rand"
 	"strings"
 	"testing"
 
 	"github.com/petermattis/pebble/datadriven"
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
 )
 
 func TestBatch(t *testing.T) {
@@ -31,20 +34,38 @@ func TestBatch(t *testing.T) {
 		{db.InternalKeyKindDelete, "nosuchkey", ""},
 		{db.InternalKeyKindSet, "binarydata", "\x00"},
 		{db.InternalKeyKindSet, "binarydata", "\xff"},
+		{db.InternalKeyKindMerge, "merge", "mergedata"},
+		{db.InternalKeyKindMerge, "merge", ""},
+		{db.InternalKeyKindMerge, "", ""},
+		{db.InternalKeyKindLogData, "logdata", ""},
+		{db.InternalKeyKindLogData, "", ""},
+		{db.InternalKeyKindSet, "after-logdata", "value"},
 	}
 	var b Batch
+	var count uint32
 	for _, tc := range testCases {
-		if tc.kind == db.InternalKeyKindDelete {
-			b.Delete([]byte(tc.key), nil)
-		} else {
+		switch tc.kind {
+		case db.InternalKeyKindSet:
 			b.Set([]byte(tc.key), []byte(tc.value), nil)
+		case db.InternalKeyKindMerge:
+			b.Merge([]byte(tc.key), []byte(tc.value), nil)
+		case db.InternalKeyKindDelete:
+			b.Delete([]byte(tc.key), nil)
+		case db.InternalKeyKindLogData:
+			b.LogData([]byte(tc.key), nil)
+			continue
 		}
+		count++
+	}
+	// Log data is not included in the count.
+	if c := b.Count(); c != count {
+		t.Fatalf("expected count %d, but found %d", count, c)
 	}
 	iter := b.iter()
 	for _, tc := range testCases {
 		kind, k, v, ok := iter.next()
 		if !ok {
-			t.Fatalf("next returned !ok: test case = %q", tc)
+			t.Fatalf("next returned !ok: test case = %v", tc)
 		}
 		key, value := string(k), string(v)
 		if kind != tc.kind || key != tc.key || value != tc.value {
@@ -104,6 +125,111 @@ func TestBatchIncrement(t *testing.T) {
 	}
 }
 
+func TestBatchAccessors(t *testing.T) {
+	var b Batch
+	if !b.Empty() || b.Count() != 0 || b.Len() != 0 || b.SeqNum() != 0 {
+		t.Fatalf("expected empty batch, but found count=%d len=%d seqnum=%d",
+			b.Count(), b.Len(), b.SeqNum())
+	}
+
+	_ = b.Set([]byte("a"), []byte("1"), nil)
+	_ = b.Delete([]byte("b"), nil)
+	_ = b.DeleteRange([]byte("c"), []byte("d"), nil)
+	if b.Empty() {
+		t.Fatalf("expected non-empty batch")
+	}
+	if n := b.Count(); n != 3 {
+		t.Fatalf("expected count 3, but found %d", n)
+	}
+	if n := b.Len(); n != len(b.Repr()) {
+		t.Fatalf("expected len %d, but found %d", len(b.Repr()), n)
+	}
+
+	b.setSeqNum(100)
+	if s := b.SeqNum(); s != 100 {
+		t.Fatalf("expected seqnum 100, but found %d", s)
+	}
+	if s := binary.LittleEndian.Uint64(b.Repr()[:8]); s != 100 {
+		t.Fatalf("expected repr seqnum 100, but found %d", s)
+	}
+}
+
+func TestBatchSpill(t *testing.T) {
+	d, err := Open("", &db.Options{
+		MemTableSize: 64 << 10,
+		Storage:      storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Set([]byte("b"), []byte("old"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// The merge of "a" is performed by an indexed batch, for comparison with
+	// the merge of "a" in the spilled batch.
+	ib := d.NewIndexedBatch()
+	_ = ib.Set([]byte("a"), []byte("1"), nil)
+	_ = ib.Merge([]byte("a"), []byte("2"), nil)
+	ref, err := ib.Get([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A batch which needs more memtable space than the spill threshold is
+	// written to an sstable and ingested.
+	large := bytes.Repeat([]byte("x"), 64<<10)
+	b := d.NewBatch()
+	_ = b.Set([]byte("a"), []byte("1"), nil)
+	_ = b.Merge([]byte("a"), []byte("2"), nil)
+	_ = b.Delete([]byte("b"), nil)
+	_ = b.Set([]byte("c"), large, nil)
+	_ = b.DeleteRange([]byte("d"), []byte("e"), nil)
+	_ = b.Set([]byte("d1"), []byte("d1"), nil)
+	var committed uint64
+	b.OnCommit(func(seqNum uint64, err error) {
+		committed = seqNum
+	})
+	if err := d.Apply(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if committed == 0 || committed != b.SeqNum() {
+		t.Fatalf("expected committed sequence number %d, but found %d", b.SeqNum(), committed)
+	}
+	// The memtable, which overlaps the batch, is flushed by the ingestion.
+	var tables int
+	for _, l := range d.Metrics().Tables {
+		tables += int(l.Count)
+	}
+	if tables != 2 {
+		t.Fatalf("expected 2 tables, but found %d", tables)
+	}
+
+	for k, v := range map[string]string{"a": string(ref), "c": string(large), "d1": "d1"} {
+		if value, err := d.Get([]byte(k)); err != nil || string(value) != v {
+			t.Fatalf("%s: expected %.10q, but found %.10q (%v)", k, v, value, err)
+		}
+	}
+	if _, err := d.Get([]byte("b")); err != db.ErrNotFound {
+		t.Fatalf("b: expected not found, but found %v", err)
+	}
+
+	// A batch which cannot be spilled, such as the commit of a prepared
+	// transaction, is rejected if it does not fit in an empty memtable.
+	p := d.NewBatch()
+	_ = p.Set([]byte("p"), large, nil)
+	if err := d.Prepare([]byte("xid"), p, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CommitPrepared([]byte("xid"), nil); err != ErrBatchTooLarge {
+		t.Fatalf("expected %v, but found %v", ErrBatchTooLarge, err)
+	}
+	if err := d.Set([]byte("e"), []byte("e"), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestBatchGet(t *testing.T) {
 	testCases := []struct {
 		key      []byte
@@ -135,6 +261,197 @@ func TestBatchGet(t *testing.T) {
 	}
 }
 
+func TestBatchGetMerge(t *testing.T) {
+	testCases := []struct {
+		ops      []string
+		expected string
+	}{
+		{[]string{"merge b"}, "b"},
+		{[]string{"merge b", "merge c"}, "cb"},
+		{[]string{"set a", "merge b", "merge c"}, "cba"},
+		{[]string{"merge a", "set b", "merge c"}, "cb"},
+		{[]string{"merge a", "delete", "merge b", "merge c"}, "cb"},
+		{[]string{"set a", "delete-range", "merge b"}, "b"},
+		{[]string{"merge a", "merge b", "set c"}, "c"},
+	}
+
+	for _, c := range testCases {
+		b := newIndexedBatch(nil, db.DefaultComparer)
+		key := []byte("k")
+		for _, op := range c.ops {
+			fields := strings.Fields(op)
+			switch fields[0] {
+			case "set":
+				_ = b.Set(key, []byte(fields[1]), nil)
+			case "merge":
+				_ = b.Merge(key, []byte(fields[1]), nil)
+			case "delete":
+				_ = b.Delete(key, nil)
+			case "delete-range":
+				_ = b.DeleteRange(key, []byte("l"), nil)
+			}
+		}
+		v, err := b.Get(key)
+		if err != nil {
+			t.Fatalf("%s: %v", c.ops, err)
+		}
+		if string(v) != c.expected {
+			t.Fatalf("%s: expected %q, but found %q", c.ops, c.expected, v)
+		}
+	}
+}
+
+func TestBatchRangeDelete(t *testing.T) {
+	b := newIndexedBatch(nil, db.DefaultComparer)
+	_ = b.Set([]byte("a"), []byte("1"), nil)
+	_ = b.Set([]byte("b"), []byte("2"), nil)
+	_ = b.Set([]byte("c"), []byte("3"), nil)
+	_ = b.DeleteRange([]byte("b"), []byte("d"), nil)
+	_ = b.Set([]byte("c"), []byte("4"), nil)
+	_ = b.Set([]byte("d"), []byte("5"), nil)
+
+	expected := map[string]string{
+		"a": "1",
+		"b": "",
+		"c": "4",
+		"d": "5",
+	}
+	for key, value := range expected {
+		v, err := b.Get([]byte(key))
+		if value == "" {
+			if err != db.ErrNotFound {
+				t.Fatalf("%s: expected not found, but found %q, %v", key, v, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if string(v) != value {
+			t.Fatalf("%s: expected %q, but found %q", key, value, v)
+		}
+	}
+
+	iter := b.newInternalIter(nil)
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, fmt.Sprintf("%s:%s", iter.Key().UserKey, iter.Value()))
+	}
+	if got, want := strings.Join(keys, " "), "a:1 c:4 d:5"; got != want {
+		t.Fatalf("expected %q, but found %q", want, got)
+	}
+
+	keys = keys[:0]
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		keys = append(keys, fmt.Sprintf("%s:%s", iter.Key().UserKey, iter.Value()))
+	}
+	if got, want := strings.Join(keys, " "), "d:5 c:4 a:1"; got != want {
+		t.Fatalf("expected %q, but found %q", want, got)
+	}
+
+	iter.SeekGE([]byte("b"))
+	if !iter.Valid() || string(iter.Key().UserKey) != "c" {
+		t.Fatalf("expected c, but found %s", iter.Key())
+	}
+	iter.SeekLT([]byte("c"))
+	if !iter.Valid() || string(iter.Key().UserKey) != "a" {
+		t.Fatalf("expected a, but found %s", iter.Key())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Applying the batch to another indexed batch should index the range
+	// deletion.
+	b2 := newIndexedBatch(nil, db.DefaultComparer)
+	if err := b2.Apply(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b2.Get([]byte("b")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %q, %v", v, err)
+	}
+	if v, err := b2.Get([]byte("c")); err != nil || string(v) != "4" {
+		t.Fatalf("expected 4, but found %q, %v", v, err)
+	}
+}
+
+func TestBatchRangeDeleted(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randKey := func() []byte {
+		return []byte{byte('a' + rng.Intn(20))}
+	}
+
+	for n := 0; n < 100; n++ {
+		b := newIndexedBatch(nil, db.DefaultComparer)
+		type entry struct {
+			start, end []byte
+			offset     uint64
+		}
+		var tombstones, points []entry
+		for i := 0; i < 30; i++ {
+			offset := uint64(len(b.data))
+			if len(b.data) == 0 {
+				offset = batchHeaderLen
+			}
+			if rng.Intn(3) == 0 {
+				start, end := randKey(), randKey()
+				_ = b.DeleteRange(start, end, nil)
+				tombstones = append(tombstones, entry{start, end, offset})
+			} else {
+				key := randKey()
+				_ = b.Set(key, nil, nil)
+				points = append(points, entry{start: key, offset: offset})
+			}
+
+			// Each point entry is covered if there is a newer tombstone which
+			// contains its key.
+			for _, p := range points {
+				expected := false
+				for _, t := range tombstones {
+					if t.offset > p.offset && string(t.start) <= string(p.start) &&
+						string(p.start) < string(t.end) {
+						expected = true
+					}
+				}
+				if got := b.rangeDeleted(p.start, p.offset); got != expected {
+					t.Fatalf("%d: %s@%d: expected %t, but found %t",
+						n, p.start, p.offset, expected, got)
+				}
+			}
+		}
+	}
+}
+
+func TestBatchIterPrevManyVersions(t *testing.T) {
+	// The number of versions exceeds maxPrevSteps, exercising the seek to the
+	// newest version of a user key during reverse iteration.
+	const versions = 3 * maxPrevSteps
+	b := newIndexedBatch(nil, db.DefaultComparer)
+	for _, key := range []string{"a", "b", "c"} {
+		for j := 0; j < versions; j++ {
+			b.Set([]byte(key), []byte(fmt.Sprint(j)), nil)
+		}
+	}
+
+	var expected []string
+	for _, key := range []string{"c", "b", "a"} {
+		for j := versions - 1; j >= 0; j-- {
+			expected = append(expected, fmt.Sprintf("%s:%d", key, j))
+		}
+	}
+	iter := b.newInternalIter(nil)
+	var found []string
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		found = append(found, fmt.Sprintf("%s:%s", iter.Key().UserKey, iter.Value()))
+	}
+	if fmt.Sprint(expected) != fmt.Sprint(found) {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, found)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestBatchIter(t *testing.T) {
 	var b *Batch
 	datadriven.RunTest(t, "testdata/internal_iter_next", func(d *datadriven.TestData) string {
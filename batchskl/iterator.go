@@ -20,11 +20,11 @@ package batchskl
 import "github.com/petermattis/pebble/db"
 
 type splice struct {
-	prev uint32
-	next uint32
+	prev uint64
+	next uint64
 }
 
-func (s *splice) init(prev, next uint32) {
+func (s *splice) init(prev, next uint64) {
 	s.prev = prev
 	s.next = next
 }
@@ -34,7 +34,7 @@ func (s *splice) init(prev, next uint32) {
 // by simply value copying the struct.
 type Iterator struct {
 	list *Skiplist
-	nd   uint32
+	nd   uint64
 }
 
 // Close resets the iterator.
@@ -92,7 +92,7 @@ func (it *Iterator) Key() db.InternalKey {
 }
 
 // KeyOffset returns the key offset at the current position.
-func (it *Iterator) KeyOffset() uint32 {
+func (it *Iterator) KeyOffset() uint64 {
 	return it.list.getKey(it.nd)
 }
 
@@ -113,7 +113,7 @@ func (it *Iterator) Valid() bool {
 
 func (it *Iterator) seekForBaseSplice(
 	key []byte, inlineKey uint64,
-) (prev, next uint32, found bool) {
+) (prev, next uint64, found bool) {
 	prev = it.list.head
 	for level := it.list.height - 1; ; level-- {
 		prev, next, found = it.list.findSpliceForLevel(key, inlineKey, level, prev)
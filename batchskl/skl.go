@@ -73,13 +73,13 @@ const (
 var ErrExists = errors.New("record with this key already exists")
 
 type links struct {
-	next uint32
-	prev uint32
+	next uint64
+	prev uint64
 }
 
 type node struct {
 	// The offset of the key in storage. See Storage.Get.
-	key uint32
+	key uint64
 	// A fixed 8-byte inlineKey of the key, used to avoid retrieval of the key
 	// during seek operations. The key retrieval can be expensive purely due to
 	// cache misses while the inlineKey stored here will be in the same cache line
@@ -97,7 +97,7 @@ type node struct {
 // Storage defines the storage interface for retrieval and comparison of keys.
 type Storage interface {
 	// Get returns the key stored at the specified offset.
-	Get(offset uint32) db.InternalKey
+	Get(offset uint64) db.InternalKey
 
 	// InlineKey returns a fixed length prefix of the specified key such that
 	// InlineKey(a) < InlineKey(b) iff a < b and InlineKey(a) > InlineKey(b) iff
@@ -107,7 +107,7 @@ type Storage interface {
 
 	// Compare returns -1, 0, or +1 depending on whether a is 'less than', 'equal
 	// to', or 'greater than' the key stored at b.
-	Compare(a []byte, b uint32) int
+	Compare(a []byte, b uint64) int
 }
 
 // Skiplist is a fast, non-cocnurrent skiplist implementation that supports
@@ -119,8 +119,8 @@ type Storage interface {
 type Skiplist struct {
 	storage Storage
 	nodes   []byte
-	head    uint32
-	tail    uint32
+	head    uint64
+	tail    uint64
 	height  uint32 // Current height: 1 <= height <= maxHeight
 }
 
@@ -189,7 +189,7 @@ func (s *Skiplist) Reset(storage Storage, initBufSize int) {
 
 // Add adds a new key to the skiplist if it does not yet exist. If the record
 // already exists, then Add returns ErrRecordExists.
-func (s *Skiplist) Add(keyOffset uint32) error {
+func (s *Skiplist) Add(keyOffset uint64) error {
 	key := s.storage.Get(keyOffset)
 	inlineKey := s.storage.InlineKey(key.UserKey)
 
@@ -227,13 +227,13 @@ func (s *Skiplist) NewIter() Iterator {
 	return Iterator{list: s}
 }
 
-func (s *Skiplist) newNode(height, key uint32, inlineKey uint64) uint32 {
+func (s *Skiplist) newNode(height uint32, key, inlineKey uint64) uint64 {
 	if height < 1 || height > maxHeight {
 		panic("height cannot be less than one or greater than the max height")
 	}
 
 	unusedSize := (maxHeight - int(height)) * linksSize
-	offset := s.alloc(uint32(maxNodeSize - unusedSize))
+	offset := s.alloc(uint64(maxNodeSize - unusedSize))
 	nd := s.node(offset)
 
 	nd.key = key
@@ -241,11 +241,11 @@ func (s *Skiplist) newNode(height, key uint32, inlineKey uint64) uint32 {
 	return offset
 }
 
-func (s *Skiplist) alloc(size uint32) uint32 {
-	offset := uint32(len(s.nodes))
+func (s *Skiplist) alloc(size uint64) uint64 {
+	offset := uint64(len(s.nodes))
 	newSize := offset + size
-	if cap(s.nodes) < int(newSize) {
-		allocSize := uint32(cap(s.nodes) * 2)
+	if uint64(cap(s.nodes)) < newSize {
+		allocSize := uint64(cap(s.nodes) * 2)
 		if allocSize < newSize {
 			allocSize = newSize
 		}
@@ -258,7 +258,7 @@ func (s *Skiplist) alloc(size uint32) uint32 {
 	return offset
 }
 
-func (s *Skiplist) node(offset uint32) *node {
+func (s *Skiplist) node(offset uint64) *node {
 	return (*node)(unsafe.Pointer(&s.nodes[offset]))
 }
 
@@ -274,7 +274,7 @@ func (s *Skiplist) randomHeight() uint32 {
 func (s *Skiplist) findSplice(
 	key []byte, inlineKey uint64, spl *[maxHeight]splice,
 ) (found bool) {
-	var prev, next uint32
+	var prev, next uint64
 	prev = s.head
 
 	for level := s.height - 1; ; level-- {
@@ -289,8 +289,8 @@ func (s *Skiplist) findSplice(
 }
 
 func (s *Skiplist) findSpliceForLevel(
-	key []byte, inlineKey uint64, level, start uint32,
-) (prev, next uint32, found bool) {
+	key []byte, inlineKey uint64, level uint32, start uint64,
+) (prev, next uint64, found bool) {
 	prev = start
 
 	for {
@@ -326,27 +326,27 @@ func (s *Skiplist) findSpliceForLevel(
 	return
 }
 
-func (s *Skiplist) getKey(nd uint32) uint32 {
+func (s *Skiplist) getKey(nd uint64) uint64 {
 	return s.node(nd).key
 }
 
-func (s *Skiplist) getInlineKey(nd uint32) uint64 {
+func (s *Skiplist) getInlineKey(nd uint64) uint64 {
 	return s.node(nd).inlineKey
 }
 
-func (s *Skiplist) getNext(nd, h uint32) uint32 {
+func (s *Skiplist) getNext(nd uint64, h uint32) uint64 {
 	return s.node(nd).links[h].next
 }
 
-func (s *Skiplist) getPrev(nd, h uint32) uint32 {
+func (s *Skiplist) getPrev(nd uint64, h uint32) uint64 {
 	return s.node(nd).links[h].prev
 }
 
-func (s *Skiplist) setNext(nd, h, next uint32) {
+func (s *Skiplist) setNext(nd uint64, h uint32, next uint64) {
 	s.node(nd).links[h].next = next
 }
 
-func (s *Skiplist) setPrev(nd, h, prev uint32) {
+func (s *Skiplist) setPrev(nd uint64, h uint32, prev uint64) {
 	s.node(nd).links[h].prev = prev
 }
 
@@ -61,13 +61,13 @@ type testStorage struct {
 	keys [][]byte
 }
 
-func (d *testStorage) add(key string) uint32 {
-	offset := uint32(len(d.keys))
+func (d *testStorage) add(key string) uint64 {
+	offset := uint64(len(d.keys))
 	d.keys = append(d.keys, []byte(key))
 	return offset
 }
 
-func (d *testStorage) Get(offset uint32) db.InternalKey {
+func (d *testStorage) Get(offset uint64) db.InternalKey {
 	return db.InternalKey{UserKey: d.keys[offset]}
 }
 
@@ -75,7 +75,7 @@ func (d *testStorage) InlineKey(key []byte) uint64 {
 	return db.DefaultComparer.InlineKey(key)
 }
 
-func (d *testStorage) Compare(a []byte, b uint32) int {
+func (d *testStorage) Compare(a []byte, b uint64) int {
 	return bytes.Compare(a, d.keys[b])
 }
 
@@ -322,7 +322,7 @@ func BenchmarkReadWrite(b *testing.B) {
 				if rng.Float32() < readFrac {
 					_ = it.SeekGE(key)
 				} else {
-					offset := uint32(len(d.keys))
+					offset := uint64(len(d.keys))
 					d.keys = append(d.keys, key)
 					_ = l.Add(offset)
 				}
@@ -342,7 +342,7 @@ func BenchmarkIterNext(b *testing.B) {
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 	for i := 0; i < len(buf); i += 8 {
 		key := randomKey(rng, buf[i:i+8])
-		offset := uint32(len(d.keys))
+		offset := uint64(len(d.keys))
 		d.keys = append(d.keys, key)
 		_ = l.Add(offset)
 	}
@@ -367,7 +367,7 @@ func BenchmarkIterPrev(b *testing.B) {
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 	for i := 0; i < len(buf); i += 8 {
 		key := randomKey(rng, buf[i:i+8])
-		offset := uint32(len(d.keys))
+		offset := uint64(len(d.keys))
 		d.keys = append(d.keys, key)
 		_ = l.Add(offset)
 	}
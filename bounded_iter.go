@@ -0,0 +1,179 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import "github.com/petermattis/pebble/db"
+
+// boundedIter wraps an iterator over a table, hiding the entries outside of
+// the inclusive internal key bounds [lower, upper]. It is used to iterate over
+// a virtual table, which references a portion of its backing table.
+type boundedIter struct {
+	cmp   db.Compare
+	iter  db.InternalIterator
+	lower db.InternalKey
+	upper db.InternalKey
+	valid bool
+}
+
+var _ db.InternalIterator = (*boundedIter)(nil)
+
+func newBoundedIter(
+	cmp db.Compare, iter db.InternalIterator, lower, upper db.InternalKey,
+) *boundedIter {
+	return &boundedIter{
+		cmp:   cmp,
+		iter:  iter,
+		lower: lower,
+		upper: upper,
+	}
+}
+
+func (i *boundedIter) checkLower() bool {
+	i.valid = i.iter.Valid() && db.InternalCompare(i.cmp, i.iter.Key(), i.lower) >= 0
+	return i.valid
+}
+
+func (i *boundedIter) checkUpper() bool {
+	i.valid = i.iter.Valid() && db.InternalCompare(i.cmp, i.iter.Key(), i.upper) <= 0
+	return i.valid
+}
+
+// SeekGE implements InternalIterator.SeekGE, as documented in the pebble/db
+// package.
+func (i *boundedIter) SeekGE(key []byte) {
+	if i.cmp(key, i.lower.UserKey) <= 0 {
+		i.First()
+		return
+	}
+	i.iter.SeekGE(key)
+	i.checkUpper()
+}
+
+// SeekPrefixGE implements InternalIterator.SeekPrefixGE, as documented in the
+// pebble/db package.
+func (i *boundedIter) SeekPrefixGE(prefix, key []byte) {
+	if i.cmp(key, i.lower.UserKey) <= 0 {
+		// Positioned as by First, but seeking using the prefix which allows the
+		// table's filter to be consulted.
+		i.iter.SeekPrefixGE(prefix, i.lower.UserKey)
+		for i.iter.Valid() && db.InternalCompare(i.cmp, i.iter.Key(), i.lower) < 0 {
+			i.iter.Next()
+		}
+		i.checkUpper()
+		return
+	}
+	i.iter.SeekPrefixGE(prefix, key)
+	i.checkUpper()
+}
+
+// SeekLT implements InternalIterator.SeekLT, as documented in the pebble/db
+// package.
+func (i *boundedIter) SeekLT(key []byte) {
+	if i.cmp(key, i.upper.UserKey) > 0 {
+		i.Last()
+		return
+	}
+	i.iter.SeekLT(key)
+	i.checkLower()
+}
+
+// First implements InternalIterator.First, as documented in the pebble/db
+// package.
+func (i *boundedIter) First() {
+	// Entries for lower.UserKey with a larger sequence number than lower sort
+	// before lower and are skipped.
+	i.iter.SeekGE(i.lower.UserKey)
+	for i.iter.Valid() && db.InternalCompare(i.cmp, i.iter.Key(), i.lower) < 0 {
+		i.iter.Next()
+	}
+	i.checkUpper()
+}
+
+// Last implements InternalIterator.Last, as documented in the pebble/db
+// package.
+func (i *boundedIter) Last() {
+	i.iter.SeekGE(i.upper.UserKey)
+	if !i.iter.Valid() || db.InternalCompare(i.cmp, i.iter.Key(), i.upper) > 0 {
+		// None of the entries for upper.UserKey are within the bounds.
+		i.iter.SeekLT(i.upper.UserKey)
+	} else {
+		// Step over the entries for upper.UserKey with a sequence number at least
+		// as large as upper's, which sort before upper.
+		for {
+			if !i.iter.Next() {
+				i.iter.Last()
+				break
+			}
+			if db.InternalCompare(i.cmp, i.iter.Key(), i.upper) > 0 {
+				i.iter.Prev()
+				break
+			}
+		}
+	}
+	i.checkLower()
+}
+
+// Next implements InternalIterator.Next, as documented in the pebble/db
+// package.
+func (i *boundedIter) Next() bool {
+	i.iter.Next()
+	return i.checkUpper()
+}
+
+// NextUserKey implements InternalIterator.NextUserKey, as documented in the
+// pebble/db package.
+func (i *boundedIter) NextUserKey() bool {
+	i.iter.NextUserKey()
+	return i.checkUpper()
+}
+
+// Prev implements InternalIterator.Prev, as documented in the pebble/db
+// package.
+func (i *boundedIter) Prev() bool {
+	i.iter.Prev()
+	return i.checkLower()
+}
+
+// PrevUserKey implements InternalIterator.PrevUserKey, as documented in the
+// pebble/db package.
+func (i *boundedIter) PrevUserKey() bool {
+	i.iter.PrevUserKey()
+	return i.checkLower()
+}
+
+// Key implements InternalIterator.Key, as documented in the pebble/db package.
+func (i *boundedIter) Key() db.InternalKey {
+	if !i.valid {
+		return db.InvalidInternalKey
+	}
+	return i.iter.Key()
+}
+
+// Value implements InternalIterator.Value, as documented in the pebble/db
+// package.
+func (i *boundedIter) Value() []byte {
+	if !i.valid {
+		return nil
+	}
+	return i.iter.Value()
+}
+
+// Valid implements InternalIterator.Valid, as documented in the pebble/db
+// package.
+func (i *boundedIter) Valid() bool {
+	return i.valid
+}
+
+// Error implements InternalIterator.Error, as documented in the pebble/db
+// package.
+func (i *boundedIter) Error() error {
+	return i.iter.Error()
+}
+
+// Close implements InternalIterator.Close, as documented in the pebble/db
+// package.
+func (i *boundedIter) Close() error {
+	return i.iter.Close()
+}
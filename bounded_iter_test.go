@@ -0,0 +1,89 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestBoundedIter(t *testing.T) {
+	mem := storage.NewMem()
+	f, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sstable.NewWriter(f, nil, db.LevelOptions{BlockSize: 1})
+	for _, k := range []string{
+		"a:1", "b:5", "b:3", "b:1", "c:2", "d:4", "d:1", "e:3", "e:2", "e:1", "f:1",
+	} {
+		if err := w.Add(fakeIkey(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := sstable.NewReader(f, 0, nil)
+	defer r.Close()
+
+	iter := newBoundedIter(db.DefaultComparer.Compare, r.NewIter(nil), fakeIkey("b:3"), fakeIkey("e:2"))
+	defer iter.Close()
+
+	key := func() string {
+		if !iter.Valid() {
+			return "."
+		}
+		return fmt.Sprintf("%s:%d", iter.Key().UserKey, iter.Key().SeqNum())
+	}
+	forward := func() string {
+		var buf bytes.Buffer
+		for ; iter.Valid(); iter.Next() {
+			fmt.Fprintf(&buf, "%s ", key())
+		}
+		return buf.String()
+	}
+	reverse := func() string {
+		var buf bytes.Buffer
+		for ; iter.Valid(); iter.Prev() {
+			fmt.Fprintf(&buf, "%s ", key())
+		}
+		return buf.String()
+	}
+
+	testCases := []struct {
+		op       func()
+		iterate  func() string
+		expected string
+	}{
+		{iter.First, forward, "b:3 b:1 c:2 d:4 d:1 e:3 e:2 "},
+		{iter.Last, reverse, "e:2 e:3 d:1 d:4 c:2 b:1 b:3 "},
+		{func() { iter.SeekGE([]byte("a")) }, key, "b:3"},
+		{func() { iter.SeekGE([]byte("b")) }, key, "b:3"},
+		{func() { iter.SeekGE([]byte("d")) }, forward, "d:4 d:1 e:3 e:2 "},
+		{func() { iter.SeekGE([]byte("f")) }, key, "."},
+		{func() { iter.SeekLT([]byte("z")) }, key, "e:2"},
+		{func() { iter.SeekLT([]byte("e")) }, reverse, "d:1 d:4 c:2 b:1 b:3 "},
+		{func() { iter.SeekLT([]byte("b")) }, key, "."},
+	}
+	for i, c := range testCases {
+		c.op()
+		if s := c.iterate(); s != c.expected {
+			t.Errorf("%d: expected %q, but found %q", i, c.expected, s)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
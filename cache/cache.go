@@ -0,0 +1,273 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// Package cache implements the block cache, which caches blocks keyed by the
+// number of the file they belong to and their offset within it. The cache is
+// divided into shards, each of which is guarded by its own mutex and evicts
+// blocks according to a replacement policy: CLOCK-Pro, LRU or 2Q.
+package cache // import "github.com/petermattis/pebble/cache"
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Policy is a cache replacement policy, which determines the blocks a cache
+// shard evicts when it is full.
+type Policy int
+
+const (
+	// ClockPro is the CLOCK-Pro policy, an approximation of LIRS which adapts
+	// to the recency and frequency of the accesses to the blocks, and is
+	// resistant to scans. It is the default policy.
+	ClockPro Policy = iota
+	// LRU evicts the least recently used block.
+	LRU
+	// TwoQ is the 2Q policy. A block is first admitted to a FIFO queue, which
+	// holds a quarter of the cache, and is promoted to the main LRU queue if
+	// it is accessed again after being evicted from the FIFO queue, while its
+	// key is remembered. A block which is only accessed once, such as by a
+	// scan, does not displace the blocks in the main queue.
+	TwoQ
+)
+
+func (p Policy) String() string {
+	switch p {
+	case ClockPro:
+		return "clockpro"
+	case LRU:
+		return "lru"
+	case TwoQ:
+		return "2q"
+	}
+	return "unknown"
+}
+
+// AdmissionPolicy decides whether a block is added to the cache. A block
+// which is not admitted is not cached, and does not displace the cached
+// blocks. An AdmissionPolicy may be used, for example, to keep very large
+// blocks out of the cache. Admit may be called concurrently.
+type AdmissionPolicy interface {
+	Admit(fileNum, offset uint64, size int64) bool
+}
+
+// AdmissionFunc adapts a function to the AdmissionPolicy interface.
+type AdmissionFunc func(fileNum, offset uint64, size int64) bool
+
+// Admit implements AdmissionPolicy.
+func (f AdmissionFunc) Admit(fileNum, offset uint64, size int64) bool {
+	return f(fileNum, offset, size)
+}
+
+// Options holds the optional parameters for a cache.
+type Options struct {
+	// Policy is the replacement policy of the cache shards.
+	//
+	// The default value is ClockPro.
+	Policy Policy
+
+	// Shards is the number of shards the cache is divided into, each of which
+	// holds an equal part of the capacity of the cache. More shards reduce the
+	// contention on the cache when it is accessed concurrently, at the cost
+	// of the shards evicting blocks independently of each other.
+	//
+	// The default value is 1.
+	Shards int
+
+	// Admission, if non-nil, decides whether a block is added to the cache.
+	//
+	// The default value is nil, which admits every block.
+	Admission AdmissionPolicy
+}
+
+// ShardMetrics holds the statistics of a cache shard.
+type ShardMetrics struct {
+	// The total size of the cached blocks.
+	Size int64
+	// The number of lookups which found a cached block.
+	Hits int64
+	// The number of lookups which did not find a cached block.
+	Misses int64
+	// The number of blocks evicted to make room for other blocks.
+	Evictions int64
+}
+
+// Metrics holds the statistics of a cache: the sum of the statistics of its
+// shards, and the statistics of each shard.
+type Metrics struct {
+	ShardMetrics
+	Shards []ShardMetrics
+}
+
+type key struct {
+	fileNum uint64
+	offset  uint64
+}
+
+// policy is the replacement policy of a shard. Its methods are called with the
+// shard's mutex held.
+type policy interface {
+	get(k key) []byte
+	set(k key, value []byte)
+	// size returns the total size of the cached blocks.
+	size() int64
+	// evicted returns the number of blocks evicted.
+	evicted() int64
+	// setMaxSize changes the maximum total size of the cached blocks, evicting
+	// blocks if the cache shrinks.
+	setMaxSize(size int64)
+}
+
+type shard struct {
+	mu     sync.Mutex
+	policy policy
+	hits   int64
+	misses int64
+}
+
+// Cache is a block cache. A nil *Cache is a valid cache which caches
+// nothing.
+type Cache struct {
+	shards    []shard
+	admission AdmissionPolicy
+	// The capacity of the cache, which is updated atomically. See SetCapacity.
+	capacity int64
+}
+
+// New returns a cache of the specified size in bytes, using the default
+// options.
+func New(size int64) *Cache {
+	return NewWithOptions(size, Options{})
+}
+
+// NewWithOptions returns a cache of the specified size in bytes.
+func NewWithOptions(size int64, opts Options) *Cache {
+	n := opts.Shards
+	if n <= 0 {
+		n = 1
+	}
+	c := &Cache{
+		shards:    make([]shard, n),
+		admission: opts.Admission,
+		capacity:  size,
+	}
+	shardSize := size / int64(n)
+	for i := range c.shards {
+		switch opts.Policy {
+		case LRU:
+			c.shards[i].policy = newLRU(shardSize)
+		case TwoQ:
+			c.shards[i].policy = newTwoQ(shardSize)
+		default:
+			c.shards[i].policy = newClockPro(shardSize)
+		}
+	}
+	return c
+}
+
+func (c *Cache) shard(k key) *shard {
+	if len(c.shards) == 1 {
+		return &c.shards[0]
+	}
+	// Mix the file number and offset so that the blocks of a file, whose
+	// offsets share their low bits, are spread across the shards.
+	h := (k.fileNum*0x9e3779b97f4a7c15 ^ k.offset) * 0xbf58476d1ce4e5b9
+	return &c.shards[(h>>32)%uint64(len(c.shards))]
+}
+
+// Get returns the cached block with the specified file number and offset, or
+// nil if the block is not cached.
+func (c *Cache) Get(fileNum, offset uint64) []byte {
+	if c == nil {
+		return nil
+	}
+
+	k := key{fileNum: fileNum, offset: offset}
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := s.policy.get(k)
+	if v == nil {
+		s.misses++
+		return nil
+	}
+	s.hits++
+	return v
+}
+
+// Set caches the block with the specified file number and offset, unless the
+// admission policy of the cache rejects it.
+func (c *Cache) Set(fileNum, offset uint64, value []byte) {
+	if c == nil {
+		return
+	}
+	if c.admission != nil && !c.admission.Admit(fileNum, offset, int64(len(value))) {
+		return
+	}
+
+	k := key{fileNum: fileNum, offset: offset}
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.policy.set(k, value)
+}
+
+// Metrics returns the statistics of the cache. A nil cache has no statistics.
+func (c *Cache) Metrics() Metrics {
+	if c == nil {
+		return Metrics{}
+	}
+
+	m := Metrics{Shards: make([]ShardMetrics, len(c.shards))}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		sm := ShardMetrics{
+			Size:      s.policy.size(),
+			Hits:      s.hits,
+			Misses:    s.misses,
+			Evictions: s.policy.evicted(),
+		}
+		s.mu.Unlock()
+
+		m.Shards[i] = sm
+		m.Size += sm.Size
+		m.Hits += sm.Hits
+		m.Misses += sm.Misses
+		m.Evictions += sm.Evictions
+	}
+	return m
+}
+
+// Capacity returns the size of the cache in bytes. A nil cache has no
+// capacity.
+func (c *Cache) Capacity() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.capacity)
+}
+
+// SetCapacity changes the size of the cache in bytes, evicting blocks if the
+// cache shrinks. It is used to shrink the cache when the memory used by a DB
+// exceeds its budget, and to grow the cache back afterwards. The capacity of
+// each shard is at least one byte.
+func (c *Cache) SetCapacity(size int64) {
+	if c == nil {
+		return
+	}
+	atomic.StoreInt64(&c.capacity, size)
+	shardSize := size / int64(len(c.shards))
+	if shardSize < 1 {
+		shardSize = 1
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		s.policy.setMaxSize(shardSize)
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestPolicies(t *testing.T) {
+	for _, p := range []Policy{ClockPro, LRU, TwoQ} {
+		t.Run(p.String(), func(t *testing.T) {
+			c := NewWithOptions(100, Options{Policy: p})
+			for i := uint64(0); i < 100; i++ {
+				c.Set(i, 0, bytes.Repeat([]byte{byte(i)}, 10))
+				if v := c.Get(i, 0); len(v) != 10 || v[0] != byte(i) {
+					t.Fatalf("%d: expected the block just cached, but found %v", i, v)
+				}
+			}
+			m := c.Metrics()
+			if m.Size <= 0 || m.Size > 100 {
+				t.Fatalf("unexpected cache size: %d", m.Size)
+			}
+			if m.Evictions < 90 {
+				t.Fatalf("expected at least 90 evictions, but found %d", m.Evictions)
+			}
+			if m.Hits != 100 || m.Misses != 0 {
+				t.Fatalf("expected 100 hits and no misses, but found %+v", m.ShardMetrics)
+			}
+			if c.Get(0, 0) != nil {
+				t.Fatalf("expected the first block to be evicted")
+			}
+		})
+	}
+}
+
+func TestLRU(t *testing.T) {
+	c := NewWithOptions(30, Options{Policy: LRU})
+	for i := uint64(0); i < 3; i++ {
+		c.Set(i, 0, make([]byte, 10))
+	}
+	// Accessing the first block makes the second the least recently used.
+	c.Get(0, 0)
+	c.Set(3, 0, make([]byte, 10))
+	for i, expected := range []bool{true, false, true, true} {
+		if cached := c.Get(uint64(i), 0) != nil; cached != expected {
+			t.Errorf("%d: expected cached=%t, but found %t", i, expected, cached)
+		}
+	}
+	if m := c.Metrics(); m.Size != 30 || m.Evictions != 1 {
+		t.Fatalf("unexpected metrics: %+v", m.ShardMetrics)
+	}
+}
+
+func TestTwoQ(t *testing.T) {
+	c := NewWithOptions(100, Options{Policy: TwoQ})
+	hot := func() {
+		for i := uint64(0); i < 5; i++ {
+			if c.Get(i, 0) == nil {
+				c.Set(i, 0, make([]byte, 10))
+			}
+		}
+	}
+	// Cache the hot blocks, push them out of a1in, and cache them again,
+	// which promotes them to the main queue.
+	hot()
+	for i := uint64(100); i < 110; i++ {
+		c.Set(i, 0, make([]byte, 10))
+	}
+	hot()
+
+	// A scan of blocks which are accessed once does not displace the hot
+	// blocks.
+	for i := uint64(1000); i < 2000; i++ {
+		c.Set(i, 0, make([]byte, 10))
+	}
+	for i := uint64(0); i < 5; i++ {
+		if c.Get(i, 0) == nil {
+			t.Fatalf("%d: expected the hot block to be cached", i)
+		}
+	}
+	if m := c.Metrics(); m.Size > 100 {
+		t.Fatalf("unexpected cache size: %d", m.Size)
+	}
+}
+
+func TestShards(t *testing.T) {
+	c := NewWithOptions(1000, Options{Shards: 4})
+	for i := uint64(0); i < 50; i++ {
+		c.Set(1, i*4096, make([]byte, 10))
+	}
+	for i := uint64(0); i < 60; i++ {
+		c.Get(1, i*4096)
+	}
+
+	m := c.Metrics()
+	if len(m.Shards) != 4 {
+		t.Fatalf("expected 4 shards, but found %d", len(m.Shards))
+	}
+	var sum ShardMetrics
+	for i, s := range m.Shards {
+		if s.Size == 0 {
+			t.Errorf("shard %d: expected the blocks to be spread across the shards", i)
+		}
+		sum.Size += s.Size
+		sum.Hits += s.Hits
+		sum.Misses += s.Misses
+		sum.Evictions += s.Evictions
+	}
+	if sum != m.ShardMetrics {
+		t.Fatalf("expected the sum of the shards %+v, but found %+v", sum, m.ShardMetrics)
+	}
+	if m.Size != 500 || m.Hits != 50 || m.Misses != 10 {
+		t.Fatalf("unexpected metrics: %+v", m.ShardMetrics)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	c := NewWithOptions(1000, Options{
+		Admission: AdmissionFunc(func(fileNum, offset uint64, size int64) bool {
+			return size <= 100
+		}),
+	})
+	for _, size := range []int{10, 100, 101, 500} {
+		c.Set(uint64(size), 0, make([]byte, size))
+		if cached, expected := c.Get(uint64(size), 0) != nil, size <= 100; cached != expected {
+			t.Errorf("%d: expected cached=%t, but found %t", size, expected, cached)
+		}
+	}
+	if m := c.Metrics(); m.Size != 110 {
+		t.Fatalf("expected size 110, but found %d", m.Size)
+	}
+}
+
+func TestSetCapacity(t *testing.T) {
+	for _, p := range []Policy{ClockPro, LRU, TwoQ} {
+		t.Run(p.String(), func(t *testing.T) {
+			c := NewWithOptions(1000, Options{Policy: p, Shards: 2})
+			for i := uint64(0); i < 200; i++ {
+				c.Set(i, 0, make([]byte, 10))
+			}
+			if m := c.Metrics(); m.Size <= 500 {
+				t.Fatalf("expected the cache to be mostly full, but found size %d", m.Size)
+			}
+
+			c.SetCapacity(200)
+			if n := c.Capacity(); n != 200 {
+				t.Fatalf("expected capacity 200, but found %d", n)
+			}
+			if m := c.Metrics(); m.Size > 200 {
+				t.Fatalf("expected the cache to shrink to 200 bytes, but found size %d", m.Size)
+			}
+
+			c.SetCapacity(0)
+			for i := uint64(200); i < 210; i++ {
+				c.Set(i, 0, make([]byte, 10))
+			}
+			if m := c.Metrics(); m.Size > 20 {
+				t.Fatalf("expected the cache to be nearly empty, but found size %d", m.Size)
+			}
+
+			c.SetCapacity(1000)
+			for i := uint64(300); i < 500; i++ {
+				c.Set(i, 0, make([]byte, 10))
+			}
+			if m := c.Metrics(); m.Size <= 500 {
+				t.Fatalf("expected the cache to grow back, but found size %d", m.Size)
+			}
+		})
+	}
+}
+
+func TestNilCache(t *testing.T) {
+	var c *Cache
+	c.Set(1, 0, []byte("a"))
+	if v := c.Get(1, 0); v != nil {
+		t.Fatalf("expected nil, but found %q", v)
+	}
+	if m := c.Metrics(); fmt.Sprint(m) != fmt.Sprint(Metrics{}) {
+		t.Fatalf("expected no metrics, but found %+v", m)
+	}
+	c.SetCapacity(100)
+	if n := c.Capacity(); n != 0 {
+		t.Fatalf("expected no capacity, but found %d", n)
+	}
+}
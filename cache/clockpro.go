@@ -1,7 +1,6 @@
 // Copyright 2018. All rights reserved. Use of this source code is governed by
 // an MIT-style license that can be found in the LICENSE file.
 
-// Package cache implements the CLOCK-Pro caching algorithm.
 /*
 
 CLOCK-Pro is a patent-free alternative to the Adaptive Replacement Cache,
@@ -17,11 +16,8 @@ The original paper: http://static.usenix.org/event/usenix05/tech/general/full_pa
 
 It is MIT licensed, like the original.
 */
-package cache
 
-import (
-	"sync"
-)
+package cache
 
 type pageType int8
 
@@ -43,11 +39,6 @@ func (p pageType) String() string {
 	return "unknown"
 }
 
-type key struct {
-	fileNum uint64
-	offset  uint64
-}
-
 type entry struct {
 	key   key
 	val   []byte
@@ -116,10 +107,8 @@ func (e *entry) Unlink(n int) *entry {
 	return e.Link(e.Move(n + 1))
 }
 
-// Cache ...
-type Cache struct {
-	mu sync.Mutex
-
+// clockPro is a cache shard implementing the CLOCK-Pro policy.
+type clockPro struct {
 	maxSize  int64
 	coldSize int64
 	keys     map[key]*entry
@@ -131,47 +120,36 @@ type Cache struct {
 	countHot  int64
 	countCold int64
 	countTest int64
+
+	evictions int64
 }
 
-// New ...
-func New(size int64) *Cache {
-	return &Cache{
+func newClockPro(size int64) *clockPro {
+	return &clockPro{
 		maxSize:  size,
 		coldSize: size,
 		keys:     make(map[key]*entry),
 	}
 }
 
-// Get ...
-func (c *Cache) Get(fileNum, offset uint64) []byte {
-	if c == nil {
-		return nil
-	}
-
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	e := c.keys[key{fileNum: fileNum, offset: offset}]
-	if e == nil {
-		return nil
-	}
-	if e.val == nil {
+func (c *clockPro) get(k key) []byte {
+	e := c.keys[k]
+	if e == nil || e.val == nil {
 		return nil
 	}
 	e.ref = true
 	return e.val
 }
 
-// Set ...
-func (c *Cache) Set(fileNum, offset uint64, value []byte) {
-	if c == nil {
-		return
-	}
+func (c *clockPro) size() int64 {
+	return c.countHot + c.countCold
+}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (c *clockPro) evicted() int64 {
+	return c.evictions
+}
 
-	k := key{fileNum: fileNum, offset: offset}
+func (c *clockPro) set(k key, value []byte) {
 	e := c.keys[k]
 	if e == nil {
 		// no cache entry? add it
@@ -210,7 +188,18 @@ func (c *Cache) Set(fileNum, offset uint64, value []byte) {
 	c.countHot += e.size
 }
 
-func (c *Cache) metaAdd(key key, e *entry) {
+func (c *clockPro) setMaxSize(size int64) {
+	c.maxSize = size
+	if c.coldSize > size {
+		c.coldSize = size
+	}
+	for c.maxSize < c.countTest {
+		c.runHandTest()
+	}
+	c.evict()
+}
+
+func (c *clockPro) metaAdd(key key, e *entry) {
 	c.evict()
 
 	c.keys[key] = e
@@ -228,7 +217,7 @@ func (c *Cache) metaAdd(key key, e *entry) {
 	}
 }
 
-func (c *Cache) metaDel(e *entry) {
+func (c *clockPro) metaDel(e *entry) {
 	delete(c.keys, e.key)
 
 	if e == c.handHot {
@@ -244,13 +233,13 @@ func (c *Cache) metaDel(e *entry) {
 	e.Prev().Unlink(1)
 }
 
-func (c *Cache) evict() {
+func (c *clockPro) evict() {
 	for c.maxSize <= c.countHot+c.countCold {
 		c.runHandCold()
 	}
 }
 
-func (c *Cache) runHandCold() {
+func (c *clockPro) runHandCold() {
 	e := c.handCold
 	if e.ptype == ptCold {
 		if e.ref {
@@ -261,6 +250,7 @@ func (c *Cache) runHandCold() {
 		} else {
 			e.val = nil
 			e.ptype = ptTest
+			c.evictions++
 			c.countCold -= e.size
 			c.countTest += e.size
 			for c.maxSize < c.countTest {
@@ -276,7 +266,7 @@ func (c *Cache) runHandCold() {
 	}
 }
 
-func (c *Cache) runHandHot() {
+func (c *clockPro) runHandHot() {
 	if c.handHot == c.handTest {
 		c.runHandTest()
 	}
@@ -295,7 +285,7 @@ func (c *Cache) runHandHot() {
 	c.handHot = c.handHot.Next()
 }
 
-func (c *Cache) runHandTest() {
+func (c *clockPro) runHandTest() {
 	if c.handTest == c.handCold {
 		c.runHandCold()
 	}
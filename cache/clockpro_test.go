@@ -20,6 +20,7 @@ func TestCache(t *testing.T) {
 
 	cache := New(200)
 	scanner := bufio.NewScanner(f)
+	var hits, misses int64
 
 	for scanner.Scan() {
 		fields := bytes.Fields(scanner.Bytes())
@@ -43,5 +44,19 @@ func TestCache(t *testing.T) {
 		if hit != wantHit {
 			t.Errorf("cache hit mismatch: got %v, want %v\n", hit, wantHit)
 		}
+		if hit {
+			hits++
+		} else {
+			misses++
+		}
+	}
+
+	m := cache.Metrics()
+	if m.Hits != hits || m.Misses != misses {
+		t.Errorf("metrics mismatch: got %d hits and %d misses, want %d and %d\n",
+			m.Hits, m.Misses, hits, misses)
+	}
+	if m.Size <= 0 || m.Size > 200 {
+		t.Errorf("unexpected cache size: %d\n", m.Size)
 	}
 }
@@ -0,0 +1,80 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import "container/list"
+
+type lruEntry struct {
+	key key
+	val []byte
+	// The queue of a 2Q cache holding the entry, and the size of the block of
+	// an entry in the ghost queue, whose data is not retained. Unused by an
+	// LRU cache.
+	queue *list.List
+	size  int64
+}
+
+// lru is a cache shard implementing the LRU policy.
+type lru struct {
+	maxSize   int64
+	curSize   int64
+	evictions int64
+	keys      map[key]*list.Element
+	// The cached blocks, from the most to the least recently used.
+	queue list.List
+}
+
+func newLRU(size int64) *lru {
+	return &lru{
+		maxSize: size,
+		keys:    make(map[key]*list.Element),
+	}
+}
+
+func (c *lru) get(k key) []byte {
+	e := c.keys[k]
+	if e == nil {
+		return nil
+	}
+	c.queue.MoveToFront(e)
+	return e.Value.(*lruEntry).val
+}
+
+func (c *lru) set(k key, value []byte) {
+	if e := c.keys[k]; e != nil {
+		le := e.Value.(*lruEntry)
+		c.curSize += int64(len(value) - len(le.val))
+		le.val = value
+		c.queue.MoveToFront(e)
+	} else {
+		c.keys[k] = c.queue.PushFront(&lruEntry{key: k, val: value})
+		c.curSize += int64(len(value))
+	}
+	c.reclaim()
+}
+
+func (c *lru) setMaxSize(size int64) {
+	c.maxSize = size
+	c.reclaim()
+}
+
+// reclaim evicts the least recently used blocks until the cached blocks fit
+// in the cache.
+func (c *lru) reclaim() {
+	for c.curSize > c.maxSize && c.queue.Len() > 0 {
+		le := c.queue.Remove(c.queue.Back()).(*lruEntry)
+		delete(c.keys, le.key)
+		c.curSize -= int64(len(le.val))
+		c.evictions++
+	}
+}
+
+func (c *lru) size() int64 {
+	return c.curSize
+}
+
+func (c *lru) evicted() int64 {
+	return c.evictions
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package cache
+
+import "container/list"
+
+// twoQ is a cache shard implementing the full version of the 2Q policy, as
+// described in "2Q: A Low Overhead High Performance Buffer Management
+// Replacement Algorithm" by Johnson and Shasha.
+//
+// A block which is not known to the cache is added to the FIFO queue a1in.
+// When a1in holds more than its share of the cache, the blocks at its tail
+// are evicted and their keys remembered in the ghost queue a1out, which holds
+// no data. A block which is added again while its key is in a1out has been
+// accessed at a longer interval than a1in retains blocks, and is added to the
+// main LRU queue am. Hits in a1in do not reorder it, so that a block accessed
+// several times in a short interval is not mistaken for a frequently
+// accessed block.
+type twoQ struct {
+	maxSize   int64
+	inSize    int64
+	mainSize  int64
+	outSize   int64
+	evictions int64
+	// The maximum size of a1in and of the blocks remembered in a1out.
+	maxInSize  int64
+	maxOutSize int64
+
+	keys map[key]*list.Element
+	a1in list.List
+	// The keys and sizes of the blocks recently evicted from a1in.
+	a1out list.List
+	am    list.List
+}
+
+func newTwoQ(size int64) *twoQ {
+	return &twoQ{
+		maxSize:    size,
+		maxInSize:  size / 4,
+		maxOutSize: size / 2,
+		keys:       make(map[key]*list.Element),
+	}
+}
+
+func (c *twoQ) get(k key) []byte {
+	e := c.keys[k]
+	if e == nil {
+		return nil
+	}
+	le := e.Value.(*lruEntry)
+	switch le.queue {
+	case &c.am:
+		c.am.MoveToFront(e)
+	case &c.a1out:
+		return nil
+	}
+	return le.val
+}
+
+func (c *twoQ) set(k key, value []byte) {
+	e := c.keys[k]
+	if e == nil {
+		c.keys[k] = c.a1in.PushFront(&lruEntry{key: k, val: value, queue: &c.a1in})
+		c.inSize += int64(len(value))
+	} else {
+		le := e.Value.(*lruEntry)
+		switch le.queue {
+		case &c.a1in:
+			c.inSize += int64(len(value) - len(le.val))
+			le.val = value
+		case &c.am:
+			c.mainSize += int64(len(value) - len(le.val))
+			le.val = value
+			c.am.MoveToFront(e)
+		case &c.a1out:
+			c.a1out.Remove(e)
+			c.outSize -= le.size
+			le.val = value
+			le.queue = &c.am
+			c.keys[k] = c.am.PushFront(le)
+			c.mainSize += int64(len(value))
+		}
+	}
+	c.reclaim()
+}
+
+func (c *twoQ) setMaxSize(size int64) {
+	c.maxSize = size
+	c.maxInSize = size / 4
+	c.maxOutSize = size / 2
+	for c.outSize > c.maxOutSize {
+		out := c.a1out.Remove(c.a1out.Back()).(*lruEntry)
+		delete(c.keys, out.key)
+		c.outSize -= out.size
+	}
+	c.reclaim()
+}
+
+// reclaim evicts blocks until the cached blocks fit in the cache, preferring
+// to evict from a1in while it holds more than its share of the cache.
+func (c *twoQ) reclaim() {
+	for c.inSize+c.mainSize > c.maxSize {
+		if c.inSize > c.maxInSize || c.am.Len() == 0 {
+			e := c.a1in.Back()
+			if e == nil {
+				break
+			}
+			c.a1in.Remove(e)
+			le := e.Value.(*lruEntry)
+			c.inSize -= int64(len(le.val))
+			c.evictions++
+
+			// Remember the key and the size of the block, but not its data.
+			le.size = int64(len(le.val))
+			le.val = nil
+			le.queue = &c.a1out
+			c.keys[le.key] = c.a1out.PushFront(le)
+			c.outSize += le.size
+			for c.outSize > c.maxOutSize {
+				out := c.a1out.Remove(c.a1out.Back()).(*lruEntry)
+				delete(c.keys, out.key)
+				c.outSize -= out.size
+			}
+		} else {
+			le := c.am.Remove(c.am.Back()).(*lruEntry)
+			delete(c.keys, le.key)
+			c.mainSize -= int64(len(le.val))
+			c.evictions++
+		}
+	}
+}
+
+func (c *twoQ) size() int64 {
+	return c.inSize + c.mainSize
+}
+
+func (c *twoQ) evicted() int64 {
+	return c.evictions
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/petermattis/pebble/record"
+	"github.com/petermattis/pebble/storage"
+)
+
+// Clone creates a writable fork of the DB in the directory dirname, which is
+// created if it does not exist and must not already contain a DB. The fork is
+// opened with Open, after which it evolves independently of the DB.
+//
+// The sstables and OPTIONS file of the DB are immutable, and are shared with
+// the fork using hard links, so dirname must reside on the same filesystem as
+// the DB. Only the live WALs are copied, and a fresh MANIFEST describing the
+// current LSM is written, making Clone fast regardless of the size of the DB.
+// The fork contains every write which was committed before Clone was called.
+// Writes to the DB are blocked while the WALs are copied.
+//
+// The fork is given a new identifier (see DB.ID) if the DB has one. Cloning a
+// DB with keyspaces is not supported.
+func (d *DB) Clone(dirname string) (err error) {
+	if d.parent != nil {
+		return errors.New("pebble: keyspaces cannot be cloned")
+	}
+	fs := d.opts.Storage
+	if err := fs.MkdirAll(dirname, 0755); err != nil {
+		return err
+	}
+	if _, err := fs.Stat(dbFilename(dirname, fileTypeCurrent, 0)); err == nil {
+		return fmt.Errorf("pebble: DB already exists in %q", dirname)
+	}
+
+	// The files created in dirname are removed if the clone fails.
+	var created []string
+	defer func() {
+		if err != nil {
+			for _, filename := range created {
+				fs.Remove(filename)
+			}
+		}
+	}()
+	link := func(fileType fileType, fileNum uint64) error {
+		filename := dbFilename(dirname, fileType, fileNum)
+		if err := fs.Link(dbFilename(d.dirname, fileType, fileNum), filename); err != nil {
+			return err
+		}
+		created = append(created, filename)
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.mu.keyspaces) > 0 {
+		return errors.New("pebble: a DB with keyspaces cannot be cloned")
+	}
+	// The current WAL is being replaced while the memtable is switching.
+	for d.mu.mem.switching {
+		d.mu.mem.cond.Wait()
+	}
+
+	// Holding d.mu prevents the live WALs and sstables from becoming obsolete,
+	// and new records from being written to the current WAL.
+	logs, err := d.copyLiveLogs(dirname)
+	created = append(created, logs...)
+	if err != nil {
+		return err
+	}
+
+	linked := make(map[uint64]bool)
+	for _, files := range d.mu.versions.currentVersion().files {
+		for i := range files {
+			fileNum := files[i].diskFileNum()
+			if linked[fileNum] {
+				continue
+			}
+			linked[fileNum] = true
+			if err := link(fileTypeTable, fileNum); err != nil {
+				return err
+			}
+		}
+	}
+	if d.optionsFileNum != 0 {
+		if err := link(fileTypeOptions, d.optionsFileNum); err != nil {
+			return err
+		}
+	}
+
+	// The linked and copied files must survive a crash before the MANIFEST
+	// which refers to them.
+	if err := syncDir(fs, dirname); err != nil {
+		return err
+	}
+
+	manifestFileNum := d.mu.versions.nextFileNum()
+	ve := d.mu.versions.snapshot()
+	if ve.dbID != "" {
+		if ve.dbID, err = newDBID(); err != nil {
+			return err
+		}
+	}
+	if err := writeManifest(fs, dirname, manifestFileNum, &ve); err != nil {
+		return err
+	}
+	created = append(created, dbFilename(dirname, fileTypeManifest, manifestFileNum))
+	return setCurrentFile(dirname, fs, manifestFileNum)
+}
+
+// writeManifest writes a MANIFEST file containing ve to dirname.
+func writeManifest(fs storage.Storage, dirname string, fileNum uint64, ve *versionEdit) error {
+	filename := dbFilename(dirname, fileTypeManifest, fileNum)
+	f, err := fs.Create(filename)
+	if err != nil {
+		return fmt.Errorf("pebble: could not create %q: %v", filename, err)
+	}
+	recWriter := record.NewWriter(f)
+	w, err := recWriter.Next()
+	if err == nil {
+		err = ve.encode(w)
+	}
+	err = firstError(err, recWriter.Close())
+	if err == nil {
+		err = f.Sync()
+	}
+	err = firstError(err, f.Close())
+	if err != nil {
+		fs.Remove(filename)
+	}
+	return err
+}
+
+// copyLiveLogs copies the live WALs of the DB to dirname, returning the names
+// of the files created. Only the complete records written to the current WAL
+// are copied.
+//
+// d.mu must be held when calling this, and the memtable must not be
+// switching.
+func (d *DB) copyLiveLogs(dirname string) ([]string, error) {
+	fs := d.opts.Storage
+	var created []string
+	copyLog := func(fileNum uint64, n int64) error {
+		filename := dbFilename(dirname, fileTypeLog, fileNum)
+		if err := copyFile(fs, dbFilename(d.dirname, fileTypeLog, fileNum), filename, n); err != nil {
+			return err
+		}
+		created = append(created, filename)
+		return nil
+	}
+	for _, f := range d.mu.log.retired {
+		if f.fileNum < d.mu.versions.logNumber {
+			continue
+		}
+		if err := copyLog(f.fileNum, -1); err != nil {
+			return created, err
+		}
+	}
+	if d.mu.log.LogWriter != nil {
+		size := d.mu.log.Size()
+		if err := d.mu.log.Flush(); err != nil {
+			return created, err
+		}
+		if err := copyLog(d.mu.log.number, size); err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+// copyFile copies the first n bytes of the file oldname to newname, or the
+// entire file if n is negative. newname is synced, and removed if the copy
+// fails.
+func copyFile(fs storage.Storage, oldname, newname string, n int64) (err error) {
+	src, err := fs.Open(oldname)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := fs.Create(newname)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			fs.Remove(newname)
+		}
+	}()
+	var r io.Reader = src
+	if n >= 0 {
+		r = io.LimitReader(src, n)
+	}
+	_, err = io.Copy(dst, r)
+	if err == nil {
+		err = dst.Sync()
+	}
+	return firstError(err, dst.Close())
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestClone(t *testing.T) {
+	mem := storage.NewMem()
+	open := func(dirname string) *DB {
+		d, err := Open(dirname, &db.Options{
+			FormatMajorVersion: db.FormatNewest,
+			Logger:             discardLogger{},
+			Storage:            mem,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	set := func(d *DB, key, value string) {
+		if err := d.Set([]byte(key), []byte(value), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(d *DB, key, value string) {
+		t.Helper()
+		v, err := d.Get([]byte(key))
+		if value == "" {
+			if err != db.ErrNotFound {
+				t.Fatalf("%s: expected not found, but found %q (%v)", key, v, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if string(v) != value {
+			t.Fatalf("%s: expected %q, but found %q", key, value, v)
+		}
+	}
+
+	// The fork contains both the flushed writes and the writes which are only
+	// in the WAL.
+	d := open("db")
+	set(d, "a", "1")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	set(d, "b", "2")
+	if err := d.Clone("fork"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Clone("fork"); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected error cloning into an existing DB, but found %v", err)
+	}
+
+	// The DB and its fork evolve independently.
+	fork := open("fork")
+	expect(fork, "a", "1")
+	expect(fork, "b", "2")
+	if fork.ID() == "" || fork.ID() == d.ID() {
+		t.Fatalf("expected the fork to have a new ID, but found %q", fork.ID())
+	}
+	set(d, "c", "3")
+	set(fork, "a", "10")
+	if err := fork.Delete([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := fork.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expect(d, "a", "1")
+	expect(d, "b", "2")
+	expect(fork, "c", "")
+
+	for _, d := range []*DB{d, fork} {
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d = open("db")
+	expect(d, "a", "1")
+	expect(d, "b", "2")
+	expect(d, "c", "3")
+	fork = open("fork")
+	expect(fork, "a", "10")
+	expect(fork, "b", "")
+	for _, d := range []*DB{d, fork} {
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/petermattis/pebble"
+	"github.com/petermattis/pebble/db"
+	"github.com/spf13/cobra"
+)
+
+var (
+	dbComparer  = db.DefaultComparer.Name
+	dbMerger    = db.DefaultMerger.Name()
+	dbFormat    = "pretty"
+	dbScanStart string
+	dbScanEnd   string
+)
+
+// The comparers and mergers which can be specified by name. A DB can only be
+// opened with the comparer and merger it was created with.
+var (
+	comparers = map[string]*db.Comparer{
+		db.DefaultComparer.Name: db.DefaultComparer,
+	}
+	mergers = map[string]db.MergeOperator{
+		db.DefaultMerger.Name(): db.DefaultMerger,
+	}
+)
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "DB introspection tools",
+}
+
+var dbGetCmd = &cobra.Command{
+	Use:   "get <dir> <key>",
+	Short: "print the value for a key",
+	Long: `
+Print the value for the specified key. The DB is opened read-only and can be
+in use by another process.
+`,
+	Args: cobra.ExactArgs(2),
+	Run:  runDBGet,
+}
+
+var dbScanCmd = &cobra.Command{
+	Use:   "scan <dir>",
+	Short: "print the records in a DB",
+	Long: `
+Print the records in the DB within the range [--start,--end). The DB is opened
+read-only and can be in use by another process.
+`,
+	Args: cobra.ExactArgs(1),
+	Run:  runDBScan,
+}
+
+var dbLSMCmd = &cobra.Command{
+	Use:   "lsm <dir>",
+	Short: "print the LSM structure",
+	Long: `
+Print the sstables in each level of the LSM. The DB is opened read-only and can
+be in use by another process.
+`,
+	Args: cobra.ExactArgs(1),
+	Run:  runDBLSM,
+}
+
+var dbCompactionPlanCmd = &cobra.Command{
+	Use:   "compaction-plan <dir>",
+	Short: "print the next compaction",
+	Long: `
+Print the compaction which the DB would run next, without running it: its
+input tables, output level and the number of bytes it would read. The DB is
+opened read-only and can be in use by another process.
+`,
+	Args: cobra.ExactArgs(1),
+	Run:  runDBCompactionPlan,
+}
+
+// openDB opens the DB in the specified directory in read-only mode.
+func openDB(dir string) *pebble.DB {
+	comparer, ok := comparers[dbComparer]
+	if !ok {
+		log.Fatalf("unknown comparer %q", dbComparer)
+	}
+	merger, ok := mergers[dbMerger]
+	if !ok {
+		log.Fatalf("unknown merger %q", dbMerger)
+	}
+	d, err := pebble.Open(dir, &db.Options{
+		Comparer: comparer,
+		Merger:   merger,
+		ReadOnly: true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return d
+}
+
+// formatData formats a key or value according to --format.
+func formatData(b []byte) string {
+	switch dbFormat {
+	case "raw":
+		return string(b)
+	case "pretty":
+		return formatBytes(b)
+	default:
+		log.Fatalf("unknown format %q", dbFormat)
+		return ""
+	}
+}
+
+func runDBGet(cmd *cobra.Command, args []string) {
+	d := openDB(args[0])
+	defer d.Close()
+
+	value, err := d.Get([]byte(args[1]))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s\n", formatData(value))
+}
+
+func runDBScan(cmd *cobra.Command, args []string) {
+	d := openDB(args[0])
+	defer d.Close()
+
+	cmp := comparers[dbComparer].Compare
+	iter := d.NewIter(nil)
+	if dbScanStart != "" {
+		iter.SeekGE([]byte(dbScanStart))
+	} else {
+		iter.First()
+	}
+	for ; iter.Valid(); iter.Next() {
+		if dbScanEnd != "" && cmp(iter.Key(), []byte(dbScanEnd)) >= 0 {
+			break
+		}
+		fmt.Printf("%s %s\n", formatData(iter.Key()), formatData(iter.Value()))
+	}
+	if err := iter.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runDBLSM(cmd *cobra.Command, args []string) {
+	d := openDB(args[0])
+	defer d.Close()
+
+	tables, err := d.SSTables()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Print(tables)
+}
+
+func runDBCompactionPlan(cmd *cobra.Command, args []string) {
+	d := openDB(args[0])
+	defer d.Close()
+
+	plan, err := d.DebugCompactionPlan()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if plan == nil {
+		fmt.Printf("no compaction needed\n")
+		return
+	}
+	fmt.Print(plan)
+}
@@ -17,6 +17,11 @@ var (
 	wipe        bool
 )
 
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "benchmarks",
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "pebble [command] (flags)",
 	Short: "pebble benchmarking/introspection tool",
@@ -26,11 +31,19 @@ var rootCmd = &cobra.Command{
 func main() {
 	cobra.EnableCommandSorting = false
 	rootCmd.AddCommand(
+		benchCmd,
+		dbCmd,
+		manifestCmd,
+		sstableCmd,
+		walCmd,
+	)
+
+	benchCmd.AddCommand(
 		scanCmd,
 		syncCmd,
+		ycsbCmd,
 	)
-
-	for _, cmd := range []*cobra.Command{scanCmd, syncCmd} {
+	for _, cmd := range []*cobra.Command{scanCmd, syncCmd, ycsbCmd} {
 		cmd.Flags().IntVarP(
 			&concurrency, "concurrency", "c", 1, "number of concurrent workers")
 		cmd.Flags().DurationVarP(
@@ -39,6 +52,39 @@ func main() {
 			&wipe, "wipe", "w", false, "wipe the database before starting")
 	}
 
+	dbCmd.AddCommand(
+		dbGetCmd,
+		dbScanCmd,
+		dbLSMCmd,
+		dbCompactionPlanCmd,
+	)
+	for _, cmd := range []*cobra.Command{dbGetCmd, dbScanCmd, dbLSMCmd, dbCompactionPlanCmd} {
+		cmd.Flags().StringVar(
+			&dbComparer, "comparer", dbComparer, "comparer name")
+		cmd.Flags().StringVar(
+			&dbMerger, "merger", dbMerger, "merger name")
+		cmd.Flags().StringVar(
+			&dbFormat, "format", dbFormat, "key/value format (raw, pretty)")
+	}
+	dbScanCmd.Flags().StringVar(
+		&dbScanStart, "start", "", "start key (inclusive)")
+	dbScanCmd.Flags().StringVar(
+		&dbScanEnd, "end", "", "end key (exclusive)")
+
+	manifestCmd.AddCommand(manifestDumpCmd)
+	walCmd.AddCommand(walDumpCmd)
+	sstableCmd.AddCommand(
+		sstableLayoutCmd,
+		sstableScanCmd,
+		sstablePropertiesCmd,
+	)
+	sstableLayoutCmd.Flags().BoolVarP(
+		&sstableLayoutVerbose, "verbose", "v", false, "print the contents summary of each block")
+	sstableScanCmd.Flags().StringVar(
+		&sstableScanStart, "start", "", "start user key (inclusive)")
+	sstableScanCmd.Flags().StringVar(
+		&sstableScanEnd, "end", "", "end user key (exclusive)")
+
 	scanCmd.Flags().BoolVarP(
 		&scanReverse, "reverse", "r", false, "reverse scan")
 	scanCmd.Flags().IntVar(
@@ -46,6 +92,17 @@ func main() {
 	scanCmd.Flags().IntVar(
 		&scanValueSize, "value", scanValueSize, "size of values to scan")
 
+	ycsbCmd.Flags().StringVar(
+		&ycsbWorkload, "workload", ycsbWorkload, "workload (A-F, or a list of operation weights)")
+	ycsbCmd.Flags().StringVar(
+		&ycsbDistribution, "keys", ycsbDistribution, "key distribution (uniform, zipf)")
+	ycsbCmd.Flags().IntVar(
+		&ycsbInitialKeys, "initial-keys", ycsbInitialKeys, "number of keys to load before running the workload")
+	ycsbCmd.Flags().IntVar(
+		&ycsbScanLength, "scan-length", ycsbScanLength, "number of rows read by each scan")
+	ycsbCmd.Flags().IntVar(
+		&ycsbValueSize, "value", ycsbValueSize, "size of values to write")
+
 	if err := rootCmd.Execute(); err != nil {
 		// Cobra has already printed the error message.
 		os.Exit(1)
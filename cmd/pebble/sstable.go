@@ -0,0 +1,150 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+	"github.com/petermattis/pebble/storage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	sstableLayoutVerbose bool
+	sstableScanStart     string
+	sstableScanEnd       string
+)
+
+var sstableCmd = &cobra.Command{
+	Use:   "sstable",
+	Short: "sstable introspection tools",
+}
+
+var sstableLayoutCmd = &cobra.Command{
+	Use:   "layout <sstables>",
+	Short: "print the block layout of sstables",
+	Long: `
+Print the layout of the specified sstables: the offset and length of every
+data, index, filter, properties and meta-index block, and the footer. With
+--verbose, the number of entries, the number of restart points and the first
+and last keys of every data and index block are printed as well.
+`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runSSTableLayout,
+}
+
+var sstableScanCmd = &cobra.Command{
+	Use:   "scan <sstables>",
+	Short: "print the records in sstables",
+	Long: `
+Print the records in the specified sstables. Each record is printed as
+<user-key>#<seqnum>,<kind> followed by the value. Non-printable keys and values
+are printed in hex.
+`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runSSTableScan,
+}
+
+var sstablePropertiesCmd = &cobra.Command{
+	Use:   "properties <sstables>",
+	Short: "print the properties of sstables",
+	Long: `
+Print the contents of the properties block of the specified sstables.
+`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runSSTableProperties,
+}
+
+// openSSTable opens the named sstable. The reader is configured with the
+// default comparer and a bloom filter policy so that the filter block of
+// tables written with bloom filters is recognized.
+func openSSTable(path string) (*sstable.Reader, error) {
+	f, err := storage.Default.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	opts := &db.Options{
+		Levels: []db.LevelOptions{{
+			FilterPolicy: bloom.FilterPolicy(10),
+		}},
+	}
+	return sstable.NewReader(f, 0, opts), nil
+}
+
+// forEachSSTable opens each sstable in turn, printing its name before
+// invoking fn if there is more than one. Errors are printed to stderr and the
+// command exits with a non-zero status.
+func forEachSSTable(args []string, fn func(r *sstable.Reader) error) {
+	var failed bool
+	for i, path := range args {
+		if len(args) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%s\n", path)
+		}
+		r, err := openSSTable(path)
+		if err == nil {
+			err = fn(r)
+			if cerr := r.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func runSSTableLayout(cmd *cobra.Command, args []string) {
+	forEachSSTable(args, func(r *sstable.Reader) error {
+		l, err := r.Layout()
+		if err != nil {
+			return err
+		}
+		l.Describe(os.Stdout, sstableLayoutVerbose, r)
+		return nil
+	})
+}
+
+func runSSTableScan(cmd *cobra.Command, args []string) {
+	forEachSSTable(args, func(r *sstable.Reader) error {
+		iter := r.NewIter(nil)
+		if sstableScanStart != "" {
+			iter.SeekGE([]byte(sstableScanStart))
+		} else {
+			iter.First()
+		}
+		for ; iter.Valid(); iter.Next() {
+			key := iter.Key()
+			if sstableScanEnd != "" && string(key.UserKey) >= sstableScanEnd {
+				break
+			}
+			fmt.Printf("%s#%d,%s: %s\n",
+				formatBytes(key.UserKey), key.SeqNum(), key.Kind(), formatBytes(iter.Value()))
+		}
+		return iter.Close()
+	})
+}
+
+func runSSTableProperties(cmd *cobra.Command, args []string) {
+	forEachSSTable(args, func(r *sstable.Reader) error {
+		// Layout returns the error, if any, encountered while opening the
+		// table, in which case the properties are not valid.
+		if _, err := r.Layout(); err != nil {
+			return err
+		}
+		fmt.Print(r.Properties.String())
+		return nil
+	})
+}
@@ -4,6 +4,19 @@
 
 package main
 
+import "fmt"
+
 func encodeUint32Ascending(b []byte, v uint32) []byte {
 	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
 }
+
+// formatBytes returns b as a string if it consists entirely of printable
+// ASCII characters, and as hex otherwise.
+func formatBytes(b []byte) string {
+	for _, c := range b {
+		if c < ' ' || c > '~' {
+			return fmt.Sprintf("%x", b)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/petermattis/pebble"
+	"github.com/petermattis/pebble/db"
+	"github.com/spf13/cobra"
+)
+
+var walCmd = &cobra.Command{
+	Use:   "wal",
+	Short: "WAL introspection tools",
+}
+
+var walDumpCmd = &cobra.Command{
+	Use:   "dump <wal-files>",
+	Short: "print WAL contents",
+	Long: `
+Print the contents of the specified WAL files. Each record is decoded as a
+batch and printed with its sequence number, followed by the operations in the
+batch. Corrupted records are reported and skipped, and the number of bytes
+skipped is printed at the end.
+`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runWALDump,
+}
+
+func runWALDump(cmd *cobra.Command, args []string) {
+	dumpFiles(args, pebble.DumpWAL)
+}
+
+var manifestCmd = &cobra.Command{
+	Use:   "manifest",
+	Short: "MANIFEST introspection tools",
+}
+
+var manifestDumpCmd = &cobra.Command{
+	Use:   "dump <manifest-files>",
+	Short: "print MANIFEST contents",
+	Long: `
+Print the contents of the specified MANIFEST files. Each version edit is
+printed, followed by the level structure that results from applying it.
+`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runManifestDump,
+}
+
+func runManifestDump(cmd *cobra.Command, args []string) {
+	dumpFiles(args, pebble.DumpManifest)
+}
+
+// dumpFiles invokes dump on each of the named files, printing the file name
+// first if there is more than one. Errors are printed to stderr and the
+// command exits with a non-zero status.
+func dumpFiles(args []string, dump func(w io.Writer, filename string, opts *db.Options) error) {
+	var failed bool
+	for i, path := range args {
+		if len(args) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%s\n", path)
+		}
+		if err := dump(os.Stdout, path, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/petermattis/pebble"
+	"github.com/petermattis/pebble/db"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ycsbDistribution = "zipf"
+	ycsbInitialKeys  = 10000
+	ycsbScanLength   = 10
+	ycsbValueSize    = 1000
+	ycsbWorkload     = "B"
+)
+
+var ycsbCmd = &cobra.Command{
+	Use:   "ycsb <dir>",
+	Short: "run a YCSB-style benchmark",
+	Long: `
+Run a customizable YCSB-style benchmark. The --workload flag specifies the mix
+of operations, either as one of the standard workloads:
+
+  A: 50% reads, 50% updates
+  B: 95% reads, 5% updates
+  C: 100% reads
+  D: 95% reads, 5% inserts
+  E: 95% scans, 5% inserts
+  F: 100% read-modify-writes
+
+or as a comma-separated list of operation weights, such as
+"read=50,update=25,insert=20,scan=5". The read-modify-write operation is
+specified as "rmw".
+`,
+	Args: cobra.ExactArgs(1),
+	Run:  runYCSB,
+}
+
+const (
+	ycsbRead = iota
+	ycsbUpdate
+	ycsbInsert
+	ycsbScan
+	ycsbReadModifyWrite
+	ycsbNumOps
+)
+
+var ycsbOpNames = [ycsbNumOps]string{
+	ycsbRead:            "read",
+	ycsbUpdate:          "update",
+	ycsbInsert:          "insert",
+	ycsbScan:            "scan",
+	ycsbReadModifyWrite: "rmw",
+}
+
+var ycsbWorkloads = map[string]string{
+	"A": "read=50,update=50",
+	"B": "read=95,update=5",
+	"C": "read=100",
+	"D": "read=95,insert=5",
+	"E": "scan=95,insert=5",
+	"F": "rmw=100",
+}
+
+// ycsbWeights is the relative weight of each operation in a workload.
+type ycsbWeights [ycsbNumOps]int
+
+func parseYCSBWorkload(s string) (ycsbWeights, error) {
+	var w ycsbWeights
+	if spec, ok := ycsbWorkloads[strings.ToUpper(s)]; ok {
+		s = spec
+	}
+	var total int
+	for _, field := range strings.Split(s, ",") {
+		parts := strings.Split(field, "=")
+		if len(parts) != 2 {
+			return w, fmt.Errorf("malformed weight: %q", field)
+		}
+		op := -1
+		for i, name := range ycsbOpNames {
+			if name == strings.TrimSpace(parts[0]) {
+				op = i
+			}
+		}
+		if op < 0 {
+			return w, fmt.Errorf("unknown operation: %q", parts[0])
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || weight < 0 {
+			return w, fmt.Errorf("malformed weight: %q", field)
+		}
+		w[op] = weight
+		total += weight
+	}
+	if total == 0 {
+		return w, fmt.Errorf("workload %q has no operations", s)
+	}
+	return w, nil
+}
+
+// pick returns an operation chosen at random according to the weights.
+func (w *ycsbWeights) pick(rng *rand.Rand, total int) int {
+	n := rng.Intn(total)
+	for op, weight := range w {
+		if n < weight {
+			return op
+		}
+		n -= weight
+	}
+	panic("not reached")
+}
+
+type ycsb struct {
+	weights ycsbWeights
+	total   int
+	reg     *histogramRegistry
+	// The number of keys in the DB. Keys are inserted in sequence, so the keys
+	// [0,keyCount) are present.
+	keyCount uint64
+}
+
+func ycsbKey(buf []byte, i uint64) []byte {
+	buf = append(buf[:0], "user"...)
+	return strconv.AppendUint(buf, i, 10)
+}
+
+func ycsbValue(rng *rand.Rand, buf []byte) []byte {
+	if cap(buf) < ycsbValueSize {
+		buf = make([]byte, ycsbValueSize)
+	}
+	buf = buf[:ycsbValueSize]
+	for i := range buf {
+		buf[i] = byte(rng.Int() & 0xff)
+	}
+	return buf
+}
+
+func runYCSB(cmd *cobra.Command, args []string) {
+	weights, err := parseYCSBWorkload(ycsbWorkload)
+	if err != nil {
+		log.Fatal(err)
+	}
+	y := &ycsb{
+		weights: weights,
+		reg:     newHistogramRegistry(),
+	}
+	for _, weight := range weights {
+		y.total += weight
+	}
+
+	runTest(args[0], test{
+		init: y.init,
+		tick: y.tick,
+		done: y.done,
+	})
+}
+
+func (y *ycsb) init(d *pebble.DB, wg *sync.WaitGroup) {
+	// Load the initial keys.
+	const batchSize = 1000
+	rng := rand.New(rand.NewSource(1449168817))
+	var keyBuf, valueBuf []byte
+	for i := 0; i < ycsbInitialKeys; {
+		b := d.NewBatch()
+		for end := i + batchSize; i < end && i < ycsbInitialKeys; i++ {
+			keyBuf = ycsbKey(keyBuf, uint64(i))
+			valueBuf = ycsbValue(rng, valueBuf)
+			if err := b.Set(keyBuf, valueBuf, nil); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := b.Commit(db.NoSync); err != nil {
+			log.Fatal(err)
+		}
+	}
+	y.keyCount = uint64(ycsbInitialKeys)
+	fmt.Printf("workload %s\nloaded %d keys\n", ycsbWorkload, ycsbInitialKeys)
+
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go y.worker(d, wg, int64(i))
+	}
+}
+
+func (y *ycsb) worker(d *pebble.DB, wg *sync.WaitGroup, seed int64) {
+	defer wg.Done()
+
+	var latency [ycsbNumOps]*namedHistogram
+	for op, name := range ycsbOpNames {
+		latency[op] = y.reg.Register(name)
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	var zipf *rand.Zipf
+	switch ycsbDistribution {
+	case "uniform":
+	case "zipf":
+		zipf = rand.NewZipf(rng, 1.1, 1, uint64(ycsbInitialKeys))
+	default:
+		log.Fatalf("unknown distribution: %q", ycsbDistribution)
+	}
+	// nextKey returns an existing key, chosen according to the distribution.
+	// Under the zipf distribution recently inserted keys are the most popular.
+	nextKey := func(buf []byte) []byte {
+		count := atomic.LoadUint64(&y.keyCount)
+		var i uint64
+		if zipf != nil {
+			i = count - 1 - zipf.Uint64()%count
+		} else {
+			i = uint64(rng.Int63n(int64(count)))
+		}
+		return ycsbKey(buf, i)
+	}
+
+	var keyBuf, valueBuf []byte
+	for {
+		op := y.weights.pick(rng, y.total)
+		start := time.Now()
+		switch op {
+		case ycsbRead:
+			keyBuf = nextKey(keyBuf)
+			if _, err := d.Get(keyBuf); err != nil && err != db.ErrNotFound {
+				log.Fatal(err)
+			}
+
+		case ycsbUpdate:
+			keyBuf = nextKey(keyBuf)
+			valueBuf = ycsbValue(rng, valueBuf)
+			if err := d.Set(keyBuf, valueBuf, db.NoSync); err != nil {
+				log.Fatal(err)
+			}
+
+		case ycsbInsert:
+			keyBuf = ycsbKey(keyBuf, atomic.AddUint64(&y.keyCount, 1)-1)
+			valueBuf = ycsbValue(rng, valueBuf)
+			if err := d.Set(keyBuf, valueBuf, db.NoSync); err != nil {
+				log.Fatal(err)
+			}
+
+		case ycsbScan:
+			keyBuf = nextKey(keyBuf)
+			iter := d.NewIter(nil)
+			iter.SeekGE(keyBuf)
+			for j := 0; iter.Valid() && j < ycsbScanLength; j++ {
+				iter.Next()
+			}
+			if err := iter.Close(); err != nil {
+				log.Fatal(err)
+			}
+
+		case ycsbReadModifyWrite:
+			keyBuf = nextKey(keyBuf)
+			if _, err := d.Get(keyBuf); err != nil && err != db.ErrNotFound {
+				log.Fatal(err)
+			}
+			valueBuf = ycsbValue(rng, valueBuf)
+			if err := d.Set(keyBuf, valueBuf, db.NoSync); err != nil {
+				log.Fatal(err)
+			}
+		}
+		latency[op].Record(time.Since(start))
+	}
+}
+
+func (y *ycsb) tick(elapsed time.Duration, i int) {
+	if i%20 == 0 {
+		fmt.Println("_elapsed___op______ops/sec__p50(ms)__p95(ms)__p99(ms)_pMax(ms)")
+	}
+	y.reg.Tick(func(tick histogramTick) {
+		h := tick.Hist
+		if h.TotalCount() == 0 {
+			return
+		}
+		fmt.Printf("%8s %-6s %10.1f %8.1f %8.1f %8.1f %8.1f\n",
+			time.Duration(elapsed.Seconds()+0.5)*time.Second,
+			tick.Name,
+			float64(h.TotalCount())/tick.Elapsed.Seconds(),
+			time.Duration(h.ValueAtQuantile(50)).Seconds()*1000,
+			time.Duration(h.ValueAtQuantile(95)).Seconds()*1000,
+			time.Duration(h.ValueAtQuantile(99)).Seconds()*1000,
+			time.Duration(h.ValueAtQuantile(100)).Seconds()*1000,
+		)
+	})
+}
+
+func (y *ycsb) done(elapsed time.Duration) {
+	fmt.Println("\n_elapsed___op______ops(total)___ops/sec(cum)__avg(ms)__p50(ms)__p95(ms)__p99(ms)_pMax(ms)")
+	y.reg.Tick(func(tick histogramTick) {
+		h := tick.Cumulative
+		if h.TotalCount() == 0 {
+			return
+		}
+		fmt.Printf("%7.1fs %-6s %14d %14.1f %8.1f %8.1f %8.1f %8.1f %8.1f\n",
+			elapsed.Seconds(), tick.Name, h.TotalCount(),
+			float64(h.TotalCount())/elapsed.Seconds(),
+			time.Duration(h.Mean()).Seconds()*1000,
+			time.Duration(h.ValueAtQuantile(50)).Seconds()*1000,
+			time.Duration(h.ValueAtQuantile(95)).Seconds()*1000,
+			time.Duration(h.ValueAtQuantile(99)).Seconds()*1000,
+			time.Duration(h.ValueAtQuantile(100)).Seconds()*1000)
+	})
+	fmt.Println()
+}
@@ -9,11 +9,20 @@ import (
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/histogram"
 	"github.com/petermattis/pebble/rate"
 )
 
+// syncConcurrency is the maximum number of batches which may be waiting for
+// a WAL sync, either queued or covered by the in-progress sync. Committers
+// requesting a sync block before entering the pipeline once the limit is
+// reached, bounding the work queued behind a slow sync.
+const syncConcurrency = 512
+
 type commitQueueNode struct {
 	position uint64
 	value    unsafe.Pointer
@@ -131,27 +140,72 @@ type commitEnv struct {
 	write func(b *Batch) (*memTable, error)
 }
 
-// A commitPipeline manages the commit commitPipeline: writing batches to the
-// WAL, optionally syncing the WAL, and applying the batches to the memtable. A
-// commitPipeline groups batches together before writing them to the WAL to
-// optimize the WAL write behavior. After a batch has been written to the WAL,
-// if the batch requested syncing it will wait for the next WAL sync to
-// occur. Next, the commitPipeline applies the written (and synced) batches to
-// the memtable concurrently (using the goroutine that called
-// commitPipeline.commit). Lastly, the commitPipeline publishes that visible
-// sequence number ensuring that the sequence number only ratchets up.
+// A commitPipeline manages the commit pipeline, which is composed of four
+// stages connected by bounded queues:
+//
+//   - WAL append: the batch is assigned a sequence number, added to the
+//     pending queue and written to the WAL. This stage is serialized by
+//     commitEnv.mu, but only copies the batch into the WAL's buffers as the
+//     WAL is flushed to the underlying file asynchronously.
+//   - WAL sync: batches which requested a sync are added to the sync queue and
+//     released by the sync goroutine once a sync which started after they were
+//     written completes. A single sync covers every queued batch. A slot in
+//     the sync queue is reserved before the batch enters the pipeline, so
+//     that a full sync queue never holds up the stages which process batches
+//     in sequence number order.
+//   - Memtable apply: the batch is applied to the memtable concurrently with
+//     other batches (using the goroutine that called commitPipeline.Commit).
+//     Application does not wait for the WAL sync, so batches which did not
+//     request a sync are applied, and become visible, while a sync for earlier
+//     batches is in flight.
+//   - Publish: applied batches are removed from the head of the pending queue
+//     in sequence number order and their sequence numbers published, ensuring
+//     that the visible sequence number only ratchets up.
+//
+// Commit returns once the batch has been published and, if requested, the WAL
+// has been synced.
 type commitPipeline struct {
 	env commitEnv
 	// Condition var to signal upon changes to the pending queue.
 	cond sync.Cond
 	// Queue of pending batches to commit.
 	pending commitQueue
+	// The latencies of the stages of Commit. See CommitMetrics.
+	latency struct {
+		wait      histogram.Histogram
+		walAppend histogram.Histogram
+		apply     histogram.Histogram
+		publish   histogram.Histogram
+	}
+
+	// visible is signalled when a sequence number is published while a
+	// goroutine is waiting in waitForVisible.
+	visible struct {
+		sync.Mutex
+		cond sync.Cond
+		// The number of goroutines waiting in waitForVisible. Updated
+		// atomically, so that publish only takes the mutex when there is a
+		// waiter.
+		waiters int32
+	}
 
 	syncer struct {
 		sync.Mutex
-		cond    sync.Cond
-		closed  bool
+		// Signalled when batches are added to the sync queue, or the pipeline
+		// is closed.
+		ready sync.Cond
+		// Signalled when a sync completes, releasing its reserved slots.
+		space  sync.Cond
+		closed bool
+		// The number of reserved slots: batches which have requested a sync
+		// and have not yet been released by the sync goroutine. At most
+		// syncConcurrency.
+		reserved int
+		// The batches waiting for the next sync. The sync goroutine swaps
+		// pending with spare so that batches can be queued during a sync
+		// without allocating.
 		pending []*Batch
+		spare   []*Batch
 	}
 }
 
@@ -164,7 +218,11 @@ func newCommitPipeline(env commitEnv) *commitPipeline {
 	}
 	p.cond.L = p.env.mu
 	p.pending.init()
-	p.syncer.cond.L = &p.syncer.Mutex
+	p.visible.cond.L = &p.visible.Mutex
+	p.syncer.ready.L = &p.syncer.Mutex
+	p.syncer.space.L = &p.syncer.Mutex
+	p.syncer.pending = make([]*Batch, 0, syncConcurrency)
+	p.syncer.spare = make([]*Batch, 0, syncConcurrency)
 	go p.syncLoop()
 	return p
 }
@@ -181,14 +239,14 @@ func (p *commitPipeline) syncLoop() {
 
 	for {
 		for len(s.pending) == 0 && !s.closed {
-			s.cond.Wait()
+			s.ready.Wait()
 		}
 		if s.closed {
 			return
 		}
 
 		pending := s.pending
-		s.pending = nil
+		s.pending, s.spare = s.spare, nil
 
 		s.Unlock()
 
@@ -197,25 +255,65 @@ func (p *commitPipeline) syncLoop() {
 			panic(err)
 		}
 
-		for _, b := range pending {
+		for i, b := range pending {
+			pending[i] = nil
 			b.commit.Done()
 		}
 
 		s.Lock()
+		s.reserved -= len(pending)
+		s.spare = pending[:0]
+		s.space.Broadcast()
+	}
+}
+
+// reserveSync reserves a slot in the sync queue, blocking while all of the
+// slots are in use. It must be called before the batch is added to the
+// pending queue: a batch which blocked after being added would prevent the
+// batches behind it from being published.
+func (p *commitPipeline) reserveSync() {
+	s := &p.syncer
+	s.Lock()
+	for s.reserved >= syncConcurrency && !s.closed {
+		s.space.Wait()
 	}
+	s.reserved++
+	s.Unlock()
+}
+
+// releaseSync releases a slot reserved by reserveSync for a batch which did
+// not enter the pipeline.
+func (p *commitPipeline) releaseSync() {
+	s := &p.syncer
+	s.Lock()
+	s.reserved--
+	s.space.Signal()
+	s.Unlock()
+}
+
+// queueSync adds a batch which has been written to the WAL to the sync queue,
+// using the slot reserved by reserveSync.
+func (p *commitPipeline) queueSync(b *Batch) {
+	s := &p.syncer
+	s.Lock()
+	s.pending = append(s.pending, b)
+	s.ready.Signal()
+	s.Unlock()
 }
 
 func (p *commitPipeline) Close() {
 	p.syncer.Lock()
 	p.syncer.closed = true
-	p.syncer.cond.Broadcast()
+	p.syncer.ready.Broadcast()
+	p.syncer.space.Broadcast()
 	p.syncer.Unlock()
 }
 
 // Commit the specified batch, writing it to the WAL, optionally syncing the
-// WAL, and applying the batch to the memtable. Upon successful return the
-// batch's mutations will be visible for reading.
-func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
+// WAL, and applying the batch to the memtable. The batch is admitted by the
+// commit rate limiter according to its priority pri. Upon successful return
+// the batch's mutations will be visible for reading.
+func (p *commitPipeline) Commit(b *Batch, syncWAL bool, pri db.WritePriority) error {
 	if len(b.data) == 0 {
 		return nil
 	}
@@ -223,22 +321,27 @@ func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
 	// Prepare the batch for committing: enqueuing the batch in the pending
 	// queue, determining the batch sequence number and writing the data to the
 	// WAL.
-	mem, err := p.prepare(b, true /* writeWAL */, syncWAL)
+	start := time.Now()
+	mem, err := p.prepare(b, true /* writeWAL */, syncWAL, pri, start)
 	if err != nil {
-		// TODO(peter): what to do on error? the pipeline will be horked at this
-		// point.
-		panic(err)
+		return err
 	}
 
-	// Apply the batch to the memtable.
+	// Apply the batch to the memtable. This does not wait for a WAL sync
+	// requested by this or an earlier batch.
+	start = time.Now()
 	if err := p.env.apply(b, mem); err != nil {
 		// TODO(peter): what to do on error? the pipeline will be horked at this
 		// point.
 		panic(err)
 	}
+	p.latency.apply.Since(start)
 
-	// Publish the batch sequence number.
+	// Publish the batch sequence number, and wait for the WAL sync if one was
+	// requested.
+	start = time.Now()
 	p.publish(b)
+	p.latency.publish.Since(start)
 
 	return nil
 }
@@ -293,7 +396,16 @@ func (p *commitPipeline) AllocateSeqNum(prepare func(), apply func(seqNum uint64
 	p.publish(b)
 }
 
-func (p *commitPipeline) prepare(b *Batch, writeWAL, syncWAL bool) (*memTable, error) {
+// prepare enqueues the batch, assigns its sequence number and, if requested,
+// writes it to the WAL. The time spent waiting since start for a sync slot,
+// the commit rate limiter and commitEnv.mu is recorded as the commit wait. An
+// error is returned if the batch is invalid or fails validation, in which
+// case it has not entered the pipeline, or if it could not be written, in
+// which case its sequence number has been published without the batch being
+// applied.
+func (p *commitPipeline) prepare(
+	b *Batch, writeWAL, syncWAL bool, pri db.WritePriority, start time.Time,
+) (*memTable, error) {
 	n := uint64(b.count())
 	if n == invalidBatchCount {
 		return nil, ErrInvalidBatch
@@ -304,14 +416,32 @@ func (p *commitPipeline) prepare(b *Batch, writeWAL, syncWAL bool) (*memTable, e
 	}
 	b.commit.Add(count)
 
-	p.env.controller.WaitN(len(b.data))
+	if syncWAL {
+		p.reserveSync()
+	}
+	p.env.controller.WaitPriorityN(len(b.data), pri)
 
 	p.env.mu.Lock()
 
+	// Validate the batch before it is assigned a sequence number, so that a
+	// batch which fails validation never enters the pipeline.
+	if b.validate != nil {
+		if err := b.validate(); err != nil {
+			p.env.mu.Unlock()
+			if syncWAL {
+				p.releaseSync()
+			}
+			b.commit.Add(-count)
+			return nil, err
+		}
+	}
+
 	// Enqueue the batch in the pending queue. Note that while the pending queue
 	// is lock-free, we want the order of batches to be the same as the sequence
 	// number order.
 	p.pending.enqueue(b, &p.cond)
+	now := time.Now()
+	p.latency.wait.Record(now.Sub(start))
 
 	// Assign the batch a sequence number.
 	b.setSeqNum(atomic.AddUint64(p.env.logSeqNum, n) - n)
@@ -321,21 +451,47 @@ func (p *commitPipeline) prepare(b *Batch, writeWAL, syncWAL bool) (*memTable, e
 	var err error
 	if writeWAL {
 		mem, err = p.env.write(b)
+		p.latency.walAppend.Since(now)
+	}
+	if err != nil {
+		// The batch was not written, such as when writes are stopped by a sticky
+		// background error, but has been assigned a sequence number, which must
+		// be published for the batches behind it to be published. The batch
+		// does not wait for a sync.
+		p.env.mu.Unlock()
+		if syncWAL {
+			p.releaseSync()
+			b.commit.Done()
+		}
+		p.publish(b)
+		return nil, err
 	}
 
 	p.env.mu.Unlock()
 
 	if syncWAL {
-		s := &p.syncer
-		s.Lock()
-		s.pending = append(s.pending, b)
-		s.cond.Signal()
-		s.Unlock()
+		p.queueSync(b)
 	}
 
 	return mem, err
 }
 
+// waitForVisible waits until the visible sequence number is at least seqNum:
+// until every batch assigned a smaller sequence number has been published.
+func (p *commitPipeline) waitForVisible(seqNum uint64) {
+	if atomic.LoadUint64(p.env.visibleSeqNum) >= seqNum {
+		return
+	}
+	v := &p.visible
+	atomic.AddInt32(&v.waiters, 1)
+	v.Lock()
+	for atomic.LoadUint64(p.env.visibleSeqNum) < seqNum {
+		v.cond.Wait()
+	}
+	v.Unlock()
+	atomic.AddInt32(&v.waiters, -1)
+}
+
 func (p *commitPipeline) publish(b *Batch) {
 	// Mark the batch as applied.
 	atomic.StoreUint32(&b.applied, 1)
@@ -350,7 +506,8 @@ func (p *commitPipeline) publish(b *Batch) {
 	for {
 		t := p.pending.dequeue(&p.cond)
 		if t == nil {
-			// Wait for another goroutine to publish us.
+			// Wait for another goroutine to publish us, and for the sync
+			// goroutine to sync the WAL if we requested a sync.
 			b.commit.Wait()
 			break
 		}
@@ -368,6 +525,11 @@ func (p *commitPipeline) publish(b *Batch) {
 			}
 			if atomic.CompareAndSwapUint64(p.env.visibleSeqNum, curSeqNum, newSeqNum) {
 				// We successfully published t's sequence number.
+				if atomic.LoadInt32(&p.visible.waiters) > 0 {
+					p.visible.Lock()
+					p.visible.cond.Broadcast()
+					p.visible.Unlock()
+				}
 				break
 			}
 		}
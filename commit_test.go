@@ -15,6 +15,8 @@ import (
 	"time"
 
 	"github.com/petermattis/pebble/arenaskl"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/histogram"
 	"github.com/petermattis/pebble/record"
 )
 
@@ -71,7 +73,7 @@ func TestCommitPipeline(t *testing.T) {
 			defer wg.Done()
 			var b Batch
 			_ = b.Set([]byte(fmt.Sprint(i)), nil, nil)
-			_ = p.Commit(&b, false)
+			_ = p.Commit(&b, false, db.NormalPriority)
 		}(i)
 	}
 	wg.Wait()
@@ -128,6 +130,204 @@ func TestCommitPipelineAllocateSeqNum(t *testing.T) {
 	}
 }
 
+func TestCommitPipelineConcurrentApply(t *testing.T) {
+	// Verify that batches are applied concurrently and that a batch's sequence
+	// number is not published until every preceding batch has been applied.
+	var e testCommitEnv
+	env := e.env()
+
+	applied := make(map[uint64]bool)
+	var appliedMu sync.Mutex
+
+	env.apply = func(b *Batch, mem *memTable) error {
+		if visible := atomic.LoadUint64(&e.visibleSeqNum); visible > b.seqNum() {
+			t.Errorf("seqnum %d visible before batch %d applied", visible, b.seqNum())
+		}
+		time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+		appliedMu.Lock()
+		applied[b.seqNum()] = true
+		appliedMu.Unlock()
+		return nil
+	}
+	p := newCommitPipeline(env)
+
+	const n = 1000
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			var b Batch
+			_ = b.Set([]byte(fmt.Sprint(i)), nil, nil)
+			_ = p.Commit(&b, false, db.NormalPriority)
+
+			// Upon return from Commit, the batch and all preceding batches must
+			// have been applied.
+			visible := atomic.LoadUint64(&e.visibleSeqNum)
+			if visible < b.seqNum()+1 {
+				t.Errorf("expected seqnum %d to be visible, but found %d", b.seqNum(), visible)
+			}
+			appliedMu.Lock()
+			for s := uint64(0); s <= b.seqNum(); s++ {
+				if !applied[s] {
+					t.Errorf("batch %d visible, but batch %d not applied", b.seqNum(), s)
+					break
+				}
+			}
+			appliedMu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	if s := atomic.LoadUint64(&e.visibleSeqNum); n != s {
+		t.Fatalf("expected %d, but found %d", n, s)
+	}
+}
+
+func TestCommitPipelineSyncInFlight(t *testing.T) {
+	// Verify that batches which did not request a sync are applied and
+	// published while a sync requested by an earlier batch is in flight.
+	var e testCommitEnv
+	env := e.env()
+	syncing := make(chan struct{})
+	release := make(chan struct{})
+	env.sync = func() error {
+		syncing <- struct{}{}
+		<-release
+		return nil
+	}
+	p := newCommitPipeline(env)
+	defer p.Close()
+
+	synced := make(chan struct{})
+	go func() {
+		var b Batch
+		_ = b.Set([]byte("sync"), nil, nil)
+		_ = p.Commit(&b, true, db.NormalPriority)
+		close(synced)
+	}()
+	<-syncing
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		var b Batch
+		_ = b.Set([]byte(fmt.Sprint(i)), nil, nil)
+		if err := p.Commit(&b, false, db.NormalPriority); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := atomic.LoadUint64(&e.visibleSeqNum); s != n+1 {
+		t.Fatalf("expected %d, but found %d", n+1, s)
+	}
+	select {
+	case <-synced:
+		t.Fatalf("synced batch committed before the sync completed")
+	default:
+	}
+
+	close(release)
+	<-synced
+}
+
+func TestCommitPipelineLatency(t *testing.T) {
+	// Verify that the latency of each stage of a commit is attributed to that
+	// stage.
+	var e testCommitEnv
+	env := e.env()
+	env.apply = func(b *Batch, mem *memTable) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	env.sync = func() error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+	p := newCommitPipeline(env)
+	defer p.Close()
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		var b Batch
+		_ = b.Set([]byte(fmt.Sprint(i)), nil, nil)
+		if err := p.Commit(&b, i%2 == 0, db.NormalPriority); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wait := p.latency.wait.Snapshot()
+	walAppend := p.latency.walAppend.Snapshot()
+	apply := p.latency.apply.Snapshot()
+	publish := p.latency.publish.Snapshot()
+	for _, s := range []*histogram.Snapshot{&wait, &walAppend, &apply, &publish} {
+		if s.Count != n {
+			t.Fatalf("expected %d latencies, but found %d", n, s.Count)
+		}
+	}
+	if q := apply.Quantile(0); q < time.Millisecond {
+		t.Fatalf("expected apply latencies of at least 1ms, but found %s", q)
+	}
+	// Only the batches which requested a sync wait for it when published. The
+	// sync overlaps with the application of the batch.
+	if q := publish.Quantile(0.5); q >= 5*time.Millisecond {
+		t.Fatalf("expected a median publish latency below 5ms, but found %s", q)
+	}
+	if q := publish.Quantile(1); q < 5*time.Millisecond {
+		t.Fatalf("expected a maximum publish latency of at least 5ms, but found %s", q)
+	}
+}
+
+func TestCommitPipelineSyncQueueBound(t *testing.T) {
+	// Verify that no more than syncConcurrency batches are queued waiting for
+	// a sync, and that blocked committers proceed once the sync completes.
+	var e testCommitEnv
+	env := e.env()
+	release := make(chan struct{})
+	var syncs uint64
+	env.sync = func() error {
+		if atomic.AddUint64(&syncs, 1) == 1 {
+			<-release
+		}
+		return nil
+	}
+	p := newCommitPipeline(env)
+	defer p.Close()
+
+	const n = syncConcurrency + 10
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			var b Batch
+			_ = b.Set([]byte(fmt.Sprint(i)), nil, nil)
+			_ = p.Commit(&b, true, db.NormalPriority)
+		}(i)
+	}
+
+	// Committers block before writing to the WAL once the sync slots are
+	// exhausted.
+	for atomic.LoadUint64(&e.writeCount) != syncConcurrency {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if s := atomic.LoadUint64(&e.writeCount); s != syncConcurrency {
+		t.Fatalf("expected %d written batches, but found %d", syncConcurrency, s)
+	}
+
+	// Batches which did not request a sync are not held up.
+	var b Batch
+	_ = b.Set([]byte("nosync"), nil, nil)
+	if err := p.Commit(&b, false, db.NormalPriority); err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+	wg.Wait()
+	if s := atomic.LoadUint64(&e.visibleSeqNum); s != n+1 {
+		t.Fatalf("expected %d, but found %d", n+1, s)
+	}
+}
+
 func BenchmarkCommitPipeline(b *testing.B) {
 	for _, parallelism := range []int{1, 2, 4, 8, 16, 32, 64, 128} {
 		b.Run(fmt.Sprintf("parallel=%d", parallelism), func(b *testing.B) {
@@ -181,7 +381,7 @@ func BenchmarkCommitPipeline(b *testing.B) {
 					batch := newBatch(nil)
 					binary.BigEndian.PutUint64(buf, rng.Uint64())
 					batch.Set(buf, buf, nil)
-					if err := p.Commit(batch, true /* sync */); err != nil {
+					if err := p.Commit(batch, true /* sync */, db.NormalPriority); err != nil {
 						b.Fatal(err)
 					}
 					batch.release()
@@ -5,13 +5,26 @@
 package pebble
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"sync/atomic"
+	"time"
 
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/sstable"
 )
 
+const (
+	// minBackgroundErrorBackoff is the delay after the first consecutive
+	// background error. The delay doubles after each subsequent error.
+	minBackgroundErrorBackoff = 10 * time.Millisecond
+	// maxConsecutiveBackgroundErrors is the number of consecutive background
+	// errors after which the DB becomes read-only.
+	maxConsecutiveBackgroundErrors = 5
+)
+
 // expandedCompactionByteSizeLimit is the maximum number of bytes in all
 // compacted files. We avoid expanding the lower level file set of a compaction
 // if it would make the total compaction cover more than this many bytes.
@@ -25,6 +38,13 @@ func maxGrandparentOverlapBytes(opts *db.Options, level int) uint64 {
 	return uint64(10 * opts.Level(level).TargetFileSize)
 }
 
+// maxFlushLevel is the deepest level to which a flushed memtable is written if
+// it does not overlap the tables in the levels above. See Options.FlushToL0. Writing below level 0
+// avoids the relatively expensive level 0 to level 1 compactions, but a flush
+// is not written all the way to the bottom level, as that wastes space if the
+// same keys are repeatedly overwritten.
+const maxFlushLevel = 2
+
 // compaction is a table compaction from one level to the next, starting from a
 // given version.
 type compaction struct {
@@ -36,14 +56,39 @@ type compaction struct {
 
 	// inputs are the tables to be compacted.
 	inputs [3][]fileMetadata
+
+	// duplicates are the tables of level+1 which are also in inputs[0]. The
+	// version lists such a table in both levels. It is read once, as part of
+	// inputs[0], and is deleted from both levels by the compaction.
+	duplicates []fileMetadata
+
+	// levelPtrs are the indexes of the first tables in the levels below the
+	// output level whose largest user key is not less than the user keys
+	// checked by isBaseLevelForUkey so far.
+	levelPtrs [numLevels]int
 }
 
 // pickCompaction picks the best compaction, if any, for vs' current version.
-func pickCompaction(vs *versionSet) (c *compaction) {
+// The tables whose files are suspect, if suspect is non-nil, are rewritten
+// first.
+//
+// An error is returned if the inputs picked are inconsistent with the version,
+// as compacting them would corrupt the LSM.
+func pickCompaction(
+	vs *versionSet, suspect func(fileNum uint64) bool,
+) (c *compaction, err error) {
 	cur := vs.currentVersion()
 
-	// Pick a compaction based on size. If none exist, pick one based on seeks.
-	if cur.compactionScore >= 1 {
+	// Pick a suspect table, so that reads stop failing on its corrupted blocks
+	// as soon as possible. Otherwise pick a compaction based on size. If none
+	// exist, pick a table which is marked for compaction.
+	if level, f := cur.suspectTable(suspect); f != nil {
+		c = &compaction{
+			version: cur,
+			level:   level,
+		}
+		c.inputs[0] = []fileMetadata{*f}
+	} else if cur.compactionScore >= 1 {
 		c = &compaction{
 			version: cur,
 			level:   cur.compactionLevel,
@@ -51,21 +96,31 @@ func pickCompaction(vs *versionSet) (c *compaction) {
 		// TODO(peter): Pick the first file that comes after the compaction pointer
 		// for c.level.
 		c.inputs[0] = []fileMetadata{cur.files[c.level][0]}
+	} else if level, f := cur.markedForCompaction(); f != nil {
+		c = &compaction{
+			version: cur,
+			level:   level,
+		}
+		c.inputs[0] = []fileMetadata{*f}
 	} else {
-		return nil
+		return nil, nil
 	}
 
 	// Files in level 0 may overlap each other, so pick up all overlapping ones.
 	if c.level == 0 {
 		smallest, largest := ikeyRange(vs.cmp, c.inputs[0], nil)
 		c.inputs[0] = cur.overlaps(0, vs.cmp, smallest.UserKey, largest.UserKey)
-		if len(c.inputs) == 0 {
-			panic("pebble: empty compaction")
+		if len(c.inputs[0]) == 0 {
+			return nil, errors.New("pebble: empty compaction")
 		}
 	}
 
 	c.setupOtherInputs(vs)
-	return c
+	c.dedupInputs()
+	if err := c.checkInputs(vs.cmp); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 // TODO(peter): user initiated compactions.
@@ -115,20 +170,94 @@ func (c *compaction) grow(vs *versionSet, sm, la db.InternalKey) bool {
 	return true
 }
 
+// dedupInputs removes the duplicate tables from the inputs of c. A table is
+// identified by its file number: the virtual tables sharing a backing file
+// are distinct tables, and are all compacted.
+func (c *compaction) dedupInputs() {
+	in0 := make(map[uint64]bool)
+	var files0 []fileMetadata
+	for _, f := range c.inputs[0] {
+		if !in0[f.fileNum] {
+			in0[f.fileNum] = true
+			files0 = append(files0, f)
+		}
+	}
+	in1 := make(map[uint64]bool)
+	var files1 []fileMetadata
+	for _, f := range c.inputs[1] {
+		switch {
+		case in1[f.fileNum]:
+		case in0[f.fileNum]:
+			c.duplicates = append(c.duplicates, f)
+		default:
+			files1 = append(files1, f)
+		}
+		in1[f.fileNum] = true
+	}
+	c.inputs[0], c.inputs[1] = files0, files1
+}
+
+// containsFile returns whether files contains the table fileNum.
+func containsFile(files []fileMetadata, fileNum uint64) bool {
+	for i := range files {
+		if files[i].fileNum == fileNum {
+			return true
+		}
+	}
+	return false
+}
+
+// checkInputs checks that the tables left behind in the levels of the
+// compaction do not overlap its inputs. The output of the compaction replaces
+// its inputs, so an overlapping table left behind in the output level would
+// overlap the output, and one left behind in level 0 would be ordered
+// incorrectly with respect to the output.
+func (c *compaction) checkInputs(cmp db.Compare) error {
+	for i := 0; i < 2; i++ {
+		level := c.level + i
+		var smallest, largest db.InternalKey
+		if i == 0 {
+			smallest, largest = ikeyRange(cmp, c.inputs[0], nil)
+		} else {
+			// The output of the compaction spans the inputs of both levels.
+			smallest, largest = ikeyRange(cmp, c.inputs[0], c.inputs[1])
+		}
+		for _, f := range c.version.files[level] {
+			if containsFile(c.inputs[i], f.fileNum) ||
+				(i == 1 && containsFile(c.duplicates, f.fileNum)) {
+				continue
+			}
+			if cmp(f.largest.UserKey, smallest.UserKey) < 0 ||
+				cmp(f.smallest.UserKey, largest.UserKey) > 0 {
+				continue
+			}
+			return fmt.Errorf("pebble: compaction of L%d [%s] + L%d [%s] overlaps "+
+				"table %06d [%s-%s] left behind in L%d",
+				c.level, fileNums(c.inputs[0]), c.level+1, fileNums(c.inputs[1]),
+				f.fileNum, f.smallest.UserKey, f.largest.UserKey, level)
+		}
+	}
+	return nil
+}
+
 // isBaseLevelForUkey reports whether it is guaranteed that there are no
 // key/value pairs at c.level+2 or higher that have the user key ukey.
+//
+// The user keys passed to successive calls must be non-decreasing, as are the
+// keys of a compaction. The tables of each level below the output level are
+// then scanned by a cursor which only moves forward, making the check
+// amortized O(1) per key.
 func (c *compaction) isBaseLevelForUkey(userCmp db.Compare, ukey []byte) bool {
-	// TODO(peter): this can be faster if ukey is always increasing between
-	// successive isBaseLevelForUkey calls and we can keep some state in between
-	// calls.
 	for level := c.level + 2; level < numLevels; level++ {
-		for _, f := range c.version.files[level] {
+		// The files within the levels above level 0 are in increasing key
+		// order, so the tables preceding the cursor end before ukey.
+		files := c.version.files[level]
+		for ; c.levelPtrs[level] < len(files); c.levelPtrs[level]++ {
+			f := &files[c.levelPtrs[level]]
 			if userCmp(ukey, f.largest.UserKey) <= 0 {
 				if userCmp(ukey, f.smallest.UserKey) >= 0 {
 					return false
 				}
-				// For levels above level 0, the files within a level are in
-				// increasing ikey order, so we can break early.
 				break
 			}
 		}
@@ -140,7 +269,7 @@ func (c *compaction) isBaseLevelForUkey(userCmp db.Compare, ukey []byte) bool {
 //
 // d.mu must be held when calling this.
 func (d *DB) maybeScheduleFlush() {
-	if d.mu.compact.flushing || d.mu.closed {
+	if d.mu.compact.flushing || d.mu.closed || d.backgroundError() != nil || d.opts.ReadOnly {
 		return
 	}
 	if len(d.mu.mem.queue) <= 1 {
@@ -157,9 +286,7 @@ func (d *DB) maybeScheduleFlush() {
 func (d *DB) flush() {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if err := d.flush1(); err != nil {
-		// TODO(peter): count consecutive compaction errors and backoff.
-	}
+	d.handleBackgroundError("flush", &d.mu.compact.flushErrors, d.flush1())
 	d.mu.compact.flushing = false
 	// More flush work may have arrived while we were flushing, so schedule
 	// another flush if needed.
@@ -192,30 +319,90 @@ func (d *DB) flush1() error {
 		return nil
 	}
 
-	var iter db.InternalIterator
-	if n == 1 {
-		iter = d.mu.mem.queue[0].NewIter(nil)
-	} else {
-		iters := make([]db.InternalIterator, n)
-		for i := range iters {
-			iters[i] = d.mu.mem.queue[i].NewIter(nil)
+	// The memtables are flushed together by a single version edit, which
+	// records that the WALs older than that of the oldest unflushed memtable
+	// are no longer needed, so that recovery neither replays the flushed
+	// entries nor skips the unflushed ones. The newer memtables are not
+	// necessarily written to the current WAL, as a memtable which is not yet
+	// ready for flushing holds back the flush of the memtables after it. A
+	// keyspace has no WAL of its own, and instead persists the sequence number
+	// of its flushed entries below.
+	start := time.Now()
+	ve := &versionEdit{
+		logNumber: d.mu.log.number,
+	}
+	if logNum := d.mu.mem.queue[n].logNum; d.parent == nil && logNum != 0 {
+		ve.logNumber = logNum
+	}
+
+	// Empty memtables, such as those switched out by an explicit Flush of an
+	// idle DB, do not produce a table, but the log number must still advance
+	// so that their logs can be deleted.
+	empty := true
+	var jobID int
+	for i := 0; i < n; i++ {
+		if !d.mu.mem.queue[i].Empty() {
+			empty = false
+			break
 		}
-		iter = newMergingIter(d.cmp, iters...)
 	}
 
-	meta, err := d.writeLevel0Table(d.opts.Storage, iter)
-	if err != nil {
-		return err
+	if !empty {
+		var inputBytes uint64
+		for i := 0; i < n; i++ {
+			inputBytes += uint64(d.mu.mem.queue[i].ApproximateMemoryUsage())
+		}
+		j := d.newJob(FlushJob, nil, 0, inputBytes)
+		defer d.finishJob(j)
+		jobID = j.info.JobID
+
+		var iter db.InternalIterator
+		if n == 1 {
+			iter = d.mu.mem.queue[0].NewIter(nil)
+		} else {
+			iters := make([]db.InternalIterator, n)
+			for i := range iters {
+				iters[i] = d.mu.mem.queue[i].NewIter(nil)
+			}
+			iter = newMergingIter(d.cmp, iters...)
+		}
+
+		metas, err := d.writeLevel0Table(d.opts.Storage, iter, j)
+		if err != nil {
+			return err
+		}
+
+		// Write each table below level 0 if it does not overlap the tables in the
+		// levels above. The tables of a flush do not overlap each other, so their
+		// levels are chosen independently. The levels may not be chosen while a
+		// compaction is running, as the compaction's output may cover the
+		// table's key range.
+		current := d.mu.versions.currentVersion()
+		for i := range metas {
+			meta := &metas[i]
+			defer delete(d.mu.compact.pendingOutputs, meta.fileNum)
+			level := 0
+			if !d.opts.FlushToL0 && !d.mu.compact.compacting {
+				level = current.pickLevelForOutput(
+					d.opts, d.cmp, 0, maxFlushLevel, meta.smallest.UserKey, meta.largest.UserKey)
+			}
+			ve.newFiles = append(ve.newFiles, newFileEntry{level: level, meta: *meta})
+		}
 	}
 
-	err = d.mu.versions.logAndApply(d.opts, d.dirname, &versionEdit{
-		logNumber: d.mu.log.number,
-		newFiles: []newFileEntry{
-			{level: 0, meta: meta},
-		},
-	})
-	delete(d.mu.compact.pendingOutputs, meta.fileNum)
-	if err != nil {
+	// The entries of a keyspace are recovered from the WAL of its parent. The
+	// sequence number persisted by the flush marks the entries with smaller
+	// sequence numbers as flushed, so that recovery skips them. See
+	// DB.replayKeyspaces.
+	var prevLogSeqNum uint64
+	if d.parent != nil {
+		prevLogSeqNum = atomic.LoadUint64(&d.mu.versions.logSeqNum)
+		atomic.StoreUint64(&d.mu.versions.logSeqNum, d.mu.mem.queue[n].baseSeqNum)
+	}
+	if err := d.mu.versions.logAndApply(d.opts, d.dirname, ve); err != nil {
+		if d.parent != nil {
+			atomic.StoreUint64(&d.mu.versions.logSeqNum, prevLogSeqNum)
+		}
 		return err
 	}
 
@@ -224,6 +411,21 @@ func (d *DB) flush1() error {
 		close(d.mu.mem.queue[i].flushed)
 	}
 	d.mu.mem.queue = d.mu.mem.queue[n:]
+	if !empty {
+		d.mu.metrics.Flush.Count++
+		var outputs bytes.Buffer
+		var size uint64
+		for i := range ve.newFiles {
+			f := &ve.newFiles[i]
+			if i > 0 {
+				outputs.WriteString(",")
+			}
+			fmt.Fprintf(&outputs, "L%d:%06d", f.level, f.meta.fileNum)
+			size += f.meta.size
+		}
+		d.opts.Logger.Infof("[JOB %d] flushed %d memtable(s) to [%s] (%d bytes) in %.1fs",
+			jobID, n, outputs.String(), size, time.Since(start).Seconds())
+	}
 
 	// var newDirty int
 	// for _, mem := range d.mu.mem.queue {
@@ -240,17 +442,18 @@ func (d *DB) flush1() error {
 //
 // d.mu must be held when calling this.
 func (d *DB) maybeScheduleCompaction() {
-	if d.mu.compact.compacting || d.mu.closed {
+	if d.mu.compact.compacting || d.mu.closed || d.backgroundError() != nil || d.opts.ReadOnly {
 		return
 	}
 
 	// TODO(peter): check for manual compactions.
 
 	v := d.mu.versions.currentVersion()
-	// TODO(peter): check v.fileToCompact.
-	if v.compactionScore < 1 {
-		// There is no work to be done.
-		return
+	if _, f := v.markedForCompaction(); v.compactionScore < 1 && f == nil {
+		if _, f := v.suspectTable(d.isSuspect); f == nil {
+			// There is no work to be done.
+			return
+		}
 	}
 
 	d.mu.compact.compacting = true
@@ -261,9 +464,7 @@ func (d *DB) maybeScheduleCompaction() {
 func (d *DB) compact() {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if err := d.compact1(); err != nil {
-		// TODO(peter): count consecutive compaction errors and backoff.
-	}
+	d.handleBackgroundError("compaction", &d.mu.compact.compactionErrors, d.compact1())
 	d.mu.compact.compacting = false
 	// The previous compaction may have produced too many files in a
 	// level, so reschedule another compaction if needed.
@@ -278,31 +479,40 @@ func (d *DB) compact() {
 func (d *DB) compact1() error {
 	// TODO(peter): support manual compactions.
 
-	c := pickCompaction(&d.mu.versions)
-	if c == nil {
-		return nil
+	c, err := pickCompaction(&d.mu.versions, d.isSuspect)
+	if err != nil || c == nil {
+		return err
 	}
+	start := time.Now()
+	j := d.newJob(CompactionJob, []int{c.level, c.level + 1}, c.level+1,
+		totalSize(c.inputs[0])+totalSize(c.inputs[1]))
+	defer d.finishJob(j)
 
 	// Check for a trivial move of one table from one level to the next.
-	// We avoid such a move if there is lots of overlapping grandparent data.
-	// Otherwise, the move could create a parent file that will require
-	// a very expensive merge later on.
-	//
-	if len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 &&
-		totalSize(c.inputs[2]) <= maxGrandparentOverlapBytes(d.opts, c.level+1) {
-
+	if d.isTrivialMove(c) {
+		// The table is moved further down if it does not overlap the tables in
+		// the levels below.
 		meta := &c.inputs[0][0]
-		return d.mu.versions.logAndApply(d.opts, d.dirname, &versionEdit{
+		level := c.version.pickLevelForOutput(d.opts, d.cmp, c.level+1, numLevels-1,
+			meta.smallest.UserKey, meta.largest.UserKey)
+		err := d.mu.versions.logAndApply(d.opts, d.dirname, &versionEdit{
 			deletedFiles: map[deletedFileEntry]bool{
 				deletedFileEntry{level: c.level, fileNum: meta.fileNum}: true,
 			},
 			newFiles: []newFileEntry{
-				{level: c.level + 1, meta: *meta},
+				{level: level, meta: *meta},
 			},
 		})
+		if err != nil {
+			return err
+		}
+		d.mu.metrics.Compact.Count++
+		d.opts.Logger.Infof("[JOB %d] moved L%d [%06d] -> L%d (%d bytes)",
+			j.info.JobID, c.level, meta.fileNum, level, meta.size)
+		return nil
 	}
 
-	ve, pendingOutputs, err := d.compactDiskTables(c)
+	ve, pendingOutputs, err := d.compactDiskTables(c, j)
 	if err != nil {
 		return err
 	}
@@ -313,16 +523,150 @@ func (d *DB) compact1() error {
 	if err != nil {
 		return err
 	}
+	d.mu.metrics.Compact.Count++
+	outputs := make([]fileMetadata, len(ve.newFiles))
+	for i := range ve.newFiles {
+		outputs[i] = ve.newFiles[i].meta
+	}
+	d.opts.Logger.Infof("[JOB %d] compacted L%d [%s] + L%d [%s] -> L%d [%s] (%d bytes) in %.1fs",
+		j.info.JobID, c.level, fileNums(c.inputs[0]), c.level+1, fileNums(c.inputs[1]),
+		c.level+1, fileNums(outputs), totalSize(outputs), time.Since(start).Seconds())
+	d.pruneSuspectTables()
 	d.deleteObsoleteFiles()
 	return nil
 }
 
+// isTrivialMove returns whether the compaction c moves its single input table
+// to the next level rather than rewriting it.
+//
+// A move is avoided if there is lots of overlapping grandparent data, as the
+// moved table would later require a very expensive merge. A table which is
+// marked for compaction is always rewritten, since moving it would not reclaim
+// any space. Neither would moving a suspect table drop its corrupted blocks. A
+// table which the version also lists in the next level is rewritten, so that
+// both of its entries are deleted.
+func (d *DB) isTrivialMove(c *compaction) bool {
+	return len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 && len(c.duplicates) == 0 &&
+		!c.inputs[0][0].markedForCompaction &&
+		!d.isSuspect(c.inputs[0][0].diskFileNum()) &&
+		totalSize(c.inputs[2]) <= maxGrandparentOverlapBytes(d.opts, c.level+1)
+}
+
+// bgError wraps the sticky background error of a DB, as an atomic.Value
+// requires the values it holds to be of the same concrete type.
+type bgError struct {
+	err error
+}
+
+// backgroundError returns the sticky background error, or nil if there is
+// none. It may be called without holding d.mu.
+func (d *DB) backgroundError() error {
+	e, _ := d.bgErr.Load().(bgError)
+	return e.err
+}
+
+// handleBackgroundError records the outcome of a background flush or
+// compaction. A non-nil error is logged, counted in the metrics and reported
+// via EventListener.BackgroundError, after which the caller is delayed using
+// exponential backoff before the operation is retried. The consecutive errors
+// of flushes and compactions are counted separately, in *consecutive, so that
+// a successful compaction does not hide a run of failing flushes, or vice
+// versa. After maxConsecutiveBackgroundErrors consecutive errors the error
+// becomes sticky: background work stops and new writes are refused until
+// ResumeBackgroundWork is called.
+//
+// d.mu must be held when calling this, but the mutex may be dropped and
+// re-acquired during the course of this method.
+func (d *DB) handleBackgroundError(op string, consecutive *int64, err error) {
+	if err == nil {
+		*consecutive = 0
+		d.updateConsecutiveBackgroundErrors()
+		return
+	}
+	*consecutive++
+	d.updateConsecutiveBackgroundErrors()
+	d.mu.metrics.BackgroundErrors++
+	d.mu.metrics.LastBackgroundError = err
+	d.opts.Logger.Errorf("background %s error (%d consecutive): %v", op, *consecutive, err)
+	if fn := d.opts.EventListener.BackgroundError; fn != nil {
+		fn(err)
+	}
+
+	n := *consecutive
+	if n >= maxConsecutiveBackgroundErrors {
+		if d.backgroundError() == nil {
+			bgErr := fmt.Errorf("pebble: read-only after background %s error: %v", op, err)
+			d.bgErr.Store(bgError{bgErr})
+			d.opts.Logger.Errorf("%v", bgErr)
+			// Wake up the writers stalled waiting for a flush or compaction, which
+			// will not happen until ResumeBackgroundWork is called.
+			d.mu.compact.cond.Broadcast()
+		}
+		return
+	}
+
+	// Release the d.mu lock while backing off.
+	// Note the unusual order: Unlock and then Lock.
+	d.mu.Unlock()
+	defer d.mu.Lock()
+	time.Sleep(minBackgroundErrorBackoff << uint(n-1))
+}
+
+// updateConsecutiveBackgroundErrors sets
+// Metrics.ConsecutiveBackgroundErrors to the larger of the consecutive errors
+// of flushes and compactions.
+//
+// d.mu must be held when calling this.
+func (d *DB) updateConsecutiveBackgroundErrors() {
+	n := d.mu.compact.flushErrors
+	if n < d.mu.compact.compactionErrors {
+		n = d.mu.compact.compactionErrors
+	}
+	d.mu.metrics.ConsecutiveBackgroundErrors = n
+}
+
+// ResumeBackgroundWork clears a sticky background error, allowing writes to
+// proceed and background flushes and compactions to be retried. It should be
+// called once the condition that caused the error, such as a full disk, has
+// been resolved. ResumeBackgroundWork is a no-op if there is no background
+// error.
+func (d *DB) ResumeBackgroundWork() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.backgroundError() == nil {
+		return
+	}
+	d.opts.Logger.Infof("resuming background work")
+	d.bgErr.Store(bgError{})
+	d.mu.compact.flushErrors = 0
+	d.mu.compact.compactionErrors = 0
+	d.updateConsecutiveBackgroundErrors()
+	d.maybeScheduleFlush()
+	d.maybeScheduleCompaction()
+	d.mu.compact.cond.Broadcast()
+}
+
+// fileNums returns the file numbers of the specified tables formatted as a
+// comma-separated list.
+func fileNums(files []fileMetadata) string {
+	var buf bytes.Buffer
+	for i := range files {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, "%06d", files[i].fileNum)
+	}
+	return buf.String()
+}
+
 // compactDiskTables runs a compaction that produces new on-disk tables from
 // old on-disk tables.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
-func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs []uint64, retErr error) {
+func (d *DB) compactDiskTables(
+	c *compaction, j *job,
+) (ve *versionEdit, pendingOutputs []uint64, retErr error) {
 	defer func() {
 		if retErr != nil {
 			for _, fileNum := range pendingOutputs {
@@ -332,19 +676,35 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		}
 	}()
 
+	// The entries visible to the open snapshots must be retained. Snapshots
+	// created after this point see the newest entry for every key in the
+	// compaction, which is always retained.
+	snapshots := d.mu.snapshots.toSlice()
+
 	// Release the d.mu lock while doing I/O.
 	// Note the unusual order: Unlock and then Lock.
 	d.mu.Unlock()
 	defer d.mu.Lock()
 
-	iiter, err := compactionIterator(d.cmp, d.newIter, c)
+	iiter, err := compactionIterator(d.cmp, d.newIter, c, &d.readStats.Compaction, d.isSuspect)
 	if err != nil {
 		return nil, pendingOutputs, err
 	}
+	var checker *compactionChecker
+	if d.opts.ParanoidCompactions {
+		if checker, err = d.newCompactionChecker(c, iiter); err != nil {
+			iiter.Close()
+			return nil, pendingOutputs, err
+		}
+		iiter = checker.input
+	}
 	iter := &compactionIter{
-		cmp:   d.cmp,
-		merge: d.merge,
-		iter:  iiter,
+		cmp:           d.cmp,
+		merge:         d.merge,
+		iter:          iiter,
+		snapshots:     snapshots,
+		unknownKind:   d.opts.UnknownKeyKindMode,
+		onUnknownKind: d.opts.EventListener.UnknownKeyKind,
 	}
 
 	// TODO(peter): output to more than one table, if it would otherwise be too large.
@@ -365,16 +725,64 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		}
 	}()
 
+	ve = &versionEdit{
+		deletedFiles: map[deletedFileEntry]bool{},
+	}
 	var smallest, largest db.InternalKey
+	var meta fileMetadata
+	// The size of the finished output tables.
+	var written uint64
+	finishOutput := func() error {
+		if err := tw.Close(); err != nil {
+			tw = nil
+			return err
+		}
+		stat, err := tw.Stat()
+		if err != nil {
+			tw = nil
+			return err
+		}
+		tw = nil
+
+		meta.fileNum = fileNum
+		meta.size = uint64(stat.Size())
+		meta.smallest = smallest
+		meta.largest = largest.Clone()
+		written += meta.size
+		j.setBytesWritten(written)
+		j.setBuffered(0)
+		ve.newFiles = append(ve.newFiles, newFileEntry{
+			level: c.level + 1,
+			meta:  meta,
+		})
+		return nil
+	}
+
+	split := d.opts.SplitCompactionOutput
 	for iter.First(); iter.Valid(); iter.Next() {
 		// TODO(peter): support c.shouldStopBefore.
 
+		// A tombstone can be elided at the base level for its key, unless it is
+		// newer than an open snapshot which may see an older entry for the key.
 		ikey := iter.Key()
 		if ikey.Kind() == db.InternalKeyKindDelete &&
+			iter.stripe(ikey.SeqNum()) == 0 &&
 			c.isBaseLevelForUkey(d.opts.Comparer.Compare, ikey.UserKey) {
+			if checker != nil {
+				checker.elided++
+			}
 			continue
 		}
 
+		// The output is split where requested by the user, but never between the
+		// entries for a single user key.
+		if tw != nil && split != nil && d.cmp(largest.UserKey, ikey.UserKey) != 0 &&
+			split(largest.UserKey, ikey.UserKey) {
+			if err := finishOutput(); err != nil {
+				return nil, pendingOutputs, err
+			}
+		}
+
 		if tw == nil {
 			d.mu.Lock()
 			fileNum = d.mu.versions.nextFileNum()
@@ -387,8 +795,9 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 			if err != nil {
 				return nil, pendingOutputs, err
 			}
-			tw = sstable.NewWriter(file, d.opts, d.opts.Level(c.level+1))
+			tw = d.newTableWriter(file, c.level+1)
 			smallest = ikey.Clone()
+			meta = fileMetadata{smallestSeqNum: db.InternalKeySeqNumMax}
 		}
 
 		// Avoid the memory allocation in InternalKey.Clone() by reusing the buffer
@@ -398,35 +807,36 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		// added. Rather than making our own copy here, we should expose that one.
 		largest.UserKey = append(largest.UserKey[:0], ikey.UserKey...)
 		largest.Trailer = ikey.Trailer
+		meta.updateSeqNum(ikey.SeqNum())
+		if checker != nil {
+			if err := checker.add(ikey); err != nil {
+				return nil, pendingOutputs, err
+			}
+		}
 		if err := tw.Add(ikey, iter.Value()); err != nil {
 			return nil, pendingOutputs, err
 		}
+		j.setBytesWritten(written + tw.EstimatedSize())
+		j.setBuffered(tw.BufferedSize())
 	}
 
-	if err := tw.Close(); err != nil {
-		tw = nil
-		return nil, pendingOutputs, err
+	if tw != nil {
+		if err := finishOutput(); err != nil {
+			return nil, pendingOutputs, err
+		}
 	}
-	stat, err := tw.Stat()
-	if err != nil {
-		tw = nil
-		return nil, pendingOutputs, err
+	if checker != nil {
+		if err := iter.Error(); err != nil {
+			return nil, pendingOutputs, err
+		}
+		if err := checker.finish(&iter.stats); err != nil {
+			return nil, pendingOutputs, err
+		}
 	}
-	tw = nil
-
-	ve = &versionEdit{
-		deletedFiles: map[deletedFileEntry]bool{},
-		newFiles: []newFileEntry{
-			{
-				level: c.level + 1,
-				meta: fileMetadata{
-					fileNum:  fileNum,
-					size:     uint64(stat.Size()),
-					smallest: smallest,
-					largest:  largest,
-				},
-			},
-		},
+	if d.opts.VerifyCompactionOutput {
+		if err := d.verifyCompactionOutput(ve); err != nil {
+			return nil, pendingOutputs, err
+		}
 	}
 	for i := 0; i < 2; i++ {
 		for _, f := range c.inputs[i] {
@@ -436,10 +846,17 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 			}] = true
 		}
 	}
+	for _, f := range c.duplicates {
+		ve.deletedFiles[deletedFileEntry{
+			level:   c.level + 1,
+			fileNum: f.fileNum,
+		}] = true
+	}
 	return ve, pendingOutputs, nil
 }
 
-// deleteObsoleteFiles deletes those files that are no longer needed.
+// deleteObsoleteFiles deletes those files that are no longer needed. The
+// files are deleted asynchronously by d.deleter.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
@@ -448,9 +865,18 @@ func (d *DB) deleteObsoleteFiles() {
 	for fileNum := range d.mu.compact.pendingOutputs {
 		liveFileNums[fileNum] = struct{}{}
 	}
+	for fileNum := range d.mu.protected {
+		liveFileNums[fileNum] = struct{}{}
+	}
 	d.mu.versions.addLiveFileNums(liveFileNums)
 	logNumber := d.mu.versions.logNumber
+	if n := d.minKeyspaceLogNum(); n != 0 && n < logNumber {
+		logNumber = n
+	}
 	manifestFileNumber := d.mu.versions.manifestFileNumber
+	for len(d.mu.log.retired) > 0 && d.mu.log.retired[0].fileNum < logNumber {
+		d.mu.log.retired = d.mu.log.retired[1:]
+	}
 
 	// Release the d.mu lock while doing I/O.
 	// Note the unusual order: Unlock and then Lock.
@@ -463,10 +889,11 @@ func (d *DB) deleteObsoleteFiles() {
 		// Ignore any filesystem errors.
 		return
 	}
+	var obsolete []string
 	for _, filename := range list {
 		fileType, fileNum, ok := parseDBFilename(filename)
 		if !ok {
-			return
+			continue
 		}
 		keep := true
 		switch fileType {
@@ -475,6 +902,8 @@ func (d *DB) deleteObsoleteFiles() {
 			keep = fileNum >= logNumber
 		case fileTypeManifest:
 			keep = fileNum >= manifestFileNumber
+		case fileTypeOptions:
+			keep = fileNum >= d.optionsFileNum
 		case fileTypeTable:
 			_, keep = liveFileNums[fileNum]
 		}
@@ -484,15 +913,44 @@ func (d *DB) deleteObsoleteFiles() {
 		if fileType == fileTypeTable {
 			d.tableCache.evict(fileNum)
 		}
-		// Ignore any file system errors.
-		fs.Remove(filepath.Join(d.dirname, filename))
+		obsolete = append(obsolete, filepath.Join(d.dirname, filename))
 	}
+	d.tableCache.evictVirtual(liveFileNums)
+	d.deleter.enqueue(obsolete...)
 }
 
 // compactionIterator returns an iterator over all the tables in a compaction.
+// The bytes read from the tables of each level are accumulated in stats. The
+// blocks read by the compaction are not added to the block cache, where they
+// would evict the blocks used by foreground reads, though blocks which are
+// already cached are used.
+//
+// The corrupted blocks of the tables whose files are suspect are skipped, so
+// that the readable part of such a table is salvaged. The keys of a skipped
+// block are lost, and the older versions of those keys in the levels below
+// become visible again.
 func compactionIterator(
-	cmp db.Compare, newIter tableNewIter, c *compaction,
+	cmp db.Compare,
+	newIter tableNewIter,
+	c *compaction,
+	stats *[numLevels]sstable.ReadStats,
+	suspect func(fileNum uint64) bool,
 ) (cIter db.InternalIterator, retErr error) {
+	newTableIter := newIter
+	newIter = func(meta *fileMetadata) (db.InternalIterator, error) {
+		iter, err := newTableIter(meta)
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := iter.(*tableCacheIter); ok {
+			t.tableIter.SetFillCache(false)
+			if suspect(meta.diskFileNum()) {
+				t.tableIter.SetSkipCorruptBlocks(true)
+			}
+		}
+		return iter, nil
+	}
+
 	iters := make([]db.InternalIterator, 0, len(c.inputs[0])+1)
 	defer func() {
 		if retErr != nil {
@@ -505,7 +963,8 @@ func compactionIterator(
 	}()
 
 	if c.level != 0 {
-		iter := newLevelIter(cmp, newIter, c.inputs[0])
+		iter := newLevelIter(nil, cmp, newIter, c.inputs[0])
+		iter.readStats = &stats[c.level]
 		iters = append(iters, iter)
 	} else {
 		for i := range c.inputs[0] {
@@ -514,12 +973,14 @@ func compactionIterator(
 			if err != nil {
 				return nil, fmt.Errorf("pebble: could not open table %d: %v", f.fileNum, err)
 			}
+			setReadStats(iter, &stats[0])
 			iter.First()
 			iters = append(iters, iter)
 		}
 	}
 
-	iter := newLevelIter(cmp, newIter, c.inputs[1])
+	iter := newLevelIter(nil, cmp, newIter, c.inputs[1])
+	iter.readStats = &stats[c.level+1]
 	iters = append(iters, iter)
 	return newMergingIter(cmp, iters...), nil
 }
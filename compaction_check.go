@@ -0,0 +1,134 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+)
+
+// countingIter counts the entries visited by First and Next, by kind.
+type countingIter struct {
+	db.InternalIterator
+	counts [int(db.InternalKeyKindInvalid) + 1]uint64
+}
+
+func (i *countingIter) First() {
+	i.InternalIterator.First()
+	if i.Valid() {
+		i.counts[i.Key().Kind()]++
+	}
+}
+
+func (i *countingIter) Next() bool {
+	if !i.InternalIterator.Next() {
+		return false
+	}
+	i.counts[i.Key().Kind()]++
+	return true
+}
+
+// compactionChecker validates the output of a compaction when
+// Options.ParanoidCompactions is set. It checks that the keys written are
+// strictly increasing, and that every entry read from the inputs is accounted
+// for by the compactionIter and the compaction.
+type compactionChecker struct {
+	cmp   db.Compare
+	input *countingIter
+	// expected is the number of entries in the input tables, or -1 if it is
+	// unknown.
+	expected int64
+	// written is the number of entries written to the output tables, and
+	// elided the number of tombstones dropped at the base level for their key.
+	written, elided uint64
+	last            db.InternalKey
+}
+
+// newCompactionChecker returns a checker for the compaction c, which reads
+// its inputs from iter.
+func (d *DB) newCompactionChecker(
+	c *compaction, iter db.InternalIterator,
+) (*compactionChecker, error) {
+	k := &compactionChecker{
+		cmp:   d.cmp,
+		input: &countingIter{InternalIterator: iter},
+	}
+	// The number of entries of the input tables is known from their
+	// properties, unless the compaction reads only part of a table: a virtual
+	// table, or a suspect table whose corrupted blocks are skipped.
+	for i := range c.inputs {
+		for j := range c.inputs[i] {
+			f := &c.inputs[i][j]
+			if f.backingFileNum != 0 || d.isSuspect(f.diskFileNum()) {
+				k.expected = -1
+				return k, nil
+			}
+			err := d.tableCache.withReader(f, func(r *sstable.Reader) error {
+				k.expected += int64(r.Properties.NumEntries)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return k, nil
+}
+
+// add checks that key is greater than the previous key written.
+func (k *compactionChecker) add(key db.InternalKey) error {
+	if k.written > 0 && db.InternalCompare(k.cmp, k.last, key) >= 0 {
+		return fmt.Errorf("pebble: compaction check: key %s written after %s", key, k.last)
+	}
+	k.last.UserKey = append(k.last.UserKey[:0], key.UserKey...)
+	k.last.Trailer = key.Trailer
+	k.written++
+	return nil
+}
+
+// finish checks that every entry read from the inputs was accounted for.
+func (k *compactionChecker) finish(stats *compactionIterStats) error {
+	var read, emitted uint64
+	for kind := range k.input.counts {
+		n := k.input.counts[kind]
+		read += n
+		emitted += stats.emitted[kind]
+		if n != stats.emitted[kind]+stats.shadowed[kind]+stats.merged[kind]+stats.skipped[kind] {
+			return fmt.Errorf("pebble: compaction check: %d %s entries read, "+
+				"but %d emitted, %d shadowed, %d merged and %d skipped",
+				n, db.InternalKeyKind(kind), stats.emitted[kind], stats.shadowed[kind],
+				stats.merged[kind], stats.skipped[kind])
+		}
+	}
+	if emitted != k.written+k.elided {
+		return fmt.Errorf("pebble: compaction check: %d entries emitted, "+
+			"but %d written and %d tombstones elided", emitted, k.written, k.elided)
+	}
+	if k.expected >= 0 && uint64(k.expected) != read {
+		return fmt.Errorf("pebble: compaction check: %d entries read, "+
+			"but the input tables contain %d", read, k.expected)
+	}
+	return nil
+}
+
+// verifyCompactionOutput reads back the tables written by a compaction,
+// verifying the checksum of every block.
+func (d *DB) verifyCompactionOutput(ve *versionEdit) error {
+	for _, nf := range ve.newFiles {
+		fileNum := nf.meta.fileNum
+		f, err := d.opts.Storage.Open(dbFilename(d.dirname, fileTypeTable, fileNum))
+		if err != nil {
+			return err
+		}
+		r := sstable.NewReader(f, fileNum, d.opts)
+		err = r.VerifyChecksums()
+		if err := firstError(err, r.Close()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
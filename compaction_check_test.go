@@ -0,0 +1,132 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestParanoidCompactions(t *testing.T) {
+	d, err := Open("", &db.Options{
+		FlushToL0:              true,
+		L0CompactionThreshold:  2,
+		Logger:                 discardLogger{},
+		ParanoidCompactions:    true,
+		Storage:                storage.NewMem(),
+		VerifyCompactionOutput: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Overwritten, deleted and merged keys, some of which are visible to a
+	// snapshot, exercise every way the entries of the inputs are accounted for.
+	snap := d.NewSnapshot()
+	defer snap.Close()
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("%03d", i))
+			var err error
+			switch (i + round) % 4 {
+			case 0:
+				err = d.Set(key, []byte(fmt.Sprint(round)), nil)
+			case 1:
+				err = d.Delete(key, nil)
+			default:
+				err = d.Merge(key, []byte(fmt.Sprint(round)), nil)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if round == 1 {
+			snap.Close()
+			snap = d.NewSnapshot()
+		}
+	}
+
+	// The last flushed table may be left alone in L0, below the compaction
+	// threshold, if an earlier compaction picked up the table before it.
+	d.mu.Lock()
+	for (len(d.mu.versions.currentVersion().files[0]) >= 2 || d.mu.compact.compacting) &&
+		d.mu.metrics.BackgroundErrors == 0 {
+		d.mu.compact.cond.Wait()
+	}
+	d.mu.Unlock()
+	m := d.Metrics()
+	if m.BackgroundErrors != 0 {
+		t.Fatalf("expected no background errors, but found %v", m.LastBackgroundError)
+	}
+	if m.Compact.Count == 0 {
+		t.Fatalf("expected compactions")
+	}
+}
+
+func TestCompactionChecker(t *testing.T) {
+	key := func(s string) db.InternalKey {
+		return db.ParseInternalKey(s)
+	}
+	newChecker := func() *compactionChecker {
+		return &compactionChecker{
+			cmp:      db.DefaultComparer.Compare,
+			input:    &countingIter{},
+			expected: -1,
+		}
+	}
+
+	k := newChecker()
+	if err := k.add(key("a.SET.2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.add(key("a.SET.1")); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"a.SET.1", "a.SET.3"} {
+		if err := k.add(key(s)); err == nil || !strings.Contains(err.Error(), "written after") {
+			t.Fatalf("%s: expected out of order error, but found %v", s, err)
+		}
+	}
+
+	testCases := []struct {
+		read     uint64
+		written  uint64
+		elided   uint64
+		expected int64
+		err      string
+	}{
+		{read: 4, written: 1, elided: 1, expected: 4},
+		{read: 5, err: "5 SET entries read"},
+		{read: 4, written: 2, elided: 1, err: "2 entries emitted, but 2 written and 1 tombstones elided"},
+		{read: 4, written: 1, elided: 1, expected: 6, err: "the input tables contain 6"},
+	}
+	for _, c := range testCases {
+		k := newChecker()
+		k.input.counts[db.InternalKeyKindSet] = c.read
+		k.written, k.elided, k.expected = c.written, c.elided, c.expected
+		var stats compactionIterStats
+		stats.emitted[db.InternalKeyKindSet] = 2
+		stats.shadowed[db.InternalKeyKindSet] = 1
+		stats.merged[db.InternalKeyKindSet] = 1
+		err := k.finish(&stats)
+		if c.err == "" {
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("expected %q, but found %v", c.err, err)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package pebble
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/petermattis/pebble/db"
 )
@@ -17,40 +18,94 @@ const (
 	compactionIterNext                   = 1
 )
 
+// compactionIter collapses the entries for each user key into the newest
+// entry, merging merge operands as needed. The entries for a user key are
+// only collapsed within a snapshot stripe: the range of sequence numbers
+// between a pair of adjacent open snapshots. The newest entry in each stripe
+// is retained, so that every snapshot continues to see the value it saw
+// before the compaction.
 type compactionIter struct {
-	cmp      db.Compare
-	merge    db.Merge
-	iter     db.InternalIterator
-	err      error
-	key      db.InternalKey
-	keyBuf   []byte
-	value    []byte
-	valueBuf []byte
-	valid    bool
-	pos      compactionIterPos
+	cmp   db.Compare
+	merge db.MergeOperator
+	iter  db.InternalIterator
+	// The sequence numbers of the open snapshots, in increasing order.
+	snapshots []uint64
+	err       error
+	key       db.InternalKey
+	keyBuf    []byte
+	value     []byte
+	valueBuf  []byte
+	valid     bool
+	pos       compactionIterPos
+	// preserved is true if the current entry is of an unknown kind and was
+	// preserved.
+	preserved bool
+	// unknownKind determines how entries of an unknown kind are handled, and
+	// onUnknownKind, if non-nil, is invoked for each entry which is skipped or
+	// preserved.
+	unknownKind   db.UnknownKeyKindMode
+	onUnknownKind func(db.UnknownKeyKindInfo)
+	// stats accounts for the entries read from iter.
+	stats compactionIterStats
+}
+
+// compactionIterStats accounts for the entries read by a compactionIter, by
+// kind. Every entry read is either emitted as the newest entry for its key in
+// its snapshot stripe, shadowed by a newer entry in the stripe, merged into a
+// newer merge operand which is emitted, or skipped because its kind is
+// unknown. The kind of an emitted entry is its
+// kind when read, before merge operands are collapsed into a set.
+type compactionIterStats struct {
+	emitted, shadowed, merged, skipped [int(db.InternalKeyKindInvalid) + 1]uint64
+}
+
+// stripe returns the index of the snapshot stripe containing seqNum. An entry
+// is visible to the snapshots whose sequence numbers are greater than or equal
+// to its own, so the entries in a stripe are visible to the same snapshots.
+func (i *compactionIter) stripe(seqNum uint64) int {
+	return sort.Search(len(i.snapshots), func(j int) bool {
+		return i.snapshots[j] >= seqNum
+	})
 }
 
 func (i *compactionIter) findNextEntry() bool {
 	i.valid = false
 	i.pos = compactionIterCur
+	i.preserved = false
 
 	for i.iter.Valid() {
 		i.key = i.iter.Key()
 		switch i.key.Kind() {
 		case db.InternalKeyKindDelete:
+			i.stats.emitted[i.key.Kind()]++
 			i.value = i.iter.Value()
 			i.valid = true
 			return true
 
 		case db.InternalKeyKindSet:
+			i.stats.emitted[i.key.Kind()]++
 			i.value = i.iter.Value()
 			i.valid = true
 			return true
 
 		case db.InternalKeyKindMerge:
+			i.stats.emitted[i.key.Kind()]++
 			return i.mergeNext()
 
 		default:
+			switch i.unknownKind {
+			case db.SkipUnknownKeyKind:
+				i.skip(i.key)
+				i.iter.Next()
+				continue
+			case db.PreserveUnknownKeyKind:
+				i.stats.emitted[i.key.Kind()]++
+				i.reportUnknownKind(i.key, true)
+				i.value = i.iter.Value()
+				i.valid = true
+				i.preserved = true
+				return true
+			}
 			i.err = fmt.Errorf("invalid internal key kind: %d", i.key.Kind())
 			return false
 		}
@@ -59,6 +114,18 @@ func (i *compactionIter) findNextEntry() bool {
 	return false
 }
 
+// skip drops the entry of an unknown kind at key.
+func (i *compactionIter) skip(key db.InternalKey) {
+	i.stats.skipped[key.Kind()]++
+	i.reportUnknownKind(key, false)
+}
+
+func (i *compactionIter) reportUnknownKind(key db.InternalKey, preserved bool) {
+	if i.onUnknownKind != nil {
+		i.onUnknownKind(db.UnknownKeyKindInfo{Key: key.Clone(), Preserved: preserved})
+	}
+}
+
 func (i *compactionIter) mergeNext() bool {
 	// Save the current key and value.
 	i.keyBuf = append(i.keyBuf[:0], i.iter.Key().UserKey...)
@@ -79,27 +146,59 @@ func (i *compactionIter) mergeNext() bool {
 			i.pos = compactionIterNext
 			return true
 		}
+		if i.stripe(key.SeqNum()) != i.stripe(i.key.SeqNum()) {
+			// The older entry is visible to a snapshot which cannot see the
+			// newer operands, so it must not be merged with them.
+			i.pos = compactionIterNext
+			return true
+		}
 		switch key.Kind() {
 		case db.InternalKeyKindDelete:
-			// We've hit a deletion tombstone. Return everything up to this
-			// point.
+			// We've hit a deletion tombstone. Merge the operands with a nil
+			// existing value and return. We change the kind of the resulting key to
+			// a Set so that it shadows keys in lower levels. That is,
+			// MERGE+MERGE+DEL -> SET.
+			i.stats.merged[key.Kind()]++
+			i.value = i.merge.FullMerge(i.key.UserKey, nil, i.value, nil)
+			i.key.SetKind(db.InternalKeyKindSet)
 			return true
 
 		case db.InternalKeyKindSet:
 			// We've hit a Set value. Merge with the existing value and return. We
 			// change the kind of the resulting key to a Set so that it shadows keys
 			// in lower levels. That is, MERGE+MERGE+SET -> SET.
-			i.value = i.merge(i.key.UserKey, i.value, i.iter.Value(), nil)
+			i.stats.merged[key.Kind()]++
+			i.value = i.merge.FullMerge(i.key.UserKey, i.iter.Value(), i.value, nil)
 			i.key.SetKind(db.InternalKeyKindSet)
 			return true
 
 		case db.InternalKeyKindMerge:
-			// We've hit another Merge value. Merge with the existing value and
-			// continue looping.
-			i.value = i.merge(i.key.UserKey, i.value, i.iter.Value(), nil)
+			// We've hit another Merge value. Combine it with the newer operands and
+			// continue looping. If the operands cannot be combined, return the
+			// newer operands and leave the iterator positioned at the older
+			// operand so that it is returned by the next call to Next.
+			v, ok := i.merge.PartialMerge(i.key.UserKey, i.iter.Value(), i.value, nil)
+			if !ok {
+				i.pos = compactionIterNext
+				return true
+			}
+			i.stats.merged[key.Kind()]++
+			i.value = v
 
 		default:
-			i.err = fmt.Errorf("invalid internal key kind: %d", i.key.Kind())
+			switch i.unknownKind {
+			case db.SkipUnknownKeyKind:
+				i.skip(key)
+				continue
+			case db.PreserveUnknownKeyKind:
+				// The operands cannot be merged with an entry of an unknown
+				// kind. Return them, and leave the iterator positioned at the
+				// entry so that it is preserved by the next call to Next.
+				i.pos = compactionIterNext
+				return true
+			}
+			i.err = fmt.Errorf("invalid internal key kind: %d", key.Kind())
+			i.valid = false
 			return false
 		}
 	}
@@ -119,10 +218,23 @@ func (i *compactionIter) Next() bool {
 	}
 	switch i.pos {
 	case compactionIterCur:
-		// TODO(peter): Rather than calling NextUserKey here, we should advance the
-		// iterator manually to the next key looking for any entries which have
-		// invalid keys and returning them.
-		i.iter.NextUserKey()
+		if i.preserved {
+			// The meaning of an entry of an unknown kind is unknown, so it does
+			// not shadow the older entries for its key.
+			i.iter.Next()
+			break
+		}
+		// Skip the older entries for the current key which are in the same
+		// snapshot stripe, and are therefore shadowed for every reader.
+		i.keyBuf = append(i.keyBuf[:0], i.key.UserKey...)
+		stripe := i.stripe(i.key.SeqNum())
+		for i.iter.Next() {
+			key := i.iter.Key()
+			if i.cmp(i.keyBuf, key.UserKey) != 0 || i.stripe(key.SeqNum()) != stripe {
+				break
+			}
+			i.stats.shadowed[key.Kind()]++
+		}
 	case compactionIterNext:
 	}
 	return i.findNextEntry()
@@ -7,6 +7,7 @@ package pebble
 import (
 	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -17,12 +18,20 @@ import (
 func TestCompactionIter(t *testing.T) {
 	var keys []db.InternalKey
 	var vals [][]byte
+	var snapshots []uint64
+	var unknownKind db.UnknownKeyKindMode
+	var events []db.UnknownKeyKindInfo
 
 	newIter := func() *compactionIter {
 		return &compactionIter{
-			cmp:   db.DefaultComparer.Compare,
-			merge: db.DefaultMerger.Merge,
-			iter:  &fakeIter{keys: keys, vals: vals},
+			cmp:         db.DefaultComparer.Compare,
+			merge:       db.DefaultMerger,
+			iter:        &fakeIter{keys: keys, vals: vals},
+			snapshots:   snapshots,
+			unknownKind: unknownKind,
+			onUnknownKind: func(info db.UnknownKeyKindInfo) {
+				events = append(events, info)
+			},
 		}
 	}
 
@@ -39,6 +48,30 @@ func TestCompactionIter(t *testing.T) {
 			return ""
 
 		case "iter":
+			snapshots = snapshots[:0]
+			unknownKind = db.FailOnUnknownKeyKind
+			events = events[:0]
+			for _, arg := range d.CmdArgs {
+				switch arg.Key {
+				case "snapshots":
+					for _, val := range arg.Vals {
+						seqNum, err := strconv.Atoi(val)
+						if err != nil {
+							return err.Error()
+						}
+						snapshots = append(snapshots, uint64(seqNum))
+					}
+				case "unknown-kind":
+					switch arg.Vals[0] {
+					case "skip":
+						unknownKind = db.SkipUnknownKeyKind
+					case "preserve":
+						unknownKind = db.PreserveUnknownKeyKind
+					default:
+						return fmt.Sprintf("unknown mode: %s", arg.Vals[0])
+					}
+				}
+			}
 			iter := newIter()
 			var b bytes.Buffer
 			for _, line := range strings.Split(d.Input, "\n") {
@@ -62,6 +95,9 @@ func TestCompactionIter(t *testing.T) {
 					fmt.Fprintf(&b, ".\n")
 				}
 			}
+			for _, e := range events {
+				fmt.Fprintf(&b, "unknown-kind: %s preserved=%t\n", e.Key, e.Preserved)
+			}
 			return b.String()
 
 		default:
@@ -0,0 +1,115 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// CompactionPlan describes the compaction which the DB would run next. See
+// DB.DebugCompactionPlan.
+type CompactionPlan struct {
+	// Level is the level being compacted, and OutputLevel the level to which
+	// the output of the compaction is written. OutputLevel is Level+1, unless
+	// the input table is moved further down.
+	Level       int
+	OutputLevel int
+	// Move is true if the single input table would be moved to OutputLevel
+	// rather than rewritten.
+	Move bool
+	// Score is the compaction score of the current version. A compaction is
+	// picked based on size if the score is at least 1. Otherwise the
+	// compaction rewrites a suspect table or a table marked for compaction.
+	Score float64
+	// Inputs are the tables of Level and NextInputs the tables of Level+1
+	// which are compacted.
+	Inputs     []SSTableInfo
+	NextInputs []SSTableInfo
+	// Grandparents are the tables of Level+2 which overlap the compaction.
+	Grandparents []SSTableInfo
+	// InputBytes is the total size of the input tables, which is the number of
+	// bytes the compaction reads and an estimate of the number it writes. A
+	// move reads and writes nothing. GrandparentBytes is the total size of the
+	// grandparents, which a future compaction of the output will read.
+	InputBytes       uint64
+	GrandparentBytes uint64
+}
+
+// String returns a human-readable description of the plan.
+func (p *CompactionPlan) String() string {
+	var buf bytes.Buffer
+	op := "compact"
+	if p.Move {
+		op = "move"
+	}
+	fmt.Fprintf(&buf, "%s L%d -> L%d (score %.2f, %d bytes)\n",
+		op, p.Level, p.OutputLevel, p.Score, p.InputBytes)
+	tables := func(level int, name string, s []SSTableInfo) {
+		for i := range s {
+			t := &s[i]
+			fmt.Fprintf(&buf, "  %s L%d %06d: %d bytes [%s-%s]\n",
+				name, level, t.FileNum, t.Size, t.Smallest, t.Largest)
+		}
+	}
+	tables(p.Level, "input", p.Inputs)
+	tables(p.Level+1, "input", p.NextInputs)
+	tables(p.Level+2, "grandparent", p.Grandparents)
+	return buf.String()
+}
+
+// DebugCompactionPlan returns the compaction which the DB would run next,
+// without running it, or nil if no compaction is needed. The compaction is
+// picked from the current version using the same heuristics as the background
+// compactions, allowing those heuristics to be examined and tuned offline. A
+// compaction which is in progress is not taken into account.
+//
+// The returned keys are copies and may be retained by the caller.
+func (d *DB) DebugCompactionPlan() (*CompactionPlan, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := pickCompaction(&d.mu.versions, d.isSuspect)
+	if err != nil || c == nil {
+		return nil, err
+	}
+	p := &CompactionPlan{
+		Level:            c.level,
+		OutputLevel:      c.level + 1,
+		Score:            c.version.compactionScore,
+		Inputs:           tableInfos(c.inputs[0]),
+		NextInputs:       tableInfos(c.inputs[1]),
+		Grandparents:     tableInfos(c.inputs[2]),
+		InputBytes:       totalSize(c.inputs[0]) + totalSize(c.inputs[1]),
+		GrandparentBytes: totalSize(c.inputs[2]),
+	}
+	if d.isTrivialMove(c) {
+		meta := &c.inputs[0][0]
+		p.Move = true
+		p.OutputLevel = c.version.pickLevelForOutput(d.opts, d.cmp, c.level+1, numLevels-1,
+			meta.smallest.UserKey, meta.largest.UserKey)
+	}
+	return p, nil
+}
+
+// tableInfos describes the tables files.
+func tableInfos(files []fileMetadata) []SSTableInfo {
+	if len(files) == 0 {
+		return nil
+	}
+	infos := make([]SSTableInfo, len(files))
+	for i := range files {
+		f := &files[i]
+		infos[i] = SSTableInfo{
+			FileNum:        f.fileNum,
+			Size:           f.size,
+			Smallest:       f.smallest.Clone(),
+			Largest:        f.largest.Clone(),
+			SmallestSeqNum: f.smallestSeqNum,
+			LargestSeqNum:  f.largestSeqNum,
+		}
+	}
+	return infos
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestDebugCompactionPlan(t *testing.T) {
+	mem := storage.NewMem()
+	open := func(threshold int, readOnly bool) *DB {
+		d, err := Open("", &db.Options{
+			FlushToL0:             true,
+			L0CompactionThreshold: threshold,
+			Logger:                discardLogger{},
+			ReadOnly:              readOnly,
+			Storage:               mem,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	d := open(100, false)
+	for i := 0; i < 3; i++ {
+		if err := d.Set([]byte(fmt.Sprint(i)), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Set([]byte("x"), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plan, err := d.DebugCompactionPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan != nil {
+		t.Fatalf("expected no compaction, but found\n%s", plan)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The DB is opened read-only so that the planned compaction is not run.
+	d = open(2, true)
+	defer d.Close()
+	plan, err = d.DebugCompactionPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan == nil {
+		t.Fatal("expected a compaction")
+	}
+	if plan.Level != 0 || plan.OutputLevel != 1 || plan.Move || len(plan.Inputs) != 3 ||
+		len(plan.NextInputs) != 0 || plan.Score < 1 {
+		t.Fatalf("unexpected plan\n%s", plan)
+	}
+	var size uint64
+	for _, info := range plan.Inputs {
+		size += info.Size
+	}
+	if plan.InputBytes != size {
+		t.Fatalf("expected %d input bytes, but found %d", size, plan.InputBytes)
+	}
+	tables, err := d.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables[0]) != 3 {
+		t.Fatalf("expected the compaction not to run, but found\n%s", tables)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -400,7 +401,11 @@ func TestPickCompaction(t *testing.T) {
 		vs.versions.init()
 		vs.append(&tc.version)
 
-		c, got := pickCompaction(vs), ""
+		c, err := pickCompaction(vs, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		got := ""
 		if c != nil {
 			got0 := fileNums(c.inputs[0])
 			got1 := fileNums(c.inputs[1])
@@ -413,6 +418,86 @@ func TestPickCompaction(t *testing.T) {
 	}
 }
 
+func TestPickCompactionInputs(t *testing.T) {
+	opts := (*db.Options)(nil).EnsureDefaults()
+	table := func(fileNum uint64, smallest, largest string) fileMetadata {
+		return fileMetadata{
+			fileNum:  fileNum,
+			size:     1,
+			smallest: db.ParseInternalKey(smallest),
+			largest:  db.ParseInternalKey(largest),
+		}
+	}
+	testCases := []struct {
+		desc    string
+		files   [numLevels][]fileMetadata
+		want    string
+		wantErr string
+	}{
+		{
+			desc: "table listed in both levels",
+			files: [numLevels][]fileMetadata{
+				1: {table(100, "a.SET.101", "c.SET.102")},
+				2: {table(100, "a.SET.101", "c.SET.102"), table(200, "d.SET.201", "e.SET.202")},
+			},
+			want: "000100  000100",
+		},
+		{
+			desc: "table listed twice in a level",
+			files: [numLevels][]fileMetadata{
+				1: {table(100, "a.SET.101", "c.SET.102")},
+				2: {table(200, "b.SET.201", "c.SET.202"), table(200, "b.SET.201", "c.SET.202")},
+			},
+			want: "000100 000200 ",
+		},
+		{
+			desc: "overlapping table left behind in the input level",
+			files: [numLevels][]fileMetadata{
+				1: {table(100, "a.SET.101", "c.SET.102"), table(101, "c.SET.100", "e.SET.103")},
+			},
+			wantErr: "table 000101 [c-e] left behind in L1",
+		},
+		{
+			desc: "overlapping table left behind in the output level",
+			files: [numLevels][]fileMetadata{
+				1: {table(100, "a.SET.101", "c.SET.102")},
+				2: {table(200, "b.SET.201", "d.SET.202"), table(200, "b.SET.201", "d.SET.202"),
+					table(201, "d.SET.203", "f.SET.204")},
+			},
+			wantErr: "table 000201 [d-f] left behind in L2",
+		},
+	}
+
+	for _, tc := range testCases {
+		vs := &versionSet{
+			opts:    opts,
+			cmp:     db.DefaultComparer.Compare,
+			cmpName: db.DefaultComparer.Name,
+		}
+		vs.versions.init()
+		vs.append(&version{
+			files:           tc.files,
+			compactionScore: 99,
+			compactionLevel: 1,
+		})
+
+		c, err := pickCompaction(vs, nil)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("%s: expected %q, but found %v", tc.desc, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		got := fileNums(c.inputs[0]) + " " + fileNums(c.inputs[1]) + " " + fileNums(c.duplicates)
+		if got != tc.want {
+			t.Fatalf("%s:\ngot  %q\nwant %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
 func TestIsBaseLevelForUkey(t *testing.T) {
 	testCases := []struct {
 		desc    string
@@ -536,11 +621,26 @@ func TestIsBaseLevelForUkey(t *testing.T) {
 	}
 
 	for _, tc := range testCases {
-		c := compaction{
+		// The keys are checked in increasing order by a single compaction, as
+		// they are by a compaction's loop, and individually by new compactions.
+		var ukeys []string
+		for ukey := range tc.wants {
+			ukeys = append(ukeys, ukey)
+		}
+		sort.Strings(ukeys)
+		shared := compaction{
 			version: &tc.version,
 			level:   tc.level,
 		}
-		for ukey, want := range tc.wants {
+		for _, ukey := range ukeys {
+			want := tc.wants[ukey]
+			if got := shared.isBaseLevelForUkey(db.DefaultComparer.Compare, []byte(ukey)); got != want {
+				t.Errorf("%s: ukey=%q: got %v, want %v", tc.desc, ukey, got, want)
+			}
+			c := compaction{
+				version: &tc.version,
+				level:   tc.level,
+			}
 			if got := c.isBaseLevelForUkey(db.DefaultComparer.Compare, []byte(ukey)); got != want {
 				t.Errorf("%s: ukey=%q: got %v, want %v", tc.desc, ukey, got, want)
 			}
@@ -548,6 +648,31 @@ func TestIsBaseLevelForUkey(t *testing.T) {
 	}
 }
 
+func BenchmarkIsBaseLevelForUkey(b *testing.B) {
+	// A compaction of L1 whose keys span the 1000 tables of each of L3 to L6.
+	var v version
+	for level := 3; level < numLevels; level++ {
+		for i := 0; i < 1000; i++ {
+			v.files[level] = append(v.files[level], fileMetadata{
+				smallest: db.MakeInternalKey([]byte(fmt.Sprintf("%06d", 1000*i+level)), 1, db.InternalKeyKindSet),
+				largest:  db.MakeInternalKey([]byte(fmt.Sprintf("%06d", 1000*i+level+100)), 1, db.InternalKeyKindSet),
+			})
+		}
+	}
+	var ukeys [][]byte
+	for i := 0; i < 1000000; i += 97 {
+		ukeys = append(ukeys, []byte(fmt.Sprintf("%06d", i)))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := compaction{version: &v, level: 1}
+		for _, ukey := range ukeys {
+			c.isBaseLevelForUkey(db.DefaultComparer.Compare, ukey)
+		}
+	}
+}
+
 func TestCompaction(t *testing.T) {
 	const memTableSize = 10000
 	// Tuned so that 2 values can reside in the memtable before a flush, but a
@@ -557,6 +682,7 @@ func TestCompaction(t *testing.T) {
 
 	fs := storage.NewMem()
 	d, err := Open("", &db.Options{
+		FlushToL0:    true,
 		Storage:      fs,
 		MemTableSize: memTableSize,
 	})
@@ -661,3 +787,332 @@ func TestCompaction(t *testing.T) {
 		t.Fatalf("db Close: %v", err)
 	}
 }
+
+func TestCompactionGuards(t *testing.T) {
+	guards := [][]byte{[]byte("g"), []byte("n"), []byte("t")}
+	mem := storage.NewMem()
+	open := func(threshold int, split func(prevKey, key []byte) bool) *DB {
+		d, err := Open("", &db.Options{
+			FlushToL0:             true,
+			L0CompactionThreshold: threshold,
+			Logger:                discardLogger{},
+			SplitCompactionOutput: split,
+			Storage:               mem,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	// Flushes are also split at the guard keys, so the two L0 tables are
+	// written without guards, and without being compacted.
+	d := open(100, nil)
+	var expected []string
+	for _, step := range []int{1, 3} {
+		for c := 'a'; c <= 'z'; c += rune(step) {
+			if err := d.Set([]byte{byte(c)}, []byte(fmt.Sprint(step)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The two L0 tables are compacted into L1, which splits the output at the
+	// guard keys.
+	d = open(2, db.GuardKeys(db.DefaultComparer.Compare, guards))
+	defer d.Close()
+	for c := 'a'; c <= 'z'; c++ {
+		v := "1"
+		if (c-'a')%3 == 0 {
+			v = "3"
+		}
+		expected = append(expected, fmt.Sprintf("%c:%s", c, v))
+	}
+
+	d.mu.Lock()
+	for (len(d.mu.versions.currentVersion().files[0]) > 0 || d.mu.compact.compacting) &&
+		d.mu.metrics.BackgroundErrors == 0 {
+		d.mu.compact.cond.Wait()
+	}
+	files := d.mu.versions.currentVersion().files[1]
+	bgErr := d.mu.metrics.LastBackgroundError
+	d.mu.Unlock()
+	if bgErr != nil {
+		t.Fatal(bgErr)
+	}
+
+	var bounds []string
+	for _, f := range files {
+		bounds = append(bounds, fmt.Sprintf("%s-%s", f.smallest.UserKey, f.largest.UserKey))
+	}
+	if s := strings.Join(bounds, " "); s != "a-f g-m n-s t-z" {
+		t.Fatalf("expected a-f g-m n-s t-z, but found %s", s)
+	}
+	if s := scanString(t, d); s != strings.Join(expected, " ") {
+		t.Fatalf("expected %s, but found %s", strings.Join(expected, " "), s)
+	}
+}
+
+func TestFlushSplit(t *testing.T) {
+	tableBounds := func(d *DB) string {
+		s, err := d.SSTables()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		for level := range s {
+			if len(s[level]) == 0 {
+				continue
+			}
+			fmt.Fprintf(&buf, "L%d:", level)
+			for _, f := range s[level] {
+				fmt.Fprintf(&buf, " %s-%s", f.Smallest.UserKey, f.Largest.UserKey)
+			}
+			buf.WriteString("\n")
+		}
+		return buf.String()
+	}
+	flush := func(d *DB, start, step byte) {
+		for c := start; c <= 'z'; c += step {
+			if err := d.Set([]byte{c}, []byte{c}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := Open("", &db.Options{
+		Logger:                discardLogger{},
+		SplitCompactionOutput: db.GuardKeys(db.DefaultComparer.Compare, [][]byte{[]byte("h")}),
+		Storage:               storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first flush is split at the guard key, and the second flush is also
+	// split at the boundary between the tables in the base level.
+	flush(d, 'a', 2)
+	if s := tableBounds(d); s != "L2: a-g i-y\n" {
+		t.Fatalf("unexpected tables:\n%s", s)
+	}
+	flush(d, 'b', 2)
+	if s := tableBounds(d); s != "L1: b-f j-z\nL2: a-g h-h i-y\n" {
+		t.Fatalf("unexpected tables:\n%s", s)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A table is finished once it reaches the target file size, after which
+	// every key is written to its own table.
+	d, err = Open("", &db.Options{
+		FlushToL0: true,
+		Levels:    []db.LevelOptions{{TargetFileSize: 1}},
+		Logger:    discardLogger{},
+		Storage:   storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for _, k := range []string{"a", "b", "b", "c"} {
+		if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if s := tableBounds(d); s != "L0: a-a b-b c-c\n" {
+		t.Fatalf("unexpected tables:\n%s", s)
+	}
+}
+
+// errorFS fails the creation of tables while the failing flag is set.
+type errorFS struct {
+	storage.Storage
+	failing int32
+}
+
+func (fs *errorFS) Create(name string) (storage.File, error) {
+	if atomic.LoadInt32(&fs.failing) != 0 {
+		if ft, _, ok := parseDBFilename(name); ok && ft == fileTypeTable {
+			return nil, fmt.Errorf("injected error: %s", name)
+		}
+	}
+	return fs.Storage.Create(name)
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Infof(format string, args ...interface{})  {}
+func (discardLogger) Errorf(format string, args ...interface{}) {}
+func (discardLogger) Fatalf(format string, args ...interface{}) {}
+
+func TestBackgroundError(t *testing.T) {
+	fs := &errorFS{Storage: storage.NewMem(), failing: 1}
+	errCh := make(chan error, 1)
+	d, err := Open("", &db.Options{
+		EventListener: db.EventListener{
+			BackgroundError: func(err error) {
+				select {
+				case errCh <- err:
+				default:
+				}
+			},
+		},
+		Logger:  discardLogger{},
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- d.Flush()
+	}()
+
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "injected error") {
+			t.Fatalf("unexpected background error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("background error not reported")
+	}
+	m := d.Metrics()
+	if m.BackgroundErrors == 0 || m.ConsecutiveBackgroundErrors == 0 ||
+		m.LastBackgroundError == nil {
+		t.Fatalf("background error not recorded: %+v", m)
+	}
+	if m.Flush.Count != 0 {
+		t.Fatalf("expected 0 flushes, but found %d", m.Flush.Count)
+	}
+
+	// Once the error clears, the flush succeeds.
+	atomic.StoreInt32(&fs.failing, 0)
+	d.ResumeBackgroundWork()
+	select {
+	case <-flushed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("flush did not complete")
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	m = d.Metrics()
+	if m.ConsecutiveBackgroundErrors != 0 {
+		t.Fatalf("expected 0 consecutive errors, but found %d", m.ConsecutiveBackgroundErrors)
+	}
+	if m.Flush.Count == 0 {
+		t.Fatalf("expected a flush, but found none")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackgroundErrorReadOnly(t *testing.T) {
+	fs := &errorFS{Storage: storage.NewMem(), failing: 1}
+	d, err := Open("", &db.Options{
+		Logger:  discardLogger{},
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// The flush fails repeatedly, eventually making the DB read-only.
+	if err := d.Flush(); err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Fatalf("expected read-only error, but found %v", err)
+	}
+	if m := d.Metrics(); m.ConsecutiveBackgroundErrors != maxConsecutiveBackgroundErrors {
+		t.Fatalf("expected %d consecutive errors, but found %d",
+			maxConsecutiveBackgroundErrors, m.ConsecutiveBackgroundErrors)
+	}
+	if err := d.Set([]byte("b"), []byte("2"), nil); err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Fatalf("expected read-only error, but found %v", err)
+	}
+	// Reads are still served.
+	if v, err := d.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("expected 1, but found %s (%v)", v, err)
+	}
+
+	atomic.StoreInt32(&fs.failing, 0)
+	d.ResumeBackgroundWork()
+	if err := d.Set([]byte("b"), []byte("2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"a": "1", "b": "2"} {
+		if value, err := d.Get([]byte(k)); err != nil || string(value) != v {
+			t.Fatalf("%s: expected %s, but found %s (%v)", k, v, value, err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackgroundErrorStalledWriter(t *testing.T) {
+	fs := &errorFS{Storage: storage.NewMem(), failing: 1}
+	d, err := Open("", &db.Options{
+		Logger:                      discardLogger{},
+		MemTableSize:                64 << 10,
+		MemTableStopWritesThreshold: 2,
+		Storage:                     fs,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	// The writer fills up the memtables, which cannot be flushed, and stalls
+	// until the flush errors become sticky.
+	errCh := make(chan error, 1)
+	go func() {
+		value := make([]byte, 1<<10)
+		for i := 0; ; i++ {
+			if err := d.Set([]byte(fmt.Sprintf("%06d", i)), value, nil); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "read-only") {
+			t.Fatalf("expected read-only error, but found %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("stalled writer did not return")
+	}
+	if m := d.Metrics(); m.Stall.Count == 0 {
+		t.Fatalf("expected the writer to stall")
+	}
+
+	atomic.StoreInt32(&fs.failing, 0)
+	d.ResumeBackgroundWork()
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -9,27 +9,56 @@ import (
 	"sync"
 	"time"
 
+	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/rate"
 )
 
+// lowPriorityRateFraction is the fraction of the rate limit of a controller
+// at which low priority writes are admitted.
+const lowPriorityRateFraction = 0.25
+
 type controller struct {
 	limiter *rate.Limiter
-	sensor  *rateCounter
+	// lowLimiter limits the low priority writes, which must also be admitted
+	// by limiter, to a fraction of its rate.
+	lowLimiter *rate.Limiter
+	sensor     *rateCounter
 }
 
 func newController(l *rate.Limiter) *controller {
+	low := l.Limit()
+	if low != rate.Inf {
+		low *= lowPriorityRateFraction
+	}
 	return &controller{
-		limiter: l,
-		sensor:  newRateCounter(5*time.Second, 25),
+		limiter:    l,
+		lowLimiter: rate.NewLimiter(low, l.Burst()),
+		sensor:     newRateCounter(5*time.Second, 25),
 	}
 }
 
+// WaitN waits until n bytes may be written at normal priority.
 func (c *controller) WaitN(n int) {
+	c.WaitPriorityN(n, db.NormalPriority)
+}
+
+// WaitPriorityN waits until n bytes may be written at the priority pri. A
+// high priority write takes its tokens without waiting, which delays the
+// writes waiting behind it.
+func (c *controller) WaitPriorityN(n int, pri db.WritePriority) {
 	size := n
 	if burst := c.limiter.Burst(); size > burst {
 		size = burst
 	}
-	_ = c.limiter.WaitN(context.Background(), size)
+	switch {
+	case pri >= db.HighPriority:
+		c.limiter.ReserveN(time.Now(), size)
+	case pri <= db.LowPriority:
+		_ = c.lowLimiter.WaitN(context.Background(), size)
+		_ = c.limiter.WaitN(context.Background(), size)
+	default:
+		_ = c.limiter.WaitN(context.Background(), size)
+	}
 	c.sensor.Add(int64(n))
 }
 
@@ -7,6 +7,9 @@ package pebble
 import (
 	"testing"
 	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/rate"
 )
 
 func TestRateCounter(t *testing.T) {
@@ -43,3 +46,54 @@ func TestRateCounter(t *testing.T) {
 		}
 	}
 }
+
+func TestControllerPriority(t *testing.T) {
+	// The limiters refill so slowly that the tokens taken by each write are
+	// never replenished during the test.
+	newTestController := func() *controller {
+		return newController(rate.NewLimiter(1, 10))
+	}
+	if c := newTestController(); c.lowLimiter.Limit() != 0.25 || c.lowLimiter.Burst() != 10 {
+		t.Fatalf("unexpected low priority limit %v and burst %d",
+			c.lowLimiter.Limit(), c.lowLimiter.Burst())
+	}
+
+	// A normal priority write leaves the low priority tokens alone.
+	c := newTestController()
+	c.WaitPriorityN(10, db.NormalPriority)
+	now := time.Now()
+	if c.limiter.AllowN(now, 1) || !c.lowLimiter.AllowN(now, 10) {
+		t.Fatalf("expected only the tokens of the limiter to be taken")
+	}
+
+	// A low priority write takes the tokens of both limiters.
+	c = newTestController()
+	c.WaitPriorityN(10, db.LowPriority)
+	now = time.Now()
+	if c.limiter.AllowN(now, 1) || c.lowLimiter.AllowN(now, 1) {
+		t.Fatalf("expected the tokens of both limiters to be taken")
+	}
+
+	// A high priority write does not wait for tokens, and instead delays the
+	// writes after it.
+	c = newTestController()
+	c.WaitPriorityN(10, db.NormalPriority)
+	start := time.Now()
+	c.WaitPriorityN(10, db.HighPriority)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected the high priority write to be admitted immediately, but it waited %s", d)
+	}
+	if r := c.limiter.ReserveN(time.Now(), 1); r.Delay() < 10*time.Second {
+		t.Fatalf("expected the next write to be delayed by the high priority write, but found %s",
+			r.Delay())
+	}
+	if c.sensor.Value() != 20 {
+		t.Fatalf("expected 20 bytes, but found %d", c.sensor.Value())
+	}
+
+	// No write waits for an unlimited controller.
+	c = newController(rate.NewLimiter(rate.Inf, 0))
+	for _, pri := range []db.WritePriority{db.LowPriority, db.NormalPriority, db.HighPriority} {
+		c.WaitPriorityN(1<<20, pri)
+	}
+}
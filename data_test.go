@@ -26,6 +26,11 @@ func runInternalIterCmd(d *datadriven.TestData, iter db.InternalIterator) string
 				return fmt.Sprintf("seek-ge <key>\n")
 			}
 			iter.SeekGE([]byte(strings.TrimSpace(parts[1])))
+		case "seek-prefix-ge":
+			if len(parts) != 3 {
+				return fmt.Sprintf("seek-prefix-ge <prefix> <key>\n")
+			}
+			iter.SeekPrefixGE([]byte(parts[1]), []byte(parts[2]))
 		case "seek-lt":
 			if len(parts) != 2 {
 				return fmt.Sprintf("seek-lt <key>\n")
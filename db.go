@@ -6,6 +6,8 @@
 package pebble // import "github.com/petermattis/pebble"
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
@@ -14,6 +16,7 @@ import (
 
 	"github.com/petermattis/pebble/arenaskl"
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/histogram"
 	"github.com/petermattis/pebble/record"
 	"github.com/petermattis/pebble/sstable"
 	"github.com/petermattis/pebble/storage"
@@ -28,6 +31,10 @@ const (
 	numNonTableCacheFiles = 10
 )
 
+// ErrReadOnly is returned when a write operation is performed on a DB opened
+// in read-only mode.
+var ErrReadOnly = errors.New("pebble: read-only")
+
 // Reader is a readable key/value store.
 //
 // It is safe to call Get and NewIter from concurrent goroutines.
@@ -74,6 +81,12 @@ type Writer interface {
 	// It is safe to modify the contents of the arguments after Delete returns.
 	DeleteRange(start, end []byte, o *db.WriteOptions) error
 
+	// LogData adds the specified data, which is written to the WAL but not
+	// added to the memtable or sstables.
+	//
+	// It is safe to modify the contents of the arguments after LogData returns.
+	LogData(data []byte, opts *db.WriteOptions) error
+
 	// Merge merges the value for the given key. The details of the merge are
 	// dependent upon the configured merge operation.
 	//
@@ -92,7 +105,7 @@ type DB struct {
 	dirname   string
 	opts      *db.Options
 	cmp       db.Compare
-	merge     db.Merge
+	merge     db.MergeOperator
 	inlineKey db.InlineKey
 
 	tableCache tableCache
@@ -100,6 +113,53 @@ type DB struct {
 
 	commit   *commitPipeline
 	fileLock io.Closer
+	scrubber *scrubber
+	deleter  *fileDeleter
+
+	// The DB a keyspace belongs to, and the name of the keyspace, if the DB
+	// stores the entries of a keyspace. Such a DB has no WAL of its own: its
+	// writes are committed through the commit pipeline of its parent, and
+	// share its sequence numbers. See Keyspace.
+	parent       *DB
+	keyspaceName string
+
+	// The file number of the OPTIONS file written by Open.
+	optionsFileNum uint64
+
+	// secondary is true if the DB was opened by OpenAsSecondary.
+	secondary bool
+
+	// diskHealth measures the latency of writes and syncs if
+	// Options.DiskSlowThreshold is set, and is nil otherwise.
+	diskHealth *storage.DiskHealthChecker
+
+	// walSyncLatency records the latency of the syncs of the WAL files
+	// performed by their LogWriters.
+	walSyncLatency histogram.Histogram
+
+	// readStats accumulates the bytes read from the tables of each level,
+	// which are updated atomically.
+	readStats ReadMetrics
+
+	// memoryBatches is the size of the batches being committed, which is
+	// updated atomically. See DB.memoryUsage.
+	memoryBatches int64
+
+	// bgErr holds the sticky background error, wrapped in a bgError, which is
+	// read atomically and updated while holding d.mu. When set, background
+	// flushes and compactions are not scheduled and new writes are refused.
+	// Cleared by ResumeBackgroundWork. See DB.handleBackgroundError.
+	bgErr atomic.Value
+
+	// suspect holds the table files in which a corrupted block was found,
+	// keyed by disk file number, until a compaction rewrites them. It has its
+	// own mutex since corruptions are found by reads which may hold d.mu. See
+	// DB.reportTableCorruption.
+	suspect struct {
+		sync.Mutex
+		tables  map[uint64]*db.CorruptionError
+		metrics CorruptionMetrics
+	}
 
 	// Rate limiter for how much bandwidth to allow for commits, compactions, and
 	// flushes.
@@ -120,9 +180,34 @@ type DB struct {
 
 		versions versionSet
 
+		// The open snapshots, ordered by increasing sequence number.
+		snapshots snapshotList
+
+		// The transactions which have been prepared but not yet committed or
+		// rolled back, keyed by transaction ID. The value is the prepare record
+		// written to the WAL. See DB.Prepare.
+		prepared map[string][]byte
+
+		// The open keyspaces, keyed by name. See DB.Keyspace.
+		keyspaces map[string]*Keyspace
+
+		// The reference counts of the table files protected from deletion,
+		// keyed by disk file number. See DB.ProtectRange.
+		protected map[uint64]int
+
+		// The writes committed while transactions are open, against which the
+		// read-sets of the transactions are validated. See Tx.Commit.
+		tx txWrites
+
 		log struct {
 			number uint64
 			*record.LogWriter
+			// retired holds the WALs preceding the current WAL which are not yet
+			// obsolete, in increasing file number order.
+			retired []walFile
+			// replayedBytes is the total size of the batches replayed from the
+			// WALs.
+			replayedBytes uint64
 		}
 
 		mem struct {
@@ -144,6 +229,34 @@ type DB struct {
 			flushing       bool
 			compacting     bool
 			pendingOutputs map[uint64]struct{}
+			// The flushes and compactions in progress, keyed by job ID, and the ID
+			// of the most recently started job. See DB.Jobs.
+			jobs      map[int]*job
+			nextJobID int
+			// The number of consecutive errors of background flushes and
+			// compactions. See DB.handleBackgroundError.
+			flushErrors      int64
+			compactionErrors int64
+		}
+
+		metrics Metrics
+
+		// The state of the enforcement of Options.MemoryBudget. See
+		// DB.maybeEnforceMemoryBudget.
+		memory struct {
+			// The size of the batches committed since the memory usage was last
+			// checked.
+			sinceCheck int64
+			// The capacity of the block cache when the DB was opened, which it is
+			// never grown beyond.
+			cacheCapacity int64
+		}
+
+		// The estimated garbage in each level of version, which is cached until
+		// the current version changes. See DB.levelGarbage.
+		garbage struct {
+			version *version
+			levels  [numLevels]TableGarbage
 		}
 	}
 }
@@ -154,17 +267,79 @@ var _ Writer = (*DB)(nil)
 // Get gets the value for the given key. It returns ErrNotFound if the DB
 // does not contain the key.
 //
+// The value is not copied: the returned slice references the memtable or
+// sstable block the value was read from. Neither is reused once released by
+// the DB, so the slice remains valid for as long as the caller retains it.
+//
 // The caller should not modify the contents of the returned slice, but
 // it is safe to modify the contents of the argument after Get returns.
 func (d *DB) Get(key []byte) ([]byte, error) {
+	value, current, err := d.getInternal(key, nil, nil)
+	current.unref()
+	return value, err
+}
+
+// GetWithOptions gets the value for the given key like Get, using the read
+// options o. Only o.VerifyChecksums applies to a point lookup; the other
+// options are ignored.
+func (d *DB) GetWithOptions(key []byte, o *db.IterOptions) ([]byte, error) {
+	value, current, err := d.getInternal(key, nil, o)
+	current.unref()
+	return value, err
+}
+
+// GetAtTimestamp gets the value of the newest version of the key's prefix
+// whose timestamp is no newer than ts, as determined by the comparer's Split
+// and CompareTimestamps functions. The version without a timestamp, if any,
+// is returned only if no timestamped version is visible at ts. It returns
+// ErrNotFound if there is no such version, and an error if the comparer does
+// not support timestamps.
+//
+// It is safe to modify the contents of the arguments after GetAtTimestamp
+// returns.
+func (d *DB) GetAtTimestamp(key, ts []byte) ([]byte, error) {
+	c := d.opts.Comparer
+	if c.CompareTimestamps == nil || c.Split == nil {
+		return nil, errors.New("pebble: comparer does not support timestamps")
+	}
+	iter := d.NewIter(&db.IterOptions{Timestamp: ts})
+	var value, newest []byte
+	found := false
+	for iter.SeekPrefixGE(key); iter.Valid(); iter.Next() {
+		t := c.Timestamp(iter.Key())
+		if found && (len(t) == 0 || (len(newest) > 0 && c.CompareTimestamps(t, newest) <= 0)) {
+			continue
+		}
+		value = append(value[:0], iter.Value()...)
+		newest = append(newest[:0], t...)
+		found = true
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, db.ErrNotFound
+	}
+	return value, nil
+}
+
+// getInternal looks up the value for the given key as of the snapshot s, or
+// the latest visible state if s is nil, returning a reference to the version
+// the value was read from. The caller is responsible for unreferencing the
+// returned version.
+func (d *DB) getInternal(key []byte, s *Snapshot, o *db.IterOptions) ([]byte, *version, error) {
 	d.mu.Lock()
-	snapshot := atomic.LoadUint64(&d.mu.versions.visibleSeqNum)
+	var snapshot uint64
+	if s != nil {
+		snapshot = s.seqNum
+	} else {
+		snapshot = d.lastVisibleSeqNum()
+	}
 	// Grab and reference the current version to prevent its underlying files
 	// from being deleted if we have a concurrent compaction. Note that
 	// version.unref() can be called without holding DB.mu.
 	current := d.mu.versions.currentVersion()
 	current.ref()
-	defer current.unref()
 	memtables := d.mu.mem.queue
 	d.mu.Unlock()
 
@@ -174,16 +349,26 @@ func (d *DB) Get(key []byte) ([]byte, error) {
 	for i := len(memtables) - 1; i >= 0; i-- {
 		mem := memtables[i]
 		iter := mem.NewIter(nil)
-		iter.SeekGE(key)
 		value, conclusive, err := internalGet(iter, d.cmp, ikey)
 		if conclusive {
-			return value, err
+			return value, current, err
 		}
 	}
 
 	// TODO(peter): update stats, maybe schedule compaction.
 
-	return current.get(ikey, d.newIter, d.cmp, nil)
+	value, err := current.get(ikey, d.newIter, d.cmp, o, &d.readStats.Get)
+	return value, current, err
+}
+
+// lastVisibleSeqNum returns the largest sequence number visible to readers.
+// The visibleSeqNum of the versionSet is the sequence number following the
+// last published batch, and is never 0 (see Open).
+func (d *DB) lastVisibleSeqNum() uint64 {
+	if d.parent != nil {
+		return d.parent.lastVisibleSeqNum()
+	}
+	return atomic.LoadUint64(&d.mu.versions.visibleSeqNum) - 1
 }
 
 // Set sets the value for the given key. It overwrites any previous value
@@ -220,6 +405,20 @@ func (d *DB) DeleteRange(start, end []byte, opts *db.WriteOptions) error {
 	return d.Apply(b, opts)
 }
 
+// LogData writes the specified data to the WAL through the commit pipeline,
+// ordered with respect to concurrent writes, without adding it to the
+// memtable. If opts requests a sync, LogData returns once the WAL containing
+// the data has been synced. This allows replication layers to durably record
+// markers, such as epoch barriers, in the WAL.
+//
+// It is safe to modify the contents of the arguments after LogData returns.
+func (d *DB) LogData(data []byte, opts *db.WriteOptions) error {
+	b := newBatch(d)
+	defer b.release()
+	_ = b.LogData(data, opts)
+	return d.Apply(b, opts)
+}
+
 // Merge adds an action to the DB that merges the value at key with the new
 // value. The details of the merge are dependent upon the configured merge
 // operator.
@@ -236,7 +435,78 @@ func (d *DB) Merge(key, value []byte, opts *db.WriteOptions) error {
 //
 // It is safe to modify the contents of the arguments after Apply returns.
 func (d *DB) Apply(batch *Batch, opts *db.WriteOptions) error {
-	return d.commit.Commit(batch, opts.GetSync())
+	err := d.apply(batch, opts)
+	if batch.onCommit != nil {
+		// A failed commit may have been assigned a sequence number, which is not
+		// reported.
+		var seqNum uint64
+		if err == nil {
+			seqNum = batch.SeqNum()
+		}
+		batch.onCommit(seqNum, err)
+	}
+	return err
+}
+
+func (d *DB) apply(batch *Batch, opts *db.WriteOptions) error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if d.parent != nil {
+		return d.parent.applyKeyspace(d.keyspaceName, batch, opts)
+	}
+	if k := batch.db; k != nil && k.parent == d {
+		return d.applyKeyspace(k.keyspaceName, batch, opts)
+	}
+	large := batch.memTableSize > uint64(d.opts.BatchSpillThreshold)
+	spill := large && batch.spillable()
+	err := d.backgroundError()
+	if err == nil && (len(batch.keyspaces) > 0 || large) {
+		// Only a batch with the entries of keyspaces, or one which may not fit in
+		// a memtable, is checked, keeping d.mu off the commit path of the other
+		// batches.
+		d.mu.Lock()
+		err = d.checkKeyspaces(batch)
+		if err == nil && !spill {
+			err = d.checkBatchSize(batch)
+		}
+		d.mu.Unlock()
+	}
+	if err == nil {
+		size := int64(len(batch.data))
+		atomic.AddInt64(&d.memoryBatches, size)
+		if spill {
+			err = d.spillBatch(batch)
+		} else {
+			err = d.commit.Commit(batch, opts.GetSync(), opts.GetPriority())
+		}
+		atomic.AddInt64(&d.memoryBatches, -size)
+	}
+	return err
+}
+
+// checkBatchSize returns ErrBatchTooLarge if the entries of the batch do not
+// fit in an empty memtable of the DB, or of a keyspace they belong to. Such a
+// batch can never be applied to the memtables, and is rejected before
+// entering the commit pipeline. Only the batches which cannot be spilled to
+// an sstable are checked. See DB.spillBatch.
+//
+// d.mu must be held when calling this.
+func (d *DB) checkBatchSize(b *Batch) error {
+	if d.mu.mem.mutable.tooLarge(b.memTableSize) {
+		return ErrBatchTooLarge
+	}
+	for i := range b.keyspaces {
+		bk := &b.keyspaces[i]
+		kd := d.mu.keyspaces[bk.name].d
+		kd.mu.Lock()
+		tooLarge := kd.mu.mem.mutable.tooLarge(bk.memTableSize)
+		kd.mu.Unlock()
+		if tooLarge {
+			return ErrBatchTooLarge
+		}
+	}
+	return nil
 }
 
 func (d *DB) commitApply(b *Batch, mem *memTable) error {
@@ -249,6 +519,9 @@ func (d *DB) commitApply(b *Batch, mem *memTable) error {
 		d.maybeScheduleFlush()
 		d.mu.Unlock()
 	}
+	if len(b.keyspaces) > 0 {
+		return applyKeyspaces(b)
+	}
 	return nil
 }
 
@@ -259,33 +532,84 @@ func (d *DB) commitSync() error {
 	// NB: The log might have been closed after we unlock d.mu. That's ok because
 	// it will have been synced and all we're guaranteeing is that the log that
 	// was open at the start of this call was synced by the end of it.
-	return log.Sync()
+	start := time.Now()
+	err := log.Sync()
+	latency := time.Since(start)
+
+	d.mu.Lock()
+	m := &d.mu.metrics.WAL
+	m.Syncs++
+	m.SyncDuration += latency
+	if latency > m.MaxSyncLatency {
+		m.MaxSyncLatency = latency
+	}
+	d.mu.Unlock()
+	return err
 }
 
 func (d *DB) commitWrite(b *Batch) (*memTable, error) {
 	// NB: commitWrite is called with d.mu locked.
 
+	// Reserve room in the memtables of the batch's keyspaces before d.mu is
+	// dropped for the first time, so that the keyspaces' memtables are
+	// prepared in sequence number order. See DB.prepareKeyspaces.
+	keyspaceSwitched, err := d.maybeEnforceMemoryBudget(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.keyspaces) > 0 {
+		switched, err := d.prepareKeyspaces(b)
+		if err != nil {
+			return nil, err
+		}
+		keyspaceSwitched = keyspaceSwitched || switched
+	}
+
 	// Throttle writes if there are too many L0 tables.
 	d.throttleWrite()
 
+	// Switch to a new WAL if a keyspace switched out its memtable, so that the
+	// WALs holding the entries of the keyspace's immutable memtables are not
+	// retained until the memtable of the DB fills up.
+	if keyspaceSwitched {
+		err = d.makeRoomForWrite(nil)
+	}
+
 	// Switch out the memtable if there was not enough room to store the
 	// batch.
-	if err := d.makeRoomForWrite(b); err != nil {
+	if err == nil {
+		err = d.makeRoomForWrite(b)
+	}
+	if err != nil {
+		// The batch will not be applied to the memtables of its keyspaces.
+		releaseKeyspaces(b, len(b.keyspaces))
 		return nil, err
 	}
+	if len(b.keyspaces) > 0 {
+		setKeyspaceLogNums(b, d.mu.log.number)
+	}
+	if len(d.mu.tx.open) > 0 {
+		d.mu.tx.addBatch(b)
+	}
 
-	_, err := d.mu.log.WriteRecord(b.data)
+	_, err = d.mu.log.WriteRecord(b.data)
 	if err != nil {
 		panic(err)
 	}
 	return d.mu.mem.mutable, err
 }
 
-// newIterInternal constructs a new iterator, merging in batchIter as an extra
-// level.
-func (d *DB) newIterInternal(batchIter db.InternalIterator, o *db.IterOptions) db.Iterator {
+// newIterInternal constructs a new iterator, merging in the contents of batch
+// as an extra level if batch is non-nil. The iterator reads the state as of
+// the snapshot s, or the latest visible state if s is nil.
+func (d *DB) newIterInternal(batch *Batch, s *Snapshot, o *db.IterOptions) db.Iterator {
 	d.mu.Lock()
-	seqNum := atomic.LoadUint64(&d.mu.versions.visibleSeqNum)
+	var seqNum uint64
+	if s != nil {
+		seqNum = s.seqNum
+	} else {
+		seqNum = d.lastVisibleSeqNum()
+	}
 	// TODO(peter): The sstables in current are guaranteed to have sequence
 	// numbers less than d.mu.versions.logSeqNum, so why does dbIter need to check
 	// sequence numbers for every iter? Perhaps the sequence number filtering
@@ -299,6 +623,15 @@ func (d *DB) newIterInternal(batchIter db.InternalIterator, o *db.IterOptions) d
 	memtables := d.mu.mem.queue
 	d.mu.Unlock()
 
+	return d.newDBIter(batch, memtables, current, seqNum, o)
+}
+
+// newDBIter constructs an iterator over batch, memtables and the tables in
+// current, which reads the entries visible at seqNum. The iterator takes over
+// the caller's reference on current.
+func (d *DB) newDBIter(
+	batch *Batch, memtables []*memTable, current *version, seqNum uint64, o *db.IterOptions,
+) *dbIter {
 	var buf struct {
 		dbi    dbIter
 		iters  [3 + numLevels]db.InternalIterator
@@ -306,13 +639,21 @@ func (d *DB) newIterInternal(batchIter db.InternalIterator, o *db.IterOptions) d
 	}
 
 	dbi := &buf.dbi
+	dbi.db = d
 	dbi.cmp = d.cmp
+	dbi.split = d.opts.Comparer.Split
 	dbi.merge = d.merge
+	dbi.batch = batch
+	dbi.memtables = memtables
 	dbi.version = current
+	dbi.seqNum = seqNum
+	if o != nil {
+		dbi.opts = *o
+	}
 
 	iters := buf.iters[:0]
-	if batchIter != nil {
-		iters = append(iters, batchIter)
+	if batch != nil {
+		iters = append(iters, batch.newInternalIter(o))
 	}
 
 	for i := len(memtables) - 1; i >= 0; i-- {
@@ -320,14 +661,64 @@ func (d *DB) newIterInternal(batchIter db.InternalIterator, o *db.IterOptions) d
 		iters = append(iters, mem.NewIter(o))
 	}
 
+	newIter := d.newIter
+	ts := dbi.opts.Timestamp
+	if ts != nil && d.opts.Comparer.CompareTimestamps == nil {
+		ts = nil
+	}
+	verify := dbi.opts.VerifyChecksums
+	if ts != nil || verify {
+		// Allow the sstable iterators to skip the data blocks which only hold
+		// keys newer than the timestamp, and force them to verify the
+		// checksums of the blocks they read.
+		newIter = func(meta *fileMetadata) (db.InternalIterator, error) {
+			iter, err := d.newIter(meta)
+			if err != nil {
+				return nil, err
+			}
+			if t, ok := iter.(*tableCacheIter); ok {
+				if ts != nil {
+					t.tableIter.SetTimestamp(ts)
+				}
+				t.tableIter.SetVerifyChecksums(verify)
+			}
+			return iter, nil
+		}
+	}
+
+	// Consult the table filter using the properties of the cached table
+	// readers, which does not read any data blocks.
+	var tableFilter func(meta *fileMetadata) (bool, error)
+	if filter := dbi.opts.TableFilter; filter != nil {
+		tableFilter = func(meta *fileMetadata) (bool, error) {
+			var ok bool
+			err := d.tableCache.withReader(meta, func(r *sstable.Reader) error {
+				ok = filter(r.Properties.UserProperties)
+				return nil
+			})
+			return ok, err
+		}
+	}
+
 	// The level 0 files need to be added from newest to oldest.
 	for i := len(current.files[0]) - 1; i >= 0; i-- {
 		f := &current.files[0][i]
-		iter, err := d.newIter(f)
+		if tableFilter != nil {
+			ok, err := tableFilter(f)
+			if err != nil {
+				dbi.err = err
+				return dbi
+			}
+			if !ok {
+				continue
+			}
+		}
+		iter, err := newIter(f)
 		if err != nil {
 			dbi.err = err
 			return dbi
 		}
+		setReadStats(iter, &d.readStats.Iter[0])
 		iters = append(iters, iter)
 	}
 
@@ -347,12 +738,16 @@ func (d *DB) newIterInternal(batchIter db.InternalIterator, o *db.IterOptions) d
 			li = &levelIter{}
 		}
 
-		li.init(d.cmp, d.newIter, current.files[level])
+		li.init(&dbi.opts, d.cmp, newIter, current.files[level])
+		li.tableFilter = tableFilter
+		li.readStats = &d.readStats.Iter[level]
 		iters = append(iters, li)
 	}
 
 	dbi.iter = newMergingIter(d.cmp, iters...)
-	dbi.seqNum = seqNum
+	if ts != nil {
+		dbi.iter = newTimestampIter(d.opts.Comparer, dbi.iter, ts)
+	}
 	return dbi
 }
 
@@ -360,7 +755,33 @@ func (d *DB) newIterInternal(batchIter db.InternalIterator, o *db.IterOptions) d
 // return false). The iterator can be positioned via a call to SeekGE,
 // SeekLT, First or Last.
 func (d *DB) NewIter(o *db.IterOptions) db.Iterator {
-	return d.newIterInternal(nil, o)
+	return d.newIterInternal(nil, nil, o)
+}
+
+// LatestSeqNum returns the sequence number of the most recent write which is
+// visible to reads. Every committed write has a sequence number less than or
+// equal to the returned value.
+func (d *DB) LatestSeqNum() uint64 {
+	return d.lastVisibleSeqNum()
+}
+
+// NewIterAt returns an iterator over the DB state as of the specified
+// sequence number: only writes with sequence numbers less than or equal to
+// seqNum are visible. The sequence number must not be larger than
+// LatestSeqNum, otherwise the returned iterator's Error method reports an
+// error.
+//
+// Unlike a Snapshot, NewIterAt does not prevent compactions from dropping the
+// older versions of keys, so the iterator's view is only exact if the entries
+// visible at seqNum have been retained, such as by an open Snapshot whose
+// sequence number is no larger than seqNum. NewIterAt is intended for layers
+// above pebble which track sequence numbers themselves, and for tests.
+func (d *DB) NewIterAt(seqNum uint64, o *db.IterOptions) db.Iterator {
+	if latest := d.LatestSeqNum(); seqNum > latest {
+		return &dbIter{err: fmt.Errorf("pebble: sequence number %d is newer than the latest sequence number %d",
+			seqNum, latest)}
+	}
+	return d.newIterInternal(nil, &Snapshot{seqNum: seqNum}, o)
 }
 
 // NewBatch returns a new empty write-only batch. Any reads on the batch will
@@ -389,14 +810,35 @@ func (d *DB) Close() error {
 	if d.mu.closed {
 		return nil
 	}
+	if s := d.scrubber; s != nil {
+		d.scrubber = nil
+		d.mu.Unlock()
+		s.stop()
+		d.mu.Lock()
+	}
 	for d.mu.compact.compacting || d.mu.compact.flushing {
 		d.mu.compact.cond.Wait()
 	}
 	err := d.tableCache.Close()
-	err = firstError(err, d.mu.log.Close())
-	err = firstError(err, d.fileLock.Close())
+	if !d.opts.ReadOnly {
+		d.deleter.close()
+		if d.mu.log.LogWriter != nil {
+			err = firstError(err, d.mu.log.Close())
+		}
+		err = firstError(err, d.fileLock.Close())
+	}
 	d.commit.Close()
 	d.mu.closed = true
+	// The keyspaces are closed after the commit pipeline, as committed batches
+	// may have entries for their memtables.
+	for _, k := range d.mu.keyspaces {
+		err = firstError(err, k.d.Close())
+	}
+	// Restore the capacity of a block cache shrunk to fit the memory budget,
+	// as the cache may outlive the DB.
+	if d.opts.MemoryBudget > 0 {
+		d.opts.Cache.SetCapacity(d.mu.memory.cacheCapacity)
+	}
 	return err
 }
 
@@ -407,19 +849,185 @@ func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
 	panic("pebble.DB: Compact unimplemented")
 }
 
-// Flush the memtable to stable storage.
+// Flush the memtable to stable storage. An error is returned if the DB has a
+// sticky background error, including one that occurs while waiting for the
+// flush.
 //
-// TODO(peter): untested
+// The memtables are flushed in order, and the memtables flushed together are
+// applied to the LSM atomically along with the number of the oldest WAL which
+// still holds unflushed entries. Recovery from a crash therefore never replays
+// entries which have been flushed, nor skips entries which have not.
 func (d *DB) Flush() error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
 	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.backgroundError(); err != nil {
+		return err
+	}
 	mem := d.mu.mem.mutable
-	err := d.makeRoomForWrite(nil)
-	d.mu.Unlock()
-	if err != nil {
+	if err := d.makeRoomForWrite(nil); err != nil {
 		return err
 	}
-	<-mem.flushed
-	return nil
+	for {
+		select {
+		case <-mem.flushed:
+			return nil
+		default:
+		}
+		if err := d.backgroundError(); err != nil {
+			return err
+		}
+		d.mu.compact.cond.Wait()
+	}
+}
+
+// SSTableInfo describes a single sstable in the LSM.
+type SSTableInfo struct {
+	// FileNum is the file number of the table.
+	FileNum uint64
+	// Size is the size of the table, in bytes.
+	Size uint64
+	// Smallest and Largest are the inclusive bounds for the internal keys
+	// stored in the table.
+	Smallest db.InternalKey
+	Largest  db.InternalKey
+	// SmallestSeqNum and LargestSeqNum are the smallest and largest sequence
+	// numbers stored in the table.
+	SmallestSeqNum uint64
+	LargestSeqNum  uint64
+	// Properties are the table's properties, such as the number of entries and
+	// deletions, the raw key and value sizes, the compression and the user
+	// properties. Only populated if requested with WithProperties.
+	Properties *sstable.Properties
+	// Garbage is the estimated size of the dead data which compacting the
+	// table would reclaim. Only populated if requested with WithGarbage.
+	Garbage TableGarbage
+}
+
+// SSTablesOption sets an option for DB.SSTables.
+type SSTablesOption func(*sstablesOptions)
+
+type sstablesOptions struct {
+	withProperties bool
+	withGarbage    bool
+}
+
+// WithProperties directs DB.SSTables to load the properties of each table,
+// which requires opening every table in the LSM.
+func WithProperties() SSTablesOption {
+	return func(o *sstablesOptions) {
+		o.withProperties = true
+	}
+}
+
+// WithGarbage directs DB.SSTables to estimate the garbage of each table,
+// which requires opening every table in the LSM. See TableGarbage.
+func WithGarbage() SSTablesOption {
+	return func(o *sstablesOptions) {
+		o.withGarbage = true
+	}
+}
+
+// SSTables describes the sstables in each level of the LSM, indexed by
+// level. Within L0 tables are ordered from oldest to newest. Within the other
+// levels tables are ordered by key.
+type SSTables [][]SSTableInfo
+
+// String returns a human-readable summary of the LSM: the number of tables
+// and total size of each non-empty level followed by the individual tables.
+func (s SSTables) String() string {
+	var buf bytes.Buffer
+	for level := range s {
+		if len(s[level]) == 0 {
+			continue
+		}
+		var size uint64
+		for i := range s[level] {
+			size += s[level][i].Size
+		}
+		fmt.Fprintf(&buf, "L%d: %d files, %d bytes\n", level, len(s[level]), size)
+		for i := range s[level] {
+			t := &s[level][i]
+			fmt.Fprintf(&buf, "  %06d: %d bytes [%s-%s] seqnums [%d-%d]\n",
+				t.FileNum, t.Size, t.Smallest, t.Largest, t.SmallestSeqNum, t.LargestSeqNum)
+		}
+	}
+	return buf.String()
+}
+
+// SSTables retrieves the current sstables in the LSM. The returned keys and
+// properties are copies and may be retained by the caller.
+func (d *DB) SSTables(opts ...SSTablesOption) (SSTables, error) {
+	var o sstablesOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	current.ref()
+	d.mu.Unlock()
+	defer current.unref()
+
+	var garbage [][]TableGarbage
+	if o.withGarbage {
+		var err error
+		garbage, err = d.estimateGarbage(current)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := make(SSTables, numLevels)
+	for level := range current.files {
+		files := current.files[level]
+		if len(files) == 0 {
+			continue
+		}
+		s[level] = make([]SSTableInfo, len(files))
+		for i := range files {
+			f := &files[i]
+			s[level][i] = SSTableInfo{
+				FileNum:        f.fileNum,
+				Size:           f.size,
+				Smallest:       f.smallest.Clone(),
+				Largest:        f.largest.Clone(),
+				SmallestSeqNum: f.smallestSeqNum,
+				LargestSeqNum:  f.largestSeqNum,
+			}
+			if garbage != nil {
+				s[level][i].Garbage = garbage[level][i]
+			}
+			if !o.withProperties {
+				continue
+			}
+			err := d.tableCache.withReader(f, func(r *sstable.Reader) error {
+				// The reader's maps are shared with the table cache. Copy them so
+				// that the caller may retain or modify the properties.
+				props := r.Properties
+				if r.Properties.UserProperties != nil {
+					props.UserProperties = make(map[string]string, len(r.Properties.UserProperties))
+					for k, v := range r.Properties.UserProperties {
+						props.UserProperties[k] = v
+					}
+				}
+				if r.Properties.ValueOffsets != nil {
+					props.ValueOffsets = make(map[string]uint64, len(r.Properties.ValueOffsets))
+					for k, v := range r.Properties.ValueOffsets {
+						props.ValueOffsets[k] = v
+					}
+				}
+				s[level][i].Properties = &props
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
 }
 
 // firstError returns the first non-nil error of err0 and err1, or nil if both
@@ -431,25 +1039,47 @@ func firstError(err0, err1 error) error {
 	return err1
 }
 
-// writeLevel0Table writes a memtable to a level-0 on-disk table.
+// writeLevel0Table writes a memtable to level-0 on-disk tables. The output is
+// split into multiple tables so that the subsequent compactions of the tables
+// are narrow: when a table reaches the target file size of level 0, where
+// requested by Options.SplitCompactionOutput, and at the boundaries of the
+// tables in the base level, the first level below level 0 which has any
+// tables. The entries for a single user key are never split across tables.
 //
-// If no error is returned, it adds the file number of that on-disk table to
-// d.pendingOutputs. It is the caller's responsibility to remove that fileNum
-// from that set when it has been applied to d.mu.versions.
+// If no error is returned, it adds the file numbers of the on-disk tables to
+// d.pendingOutputs. It is the caller's responsibility to remove those fileNums
+// from that set when they have been applied to d.mu.versions. The progress of
+// the flush is recorded in j, if non-nil.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
 func (d *DB) writeLevel0Table(
-	fs storage.Storage, iter db.InternalIterator,
-) (meta fileMetadata, err error) {
-	meta.fileNum = d.mu.versions.nextFileNum()
-	filename := dbFilename(d.dirname, fileTypeTable, meta.fileNum)
-	d.mu.compact.pendingOutputs[meta.fileNum] = struct{}{}
-	defer func(fileNum uint64) {
+	fs storage.Storage, iter db.InternalIterator, j *job,
+) (metas []fileMetadata, err error) {
+	// The output is aligned with the boundaries between the tables in the base
+	// level, which are the smallest keys of the tables other than the first.
+	var baseBoundaries [][]byte
+	current := d.mu.versions.currentVersion()
+	for level := 1; level < numLevels; level++ {
+		if files := current.files[level]; len(files) > 0 {
+			for i := 1; i < len(files); i++ {
+				baseBoundaries = append(baseBoundaries, files[i].smallest.UserKey)
+			}
+			break
+		}
+	}
+	alignBase := db.GuardKeys(d.cmp, baseBoundaries)
+	targetFileSize := uint64(d.opts.Level(0).TargetFileSize)
+	split := d.opts.SplitCompactionOutput
+
+	var pendingOutputs []uint64
+	defer func() {
 		if err != nil {
-			delete(d.mu.compact.pendingOutputs, fileNum)
+			for _, fileNum := range pendingOutputs {
+				delete(d.mu.compact.pendingOutputs, fileNum)
+			}
 		}
-	}(meta.fileNum)
+	}()
 
 	// Release the d.mu lock while doing I/O.
 	// Note the unusual order: Unlock and then Lock.
@@ -457,8 +1087,9 @@ func (d *DB) writeLevel0Table(
 	defer d.mu.Lock()
 
 	var (
-		file storage.File
-		tw   *sstable.Writer
+		filename string
+		tw       *sstable.Writer
+		meta     fileMetadata
 	)
 	defer func() {
 		if iter != nil {
@@ -468,59 +1099,98 @@ func (d *DB) writeLevel0Table(
 			err = firstError(err, tw.Close())
 		}
 		if err != nil {
-			fs.Remove(filename)
-			meta = fileMetadata{}
+			if filename != "" {
+				fs.Remove(filename)
+			}
+			for i := range metas {
+				fs.Remove(dbFilename(d.dirname, fileTypeTable, metas[i].fileNum))
+			}
+			metas = nil
 		}
 	}()
 
+	// The size of the finished tables.
+	var written uint64
+	finishOutput := func() error {
+		meta.largest = meta.largest.Clone()
+		err := tw.Close()
+		if err != nil {
+			tw = nil
+			return err
+		}
+		stat, err := tw.Stat()
+		tw = nil
+		if err != nil {
+			return err
+		}
+		size := stat.Size()
+		if size < 0 {
+			return fmt.Errorf("pebble: table file %q has negative size %d", filename, size)
+		}
+		meta.size = uint64(size)
+		metas = append(metas, meta)
+		written += meta.size
+		j.setBytesWritten(written)
+		j.setBuffered(0)
+		filename = ""
+		return nil
+	}
+
 	iter.First()
 	if !iter.Valid() {
-		return fileMetadata{}, fmt.Errorf("pebble: memtable empty")
+		return nil, fmt.Errorf("pebble: memtable empty")
 	}
 
-	file, err = fs.Create(filename)
-	if err != nil {
-		return fileMetadata{}, err
-	}
-	file = newRateLimitedFile(file, d.flushController)
-	tw = sstable.NewWriter(file, d.opts, d.opts.Level(0))
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if tw != nil && d.cmp(meta.largest.UserKey, key.UserKey) != 0 &&
+			(tw.EstimatedSize() >= targetFileSize ||
+				alignBase(meta.largest.UserKey, key.UserKey) ||
+				(split != nil && split(meta.largest.UserKey, key.UserKey))) {
+			if err := finishOutput(); err != nil {
+				return nil, err
+			}
+		}
 
-	meta.smallest = iter.Key().Clone()
-	for {
-		// TODO(peter): support c.shouldStopBefore.
+		if tw == nil {
+			d.mu.Lock()
+			fileNum := d.mu.versions.nextFileNum()
+			d.mu.compact.pendingOutputs[fileNum] = struct{}{}
+			pendingOutputs = append(pendingOutputs, fileNum)
+			d.mu.Unlock()
 
-		meta.largest = iter.Key()
-		if err1 := tw.Add(meta.largest, iter.Value()); err1 != nil {
-			return fileMetadata{}, err1
+			filename = dbFilename(d.dirname, fileTypeTable, fileNum)
+			file, err := fs.Create(filename)
+			if err != nil {
+				return nil, err
+			}
+			file = newRateLimitedFile(file, d.flushController)
+			tw = d.newTableWriter(file, 0)
+			meta = fileMetadata{
+				fileNum:        fileNum,
+				smallest:       key.Clone(),
+				smallestSeqNum: db.InternalKeySeqNumMax,
+			}
 		}
-		if !iter.Next() {
-			break
+
+		meta.largest = key
+		meta.updateSeqNum(key.SeqNum())
+		if err := tw.Add(key, iter.Value()); err != nil {
+			return nil, err
 		}
+		j.setBytesWritten(written + tw.EstimatedSize())
+		j.setBuffered(tw.BufferedSize())
+	}
+	if err := finishOutput(); err != nil {
+		return nil, err
 	}
-	meta.largest = meta.largest.Clone()
 
-	if err1 := iter.Close(); err1 != nil {
+	if err := iter.Close(); err != nil {
 		iter = nil
-		return fileMetadata{}, err1
+		return nil, err
 	}
 	iter = nil
 
-	if err1 := tw.Close(); err1 != nil {
-		tw = nil
-		return fileMetadata{}, err1
-	}
-
-	stat, err := tw.Stat()
-	if err != nil {
-		return fileMetadata{}, err
-	}
-	size := stat.Size()
-	if size < 0 {
-		return fileMetadata{}, fmt.Errorf("pebble: table file %q has negative size %d", filename, size)
-	}
-	meta.size = uint64(size)
-	tw = nil
-
 	// TODO(peter): After a flush we set the commit rate to 110% of the flush
 	// rate. The rationale behind the 110% is to account for slack. Investigate a
 	// more principled way of setting this.
@@ -531,7 +1201,7 @@ func (d *DB) writeLevel0Table(
 
 	// TODO(peter): compaction stats.
 
-	return meta, nil
+	return metas, nil
 }
 
 func (d *DB) throttleWrite() {
@@ -545,9 +1215,51 @@ func (d *DB) throttleWrite() {
 	// latency variance.
 	//
 	// TODO(peter): Use more sophisticated rate limiting.
+	start := time.Now()
 	d.mu.Unlock()
 	time.Sleep(1 * time.Millisecond)
 	d.mu.Lock()
+	d.mu.metrics.Stall.Count++
+	d.mu.metrics.Stall.Duration += time.Since(start)
+}
+
+// waitForStall waits for a flush or compaction to make room for writes which
+// are stopped, recording the stall in the metrics. It returns the sticky
+// background error, if there is one before or after waiting, as no flush or
+// compaction will then make room until ResumeBackgroundWork is called.
+//
+// d.mu must be held when calling this.
+func (d *DB) waitForStall() error {
+	if err := d.backgroundError(); err != nil {
+		return err
+	}
+	start := time.Now()
+	d.mu.compact.cond.Wait()
+	d.mu.metrics.Stall.Count++
+	d.mu.metrics.Stall.Duration += time.Since(start)
+	return d.backgroundError()
+}
+
+// walFile is the file number and size of a WAL.
+type walFile struct {
+	fileNum uint64
+	size    uint64
+}
+
+// newLogWriter returns a LogWriter for a new WAL file, configured by the
+// options of the DB. The batches are compressed only if the format major
+// version of the DB permits it, so that the WAL can be replayed by the
+// versions of pebble which can open the DB.
+func (d *DB) newLogWriter(f storage.File) *record.LogWriter {
+	var opts []record.Option
+	if d.opts.WALCompression == db.SnappyCompression &&
+		d.FormatMajorVersion() >= db.FormatCompressedWAL {
+		opts = append(opts, record.Compress(record.SnappyCompression))
+	}
+	w := record.NewLogWriter(f, opts...)
+	w.SetSyncLatencyHistogram(&d.walSyncLatency)
+	w.SetFlushThresholds(d.opts.WALFlushBytes, d.opts.WALFlushInterval)
+	return w
 }
 
 func (d *DB) makeRoomForWrite(b *Batch) error {
@@ -571,13 +1283,17 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 			// We have filled up the current memtable, but the previous one is still
 			// being compacted, so we wait.
 			// fmt.Printf("memtable stop writes threshold\n")
-			d.mu.compact.cond.Wait()
+			if err := d.waitForStall(); err != nil {
+				return err
+			}
 			continue
 		}
 		if len(d.mu.versions.currentVersion().files[0]) > d.opts.L0StopWritesThreshold {
 			// There are too many level-0 files, so we wait.
 			// fmt.Printf("L0 stop writes threshold\n")
-			d.mu.compact.cond.Wait()
+			if err := d.waitForStall(); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -586,6 +1302,14 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 		d.mu.Unlock()
 
 		newLogFile, err := d.opts.Storage.Create(dbFilename(d.dirname, fileTypeLog, newLogNumber))
+		if err == nil {
+			// Sync the directory so that writes synced to the new log survive a
+			// crash.
+			err = syncDir(d.opts.Storage, d.dirname)
+			if err != nil {
+				newLogFile.Close()
+			}
+		}
 		if err == nil {
 			err = d.mu.log.Close()
 			if err != nil {
@@ -609,10 +1333,18 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 		// NB: When the immutable memtable is flushed to disk it will apply a
 		// versionEdit to the manifest telling it that log files < d.mu.log.number
 		// have been applied.
+		d.mu.log.retired = append(d.mu.log.retired, walFile{
+			fileNum: d.mu.log.number,
+			size:    uint64(d.mu.log.Size()),
+		})
 		d.mu.log.number = newLogNumber
-		d.mu.log.LogWriter = record.NewLogWriter(newLogFile)
+		d.mu.log.LogWriter = d.newLogWriter(newLogFile)
+		if err := d.writePrepared(); err != nil {
+			panic(err)
+		}
 		imm := d.mu.mem.mutable
 		d.mu.mem.mutable = newMemTable(d.opts)
+		d.mu.mem.mutable.logNum = newLogNumber
 		d.mu.mem.queue = append(d.mu.mem.queue, d.mu.mem.mutable)
 		if imm.unref() {
 			d.maybeScheduleFlush()
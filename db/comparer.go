@@ -42,13 +42,56 @@ type Separator func(dst, a, b []byte) []byte
 // key, though it is valid to pass a nil.
 type Successor func(dst, a []byte) []byte
 
+// PrefixSuccessor returns the smallest key which is greater than every key
+// with the byte prefix a, or nil if there is no such key. The dst parameter
+// may be used to store the returned key, though it is valid to pass a nil.
+type PrefixSuccessor func(dst, a []byte) []byte
+
+// Split returns the length of the prefix of the user key a which is used by
+// prefix iteration and filters. For example, if keys are composed of a row
+// followed by a version, using the row as the prefix allows a filter to rule
+// out every version of a row with a single check.
+//
+// The prefix of a key is a[:Split(a)]. The keys which share a prefix must be
+// contiguous in the ordering defined by Compare, and the ordering of the
+// prefixes must be consistent with the ordering of the keys: if Compare(a, b)
+// < 0 then Compare(a[:Split(a)], b[:Split(b)]) <= 0.
+type Split func(a []byte) int
+
+// CompareTimestamps returns -1, 0, or +1 depending on whether the timestamp
+// a is older than, the same as, or newer than the timestamp b. Neither
+// timestamp is empty.
+type CompareTimestamps func(a, b []byte) int
+
 // Comparer defines a total ordering over the space of []byte keys: a 'less
 // than' relationship.
+//
+// Separator and Successor are used by the sstable writer to shorten the keys
+// stored in index blocks. They are optional: if nil, index keys are the full
+// last key of each block.
+//
+// Split is optional: if nil, the prefix of a key is the entire key, and the
+// filters are built over whole keys.
+//
+// PrefixSuccessor is optional, and is required by DB.DeletePrefix. Unlike
+// Successor, which may return any key no smaller than its argument, it must
+// return the exact end of the range of keys sharing a prefix.
+//
+// CompareTimestamps is optional. If set, together with Split, the suffix of a
+// user key following its prefix is a timestamp, and the keys sharing a prefix
+// are the versions of a row at different timestamps, as in an MVCC system.
+// An empty suffix denotes a key without a timestamp. Timestamps allow reads
+// at a timestamp (see IterOptions.Timestamp), and tables record the range of
+// the timestamps in each data block so that such reads can skip the blocks
+// holding only newer versions.
 type Comparer struct {
-	Compare   Compare
-	InlineKey InlineKey
-	Separator Separator
-	Successor Successor
+	Compare           Compare
+	InlineKey         InlineKey
+	Separator         Separator
+	Split             Split
+	Successor         Successor
+	PrefixSuccessor   PrefixSuccessor
+	CompareTimestamps CompareTimestamps
 
 	// Name is the name of the comparer.
 	//
@@ -58,6 +101,15 @@ type Comparer struct {
 	Name string
 }
 
+// Timestamp returns the timestamp of the user key, which is empty if the key
+// has no timestamp or if the comparer does not support timestamps.
+func (c *Comparer) Timestamp(key []byte) []byte {
+	if c.CompareTimestamps == nil || c.Split == nil {
+		return nil
+	}
+	return key[c.Split(key):]
+}
+
 // DefaultComparer is the default implementation of the Comparer interface.
 // It uses the natural ordering, consistent with bytes.Compare.
 var DefaultComparer = &Comparer{
@@ -121,6 +173,17 @@ var DefaultComparer = &Comparer{
 		return append(dst, a...)
 	},
 
+	PrefixSuccessor: func(dst, a []byte) []byte {
+		for i := len(a) - 1; i >= 0; i-- {
+			if a[i] != 0xff {
+				dst = append(dst, a[:i+1]...)
+				dst[len(dst)-1]++
+				return dst
+			}
+		}
+		return nil
+	},
+
 	// This name is part of the C++ Level-DB implementation's default file
 	// format, and should not be changed.
 	Name: "leveldb.BytewiseComparator",
@@ -49,3 +49,25 @@ func TestDefAppendSeparator(t *testing.T) {
 		})
 	}
 }
+
+func TestDefPrefixSuccessor(t *testing.T) {
+	testCases := []struct {
+		a, want string
+	}{
+		{"", ""},
+		{"1", "2"},
+		{"13", "14"},
+		{"1\xff", "2"},
+		{"1\xff\xff", "2"},
+		{"\xff", ""},
+		{"\xff\xff", ""},
+	}
+	for _, tc := range testCases {
+		t.Run("", func(t *testing.T) {
+			got := string(DefaultComparer.PrefixSuccessor(nil, []byte(tc.a)))
+			if got != tc.want {
+				t.Errorf("a = %q: got %q, want %q", tc.a, got, tc.want)
+			}
+		})
+	}
+}
@@ -55,6 +55,16 @@ type Iterator interface {
 	// than or equal to the given key.
 	SeekGE(key []byte)
 
+	// SeekPrefixGE moves the iterator to the first key/value pair whose key is
+	// greater than or equal to the given key and which shares the prefix of the
+	// given key, as defined by Comparer.Split. The iterator then only returns
+	// the key/value pairs with that prefix: it is exhausted once it has moved
+	// past the last such pair. A prefix seek can skip the tables whose filters
+	// rule out the prefix, making it cheaper than SeekGE. Prev is not supported
+	// after a prefix seek and exhausts the iterator. The iterator leaves prefix
+	// iteration mode on the next call to SeekGE, SeekLT, First or Last.
+	SeekPrefixGE(key []byte)
+
 	// SeekLT moves the iterator to the last key/value pair whose key is less
 	// than the given key.
 	SeekLT(key []byte)
@@ -74,15 +84,27 @@ type Iterator interface {
 	Prev() bool
 
 	// Key returns the key of the current key/value pair, or nil if done.
-	// The caller should not modify the contents of the returned slice, and
-	// its contents may change on the next call to Next.
+	// The caller should not modify the contents of the returned slice. The
+	// slice remains valid until the next call to a method which repositions
+	// the iterator (SeekGE, SeekPrefixGE, SeekLT, First, Last, Next or Prev),
+	// or to SetBounds or Close, after which its contents may change. A caller
+	// which needs the key for longer must copy it.
 	Key() []byte
 
-	// Value returns the value of the current key/value pair, or nil if done.
-	// The caller should not modify the contents of the returned slice, and
-	// its contents may change on the next call to Next.
+	// Value returns the value of the current key/value pair, or nil if done or
+	// if the value could not be retrieved, in which case Error returns the
+	// cause. The caller should not modify the contents of the returned slice,
+	// which is valid for the same duration as the slice returned by Key. The
+	// slice may refer to a block of an sstable, which the iterator keeps
+	// pinned until it is repositioned or closed.
 	Value() []byte
 
+	// ValueAndErr returns the value of the current key/value pair together
+	// with any error encountered while retrieving it, so that an empty value
+	// can be distinguished from a value which could not be read. The returned
+	// slice has the same lifetime as the slice returned by Value.
+	ValueAndErr() ([]byte, error)
+
 	// Valid returns true if the iterator is positioned at a valid key/value pair
 	// and false otherwise.
 	Valid() bool
@@ -90,6 +112,32 @@ type Iterator interface {
 	// Error returns any accumulated error.
 	Error() error
 
+	// SetBounds sets the lower (inclusive) and upper (exclusive) bounds of the
+	// keys returned by the iterator, replacing the bounds set by
+	// IterOptions.LowerBound and IterOptions.UpperBound. A nil bound leaves the
+	// key space unbounded in that direction. The iterator is left unpositioned,
+	// and retains its view of the underlying data, so re-bounding an iterator
+	// is cheaper than creating a new one. The caller must not modify the
+	// contents of the bounds until they are replaced or the iterator is closed.
+	SetBounds(lower, upper []byte)
+
+	// Prepare prefetches the data read by the first seek into the key range
+	// [start, end), avoiding the latency of reading it from disk, which is
+	// most noticeable after the DB is opened. It opens the tables overlapping
+	// the range, whose indexes and filters are read when they are opened, and
+	// reads the data block holding start, or the first data block of a table
+	// starting after it, into the block cache. A nil start or end leaves the
+	// range unbounded in that direction. The iterator is not repositioned, and
+	// an error returned by Prepare is not retained by the iterator. See also
+	// Options.PrewarmLevels.
+	Prepare(start, end []byte) error
+
+	// Clone returns a new unpositioned iterator with the same view of the
+	// underlying data and the same bounds as the receiver. Writes made after
+	// the receiver was created are not visible to the clone. The clone must be
+	// closed independently of the receiver.
+	Clone() Iterator
+
 	// Close closes the iterator and returns any accumulated error. Exhausting
 	// all the key/value pairs in a table is not considered to be an error.
 	// It is valid to call Close multiple times. Other methods should not be
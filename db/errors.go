@@ -0,0 +1,85 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// FileType enumerates the types of files found in a DB.
+type FileType int
+
+// The FileType enumeration.
+const (
+	FileTypeLog FileType = iota
+	FileTypeLock
+	FileTypeTable
+	FileTypeManifest
+	FileTypeCurrent
+)
+
+func (t FileType) String() string {
+	switch t {
+	case FileTypeLog:
+		return "log"
+	case FileTypeLock:
+		return "lock"
+	case FileTypeTable:
+		return "table"
+	case FileTypeManifest:
+		return "manifest"
+	case FileTypeCurrent:
+		return "current"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrCorruption is the error matched by every CorruptionError when compared
+// using errors.Is.
+var ErrCorruption = errors.New("pebble: corruption")
+
+// CorruptionError is returned when on-disk data is found to be corrupt. It
+// identifies the damaged file, and the offset of the damage within the file
+// when known, so that the file can be quarantined.
+type CorruptionError struct {
+	// FileType is the type of the corrupted file.
+	FileType FileType
+	// Path is the path of the corrupted file. Path is empty if the path is not
+	// known.
+	Path string
+	// FileNum is the file number of the corrupted file.
+	FileNum uint64
+	// Offset is the offset within the file of the corrupted block, or -1 if
+	// the offset is not known.
+	Offset int64
+	// Err is the underlying error describing the corruption.
+	Err error
+}
+
+func (e *CorruptionError) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "pebble: corruption in %s %06d", e.FileType, e.FileNum)
+	if e.Path != "" {
+		fmt.Fprintf(&buf, " (%s)", e.Path)
+	}
+	if e.Offset >= 0 {
+		fmt.Fprintf(&buf, " at offset %d", e.Offset)
+	}
+	fmt.Fprintf(&buf, ": %v", e.Err)
+	return buf.String()
+}
+
+// Unwrap returns the underlying error.
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is ErrCorruption.
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package db
+
+import "time"
+
+// DiskSlowInfo contains the info for a disk slowness event.
+type DiskSlowInfo struct {
+	// Path is the path of the file being written or synced.
+	Path string
+	// Op is the operation, either "write" or "sync".
+	Op string
+	// Duration is how long the operation had taken when it was reported. The
+	// operation may still be in progress.
+	Duration time.Duration
+}
+
+// TableCorruptionInfo contains the info for a table corruption event.
+type TableCorruptionInfo struct {
+	// FileNum is the file number of the corrupted table.
+	FileNum uint64
+	// Offset is the offset within the table of the corrupted block. Offset is
+	// zero if the corruption was detected while opening the table.
+	Offset uint64
+	// Err is the error describing the corruption.
+	Err error
+}
+
+// UnknownKeyKindInfo contains the info for an event reporting an entry of an
+// unknown kind found by a compaction.
+type UnknownKeyKindInfo struct {
+	// Key is the key of the entry.
+	Key InternalKey
+	// Preserved is true if the entry was written to the output of the
+	// compaction, and false if it was dropped.
+	Preserved bool
+}
+
+// WALReplayInfo contains the info for the events reporting the replay of the
+// WALs by Open.
+type WALReplayInfo struct {
+	// Files is the number of WALs to replay, and Size their total size.
+	Files int
+	Size  uint64
+	// FileNum is the file number of the WAL being replayed, or of the last WAL
+	// replayed. It is zero for WALReplayBegin.
+	FileNum uint64
+	// BytesReplayed is the number of bytes of the WALs replayed so far.
+	BytesReplayed uint64
+	// Duration is the time elapsed since the replay began.
+	Duration time.Duration
+	// Err is the error which ended the replay, if any. It is only set for
+	// WALReplayEnd.
+	Err error
+}
+
+// EventListener contains a set of functions that will be invoked when various
+// significant DB events occur. Note that the functions should not run for an
+// excessive amount of time as they are invoked synchronously by the DB and may
+// block continued DB work. A nil function is ignored.
+type EventListener struct {
+	// BackgroundError is invoked whenever an error occurs during a background
+	// operation such as flush or compaction.
+	BackgroundError func(error)
+
+	// DiskSlow is invoked when a write or sync of a file takes longer than
+	// Options.DiskSlowThreshold.
+	DiskSlow func(DiskSlowInfo)
+
+	// TableCorruption is invoked when the background scrubber finds a corrupted
+	// table, and when a read finds the first corrupted block of a table, which
+	// is then rewritten by a compaction.
+	TableCorruption func(TableCorruptionInfo)
+
+	// UnknownKeyKind is invoked when a compaction skips or preserves an entry
+	// of an unknown kind, as determined by Options.UnknownKeyKindMode.
+	UnknownKeyKind func(UnknownKeyKindInfo)
+
+	// WALReplayBegin is invoked when Open begins replaying the WALs of the DB,
+	// if there are any. WALReplayProgress is invoked once each WAL has been
+	// replayed, and after every 64MB replayed within a WAL. WALReplayEnd is
+	// invoked once the replay has completed or failed. Together, they report
+	// the progress of an Open which has a large backlog of WALs to recover.
+	WALReplayBegin    func(WALReplayInfo)
+	WALReplayProgress func(WALReplayInfo)
+	WALReplayEnd      func(WALReplayInfo)
+}
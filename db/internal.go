@@ -47,16 +47,29 @@ const (
 	InternalKeyKindDelete InternalKeyKind = 0
 	InternalKeyKindSet                    = 1
 	InternalKeyKindMerge                  = 2
-	// InternalKeyKindLogData                                  = 3
-	// InternalKeyKindColumnFamilyDeletion                     = 4
+	// InternalKeyKindLogData is only found in batches and the WAL. Log data is
+	// never added to the memtable or sstables.
+	InternalKeyKindLogData = 3
+	// InternalKeyKindKeyspace is a marker which is only found in batches and
+	// the WAL. The key of the marker is the name of a keyspace, and the entries
+	// following the marker, up to the next keyspace marker, belong to that
+	// keyspace. An empty name denotes the default keyspace. The kind occupies
+	// the slot of RocksDB's column family deletion.
+	InternalKeyKindKeyspace = 4
 	// InternalKeyKindColumnFamilyValue                        = 5
 	// InternalKeyKindColumnFamilyMerge                        = 6
 	// InternalKeyKindSingleDelete                             = 7
 	// InternalKeyKindColumnFamilySingleDelete                 = 8
-	// InternalKeyKindBeginPrepareXID                          = 9
+	// InternalKeyKindBeginPrepareXID, InternalKeyKindCommitXID and
+	// InternalKeyKindRollbackXID are transaction markers which are only found
+	// in the WAL. The key of a marker is the ID of the transaction. A
+	// BeginPrepareXID marker is the first entry of a batch which has been
+	// prepared, and the entries following it are not applied until a batch
+	// starting with a CommitXID marker for the same transaction is written.
+	InternalKeyKindBeginPrepareXID = 9
 	// InternalKeyKindEndPrepareXID                            = 10
-	// InternalKeyKindCommitXID                                = 11
-	// InternalKeyKindRollbackXID                              = 12
+	InternalKeyKindCommitXID   = 11
+	InternalKeyKindRollbackXID = 12
 	// InternalKeyKindNoop                                     = 13
 	// InternalKeyKindColumnFamilyRangeDelete                  = 14
 	InternalKeyKindRangeDelete = 15
@@ -85,6 +98,27 @@ const (
 	InternalKeySeqNumMax = uint64(1<<56 - 1)
 )
 
+var internalKeyKindNames = []string{
+	InternalKeyKindDelete:          "DEL",
+	InternalKeyKindSet:             "SET",
+	InternalKeyKindMerge:           "MERGE",
+	InternalKeyKindLogData:         "LOGDATA",
+	InternalKeyKindKeyspace:        "KEYSPACE",
+	InternalKeyKindBeginPrepareXID: "BEGINPREPARE",
+	InternalKeyKindCommitXID:       "COMMIT",
+	InternalKeyKindRollbackXID:     "ROLLBACK",
+	InternalKeyKindRangeDelete:     "RANGEDEL",
+	InternalKeyKindMax:             "MAX",
+	InternalKeyKindInvalid:         "INVALID",
+}
+
+func (k InternalKeyKind) String() string {
+	if int(k) < len(internalKeyKindNames) && internalKeyKindNames[k] != "" {
+		return internalKeyKindNames[k]
+	}
+	return fmt.Sprintf("UNKNOWN:%d", k)
+}
+
 // InternalKey is a key used for the in-memory and on-disk partial DBs that
 // make up a pebble DB.
 //
@@ -307,6 +341,18 @@ type InternalIterator interface {
 	// than or equal to the given key.
 	SeekGE(key []byte)
 
+	// SeekPrefixGE moves the iterator to the first key/value pair whose key is
+	// greater than or equal to the given key, like SeekGE, where prefix is the
+	// prefix of key as defined by Comparer.Split. The caller is only interested
+	// in the key/value pairs whose keys share the prefix, which allows the
+	// iterator to skip data which cannot contain such keys, such as a table
+	// whose filter rules out the prefix. The iterator may therefore be exhausted
+	// before all of the keys greater than or equal to key have been returned,
+	// and the key/value pairs following those with the prefix are unspecified.
+	// Only Next and NextUserKey may be called until the iterator is
+	// repositioned by another seek.
+	SeekPrefixGE(prefix, key []byte)
+
 	// SeekLT moves the iterator to the last key/value pair whose key is less
 	// than the given key.
 	SeekLT(key []byte)
@@ -336,13 +382,14 @@ type InternalIterator interface {
 	PrevUserKey() bool
 
 	// Key returns the encoded internal key of the current key/value pair, or nil
-	// if done.  The caller should not modify the contents of the returned slice,
-	// and its contents may change on the next call to Next.
+	// if done. The caller should not modify the contents of the returned slice.
+	// The slice remains valid until the iterator is repositioned or closed,
+	// after which its contents may change.
 	Key() InternalKey
 
 	// Value returns the value of the current key/value pair, or nil if done.
-	// The caller should not modify the contents of the returned slice, and
-	// its contents may change on the next call to Next.
+	// The caller should not modify the contents of the returned slice. The
+	// slice remains valid until the iterator is repositioned or closed.
 	Value() []byte
 
 	// Valid returns true if the iterator is positioned at a valid key/value pair
@@ -4,41 +4,59 @@
 
 package db
 
-// Merge merges oldValue and newValue, and returns the merged value. The buf
-// parameter can be used to store the newly merged value in order to avoid
-// memory allocations. The merge operation must be associative. That is, for
-// the values A, B, C:
-//
-//   Merge(A, Merge(B, C)) == Merge(Merge(A, B), C)
-//
-// Examples of merge operators are integer addition and list append.
-type Merge func(key, oldValue, newValue, buf []byte) []byte
-
-// Merger defines an associative merge operation. The merge operation merges
-// two or more values for a single key. A merge operation is required by
-// writing value using {Batch,DB}.Merge(). The value at that key is merged with
-// any existing value. It is valid to Set a value at a key and then Merge a new
-// value. Similar to non-merged values, a merged value can be deleted by either
-// Delete or DeleteRange.
+// MergeOperator defines an associative merge operation. The merge operation
+// merges two or more values for a single key. A merge operation is required
+// by writing value using {Batch,DB}.Merge(). The value at that key is merged
+// with any existing value. It is valid to Set a value at a key and then Merge
+// a new value. Similar to non-merged values, a merged value can be deleted by
+// either Delete or DeleteRange.
 //
 // The merge operation is invoked when a merge value is encountered during a
 // read, either during a compaction or during iteration.
-type Merger struct {
-	Merge Merge
+type MergeOperator interface {
+	// Name is the name of the merge operator.
+	//
+	// Pebble stores the merge operator name on disk, and opening a table written
+	// with a different merge operator from the one the database is configured
+	// with will result in an error.
+	Name() string
 
-	// Name is the name of the merger.
+	// FullMerge merges operand into existingValue and returns the merged
+	// value. The existingValue is nil if the key does not have an existing value
+	// (either because it was never set or because it was deleted). The buf
+	// parameter can be used to store the newly merged value in order to avoid
+	// memory allocations. FullMerge must not modify existingValue or operand.
+	FullMerge(key, existingValue, operand, buf []byte) []byte
+
+	// PartialMerge combines two merge operands for the same key, where newer
+	// was written after older, into a single operand. PartialMerge is used to
+	// collapse merge operands when the existing value for the key is not
+	// available, such as during a compaction that does not include the bottom
+	// of the LSM. If the operands cannot be combined without the existing value,
+	// PartialMerge returns false and the operands are retained separately. For
+	// an associative merge operation the result must satisfy:
+	//
+	//   FullMerge(FullMerge(V, older), newer) == FullMerge(V, PartialMerge(older, newer))
 	//
-	// Pebble stores the merger name on disk, and opening a database with a
-	// different merger from the one it was created with will result in an error.
-	Name string
+	// PartialMerge must not modify older or newer.
+	PartialMerge(key, older, newer, buf []byte) ([]byte, bool)
 }
 
-// DefaultMerger is the default implementation of the Merger interface. It
-// concatenates the two values to merge.
-var DefaultMerger = &Merger{
-	Merge: func(key, oldValue, newValue, buf []byte) []byte {
-		return append(append(buf, oldValue...), newValue...)
-	},
+type concatMerger struct{}
 
-	Name: "pebble.concatenate",
+func (concatMerger) Name() string {
+	return "pebble.concatenate"
 }
+
+func (concatMerger) FullMerge(key, existingValue, operand, buf []byte) []byte {
+	return append(append(buf, operand...), existingValue...)
+}
+
+func (concatMerger) PartialMerge(key, older, newer, buf []byte) ([]byte, bool) {
+	return append(append(buf, newer...), older...), true
+}
+
+// DefaultMerger is the default implementation of the MergeOperator
+// interface. It concatenates the two values to merge, with the newer value
+// prepended to the older value.
+var DefaultMerger MergeOperator = concatMerger{}
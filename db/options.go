@@ -5,6 +5,12 @@
 package db
 
 import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/storage"
 )
@@ -32,13 +38,135 @@ func (c Compression) String() string {
 	}
 }
 
-// FilterType is the level at which to apply a filter: block or table.
+// WALRecoveryMode controls how Open handles corrupted or incomplete records
+// in the write-ahead logs it replays.
+type WALRecoveryMode int
+
+// The available WAL recovery modes.
+const (
+	// TolerateCorruptedTailRecords ignores an incomplete or corrupted record
+	// at the end of a log, such as is left behind when the process crashes
+	// part-way through writing a record. Corruption in the middle of a log
+	// causes Open to fail.
+	TolerateCorruptedTailRecords WALRecoveryMode = iota
+	// AbsoluteConsistency causes Open to fail on any corrupted or incomplete
+	// record.
+	AbsoluteConsistency
+	// PointInTime stops replaying at the first corrupted or incomplete
+	// record, discarding the remainder of that log and all subsequent logs.
+	// The DB is recovered to a consistent point in time before the
+	// corruption.
+	PointInTime
+	// SkipAnyCorruptedRecords skips over corrupted records and continues
+	// replaying. This salvages as much data as possible, but the recovered DB
+	// may be missing writes from the middle of its history.
+	SkipAnyCorruptedRecords
+)
+
+func (m WALRecoveryMode) String() string {
+	switch m {
+	case TolerateCorruptedTailRecords:
+		return "TolerateCorruptedTailRecords"
+	case AbsoluteConsistency:
+		return "AbsoluteConsistency"
+	case PointInTime:
+		return "PointInTime"
+	case SkipAnyCorruptedRecords:
+		return "SkipAnyCorruptedRecords"
+	default:
+		return "Unknown"
+	}
+}
+
+// UnknownKeyKindMode controls how a compaction handles an entry whose internal
+// key kind it does not recognize, which indicates corruption or a table
+// written by a newer version of pebble.
+type UnknownKeyKindMode int
+
+// The available unknown key kind modes.
+const (
+	// FailOnUnknownKeyKind fails the compaction. The compaction is retried, and
+	// fails again, until the entry is removed, so the tables containing the
+	// entry are never compacted.
+	FailOnUnknownKeyKind UnknownKeyKindMode = iota
+	// SkipUnknownKeyKind drops the entry from the output of the compaction,
+	// as if it had never been written.
+	SkipUnknownKeyKind
+	// PreserveUnknownKeyKind writes the entry to the output of the compaction
+	// unchanged. The entry does not shadow the older entries for its key, which
+	// are compacted as if it were absent. Reads of the key continue to fail.
+	PreserveUnknownKeyKind
+)
+
+func (m UnknownKeyKindMode) String() string {
+	switch m {
+	case FailOnUnknownKeyKind:
+		return "FailOnUnknownKeyKind"
+	case SkipUnknownKeyKind:
+		return "SkipUnknownKeyKind"
+	case PreserveUnknownKeyKind:
+		return "PreserveUnknownKeyKind"
+	default:
+		return "Unknown"
+	}
+}
+
+// FormatMajorVersion is a version of the on-disk format of a DB. New table
+// and WAL features which older versions of pebble are unable to read are
+// gated on the format major version, which is recorded in the MANIFEST. The
+// format major version of a DB only increases, and only when explicitly
+// requested, so a DB can be reopened by an older version of pebble until it
+// is ratcheted past the newest version that older version supports.
+type FormatMajorVersion uint64
+
+// The available format major versions.
+const (
+	// FormatDefault leaves the format major version unspecified. New DBs are
+	// created with FormatMostCompatible and the format major version of an
+	// existing DB is left unchanged.
+	FormatDefault FormatMajorVersion = iota
+	// FormatMostCompatible is the format written by versions of pebble which
+	// predate format major versions, and is readable by all versions.
+	FormatMostCompatible
+	// FormatPartitionedFilters permits sstables to be written with
+	// PartitionedFilter filters. At older format major versions, levels
+	// configured to use partitioned filters are written with table filters.
+	FormatPartitionedFilters
+	// FormatVirtualSSTables permits the MANIFEST to contain virtual sstables,
+	// which reference a portion of another sstable. At older format major
+	// versions, sstables are rewritten rather than virtualized.
+	FormatVirtualSSTables
+	// FormatCompressedWAL permits the records of the WAL to be compressed, as
+	// configured by Options.WALCompression. At older format major versions,
+	// the WAL is written uncompressed.
+	FormatCompressedWAL
+	// FormatDBID records a unique identifier for the DB in the MANIFEST and in
+	// the properties of every sstable written by the DB. Ingestion rejects
+	// sstables which were written for a different DB.
+	FormatDBID
+	// FormatMergerName records the name of the merge operator in the MANIFEST,
+	// so that opening the DB with a different merge operator fails, even if
+	// the OPTIONS file is missing.
+	FormatMergerName
+	// FormatNewest is the newest format major version supported.
+	FormatNewest = FormatMergerName
+)
+
+// FilterType is the level at which to apply a filter: block, table or
+// partitioned table.
 type FilterType int
 
 // The available filter types.
+//
+// A PartitionedFilter is a table-level filter which is split into partitions,
+// each covering a contiguous range of the table's keys. Only the partition
+// covering a key needs to be read to check the key, so large tables do not
+// require their entire filter to be loaded. The partitions are encoded with
+// the TableFilter format of the FilterPolicy.
 const (
 	BlockFilter FilterType = iota
 	TableFilter
+	PartitionedFilter
 )
 
 // FilterWriter provides an interface for creating filter blocks. See
@@ -95,7 +223,7 @@ type LevelOptions struct {
 	// specified percentage of the target block size and adding the next entry
 	// would cause the block to be larger than the target block size.
 	//
-	// The default value is 90
+	// The default value is 90.
 	BlockSizeThreshold int
 
 	// Compression defines the per-block compression to use.
@@ -103,6 +231,13 @@ type LevelOptions struct {
 	// The default value (DefaultCompression) uses snappy compression.
 	Compression Compression
 
+	// FilterPartitionSize is the approximate number of bytes of data blocks
+	// covered by each partition of a partitioned filter. It is only used if
+	// FilterType is PartitionedFilter.
+	//
+	// The default value is 256KB.
+	FilterPartitionSize int
+
 	// FilterPolicy defines a filter algorithm (such as a Bloom filter) that can
 	// reduce disk reads for Get calls.
 	//
@@ -119,6 +254,9 @@ type LevelOptions struct {
 	// memory proportional to the number of keys in an sstable to create, but
 	// avoids the index lookup when determining if a key is present. Table-level
 	// filters should be preferred except under constrained memory situations.
+	// A partitioned filter is a table-level filter which is split into
+	// partitions that are loaded individually, which bounds the memory required
+	// to check a key in very large tables.
 	FilterType FilterType
 
 	// The maximum number of bytes for the level. When the maximum number of
@@ -148,6 +286,9 @@ func (o *LevelOptions) EnsureDefaults() *LevelOptions {
 	if o.Compression <= DefaultCompression || o.Compression >= nCompression {
 		o.Compression = SnappyCompression
 	}
+	if o.FilterPartitionSize <= 0 {
+		o.FilterPartitionSize = 256 << 10 // 256 KB
+	}
 	if o.MaxBytes <= 0 {
 		o.MaxBytes = 64 << 20 // 64 MB
 	}
@@ -157,10 +298,54 @@ func (o *LevelOptions) EnsureDefaults() *LevelOptions {
 	return o
 }
 
+// TablePropertyCollector collects user-defined properties from the entries of
+// an sstable as it is written. The properties are stored in the table's
+// properties block, and are available to readers as
+// sstable.Properties.UserProperties. A new collector is created for every
+// table written.
+type TablePropertyCollector interface {
+	// Add is called with each entry added to the table, in key order.
+	Add(key InternalKey, value []byte) error
+
+	// Finish is called when the table is finished, and adds the collected
+	// properties to userProps.
+	Finish(userProps map[string]string) error
+
+	// Name returns the name of the collector, which is recorded in the table's
+	// properties.
+	Name() string
+}
+
+// GuardKeys returns a function for Options.SplitCompactionOutput which
+// splits the output of compactions at the specified guard keys, which must be
+// sorted: a key at or after a guard key is never written to the same table as
+// a key before it.
+func GuardKeys(cmp Compare, guards [][]byte) func(prevKey, key []byte) bool {
+	return func(prevKey, key []byte) bool {
+		// Find the first guard key after prevKey, and check whether the next key
+		// is at or after it.
+		i := sort.Search(len(guards), func(i int) bool {
+			return cmp(guards[i], prevKey) > 0
+		})
+		return i < len(guards) && cmp(key, guards[i]) >= 0
+	}
+}
+
 // Options holds the optional parameters for configuring pebble. These options
 // apply to the DB at large; per-query options are defined by the ReadOptions
 // and WriteOptions types.
 type Options struct {
+	// BatchSpillThreshold is the size of the memtable space needed by the
+	// entries of a batch above which the batch is spilled when committed:
+	// rather than being written to the WAL and applied to the memtable, its
+	// entries are written to an sstable which is ingested into the DB. A batch
+	// containing the entries of a keyspace or a two-phase commit marker, or
+	// the batch of a transaction, is never spilled.
+	//
+	// The default value, which is also the maximum value, is half of
+	// MemTableSize.
+	BatchSpillThreshold int
+
 	// Sync sstables and the WAL periodically in order to smooth out writes to
 	// disk. This option does not provide any persistency guarantee, but is used
 	// to avoid latency spikes if the OS automatically decides to write out a
@@ -172,6 +357,19 @@ type Options struct {
 	// TODO(peter): provide a cache interface.
 	Cache *cache.Cache
 
+	// CompressedCache, if non-nil, caches the compressed blocks read from
+	// sstables, as stored in the files. A block which is not found in Cache is
+	// looked up in CompressedCache before it is read from disk, and is
+	// decompressed and added to Cache if found. Since compressed blocks are
+	// smaller, a block evicted from Cache is likely to remain in
+	// CompressedCache for longer, trading the CPU spent decompressing it again
+	// for a larger effective cache capacity on compressible data. Blocks
+	// which are stored uncompressed are not added to CompressedCache. It must
+	// not be the same cache as Cache.
+	//
+	// The default value is nil.
+	CompressedCache *cache.Cache
+
 	// Comparer defines a total ordering over the space of []byte keys: a 'less
 	// than' relationship. The same comparison algorithm must be used for reads
 	// and writes over the lifetime of the DB.
@@ -179,10 +377,79 @@ type Options struct {
 	// The default value uses the same ordering as bytes.Compare.
 	Comparer *Comparer
 
-	// ErrorIfDBExists is whether it is an error if the database already exists.
+	// DeleteRateBytesPerSec limits the rate at which obsolete files are
+	// deleted, in bytes per second. Obsolete files are deleted by a background
+	// goroutine; pacing the deletions avoids the I/O spikes caused by unlinking
+	// many large files at once after a compaction, which can interfere with
+	// foreground traffic.
+	//
+	// The default value is 0, which deletes obsolete files as fast as possible.
+	DeleteRateBytesPerSec int
+
+	// DeleteRateFilesPerSec limits the rate at which obsolete files are
+	// deleted, in files per second, in addition to DeleteRateBytesPerSec.
+	// Unlinking a file has a cost regardless of its size, so this paces the
+	// deletion of the many small files, such as those left behind by a
+	// compaction of small tables, which DeleteRateBytesPerSec does not slow
+	// down.
+	//
+	// The default value is 0, which does not limit the number of files deleted
+	// per second.
+	DeleteRateFilesPerSec int
+
+	// DiskSlowThreshold is the latency above which a write or sync of a file
+	// is considered slow. Slow operations are logged and reported via
+	// EventListener.DiskSlow, even while they are still in progress, and the
+	// maximum latencies are recorded in the DB's metrics. This allows a
+	// degraded disk to be diagnosed.
+	//
+	// The default value is 0, which disables disk health checking.
+	DiskSlowThreshold time.Duration
+
+	// ErrorIfDBExists is whether it is an error if the database already exists,
+	// and ErrorIfNotExists whether it is an error if the database does not
+	// exist. Together they select the behavior of Open:
+	//
+	//   - Neither: the database is opened, or created if it does not exist.
+	//   - ErrorIfDBExists: the database is created, and must not exist.
+	//   - ErrorIfNotExists: the database is opened, and must exist. Nothing is
+	//     written to the directory, which is not created, if it does not hold
+	//     a database, so that pointing a process at the wrong directory does
+	//     not silently create an empty database.
+	//
+	// Setting both is invalid. A ReadOnly database is never created, so
+	// ErrorIfNotExists is implied and ErrorIfDBExists is invalid.
+	//
+	// The default values are false.
+	ErrorIfDBExists  bool
+	ErrorIfNotExists bool
+
+	// EventListener provides hooks to listening to significant DB events such
+	// as the detection of corrupted tables.
+	EventListener EventListener
+
+	// FlushToL0 directs flushes to always write their tables to L0. Otherwise a
+	// flushed table which does not overlap the tables in the levels above L2 is
+	// written below L0, avoiding the write amplification of compacting it out
+	// of L0, which benefits append-only workloads.
 	//
 	// The default value is false.
-	ErrorIfDBExists bool
+	FlushToL0 bool
+
+	// FormatMajorVersion is the format major version to create a new DB with.
+	// If the DB already exists at an older format major version, Open ratchets
+	// it to this version. Open never lowers the format major version of a DB.
+	// See also DB.RatchetFormatMajorVersion.
+	//
+	// The default value is FormatDefault.
+	FormatMajorVersion FormatMajorVersion
+
+	// Keyspaces specifies the options for the keyspaces of the DB, keyed by
+	// keyspace name. A keyspace without an entry uses the options of the DB.
+	// The Storage and ReadOnly options of a keyspace are always those of the
+	// DB, and its Cache, CompressedCache and Logger default to those of the DB.
+	// See pebble.DB.Keyspace.
+	Keyspaces map[string]*Options
 
 	// The number of files necessary to trigger an L0 compaction.
 	L0CompactionThreshold int
@@ -195,10 +462,35 @@ type Options struct {
 	// threshold is reached.
 	L0StopWritesThreshold int
 
+	// LazyTableIndex opens tables in a metadata-only mode: opening a table
+	// reads its footer, properties and filter, but its index block is only
+	// read when an iterator over the table is first positioned. Workloads
+	// which touch many tables only once, or whose point lookups are mostly
+	// ruled out by the tables' filters, then avoid reading the index of every
+	// table they open. A table whose index is corrupt is detected when the
+	// index is read rather than when the table is opened, unless ParanoidChecks
+	// is set, which reads the index to check the table.
+	//
+	// The default value is false.
+	LazyTableIndex bool
+
+	// Logger used to write log messages, such as the details of background
+	// flushes and compactions and any errors they encounter.
+	//
+	// The default logger writes to the Go stdlib log package.
+	Logger Logger
+
 	// Per-level options. Options for at least one level must be specified. The
 	// options for the last level are used for all subsequent levels.
 	Levels []LevelOptions
 
+	// MaxManifestFileSize is the maximum size the MANIFEST file is allowed to
+	// become. When the MANIFEST exceeds this size it is rolled over and a new
+	// MANIFEST is created containing a snapshot of the current state.
+	//
+	// The default value is 128MB.
+	MaxManifestFileSize int64
+
 	// MaxOpenFiles is a soft limit on the number of open files that can be
 	// used by the DB.
 	//
@@ -217,16 +509,162 @@ type Options struct {
 	// the MemTable is being flushed.
 	MemTableStopWritesThreshold int
 
+	// MemoryBudget limits the memory used by the DB and its keyspaces: the
+	// memtables, the batches being committed, the buffers of the tables being
+	// written by flushes and compactions, and the block cache. While the DB is
+	// over budget, the block cache is shrunk, down to a quarter of the budget,
+	// and memtables are flushed before they are full. The budget is a soft
+	// limit, which writes may exceed until the flushes complete.
+	//
+	// The default value is 0, which does not limit the memory used.
+	MemoryBudget int64
+
 	// Merger defines the associative merge operation to use for merging values
 	// written with {Batch,DB}.Merge.
 	//
 	// The default merger concatenates values.
-	Merger *Merger
+	Merger MergeOperator
+
+	// ParanoidChecks enables additional validation of sstables when they are
+	// opened: the table must contain a properties block and every entry in the
+	// index block must reference a block that lies within the file. Tables that
+	// fail validation return an error when opened rather than when the corrupt
+	// portion is read. Additionally, sstables found by Open which are not
+	// referenced by the MANIFEST are moved into a "lost" subdirectory for
+	// inspection rather than being removed.
+	//
+	// The default value is false.
+	ParanoidChecks bool
+
+	// ParanoidCompactions enables additional validation of the output of
+	// compactions: the keys written must be strictly increasing, and every
+	// entry read from the input tables must be accounted for, by kind, as
+	// either written, shadowed by a newer entry for its key, merged into a
+	// newer entry, dropped as an obsolete tombstone or skipped because its
+	// kind is unknown. A compaction which fails
+	// validation returns an error rather than installing its output, leaving
+	// its input tables in place.
+	//
+	// The default value is false.
+	ParanoidCompactions bool
+
+	// PrewarmLevels is the number of levels, starting at L0, whose tables are
+	// opened by Open, up to the capacity of the table cache. Opening a table
+	// reads its footer, index and filter, and validates them, so that a table
+	// which cannot be read fails Open rather than a later read, and the first
+	// reads after a restart do not wait for the tables to be opened. A value
+	// of 7, the number of levels, or more opens the tables of every level. See
+	// also Iterator.Prepare.
+	//
+	// The default value is 0, which opens tables on their first access.
+	PrewarmLevels int
+
+	// ReadOnly indicates that the DB should be opened in read-only mode. The
+	// DB directory is not locked, allowing a DB in use by another process to be
+	// inspected, and nothing is written to it: the contents of the WAL are
+	// recovered into memory rather than flushed, obsolete files are not
+	// deleted, and flushes and compactions are disabled. Writes to the DB
+	// return an error.
+	//
+	// The default value is false.
+	ReadOnly bool
+
+	// ScrubBytesPerSec limits the rate at which the background scrubber reads
+	// sstable blocks, in bytes per second.
+	//
+	// The default value is 4MB/sec.
+	ScrubBytesPerSec int
+
+	// ScrubInterval is the interval between the start of successive passes of
+	// the background scrubber. Each pass reads every block of every live
+	// sstable, verifying checksums, and reports corrupted tables via
+	// EventListener.TableCorruption. This allows latent on-disk corruption to
+	// be found before it is encountered by a compaction or user read.
+	//
+	// The default value is 0, which disables the scrubber.
+	ScrubInterval time.Duration
+
+	// SplitCompactionOutput, if set, is consulted by compactions when deciding
+	// where to split their output into sstables. It is called with the last
+	// user key written to the current output table and the next user key, and
+	// returns true if the next key should start a new table. This allows the
+	// table boundaries to be aligned with application-level boundaries, such
+	// as shards, so that later excise and ingest operations on those ranges do
+	// not need to cut tables. The entries for a single user key are never
+	// split across tables. See GuardKeys.
+	//
+	// The default value is nil, which writes the output of a compaction to a
+	// single table.
+	SplitCompactionOutput func(prevKey, key []byte) bool
 
 	// Storage maps file names to byte storage.
 	//
 	// The default value uses the underlying operating system's file system.
 	Storage storage.Storage
+
+	// TablePropertyCollectors is a list of functions which create the
+	// collectors of user-defined properties for each sstable written.
+	//
+	// The default value is nil.
+	TablePropertyCollectors []func() TablePropertyCollector
+
+	// UnknownKeyKindMode controls how a compaction handles an entry of an
+	// unknown kind. Skipping or preserving such entries prevents a single
+	// corrupt entry from blocking the compaction of its tables indefinitely.
+	// Each entry skipped or preserved is reported via
+	// EventListener.UnknownKeyKind.
+	//
+	// The default value is FailOnUnknownKeyKind.
+	UnknownKeyKindMode UnknownKeyKindMode
+
+	// VerifyChecksums forces every sstable block read to be read from storage
+	// and have its checksum verified, even if the block is present in the
+	// cache. The cache holds uncompressed blocks which can no longer be
+	// verified against the on-disk checksum, so enabling this option
+	// effectively bypasses the cache, and the compressed block cache, for
+	// reads. This trades read latency for
+	// prompt detection of on-disk corruption.
+	//
+	// The default value is false.
+	VerifyChecksums bool
+
+	// VerifyCompactionOutput causes the tables written by a compaction to be
+	// read back from storage, verifying the checksum of every block, before
+	// they are installed. A compaction whose output fails verification returns
+	// an error rather than replacing its input tables with corrupt tables.
+	//
+	// The default value is false.
+	VerifyCompactionOutput bool
+
+	// WALCompression is the compression applied to the batches written to the
+	// WAL. Compression reduces the volume of the WAL writes and syncs for
+	// batches with large, compressible values, at the cost of CPU time on the
+	// commit path. A batch is written uncompressed if compression does not
+	// reduce its size by at least 1/8th. The WAL is only compressed once the
+	// format major version of the DB is at least FormatCompressedWAL, starting
+	// with the WAL created after the version is ratcheted.
+	//
+	// The default value (DefaultCompression) is NoCompression.
+	WALCompression Compression
+
+	// WALFlushBytes and WALFlushInterval control the writing of the WAL
+	// records of the commits which do not sync. The records are buffered in
+	// blocks of 32 KB, and written to the WAL file by a background goroutine
+	// once the buffered records amount to WALFlushBytes, or once
+	// WALFlushInterval has elapsed since they were committed, whichever comes
+	// first, rather than only once a block fills up. The commits never wait
+	// for these writes. A negative WALFlushBytes disables the background
+	// writes of partial blocks.
+	//
+	// The default values are 16KB and 1ms.
+	WALFlushBytes    int
+	WALFlushInterval time.Duration
+
+	// WALRecoveryMode controls how corrupted or incomplete records in the
+	// write-ahead logs are handled when they are replayed by Open.
+	//
+	// The default value is TolerateCorruptedTailRecords.
+	WALRecoveryMode WALRecoveryMode
 }
 
 // EnsureDefaults ensures that the default values for all options are set if a
@@ -238,6 +676,15 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.BytesPerSync <= 0 {
 		o.BytesPerSync = 512 << 10
 	}
+	if o.WALCompression <= DefaultCompression || o.WALCompression >= nCompression {
+		o.WALCompression = NoCompression
+	}
+	if o.WALFlushBytes == 0 {
+		o.WALFlushBytes = 16 << 10
+	}
+	if o.WALFlushInterval <= 0 {
+		o.WALFlushInterval = time.Millisecond
+	}
 	if o.Comparer == nil {
 		o.Comparer = DefaultComparer
 	}
@@ -252,18 +699,13 @@ func (o *Options) EnsureDefaults() *Options {
 	}
 	if o.Levels == nil {
 		o.Levels = make([]LevelOptions, 1)
-		for i := range o.Levels {
-			if i > 0 {
-				l := &o.Levels[i]
-				if l.MaxBytes <= 0 {
-					l.MaxBytes = o.Levels[i-1].MaxBytes * 10
-				}
-				if l.TargetFileSize <= 0 {
-					l.TargetFileSize = o.Levels[i-1].TargetFileSize * 2
-				}
-			}
-			o.Levels[i] = *o.Levels[i].EnsureDefaults()
-		}
+		o.EnsureLevelDefaults()
+	}
+	if o.Logger == nil {
+		o.Logger = DefaultLogger
+	}
+	if o.MaxManifestFileSize == 0 {
+		o.MaxManifestFileSize = 128 << 20
 	}
 	if o.MaxOpenFiles == 0 {
 		o.MaxOpenFiles = 1000
@@ -271,18 +713,88 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.MemTableSize <= 0 {
 		o.MemTableSize = 4 << 20
 	}
+	if o.BatchSpillThreshold <= 0 || o.BatchSpillThreshold > o.MemTableSize/2 {
+		o.BatchSpillThreshold = o.MemTableSize / 2
+	}
 	if o.MemTableStopWritesThreshold <= 0 {
 		o.MemTableStopWritesThreshold = 2
 	}
 	if o.Merger == nil {
 		o.Merger = DefaultMerger
 	}
+	if o.ScrubBytesPerSec <= 0 {
+		o.ScrubBytesPerSec = 4 << 20
+	}
 	if o.Storage == nil {
 		o.Storage = storage.Default
 	}
 	return o
 }
 
+// EnsureLevelDefaults ensures that the default values for the options of
+// each of the specified Levels are set, with the MaxBytes and TargetFileSize
+// of a level derived from the previous level. Only the unset fields are
+// written. EnsureLevelDefaults is called by Open before the options are
+// shared, rather than by EnsureDefaults, which is called concurrently on the
+// options of an open DB by the sstable readers and writers.
+func (o *Options) EnsureLevelDefaults() {
+	for i := range o.Levels {
+		l := &o.Levels[i]
+		if i > 0 {
+			if l.MaxBytes <= 0 {
+				l.MaxBytes = o.Levels[i-1].MaxBytes * 10
+			}
+			if l.TargetFileSize <= 0 {
+				l.TargetFileSize = o.Levels[i-1].TargetFileSize * 2
+			}
+		}
+		l.EnsureDefaults()
+	}
+}
+
+// Validate verifies that the explicitly specified options are valid,
+// returning an error describing the first invalid option found. Unset options
+// are permitted as they are replaced by their defaults in EnsureDefaults, and
+// Validate should be called before EnsureDefaults as the latter replaces
+// invalid per-level compression settings with the default. It is valid to call
+// Validate on a nil receiver.
+func (o *Options) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.CompressedCache != nil && o.CompressedCache == o.Cache {
+		return fmt.Errorf("pebble: CompressedCache must not be the same cache as Cache")
+	}
+	if o.MemoryBudget < 0 {
+		return fmt.Errorf("pebble: negative MemoryBudget %d", o.MemoryBudget)
+	}
+	if o.ErrorIfDBExists && o.ErrorIfNotExists {
+		return fmt.Errorf("pebble: ErrorIfDBExists and ErrorIfNotExists are mutually exclusive")
+	}
+	if o.ErrorIfDBExists && o.ReadOnly {
+		return fmt.Errorf("pebble: ErrorIfDBExists is invalid for a ReadOnly DB, which is never created")
+	}
+	if o.WALCompression < DefaultCompression || o.WALCompression >= nCompression {
+		return fmt.Errorf("pebble: unknown WAL compression %d", o.WALCompression)
+	}
+	for i := range o.Levels {
+		l := &o.Levels[i]
+		if l.Compression < DefaultCompression || l.Compression >= nCompression {
+			return fmt.Errorf("pebble: level %d: unknown compression %d", i, l.Compression)
+		}
+		switch l.FilterType {
+		case BlockFilter, TableFilter, PartitionedFilter:
+		default:
+			return fmt.Errorf("pebble: level %d: unknown filter type %d", i, l.FilterType)
+		}
+		if l.BlockSizeThreshold > 100 {
+			return fmt.Errorf("pebble: level %d: BlockSizeThreshold (%d) must be <= 100",
+				i, l.BlockSizeThreshold)
+		}
+	}
+	return nil
+}
+
 // Level returns the LevelOptions for the specified level.
 func (o *Options) Level(level int) LevelOptions {
 	if level < len(o.Levels) {
@@ -297,6 +809,106 @@ func (o *Options) Level(level int) LevelOptions {
 	return l
 }
 
+// String returns a textual representation of the options in an INI-like
+// format. The options are persisted in this format in the OPTIONS file of a
+// DB, and can be validated against another set of options using Check.
+func (o *Options) String() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "[Options]\n")
+	fmt.Fprintf(&buf, "  bytes_per_sync=%d\n", o.BytesPerSync)
+	fmt.Fprintf(&buf, "  comparer=%s\n", o.Comparer.Name)
+	fmt.Fprintf(&buf, "  l0_compaction_threshold=%d\n", o.L0CompactionThreshold)
+	fmt.Fprintf(&buf, "  l0_slowdown_writes_threshold=%d\n", o.L0SlowdownWritesThreshold)
+	fmt.Fprintf(&buf, "  l0_stop_writes_threshold=%d\n", o.L0StopWritesThreshold)
+	fmt.Fprintf(&buf, "  max_manifest_file_size=%d\n", o.MaxManifestFileSize)
+	fmt.Fprintf(&buf, "  max_open_files=%d\n", o.MaxOpenFiles)
+	fmt.Fprintf(&buf, "  mem_table_size=%d\n", o.MemTableSize)
+	fmt.Fprintf(&buf, "  mem_table_stop_writes_threshold=%d\n", o.MemTableStopWritesThreshold)
+	fmt.Fprintf(&buf, "  merger=%s\n", o.Merger.Name())
+	fmt.Fprintf(&buf, "  paranoid_checks=%t\n", o.ParanoidChecks)
+	fmt.Fprintf(&buf, "  paranoid_compactions=%t\n", o.ParanoidCompactions)
+	fmt.Fprintf(&buf, "  unknown_key_kind_mode=%s\n", o.UnknownKeyKindMode)
+	fmt.Fprintf(&buf, "  verify_checksums=%t\n", o.VerifyChecksums)
+	fmt.Fprintf(&buf, "  verify_compaction_output=%t\n", o.VerifyCompactionOutput)
+	fmt.Fprintf(&buf, "  wal_compression=%s\n", o.WALCompression)
+	fmt.Fprintf(&buf, "  wal_flush_bytes=%d\n", o.WALFlushBytes)
+	fmt.Fprintf(&buf, "  wal_flush_interval=%s\n", o.WALFlushInterval)
+	fmt.Fprintf(&buf, "  wal_recovery_mode=%s\n", o.WALRecoveryMode)
+
+	for i := range o.Levels {
+		l := &o.Levels[i]
+		fmt.Fprintf(&buf, "\n")
+		fmt.Fprintf(&buf, "[Level \"%d\"]\n", i)
+		fmt.Fprintf(&buf, "  block_restart_interval=%d\n", l.BlockRestartInterval)
+		fmt.Fprintf(&buf, "  block_size=%d\n", l.BlockSize)
+		fmt.Fprintf(&buf, "  block_size_threshold=%d\n", l.BlockSizeThreshold)
+		fmt.Fprintf(&buf, "  compression=%s\n", l.Compression)
+		if l.FilterPolicy != nil {
+			fmt.Fprintf(&buf, "  filter_policy=%s\n", l.FilterPolicy.Name())
+			switch l.FilterType {
+			case BlockFilter:
+				fmt.Fprintf(&buf, "  filter_type=block\n")
+			case TableFilter:
+				fmt.Fprintf(&buf, "  filter_type=table\n")
+			case PartitionedFilter:
+				fmt.Fprintf(&buf, "  filter_type=partitioned\n")
+				fmt.Fprintf(&buf, "  filter_partition_size=%d\n", l.FilterPartitionSize)
+			}
+		}
+		fmt.Fprintf(&buf, "  max_bytes=%d\n", l.MaxBytes)
+		fmt.Fprintf(&buf, "  target_file_size=%d\n", l.TargetFileSize)
+	}
+
+	return buf.String()
+}
+
+// Check verifies that the options, as serialized by Options.String, are
+// compatible with o. Options which affect the on-disk format, such as the
+// comparer and merger, must match. Differences in tuning options are
+// allowed, as are unknown options.
+func (o *Options) Check(s string) error {
+	var section string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == ';' || line[0] == '#' {
+			// Skip blank lines and comments.
+			continue
+		}
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return fmt.Errorf("pebble: invalid section: %q", line)
+			}
+			section = line[1 : len(line)-1]
+			continue
+		}
+		pos := strings.Index(line, "=")
+		if pos < 0 {
+			return fmt.Errorf("pebble: invalid key=value syntax: %q", line)
+		}
+		if section != "Options" {
+			continue
+		}
+		key := strings.TrimSpace(line[:pos])
+		value := strings.TrimSpace(line[pos+1:])
+		switch key {
+		case "comparer":
+			if value != o.Comparer.Name {
+				return fmt.Errorf("pebble: comparer name from file %q != comparer name from options %q",
+					value, o.Comparer.Name)
+			}
+		case "merger":
+			// RocksDB records the merge operator name as "nullptr" when no merge
+			// operator is configured.
+			if value != "nullptr" && value != o.Merger.Name() {
+				return fmt.Errorf("pebble: merger name from file %q != merger name from options %q",
+					value, o.Merger.Name())
+			}
+		}
+	}
+	return nil
+}
+
 // IterOptions hold the optional per-query parameters for NewIter.
 //
 // Like Options, a nil *IterOptions is valid and means to use the default
@@ -306,22 +918,31 @@ type IterOptions struct {
 	// return during iteration. If the iterator is seeked or iterated past this
 	// boundary the iterator will return Valid()==false. Setting LowerBound
 	// effectively truncates the key space visible to the iterator.
-	//
-	// TODO(peter): unimplemented.
 	LowerBound []byte
 	// UpperBound specifies the largest key (exclusive) that the iterator will
 	// return during iteration. If the iterator is seeked or iterated past this
 	// boundary the iterator will return Valid()==false. Setting UpperBound
 	// effectively truncates the key space visible to the iterator.
-	//
-	// TODO(peter): unimplemented.
 	UpperBound []byte
 	// TableFilter can be used to filter the tables that are scanned during
 	// iteration based on the user properties. Return true to scan the table and
-	// false to skip scanning.
-	//
-	// TODO(peter): unimplemented.
+	// false to skip scanning. The filter is consulted before a table is read,
+	// and is not applied to the memtables. Note that skipping a table hides
+	// its deletions as well as its sets, which may expose older versions of
+	// keys in the other tables.
 	TableFilter func(userProps map[string]string) bool
+	// Timestamp specifies the timestamp to read at, if the comparer supports
+	// timestamps (see Comparer.CompareTimestamps). The keys whose timestamp is
+	// newer than Timestamp are hidden from the iterator, while keys without a
+	// timestamp are always visible. The data blocks of sstables which only hold
+	// keys newer than Timestamp are skipped without being read.
+	Timestamp []byte
+	// VerifyChecksums forces the sstable data blocks read by the iterator to be
+	// read from storage and have their checksums verified, even if the blocks
+	// are present in the cache, as Options.VerifyChecksums does for every read.
+	// It allows a read whose result must not be affected by on-disk
+	// corruption to be checked without paying the cost on every read.
+	VerifyChecksums bool
 }
 
 // WriteOptions hold the optional per-query parameters for Set and Delete
@@ -343,6 +964,58 @@ type WriteOptions struct {
 	//
 	// The default value is true.
 	Sync bool
+
+	// Priority determines how the write is admitted by the commit rate
+	// limiter, allowing background writes such as backfills to share a DB with
+	// latency-sensitive foreground writes. High priority writes are admitted
+	// immediately, delaying the writes of lower priority instead. Low priority
+	// writes are additionally limited to a fraction of the commit rate limit.
+	//
+	// The default value is NormalPriority.
+	Priority WritePriority
+}
+
+// DeletePrefixOptions hold the optional parameters for DB.DeletePrefix.
+//
+// Like Options, a nil *DeletePrefixOptions is valid and means to use the
+// default values.
+type DeletePrefixOptions struct {
+	// IgnoreSnapshots permits the prefix deletion to remove data which is
+	// visible to open snapshots, which then no longer see it. Otherwise, a
+	// prefix deletion whose range overlaps the data visible to an open
+	// snapshot fails.
+	//
+	// The default value is false.
+	IgnoreSnapshots bool
+}
+
+// GetIgnoreSnapshots returns whether the prefix deletion may remove data
+// visible to open snapshots.
+func (o *DeletePrefixOptions) GetIgnoreSnapshots() bool {
+	return o != nil && o.IgnoreSnapshots
+}
+
+// WritePriority is the priority of a write. See WriteOptions.Priority.
+type WritePriority int8
+
+// The available write priorities.
+const (
+	LowPriority    WritePriority = -1
+	NormalPriority WritePriority = 0
+	HighPriority   WritePriority = 1
+)
+
+func (p WritePriority) String() string {
+	switch p {
+	case LowPriority:
+		return "low"
+	case NormalPriority:
+		return "normal"
+	case HighPriority:
+		return "high"
+	default:
+		return fmt.Sprintf("WritePriority(%d)", int8(p))
+	}
 }
 
 var Sync = &WriteOptions{Sync: true}
@@ -351,3 +1024,11 @@ var NoSync = &WriteOptions{Sync: false}
 func (o *WriteOptions) GetSync() bool {
 	return o == nil || o.Sync
 }
+
+// GetPriority returns the priority of the write.
+func (o *WriteOptions) GetPriority() WritePriority {
+	if o == nil {
+		return NormalPriority
+	}
+	return o.Priority
+}
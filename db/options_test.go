@@ -5,7 +5,10 @@
 package db
 
 import (
+	"strings"
 	"testing"
+
+	"github.com/petermattis/pebble/cache"
 )
 
 func TestLevelOptions(t *testing.T) {
@@ -37,3 +40,120 @@ func TestLevelOptions(t *testing.T) {
 		}
 	}
 }
+
+func TestLevelOptionsDefaults(t *testing.T) {
+	// Defaults are applied to explicitly specified levels by
+	// EnsureLevelDefaults.
+	opts := (&Options{
+		Levels: []LevelOptions{{Compression: NoCompression}, {BlockSize: 32 << 10}},
+	}).EnsureDefaults()
+	if l1 := opts.Level(1); l1.Compression != DefaultCompression || l1.MaxBytes != 0 {
+		t.Fatalf("unexpected L1 options before EnsureLevelDefaults: %+v", l1)
+	}
+	opts.EnsureLevelDefaults()
+
+	l0, l1 := opts.Level(0), opts.Level(1)
+	if l0.Compression != NoCompression || l0.BlockSize != 4096 || l0.MaxBytes != 64<<20 {
+		t.Fatalf("unexpected L0 options: %+v", l0)
+	}
+	if l1.Compression != SnappyCompression || l1.BlockSize != 32<<10 || l1.MaxBytes != 640<<20 {
+		t.Fatalf("unexpected L1 options: %+v", l1)
+	}
+	if l2 := opts.Level(2); l2.BlockSize != 32<<10 || l2.TargetFileSize != 16<<20 {
+		t.Fatalf("unexpected L2 options: %+v", l2)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	var opts *Options
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.EnsureDefaults().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		level    LevelOptions
+		expected string
+	}{
+		{LevelOptions{Compression: nCompression}, "unknown compression"},
+		{LevelOptions{FilterType: PartitionedFilter + 1}, "unknown filter type"},
+		{LevelOptions{BlockSizeThreshold: 200}, "BlockSizeThreshold"},
+	}
+	for _, c := range testCases {
+		opts := &Options{Levels: []LevelOptions{{}, c.level}}
+		err := opts.Validate()
+		if err == nil || !strings.Contains(err.Error(), "level 1: "+c.expected) {
+			t.Errorf("expected error containing %q, but found %v", c.expected, err)
+		}
+	}
+
+	c := cache.New(1 << 20)
+	opts = &Options{Cache: c, CompressedCache: c}
+	if err := opts.Validate(); err == nil || !strings.Contains(err.Error(), "CompressedCache") {
+		t.Errorf("expected error containing %q, but found %v", "CompressedCache", err)
+	}
+}
+
+type renamedMerger struct {
+	MergeOperator
+}
+
+func (renamedMerger) Name() string {
+	return "renamed"
+}
+
+func TestOptionsCheck(t *testing.T) {
+	var opts *Options
+	opts = opts.EnsureDefaults()
+	s := opts.String()
+	if err := opts.Check(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// Differences in tuning options are allowed.
+	other := *opts
+	other.MemTableSize *= 2
+	if err := other.Check(s); err != nil {
+		t.Fatal(err)
+	}
+
+	other = *opts
+	other.Comparer = &Comparer{Name: "renamed"}
+	if err := other.Check(s); err == nil || !strings.Contains(err.Error(), "comparer name") {
+		t.Fatalf("expected comparer mismatch, but found %v", err)
+	}
+
+	other = *opts
+	other.Merger = renamedMerger{DefaultMerger}
+	if err := other.Check(s); err == nil || !strings.Contains(err.Error(), "merger name") {
+		t.Fatalf("expected merger mismatch, but found %v", err)
+	}
+
+	if err := opts.Check("[Options]\n  comparer\n"); err == nil {
+		t.Fatalf("expected syntax error")
+	}
+}
+
+func TestGuardKeys(t *testing.T) {
+	split := GuardKeys(DefaultComparer.Compare, [][]byte{[]byte("c"), []byte("f")})
+	testCases := []struct {
+		prevKey, key string
+		expected     bool
+	}{
+		{"a", "b", false},
+		{"a", "c", true},
+		{"b", "d", true},
+		{"c", "d", false},
+		{"c", "f", true},
+		{"a", "g", true},
+		{"f", "z", false},
+		{"g", "h", false},
+	}
+	for _, c := range testCases {
+		if v := split([]byte(c.prevKey), []byte(c.key)); v != c.expected {
+			t.Errorf("%s, %s: expected %t, but found %t", c.prevKey, c.key, c.expected, v)
+		}
+	}
+}
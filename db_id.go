@@ -0,0 +1,34 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// ID returns the unique identifier of the DB, which is recorded in the
+// MANIFEST and in the properties of the sstables written by the DB. The
+// identifier is generated when the DB is created or ratcheted to
+// db.FormatDBID. The empty string is returned for a DB at an older format
+// major version.
+//
+// Sstables written for ingestion into the DB may be marked with the identifier
+// using sstable.Writer.SetDBID, in which case Ingest verifies that they were
+// written for this DB.
+func (d *DB) ID() string {
+	return d.mu.versions.id()
+}
+
+// newDBID returns a new random (version 4) UUID.
+func newDBID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("pebble: could not generate DB ID: %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestDBID(t *testing.T) {
+	mem := storage.NewMem()
+	open := func(vers db.FormatMajorVersion) *DB {
+		d, err := Open("", &db.Options{
+			FormatMajorVersion:  vers,
+			Logger:              discardLogger{},
+			MaxManifestFileSize: 1,
+			Storage:             mem,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	// A DB at an older format major version has no identifier.
+	d := open(db.FormatCompressedWAL)
+	if id := d.ID(); id != "" {
+		t.Fatalf("expected no DB ID, but found %s", id)
+	}
+
+	// Ratcheting the DB generates an identifier.
+	if err := d.RatchetFormatMajorVersion(db.FormatDBID); err != nil {
+		t.Fatal(err)
+	}
+	id := d.ID()
+	uuidRE := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	if !uuidRE.MatchString(id) {
+		t.Fatalf("expected a UUID, but found %q", id)
+	}
+
+	// The identifier is recorded in the tables written by the DB, and survives
+	// the MANIFEST being rolled over.
+	for i := 0; i < 2; i++ {
+		if err := d.Set([]byte("a"), []byte("b"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tables, err := d.SSTables(WithProperties())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, level := range tables {
+		for _, info := range level {
+			if info.Properties.DBID != id {
+				t.Fatalf("expected table %d to have DB ID %s, but found %q",
+					info.FileNum, id, info.Properties.DBID)
+			}
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d = open(db.FormatDefault)
+	if v := d.ID(); v != id {
+		t.Fatalf("expected DB ID %s, but found %s", id, v)
+	}
+
+	// Sstables marked with the identifier of another DB cannot be ingested.
+	ingest := func(id string) error {
+		f, err := mem.Create("ext")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := sstable.NewWriter(f, nil, db.LevelOptions{})
+		w.SetDBID(id)
+		if err := w.Add(db.MakeInternalKey([]byte("c"), 0, db.InternalKeyKindSet), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return d.Ingest([]string{"ext"})
+	}
+	other, err := newDBID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ingest(other); err == nil || !strings.Contains(err.Error(), "was written for DB") {
+		t.Fatalf("expected DB ID mismatch error, but found %v", err)
+	}
+	if err := ingest(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A DB created at FormatDBID has a distinct identifier.
+	d2, err := Open("", &db.Options{
+		FormatMajorVersion: db.FormatDBID,
+		Storage:            storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d2.ID(); v == "" || v == id {
+		t.Fatalf("expected a new DB ID, but found %q", v)
+	}
+	if err := d2.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
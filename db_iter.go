@@ -5,11 +5,17 @@
 package pebble
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
 )
 
+// errIterClosed is returned by Clone if the iterator has been closed.
+var errIterClosed = errors.New("pebble: iterator is closed")
+
 type dbIterPos int8
 
 const (
@@ -18,19 +24,68 @@ const (
 	dbIterPrev           = -1
 )
 
+// mergeOperands accumulates the merge operands for a user key, from newest to
+// oldest, combining adjacent operands using MergeOperator.PartialMerge where
+// possible.
+type mergeOperands struct {
+	merge    db.MergeOperator
+	key      []byte
+	operands [][]byte
+}
+
+// init initializes the operands with the newest merge operand for key.
+func (m *mergeOperands) init(merge db.MergeOperator, key, operand []byte) {
+	m.merge = merge
+	m.key = key
+	m.operands = append(m.operands[:0], append([]byte(nil), operand...))
+}
+
+// add adds a merge operand which is older than the operands previously added.
+func (m *mergeOperands) add(operand []byte) {
+	last := len(m.operands) - 1
+	if v, ok := m.merge.PartialMerge(m.key, operand, m.operands[last], nil); ok {
+		m.operands[last] = v
+		return
+	}
+	m.operands = append(m.operands, append([]byte(nil), operand...))
+}
+
+// finish merges the operands into existingValue, which is nil if there is no
+// existing value for the key.
+func (m *mergeOperands) finish(existingValue []byte) []byte {
+	v := existingValue
+	for j := len(m.operands) - 1; j >= 0; j-- {
+		v = m.merge.FullMerge(m.key, v, m.operands[j], nil)
+	}
+	return v
+}
+
 type dbIter struct {
 	cmp      db.Compare
-	merge    db.Merge
+	split    db.Split
+	merge    db.MergeOperator
+	operands mergeOperands
 	iter     db.InternalIterator
 	seqNum   uint64
-	version  *version
 	err      error
 	key      []byte
 	keyBuf   []byte
 	value    []byte
-	valueBuf []byte
 	valid    bool
 	pos      dbIterPos
+	// The prefix of the key passed to SeekPrefixGE while the iterator is in
+	// prefix iteration mode, or nil otherwise. prefixBuf retains the memory
+	// backing the prefix.
+	prefix    []byte
+	prefixBuf []byte
+
+	// The view of the DB the iterator reads, from which Clone constructs a new
+	// iterator. The bounds in opts are enforced by the iterator.
+	db        *DB
+	batch     *Batch
+	memtables []*memTable
+	version   *version
+	opts      db.IterOptions
 }
 
 var _ db.Iterator = (*dbIter)(nil)
@@ -41,6 +96,12 @@ func (i *dbIter) findNextEntry() bool {
 
 	for i.iter.Valid() {
 		key := i.iter.Key()
+		if upper := i.opts.UpperBound; upper != nil && i.cmp(key.UserKey, upper) >= 0 {
+			break
+		}
+		if i.prefix != nil && !i.hasPrefix(key.UserKey) {
+			break
+		}
 		if seqNum := key.SeqNum(); seqNum > i.seqNum {
 			// Ignore entries that are newer than our snapshot sequence number,
 			// except for batch sequence numbers which are always visible.
@@ -72,12 +133,27 @@ func (i *dbIter) findNextEntry() bool {
 	return false
 }
 
+// hasPrefix returns true if the user key has the prefix being iterated over
+// following a call to SeekPrefixGE.
+func (i *dbIter) hasPrefix(key []byte) bool {
+	if !bytes.HasPrefix(key, i.prefix) {
+		return false
+	}
+	if i.split == nil {
+		return len(key) == len(i.prefix)
+	}
+	return i.split(key) == len(i.prefix)
+}
+
 func (i *dbIter) findPrevEntry() bool {
 	i.valid = false
 	i.pos = dbIterCur
 
 	for i.iter.Valid() {
 		key := i.iter.Key()
+		if lower := i.opts.LowerBound; lower != nil && i.cmp(key.UserKey, lower) < 0 {
+			break
+		}
 		if seqNum := key.SeqNum(); seqNum > i.seqNum {
 			// Ignore entries that are newer than our snapshot sequence number,
 			// except for batch sequence numbers which are always visible.
@@ -112,8 +188,8 @@ func (i *dbIter) findPrevEntry() bool {
 func (i *dbIter) mergeNext() bool {
 	// Save the current key and value.
 	i.keyBuf = append(i.keyBuf[:0], i.iter.Key().UserKey...)
-	i.valueBuf = append(i.valueBuf[:0], i.iter.Value()...)
-	i.key, i.value = i.keyBuf, i.valueBuf
+	i.key = i.keyBuf
+	i.operands.init(i.merge, i.key, i.iter.Value())
 	i.valid = true
 
 	// Loop looking for older values for this key and merging them.
@@ -121,29 +197,31 @@ func (i *dbIter) mergeNext() bool {
 		i.iter.Next()
 		if !i.iter.Valid() {
 			i.pos = dbIterNext
+			i.value = i.operands.finish(nil)
 			return true
 		}
 		key := i.iter.Key()
 		if i.cmp(i.key, key.UserKey) != 0 {
 			// We've advanced to the next key.
 			i.pos = dbIterNext
+			i.value = i.operands.finish(nil)
 			return true
 		}
 		switch key.Kind() {
 		case db.InternalKeyKindDelete:
 			// We've hit a deletion tombstone. Return everything up to this
 			// point.
+			i.value = i.operands.finish(nil)
 			return true
 
 		case db.InternalKeyKindSet:
 			// We've hit a Set value. Merge with the existing value and return.
-			i.value = i.merge(i.key, i.value, i.iter.Value(), nil)
+			i.value = i.operands.finish(i.iter.Value())
 			return true
 
 		case db.InternalKeyKindMerge:
-			// We've hit another Merge value. Merge with the existing value and
-			// continue looping.
-			i.value = i.merge(i.key, i.value, i.iter.Value(), nil)
+			// We've hit another Merge value. Accumulate it and continue looping.
+			i.operands.add(i.iter.Value())
 
 		default:
 			i.err = fmt.Errorf("invalid internal key kind: %d", key.Kind())
@@ -155,8 +233,8 @@ func (i *dbIter) mergeNext() bool {
 func (i *dbIter) mergePrev() bool {
 	// Save the current key and value.
 	i.keyBuf = append(i.keyBuf[:0], i.iter.Key().UserKey...)
-	i.valueBuf = append(i.valueBuf[:0], i.iter.Value()...)
-	i.key, i.value = i.keyBuf, i.valueBuf
+	i.key = i.keyBuf
+	i.operands.init(i.merge, i.key, i.iter.Value())
 	i.valid = true
 
 	// Loop looking for older values for this key and merging them.
@@ -164,29 +242,31 @@ func (i *dbIter) mergePrev() bool {
 		i.iter.Prev()
 		if !i.iter.Valid() {
 			i.pos = dbIterPrev
+			i.value = i.operands.finish(nil)
 			return true
 		}
 		key := i.iter.Key()
 		if i.cmp(i.key, key.UserKey) != 0 {
 			// We've advanced to the previous key.
 			i.pos = dbIterPrev
+			i.value = i.operands.finish(nil)
 			return true
 		}
 		switch key.Kind() {
 		case db.InternalKeyKindDelete:
 			// We've hit a deletion tombstone. Return everything up to this
 			// point.
+			i.value = i.operands.finish(nil)
 			return true
 
 		case db.InternalKeyKindSet:
 			// We've hit a Set value. Merge with the existing value and return.
-			i.value = i.merge(i.key, i.value, i.iter.Value(), nil)
+			i.value = i.operands.finish(i.iter.Value())
 			return true
 
 		case db.InternalKeyKindMerge:
-			// We've hit another Merge value. Merge with the existing value and
-			// continue looping.
-			i.value = i.merge(i.key, i.value, i.iter.Value(), nil)
+			// We've hit another Merge value. Accumulate it and continue looping.
+			i.operands.add(i.iter.Value())
 
 		default:
 			i.err = fmt.Errorf("invalid internal key kind: %d", key.Kind())
@@ -199,14 +279,43 @@ func (i *dbIter) SeekGE(key []byte) {
 	if i.err != nil {
 		return
 	}
+	i.prefix = nil
+	if lower := i.opts.LowerBound; lower != nil && i.cmp(key, lower) < 0 {
+		key = lower
+	}
 	i.iter.SeekGE(key)
 	i.findNextEntry()
 }
 
+// SeekPrefixGE implements Iterator.SeekPrefixGE, as documented in the
+// pebble/db package.
+func (i *dbIter) SeekPrefixGE(key []byte) {
+	if i.err != nil {
+		return
+	}
+	n := len(key)
+	if i.split != nil {
+		n = i.split(key)
+	}
+	// The prefix is retained for the duration of the prefix iteration, so it is
+	// copied rather than aliasing the caller's key.
+	i.prefixBuf = append(i.prefixBuf[:0], key[:n]...)
+	i.prefix = i.prefixBuf
+	if lower := i.opts.LowerBound; lower != nil && i.cmp(key, lower) < 0 {
+		key = lower
+	}
+	i.iter.SeekPrefixGE(i.prefix, key)
+	i.findNextEntry()
+}
+
 func (i *dbIter) SeekLT(key []byte) {
 	if i.err != nil {
 		return
 	}
+	i.prefix = nil
+	if upper := i.opts.UpperBound; upper != nil && i.cmp(key, upper) > 0 {
+		key = upper
+	}
 	i.iter.SeekLT(key)
 	i.findPrevEntry()
 }
@@ -215,7 +324,12 @@ func (i *dbIter) First() {
 	if i.err != nil {
 		return
 	}
-	i.iter.First()
+	i.prefix = nil
+	if lower := i.opts.LowerBound; lower != nil {
+		i.iter.SeekGE(lower)
+	} else {
+		i.iter.First()
+	}
 	i.findNextEntry()
 }
 
@@ -223,7 +337,12 @@ func (i *dbIter) Last() {
 	if i.err != nil {
 		return
 	}
-	i.iter.Last()
+	i.prefix = nil
+	if upper := i.opts.UpperBound; upper != nil {
+		i.iter.SeekLT(upper)
+	} else {
+		i.iter.Last()
+	}
 	i.findPrevEntry()
 }
 
@@ -246,6 +365,11 @@ func (i *dbIter) Prev() bool {
 	if i.err != nil {
 		return false
 	}
+	if i.prefix != nil {
+		// Reverse iteration is not supported in prefix iteration mode.
+		i.valid = false
+		return false
+	}
 	switch i.pos {
 	case dbIterCur:
 		i.iter.PrevUserKey()
@@ -265,6 +389,13 @@ func (i *dbIter) Value() []byte {
 	return i.value
 }
 
+func (i *dbIter) ValueAndErr() ([]byte, error) {
+	if !i.valid {
+		return nil, i.err
+	}
+	return i.value, nil
+}
+
 func (i *dbIter) Valid() bool {
 	return i.valid
 }
@@ -273,6 +404,60 @@ func (i *dbIter) Error() error {
 	return i.err
 }
 
+func (i *dbIter) SetBounds(lower, upper []byte) {
+	i.opts.LowerBound = lower
+	i.opts.UpperBound = upper
+	i.valid = false
+	i.pos = dbIterCur
+	i.prefix = nil
+}
+
+func (i *dbIter) Prepare(start, end []byte) error {
+	if i.err != nil {
+		return i.err
+	}
+	if i.version == nil {
+		return errIterClosed
+	}
+	for level := range i.version.files {
+		for j := range i.version.files[level] {
+			meta := &i.version.files[level][j]
+			if (start != nil && i.cmp(meta.largest.UserKey, start) < 0) ||
+				(end != nil && i.cmp(meta.smallest.UserKey, end) >= 0) {
+				continue
+			}
+			// The data block holding start, or the first data block of a table
+			// starting after it. The bounds of a virtual table lie within its
+			// backing table.
+			key := meta.smallest.UserKey
+			if start != nil && i.cmp(start, key) > 0 {
+				key = start
+			}
+			stats := &i.db.readStats.Iter[level]
+			err := i.db.tableCache.withReader(meta, func(r *sstable.Reader) error {
+				return r.Prefetch(key, stats)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (i *dbIter) Clone() db.Iterator {
+	if i.err != nil {
+		return &dbIter{err: i.err}
+	}
+	if i.version == nil {
+		return &dbIter{err: errIterClosed}
+	}
+	// The clone shares the view of the receiver, and holds its own reference
+	// on the version.
+	i.version.ref()
+	return i.db.newDBIter(i.batch, i.memtables, i.version, i.seqNum, &i.opts)
+}
+
 func (i *dbIter) Close() error {
 	if i.version != nil {
 		i.version.unref()
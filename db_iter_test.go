@@ -24,7 +24,7 @@ func TestDBIter(t *testing.T) {
 	newIter := func(seqNum uint64) *dbIter {
 		return &dbIter{
 			cmp:    db.DefaultComparer.Compare,
-			merge:  db.DefaultMerger.Merge,
+			merge:  db.DefaultMerger,
 			iter:   &fakeIter{keys: keys, vals: vals},
 			seqNum: seqNum,
 		}
@@ -64,15 +64,39 @@ func TestDBIter(t *testing.T) {
 						return fmt.Sprintf("seek-ge <key>\n")
 					}
 					iter.SeekGE([]byte(strings.TrimSpace(parts[1])))
+				case "seek-prefix-ge":
+					if len(parts) != 2 {
+						return fmt.Sprintf("seek-prefix-ge <key>\n")
+					}
+					iter.SeekPrefixGE([]byte(strings.TrimSpace(parts[1])))
 				case "seek-lt":
 					if len(parts) != 2 {
 						return fmt.Sprintf("seek-lt <key>\n")
 					}
 					iter.SeekLT([]byte(strings.TrimSpace(parts[1])))
+				case "first":
+					iter.First()
+				case "last":
+					iter.Last()
 				case "next":
 					iter.Next()
 				case "prev":
 					iter.Prev()
+				case "set-bounds":
+					var lower, upper []byte
+					for _, arg := range parts[1:] {
+						switch {
+						case strings.HasPrefix(arg, "lower="):
+							lower = []byte(strings.TrimPrefix(arg, "lower="))
+						case strings.HasPrefix(arg, "upper="):
+							upper = []byte(strings.TrimPrefix(arg, "upper="))
+						default:
+							return fmt.Sprintf("set-bounds [lower=<key>] [upper=<key>]\n")
+						}
+					}
+					iter.SetBounds(lower, upper)
+					fmt.Fprintf(&b, ".\n")
+					continue
 				default:
 					return fmt.Sprintf("unknown op: %s", parts[0])
 				}
@@ -7,15 +7,20 @@ package pebble
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"math/rand"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/storage"
 )
@@ -219,6 +224,1024 @@ func TestBasicReads(t *testing.T) {
 	}
 }
 
+func TestBatchOnCommit(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	var seqNums []uint64
+	for i := 0; i < 3; i++ {
+		b := d.NewBatch()
+		key := []byte(strconv.Itoa(i))
+		_ = b.Set(key, key, nil)
+		b.OnCommit(func(seqNum uint64, err error) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The batch must be visible when the callback is invoked.
+			if v, err := d.Get(key); err != nil {
+				t.Fatal(err)
+			} else if string(v) != string(key) {
+				t.Fatalf("expected %s, but found %s", key, v)
+			}
+			seqNums = append(seqNums, seqNum)
+		})
+		if err := b.Commit(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(seqNums) != 3 {
+		t.Fatalf("expected 3 callbacks, but found %d", len(seqNums))
+	}
+	for i := 1; i < len(seqNums); i++ {
+		if seqNums[i] <= seqNums[i-1] {
+			t.Fatalf("expected increasing sequence numbers: %d", seqNums)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The callback is also invoked for a batch rejected before entering the
+	// commit pipeline.
+	d, err = Open("", &db.Options{
+		ReadOnly: true,
+		Storage:  mem,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	var called bool
+	b := d.NewBatch()
+	_ = b.Set([]byte("a"), []byte("a"), nil)
+	b.OnCommit(func(seqNum uint64, err error) {
+		if seqNum != 0 || err != ErrReadOnly {
+			t.Fatalf("expected 0, %v, but found %d, %v", ErrReadOnly, seqNum, err)
+		}
+		called = true
+	})
+	if err := b.Commit(nil); err != ErrReadOnly {
+		t.Fatalf("expected %v, but found %v", ErrReadOnly, err)
+	}
+	if !called {
+		t.Fatalf("expected callback to be invoked")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForBackgroundWork blocks until the background flushes and compactions
+// have finished, and the obsolete files they left behind have been deleted.
+func waitForBackgroundWork(d *DB) {
+	d.mu.Lock()
+	for d.mu.compact.flushing || d.mu.compact.compacting {
+		d.mu.compact.cond.Wait()
+	}
+	d.mu.Unlock()
+	d.deleter.wait()
+}
+
+func TestGetFilter(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		filterType db.FilterType
+	}{
+		{"block", db.BlockFilter},
+		{"table", db.TableFilter},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			d, err := Open("", &db.Options{
+				Levels: []db.LevelOptions{{
+					FilterPolicy: bloom.FilterPolicy(10),
+					FilterType:   c.filterType,
+				}},
+				Storage: storage.NewMem(),
+			})
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer d.Close()
+
+			// Write the even keys to one table, and then overwrite and delete some
+			// of them in a second table.
+			for i := 0; i < 200; i += 2 {
+				if err := d.Set([]byte(fmt.Sprintf("%03d", i)), []byte("1"), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 200; i += 20 {
+				if err := d.Set([]byte(fmt.Sprintf("%03d", i)), []byte("2"), nil); err != nil {
+					t.Fatal(err)
+				}
+				if err := d.Delete([]byte(fmt.Sprintf("%03d", i+10)), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("%03d", i)
+				var expected string
+				switch {
+				case i%20 == 0:
+					expected = "2"
+				case i%10 == 0:
+					expected = "not found"
+				case i%2 == 0:
+					expected = "1"
+				default:
+					expected = "not found"
+				}
+				value, err := d.Get([]byte(key))
+				if err == db.ErrNotFound {
+					value = []byte("not found")
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				if string(value) != expected {
+					t.Fatalf("%s: expected %s, but found %s", key, expected, value)
+				}
+			}
+
+			// Each of the odd keys is ruled out by the filters of both tables, except
+			// for the occasional false positive.
+			m := d.Metrics()
+			if m.Filter.Hits < 150 {
+				t.Fatalf("expected the filters to be used, but found %d hits", m.Filter.Hits)
+			}
+			if m.Filter.Misses < 100 {
+				t.Fatalf("expected at least 100 misses, but found %d", m.Filter.Misses)
+			}
+		})
+	}
+}
+
+func TestReadVerifyChecksums(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Cache:   cache.New(1 << 20),
+		Logger:  discardLogger{},
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Set([]byte("a"), []byte("value"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	tables, err := d.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fileNum uint64
+	for _, level := range tables {
+		for _, f := range level {
+			fileNum = f.FileNum
+		}
+	}
+
+	// Populate the cache, and then corrupt the data block of the table.
+	if _, err := d.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	corruptTable(t, mem, fileNum, 0)
+	d.tableCache.evict(fileNum)
+
+	// The reads are served from the cache.
+	if _, err := d.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	first := func(o *db.IterOptions) bool {
+		iter := d.NewIter(o)
+		defer iter.Close()
+		iter.First()
+		return iter.Valid()
+	}
+	if !first(nil) {
+		t.Fatal("expected the iterator to find \"a\"")
+	}
+
+	// Unless they verify the checksums.
+	verify := &db.IterOptions{VerifyChecksums: true}
+	_, err = d.GetWithOptions([]byte("a"), verify)
+	if ce, ok := err.(*db.CorruptionError); !ok || ce.FileNum != fileNum {
+		t.Fatalf("expected a corruption of table %d, but found %v", fileNum, err)
+	}
+	if first(verify) {
+		t.Fatal("expected the corrupted block not to be read")
+	}
+}
+
+func TestIterSeekPrefixGE(t *testing.T) {
+	// Keys are composed of a row and a version separated by '@', and the prefix
+	// of a key is its row.
+	comparer := *db.DefaultComparer
+	comparer.Split = func(a []byte) int {
+		if i := bytes.IndexByte(a, '@'); i >= 0 {
+			return i
+		}
+		return len(a)
+	}
+	d, err := Open("", &db.Options{
+		Comparer: &comparer,
+		Levels: []db.LevelOptions{{
+			FilterPolicy: bloom.FilterPolicy(10),
+			FilterType:   db.TableFilter,
+		}},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer d.Close()
+
+	// Write two versions of each of the even rows, spread across two tables.
+	for v := 1; v <= 2; v++ {
+		for i := 0; i < 100; i += 2 {
+			key := []byte(fmt.Sprintf("%03d@%d", i, v))
+			if err := d.Set(key, []byte(fmt.Sprint(v)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	iter := d.NewIter(nil)
+	for i := 0; i < 100; i++ {
+		row := fmt.Sprintf("%03d", i)
+		var keys []string
+		for iter.SeekPrefixGE([]byte(row)); iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		var expected []string
+		if i%2 == 0 {
+			expected = []string{row + "@1", row + "@2"}
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(expected) {
+			t.Fatalf("%s: expected %s, but found %s", row, expected, keys)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each of the odd rows is ruled out by the filters of both tables, except
+	// for the occasional false positive.
+	if m := d.Metrics(); m.Filter.Hits < 75 {
+		t.Fatalf("expected the filters to be used, but found %d hits", m.Filter.Hits)
+	}
+}
+
+func TestReadMetrics(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Cache:                 cache.New(1 << 20),
+		FlushToL0:             true,
+		L0CompactionThreshold: 2,
+		Storage:               storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if m := d.Metrics(); m.ReadAmp != 1 {
+		t.Fatalf("expected read amplification 1, but found %d", m.ReadAmp)
+	}
+
+	// The first lookup reads the data block from the file, and the second
+	// finds it in the cache.
+	for i := 0; i < 2; i++ {
+		if _, err := d.Get([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := d.Metrics()
+	if r := m.Read.Get[0]; r.FileBytes == 0 || r.CacheBytes == 0 {
+		t.Fatalf("expected L0 lookups from the file and the cache, but found %+v", r)
+	}
+	if r := m.Read.Iter[0]; r.FileBytes != 0 || r.CacheBytes != 0 {
+		t.Fatalf("expected no L0 iterator reads, but found %+v", r)
+	}
+
+	iter := d.NewIter(nil)
+	for iter.First(); iter.Valid(); iter.Next() {
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r := d.Metrics().Read.Iter[0]; r.FileBytes != 0 || r.CacheBytes == 0 {
+		t.Fatalf("expected L0 iterator reads from the cache, but found %+v", r)
+	}
+
+	// A second, overlapping L0 table triggers a compaction of both into L1.
+	for _, k := range []string{"a", "b"} {
+		if err := d.Set([]byte(k), []byte("2"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	for d.mu.compact.compacting || len(d.mu.versions.currentVersion().files[0]) > 0 {
+		d.mu.compact.cond.Wait()
+	}
+	d.mu.Unlock()
+
+	m = d.Metrics()
+	if m.ReadAmp != 1 {
+		t.Fatalf("expected read amplification 1, but found %d", m.ReadAmp)
+	}
+	if r := m.Read.Compaction[0]; r.FileBytes == 0 || r.CacheBytes == 0 {
+		t.Fatalf("expected L0 compaction reads from the file and the cache, but found %+v", r)
+	}
+	if _, err := d.Get([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if r := d.Metrics().Read.Get[1]; r.FileBytes == 0 {
+		t.Fatalf("expected L1 lookups from the file, but found %+v", r)
+	}
+}
+
+func TestWALMetrics(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Logger:  discardLogger{},
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("x"), 1000)
+	for i := 0; i < 10; i++ {
+		if err := d.Set([]byte(strconv.Itoa(i)), value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := d.Metrics()
+	if m.WAL.Files != 1 || m.WAL.Size < 10000 || m.WAL.LiveSize != m.WAL.Size {
+		t.Fatalf("unexpected WAL metrics: %d files, %d bytes, %d live bytes",
+			m.WAL.Files, m.WAL.Size, m.WAL.LiveSize)
+	}
+	if m.WAL.ReplayedBytes != 0 {
+		t.Fatalf("expected no replayed bytes, but found %d", m.WAL.ReplayedBytes)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A read-only DB keeps the replayed WAL live.
+	d, err = Open("", &db.Options{
+		Logger:   discardLogger{},
+		ReadOnly: true,
+		Storage:  mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = d.Metrics()
+	if m.WAL.Files != 1 || m.WAL.Size != 0 || m.WAL.LiveSize < 10000 {
+		t.Fatalf("unexpected WAL metrics: %d files, %d bytes, %d live bytes",
+			m.WAL.Files, m.WAL.Size, m.WAL.LiveSize)
+	}
+	if m.WAL.ReplayedBytes < 10000 {
+		t.Fatalf("expected the batches to be replayed, but found %d bytes", m.WAL.ReplayedBytes)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Otherwise the replayed WAL is flushed and becomes obsolete.
+	d, err = Open("", &db.Options{
+		Logger:  discardLogger{},
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.deleter.wait()
+	m = d.Metrics()
+	if m.WAL.Files != 1 || m.WAL.Size != 0 || m.WAL.LiveSize != 0 {
+		t.Fatalf("unexpected WAL metrics: %d files, %d bytes, %d live bytes",
+			m.WAL.Files, m.WAL.Size, m.WAL.LiveSize)
+	}
+	if m.WAL.ObsoleteFiles != 0 || m.WAL.ObsoleteSize != 0 {
+		t.Fatalf("expected the obsolete WAL to be deleted, but found %d files of %d bytes",
+			m.WAL.ObsoleteFiles, m.WAL.ObsoleteSize)
+	}
+}
+
+func TestIterCloneAndSetBounds(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer d.Close()
+
+	scan := func(iter db.Iterator) string {
+		var keys []string
+		for iter.First(); iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return strings.Join(keys, " ")
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := d.Set([]byte(k), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	iter := d.NewIter(&db.IterOptions{LowerBound: []byte("b")})
+	if err := d.Set([]byte("d"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The clone shares the view and bounds of the iterator, and outlives it.
+	clone := iter.Clone()
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := scan(clone); s != "b c" {
+		t.Fatalf("expected \"b c\", but found %q", s)
+	}
+	clone.SetBounds(nil, []byte("b"))
+	if s := scan(clone); s != "a" {
+		t.Fatalf("expected \"a\", but found %q", s)
+	}
+	clone.SetBounds(nil, nil)
+	if s := scan(clone); s != "a b c" {
+		t.Fatalf("expected \"a b c\", but found %q", s)
+	}
+	if err := clone.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A clone of a batch iterator includes the contents of the batch.
+	b := d.NewIndexedBatch()
+	if err := b.Set([]byte("e"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	iter = b.NewIter(nil)
+	clone = iter.Clone()
+	if s := scan(clone); s != "a b c d e" {
+		t.Fatalf("expected \"a b c d e\", but found %q", s)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := clone.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// firstKeyCollector records the first key of a table in its user properties.
+type firstKeyCollector struct {
+	first []byte
+}
+
+func TestIterPrepare(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := d.Set([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open("", &db.Options{
+		Cache:   cache.New(1 << 20),
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	fileBytes := func() int64 {
+		var n int64
+		for _, s := range d.Metrics().Read.Iter {
+			n += s.FileBytes
+		}
+		return n
+	}
+
+	iter := d.NewIter(nil)
+	if err := iter.Prepare([]byte("0500"), []byte("0600")); err != nil {
+		t.Fatal(err)
+	}
+	prefetched := fileBytes()
+	if prefetched == 0 {
+		t.Fatalf("expected Prepare to read a block")
+	}
+	if iter.Valid() {
+		t.Fatalf("expected the iterator to remain unpositioned")
+	}
+
+	// The block read by the seek was prefetched.
+	iter.SeekGE([]byte("0500"))
+	if !iter.Valid() || string(iter.Key()) != "0500" {
+		t.Fatalf("expected 0500, but found %q", iter.Key())
+	}
+	if n := fileBytes(); n != prefetched {
+		t.Fatalf("expected the seek to read from the cache, but %d bytes were read from the file",
+			n-prefetched)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := iter.Prepare(nil, nil); err != errIterClosed {
+		t.Fatalf("expected %v, but found %v", errIterClosed, err)
+	}
+}
+
+func (c *firstKeyCollector) Add(key db.InternalKey, value []byte) error {
+	if c.first == nil {
+		c.first = append([]byte(nil), key.UserKey...)
+	}
+	return nil
+}
+
+func (c *firstKeyCollector) Finish(userProps map[string]string) error {
+	userProps["test.first"] = string(c.first)
+	return nil
+}
+
+func (c *firstKeyCollector) Name() string {
+	return "firstKeyCollector"
+}
+
+func TestIterTableFilter(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+		TablePropertyCollectors: []func() db.TablePropertyCollector{
+			func() db.TablePropertyCollector { return &firstKeyCollector{} },
+		},
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer d.Close()
+
+	for _, keys := range [][]string{{"a", "b"}, {"c", "d"}, {"e"}} {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if keys[0] != "e" {
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var filtered []string
+	iter := d.NewIter(&db.IterOptions{
+		TableFilter: func(userProps map[string]string) bool {
+			filtered = append(filtered, userProps["test.first"])
+			return userProps["test.first"] != "c"
+		},
+	})
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The memtable is not filtered.
+	if s := strings.Join(keys, " "); s != "a b e" {
+		t.Fatalf("expected \"a b e\", but found %q", s)
+	}
+	sort.Strings(filtered)
+	if s := strings.Join(filtered, " "); s != "a c" {
+		t.Fatalf("expected \"a c\", but found %q", s)
+	}
+}
+
+func TestIterKeyValueLifetime(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer d.Close()
+
+	// Place the keys in both an sstable and the memtable.
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		key := fmt.Sprintf("%03d", i)
+		if err := d.Set([]byte(key), []byte("v"+key), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The key and value remain valid until the iterator is repositioned, even
+	// when the remaining methods are called.
+	iter := d.NewIter(nil)
+	n := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		key, value := iter.Key(), iter.Value()
+		expected := fmt.Sprintf("%03d", n)
+		if v, err := iter.ValueAndErr(); err != nil || string(v) != "v"+expected {
+			t.Fatalf("expected %q, but found %q (%v)", "v"+expected, v, err)
+		}
+		_ = iter.Error()
+		if string(key) != expected || string(value) != "v"+expected {
+			t.Fatalf("expected %s:v%s, but found %s:%s", expected, expected, key, value)
+		}
+		n++
+	}
+	if n != 100 {
+		t.Fatalf("expected 100 keys, but found %d", n)
+	}
+	if v, err := iter.ValueAndErr(); v != nil || err != nil {
+		t.Fatalf("expected no value and no error, but found %q (%v)", v, err)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An error retrieving the value is reported by ValueAndErr.
+	s := d.NewSnapshot()
+	s.Close()
+	iter = s.NewIter(nil)
+	iter.First()
+	if v, err := iter.ValueAndErr(); v != nil || err != ErrSnapshotClosed {
+		t.Fatalf("expected %v, but found %q (%v)", ErrSnapshotClosed, v, err)
+	}
+}
+
+func TestSSTables(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if s, err := d.SSTables(); err != nil {
+		t.Fatal(err)
+	} else if s.String() != "" {
+		t.Fatalf("expected no tables, but found\n%s", s)
+	}
+
+	for _, k := range []string{"a", "c"} {
+		if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := d.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != numLevels {
+		t.Fatalf("expected %d levels, but found %d", numLevels, len(s))
+	}
+	// The flushed table does not overlap any other table, so it is written
+	// below L0.
+	if len(s[maxFlushLevel]) != 1 {
+		t.Fatalf("expected 1 table in L%d, but found\n%s", maxFlushLevel, s)
+	}
+	f := s[maxFlushLevel][0]
+	if string(f.Smallest.UserKey) != "a" || string(f.Largest.UserKey) != "c" {
+		t.Fatalf("unexpected bounds: %s-%s", f.Smallest, f.Largest)
+	}
+	if f.Size == 0 {
+		t.Fatalf("expected non-zero size")
+	}
+	if f.SmallestSeqNum != f.Smallest.SeqNum() || f.LargestSeqNum != f.Largest.SeqNum() ||
+		f.SmallestSeqNum >= f.LargestSeqNum {
+		t.Fatalf("unexpected seqnums: [%d-%d]", f.SmallestSeqNum, f.LargestSeqNum)
+	}
+	if str := s.String(); !strings.HasPrefix(str, fmt.Sprintf("L%d: 1 files, ", maxFlushLevel)) {
+		t.Fatalf("unexpected summary:\n%s", str)
+	}
+	if f.Properties != nil {
+		t.Fatalf("expected no properties unless requested")
+	}
+
+	if err := d.Delete([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = d.SSTables(WithProperties())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second table overlaps the first, and is written to the level above
+	// it.
+	if len(s[maxFlushLevel-1]) != 1 || len(s[maxFlushLevel]) != 1 {
+		t.Fatalf("expected a table in L%d and L%d, but found\n%s", maxFlushLevel-1, maxFlushLevel, s)
+	}
+	props := s[maxFlushLevel][0].Properties
+	if props == nil {
+		t.Fatalf("expected properties")
+	}
+	if props.NumEntries != 2 || props.NumDeletions != 0 || props.RawKeySize == 0 ||
+		props.RawValueSize != 2 {
+		t.Fatalf("unexpected properties:\n%s", props)
+	}
+	if props := s[maxFlushLevel-1][0].Properties; props.NumEntries != 1 || props.NumDeletions != 1 {
+		t.Fatalf("unexpected properties:\n%s", props)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type renamedMerger struct {
+	db.MergeOperator
+}
+
+func (renamedMerger) Name() string {
+	return "renamed"
+}
+
+func TestPerLevelOptions(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage:               storage.NewMem(),
+		FormatMajorVersion:    db.FormatMostCompatible,
+		L0CompactionThreshold: 2,
+		Levels: []db.LevelOptions{
+			{
+				Compression:  db.NoCompression,
+				FilterPolicy: bloom.FilterPolicy(10),
+				FilterType:   db.PartitionedFilter,
+			},
+			{Compression: db.SnappyCompression},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The metrics report the effective options of every level: defaults are
+	// applied, the last configured level is extended to the subsequent levels,
+	// and partitioned filters are not permitted at this format major version.
+	m := d.Metrics()
+	if l := m.Levels[0]; l.Compression != db.NoCompression || l.FilterType != db.TableFilter ||
+		l.BlockSize != 4096 {
+		t.Fatalf("unexpected L0 options: %+v", l)
+	}
+	for level := 1; level < numLevels; level++ {
+		l := m.Levels[level]
+		if l.Compression != db.SnappyCompression || l.FilterPolicy != nil {
+			t.Fatalf("unexpected L%d options: %+v", level, l)
+		}
+		if l.MaxBytes != 10*m.Levels[level-1].MaxBytes {
+			t.Fatalf("L%d: expected max-bytes %d, but found %d",
+				level, 10*m.Levels[level-1].MaxBytes, l.MaxBytes)
+		}
+	}
+	if err := d.RatchetFormatMajorVersion(db.FormatPartitionedFilters); err != nil {
+		t.Fatal(err)
+	}
+	if l := d.Metrics().Levels[0]; l.FilterType != db.PartitionedFilter {
+		t.Fatalf("expected partitioned filter, but found %d", l.FilterType)
+	}
+
+	// Flushes are written with the L0 options, and compactions with the options
+	// of their output level. The first flushes of the key are written below L0,
+	// one level above the previous one, until the L0 tables are compacted.
+	for i := 0; i < maxFlushLevel+2; i++ {
+		if err := d.Set([]byte("a"), []byte(strconv.Itoa(i)), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			s, err := d.SSTables(WithProperties())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name := s[maxFlushLevel][0].Properties.CompressionName; name != "NoCompression" {
+				t.Fatalf("expected flushed table to use NoCompression, but found %s", name)
+			}
+		}
+	}
+	d.mu.Lock()
+	for d.mu.compact.compacting || len(d.mu.versions.currentVersion().files[0]) >= 2 {
+		d.mu.compact.cond.Wait()
+	}
+	d.mu.Unlock()
+
+	s, err := d.SSTables(WithProperties())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s[0]) != 0 || len(s[1]) != 1 {
+		t.Fatalf("expected a single L1 table, but found\n%s", s)
+	}
+	if name := s[1][0].Properties.CompressionName; name != "Snappy" {
+		t.Fatalf("expected compacted table to use Snappy, but found %s", name)
+	}
+}
+
+func TestLogData(t *testing.T) {
+	mem := storage.NewMem()
+	opts := &db.Options{Storage: mem}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	seqNum := atomic.LoadUint64(&d.mu.versions.logSeqNum)
+	if err := d.LogData([]byte("marker"), db.Sync); err != nil {
+		t.Fatal(err)
+	}
+	// Log data does not consume a sequence number or become visible to reads.
+	if s := atomic.LoadUint64(&d.mu.versions.logSeqNum); s != seqNum {
+		t.Fatalf("expected sequence number %d, but found %d", seqNum, s)
+	}
+	if s := atomic.LoadUint64(&d.mu.versions.visibleSeqNum); s != seqNum {
+		t.Fatalf("expected visible sequence number %d, but found %d", seqNum, s)
+	}
+	b := d.NewIndexedBatch()
+	_ = b.LogData([]byte("in-batch"), nil)
+	_ = b.Set([]byte("b"), []byte("2"), nil)
+	if err := b.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		iter := d.NewIter(nil)
+		var keys []string
+		for iter.First(); iter.Valid(); iter.Next() {
+			keys = append(keys, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if s := strings.Join(keys, " "); s != "a:1 b:2" {
+			t.Fatalf("expected a:1 b:2, but found %s", s)
+		}
+	}
+	check()
+
+	d.mu.Lock()
+	logNum := d.mu.log.number
+	d.mu.Unlock()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := DumpWAL(&buf, dbFilename("", fileTypeLog, logNum), opts); err != nil {
+		t.Fatal(err)
+	}
+	expected := `record 0: seqnum=1 count=1 len=17
+    SET("a", "1") #1
+record 1: seqnum=2 count=0 len=20
+    LOGDATA("marker")
+record 2: seqnum=2 count=1 len=27
+    LOGDATA("in-batch")
+    SET("b", "2") #2
+`
+	if s := buf.String(); s != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, s)
+	}
+
+	// Replaying the WAL skips the log data.
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeOperatorMismatch(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := d.Merge([]byte("a"), []byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &db.Options{
+		Storage: mem,
+		Merger:  renamedMerger{db.DefaultMerger},
+	}
+	_, err = Open("", opts)
+	if err == nil || !strings.Contains(err.Error(), "merger name") {
+		t.Fatalf("expected merger mismatch error, but found %v", err)
+	}
+
+	removeOptions := func() {
+		ls, err := mem.List("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, filename := range ls {
+			if ft, _, ok := parseDBFilename(filename); ok && ft == fileTypeOptions {
+				if err := mem.Remove(filename); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	// Without the OPTIONS file, the mismatch is detected when the table is
+	// read.
+	removeOptions()
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	_, err = d.Get([]byte("a"))
+	if err == nil || !strings.Contains(err.Error(), "merge operator name") {
+		t.Fatalf("expected merge operator mismatch error, but found %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unless the merger name is recorded in the manifest, which is checked by
+	// Open.
+	removeOptions()
+	d, err = Open("", &db.Options{
+		FormatMajorVersion: db.FormatMergerName,
+		Storage:            mem,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	removeOptions()
+	_, err = Open("", opts)
+	if err == nil || !strings.Contains(err.Error(), "merger name from file") {
+		t.Fatalf("expected merger mismatch error, but found %v", err)
+	}
+}
+
 func TestBasicWrites(t *testing.T) {
 	d, err := Open("", &db.Options{
 		Storage: storage.NewMem(),
@@ -413,3 +1436,71 @@ func TestRandomWrites(t *testing.T) {
 		t.Fatalf("db Close: %v", err)
 	}
 }
+
+// slowSyncFS creates files whose syncs are delayed while slow is set.
+type slowSyncFS struct {
+	storage.Storage
+	slow int32
+}
+
+func (fs *slowSyncFS) Create(name string) (storage.File, error) {
+	f, err := fs.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &slowSyncFile{File: f, fs: fs}, nil
+}
+
+type slowSyncFile struct {
+	storage.File
+	fs *slowSyncFS
+}
+
+func (f *slowSyncFile) Sync() error {
+	if atomic.LoadInt32(&f.fs.slow) != 0 {
+		time.Sleep(20 * time.Millisecond)
+	}
+	return f.File.Sync()
+}
+
+func TestDiskSlow(t *testing.T) {
+	fs := &slowSyncFS{Storage: storage.NewMem()}
+	events := make(chan db.DiskSlowInfo, 10)
+	d, err := Open("", &db.Options{
+		DiskSlowThreshold: 10 * time.Millisecond,
+		EventListener: db.EventListener{
+			DiskSlow: func(info db.DiskSlowInfo) {
+				select {
+				case events <- info:
+				default:
+				}
+			},
+		},
+		Logger:  discardLogger{},
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.opts.Storage == fs {
+		t.Fatalf("expected the storage to be wrapped")
+	}
+
+	atomic.StoreInt32(&fs.slow, 1)
+	if err := d.Set([]byte("a"), []byte("b"), db.Sync); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case info := <-events:
+		if ft, _, ok := parseDBFilename(info.Path); !ok || ft != fileTypeLog || info.Op != "sync" {
+			t.Fatalf("unexpected event: %+v", info)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("slow sync not reported")
+	}
+	m := d.Metrics()
+	if m.Disk.SlowCount == 0 || m.Disk.MaxSyncLatency < 10*time.Millisecond {
+		t.Fatalf("slow sync not recorded: %+v", m.Disk)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/record"
+)
+
+// DumpWAL writes a human-readable description of the records in the
+// specified WAL to w. Each record is decoded as a batch and printed along with
+// its sequence number, followed by the batch's operations. Corrupted records
+// are reported and skipped, and the number of bytes skipped is printed last.
+func DumpWAL(w io.Writer, filename string, opts *db.Options) error {
+	opts = opts.EnsureDefaults()
+	f, err := opts.Storage.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	rr := record.NewReader(f)
+	for i := 0; ; i++ {
+		buf.Reset()
+		r, err := rr.Next()
+		if err == nil {
+			_, err = io.Copy(&buf, r)
+		}
+		if err == io.EOF {
+			if n := rr.Dropped(); n > 0 {
+				fmt.Fprintf(w, "dropped %d bytes of corrupted records\n", n)
+			}
+			return nil
+		}
+		if err != nil {
+			fmt.Fprintf(w, "record %d: %v\n", i, err)
+			rr.Recover()
+			continue
+		}
+		if buf.Len() < batchHeaderLen {
+			fmt.Fprintf(w, "record %d: invalid batch (too short): %d bytes\n", i, buf.Len())
+			continue
+		}
+
+		b := Batch{data: buf.Bytes()}
+		seqNum := b.seqNum()
+		fmt.Fprintf(w, "record %d: seqnum=%d count=%d len=%d\n", i, seqNum, b.count(), len(b.data))
+		iter := b.iter()
+		prepared := false
+		for j := uint64(0); ; {
+			kind, ukey, value, ok := iter.next()
+			if !ok {
+				break
+			}
+			switch kind {
+			case db.InternalKeyKindLogData, db.InternalKeyKindKeyspace,
+				db.InternalKeyKindCommitXID, db.InternalKeyKindRollbackXID:
+				// Log data and markers do not consume a sequence number.
+				fmt.Fprintf(w, "    %s(%q)\n", kind, ukey)
+				continue
+			case db.InternalKeyKindBeginPrepareXID:
+				// The entries of a prepared batch are assigned sequence numbers
+				// when the transaction commits.
+				fmt.Fprintf(w, "    %s(%q)\n", kind, ukey)
+				prepared = true
+				continue
+			}
+			fmt.Fprintf(w, "    %s(%q", kind, ukey)
+			switch kind {
+			case db.InternalKeyKindSet, db.InternalKeyKindMerge, db.InternalKeyKindRangeDelete:
+				fmt.Fprintf(w, ", %q", value)
+			}
+			if prepared {
+				fmt.Fprintf(w, ")\n")
+				continue
+			}
+			fmt.Fprintf(w, ") #%d\n", seqNum+j)
+			j++
+		}
+		if len(iter) != 0 {
+			fmt.Fprintf(w, "    corrupt batch: %d trailing bytes\n", len(iter))
+		}
+	}
+}
+
+// DumpManifest writes a human-readable description of the version edits in
+// the specified MANIFEST to w. Each edit is followed by the level structure
+// that results from applying it and all preceding edits.
+func DumpManifest(w io.Writer, filename string, opts *db.Options) error {
+	opts = opts.EnsureDefaults()
+	f, err := opts.Storage.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var v *version
+	rr := record.NewReader(f)
+	for i := 0; ; i++ {
+		r, err := rr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var ve versionEdit
+		if err := ve.decode(r); err != nil {
+			fmt.Fprintf(w, "edit %d: %v\n", i, err)
+			return err
+		}
+
+		fmt.Fprintf(w, "edit %d\n", i)
+		if ve.comparatorName != "" {
+			fmt.Fprintf(w, "  comparator:     %s\n", ve.comparatorName)
+		}
+		if ve.logNumber != 0 {
+			fmt.Fprintf(w, "  log-num:        %d\n", ve.logNumber)
+		}
+		if ve.prevLogNumber != 0 {
+			fmt.Fprintf(w, "  prev-log-num:   %d\n", ve.prevLogNumber)
+		}
+		if ve.nextFileNumber != 0 {
+			fmt.Fprintf(w, "  next-file-num:  %d\n", ve.nextFileNumber)
+		}
+		if ve.lastSequence != 0 {
+			fmt.Fprintf(w, "  last-seq-num:   %d\n", ve.lastSequence)
+		}
+		deleted := make([]deletedFileEntry, 0, len(ve.deletedFiles))
+		for df := range ve.deletedFiles {
+			deleted = append(deleted, df)
+		}
+		sort.Slice(deleted, func(i, j int) bool {
+			if deleted[i].level != deleted[j].level {
+				return deleted[i].level < deleted[j].level
+			}
+			return deleted[i].fileNum < deleted[j].fileNum
+		})
+		for _, df := range deleted {
+			fmt.Fprintf(w, "  deleted:        L%d %06d\n", df.level, df.fileNum)
+		}
+		for _, nf := range ve.newFiles {
+			fmt.Fprintf(w, "  added:          L%d %s\n", nf.level, describeFile(&nf.meta))
+		}
+
+		var bve bulkVersionEdit
+		bve.accumulate(&ve)
+		newV, err := bve.apply(opts, v, opts.Comparer.Compare)
+		if err != nil {
+			fmt.Fprintf(w, "  %v\n", err)
+			continue
+		}
+		v = newV
+		for level := range v.files {
+			if len(v.files[level]) == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "  L%d:\n", level)
+			for j := range v.files[level] {
+				fmt.Fprintf(w, "    %s\n", describeFile(&v.files[level][j]))
+			}
+		}
+	}
+}
+
+func describeFile(m *fileMetadata) string {
+	return fmt.Sprintf("%06d:%d[%s-%s]", m.fileNum, m.size, m.smallest, m.largest)
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestDump(t *testing.T) {
+	mem := storage.NewMem()
+	opts := &db.Options{
+		Logger:  discardLogger{},
+		Storage: mem,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	b := d.NewBatch()
+	b.Merge([]byte("b"), []byte("2"), nil)
+	b.Delete([]byte("c"), nil)
+	if err := d.Apply(b, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	logNum := d.mu.log.number
+	manifestNum := d.mu.versions.manifestFileNumber
+	d.mu.Unlock()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := DumpWAL(&buf, dbFilename("", fileTypeLog, logNum), opts); err != nil {
+		t.Fatal(err)
+	}
+	expected := `record 0: seqnum=2 count=2 len=20
+    MERGE("b", "2") #2
+    DEL("c") #3
+`
+	if s := buf.String(); s != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, s)
+	}
+
+	buf.Reset()
+	if err := DumpManifest(&buf, dbFilename("", fileTypeManifest, manifestNum), opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"comparator:     leveldb.BytewiseComparator", "added:          L2", "  L2:\n"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("expected %q in\n%s", s, buf.String())
+		}
+	}
+
+	// A corrupted record of the WAL is reported, along with the number of
+	// bytes skipped.
+	filename := dbFilename("", fileTypeLog, logNum)
+	f, err := mem.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	data[0] ^= 0xff
+	f, err = mem.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	buf.Reset()
+	if err := DumpWAL(&buf, filename, opts); err != nil {
+		t.Fatal(err)
+	}
+	expected = fmt.Sprintf(`record 0: pebble/record: invalid chunk (checksum mismatch)
+dropped %d bytes of corrupted records
+`, len(data))
+	if s := buf.String(); s != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, s)
+	}
+}
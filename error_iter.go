@@ -19,6 +19,9 @@ func newErrorIter(err error) *errorIter {
 func (c *errorIter) SeekGE(key []byte) {
 }
 
+func (c *errorIter) SeekPrefixGE(prefix, key []byte) {
+}
+
 func (c *errorIter) SeekLT(key []byte) {
 }
 
@@ -0,0 +1,393 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+)
+
+// ErrSnapshotOverlap is returned by DeletePrefix if the deleted range
+// overlaps the data visible to an open snapshot.
+var ErrSnapshotOverlap = errors.New("pebble: prefix deletion overlaps an open snapshot")
+
+// IngestAndExcise ingests a set of sstables into the DB while atomically
+// removing all of the existing data in the key range [span.Start,
+// span.Limit). Once IngestAndExcise returns, the data within the span is
+// exactly the data in the ingested sstables, which must lie entirely within
+// the span. This allows the contents of a key range to be replaced
+// wholesale, such as when applying a snapshot of the range received from
+// another node.
+//
+// The excised data is removed in the same version edit that adds the
+// ingested sstables. Existing sstables which lie entirely within the span are
+// dropped, while those which straddle a boundary of the span are replaced by
+// virtual sstables referencing the data outside the span. If the DB's format
+// major version predates db.FormatVirtualSSTables, the straddling sstables
+// are instead rewritten to contain only the data outside the span. Flushes
+// and compactions are paused while the excise is performed.
+func (d *DB) IngestAndExcise(paths []string, span Range) error {
+	if d.cmp(span.Start, span.Limit) >= 0 {
+		return fmt.Errorf("pebble: invalid excise span [%q, %q)", span.Start, span.Limit)
+	}
+	return d.Ingest(paths, func(o *ingestOptions) {
+		o.exciseSpan = &span
+	})
+}
+
+// DeletePrefix deletes every key with the specified byte prefix, which spans
+// the key range [prefix, PrefixSuccessor(prefix)). Rather than writing a
+// tombstone for each key, the range is excised from the LSM as by
+// IngestAndExcise with no sstables: the sstables lying entirely within the
+// range are dropped without being read, and those straddling a boundary of
+// the range are replaced by virtual sstables referencing the data outside
+// the range, which are marked for compaction so that the space used by the
+// deleted data is reclaimed.
+//
+// Unlike a range tombstone, the excise also removes the deleted data from the
+// view of the open snapshots, and of iterators and scan cursors reading at an
+// older sequence number with NewIterAt and ScanPage. DeletePrefix therefore
+// returns ErrSnapshotOverlap, and deletes nothing, if the range overlaps a
+// table holding data which is visible to an open snapshot, unless
+// o.IgnoreSnapshots is set. Iterators which are already open are unaffected.
+//
+// DeletePrefix requires the Comparer to implement PrefixSuccessor, and
+// returns an error for a prefix which has no successor, such as one made up
+// of 0xff bytes only.
+func (d *DB) DeletePrefix(prefix []byte, o *db.DeletePrefixOptions) error {
+	succ := d.opts.Comparer.PrefixSuccessor
+	if succ == nil {
+		return fmt.Errorf("pebble: comparer %s does not support prefix deletion", d.opts.Comparer.Name)
+	}
+	limit := succ(nil, prefix)
+	if limit == nil {
+		return fmt.Errorf("pebble: prefix %q has no successor", prefix)
+	}
+	ignoreSnapshots := o.GetIgnoreSnapshots()
+	return d.Ingest(nil, func(o *ingestOptions) {
+		o.exciseSpan = &Range{Start: prefix, Limit: limit}
+		o.deletePrefix = true
+		o.ignoreSnapshots = ignoreSnapshots
+	})
+}
+
+// exciseVerify verifies that the ingested sstables lie within the excise
+// span.
+func exciseVerify(cmp db.Compare, span Range, meta []*fileMetadata) error {
+	for _, m := range meta {
+		if cmp(m.smallest.UserKey, span.Start) < 0 || cmp(m.largest.UserKey, span.Limit) >= 0 {
+			return fmt.Errorf("pebble: sstable [%q, %q] is not within the excise span [%q, %q)",
+				m.smallest.UserKey, m.largest.UserKey, span.Start, span.Limit)
+		}
+	}
+	return nil
+}
+
+// exciseMemtableOverlaps returns true if the memtable contains any keys
+// within the excise span.
+func exciseMemtableOverlaps(mem *memTable, span Range) bool {
+	iter := mem.NewIter(nil)
+	defer iter.Close()
+
+	iter.SeekGE(span.Start)
+	return iter.Valid() && mem.cmp(iter.Key().UserKey, span.Limit) < 0
+}
+
+// ingestExciseApply removes the existing data within the excise span from the
+// LSM, and adds the ingested sstables, in a single version edit. For a prefix
+// deletion, the virtual tables which replace the tables straddling a boundary
+// of the span are marked for compaction, and the prefix deletion metrics are
+// updated. A prefix deletion fails with ErrSnapshotOverlap if the span
+// overlaps the data visible to an open snapshot, unless o.ignoreSnapshots is
+// set.
+func (d *DB) ingestExciseApply(meta []*fileMetadata, o *ingestOptions) (err error) {
+	span, deletePrefix := *o.exciseSpan, o.deletePrefix
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Wait for any in-progress flush or compaction, which may be writing data
+	// within the span, and prevent new ones from starting until the version
+	// edit has been applied. The mutex is held for the duration of the excise,
+	// so no other version edits can be applied concurrently.
+	for d.mu.compact.compacting || d.mu.compact.flushing {
+		d.mu.compact.cond.Wait()
+	}
+	if err := d.backgroundError(); err != nil {
+		return err
+	}
+	// The memtables overlapping the span have been flushed, so the data
+	// within the span is held by the tables of the current version. The
+	// snapshots are checked under the mutex held for the version edit, so a
+	// snapshot cannot be created between the check and the excise.
+	if deletePrefix && !o.ignoreSnapshots && d.exciseSnapshotOverlap(span) {
+		return ErrSnapshotOverlap
+	}
+	d.mu.compact.compacting = true
+	d.mu.compact.flushing = true
+
+	var outputs []uint64
+	defer func() {
+		for _, fileNum := range outputs {
+			delete(d.mu.compact.pendingOutputs, fileNum)
+			if err != nil {
+				d.opts.Storage.Remove(dbFilename(d.dirname, fileTypeTable, fileNum))
+			}
+		}
+		d.mu.compact.compacting = false
+		d.mu.compact.flushing = false
+		d.maybeScheduleFlush()
+		d.maybeScheduleCompaction()
+		d.mu.compact.cond.Broadcast()
+	}()
+	newFileNum := func() uint64 {
+		fileNum := d.mu.versions.nextFileNum()
+		d.mu.compact.pendingOutputs[fileNum] = struct{}{}
+		outputs = append(outputs, fileNum)
+		return fileNum
+	}
+
+	ve := &versionEdit{
+		deletedFiles: map[deletedFileEntry]bool{},
+	}
+	// Virtual tables allow the data outside the span to be referenced in place
+	// rather than copied.
+	virtual := d.FormatMajorVersion() >= db.FormatVirtualSSTables
+	current := d.mu.versions.currentVersion()
+	var dropped, marked int
+	for level := range current.files {
+		// The level 0 tables must be ordered by sequence number, which is
+		// implied by their file numbers. Once a level 0 table has been rewritten
+		// with a new file number, every subsequent level 0 table must also be
+		// given a new file number in order to preserve the ordering.
+		renumber := false
+		for i := range current.files[level] {
+			f := &current.files[level][i]
+			before := d.cmp(f.largest.UserKey, span.Start) < 0
+			after := d.cmp(f.smallest.UserKey, span.Limit) >= 0
+			if (before || after) && !renumber {
+				continue
+			}
+			ve.deletedFiles[deletedFileEntry{level: level, fileNum: f.fileNum}] = true
+			if before || after {
+				m := *f
+				m.fileNum = newFileNum()
+				if virtual {
+					m.backingFileNum = f.diskFileNum()
+				} else if err := d.opts.Storage.Link(dbFilename(d.dirname, fileTypeTable, f.fileNum),
+					dbFilename(d.dirname, fileTypeTable, m.fileNum)); err != nil {
+					return err
+				}
+				ve.newFiles = append(ve.newFiles, newFileEntry{level: level, meta: m})
+				continue
+			}
+			if d.cmp(span.Start, f.smallest.UserKey) <= 0 && d.cmp(f.largest.UserKey, span.Limit) < 0 {
+				// The table lies entirely within the span.
+				dropped++
+				continue
+			}
+			var metas []fileMetadata
+			var err error
+			if virtual {
+				metas, err = d.exciseVirtual(f, span, newFileNum)
+				if deletePrefix {
+					// The backing table still holds the deleted data, which is only
+					// reclaimed once the virtual tables are compacted.
+					for i := range metas {
+						metas[i].markedForCompaction = true
+					}
+					marked += len(metas)
+				}
+			} else {
+				metas, err = d.exciseTable(f, level, span, newFileNum)
+			}
+			if err != nil {
+				return err
+			}
+			for _, m := range metas {
+				ve.newFiles = append(ve.newFiles, newFileEntry{level: level, meta: m})
+			}
+			renumber = level == 0
+		}
+	}
+
+	// Determine the levels for the ingested sstables from the version with the
+	// data in the span removed.
+	var bve bulkVersionEdit
+	bve.accumulate(ve)
+	excised, err := bve.apply(d.opts, current, d.cmp)
+	if err != nil {
+		return err
+	}
+	for _, m := range meta {
+		ve.newFiles = append(ve.newFiles, newFileEntry{
+			level: ingestTargetLevel(d.cmp, excised, m),
+			meta:  *m,
+		})
+	}
+	if err := d.mu.versions.logAndApply(d.opts, d.dirname, ve); err != nil {
+		return err
+	}
+	if deletePrefix {
+		m := &d.mu.metrics.DeletePrefix
+		m.Count++
+		m.TablesDropped += int64(dropped)
+		m.TablesMarked += int64(marked)
+	}
+	d.deleteObsoleteFiles()
+	return nil
+}
+
+// exciseSnapshotOverlap returns true if a table in the current version which
+// overlaps the span holds data visible to an open snapshot. A table holds
+// such data if its smallest sequence number is no larger than the sequence
+// number of the newest snapshot. d.mu must be held.
+func (d *DB) exciseSnapshotOverlap(span Range) bool {
+	snapshots := d.mu.snapshots.toSlice()
+	if len(snapshots) == 0 {
+		return false
+	}
+	newest := snapshots[len(snapshots)-1]
+	current := d.mu.versions.currentVersion()
+	for level := range current.files {
+		for i := range current.files[level] {
+			f := &current.files[level][i]
+			if f.smallestSeqNum <= newest &&
+				d.cmp(f.largest.UserKey, span.Start) >= 0 && d.cmp(f.smallest.UserKey, span.Limit) < 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exciseVirtual returns virtual tables referencing the data in the table that
+// lies outside the span. The data before and after the span is referenced by
+// separate virtual tables.
+func (d *DB) exciseVirtual(
+	f *fileMetadata, span Range, newFileNum func() uint64,
+) (metas []fileMetadata, err error) {
+	iter, err := d.newIter(f)
+	if err != nil {
+		return nil, err
+	}
+	add := func(smallest, largest db.InternalKey) {
+		metas = append(metas, fileMetadata{
+			fileNum:        newFileNum(),
+			backingFileNum: f.diskFileNum(),
+			smallest:       smallest,
+			largest:        largest,
+			smallestSeqNum: f.smallestSeqNum,
+			largestSeqNum:  f.largestSeqNum,
+		})
+	}
+	if iter.SeekLT(span.Start); iter.Valid() {
+		add(f.smallest, iter.Key().Clone())
+	}
+	if iter.SeekGE(span.Limit); iter.Valid() {
+		add(iter.Key().Clone(), f.largest)
+	}
+	if err := firstError(iter.Error(), iter.Close()); err != nil {
+		return nil, err
+	}
+
+	err = d.tableCache.withReader(f, func(r *sstable.Reader) error {
+		for i := range metas {
+			m := &metas[i]
+			size, err := r.EstimateDiskUsage(m.smallest.UserKey, m.largest.UserKey)
+			if err != nil {
+				return err
+			}
+			m.size = size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metas, nil
+}
+
+// exciseTable writes the data in the table that lies outside the span into
+// new tables, returning the metadata for the new tables. The data before and
+// after the span is written to separate tables.
+func (d *DB) exciseTable(
+	f *fileMetadata, level int, span Range, newFileNum func() uint64,
+) (metas []fileMetadata, err error) {
+	iter, err := d.newIter(f)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = firstError(err, iter.Close())
+	}()
+
+	var tw *sstable.Writer
+	var meta fileMetadata
+	finish := func() error {
+		if tw == nil {
+			return nil
+		}
+		if err := tw.Close(); err != nil {
+			tw = nil
+			return err
+		}
+		stat, err := tw.Stat()
+		tw = nil
+		if err != nil {
+			return err
+		}
+		meta.size = uint64(stat.Size())
+		metas = append(metas, meta)
+		return nil
+	}
+	defer func() {
+		if tw != nil {
+			tw.Close()
+		}
+	}()
+
+	add := func(key db.InternalKey, value []byte) error {
+		if tw == nil {
+			meta = fileMetadata{
+				fileNum:        newFileNum(),
+				smallest:       key.Clone(),
+				smallestSeqNum: db.InternalKeySeqNumMax,
+			}
+			file, err := d.opts.Storage.Create(dbFilename(d.dirname, fileTypeTable, meta.fileNum))
+			if err != nil {
+				return err
+			}
+			tw = d.newTableWriter(file, level)
+		}
+		// Avoid the memory allocation in InternalKey.Clone() by reusing the
+		// buffer in largest.
+		meta.largest.UserKey = append(meta.largest.UserKey[:0], key.UserKey...)
+		meta.largest.Trailer = key.Trailer
+		meta.updateSeqNum(key.SeqNum())
+		return tw.Add(key, value)
+	}
+
+	for iter.First(); iter.Valid() && d.cmp(iter.Key().UserKey, span.Start) < 0; iter.Next() {
+		if err := add(iter.Key(), iter.Value()); err != nil {
+			return nil, err
+		}
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	for iter.SeekGE(span.Limit); iter.Valid(); iter.Next() {
+		if err := add(iter.Key(), iter.Value()); err != nil {
+			return nil, err
+		}
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return metas, iter.Error()
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// Package exporter exports the metrics of a DB for monitoring systems. The
+// metrics are named and labeled following the conventions of Prometheus, and
+// can be published via expvar or served in the Prometheus text format. The
+// metrics are gathered from DB.Metrics each time they are read.
+package exporter // import "github.com/petermattis/pebble/exporter"
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/petermattis/pebble"
+	"github.com/petermattis/pebble/histogram"
+	"github.com/petermattis/pebble/sstable"
+)
+
+// quantiles are the quantiles reported for latency histograms.
+var quantiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+// Values returns the metrics as a map from the metric name, including its
+// labels, to the value of the metric. Durations are reported in seconds.
+func Values(m *pebble.Metrics) map[string]float64 {
+	v := map[string]float64{
+		"pebble_flush_count":                   float64(m.Flush.Count),
+		"pebble_compact_count":                 float64(m.Compact.Count),
+		"pebble_delete_prefix_count":           float64(m.DeletePrefix.Count),
+		"pebble_filter_hits":                   float64(m.Filter.Hits),
+		"pebble_filter_misses":                 float64(m.Filter.Misses),
+		"pebble_filter_false_positives":        float64(m.Filter.FalsePositives),
+		"pebble_cache_bytes":                   float64(m.Cache.Size),
+		"pebble_cache_hits":                    float64(m.Cache.Hits),
+		"pebble_cache_misses":                  float64(m.Cache.Misses),
+		"pebble_cache_evictions":               float64(m.Cache.Evictions),
+		"pebble_compressed_cache_bytes":        float64(m.CompressedCache.Size),
+		"pebble_compressed_cache_hits":         float64(m.CompressedCache.Hits),
+		"pebble_compressed_cache_misses":       float64(m.CompressedCache.Misses),
+		"pebble_compressed_cache_evictions":    float64(m.CompressedCache.Evictions),
+		"pebble_wal_syncs":                     float64(m.WAL.Syncs),
+		"pebble_wal_sync_seconds_total":        m.WAL.SyncDuration.Seconds(),
+		"pebble_wal_sync_max_seconds":          m.WAL.MaxSyncLatency.Seconds(),
+		"pebble_wal_files":                     float64(m.WAL.Files),
+		"pebble_wal_bytes":                     float64(m.WAL.Size),
+		"pebble_wal_live_bytes":                float64(m.WAL.LiveSize),
+		"pebble_wal_obsolete_files":            float64(m.WAL.ObsoleteFiles),
+		"pebble_wal_obsolete_bytes":            float64(m.WAL.ObsoleteSize),
+		"pebble_wal_replayed_bytes":            float64(m.WAL.ReplayedBytes),
+		"pebble_read_amp":                      float64(m.ReadAmp),
+		"pebble_memory_budget_bytes":           float64(m.Memory.Budget),
+		"pebble_memory_early_flushes":          float64(m.Memory.EarlyFlushes),
+		"pebble_memory_cache_shrinks":          float64(m.Memory.CacheShrinks),
+		"pebble_cache_capacity_bytes":          float64(m.Memory.CacheCapacity),
+		"pebble_corruption_reads":              float64(m.Corruption.Reads),
+		"pebble_suspect_tables":                float64(m.Corruption.SuspectTables),
+		"pebble_suspect_table_rewrites":        float64(m.Corruption.Rewrites),
+		"pebble_stall_count":                   float64(m.Stall.Count),
+		"pebble_stall_seconds_total":           m.Stall.Duration.Seconds(),
+		"pebble_disk_write_max_seconds":        m.Disk.MaxWriteLatency.Seconds(),
+		"pebble_disk_sync_max_seconds":         m.Disk.MaxSyncLatency.Seconds(),
+		"pebble_disk_slow_count":               float64(m.Disk.SlowCount),
+		"pebble_background_errors":             float64(m.BackgroundErrors),
+		"pebble_consecutive_background_errors": float64(m.ConsecutiveBackgroundErrors),
+	}
+	if lookups := m.Cache.Hits + m.Cache.Misses; lookups > 0 {
+		v["pebble_cache_hit_ratio"] = float64(m.Cache.Hits) / float64(lookups)
+	}
+	for _, c := range []struct {
+		name  string
+		bytes int64
+	}{
+		{"memtables", m.Memory.MemTables},
+		{"batches", m.Memory.Batches},
+		{"compaction_buffers", m.Memory.CompactionBuffers},
+		{"cache", m.Memory.Cache},
+	} {
+		v[fmt.Sprintf(`pebble_memory_bytes{component="%s"}`, c.name)] = float64(c.bytes)
+	}
+	for i, s := range m.Cache.Shards {
+		label := fmt.Sprintf(`{shard="%d"}`, i)
+		v["pebble_cache_shard_bytes"+label] = float64(s.Size)
+		v["pebble_cache_shard_hits"+label] = float64(s.Hits)
+		v["pebble_cache_shard_misses"+label] = float64(s.Misses)
+		v["pebble_cache_shard_evictions"+label] = float64(s.Evictions)
+	}
+	summary(v, "pebble_wal_fsync_seconds", "", &m.WAL.FsyncLatency)
+	for _, stage := range []struct {
+		name string
+		s    *histogram.Snapshot
+	}{
+		{"wait", &m.Commit.Wait},
+		{"wal_append", &m.Commit.WALAppend},
+		{"apply", &m.Commit.Apply},
+		{"publish", &m.Commit.Publish},
+	} {
+		summary(v, "pebble_commit_seconds", fmt.Sprintf(`stage="%s",`, stage.name), stage.s)
+	}
+	for level := range m.Tables {
+		label := fmt.Sprintf(`{level="%d"}`, level)
+		v["pebble_level_tables"+label] = float64(m.Tables[level].Count)
+		v["pebble_level_bytes"+label] = float64(m.Tables[level].Size)
+		v["pebble_level_garbage_bytes"+label] = float64(m.Garbage[level].Total())
+		for _, read := range []struct {
+			op    string
+			stats *sstable.ReadStats
+		}{
+			{"get", &m.Read.Get[level]},
+			{"iter", &m.Read.Iter[level]},
+			{"compaction", &m.Read.Compaction[level]},
+		} {
+			labels := fmt.Sprintf(`{level="%d",op="%s",source=`, level, read.op)
+			v["pebble_level_read_bytes"+labels+`"cache"}`] = float64(read.stats.CacheBytes)
+			v["pebble_level_read_bytes"+labels+`"compressed_cache"}`] = float64(read.stats.CompressedCacheBytes)
+			v["pebble_level_read_bytes"+labels+`"file"}`] = float64(read.stats.FileBytes)
+		}
+	}
+	return v
+}
+
+// summary adds a latency histogram to v as a Prometheus summary: the count
+// and sum of the latencies, and their quantiles. The labels, if any, must end
+// in a comma.
+func summary(v map[string]float64, name, labels string, s *histogram.Snapshot) {
+	v[name+"_count"+trimLabels(labels)] = float64(s.Count)
+	v[name+"_sum"+trimLabels(labels)] = s.Sum.Seconds()
+	for _, q := range quantiles {
+		v[fmt.Sprintf(`%s{%squantile="%g"}`, name, labels, q)] = s.Quantile(q).Seconds()
+	}
+}
+
+// trimLabels returns the labels passed to summary, enclosed in braces, or
+// the empty string if there are none.
+func trimLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels[:len(labels)-1] + "}"
+}
+
+// Publish publishes the metrics of the DB as an expvar variable with the
+// specified name, whose value is the map returned by Values. Like
+// expvar.Publish, it panics if the name is already in use.
+func Publish(name string, d *pebble.DB) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return Values(d.Metrics())
+	}))
+}
+
+// Handler returns an HTTP handler which serves the metrics of the DB in the
+// Prometheus text format, allowing the DB to be scraped by Prometheus without
+// a client library.
+func Handler(d *pebble.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := Values(d.Metrics())
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var buf bytes.Buffer
+		for _, name := range names {
+			fmt.Fprintf(&buf, "%s %g\n", name, v[name])
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+}
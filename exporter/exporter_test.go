@@ -0,0 +1,116 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package exporter
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble"
+	"github.com/petermattis/pebble/cache"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestExporter(t *testing.T) {
+	d, err := pebble.Open("", &db.Options{
+		Cache:   cache.New(1 << 20),
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Set([]byte("a"), []byte("1"), db.Sync); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := d.Get([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v := Values(d.Metrics())
+	for name, expected := range map[string]float64{
+		"pebble_flush_count":             1,
+		"pebble_wal_syncs":               1,
+		"pebble_wal_files":               1,
+		`pebble_level_tables{level="0"}`: 0,
+		`pebble_level_tables{level="2"}`: 1,
+		"pebble_cache_capacity_bytes":    1 << 20,
+	} {
+		if v[name] != expected {
+			t.Errorf("%s: expected %g, but found %g", name, expected, v[name])
+		}
+	}
+	if v[`pebble_memory_bytes{component="memtables"}`] == 0 {
+		t.Errorf("expected the memory of the memtable")
+	}
+	if v["pebble_read_amp"] != 1 {
+		t.Errorf("expected read amplification 1, but found %g", v["pebble_read_amp"])
+	}
+	if n := v[`pebble_level_read_bytes{level="2",op="get",source="cache"}`]; n == 0 {
+		t.Errorf("expected the lookup of the key to be accounted")
+	}
+	if v[`pebble_level_bytes{level="2"}`] == 0 {
+		t.Errorf("expected the size of L2")
+	}
+	for _, stage := range []string{"wait", "wal_append", "apply", "publish"} {
+		name := `pebble_commit_seconds_count{stage="` + stage + `"}`
+		if v[name] != 1 {
+			t.Errorf("%s: expected 1, but found %g", name, v[name])
+		}
+	}
+	if v["pebble_wal_fsync_seconds_count"] == 0 {
+		t.Errorf("expected the WAL fsyncs to be counted")
+	}
+	if q := `pebble_commit_seconds{stage="publish",quantile="0.99"}`; v[q] == 0 {
+		t.Errorf("%s: expected the latency of the commit", q)
+	}
+	// The second lookup of the key finds the data block in the cache.
+	hits, misses := v["pebble_cache_hits"], v["pebble_cache_misses"]
+	if hits == 0 || misses == 0 || v["pebble_cache_hit_ratio"] != hits/(hits+misses) {
+		t.Errorf("unexpected cache metrics: %g hits, %g misses, %g hit ratio",
+			hits, misses, v["pebble_cache_hit_ratio"])
+	}
+	if n := v[`pebble_cache_shard_hits{shard="0"}`]; n != hits {
+		t.Errorf("expected %g hits in the only cache shard, but found %g", hits, n)
+	}
+
+	// The metrics are gathered when they are read.
+	Publish("pebble-test", d)
+	if err := d.Set([]byte("b"), []byte("2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var published map[string]float64
+	if err := json.Unmarshal([]byte(expvar.Get("pebble-test").String()), &published); err != nil {
+		t.Fatal(err)
+	}
+	if n := published["pebble_flush_count"]; n != 2 {
+		t.Errorf("expected 2 flushes, but found %g", n)
+	}
+
+	w := httptest.NewRecorder()
+	Handler(d).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		"pebble_flush_count 2\n",
+		`pebble_level_tables{level="2"} 2` + "\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected %q in\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/rate"
+	"github.com/petermattis/pebble/storage"
+)
+
+// deleteBurst is the maximum number of bytes deleted in a burst when
+// deletions are paced.
+const deleteBurst = 1 << 20 // 1 MB
+
+// fileDeleter deletes obsolete files in a background goroutine, optionally
+// limiting the rate at which bytes and files are deleted.
+type fileDeleter struct {
+	fs           storage.Storage
+	logger       db.Logger
+	limiter      *rate.Limiter
+	filesLimiter *rate.Limiter
+
+	mu struct {
+		sync.Mutex
+		cond    sync.Cond
+		pending []obsoleteFile
+		// The names of the files which are pending deletion or being deleted. A
+		// file which is still queued is not queued again.
+		queued map[string]struct{}
+		// The number of files removed from pending that are being deleted.
+		deleting int
+		closed   bool
+		// The number and total size of the WAL files which are pending
+		// deletion or being deleted.
+		logs     int64
+		logsSize uint64
+	}
+	closeCh chan struct{}
+	doneCh  chan struct{}
+}
+
+func newFileDeleter(opts *db.Options) *fileDeleter {
+	d := &fileDeleter{
+		fs:      opts.Storage,
+		logger:  opts.Logger,
+		closeCh: make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	if opts.DeleteRateBytesPerSec > 0 {
+		d.limiter = rate.NewLimiter(rate.Limit(opts.DeleteRateBytesPerSec), deleteBurst)
+	}
+	if opts.DeleteRateFilesPerSec > 0 {
+		d.filesLimiter = rate.NewLimiter(rate.Limit(opts.DeleteRateFilesPerSec), 1)
+	}
+	d.mu.cond.L = &d.mu.Mutex
+	d.mu.queued = make(map[string]struct{})
+	go d.run()
+	return d
+}
+
+// obsoleteFile is a file queued for deletion, along with its size at the
+// time it was queued.
+type obsoleteFile struct {
+	filename string
+	size     uint64
+	isLog    bool
+}
+
+// enqueue adds files to the queue of files to be deleted. Files which are
+// already queued are skipped.
+func (d *fileDeleter) enqueue(filenames ...string) {
+	if len(filenames) == 0 {
+		return
+	}
+	files := make([]obsoleteFile, len(filenames))
+	for i, filename := range filenames {
+		files[i].filename = filename
+		if info, err := d.fs.Stat(filename); err == nil {
+			files[i].size = uint64(info.Size())
+		}
+		fileType, _, ok := parseDBFilename(filepath.Base(filename))
+		files[i].isLog = ok && fileType == fileTypeLog
+	}
+
+	d.mu.Lock()
+	for _, f := range files {
+		if _, ok := d.mu.queued[f.filename]; ok {
+			continue
+		}
+		d.mu.queued[f.filename] = struct{}{}
+		if f.isLog {
+			d.mu.logs++
+			d.mu.logsSize += f.size
+		}
+		d.mu.pending = append(d.mu.pending, f)
+	}
+	d.mu.cond.Signal()
+	d.mu.Unlock()
+}
+
+// obsoleteLogs returns the number and total size of the WAL files which are
+// pending deletion.
+func (d *fileDeleter) obsoleteLogs() (int64, uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.mu.logs, d.mu.logsSize
+}
+
+// wait blocks until all of the files enqueued for deletion have been deleted.
+func (d *fileDeleter) wait() {
+	d.mu.Lock()
+	for len(d.mu.pending) > 0 || d.mu.deleting > 0 {
+		d.mu.cond.Wait()
+	}
+	d.mu.Unlock()
+}
+
+// close deletes any pending files without pacing and stops the background
+// goroutine.
+func (d *fileDeleter) close() {
+	close(d.closeCh)
+	d.mu.Lock()
+	d.mu.closed = true
+	d.mu.cond.Broadcast()
+	d.mu.Unlock()
+	<-d.doneCh
+}
+
+func (d *fileDeleter) run() {
+	defer close(d.doneCh)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		for len(d.mu.pending) == 0 && !d.mu.closed {
+			d.mu.cond.Wait()
+		}
+		if len(d.mu.pending) == 0 {
+			return
+		}
+		f := d.mu.pending[0]
+		d.mu.pending = d.mu.pending[1:]
+		d.mu.deleting++
+
+		d.mu.Unlock()
+		d.delete(f)
+		d.mu.Lock()
+
+		d.mu.deleting--
+		delete(d.mu.queued, f.filename)
+		if f.isLog {
+			d.mu.logs--
+			d.mu.logsSize -= f.size
+		}
+		d.mu.cond.Broadcast()
+	}
+}
+
+// delete deletes a single file, first waiting for the limiters to permit the
+// deletion of the file and its bytes. Pacing stops once the deleter is
+// closed.
+func (d *fileDeleter) delete(f obsoleteFile) {
+	if d.filesLimiter != nil {
+		d.pace(d.filesLimiter, 1)
+	}
+	if d.limiter != nil {
+		d.pace(d.limiter, int(f.size))
+	}
+	// Ignore any file system errors.
+	if err := d.fs.Remove(f.filename); err == nil {
+		d.logger.Infof("deleted %s", f.filename)
+	}
+}
+
+// pace blocks until the limiter allows n units to be deleted, or the deleter
+// is closed.
+func (d *fileDeleter) pace(limiter *rate.Limiter, n int) {
+	for n > 0 {
+		k := n
+		if k > limiter.Burst() {
+			k = limiter.Burst()
+		}
+		n -= k
+
+		timer := time.NewTimer(limiter.ReserveN(time.Now(), k).Delay())
+		select {
+		case <-d.closeCh:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
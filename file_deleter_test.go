@@ -0,0 +1,184 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func createDeleterTestFiles(t *testing.T, fs storage.Storage, n, size int) []string {
+	var filenames []string
+	for i := 0; i < n; i++ {
+		filename := fmt.Sprintf("%06d.sst", i)
+		f, err := fs.Create(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+	return filenames
+}
+
+func TestFileDeleterPacing(t *testing.T) {
+	fs := storage.NewMem()
+	filenames := createDeleterTestFiles(t, fs, 3, deleteBurst)
+
+	d := newFileDeleter((&db.Options{
+		DeleteRateBytesPerSec: 10 * deleteBurst,
+		Logger:                discardLogger{},
+		Storage:               fs,
+	}).EnsureDefaults())
+	defer d.close()
+
+	// The limiter permits an initial burst, after which each file takes 100ms
+	// to delete.
+	start := time.Now()
+	d.enqueue(filenames...)
+	d.wait()
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("deletions were not paced: %s", elapsed)
+	}
+	if ls, err := fs.List(""); err != nil || len(ls) != 0 {
+		t.Fatalf("expected no files, but found %q (%v)", ls, err)
+	}
+}
+
+func TestFileDeleterFilePacing(t *testing.T) {
+	fs := storage.NewMem()
+	filenames := createDeleterTestFiles(t, fs, 3, 0)
+
+	d := newFileDeleter((&db.Options{
+		DeleteRateFilesPerSec: 10,
+		Logger:                discardLogger{},
+		Storage:               fs,
+	}).EnsureDefaults())
+	defer d.close()
+
+	// The first file is deleted immediately, after which each file takes
+	// 100ms to delete regardless of its size.
+	start := time.Now()
+	d.enqueue(filenames...)
+	d.wait()
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("deletions were not paced: %s", elapsed)
+	}
+	if ls, err := fs.List(""); err != nil || len(ls) != 0 {
+		t.Fatalf("expected no files, but found %q (%v)", ls, err)
+	}
+}
+
+func TestFileDeleterDuplicates(t *testing.T) {
+	fs := storage.NewMem()
+	for _, filename := range []string{"000001.log", "000002.log"} {
+		f, err := fs.Create(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("log")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// At 1 file/sec the second file stays queued while it is enqueued again.
+	d := newFileDeleter((&db.Options{
+		DeleteRateFilesPerSec: 1,
+		Logger:                discardLogger{},
+		Storage:               fs,
+	}).EnsureDefaults())
+	defer d.close()
+	d.enqueue("000001.log", "000002.log")
+	d.enqueue("000001.log", "000002.log")
+
+	d.mu.Lock()
+	queued := len(d.mu.pending) + d.mu.deleting
+	d.mu.Unlock()
+	if queued > 2 {
+		t.Fatalf("expected at most 2 queued files, but found %d", queued)
+	}
+	if n, size := d.obsoleteLogs(); n > 2 || size > 6 {
+		t.Fatalf("expected at most 2 obsolete logs of 6 bytes, but found %d of %d bytes", n, size)
+	}
+	d.wait()
+	if n, size := d.obsoleteLogs(); n != 0 || size != 0 {
+		t.Fatalf("expected no obsolete logs, but found %d of %d bytes", n, size)
+	}
+}
+
+func TestFileDeleterClose(t *testing.T) {
+	fs := storage.NewMem()
+	filenames := createDeleterTestFiles(t, fs, 3, deleteBurst)
+
+	// At 1 byte/sec the deletions would take weeks, but closing the deleter
+	// deletes the remaining files without pacing.
+	d := newFileDeleter((&db.Options{
+		DeleteRateBytesPerSec: 1,
+		Logger:                discardLogger{},
+		Storage:               fs,
+	}).EnsureDefaults())
+	d.enqueue(filenames...)
+
+	done := make(chan struct{})
+	go func() {
+		d.close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("close did not complete")
+	}
+	if ls, err := fs.List(""); err != nil || len(ls) != 0 {
+		t.Fatalf("expected no files, but found %q (%v)", ls, err)
+	}
+}
+
+func TestFileDeleterObsoleteLogs(t *testing.T) {
+	fs := storage.NewMem()
+	filenames := createDeleterTestFiles(t, fs, 1, deleteBurst)
+	for i, size := range []int{100, 200} {
+		filename := dbFilename("", fileTypeLog, uint64(i+1))
+		f, err := fs.Create(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+
+	// The table uses up the initial burst of the limiter, after which the
+	// deletion of the logs is paced for minutes.
+	d := newFileDeleter((&db.Options{
+		DeleteRateBytesPerSec: 1,
+		Logger:                discardLogger{},
+		Storage:               fs,
+	}).EnsureDefaults())
+	d.enqueue(filenames...)
+	if n, size := d.obsoleteLogs(); n != 2 || size != 300 {
+		t.Fatalf("expected 2 obsolete logs of 300 bytes, but found %d of %d bytes", n, size)
+	}
+	d.close()
+	if n, size := d.obsoleteLogs(); n != 0 || size != 0 {
+		t.Fatalf("expected no obsolete logs, but found %d of %d bytes", n, size)
+	}
+}
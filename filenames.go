@@ -22,6 +22,7 @@ const (
 	fileTypeTable
 	fileTypeManifest
 	fileTypeCurrent
+	fileTypeOptions
 )
 
 func dbFilename(dirname string, fileType fileType, fileNum uint64) string {
@@ -39,6 +40,8 @@ func dbFilename(dirname string, fileType fileType, fileNum uint64) string {
 		return fmt.Sprintf("%s%cMANIFEST-%06d", dirname, os.PathSeparator, fileNum)
 	case fileTypeCurrent:
 		return fmt.Sprintf("%s%cCURRENT", dirname, os.PathSeparator)
+	case fileTypeOptions:
+		return fmt.Sprintf("%s%cOPTIONS-%06d", dirname, os.PathSeparator, fileNum)
 	}
 	panic("unreachable")
 }
@@ -56,6 +59,12 @@ func parseDBFilename(filename string) (fileType fileType, fileNum uint64, ok boo
 			break
 		}
 		return fileTypeManifest, u, true
+	case strings.HasPrefix(filename, "OPTIONS-"):
+		u, err := strconv.ParseUint(filename[len("OPTIONS-"):], 10, 64)
+		if err != nil {
+			break
+		}
+		return fileTypeOptions, u, true
 	default:
 		i := strings.IndexByte(filename, '.')
 		if i < 0 {
@@ -84,10 +93,32 @@ func setCurrentFile(dirname string, fs storage.Storage, fileNum uint64) error {
 		return err
 	}
 	if _, err := fmt.Fprintf(f, "MANIFEST-%06d\n", fileNum); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
 		return err
 	}
 	if err := f.Close(); err != nil {
 		return err
 	}
-	return fs.Rename(oldFilename, newFilename)
+	if err := fs.Rename(oldFilename, newFilename); err != nil {
+		return err
+	}
+	return syncDir(fs, dirname)
+}
+
+// syncDir syncs the named directory, making the creation, removal and
+// renaming of the files within it durable.
+func syncDir(fs storage.Storage, dirname string) error {
+	dir, err := fs.OpenDir(dirname)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
 }
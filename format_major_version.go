@@ -0,0 +1,79 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+	"github.com/petermattis/pebble/storage"
+)
+
+// FormatMajorVersion returns the DB's current format major version.
+func (d *DB) FormatMajorVersion() db.FormatMajorVersion {
+	return db.FormatMajorVersion(atomic.LoadUint64(&d.mu.versions.formatMajorVersion))
+}
+
+// RatchetFormatMajorVersion ratchets the DB's format major version to the
+// provided version, permitting the use of the table and WAL features gated on
+// it. Once ratcheted, the DB can no longer be opened by versions of pebble
+// which do not support the new format major version. Ratcheting to the
+// current version is a no-op, while attempting to lower the version returns
+// an error.
+func (d *DB) RatchetFormatMajorVersion(vers db.FormatMajorVersion) error {
+	if vers > db.FormatNewest {
+		return fmt.Errorf("pebble: format major version %d is newer than the newest supported version %d",
+			vers, db.FormatNewest)
+	}
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	current := db.FormatMajorVersion(d.mu.versions.formatMajorVersion)
+	if vers < current {
+		return fmt.Errorf("pebble: format major version %d cannot be lowered to %d",
+			current, vers)
+	}
+	if vers == current {
+		return nil
+	}
+	ve := versionEdit{formatMajorVersion: uint64(vers)}
+	if vers >= db.FormatDBID && d.mu.versions.id() == "" {
+		id, err := newDBID()
+		if err != nil {
+			return err
+		}
+		ve.dbID = id
+	}
+	if vers >= db.FormatMergerName {
+		ve.mergerName = d.opts.Merger.Name()
+	}
+	return d.mu.versions.logAndApply(d.opts, d.dirname, &ve)
+}
+
+// tableLevelOptions returns the options for writing sstables to the specified
+// level of a DB at the specified format major version. Table features which
+// are not permitted by the format major version are disabled.
+func tableLevelOptions(
+	opts *db.Options, level int, vers db.FormatMajorVersion,
+) db.LevelOptions {
+	l := opts.Level(level)
+	if vers < db.FormatPartitionedFilters && l.FilterType == db.PartitionedFilter {
+		l.FilterType = db.TableFilter
+	}
+	return l
+}
+
+// newTableWriter returns a writer for an sstable in the specified level of the
+// DB, configured for the DB's current format major version and marked with
+// the DB's identifier.
+func (d *DB) newTableWriter(f storage.File, level int) *sstable.Writer {
+	w := sstable.NewWriter(f, d.opts, tableLevelOptions(d.opts, level, d.FormatMajorVersion()))
+	w.SetDBID(d.ID())
+	return w
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestRatchetFormatMajorVersion(t *testing.T) {
+	mem := storage.NewMem()
+	open := func(vers db.FormatMajorVersion) *DB {
+		d, err := Open("", &db.Options{
+			FormatMajorVersion: vers,
+			Logger:             discardLogger{},
+			Storage:            mem,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	expect := func(d *DB, vers db.FormatMajorVersion) {
+		t.Helper()
+		if v := d.FormatMajorVersion(); v != vers {
+			t.Fatalf("expected format major version %d, but found %d", vers, v)
+		}
+	}
+
+	// A new DB is created at FormatMostCompatible by default.
+	d := open(db.FormatDefault)
+	expect(d, db.FormatMostCompatible)
+	if err := d.RatchetFormatMajorVersion(db.FormatMostCompatible); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RatchetFormatMajorVersion(db.FormatNewest + 1); err == nil {
+		t.Fatalf("expected error ratcheting past the newest version")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening the DB at a newer version ratchets it.
+	d = open(db.FormatPartitionedFilters)
+	expect(d, db.FormatPartitionedFilters)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The version is persisted, and opening the DB with an older version does
+	// not lower it.
+	d = open(db.FormatMostCompatible)
+	expect(d, db.FormatPartitionedFilters)
+	if err := d.RatchetFormatMajorVersion(db.FormatMostCompatible); err == nil ||
+		!strings.Contains(err.Error(), "cannot be lowered") {
+		t.Fatalf("expected error lowering the version, but found %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The version survives the MANIFEST being rolled over.
+	d, err := Open("", &db.Options{
+		Logger:              discardLogger{},
+		MaxManifestFileSize: 1,
+		Storage:             mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := d.Set([]byte("a"), []byte("b"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d = open(db.FormatDefault)
+	expect(d, db.FormatPartitionedFilters)
+
+	// A DB at a version newer than is supported cannot be opened.
+	d.mu.Lock()
+	err = d.mu.versions.logAndApply(d.opts, d.dirname, &versionEdit{
+		formatMajorVersion: uint64(db.FormatNewest + 1),
+	})
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open("", &db.Options{Storage: mem}); err == nil ||
+		!strings.Contains(err.Error(), "newer than the newest supported version") {
+		t.Fatalf("expected unsupported version error, but found %v", err)
+	}
+}
+
+func TestRatchetFormatMajorVersionNewDB(t *testing.T) {
+	mem := storage.NewMem()
+	if _, err := Open("", &db.Options{
+		FormatMajorVersion: db.FormatNewest + 1,
+		Storage:            mem,
+	}); err == nil {
+		t.Fatalf("expected error opening with an unsupported version")
+	}
+
+	d, err := Open("", &db.Options{
+		FormatMajorVersion: db.FormatPartitionedFilters,
+		Logger:             discardLogger{},
+		Storage:            mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d.FormatMajorVersion(); v != db.FormatPartitionedFilters {
+		t.Fatalf("expected format major version %d, but found %d", db.FormatPartitionedFilters, v)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTableLevelOptions(t *testing.T) {
+	opts := &db.Options{
+		Levels: []db.LevelOptions{{FilterType: db.PartitionedFilter}},
+	}
+	testCases := []struct {
+		vers     db.FormatMajorVersion
+		expected db.FilterType
+	}{
+		{db.FormatDefault, db.TableFilter},
+		{db.FormatMostCompatible, db.TableFilter},
+		{db.FormatPartitionedFilters, db.PartitionedFilter},
+	}
+	for _, c := range testCases {
+		if l := tableLevelOptions(opts, 3, c.vers); l.FilterType != c.expected {
+			t.Errorf("%d: expected filter type %d, but found %d", c.vers, c.expected, l.FilterType)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+)
+
+// TableGarbage is an estimate of the bytes of dead data which compacting a
+// table down through the LSM would reclaim. The dead data is attributed to
+// the table holding the newer entries which make it dead, even though most
+// of it resides in the tables in the lower levels.
+//
+// The estimates are computed from the table properties and the key ranges of
+// the tables, without reading any data blocks, except for tables holding
+// range deletions. They assume that the keys written over older data
+// overwrite existing keys, so Shadowed is an upper bound for workloads which
+// mostly insert new keys.
+type TableGarbage struct {
+	// PointDeletions is the estimated size of the point deletions in the table,
+	// together with the entries in the lower levels which they delete.
+	PointDeletions uint64
+	// RangeDeletions is the estimated size of the data in the lower levels
+	// covered by the range deletions in the table.
+	RangeDeletions uint64
+	// Shadowed is the estimated size of the older versions in the lower levels
+	// of the keys set or merged by the table.
+	Shadowed uint64
+	// Unreferenced is, for a virtual table, its share of the data of its
+	// backing table which no virtual table references.
+	Unreferenced uint64
+}
+
+// Total returns the total estimated size of the dead data.
+func (g TableGarbage) Total() uint64 {
+	return g.PointDeletions + g.RangeDeletions + g.Shadowed + g.Unreferenced
+}
+
+func (g *TableGarbage) add(o TableGarbage) {
+	g.PointDeletions += o.PointDeletions
+	g.RangeDeletions += o.RangeDeletions
+	g.Shadowed += o.Shadowed
+	g.Unreferenced += o.Unreferenced
+}
+
+// tableGarbageStats holds the table properties used to estimate the garbage,
+// scaled to the portion of the backing table referenced by a virtual table.
+type tableGarbageStats struct {
+	entries        uint64
+	deletions      uint64
+	rangeDeletions uint64
+}
+
+// levelGarbage returns the estimated garbage in each level of the current
+// version. The estimates are cached until the version changes. Errors are
+// logged, and result in empty estimates.
+func (d *DB) levelGarbage() [numLevels]TableGarbage {
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	if d.mu.garbage.version == current {
+		levels := d.mu.garbage.levels
+		d.mu.Unlock()
+		return levels
+	}
+	current.ref()
+	d.mu.Unlock()
+	defer current.unref()
+
+	var levels [numLevels]TableGarbage
+	estimates, err := d.estimateGarbage(current)
+	if err != nil {
+		d.opts.Logger.Infof("unable to estimate garbage: %v", err)
+		return levels
+	}
+	for level := range estimates {
+		for i := range estimates[level] {
+			levels[level].add(estimates[level][i])
+		}
+	}
+
+	d.mu.Lock()
+	d.mu.garbage.version = current
+	d.mu.garbage.levels = levels
+	d.mu.Unlock()
+	return levels
+}
+
+// estimateGarbage returns the estimated garbage of each table in v, indexed
+// by level and by the position of the table within the level.
+func (d *DB) estimateGarbage(v *version) ([][]TableGarbage, error) {
+	stats := make([][]tableGarbageStats, len(v.files))
+	// The size of the data of each backing table referenced by the virtual
+	// tables, and the total size of the virtual tables referencing it.
+	backingSize := map[uint64]uint64{}
+	referenced := map[uint64]uint64{}
+	for level := range v.files {
+		stats[level] = make([]tableGarbageStats, len(v.files[level]))
+		for i := range v.files[level] {
+			f := &v.files[level][i]
+			err := d.tableCache.withReader(f, func(r *sstable.Reader) error {
+				p := &r.Properties
+				s := tableGarbageStats{
+					entries:        p.NumEntries,
+					deletions:      p.NumDeletions - p.NumRangeDeletions,
+					rangeDeletions: p.NumRangeDeletions,
+				}
+				if f.backingFileNum != 0 && p.DataSize > 0 {
+					backingSize[f.backingFileNum] = p.DataSize
+					referenced[f.backingFileNum] += f.size
+					if f.size < p.DataSize {
+						s.entries = s.entries * f.size / p.DataSize
+						s.deletions = s.deletions * f.size / p.DataSize
+						s.rangeDeletions = s.rangeDeletions * f.size / p.DataSize
+					}
+				}
+				stats[level][i] = s
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// overlap returns the estimated size of the data in the table within the
+	// inclusive key range [start, end].
+	overlap := func(f *fileMetadata, start, end []byte) (uint64, error) {
+		if d.cmp(start, f.smallest.UserKey) < 0 {
+			start = f.smallest.UserKey
+		}
+		if d.cmp(end, f.largest.UserKey) > 0 {
+			end = f.largest.UserKey
+		}
+		if d.cmp(start, end) > 0 {
+			return 0, nil
+		}
+		var size uint64
+		err := d.tableCache.withReader(f, func(r *sstable.Reader) (err error) {
+			size, err = r.EstimateDiskUsage(start, end)
+			return err
+		})
+		if size > f.size {
+			size = f.size
+		}
+		return size, err
+	}
+
+	result := make([][]TableGarbage, len(v.files))
+	for level := range v.files {
+		result[level] = make([]TableGarbage, len(v.files[level]))
+		for i := range v.files[level] {
+			f := &v.files[level][i]
+			s := &stats[level][i]
+			g := &result[level][i]
+			if total := referenced[f.backingFileNum]; total > 0 && total < backingSize[f.backingFileNum] {
+				g.Unreferenced = (backingSize[f.backingFileNum] - total) * f.size / total
+			}
+			if s.entries == 0 {
+				continue
+			}
+
+			// The tables older than f which overlap its key range: the older level
+			// 0 tables and the tables in the lower levels.
+			var lower []*fileMetadata
+			var lowerSize, lowerEntries uint64
+			for l := level; l < len(v.files); l++ {
+				n := len(v.files[l])
+				if l == level {
+					if level != 0 {
+						continue
+					}
+					n = i
+				}
+				for j := 0; j < n; j++ {
+					if o := &v.files[l][j]; d.cmp(o.largest.UserKey, f.smallest.UserKey) >= 0 &&
+						d.cmp(o.smallest.UserKey, f.largest.UserKey) <= 0 {
+						lower = append(lower, o)
+						lowerSize += o.size
+						lowerEntries += stats[l][j].entries
+					}
+				}
+			}
+
+			// The older data within f's key range, and the average size of its
+			// entries.
+			var shadowable uint64
+			for _, o := range lower {
+				size, err := overlap(o, f.smallest.UserKey, f.largest.UserKey)
+				if err != nil {
+					return nil, err
+				}
+				shadowable += size
+			}
+			var avgLower uint64
+			if lowerEntries > 0 {
+				avgLower = lowerSize / lowerEntries
+			}
+			take := func(size uint64) uint64 {
+				if size > shadowable {
+					size = shadowable
+				}
+				shadowable -= size
+				return size
+			}
+
+			g.PointDeletions = s.deletions*(f.size/s.entries) + take(s.deletions*avgLower)
+			if s.rangeDeletions > 0 && len(lower) > 0 {
+				covered, err := d.rangeDeletionOverlap(f, lower, overlap)
+				if err != nil {
+					return nil, err
+				}
+				g.RangeDeletions = take(covered)
+			}
+			if dels := s.deletions + s.rangeDeletions; s.entries > dels {
+				g.Shadowed = take((s.entries - dels) * avgLower)
+			}
+		}
+	}
+	return result, nil
+}
+
+// rangeDeletionOverlap returns the estimated size of the data in the lower
+// tables covered by the range deletions in the table f.
+func (d *DB) rangeDeletionOverlap(
+	f *fileMetadata,
+	lower []*fileMetadata,
+	overlap func(f *fileMetadata, start, end []byte) (uint64, error),
+) (uint64, error) {
+	iter, err := d.newIter(f)
+	if err != nil {
+		return 0, err
+	}
+	var covered uint64
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if key.Kind() != db.InternalKeyKindRangeDelete {
+			continue
+		}
+		for _, o := range lower {
+			size, err := overlap(o, key.UserKey, iter.Value())
+			if err != nil {
+				iter.Close()
+				return 0, err
+			}
+			covered += size
+		}
+	}
+	return covered, firstError(iter.Error(), iter.Close())
+}
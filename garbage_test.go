@@ -0,0 +1,124 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestEstimateGarbage(t *testing.T) {
+	mem := storage.NewMem()
+	open := func(l0CompactionThreshold int) *DB {
+		d, err := Open("", &db.Options{
+			FlushToL0:             true,
+			L0CompactionThreshold: l0CompactionThreshold,
+			Levels: []db.LevelOptions{{
+				BlockSize:   1024,
+				Compression: db.NoCompression,
+			}},
+			Logger:  discardLogger{},
+			Storage: mem,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	d := open(100)
+	defer func() {
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%05d", i))
+	}
+	value := make([]byte, 100)
+	const count = 1000
+	garbage := func() (SSTables, uint64) {
+		t.Helper()
+		tables, err := d.SSTables(WithGarbage())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total uint64
+		for level := range tables {
+			for _, info := range tables[level] {
+				total += info.Garbage.Total()
+			}
+		}
+		var metrics uint64
+		for _, g := range d.Metrics().Garbage {
+			metrics += g.Total()
+		}
+		if metrics != total {
+			t.Fatalf("expected metrics to report %d bytes of garbage, but found %d", total, metrics)
+		}
+		return tables, total
+	}
+
+	var err error
+	for i := 0; i < count; i++ {
+		if err := d.Set(key(i), value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, total := garbage(); total != 0 {
+		t.Fatalf("expected no garbage, but found %d bytes", total)
+	}
+
+	// Overwrite the first quarter of the keys, and delete the second quarter.
+	for i := 0; i < count/2; i++ {
+		if i < count/4 {
+			err = d.Set(key(i), value, nil)
+		} else {
+			err = d.Delete(key(i), nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	tables, total := garbage()
+	if len(tables[0]) != 2 {
+		t.Fatalf("expected 2 L0 tables, but found\n%s", tables)
+	}
+	older, newer := tables[0][0], tables[0][1]
+	if g := older.Garbage.Total(); g != 0 {
+		t.Fatalf("expected no garbage in the older table, but found %d bytes", g)
+	}
+	g := newer.Garbage
+	if g.PointDeletions == 0 || g.Shadowed == 0 || g.RangeDeletions != 0 || g.Unreferenced != 0 {
+		t.Fatalf("unexpected garbage estimate: %+v", g)
+	}
+	// Half of the older table is dead, and the tombstones are garbage as well.
+	if lo, hi := older.Size*4/10, older.Size*6/10+newer.Size; total < lo || total > hi {
+		t.Fatalf("expected between %d and %d bytes of garbage, but found %d", lo, hi, total)
+	}
+
+	// A compaction reclaims the garbage.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d = open(1)
+	d.mu.Lock()
+	for len(d.mu.versions.currentVersion().files[0]) > 0 || d.mu.compact.compacting {
+		d.mu.compact.cond.Wait()
+	}
+	d.mu.Unlock()
+	if tables, total := garbage(); total != 0 {
+		t.Fatalf("expected no garbage, but found %d bytes\n%s", total, tables)
+	}
+}
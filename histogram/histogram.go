@@ -0,0 +1,160 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// Package histogram provides a histogram of latencies which is cheap enough to
+// record on every operation of a hot path.
+//
+// Like an HDR histogram, the histogram divides the range of latencies into
+// buckets whose width grows with the latency: each power of two is divided
+// into 16 equal sub-buckets, bounding the relative error of a quantile to
+// 1/16th of its value. Latencies are recorded with nanosecond precision up to
+// maxLatency.
+package histogram // import "github.com/petermattis/pebble/histogram"
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	subBucketBits = 4
+	subBuckets    = 1 << subBucketBits
+
+	// maxLatency is the largest latency the histogram distinguishes. Larger
+	// latencies are counted in the last bucket, though Max still reports them
+	// exactly.
+	maxLatency = 1<<40 - 1 // ~18 minutes
+
+	numBuckets = (40 - subBucketBits + 1) * subBuckets
+)
+
+// bucketIndex returns the index of the bucket holding latencies of n
+// nanoseconds.
+func bucketIndex(n int64) int {
+	if n < 0 {
+		n = 0
+	} else if n > maxLatency {
+		n = maxLatency
+	}
+	v := uint64(n)
+	if v < subBuckets {
+		return int(v)
+	}
+	shift := uint(bits.Len64(v) - 1 - subBucketBits)
+	return int(shift+1)*subBuckets + int(v>>shift) - subBuckets
+}
+
+// bucketUpperBound returns the largest latency, in nanoseconds, held by the
+// bucket with index i.
+func bucketUpperBound(i int) int64 {
+	if i < subBuckets {
+		return int64(i)
+	}
+	shift := uint(i/subBuckets - 1)
+	mantissa := int64(subBuckets + i%subBuckets)
+	return (mantissa+1)<<shift - 1
+}
+
+// A Histogram records a distribution of latencies. Record may be called
+// concurrently with itself and Snapshot. The zero value is an empty
+// histogram.
+type Histogram struct {
+	count   int64
+	sum     int64
+	max     int64
+	buckets [numBuckets]int64
+}
+
+// Record adds a latency to the histogram.
+func (h *Histogram) Record(d time.Duration) {
+	n := int64(d)
+	atomic.AddInt64(&h.buckets[bucketIndex(n)], 1)
+	atomic.AddInt64(&h.sum, n)
+	atomic.AddInt64(&h.count, 1)
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if n <= max || atomic.CompareAndSwapInt64(&h.max, max, n) {
+			break
+		}
+	}
+}
+
+// Since records the latency elapsed since start, and is a shorthand for
+// h.Record(time.Since(start)).
+func (h *Histogram) Since(start time.Time) {
+	h.Record(time.Since(start))
+}
+
+// Snapshot returns a copy of the distribution recorded so far. A snapshot
+// taken concurrently with Record may not include all of the latencies being
+// recorded, in which case the count, sum and buckets of the snapshot may be
+// slightly inconsistent with each other.
+func (h *Histogram) Snapshot() Snapshot {
+	s := Snapshot{
+		Count: atomic.LoadInt64(&h.count),
+		Sum:   time.Duration(atomic.LoadInt64(&h.sum)),
+		Max:   time.Duration(atomic.LoadInt64(&h.max)),
+	}
+	for i := range h.buckets {
+		s.buckets[i] = atomic.LoadInt64(&h.buckets[i])
+	}
+	return s
+}
+
+// Snapshot is a point in time copy of a Histogram.
+type Snapshot struct {
+	// The number of latencies recorded.
+	Count int64
+	// The sum of the latencies recorded.
+	Sum time.Duration
+	// The largest latency recorded.
+	Max     time.Duration
+	buckets [numBuckets]int64
+}
+
+// Mean returns the mean of the latencies recorded, or 0 if no latencies were
+// recorded.
+func (s *Snapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+// Quantile returns the latency below which the fraction q of the recorded
+// latencies fall, such as 0.99 for the 99th percentile. The result is the
+// upper bound of the bucket holding the quantile, capped at Max, and so may
+// overestimate the quantile by up to 1/16th of its value. Quantile returns 0
+// if no latencies were recorded.
+func (s *Snapshot) Quantile(q float64) time.Duration {
+	var total int64
+	for _, c := range s.buckets {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	if q < 0 {
+		q = 0
+	} else if q > 1 {
+		q = 1
+	}
+	rank := int64(q*float64(total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, c := range s.buckets {
+		seen += c
+		if seen >= rank {
+			d := time.Duration(bucketUpperBound(i))
+			if d > s.Max {
+				d = s.Max
+			}
+			return d
+		}
+	}
+	return s.Max
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package histogram
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBuckets(t *testing.T) {
+	prev := -1
+	for _, n := range []int64{0, 1, 15, 16, 17, 31, 32, 34, 1000, 1 << 20, 1<<30 + 12345, maxLatency} {
+		i := bucketIndex(n)
+		if i <= prev {
+			t.Fatalf("%d: expected bucket > %d, but found %d", n, prev, i)
+		}
+		prev = i
+		if upper := bucketUpperBound(i); n > upper {
+			t.Fatalf("%d: exceeds upper bound %d of bucket %d", n, upper, i)
+		} else if i > 0 && n <= bucketUpperBound(i-1) {
+			t.Fatalf("%d: within upper bound %d of bucket %d", n, bucketUpperBound(i-1), i-1)
+		} else if float64(upper-n) > float64(n)/subBuckets {
+			t.Fatalf("%d: upper bound %d of bucket %d is too large", n, upper, i)
+		}
+	}
+	if i := bucketIndex(maxLatency); i != numBuckets-1 {
+		t.Fatalf("expected bucket %d, but found %d", numBuckets-1, i)
+	}
+	if i := bucketIndex(1 << 50); i != numBuckets-1 {
+		t.Fatalf("expected bucket %d, but found %d", numBuckets-1, i)
+	}
+	if i := bucketIndex(-1); i != 0 {
+		t.Fatalf("expected bucket 0, but found %d", i)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	s := h.Snapshot()
+	if s.Count != 0 || s.Mean() != 0 || s.Quantile(0.5) != 0 {
+		t.Fatalf("expected empty snapshot, but found %+v", s)
+	}
+
+	rng := rand.New(rand.NewSource(123))
+	var latencies []time.Duration
+	var sum time.Duration
+	for i := 0; i < 10000; i++ {
+		d := time.Duration(rng.ExpFloat64() * float64(time.Millisecond))
+		latencies = append(latencies, d)
+		sum += d
+		h.Record(d)
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	s = h.Snapshot()
+	if s.Count != int64(len(latencies)) {
+		t.Fatalf("expected count %d, but found %d", len(latencies), s.Count)
+	}
+	if s.Sum != sum {
+		t.Fatalf("expected sum %s, but found %s", sum, s.Sum)
+	}
+	if max := latencies[len(latencies)-1]; s.Max != max {
+		t.Fatalf("expected max %s, but found %s", max, s.Max)
+	}
+	if mean := sum / time.Duration(len(latencies)); s.Mean() != mean {
+		t.Fatalf("expected mean %s, but found %s", mean, s.Mean())
+	}
+	for _, q := range []float64{0, 0.5, 0.9, 0.99, 0.999, 1} {
+		rank := int(q*float64(len(latencies))+0.5) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		expected := latencies[rank]
+		actual := s.Quantile(q)
+		if actual < expected || float64(actual-expected) > float64(expected)/subBuckets {
+			t.Fatalf("%.3f: expected %s within 1/16th, but found %s", q, expected, actual)
+		}
+	}
+}
+
+func TestHistogramConcurrent(t *testing.T) {
+	var h Histogram
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				h.Record(time.Duration(i*1000 + j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s := h.Snapshot()
+	if s.Count != 8000 {
+		t.Fatalf("expected count 8000, but found %d", s.Count)
+	}
+	if s.Max != 7999 {
+		t.Fatalf("expected max 7999, but found %s", s.Max)
+	}
+	if q := s.Quantile(1); q != s.Max {
+		t.Fatalf("expected quantile 1 to be %s, but found %s", s.Max, q)
+	}
+}
@@ -7,13 +7,16 @@ package pebble
 import (
 	"fmt"
 	"sort"
+	"sync/atomic"
 
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/sstable"
 	"github.com/petermattis/pebble/storage"
 )
 
-func ingestLoad1(opts *db.Options, path string, fileNum uint64) (*fileMetadata, error) {
+func ingestLoad1(
+	opts *db.Options, dbID string, path string, fileNum uint64,
+) (*fileMetadata, error) {
 	stat, err := opts.Storage.Stat(path)
 	if err != nil {
 		return nil, err
@@ -27,6 +30,11 @@ func ingestLoad1(opts *db.Options, path string, fileNum uint64) (*fileMetadata,
 	r := sstable.NewReader(f, fileNum, opts)
 	defer r.Close()
 
+	// An sstable marked with the identifier of a DB was written for that DB.
+	if id := r.Properties.DBID; id != "" && id != dbID {
+		return nil, fmt.Errorf("pebble: sstable %q was written for DB %s, not %s", path, id, dbID)
+	}
+
 	meta := &fileMetadata{}
 	meta.fileNum = fileNum
 	meta.size = uint64(stat.Size())
@@ -47,11 +55,13 @@ func ingestLoad1(opts *db.Options, path string, fileNum uint64) (*fileMetadata,
 	return meta, nil
 }
 
-func ingestLoad(opts *db.Options, paths []string, pending []uint64) ([]*fileMetadata, error) {
+func ingestLoad(
+	opts *db.Options, dbID string, paths []string, pending []uint64,
+) ([]*fileMetadata, error) {
 	meta := make([]*fileMetadata, len(paths))
 	for i := range paths {
 		var err error
-		meta[i], err = ingestLoad1(opts, paths[i], pending[i])
+		meta[i], err = ingestLoad1(opts, dbID, paths[i], pending[i])
 		if err != nil {
 			return nil, err
 		}
@@ -157,16 +167,61 @@ func ingestTargetLevel(cmp db.Compare, v *version, meta *fileMetadata) int {
 	return level - 1
 }
 
+// IngestOption sets an option for DB.Ingest.
+type IngestOption func(*ingestOptions)
+
+type ingestOptions struct {
+	ingestBehind bool
+	// exciseSpan, if non-nil, is the key range whose existing data is removed
+	// by the ingestion. See DB.IngestAndExcise.
+	exciseSpan *Range
+	// deletePrefix is set if the excise is performed by DB.DeletePrefix.
+	deletePrefix bool
+	// ignoreSnapshots is set if a prefix deletion may remove data visible to
+	// open snapshots. See DB.DeletePrefix.
+	ignoreSnapshots bool
+	// seqNum, if non-nil, is set to the sequence number assigned to the
+	// ingested sstables. See DB.spillBatch.
+	seqNum *uint64
+}
+
+// IngestBehind directs DB.Ingest to place the sstables directly in the
+// bottommost level of the LSM with a sequence number of zero, rather than
+// assigning them a new sequence number and placing them above the existing
+// data. This avoids the write amplification of compacting the data down
+// through the levels, and is intended for restoring or bulk-loading cold
+// data. The keys of the sstables must not exist anywhere in the DB: Ingest
+// returns an error if the key range of an sstable overlaps any memtable or
+// sstable in the DB. The keys in the sstables must have a sequence number of
+// zero.
+func IngestBehind() IngestOption {
+	return func(o *ingestOptions) {
+		o.ingestBehind = true
+	}
+}
+
 // Ingest ingests a set of sstables into the DB. Ingestion of the files is
 // atomic and semantically equivalent to creating a single batch containing all
 // of the mutations in the sstables. Ingestion may require the memtable to be
 // flushed. The ingested sstable files are moved into the DB and must reside on
 // the same filesystem as the DB. Sstables can be created for ingestion using
-// sstable.Writer.
-func (d *DB) Ingest(paths []string) error {
+// sstable.Writer. Ingest returns an error if an sstable was marked with the
+// identifier of a different DB (see DB.ID).
+func (d *DB) Ingest(paths []string, opts ...IngestOption) error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	var o ingestOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
 	// Allocate file numbers for all of the files being ingested and mark them as
 	// pending in order to prevent them from being deleted.
 	d.mu.Lock()
+	if err := d.backgroundError(); err != nil {
+		d.mu.Unlock()
+		return err
+	}
 	pendingOutputs := make([]uint64, len(paths))
 	for i := range paths {
 		pendingOutputs[i] = d.mu.versions.nextFileNum()
@@ -185,7 +240,7 @@ func (d *DB) Ingest(paths []string) error {
 	}()
 
 	// Load the metadata for all of the files being ingested.
-	meta, err := ingestLoad(d.opts, paths, pendingOutputs)
+	meta, err := ingestLoad(d.opts, d.ID(), paths, pendingOutputs)
 	if err != nil {
 		return err
 	}
@@ -194,6 +249,11 @@ func (d *DB) Ingest(paths []string) error {
 	if err := ingestSortAndVerify(d.cmp, meta); err != nil {
 		return err
 	}
+	if o.exciseSpan != nil {
+		if err := exciseVerify(d.cmp, *o.exciseSpan, meta); err != nil {
+			return err
+		}
+	}
 
 	// Hard link the sstables into the DB directory. Since the sstables aren't
 	// referenced by a version, they won't be used. If the hard linking fails
@@ -203,10 +263,33 @@ func (d *DB) Ingest(paths []string) error {
 		return err
 	}
 
+	if o.ingestBehind {
+		if err := d.ingestBehindApply(meta); err != nil {
+			if err2 := ingestCleanup(d.opts.Storage, d.dirname, meta); err2 != nil {
+				// TODO(peter): log a warning.
+				panic(err2)
+			}
+			return err
+		}
+		return nil
+	}
+
 	var mem *memTable
 	prepareLocked := func() {
 		// NB: prepare is called with d.mu locked.
 
+		// Record the ingested spans for the validation of open transactions. The
+		// ingestion has been assigned the most recent sequence number.
+		if len(d.mu.tx.open) > 0 {
+			seqNum := atomic.LoadUint64(&d.mu.versions.logSeqNum) - 1
+			if o.exciseSpan != nil {
+				d.mu.tx.addSpan(o.exciseSpan.Start, o.exciseSpan.Limit, false, seqNum)
+			}
+			for _, m := range meta {
+				d.mu.tx.addSpan(m.smallest.UserKey, m.largest.UserKey, true, seqNum)
+			}
+		}
+
 		// If the mutable memtable contains keys which overlap any of the sstables
 		// then flush the memtable. Note that apply will wait for the flushing to
 		// finish.
@@ -230,7 +313,15 @@ func (d *DB) Ingest(paths []string) error {
 		// that sstable until the corresponding memtable has been flushed. This
 		// complicates the compaction heuristics, but avoids have to wait for
 		// memtable flushes during ingestion.
-		if ingestMemtableOverlaps(d.mu.mem.mutable, meta) {
+		overlaps := func(mem *memTable) bool {
+			if o.exciseSpan != nil {
+				// The ingested sstables lie within the excise span, which must also
+				// be cleared of the memtable data.
+				return exciseMemtableOverlaps(mem, *o.exciseSpan)
+			}
+			return ingestMemtableOverlaps(mem, meta)
+		}
+		if overlaps(d.mu.mem.mutable) {
 			mem = d.mu.mem.mutable
 			err = d.makeRoomForWrite(nil)
 			return
@@ -241,7 +332,7 @@ func (d *DB) Ingest(paths []string) error {
 		// for the newest table that overlaps.
 		for i := len(d.mu.mem.queue) - 1; i >= 0; i-- {
 			m := d.mu.mem.queue[i]
-			if ingestMemtableOverlaps(m, meta) {
+			if overlaps(m) {
 				mem = m
 				return
 			}
@@ -259,6 +350,9 @@ func (d *DB) Ingest(paths []string) error {
 		if err = ingestUpdateSeqNum(d.opts, d.dirname, seqNum, meta); err != nil {
 			return
 		}
+		if o.seqNum != nil {
+			*o.seqNum = seqNum
+		}
 
 		// If we flushed the mutable memtable in prepareLocked wait for the flush
 		// to finish.
@@ -268,7 +362,11 @@ func (d *DB) Ingest(paths []string) error {
 
 		// Assign the sstables to the correct level in the LSM and apply the
 		// version edit.
-		err = d.ingestApply(meta)
+		if o.exciseSpan != nil {
+			err = d.ingestExciseApply(meta, &o)
+		} else {
+			err = d.ingestApply(meta)
+		}
 	}
 
 	d.commit.AllocateSeqNum(prepareLocked, apply)
@@ -299,3 +397,45 @@ func (d *DB) ingestApply(meta []*fileMetadata) error {
 	}
 	return d.mu.versions.logAndApply(d.opts, d.dirname, ve)
 }
+
+// ingestBehindApply places the sstables in the bottommost level of the LSM
+// with a sequence number of zero, after verifying that they do not overlap any
+// of the existing data in the DB.
+func (d *DB) ingestBehindApply(meta []*fileMetadata) error {
+	for _, m := range meta {
+		if m.smallest.SeqNum() != 0 || m.largest.SeqNum() != 0 {
+			return fmt.Errorf("pebble: ingest-behind sstable %d contains keys with a non-zero sequence number",
+				m.fileNum)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, mem := range d.mu.mem.queue {
+		if ingestMemtableOverlaps(mem, meta) {
+			return fmt.Errorf("pebble: ingest-behind sstables overlap a memtable")
+		}
+	}
+	current := d.mu.versions.currentVersion()
+	for _, m := range meta {
+		for level := 0; level < numLevels; level++ {
+			if len(current.overlaps(level, d.cmp, m.smallest.UserKey, m.largest.UserKey)) != 0 {
+				return fmt.Errorf("pebble: ingest-behind sstable %d overlaps sstables in L%d",
+					m.fileNum, level)
+			}
+		}
+	}
+	if err := ingestUpdateSeqNum(d.opts, d.dirname, 0, meta); err != nil {
+		return err
+	}
+
+	ve := &versionEdit{
+		newFiles: make([]newFileEntry, len(meta)),
+	}
+	for i := range meta {
+		ve.newFiles[i].level = numLevels - 1
+		ve.newFiles[i].meta = *meta[i]
+	}
+	return d.mu.versions.logAndApply(d.opts, d.dirname, ve)
+}
@@ -87,7 +87,7 @@ func TestIngestLoad(t *testing.T) {
 		Comparer: db.DefaultComparer,
 		Storage:  mem,
 	}
-	meta, err := ingestLoad(opts, paths, pending)
+	meta, err := ingestLoad(opts, "", paths, pending)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -101,7 +101,7 @@ func TestIngestLoadNonExistent(t *testing.T) {
 		Comparer: db.DefaultComparer,
 		Storage:  storage.NewMem(),
 	}
-	if _, err := ingestLoad(opts, []string{"non-existent"}, []uint64{1}); err == nil {
+	if _, err := ingestLoad(opts, "", []string{"non-existent"}, []uint64{1}); err == nil {
 		t.Fatalf("expected error, but found success")
 	}
 }
@@ -118,7 +118,7 @@ func TestIngestLoadEmpty(t *testing.T) {
 		Comparer: db.DefaultComparer,
 		Storage:  mem,
 	}
-	if _, err := ingestLoad(opts, []string{"empty"}, []uint64{1}); err == nil {
+	if _, err := ingestLoad(opts, "", []string{"empty"}, []uint64{1}); err == nil {
 		t.Fatalf("expected error, but found success")
 	}
 }
@@ -529,3 +529,409 @@ func TestIngest(t *testing.T) {
 		return ""
 	})
 }
+
+func TestIngestBehind(t *testing.T) {
+	fs := storage.NewMem()
+	if err := fs.MkdirAll("ext", 0755); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open("", &db.Options{
+		Logger:  discardLogger{},
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("c"), []byte("3"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("x"), []byte("24"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ingest := func(seqNum uint64, keys ...string) error {
+		f, err := fs.Create("ext/0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := sstable.NewWriter(f, nil, db.LevelOptions{})
+		for _, k := range keys {
+			if err := w.Add(db.MakeInternalKey([]byte(k), seqNum, db.InternalKeyKindSet), []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		defer fs.Remove("ext/0")
+		return d.Ingest([]string{"ext/0"}, IngestBehind())
+	}
+
+	testCases := []struct {
+		seqNum   uint64
+		keys     []string
+		expected string
+	}{
+		{0, []string{"b", "c"}, "overlaps sstables in L2"},
+		{0, []string{"w", "y"}, "overlap a memtable"},
+		{1, []string{"e", "f"}, "non-zero sequence number"},
+		{0, []string{"e", "f"}, ""},
+		{0, []string{"f", "g"}, "overlaps sstables in L6"},
+	}
+	for _, c := range testCases {
+		err := ingest(c.seqNum, c.keys...)
+		if c.expected == "" {
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", c.keys, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Fatalf("%s: expected error %q, but found %v", c.keys, c.expected, err)
+		}
+	}
+
+	// The failed ingestions do not leave any files behind in the DB
+	// directory, and the successful ingestion is placed in the bottommost
+	// level.
+	tables, err := d.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tables[numLevels-1]); n != 1 {
+		t.Fatalf("expected 1 table in L%d, but found %d", numLevels-1, n)
+	}
+	info := tables[numLevels-1][0]
+	if info.SmallestSeqNum != 0 || info.LargestSeqNum != 0 {
+		t.Fatalf("expected sequence number 0, but found %d-%d", info.SmallestSeqNum, info.LargestSeqNum)
+	}
+	ls, err := fs.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numTables int
+	for _, name := range ls {
+		if ft, _, ok := parseDBFilename(name); ok && ft == fileTypeTable {
+			numTables++
+		}
+	}
+	if numTables != 2 {
+		t.Fatalf("expected 2 tables, but found %d: %s", numTables, ls)
+	}
+
+	for k, v := range map[string]string{"a": "1", "e": "e", "f": "f", "x": "24"} {
+		if value, err := d.Get([]byte(k)); err != nil || string(value) != v {
+			t.Fatalf("%s: expected %s, but found %s (%v)", k, v, value, err)
+		}
+	}
+}
+
+func TestIngestAndExcise(t *testing.T) {
+	for _, vers := range []db.FormatMajorVersion{db.FormatMostCompatible, db.FormatVirtualSSTables} {
+		t.Run(fmt.Sprintf("vers=%d", vers), func(t *testing.T) {
+			testIngestAndExcise(t, vers)
+		})
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	d, err := Open("", &db.Options{
+		FormatMajorVersion:    db.FormatVirtualSSTables,
+		L0CompactionThreshold: 100,
+		Logger:                discardLogger{},
+		Storage:               storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	write := func(keys ...string) {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	flush := func() {
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	verify := func() {
+		t.Helper()
+		if s := scanString(t, d); s != "a1:a1 c1:c1 d:d" {
+			t.Fatalf("expected a1:a1 c1:c1 d:d, but found %s", s)
+		}
+	}
+
+	// The first table straddles the prefix, the second lies within it, and the
+	// memtable contains keys both within and outside of it.
+	write("a1", "b1", "b2", "c1")
+	flush()
+	write("b3", "b4")
+	flush()
+	write("b5", "d")
+
+	if err := d.DeletePrefix([]byte("\xff\xff"), nil); err == nil {
+		t.Fatalf("expected an error deleting a prefix without a successor")
+	}
+	if err := d.DeletePrefix([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	verify()
+	m := d.Metrics().DeletePrefix
+	if m.Count != 1 || m.TablesDropped != 1 || m.TablesMarked != 3 {
+		t.Fatalf("unexpected prefix deletion metrics: %+v", m)
+	}
+
+	// The virtual tables are compacted, releasing the backing tables holding
+	// the deleted keys.
+	d.mu.Lock()
+	for {
+		v := d.mu.versions.currentVersion()
+		if _, f := v.markedForCompaction(); f == nil && !d.mu.compact.compacting {
+			break
+		}
+		d.mu.compact.cond.Wait()
+	}
+	for _, files := range d.mu.versions.currentVersion().files {
+		for _, f := range files {
+			if f.backingFileNum != 0 {
+				t.Fatalf("expected no virtual tables, but found %d", f.fileNum)
+			}
+		}
+	}
+	d.mu.Unlock()
+	verify()
+}
+
+func TestDeletePrefixSnapshot(t *testing.T) {
+	d, err := Open("", &db.Options{
+		FormatMajorVersion:    db.FormatVirtualSSTables,
+		L0CompactionThreshold: 100,
+		Logger:                discardLogger{},
+		Storage:               storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	set := func(key string) {
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A snapshot which predates the data in the prefix does not prevent the
+	// prefix deletion.
+	set("a")
+	s := d.NewSnapshot()
+	defer s.Close()
+	set("b1")
+	if err := d.DeletePrefix([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A snapshot which can see the data in the prefix does.
+	set("b2")
+	s2 := d.NewSnapshot()
+	defer s2.Close()
+	if err := d.DeletePrefix([]byte("b"), nil); err != ErrSnapshotOverlap {
+		t.Fatalf("expected ErrSnapshotOverlap, but found %v", err)
+	}
+	if s := scanString(t, d); s != "a:a b2:b2" {
+		t.Fatalf("expected a:a b2:b2, but found %s", s)
+	}
+	if _, err := s2.Get([]byte("b2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unless the snapshots are explicitly ignored.
+	err = d.DeletePrefix([]byte("b"), &db.DeletePrefixOptions{IgnoreSnapshots: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := scanString(t, d); s != "a:a" {
+		t.Fatalf("expected a:a, but found %s", s)
+	}
+	if _, err := s2.Get([]byte("b2")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %v", err)
+	}
+}
+
+func testIngestAndExcise(t *testing.T, vers db.FormatMajorVersion) {
+	fs := storage.NewMem()
+	if err := fs.MkdirAll("ext", 0755); err != nil {
+		t.Fatal(err)
+	}
+	open := func(l0CompactionThreshold int) *DB {
+		d, err := Open("", &db.Options{
+			FormatMajorVersion:    vers,
+			L0CompactionThreshold: l0CompactionThreshold,
+			Logger:                discardLogger{},
+			Storage:               fs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	d := open(100)
+	defer func() {
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	write := func(value string, keys ...string) {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(value), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	flush := func() {
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Three L0 tables: the first two straddle the excise span, while the
+	// third lies before it and is newer than the first two. The memtable
+	// contains data both within and outside of the span.
+	write("1", "a", "c", "k", "m", "p", "q", "z")
+	flush()
+	write("2", "b", "m", "y")
+	flush()
+	write("3", "c")
+	flush()
+	write("4", "n", "z")
+
+	ingest := func(keys ...string) string {
+		f, err := fs.Create("ext/0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := sstable.NewWriter(f, nil, db.LevelOptions{})
+		for _, k := range keys {
+			if err := w.Add(db.MakeInternalKey([]byte(k), 0, db.InternalKeyKindSet), []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		defer fs.Remove("ext/0")
+		err = d.IngestAndExcise([]string{"ext/0"}, Range{Start: []byte("k"), Limit: []byte("q")})
+		if err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+
+	if err := d.IngestAndExcise(nil, Range{Start: []byte("q"), Limit: []byte("k")}); err == nil ||
+		!strings.Contains(err.Error(), "invalid excise span") {
+		t.Fatalf("expected invalid span error, but found %v", err)
+	}
+	if err := ingest("j", "l"); !strings.Contains(err, "not within the excise span") {
+		t.Fatalf("expected span error, but found %q", err)
+	}
+	if err := ingest("l", "q"); !strings.Contains(err, "not within the excise span") {
+		t.Fatalf("expected span error, but found %q", err)
+	}
+	if err := ingest("l", "o"); err != "" {
+		t.Fatal(err)
+	}
+
+	const expected = "a:1 b:2 c:3 l:new o:new q:1 y:2 z:4 "
+	verify := func() {
+		t.Helper()
+		iter := d.NewIter(nil)
+		var buf bytes.Buffer
+		for iter.First(); iter.Valid(); iter.Next() {
+			fmt.Fprintf(&buf, "%s:%s ", iter.Key(), iter.Value())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if s := buf.String(); s != expected {
+			t.Fatalf("expected\n%s\nbut found\n%s", expected, s)
+		}
+	}
+	verify()
+	for k, v := range map[string]string{"b": "2", "c": "3", "m": "", "n": "", "o": "new"} {
+		value, err := d.Get([]byte(k))
+		if v == "" {
+			if err != db.ErrNotFound {
+				t.Fatalf("%s: expected not found, but found %s (%v)", k, value, err)
+			}
+		} else if err != nil || string(value) != v {
+			t.Fatalf("%s: expected %s, but found %s (%v)", k, v, value, err)
+		}
+	}
+
+	// Only the ingested table overlaps the span, and the level 0 tables are
+	// still ordered by sequence number. The virtual tables referencing the same
+	// backing table share its sequence numbers.
+	tables, err := d.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for level := range tables {
+		for i, info := range tables[level] {
+			if bytes.Compare(info.Largest.UserKey, []byte("k")) >= 0 &&
+				bytes.Compare(info.Smallest.UserKey, []byte("q")) < 0 &&
+				(string(info.Smallest.UserKey) != "l" || string(info.Largest.UserKey) != "o") {
+				t.Fatalf("L%d: table %d [%s-%s] overlaps the excise span",
+					level, info.FileNum, info.Smallest, info.Largest)
+			}
+			if level == 0 && i > 0 && info.SmallestSeqNum <= tables[0][i-1].LargestSeqNum &&
+				(info.SmallestSeqNum != tables[0][i-1].SmallestSeqNum ||
+					info.LargestSeqNum != tables[0][i-1].LargestSeqNum) {
+				t.Fatalf("L0: table %d is out of order", info.FileNum)
+			}
+		}
+	}
+
+	// At FormatVirtualSSTables the straddling tables are virtualized rather
+	// than rewritten, so the excise doesn't write any tables.
+	var virtual int
+	d.mu.Lock()
+	for _, files := range d.mu.versions.currentVersion().files {
+		for _, f := range files {
+			if f.backingFileNum != 0 {
+				virtual++
+			}
+		}
+	}
+	d.mu.Unlock()
+	if expectVirtual := vers >= db.FormatVirtualSSTables; (virtual > 0) != expectVirtual {
+		t.Fatalf("expected virtual tables %t, but found %d", expectVirtual, virtual)
+	}
+
+	// The excised DB survives being reopened and compacted.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d = open(1)
+	verify()
+	write("4", "z")
+	flush()
+	d.mu.Lock()
+	for d.mu.compact.compacting || len(d.mu.versions.currentVersion().files[0]) > 0 {
+		d.mu.compact.cond.Wait()
+	}
+	d.mu.Unlock()
+	verify()
+}
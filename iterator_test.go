@@ -65,6 +65,10 @@ func (f *fakeIter) SeekGE(key []byte) {
 	}
 }
 
+func (f *fakeIter) SeekPrefixGE(prefix, key []byte) {
+	f.SeekGE(key)
+}
+
 func (f *fakeIter) SeekLT(key []byte) {
 	for f.index = len(f.keys) - 1; f.index >= 0; f.index-- {
 		if db.DefaultComparer.Compare(key, f.Key().UserKey) > 0 {
@@ -0,0 +1,142 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// JobKind is the kind of a background job.
+type JobKind int
+
+const (
+	// FlushJob is a flush of memtables to level 0.
+	FlushJob JobKind = iota
+	// CompactionJob is a compaction of tables from one level into the next.
+	CompactionJob
+)
+
+func (k JobKind) String() string {
+	switch k {
+	case FlushJob:
+		return "flush"
+	case CompactionJob:
+		return "compaction"
+	}
+	return "unknown"
+}
+
+// JobInfo describes a flush or compaction which is in progress. See DB.Jobs.
+type JobInfo struct {
+	// JobID identifies the job. Job IDs are assigned in increasing order, and
+	// are included in the log messages about the job.
+	JobID int
+	Kind  JobKind
+	// InputLevels are the levels of the tables read by a compaction. A flush
+	// reads the memtables, and has no input levels.
+	InputLevels []int
+	// OutputLevel is the level the job writes its tables to. The tables of a
+	// flush may be moved to a lower level when the flush completes.
+	OutputLevel int
+	// InputBytes is the size of the input of the job: the size of the input
+	// tables of a compaction, or the memory used by the memtables of a flush.
+	InputBytes uint64
+	// BytesWritten is the size of the tables written by the job so far.
+	BytesWritten uint64
+	// Started is the time at which the job started.
+	Started time.Time
+	// EstimatedCompletion is the time at which the job is estimated to
+	// complete, assuming the job continues to write at its current rate and
+	// writes as many bytes as it reads. Both assumptions are rough: a flush
+	// writes much less than the memory used by its memtables, and a compaction
+	// writes less than it reads when it drops older versions of keys. It is
+	// the zero time if the job has not written anything yet.
+	EstimatedCompletion time.Time
+}
+
+// job is a flush or compaction which is in progress.
+type job struct {
+	info JobInfo
+	// The size of the tables written by the job so far, which is updated
+	// atomically as the job progresses.
+	bytesWritten uint64
+	// The memory used by the buffers of the table being written, which is
+	// updated atomically. See DB.memoryUsage.
+	buffered uint64
+}
+
+// setBytesWritten records the size of the tables written by the job so far. A
+// nil job, such as the flush of the memtables recovered by Open, is ignored.
+func (j *job) setBytesWritten(n uint64) {
+	if j != nil {
+		atomic.StoreUint64(&j.bytesWritten, n)
+	}
+}
+
+// setBuffered records the memory used by the buffers of the table being
+// written by the job. A nil job is ignored.
+func (j *job) setBuffered(n uint64) {
+	if j != nil {
+		atomic.StoreUint64(&j.buffered, n)
+	}
+}
+
+// newJob registers a new job, which must be unregistered by finishJob.
+//
+// d.mu must be held when calling this.
+func (d *DB) newJob(kind JobKind, inputLevels []int, outputLevel int, inputBytes uint64) *job {
+	if d.mu.compact.jobs == nil {
+		d.mu.compact.jobs = make(map[int]*job)
+	}
+	d.mu.compact.nextJobID++
+	j := &job{
+		info: JobInfo{
+			JobID:       d.mu.compact.nextJobID,
+			Kind:        kind,
+			InputLevels: inputLevels,
+			OutputLevel: outputLevel,
+			InputBytes:  inputBytes,
+			Started:     time.Now(),
+		},
+	}
+	d.mu.compact.jobs[j.info.JobID] = j
+	return j
+}
+
+// finishJob unregisters a job registered by newJob.
+//
+// d.mu must be held when calling this.
+func (d *DB) finishJob(j *job) {
+	delete(d.mu.compact.jobs, j.info.JobID)
+}
+
+// Jobs returns the flushes and compactions which are in progress, ordered by
+// job ID.
+func (d *DB) Jobs() []JobInfo {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	jobs := make([]JobInfo, 0, len(d.mu.compact.jobs))
+	for _, j := range d.mu.compact.jobs {
+		info := j.info
+		info.InputLevels = append([]int(nil), info.InputLevels...)
+		info.BytesWritten = atomic.LoadUint64(&j.bytesWritten)
+		if info.BytesWritten > 0 {
+			elapsed := now.Sub(info.Started)
+			total := time.Duration(float64(elapsed) * float64(info.InputBytes) / float64(info.BytesWritten))
+			if total < elapsed {
+				total = elapsed
+			}
+			info.EstimatedCompletion = info.Started.Add(total)
+		}
+		jobs = append(jobs, info)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].JobID < jobs[j].JobID
+	})
+	return jobs
+}
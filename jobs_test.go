@@ -0,0 +1,101 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+// blockingFS blocks the creation of each table until it is released.
+type blockingFS struct {
+	storage.Storage
+	created chan struct{}
+	release chan struct{}
+}
+
+func (fs *blockingFS) Create(name string) (storage.File, error) {
+	if ft, _, ok := parseDBFilename(name); ok && ft == fileTypeTable {
+		fs.created <- struct{}{}
+		<-fs.release
+	}
+	return fs.Storage.Create(name)
+}
+
+func TestJobs(t *testing.T) {
+	fs := &blockingFS{
+		Storage: storage.NewMem(),
+		created: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	d, err := Open("", &db.Options{
+		FlushToL0:             true,
+		L0CompactionThreshold: 2,
+		Logger:                discardLogger{},
+		Storage:               fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if jobs := d.Jobs(); len(jobs) != 0 {
+		t.Fatalf("expected no jobs, but found %+v", jobs)
+	}
+
+	flushed := make(chan error)
+	flush := func() {
+		if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			flushed <- d.Flush()
+		}()
+		<-fs.created
+	}
+
+	flush()
+	jobs := d.Jobs()
+	if len(jobs) != 1 {
+		t.Fatalf("expected 1 job, but found %+v", jobs)
+	}
+	if j := jobs[0]; j.JobID != 1 || j.Kind != FlushJob || j.InputLevels != nil ||
+		j.OutputLevel != 0 || j.InputBytes == 0 || j.BytesWritten != 0 ||
+		!j.EstimatedCompletion.IsZero() {
+		t.Fatalf("unexpected job: %+v", j)
+	}
+	fs.release <- struct{}{}
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+
+	// The second flush triggers a compaction of the two level 0 tables.
+	flush()
+	fs.release <- struct{}{}
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+	<-fs.created
+	jobs = d.Jobs()
+	if len(jobs) != 1 {
+		t.Fatalf("expected 1 job, but found %+v", jobs)
+	}
+	if j := jobs[0]; j.JobID != 3 || j.Kind != CompactionJob || len(j.InputLevels) != 2 ||
+		j.InputLevels[0] != 0 || j.InputLevels[1] != 1 || j.OutputLevel != 1 || j.InputBytes == 0 {
+		t.Fatalf("unexpected job: %+v", j)
+	}
+	fs.release <- struct{}{}
+
+	d.mu.Lock()
+	for d.mu.compact.compacting {
+		d.mu.compact.cond.Wait()
+	}
+	d.mu.Unlock()
+	if jobs := d.Jobs(); len(jobs) != 0 {
+		t.Fatalf("expected no jobs, but found %+v", jobs)
+	}
+}
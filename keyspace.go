@@ -0,0 +1,521 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/petermattis/pebble/arenaskl"
+	"github.com/petermattis/pebble/db"
+)
+
+// keyspacesDirname is the subdirectory of the DB directory holding the
+// directories of the keyspaces.
+const keyspacesDirname = "keyspaces"
+
+// Keyspace is an independent keyspace of a DB, similar to a RocksDB column
+// family. Each keyspace has its own memtables and LSM, stored in the
+// "keyspaces/<name>" subdirectory of the DB, and may have its own comparer,
+// merge operator and tuning options (see Options.Keyspaces). The data of
+// different keyspaces is never compared, merged or compacted together.
+//
+// The keyspaces of a DB share its WAL and commit pipeline, and so its
+// sequence numbers: writes to a keyspace are ordered and made durable along
+// with the writes to the DB. A batch of the DB may hold entries of several
+// keyspaces, which are committed atomically. Such a batch is built by
+// applying the batches of the keyspaces to it:
+//
+//	b := d.NewBatch()
+//	b.Set(key, value, nil)
+//	kb := ks.NewBatch()
+//	kb.Set(key, value, nil)
+//	b.Apply(kb, nil)
+//	d.Apply(b, nil)
+//
+// Keyspaces are opened along with their DB, and are closed when the DB is
+// closed.
+type Keyspace struct {
+	name string
+	// The DB storing the keyspace's memtables and LSM. Its parent is the DB the
+	// keyspace belongs to.
+	d *DB
+}
+
+var _ Reader = (*Keyspace)(nil)
+var _ Writer = (*Keyspace)(nil)
+
+// Keyspace returns the keyspace with the specified name, creating it if it
+// does not exist. A keyspace name must be a non-empty valid file name.
+func (d *DB) Keyspace(name string) (*Keyspace, error) {
+	if d.parent != nil {
+		return nil, errors.New("pebble: keyspaces cannot be nested")
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("pebble: invalid keyspace name %q", name)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if k := d.mu.keyspaces[name]; k != nil {
+		return k, nil
+	}
+	if d.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	return d.openKeyspace(name)
+}
+
+// Keyspaces returns the names of the keyspaces of the DB, in sorted order.
+func (d *DB) Keyspaces() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.mu.keyspaces))
+	for name := range d.mu.keyspaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// openKeyspaces opens the existing keyspaces of the DB.
+//
+// d.mu must be held when calling this.
+func (d *DB) openKeyspaces() error {
+	fs := d.opts.Storage
+	dirname := filepath.Join(d.dirname, keyspacesDirname)
+	if _, err := fs.Stat(dirname); os.IsNotExist(err) {
+		return nil
+	}
+	names, err := fs.List(dirname)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := d.openKeyspace(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openKeyspace opens the keyspace with the specified name, creating its
+// directory if it does not exist.
+//
+// d.mu must be held when calling this.
+func (d *DB) openKeyspace(name string) (*Keyspace, error) {
+	fs := d.opts.Storage
+	parentDir := filepath.Join(d.dirname, keyspacesDirname)
+	dirname := filepath.Join(parentDir, name)
+	if !d.opts.ReadOnly {
+		if err := fs.MkdirAll(dirname, 0755); err != nil {
+			return nil, err
+		}
+		// Sync the directories so that the keyspace survives a crash, as its
+		// entries in the WAL cannot be recovered without it.
+		if err := syncDir(fs, parentDir); err != nil {
+			return nil, err
+		}
+		if err := syncDir(fs, d.dirname); err != nil {
+			return nil, err
+		}
+	}
+	kd, err := open(dirname, d.keyspaceOptions(name), d, name)
+	if err != nil {
+		return nil, fmt.Errorf("pebble: keyspace %q: %v", name, err)
+	}
+	k := &Keyspace{name: name, d: kd}
+	if d.mu.keyspaces == nil {
+		d.mu.keyspaces = make(map[string]*Keyspace)
+	}
+	d.mu.keyspaces[name] = k
+	return k, nil
+}
+
+// keyspaceOptions returns the options of the keyspace with the specified
+// name.
+func (d *DB) keyspaceOptions(name string) *db.Options {
+	o := *d.opts
+	if ko := d.opts.Keyspaces[name]; ko != nil {
+		o = *ko
+		if o.Cache == nil {
+			o.Cache = d.opts.Cache
+		}
+		if o.CompressedCache == nil {
+			o.CompressedCache = d.opts.CompressedCache
+		}
+		if o.Logger == nil {
+			o.Logger = d.opts.Logger
+		}
+	}
+	// The storage of the DB is already monitored if DiskSlowThreshold is set.
+	o.Storage = d.opts.Storage
+	if d.diskHealth != nil {
+		o.DiskSlowThreshold = 0
+	}
+	o.ReadOnly = d.opts.ReadOnly
+	// The memory of a keyspace is accounted against the budget of the DB.
+	o.MemoryBudget = 0
+	o.ErrorIfDBExists = false
+	o.ErrorIfNotExists = false
+	o.Keyspaces = nil
+	return &o
+}
+
+// checkKeyspaces checks that the keyspaces with entries in the batch exist.
+//
+// d.mu must be held when calling this.
+func (d *DB) checkKeyspaces(b *Batch) error {
+	for i := range b.keyspaces {
+		if name := b.keyspaces[i].name; d.mu.keyspaces[name] == nil {
+			return fmt.Errorf("pebble: keyspace %q does not exist", name)
+		}
+	}
+	return nil
+}
+
+// applyKeyspace commits the entries of batch, a batch of the named keyspace,
+// through the commit pipeline of the DB.
+func (d *DB) applyKeyspace(name string, batch *Batch, opts *db.WriteOptions) error {
+	if k := batch.db; k != nil && k.parent != nil && k.keyspaceName != name {
+		return fmt.Errorf("pebble: cannot apply a batch of keyspace %q to keyspace %q",
+			k.keyspaceName, name)
+	}
+	b := newBatch(d)
+	defer b.release()
+	err := b.apply(batch, name)
+	if err == nil {
+		err = d.apply(b, opts)
+	}
+	if err == nil && len(b.data) > 0 {
+		batch.setSeqNum(b.seqNum())
+	}
+	return err
+}
+
+// prepareKeyspaces reserves room for the entries of the batch in the
+// memtables of the keyspaces they belong to, and returns true if a keyspace
+// switched out its memtable. The reservations of the keyspaces are made in
+// sequence number order, which is required by the sequence numbers recorded
+// by their flushes, as d.mu is not dropped between the assignment of the
+// batch's sequence number and the call to prepareKeyspaces.
+//
+// d.mu must be held when calling this.
+func (d *DB) prepareKeyspaces(b *Batch) (bool, error) {
+	var switched bool
+	for i := range b.keyspaces {
+		bk := &b.keyspaces[i]
+		kd := d.mu.keyspaces[bk.name].d
+		kd.mu.Lock()
+		mem, s, err := kd.makeRoomForKeyspaceWrite(bk.memTableSize, b.seqNum(), false)
+		kd.mu.Unlock()
+		if err != nil {
+			releaseKeyspaces(b, i)
+			return false, err
+		}
+		bk.d, bk.mem = kd, mem
+		switched = switched || s
+	}
+	return switched, nil
+}
+
+// releaseKeyspaces releases the reservations made by prepareKeyspaces in the
+// memtables of the first n keyspaces of the batch, which is not applied.
+func releaseKeyspaces(b *Batch, n int) {
+	for i := 0; i < n; i++ {
+		bk := &b.keyspaces[i]
+		unrefKeyspace(bk.d, bk.mem)
+		bk.d, bk.mem = nil, nil
+	}
+}
+
+// setKeyspaceLogNums records that the entries of the batch's keyspaces are
+// written to the WAL numbered logNum.
+//
+// The mutex of the keyspaces' parent must be held when calling this.
+func setKeyspaceLogNums(b *Batch, logNum uint64) {
+	for i := range b.keyspaces {
+		bk := &b.keyspaces[i]
+		bk.d.mu.Lock()
+		if bk.mem.logNum == 0 {
+			bk.mem.logNum = logNum
+		}
+		bk.d.mu.Unlock()
+	}
+}
+
+// applyKeyspaces applies the entries of the batch's keyspaces to the
+// memtables prepared by prepareKeyspaces.
+func applyKeyspaces(b *Batch) error {
+	var err error
+	for i := range b.keyspaces {
+		bk := &b.keyspaces[i]
+		if err == nil {
+			err = bk.mem.applyKeyspace(b, b.seqNum(), bk.name)
+		}
+		unrefKeyspace(bk.d, bk.mem)
+		bk.d, bk.mem = nil, nil
+	}
+	return err
+}
+
+// unrefKeyspace releases a reference to the memtable of a keyspace's DB,
+// scheduling a flush if the memtable became ready for flushing.
+func unrefKeyspace(kd *DB, mem *memTable) {
+	if mem.unref() {
+		kd.mu.Lock()
+		kd.maybeScheduleFlush()
+		kd.mu.Unlock()
+	}
+}
+
+// makeRoomForKeyspaceWrite reserves size bytes in the mutable memtable of a
+// keyspace's DB, switching to a new memtable if there is not enough room or
+// force is true. The entries of the new memtable have sequence numbers of at
+// least seqNum. It returns the memtable holding the reservation, or nil if
+// force is true, and whether the memtable was switched. Unlike
+// makeRoomForWrite, it does not switch to a new WAL, as a keyspace has none.
+//
+// d.mu and the mutex of d.parent must be held when calling this.
+func (d *DB) makeRoomForKeyspaceWrite(
+	size, seqNum uint64, force bool,
+) (*memTable, bool, error) {
+	var switched bool
+	for {
+		if !force {
+			err := d.mu.mem.mutable.reserve(size)
+			if err == nil {
+				return d.mu.mem.mutable, switched, nil
+			}
+			if err != arenaskl.ErrArenaFull {
+				return nil, switched, err
+			}
+		}
+		// A read-only keyspace only switches memtables while its entries are
+		// recovered, and never flushes them.
+		if !d.opts.ReadOnly {
+			if len(d.mu.mem.queue) >= d.opts.MemTableStopWritesThreshold {
+				if err := d.waitForStall(); err != nil {
+					return nil, switched, err
+				}
+				continue
+			}
+			if len(d.mu.versions.currentVersion().files[0]) > d.opts.L0StopWritesThreshold {
+				if err := d.waitForStall(); err != nil {
+					return nil, switched, err
+				}
+				continue
+			}
+		}
+
+		imm := d.mu.mem.mutable
+		d.mu.mem.mutable = newMemTable(d.opts)
+		d.mu.mem.mutable.baseSeqNum = seqNum
+		d.mu.mem.queue = append(d.mu.mem.queue, d.mu.mem.mutable)
+		if imm.unref() {
+			d.maybeScheduleFlush()
+		}
+		switched = true
+		if force {
+			return nil, switched, nil
+		}
+	}
+}
+
+// minKeyspaceLogNum returns the number of the oldest WAL holding entries of
+// the keyspaces which have not been flushed, or 0 if there is none.
+//
+// d.mu must be held when calling this.
+func (d *DB) minKeyspaceLogNum() uint64 {
+	var logNum uint64
+	for _, k := range d.mu.keyspaces {
+		k.d.mu.Lock()
+		for _, mem := range k.d.mu.mem.queue {
+			if mem.logNum != 0 {
+				if logNum == 0 || mem.logNum < logNum {
+					logNum = mem.logNum
+				}
+				break
+			}
+		}
+		k.d.mu.Unlock()
+	}
+	return logNum
+}
+
+// replayKeyspaces applies the entries of the keyspaces in a batch read from
+// the WAL numbered logNum, skipping those which a keyspace flushed before the
+// DB was closed.
+//
+// d.mu must be held when calling this.
+func (d *DB) replayKeyspaces(b *Batch, logNum uint64) error {
+	seqNum := b.seqNum()
+	for i := range b.keyspaces {
+		bk := &b.keyspaces[i]
+		k := d.mu.keyspaces[bk.name]
+		if k == nil {
+			return fmt.Errorf("pebble: WAL has entries of unknown keyspace %q", bk.name)
+		}
+		kd := k.d
+		kd.mu.Lock()
+		if seqNum < atomic.LoadUint64(&kd.mu.versions.logSeqNum) {
+			kd.mu.Unlock()
+			continue
+		}
+		mem, _, err := kd.makeRoomForKeyspaceWrite(bk.memTableSize, seqNum, false)
+		if err == nil && mem.logNum == 0 {
+			mem.logNum = logNum
+		}
+		kd.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		err = mem.applyKeyspace(b, seqNum, bk.name)
+		unrefKeyspace(kd, mem)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Name returns the name of the keyspace.
+func (k *Keyspace) Name() string {
+	return k.name
+}
+
+// Get gets the value for the given key. It returns ErrNotFound if the
+// keyspace does not contain the key.
+//
+// The caller should not modify the contents of the returned slice, but
+// it is safe to modify the contents of the argument after Get returns.
+func (k *Keyspace) Get(key []byte) ([]byte, error) {
+	return k.d.Get(key)
+}
+
+// NewIter returns an iterator that is unpositioned (Iterator.Valid() will
+// return false). The iterator can be positioned via a call to SeekGE,
+// SeekLT, First or Last.
+func (k *Keyspace) NewIter(o *db.IterOptions) db.Iterator {
+	return k.d.NewIter(o)
+}
+
+// NewSnapshot returns a point-in-time view of the current keyspace state.
+func (k *Keyspace) NewSnapshot() *Snapshot {
+	return k.d.NewSnapshot()
+}
+
+// NewBatch returns a new empty write-only batch of the keyspace. The batch
+// may be committed directly, or applied to a batch of the DB.
+func (k *Keyspace) NewBatch() *Batch {
+	return newBatch(k.d)
+}
+
+// NewIndexedBatch returns a new empty read-write batch of the keyspace. The
+// batch may be committed directly, or applied to a batch of the DB.
+func (k *Keyspace) NewIndexedBatch() *Batch {
+	return newIndexedBatch(k.d, k.d.opts.Comparer)
+}
+
+// Apply the operations contained in the batch to the keyspace. The batch
+// must be a batch of the keyspace, or a batch of the DB holding entries of
+// the default keyspace only, which are added to the keyspace.
+//
+// It is safe to modify the contents of the arguments after Apply returns.
+func (k *Keyspace) Apply(batch *Batch, opts *db.WriteOptions) error {
+	return k.d.Apply(batch, opts)
+}
+
+// Set sets the value for the given key.
+//
+// It is safe to modify the contents of the arguments after Set returns.
+func (k *Keyspace) Set(key, value []byte, opts *db.WriteOptions) error {
+	return k.d.Set(key, value, opts)
+}
+
+// Merge merges the value for the given key using the keyspace's merge
+// operator.
+//
+// It is safe to modify the contents of the arguments after Merge returns.
+func (k *Keyspace) Merge(key, value []byte, opts *db.WriteOptions) error {
+	return k.d.Merge(key, value, opts)
+}
+
+// Delete deletes the value for the given key.
+//
+// It is safe to modify the contents of the arguments after Delete returns.
+func (k *Keyspace) Delete(key []byte, opts *db.WriteOptions) error {
+	return k.d.Delete(key, opts)
+}
+
+// DeleteRange deletes all of the keys (and values) in the range [start,end)
+// (inclusive on start, exclusive on end).
+//
+// It is safe to modify the contents of the arguments after DeleteRange
+// returns.
+func (k *Keyspace) DeleteRange(start, end []byte, opts *db.WriteOptions) error {
+	return k.d.DeleteRange(start, end, opts)
+}
+
+// LogData writes the specified data to the WAL of the DB.
+//
+// It is safe to modify the contents of the arguments after LogData returns.
+func (k *Keyspace) LogData(data []byte, opts *db.WriteOptions) error {
+	return k.d.LogData(data, opts)
+}
+
+// Close does nothing: a keyspace is closed along with its DB.
+func (k *Keyspace) Close() error {
+	return nil
+}
+
+// Flush the memtable of the keyspace to stable storage. The memtables of the
+// DB and of other keyspaces are not flushed.
+func (k *Keyspace) Flush() error {
+	d, p := k.d, k.d.parent
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	// The parent's mutex prevents batches from being assigned sequence numbers
+	// while the memtable is switched. See DB.prepareKeyspaces.
+	p.mu.Lock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.backgroundError(); err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	mem := d.mu.mem.mutable
+	_, _, err := d.makeRoomForKeyspaceWrite(0, atomic.LoadUint64(&p.mu.versions.logSeqNum), true)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-mem.flushed:
+			return nil
+		default:
+		}
+		if err := d.backgroundError(); err != nil {
+			return err
+		}
+		d.mu.compact.cond.Wait()
+	}
+}
+
+// Metrics returns the metrics of the keyspace's memtables and LSM.
+func (k *Keyspace) Metrics() *Metrics {
+	return k.d.Metrics()
+}
+
+// SSTables retrieves the current sstables in the keyspace's LSM.
+func (k *Keyspace) SSTables(opts ...SSTablesOption) (SSTables, error) {
+	return k.d.SSTables(opts...)
+}
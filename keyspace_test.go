@@ -0,0 +1,249 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func readerString(t *testing.T, r Reader) string {
+	t.Helper()
+	iter := r.NewIter(nil)
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(keys, " ")
+}
+
+func openKeyspace(t *testing.T, d *DB, name string) *Keyspace {
+	t.Helper()
+	k, err := d.Keyspace(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeyspace(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Logger:  discardLogger{},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ks1 := openKeyspace(t, d, "ks1")
+	ks2 := openKeyspace(t, d, "ks2")
+	if k := openKeyspace(t, d, "ks1"); k != ks1 {
+		t.Fatalf("expected the same keyspace to be returned")
+	}
+	if s := strings.Join(d.Keyspaces(), " "); s != "ks1 ks2" {
+		t.Fatalf("expected ks1 ks2, but found %s", s)
+	}
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		if _, err := d.Keyspace(name); err == nil {
+			t.Fatalf("%q: expected an error", name)
+		}
+	}
+
+	// The keyspaces are independent of each other and of the DB.
+	if err := d.Set([]byte("a"), []byte("db"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks1.Set([]byte("a"), []byte("ks1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks2.Merge([]byte("b"), []byte("ks2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := readerString(t, d); s != "a:db" {
+		t.Fatalf("expected a:db, but found %s", s)
+	}
+	if s := readerString(t, ks1); s != "a:ks1" {
+		t.Fatalf("expected a:ks1, but found %s", s)
+	}
+	if s := readerString(t, ks2); s != "b:ks2" {
+		t.Fatalf("expected b:ks2, but found %s", s)
+	}
+
+	// A batch of the DB commits the entries of several keyspaces atomically.
+	b := d.NewBatch()
+	if err := b.Set([]byte("c"), []byte("db"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []*Keyspace{ks1, ks2} {
+		kb := k.NewBatch()
+		if err := kb.Set([]byte("c"), []byte(k.Name()), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Apply(kb, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Delete([]byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Apply(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := readerString(t, d); s != "c:db" {
+		t.Fatalf("expected c:db, but found %s", s)
+	}
+	if s := readerString(t, ks1); s != "a:ks1 c:ks1" {
+		t.Fatalf("expected a:ks1 c:ks1, but found %s", s)
+	}
+	if s := readerString(t, ks2); s != "b:ks2 c:ks2" {
+		t.Fatalf("expected b:ks2 c:ks2, but found %s", s)
+	}
+
+	// The batch of a keyspace may be committed through the DB.
+	kb := ks1.NewBatch()
+	if err := kb.Set([]byte("d"), []byte("ks1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Apply(kb, nil); err != nil {
+		t.Fatal(err)
+	}
+	if kb.SeqNum() == 0 {
+		t.Fatalf("expected the batch to be assigned a sequence number")
+	}
+	if s := readerString(t, ks1); s != "a:ks1 c:ks1 d:ks1" {
+		t.Fatalf("expected a:ks1 c:ks1 d:ks1, but found %s", s)
+	}
+
+	// The entries of a keyspace cannot be added to an indexed batch, or to the
+	// batch of another keyspace.
+	if err := d.NewIndexedBatch().Apply(kb, nil); err == nil {
+		t.Fatalf("expected an error applying to an indexed batch")
+	}
+	if err := ks2.NewBatch().Apply(kb, nil); err == nil {
+		t.Fatalf("expected an error applying to the batch of another keyspace")
+	}
+	if err := ks2.Apply(kb, nil); err == nil {
+		t.Fatalf("expected an error applying to another keyspace")
+	}
+}
+
+func TestKeyspaceRecovery(t *testing.T) {
+	mem := storage.NewMem()
+	opts := &db.Options{
+		Logger:  discardLogger{},
+		Storage: mem,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := openKeyspace(t, d, "ks")
+
+	b := d.NewBatch()
+	if err := b.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	kb := ks.NewBatch()
+	if err := kb.Merge([]byte("m"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Apply(kb, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Apply(b, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	logNum := d.mu.log.number
+	d.mu.Unlock()
+	var buf bytes.Buffer
+	if err := DumpWAL(&buf, dbFilename("", fileTypeLog, logNum), opts); err != nil {
+		t.Fatal(err)
+	}
+	expected := `record 0: seqnum=1 count=2 len=26
+    SET("a", "1") #1
+    KEYSPACE("ks")
+    MERGE("m", "1") #2
+`
+	if s := buf.String(); s != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, s)
+	}
+
+	// The entries flushed by the keyspace are not replayed, and the WAL holding
+	// the entries it has not flushed is retained when the DB flushes.
+	if err := ks.Merge([]byte("m"), []byte("2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Merge([]byte("m"), []byte("3"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := d.Set([]byte("b"), []byte(fmt.Sprint(i)), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		d, err = Open("", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := strings.Join(d.Keyspaces(), " "); s != "ks" {
+			t.Fatalf("expected ks, but found %s", s)
+		}
+		ks = openKeyspace(t, d, "ks")
+		if s := readerString(t, d); s != "a:1 b:1" {
+			t.Fatalf("expected a:1 b:1, but found %s", s)
+		}
+		if s := readerString(t, ks); s != "m:321" {
+			t.Fatalf("expected m:321, but found %s", s)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Once the keyspace has flushed, the older WALs are deleted.
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks = openKeyspace(t, d, "ks")
+	if err := ks.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	d.deleter.wait()
+	if _, err := mem.Stat(dbFilename("", fileTypeLog, logNum)); err == nil {
+		t.Fatalf("expected log %d to be deleted", logNum)
+	}
+	if s := readerString(t, ks); s != "m:321" {
+		t.Fatalf("expected m:321, but found %s", s)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// CheckLevels checks the sstables in the current version for consistency. It
+// verifies that:
+//
+//   - the files in L1 and higher are sorted and non-overlapping,
+//   - the keys within each file are sorted and lie within the file bounds
+//     recorded in the manifest, and the bounds match the first and last key in
+//     the file,
+//   - the sequence numbers for a user key are decreasing from newer to older
+//     levels (L0 files are considered individually from newest to oldest),
+//   - range tombstones have a start key that is less than the end key, and
+//     lie within the bounds of their file,
+//   - range tombstones do not cover a key with a larger sequence number in an
+//     older level.
+//
+// CheckLevels reads every key in the LSM and is intended for tests and
+// debugging tools.
+func (d *DB) CheckLevels() error {
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	current.ref()
+	d.mu.Unlock()
+	defer current.unref()
+
+	if err := current.checkOrdering(d.cmp); err != nil {
+		return err
+	}
+
+	for level := range current.files {
+		for i := range current.files[level] {
+			if err := d.checkTable(level, &current.files[level][i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.checkSeqNums(current)
+}
+
+// checkTable checks that the keys in the specified table are sorted and that
+// the bounds recorded in meta match the contents of the table.
+func (d *DB) checkTable(level int, meta *fileMetadata) error {
+	iter, err := d.newIter(meta)
+	if err != nil {
+		return err
+	}
+
+	var prev db.InternalKey
+	var n int
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if n == 0 {
+			if db.InternalCompare(d.cmp, key, meta.smallest) != 0 {
+				iter.Close()
+				return fmt.Errorf("pebble: L%d table %06d: smallest key %s does not match first key %s",
+					level, meta.fileNum, meta.smallest, key)
+			}
+		} else if db.InternalCompare(d.cmp, prev, key) >= 0 {
+			iter.Close()
+			return fmt.Errorf("pebble: L%d table %06d: keys out of order: %s, %s",
+				level, meta.fileNum, prev, key)
+		}
+		if meta.largestSeqNum != 0 {
+			if s := key.SeqNum(); s < meta.smallestSeqNum || s > meta.largestSeqNum {
+				iter.Close()
+				return fmt.Errorf("pebble: L%d table %06d: key %s outside of seqnum range [%d-%d]",
+					level, meta.fileNum, key, meta.smallestSeqNum, meta.largestSeqNum)
+			}
+		}
+		if key.Kind() == db.InternalKeyKindRangeDelete {
+			if d.cmp(key.UserKey, iter.Value()) >= 0 {
+				iter.Close()
+				return fmt.Errorf("pebble: L%d table %06d: invalid range tombstone: %s-%s",
+					level, meta.fileNum, key, iter.Value())
+			}
+			// The end key is exclusive, so a tombstone ending at the largest key
+			// lies within the bounds.
+			if d.cmp(iter.Value(), meta.largest.UserKey) > 0 {
+				iter.Close()
+				return fmt.Errorf("pebble: L%d table %06d: range tombstone %s-%s extends past largest key %s",
+					level, meta.fileNum, key, iter.Value(), meta.largest)
+			}
+		}
+		prev = key.Clone()
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("pebble: L%d table %06d: empty table", level, meta.fileNum)
+	}
+	if db.InternalCompare(d.cmp, prev, meta.largest) != 0 {
+		return fmt.Errorf("pebble: L%d table %06d: largest key %s does not match last key %s",
+			level, meta.fileNum, meta.largest, prev)
+	}
+	return nil
+}
+
+// checkTombstone is a range tombstone found by checkSeqNums.
+type checkTombstone struct {
+	level int
+	start db.InternalKey
+	end   []byte
+}
+
+// checkSeqNums checks that for every user key the sequence numbers in newer
+// levels are larger than the sequence numbers in older levels, and that no
+// range tombstone covers a key in an older level with a larger sequence
+// number. Each L0 file is treated as a separate level, with newer files
+// considered first.
+func (d *DB) checkSeqNums(v *version) error {
+	type checkLevel struct {
+		name string
+		iter db.InternalIterator
+	}
+	var levels []checkLevel
+	defer func() {
+		for i := range levels {
+			levels[i].iter.Close()
+		}
+	}()
+
+	for i := len(v.files[0]) - 1; i >= 0; i-- {
+		f := &v.files[0][i]
+		iter, err := d.newIter(f)
+		if err != nil {
+			return err
+		}
+		levels = append(levels, checkLevel{
+			name: fmt.Sprintf("L0 table %06d", f.fileNum),
+			iter: iter,
+		})
+	}
+	for level := 1; level < len(v.files); level++ {
+		if len(v.files[level]) == 0 {
+			continue
+		}
+		levels = append(levels, checkLevel{
+			name: fmt.Sprintf("L%d", level),
+			iter: newLevelIter(nil, d.cmp, d.newIter, v.files[level]),
+		})
+	}
+
+	for i := range levels {
+		levels[i].iter.First()
+	}
+
+	// The range tombstones which cover the current user key, or a later one.
+	var tombstones []checkTombstone
+	var userKey []byte
+	for {
+		// Find the smallest user key across all of the levels.
+		userKey = userKey[:0]
+		found := false
+		for i := range levels {
+			iter := levels[i].iter
+			if !iter.Valid() {
+				continue
+			}
+			if !found || d.cmp(iter.Key().UserKey, userKey) < 0 {
+				userKey = append(userKey[:0], iter.Key().UserKey...)
+				found = true
+			}
+		}
+		if !found {
+			break
+		}
+		live := tombstones[:0]
+		for _, t := range tombstones {
+			if d.cmp(t.end, userKey) > 0 {
+				live = append(live, t)
+			}
+		}
+		tombstones = live
+
+		// Step through the levels from newest to oldest, consuming the entries
+		// for userKey and verifying that each level's sequence numbers are below
+		// those of the newer levels.
+		var prevName string
+		var prevSeqNum uint64
+		havePrev := false
+		for i := range levels {
+			iter := levels[i].iter
+			var maxSeqNum, minSeqNum uint64
+			n := 0
+			for ; iter.Valid() && d.cmp(iter.Key().UserKey, userKey) == 0; iter.Next() {
+				key := iter.Key()
+				if key.Kind() == db.InternalKeyKindRangeDelete {
+					tombstones = append(tombstones, checkTombstone{
+						level: i,
+						start: key.Clone(),
+						end:   append([]byte(nil), iter.Value()...),
+					})
+				} else {
+					for _, t := range tombstones {
+						if t.level < i && t.start.SeqNum() < key.SeqNum() {
+							return fmt.Errorf("pebble: range tombstone %s-%s in %s covers key %s in %s",
+								t.start, t.end, levels[t.level].name, key, levels[i].name)
+						}
+					}
+				}
+				s := key.SeqNum()
+				if n == 0 {
+					maxSeqNum = s
+				}
+				minSeqNum = s
+				n++
+			}
+			if n == 0 {
+				continue
+			}
+			if havePrev && maxSeqNum >= prevSeqNum {
+				return fmt.Errorf("pebble: key %q: seqnum %d in %s is not less than seqnum %d in %s",
+					userKey, maxSeqNum, levels[i].name, prevSeqNum, prevName)
+			}
+			prevName, prevSeqNum, havePrev = levels[i].name, minSeqNum, true
+		}
+	}
+
+	for i := range levels {
+		if err := levels[i].iter.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
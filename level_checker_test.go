@@ -0,0 +1,167 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestCheckLevels(t *testing.T) {
+	d, err := Open("", &db.Options{
+		FlushToL0: true,
+		Storage:   storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer d.Close()
+
+	for _, keys := range [][]string{{"a", "c"}, {"b", "c", "d"}} {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.CheckLevels(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	d.mu.Unlock()
+	if len(current.files[0]) != 2 {
+		t.Fatalf("expected 2 L0 tables, but found\n%s", current)
+	}
+	orig := current.files
+
+	testCases := []struct {
+		corrupt  func()
+		expected string
+	}{
+		{
+			// Table bounds don't match the table contents.
+			func() {
+				current.files[0] = append([]fileMetadata(nil), orig[0]...)
+				current.files[0][0].smallest = db.MakeInternalKey([]byte("0"), 1, db.InternalKeyKindSet)
+			},
+			"does not match first key",
+		},
+		{
+			func() {
+				current.files[0] = append([]fileMetadata(nil), orig[0]...)
+				current.files[0][1].largest = db.MakeInternalKey([]byte("z"), 1, db.InternalKeyKindSet)
+			},
+			"does not match last key",
+		},
+		{
+			// The newer table is moved below the older table, leaving the older
+			// version of "c" above the newer version.
+			func() {
+				current.files[0] = orig[0][:1]
+				current.files[1] = orig[0][1:]
+			},
+			"is not less than seqnum",
+		},
+	}
+	for _, c := range testCases {
+		c.corrupt()
+		err := d.CheckLevels()
+		current.files = orig
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Fatalf("expected %q, but found %v", c.expected, err)
+		}
+	}
+
+	if err := d.CheckLevels(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckLevelsRangeTombstones(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		FlushToL0: true,
+		Storage:   mem,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer d.Close()
+
+	ingest := func(keys ...db.InternalKey) {
+		t.Helper()
+		f, err := mem.Create("ext")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := sstable.NewWriter(f, nil, db.LevelOptions{})
+		for _, k := range keys {
+			var value []byte
+			if k.Kind() == db.InternalKeyKindRangeDelete {
+				value = []byte("c")
+			}
+			if err := w.Add(k, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Ingest([]string{"ext"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The tombstone [b, c) is ingested below a newer key which it covers.
+	ingest(db.MakeInternalKey([]byte("b"), 0, db.InternalKeyKindRangeDelete),
+		db.MakeInternalKey([]byte("c"), 0, db.InternalKeyKindSet))
+	if err := d.Set([]byte("b1"), []byte("b1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CheckLevels(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Swapping the levels of the tables leaves the tombstone in the newer level
+	// covering the key with a larger sequence number in the older level.
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	d.mu.Unlock()
+	orig := current.files
+	current.files = [numLevels][]fileMetadata{}
+	for level := range orig {
+		switch len(orig[level]) {
+		case 0:
+		case 1:
+			current.files[len(orig)-1-level] = orig[level]
+		default:
+			t.Fatalf("expected a single table per level, but found\n%s", current)
+		}
+	}
+	err = d.CheckLevels()
+	current.files = orig
+	if err == nil || !strings.Contains(err.Error(), "covers key b1") {
+		t.Fatalf("expected a covered key error, but found %v", err)
+	}
+
+	// A tombstone ending past the largest key of its table.
+	ingest(db.MakeInternalKey([]byte("a"), 0, db.InternalKeyKindRangeDelete))
+	err = d.CheckLevels()
+	if err == nil || !strings.Contains(err.Error(), "extends past largest key") {
+		t.Fatalf("expected a tombstone bounds error, but found %v", err)
+	}
+}
@@ -5,34 +5,76 @@
 package pebble
 
 import (
+	"bytes"
 	"sort"
 
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
 )
 
+// levelIter provides a merged view of the sstables in a level. Only a single
+// sstable is open at a time, and the sstables are opened lazily as the
+// iterator moves into them.
+//
+// If the iterator has bounds, a file which lies entirely outside of the bounds
+// in the direction of iteration is skipped without being opened. The iterator
+// is then exhausted, but remains positioned at the skipped file so that a
+// subsequent step in the opposite direction moves to the adjacent file.
+//
+// Following a call to SeekPrefixGE, each subsequent file is only opened if its
+// smallest key may share the prefix, and is then positioned using
+// SeekPrefixGE, allowing the file to be skipped using its filter.
+//
+// If the iterator has a table filter, the files which the filter rejects are
+// skipped without being iterated over, as if they were absent from the level.
 type levelIter struct {
-	cmp     db.Compare
+	opts *db.IterOptions
+	cmp  db.Compare
+	// The index of the current file. If iter is nil, the iterator is exhausted
+	// and positioned at the gap occupied by the file at index, which may be -1
+	// or len(files) if the iterator is positioned before the first or after the
+	// last file respectively.
 	index   int
 	iter    db.InternalIterator
 	newIter tableNewIter
 	files   []fileMetadata
 	err     error
+	// tableFilter, if non-nil, is consulted before a file is opened, and
+	// returns false if the file should be skipped. See
+	// db.IterOptions.TableFilter.
+	tableFilter func(meta *fileMetadata) (bool, error)
+	// readStats, if non-nil, accumulates the bytes read from the files.
+	readStats *sstable.ReadStats
+	// The prefix passed to the last call to SeekPrefixGE, or nil if the
+	// iterator was last positioned by another seek.
+	prefix []byte
 }
 
 // levelIter implements the db.InternalIterator interface.
 var _ db.InternalIterator = (*levelIter)(nil)
 
-func newLevelIter(cmp db.Compare, newIter tableNewIter, files []fileMetadata) *levelIter {
+func newLevelIter(
+	opts *db.IterOptions, cmp db.Compare, newIter tableNewIter, files []fileMetadata,
+) *levelIter {
 	l := &levelIter{}
-	l.init(cmp, newIter, files)
+	l.init(opts, cmp, newIter, files)
 	return l
 }
 
-func (l *levelIter) init(cmp db.Compare, newIter tableNewIter, files []fileMetadata) {
+// init initializes the iterator. The bounds in opts, if any, are consulted on
+// every file transition, allowing the bounds to be changed while the iterator
+// is in use.
+func (l *levelIter) init(
+	opts *db.IterOptions, cmp db.Compare, newIter tableNewIter, files []fileMetadata,
+) {
+	l.opts = opts
 	l.cmp = cmp
 	l.index = -1
 	l.newIter = newIter
 	l.files = files
+	l.prefix = nil
+	l.tableFilter = nil
+	l.readStats = nil
 }
 
 func (l *levelIter) findFileGE(key []byte) int {
@@ -57,8 +99,30 @@ func (l *levelIter) findFileLT(key []byte) int {
 	return index - 1
 }
 
-func (l *levelIter) loadFile(index int) bool {
-	if l.index == index {
+// skipFile returns true if the file at the specified index does not need to
+// be opened because it lies entirely outside of the iterator bounds when
+// moving in the specified direction: beyond the upper bound when moving
+// forward (dir > 0), or before the lower bound when moving backward (dir < 0).
+func (l *levelIter) skipFile(index, dir int) bool {
+	if l.opts == nil {
+		return false
+	}
+	f := &l.files[index]
+	if dir > 0 {
+		upper := l.opts.UpperBound
+		return upper != nil && l.cmp(f.smallest.UserKey, upper) >= 0
+	}
+	lower := l.opts.LowerBound
+	return lower != nil && l.cmp(f.largest.UserKey, lower) < 0
+}
+
+// loadFile positions the iterator at the file at the specified index, opening
+// the file unless it is already open or is skipped due to the iterator bounds.
+// The files rejected by the table filter are passed over in the direction of
+// iteration. It returns true if a file was opened, leaving the file iterator
+// unpositioned.
+func (l *levelIter) loadFile(index, dir int) bool {
+	if l.index == index && l.iter != nil {
 		return true
 	}
 	if l.iter != nil {
@@ -68,34 +132,97 @@ func (l *levelIter) loadFile(index int) bool {
 		}
 		l.iter = nil
 	}
-	l.index = index
-	if l.index < 0 || l.index >= len(l.files) {
-		return false
+	for ; ; index += dir {
+		switch {
+		case index < 0:
+			l.index = -1
+			return false
+		case index >= len(l.files):
+			l.index = len(l.files)
+			return false
+		}
+		l.index = index
+		if l.skipFile(index, dir) {
+			return false
+		}
+		if l.tableFilter == nil {
+			break
+		}
+		var ok bool
+		ok, l.err = l.tableFilter(&l.files[index])
+		if l.err != nil {
+			return false
+		}
+		if ok {
+			break
+		}
 	}
 	l.iter, l.err = l.newIter(&l.files[l.index])
-	return l.err == nil
+	if l.err != nil {
+		return false
+	}
+	if l.readStats != nil {
+		setReadStats(l.iter, l.readStats)
+	}
+	return true
+}
+
+// loadNextFile positions the iterator at the first entry of the next file,
+// returning false if there is no such file or the file is skipped. Following a
+// call to SeekPrefixGE, the next file is skipped if its smallest key does not
+// begin with the prefix, in which case neither do any of its keys. Note that
+// a key which begins with the prefix may still have a different prefix, which
+// merely causes a file to be opened unnecessarily.
+func (l *levelIter) loadNextFile() bool {
+	if l.prefix != nil {
+		if index := l.index + 1; index < len(l.files) &&
+			!bytes.HasPrefix(l.files[index].smallest.UserKey, l.prefix) {
+			l.loadFile(len(l.files), 1)
+			return false
+		}
+	}
+	if !l.loadFile(l.index+1, 1) {
+		return false
+	}
+	if l.prefix != nil {
+		l.iter.SeekPrefixGE(l.prefix, l.files[l.index].smallest.UserKey)
+		return l.iter.Valid()
+	}
+	l.iter.First()
+	return true
 }
 
 func (l *levelIter) SeekGE(key []byte) {
-	if l.loadFile(l.findFileGE(key)) {
+	l.prefix = nil
+	if l.loadFile(l.findFileGE(key), 1) {
 		l.iter.SeekGE(key)
 	}
 }
 
+func (l *levelIter) SeekPrefixGE(prefix, key []byte) {
+	l.prefix = prefix
+	if l.loadFile(l.findFileGE(key), 1) {
+		l.iter.SeekPrefixGE(prefix, key)
+	}
+}
+
 func (l *levelIter) SeekLT(key []byte) {
-	if l.loadFile(l.findFileLT(key)) {
+	l.prefix = nil
+	if l.loadFile(l.findFileLT(key), -1) {
 		l.iter.SeekLT(key)
 	}
 }
 
 func (l *levelIter) First() {
-	if l.loadFile(0) {
+	l.prefix = nil
+	if l.loadFile(0, 1) {
 		l.iter.First()
 	}
 }
 
 func (l *levelIter) Last() {
-	if l.loadFile(len(l.files) - 1) {
+	l.prefix = nil
+	if l.loadFile(len(l.files)-1, -1) {
 		l.iter.Last()
 	}
 }
@@ -105,27 +232,32 @@ func (l *levelIter) Next() bool {
 		return false
 	}
 	if l.iter == nil {
-		if l.index == -1 && l.loadFile(0) {
-			// The iterator was positioned off the beginning of the level. Position
-			// at the first entry.
-			l.iter.First()
-			return true
-		}
-		return false
+		// The iterator is exhausted and positioned at the gap before the next
+		// file: either off the beginning of the level, or at a file which was
+		// skipped while iterating backward. Position at the first entry of the
+		// next file.
+		return l.loadNextFile()
 	}
 	if l.iter.Next() {
 		return true
 	}
 	// Current file was exhausted. Move to the next file.
-	if l.loadFile(l.index + 1) {
-		l.iter.First()
-		return true
-	}
-	return false
+	return l.loadNextFile()
 }
 
 func (l *levelIter) NextUserKey() bool {
-	return l.Next()
+	if l.err != nil {
+		return false
+	}
+	if l.iter == nil {
+		return l.Next()
+	}
+	if l.iter.NextUserKey() {
+		return true
+	}
+	// Current file was exhausted. Move to the next file. The versions of a user
+	// key are never split across the files of a level.
+	return l.loadNextFile()
 }
 
 func (l *levelIter) Prev() bool {
@@ -133,9 +265,11 @@ func (l *levelIter) Prev() bool {
 		return false
 	}
 	if l.iter == nil {
-		if n := len(l.files); l.index == n && l.loadFile(n-1) {
-			// The iterator was positioned off the end of the level. Position at the
-			// last entry.
+		// The iterator is exhausted and positioned at the gap after the previous
+		// file: either off the end of the level, or at a file which was skipped
+		// while iterating forward. Position at the last entry of the previous
+		// file.
+		if l.loadFile(l.index-1, -1) {
 			l.iter.Last()
 			return true
 		}
@@ -145,7 +279,7 @@ func (l *levelIter) Prev() bool {
 		return true
 	}
 	// Current file was exhausted. Move to the previous file.
-	if l.loadFile(l.index - 1) {
+	if l.loadFile(l.index-1, -1) {
 		l.iter.Last()
 		return true
 	}
@@ -153,7 +287,21 @@ func (l *levelIter) Prev() bool {
 }
 
 func (l *levelIter) PrevUserKey() bool {
-	return l.Prev()
+	if l.err != nil {
+		return false
+	}
+	if l.iter == nil {
+		return l.Prev()
+	}
+	if l.iter.PrevUserKey() {
+		return true
+	}
+	// Current file was exhausted. Move to the previous file.
+	if l.loadFile(l.index-1, -1) {
+		l.iter.Last()
+		return true
+	}
+	return false
 }
 
 func (l *levelIter) Key() db.InternalKey {
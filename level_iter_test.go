@@ -7,6 +7,7 @@ package pebble
 import (
 	"fmt"
 	"math/rand"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -54,7 +55,7 @@ func TestLevelIter(t *testing.T) {
 
 		case "iter":
 			iter := &levelIter{}
-			iter.init(db.DefaultComparer.Compare, newIter, files)
+			iter.init(nil, db.DefaultComparer.Compare, newIter, files)
 			defer iter.Close()
 			return runInternalIterCmd(d, iter)
 
@@ -66,6 +67,88 @@ func TestLevelIter(t *testing.T) {
 	})
 }
 
+func TestLevelIterBoundaries(t *testing.T) {
+	var iters []*fakeIter
+	var files []fileMetadata
+	var opened []string
+
+	newIter := func(meta *fileMetadata) (db.InternalIterator, error) {
+		opened = append(opened, fmt.Sprint(meta.fileNum))
+		f := *iters[meta.fileNum]
+		return &f, nil
+	}
+
+	datadriven.RunTest(t, "testdata/level_iter_boundaries", func(d *datadriven.TestData) string {
+		switch d.Cmd {
+		case "define":
+			iters = nil
+			files = nil
+
+			for _, line := range strings.Split(d.Input, "\n") {
+				f := &fakeIter{}
+				for _, key := range strings.Fields(line) {
+					j := strings.Index(key, ":")
+					f.keys = append(f.keys, db.ParseInternalKey(key[:j]))
+					f.vals = append(f.vals, []byte(key[j+1:]))
+				}
+				iters = append(iters, f)
+
+				meta := fileMetadata{
+					fileNum: uint64(len(files)),
+				}
+				meta.smallest = f.keys[0]
+				meta.largest = f.keys[len(f.keys)-1]
+				files = append(files, meta)
+			}
+
+			return ""
+
+		case "iter":
+			opts := &db.IterOptions{}
+			skip := map[uint64]bool{}
+			for _, arg := range d.CmdArgs {
+				if arg.Key == "skip" {
+					// The files rejected by the table filter.
+					for _, v := range arg.Vals {
+						fileNum, err := strconv.ParseUint(v, 10, 64)
+						if err != nil {
+							return err.Error()
+						}
+						skip[fileNum] = true
+					}
+					continue
+				}
+				if len(arg.Vals) != 1 {
+					return fmt.Sprintf("%s: %s=<value>", d.Cmd, arg.Key)
+				}
+				switch arg.Key {
+				case "lower":
+					opts.LowerBound = []byte(arg.Vals[0])
+				case "upper":
+					opts.UpperBound = []byte(arg.Vals[0])
+				default:
+					return fmt.Sprintf("%s: unknown arg: %s", d.Cmd, arg.Key)
+				}
+			}
+
+			opened = nil
+			iter := newLevelIter(opts, db.DefaultComparer.Compare, newIter, files)
+			if len(skip) > 0 {
+				iter.tableFilter = func(meta *fileMetadata) (bool, error) {
+					return !skip[meta.fileNum], nil
+				}
+			}
+			defer iter.Close()
+			return runInternalIterCmd(d, iter) + "opened: " + strings.Join(opened, ",") + "\n"
+
+		default:
+			t.Fatalf("unknown command: %s", d.Cmd)
+		}
+
+		return ""
+	})
+}
+
 func buildLevelIterTables(
 	b *testing.B, blockSize, restartInterval, count int,
 ) ([]*sstable.Reader, []fileMetadata, [][]byte) {
@@ -142,7 +225,7 @@ func BenchmarkLevelIterSeekGE(b *testing.B) {
 								return readers[meta.fileNum].NewIter(nil), nil
 							}
 							l := &levelIter{}
-							l.init(db.DefaultComparer.Compare, newIter, files)
+							l.init(nil, db.DefaultComparer.Compare, newIter, files)
 							rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 
 							b.ResetTimer()
@@ -169,7 +252,7 @@ func BenchmarkLevelIterNext(b *testing.B) {
 								return readers[meta.fileNum].NewIter(nil), nil
 							}
 							l := &levelIter{}
-							l.init(db.DefaultComparer.Compare, newIter, files)
+							l.init(nil, db.DefaultComparer.Compare, newIter, files)
 
 							b.ResetTimer()
 							for i := 0; i < b.N; i++ {
@@ -198,7 +281,7 @@ func BenchmarkLevelIterPrev(b *testing.B) {
 								return readers[meta.fileNum].NewIter(nil), nil
 							}
 							l := &levelIter{}
-							l.init(db.DefaultComparer.Compare, newIter, files)
+							l.init(nil, db.DefaultComparer.Compare, newIter, files)
 
 							b.ResetTimer()
 							for i := 0; i < b.N; i++ {
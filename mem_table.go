@@ -11,8 +11,8 @@ import (
 	"github.com/petermattis/pebble/db"
 )
 
-func memTableEntrySize(keyBytes, valueBytes int) uint32 {
-	return arenaskl.MaxNodeSize(uint32(keyBytes)+8, uint32(valueBytes))
+func memTableEntrySize(keyBytes, valueBytes int) uint64 {
+	return arenaskl.MaxNodeSize(uint64(keyBytes)+8, uint64(valueBytes))
 }
 
 // memTable is a memory-backed implementation of the db.Reader interface.
@@ -26,10 +26,24 @@ func memTableEntrySize(keyBytes, valueBytes int) uint32 {
 type memTable struct {
 	cmp       db.Compare
 	skl       arenaskl.Skiplist
-	emptySize uint32
-	reserved  uint32
+	emptySize uint64
+	reserved  uint64
 	refs      int32
 	flushed   chan struct{}
+
+	// logNum is the number of the oldest WAL which may hold entries of the
+	// memtable. The memtable of a DB is written to a single WAL, created along
+	// with the memtable. The entries of a keyspace's memtable are written to
+	// the WALs of the keyspace's parent DB, and logNum is 0 until the first
+	// entry is added.
+	//
+	// The following field is only used by the memtables of a keyspace. The
+	// sequence numbers of the entries of the memtable are at least baseSeqNum,
+	// and are larger than those of the entries of older memtables.
+	//
+	// Both fields are protected by DB.mu.
+	logNum     uint64
+	baseSeqNum uint64
 }
 
 // newMemTable returns a new MemTable.
@@ -40,7 +54,7 @@ func newMemTable(o *db.Options) *memTable {
 		refs:    1,
 		flushed: make(chan struct{}),
 	}
-	arena := arenaskl.NewArena(uint32(o.MemTableSize), 0)
+	arena := arenaskl.NewArena(uint64(o.MemTableSize), 0)
 	m.skl.Reset(arena, m.cmp)
 	m.emptySize = m.skl.Size()
 	return m
@@ -95,6 +109,16 @@ func (m *memTable) set(key db.InternalKey, value []byte) error {
 // that prepare is not thread-safe, while apply is. The caller must call
 // unref() after the batch has been applied.
 func (m *memTable) prepare(batch *Batch) error {
+	return m.reserve(batch.memTableSize)
+}
+
+// reserve is like prepare, but reserves the specified number of bytes, such
+// as those needed by the entries of a batch which belong to a keyspace.
+func (m *memTable) reserve(size uint64) error {
+	if m.tooLarge(size) {
+		// Switching to a new memtable would not make room for the reservation.
+		return ErrBatchTooLarge
+	}
 	a := m.skl.Arena()
 	if atomic.LoadInt32(&m.refs) == 1 {
 		// If there are no other concurrent apply operations, we can update the
@@ -104,25 +128,55 @@ func (m *memTable) prepare(batch *Batch) error {
 	}
 
 	avail := a.Capacity() - m.reserved
-	if batch.memTableSize > avail {
+	if size > avail {
 		return arenaskl.ErrArenaFull
 	}
-	m.reserved += batch.memTableSize
+	m.reserved += size
 
 	m.ref()
 	return nil
 }
 
+// tooLarge returns true if a reservation of size bytes would not fit in the
+// memtable even if it were empty.
+func (m *memTable) tooLarge(size uint64) bool {
+	return size > m.skl.Arena().Capacity()-m.emptySize
+}
+
 func (m *memTable) apply(batch *Batch, seqNum uint64) error {
+	return m.applyKeyspace(batch, seqNum, "")
+}
+
+// applyKeyspace applies the entries of the batch which belong to the
+// specified keyspace, or to the default keyspace if the name is empty. The
+// entries of other keyspaces are skipped, but consume sequence numbers.
+func (m *memTable) applyKeyspace(batch *Batch, seqNum uint64, keyspace string) error {
 	startSeqNum := seqNum
-	for iter := batch.iter(); ; seqNum++ {
+	skip := keyspace != ""
+	for iter := batch.iter(); ; {
 		kind, ukey, value, ok := iter.next()
 		if !ok {
 			break
 		}
-		if err := m.skl.Add(db.MakeInternalKey(ukey, seqNum, kind), value); err != nil {
-			return err
+		switch kind {
+		case db.InternalKeyKindLogData, db.InternalKeyKindCommitXID, db.InternalKeyKindRollbackXID:
+			// Log data and transaction markers are only written to the WAL and
+			// do not consume a sequence number.
+			continue
+		case db.InternalKeyKindBeginPrepareXID:
+			// The entries of a prepared batch are applied when the transaction
+			// commits. See DB.Prepare.
+			return nil
+		case db.InternalKeyKindKeyspace:
+			skip = string(ukey) != keyspace
+			continue
+		}
+		if !skip {
+			if err := m.skl.Add(db.MakeInternalKey(ukey, seqNum, kind), value); err != nil {
+				return err
+			}
 		}
+		seqNum++
 	}
 	if seqNum != startSeqNum+uint64(batch.count()) {
 		panic("pebble: inconsistent batch count")
@@ -175,10 +229,23 @@ func (t *memTableIter) clearPrevCache() {
 	}
 }
 
+// maxPrevSteps is the number of entries initPrevStart steps backward over
+// while looking for the newest entry for a user key before falling back to
+// seeking to that entry. This bounds the cost of moving to the previous user
+// key when it has many versions, while keeping the common case of a single
+// version to a single step.
+const maxPrevSteps = 64
+
 func (t *memTableIter) initPrevStart(key db.InternalKey) {
 	t.reverse = true
 	t.prevStart = t.iter
-	for {
+	for n := 0; ; n++ {
+		if n == maxPrevSteps {
+			// The user key has many versions. Seeking to the newest version is
+			// cheaper than stepping over the remaining versions.
+			t.prevStart.SeekGE(key.UserKey)
+			break
+		}
 		iter := t.prevStart
 		if !iter.Prev() {
 			break
@@ -211,6 +278,10 @@ func (t *memTableIter) SeekGE(key []byte) {
 	t.iter.SeekGE(key)
 }
 
+func (t *memTableIter) SeekPrefixGE(prefix, key []byte) {
+	t.SeekGE(key)
+}
+
 func (t *memTableIter) SeekLT(key []byte) {
 	t.clearPrevCache()
 	t.iter.SeekLT(key)
@@ -6,6 +6,7 @@ package pebble
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 	"strconv"
 	"strings"
@@ -124,6 +125,14 @@ func TestMemTableEmpty(t *testing.T) {
 	}
 }
 
+func TestMemTableEntrySize(t *testing.T) {
+	// Sizes of 4GB or more must not wrap around.
+	const size = uint64(math.MaxUint32)
+	if n := memTableEntrySize(int(size), int(size)); n < 2*size {
+		t.Fatalf("expected at least %d, but found %d", 2*size, n)
+	}
+}
+
 func TestMemTable1000Entries(t *testing.T) {
 	// Initialize the DB.
 	const N = 1000
@@ -201,6 +210,48 @@ func TestMemTable1000Entries(t *testing.T) {
 	}
 }
 
+func TestMemTableIterPrevManyVersions(t *testing.T) {
+	// The number of versions exceeds maxPrevSteps, exercising the seek to the
+	// newest version of a user key during reverse iteration.
+	const versions = 3 * maxPrevSteps
+	m := newMemTable(nil)
+	for _, key := range []string{"a", "b", "c"} {
+		for j := 0; j < versions; j++ {
+			ikey := db.MakeInternalKey([]byte(key), uint64(j), db.InternalKeyKindSet)
+			if err := m.set(ikey, []byte(fmt.Sprint(j))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var expected []string
+	for _, key := range []string{"c", "b", "a"} {
+		for j := versions - 1; j >= 0; j-- {
+			expected = append(expected, fmt.Sprintf("%s:%d", key, j))
+		}
+	}
+	iter := m.NewIter(nil)
+	var found []string
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		found = append(found, fmt.Sprintf("%s:%s", iter.Key().UserKey, iter.Value()))
+	}
+	if fmt.Sprint(expected) != fmt.Sprint(found) {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, found)
+	}
+
+	found = nil
+	for iter.Last(); iter.Valid(); iter.PrevUserKey() {
+		found = append(found, fmt.Sprintf("%s:%s", iter.Key().UserKey, iter.Value()))
+	}
+	newest := fmt.Sprintf("[c:%d b:%d a:%d]", versions-1, versions-1, versions-1)
+	if s := fmt.Sprint(found); s != newest {
+		t.Fatalf("expected %s, but found %s", newest, s)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestMemTableIter(t *testing.T) {
 	var mem *memTable
 	datadriven.RunTest(t, "testdata/internal_iter_next", func(d *datadriven.TestData) string {
@@ -279,3 +330,50 @@ func BenchmarkMemTableIterPrev(b *testing.B) {
 		iter.Prev()
 	}
 }
+
+func buildMemTableVersions(b *testing.B, versions int) *memTable {
+	m := newMemTable(nil)
+	for i := 0; i < 10000/versions; i++ {
+		key := []byte(fmt.Sprintf("%08d", i))
+		for j := 0; j < versions; j++ {
+			if err := m.set(db.MakeInternalKey(key, uint64(j), db.InternalKeyKindSet), nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return m
+}
+
+func BenchmarkMemTableIterPrevVersions(b *testing.B) {
+	for _, versions := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("versions=%d", versions), func(b *testing.B) {
+			m := buildMemTableVersions(b, versions)
+			iter := m.NewIter(nil)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !iter.Valid() {
+					iter.Last()
+				}
+				iter.Prev()
+			}
+		})
+	}
+}
+
+func BenchmarkMemTableIterPrevUserKey(b *testing.B) {
+	for _, versions := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("versions=%d", versions), func(b *testing.B) {
+			m := buildMemTableVersions(b, versions)
+			iter := m.NewIter(nil)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !iter.Valid() {
+					iter.Last()
+				}
+				iter.PrevUserKey()
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import "sync/atomic"
+
+// MemoryMetrics holds the memory used by a DB and its keyspaces, which is
+// accounted against Options.MemoryBudget. The usage is accounted whether or
+// not a budget is set.
+type MemoryMetrics struct {
+	// Budget is Options.MemoryBudget, or 0 if the memory is not limited.
+	Budget int64
+	// MemTables is the memory used by the entries of the memtables of the DB
+	// and its keyspaces, including the memtables being flushed.
+	MemTables int64
+	// Batches is the size of the batches being committed.
+	Batches int64
+	// CompactionBuffers is the memory used by the buffers of the tables being
+	// written by flushes and compactions.
+	CompactionBuffers int64
+	// Cache is the size of the blocks in the block cache, and CacheCapacity
+	// is its current capacity, which is lowered while the DB is over budget.
+	Cache         int64
+	CacheCapacity int64
+	// EarlyFlushes is the number of memtables flushed before they were full
+	// because the DB was over budget.
+	EarlyFlushes int64
+	// CacheShrinks is the number of times the block cache was shrunk because
+	// the DB was over budget.
+	CacheShrinks int64
+}
+
+// Usage returns the total memory used by the DB.
+func (m *MemoryMetrics) Usage() int64 {
+	return m.MemTables + m.Batches + m.CompactionBuffers + m.Cache
+}
+
+// memoryUsage returns the memory used by the memtables and by the buffers of
+// the flushes and compactions of the DB and its keyspaces, and the size of the
+// batches being committed.
+//
+// d.mu must be held when calling this.
+func (d *DB) memoryUsage() MemoryMetrics {
+	m := MemoryMetrics{
+		Budget:  d.opts.MemoryBudget,
+		Batches: atomic.LoadInt64(&d.memoryBatches),
+	}
+	d.localMemoryUsage(&m)
+	for _, k := range d.mu.keyspaces {
+		k.d.mu.Lock()
+		k.d.localMemoryUsage(&m)
+		k.d.mu.Unlock()
+	}
+	return m
+}
+
+// localMemoryUsage adds the memory used by the memtables and the flushes and
+// compactions of the DB, excluding its keyspaces, to m.
+//
+// d.mu must be held when calling this.
+func (d *DB) localMemoryUsage(m *MemoryMetrics) {
+	for _, mem := range d.mu.mem.queue {
+		m.MemTables += int64(mem.ApproximateMemoryUsage())
+	}
+	for _, j := range d.mu.compact.jobs {
+		m.CompactionBuffers += int64(atomic.LoadUint64(&j.buffered))
+	}
+}
+
+// maybeEnforceMemoryBudget brings the memory used by the DB back under
+// Options.MemoryBudget. It is called by commits, and checks the usage each
+// time a sixty-fourth of the budget has been committed since the last check.
+//
+// The block cache, which may be shrunk without losing data, is given the part
+// of the budget left unused by the memtables, batches and compaction buffers,
+// but no less than a quarter of the budget, and no more than its original
+// capacity. When the rest exceeds three quarters of the budget, the largest
+// mutable memtable of the DB and its keyspaces is flushed early, unless the
+// flush of one of its memtables is already pending. The memory of a memtable
+// is only released once its flush completes. A keyspace whose Options.Cache
+// differs from that of the DB does not have its cache shrunk.
+//
+// A memtable of a keyspace is switched out at the sequence number of b, whose
+// entries are yet to be added to the memtables, and the returned bool is true
+// if it was.
+//
+// d.mu must be held when calling this.
+func (d *DB) maybeEnforceMemoryBudget(b *Batch) (keyspaceSwitched bool, err error) {
+	budget := d.opts.MemoryBudget
+	if budget <= 0 {
+		return false, nil
+	}
+	d.mu.memory.sinceCheck += int64(len(b.data))
+	if d.mu.memory.sinceCheck < budget/64 {
+		return false, nil
+	}
+	d.mu.memory.sinceCheck = 0
+
+	m := d.memoryUsage()
+	rest := m.MemTables + m.Batches + m.CompactionBuffers
+	if c := d.opts.Cache; c != nil {
+		target := budget - rest
+		if min := budget / 4; target < min {
+			target = min
+		}
+		if target > d.mu.memory.cacheCapacity {
+			target = d.mu.memory.cacheCapacity
+		}
+		if capacity := c.Capacity(); target != capacity {
+			if target < capacity {
+				d.mu.metrics.Memory.CacheShrinks++
+			}
+			c.SetCapacity(target)
+		}
+	}
+	if rest <= budget-budget/4 {
+		return false, nil
+	}
+
+	// Find the largest mutable memtable which has not been flushed.
+	target, size := d, d.mu.mem.mutable.ApproximateMemoryUsage()
+	if d.mu.mem.mutable.Empty() || len(d.mu.mem.queue) > 1 {
+		target, size = nil, 0
+	}
+	for _, k := range d.mu.keyspaces {
+		kd := k.d
+		kd.mu.Lock()
+		if n := kd.mu.mem.mutable.ApproximateMemoryUsage(); n > size &&
+			!kd.mu.mem.mutable.Empty() && len(kd.mu.mem.queue) == 1 {
+			target, size = kd, n
+		}
+		kd.mu.Unlock()
+	}
+	switch {
+	case target == nil:
+		return false, nil
+	case target == d:
+		d.mu.metrics.Memory.EarlyFlushes++
+		return false, d.makeRoomForWrite(nil)
+	default:
+		d.mu.metrics.Memory.EarlyFlushes++
+		target.mu.Lock()
+		_, _, err = target.makeRoomForKeyspaceWrite(0, b.seqNum(), true)
+		target.mu.Unlock()
+		return err == nil, err
+	}
+}
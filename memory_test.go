@@ -0,0 +1,80 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/cache"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	const budget = 1 << 20
+	for _, keyspace := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keyspace=%t", keyspace), func(t *testing.T) {
+			c := cache.New(budget / 2)
+			d, err := Open("", &db.Options{
+				Cache:        c,
+				Logger:       discardLogger{},
+				MemoryBudget: budget,
+				MemTableSize: 4 << 20,
+				Storage:      storage.NewMem(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var w Writer = d
+			if keyspace {
+				w = openKeyspace(t, d, "ks")
+			}
+
+			// Fill the memtable until it uses more than three quarters of the
+			// budget, which shrinks the cache and flushes the memtable although it
+			// is far from full.
+			value := make([]byte, 1000)
+			for i := 0; i < 1000; i++ {
+				if err := w.Set([]byte(fmt.Sprintf("%04d", i)), value, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			m := d.Metrics()
+			if m.Memory.Budget != budget {
+				t.Fatalf("expected budget %d, but found %d", budget, m.Memory.Budget)
+			}
+			if m.Memory.EarlyFlushes == 0 {
+				t.Fatalf("expected an early flush, but found %+v", m.Memory)
+			}
+			if m.Memory.CacheShrinks == 0 {
+				t.Fatalf("expected the cache to be shrunk, but found %+v", m.Memory)
+			}
+			if m.Memory.MemTables <= 0 {
+				t.Fatalf("expected the memtables to be accounted, but found %+v", m.Memory)
+			}
+
+			// Once the early flush completes and the memtables shrink, the cache
+			// is grown back.
+			deadline := time.Now().Add(10 * time.Second)
+			for i := 1000; c.Capacity() < budget/2; i++ {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected the cache to grow back, but found %+v", d.Metrics().Memory)
+				}
+				if err := w.Set([]byte(fmt.Sprintf("%04d", i%1000)), nil, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if n := c.Capacity(); n != budget/2 {
+				t.Fatalf("expected the cache capacity to be restored, but found %d", n)
+			}
+		})
+	}
+}
@@ -20,6 +20,12 @@ type mergingIterHeap struct {
 	cmp     db.Compare
 	reverse bool
 	items   []mergingIterItem
+	// The index of the smaller of the root's children, or 0 if it is not
+	// known. Caching the index allows fixTop to determine that the root is
+	// still the smallest item with a single key comparison, which is the common
+	// case when iterating over a run of keys from the same input. The cache is
+	// invalidated whenever the children of the root might change.
+	minChild int
 }
 
 func (h *mergingIterHeap) len() int {
@@ -41,8 +47,9 @@ func (h *mergingIterHeap) swap(i, j int) {
 	h.items[i], h.items[j] = h.items[j], h.items[i]
 }
 
-// init, up and down are copied from the go stdlib.
+// init and down are copied from the go stdlib.
 func (h *mergingIterHeap) init() {
+	h.minChild = 0
 	// heapify
 	n := h.len()
 	for i := n/2 - 1; i >= 0; i-- {
@@ -50,13 +57,31 @@ func (h *mergingIterHeap) init() {
 	}
 }
 
-func (h *mergingIterHeap) fix(i int) {
-	if !h.down(i, h.len()) {
-		h.up(i)
+// fixTop re-establishes the heap ordering after the key of the root item has
+// been advanced.
+func (h *mergingIterHeap) fixTop() {
+	n := h.len()
+	if n <= 1 {
+		return
+	}
+	j := h.minChild
+	if j == 0 {
+		j = 1
+		if n > 2 && h.less(2, 1) {
+			j = 2
+		}
+		h.minChild = j
 	}
+	if !h.less(j, 0) {
+		return
+	}
+	h.minChild = 0
+	h.swap(0, j)
+	h.down(j, n)
 }
 
 func (h *mergingIterHeap) pop() *mergingIterItem {
+	h.minChild = 0
 	n := h.len() - 1
 	h.swap(0, n)
 	h.down(0, n)
@@ -65,17 +90,6 @@ func (h *mergingIterHeap) pop() *mergingIterItem {
 	return item
 }
 
-func (h *mergingIterHeap) up(j int) {
-	for {
-		i := (j - 1) / 2 // parent
-		if i == j || !h.less(j, i) {
-			break
-		}
-		h.swap(i, j)
-		j = i
-	}
-}
-
 func (h *mergingIterHeap) down(i0, n int) bool {
 	i := i0
 	for {
@@ -97,10 +111,11 @@ func (h *mergingIterHeap) down(i0, n int) bool {
 }
 
 type mergingIter struct {
-	dir   int
-	iters []db.InternalIterator
-	heap  mergingIterHeap
-	err   error
+	dir    int
+	iters  []db.InternalIterator
+	heap   mergingIterHeap
+	err    error
+	keyBuf []byte
 }
 
 // mergingIter implements the db.InternalIterator interface.
@@ -242,6 +257,13 @@ func (m *mergingIter) SeekGE(key []byte) {
 	m.initMinHeap()
 }
 
+func (m *mergingIter) SeekPrefixGE(prefix, key []byte) {
+	for _, t := range m.iters {
+		t.SeekPrefixGE(prefix, key)
+	}
+	m.initMinHeap()
+}
+
 func (m *mergingIter) SeekLT(key []byte) {
 	for _, t := range m.iters {
 		t.SeekLT(key)
@@ -280,7 +302,7 @@ func (m *mergingIter) Next() bool {
 	item := &m.heap.items[0]
 	if item.iter.Next() {
 		item.key = item.iter.Key()
-		m.heap.fix(0)
+		m.heap.fixTop()
 		return true
 	}
 
@@ -331,36 +353,7 @@ func (m *mergingIter) NextUserKey() bool {
 		return m.heap.len() > 0
 	}
 
-	if m.heap.len() == 0 {
-		return false
-	}
-
-	key := m.heap.items[0].key
-	cur := m.heap.items[0].iter
-
-	var reheap bool
-	for _, i := range m.iters {
-		if i == cur {
-			continue
-		}
-		if i.Valid() && m.heap.cmp(key.UserKey, i.Key().UserKey) == 0 {
-			i.NextUserKey()
-			reheap = true
-		}
-	}
-
-	// Special handling for the current iterator because we were using its key
-	// above.
-	if reheap {
-		cur.NextUserKey()
-		m.initMinHeap()
-	} else if cur.NextUserKey() {
-		m.heap.items[0].key = cur.Key()
-		m.heap.fix(0)
-	} else {
-		m.heap.pop()
-	}
-	return m.heap.len() > 0
+	return m.skipUserKey((db.InternalIterator).NextUserKey)
 }
 
 func (m *mergingIter) Prev() bool {
@@ -380,7 +373,7 @@ func (m *mergingIter) Prev() bool {
 	item := &m.heap.items[0]
 	if item.iter.Prev() {
 		item.key = item.iter.Key()
-		m.heap.fix(0)
+		m.heap.fixTop()
 		return true
 	}
 
@@ -441,36 +434,40 @@ func (m *mergingIter) PrevUserKey() bool {
 		return m.heap.len() > 0
 	}
 
+	return m.skipUserKey((db.InternalIterator).PrevUserKey)
+}
+
+// skipUserKey advances the iterators positioned at the current user key using
+// the specified step function, which is either NextUserKey or PrevUserKey
+// depending on the direction of iteration. The iterators positioned at the
+// current user key are all at the top of the heap, so only those iterators
+// are stepped and the remaining iterators are left untouched.
+func (m *mergingIter) skipUserKey(step func(db.InternalIterator) bool) bool {
 	if m.heap.len() == 0 {
 		return false
 	}
 
-	key := m.heap.items[0].key
-	cur := m.heap.items[0].iter
-
-	var reheap bool
-	for _, i := range m.iters {
-		if i == cur {
-			continue
+	// Stepping the iterator at the top of the heap may invalidate the memory
+	// backing its key, so the current user key is copied.
+	m.keyBuf = append(m.keyBuf[:0], m.heap.items[0].key.UserKey...)
+	for {
+		item := &m.heap.items[0]
+		if step(item.iter) {
+			item.key = item.iter.Key()
+			m.heap.fixTop()
+		} else {
+			if m.err = item.iter.Error(); m.err != nil {
+				return false
+			}
+			m.heap.pop()
+			if m.heap.len() == 0 {
+				return false
+			}
 		}
-		if i.Valid() && m.heap.cmp(key.UserKey, i.Key().UserKey) == 0 {
-			i.PrevUserKey()
-			reheap = true
+		if m.heap.cmp(m.keyBuf, m.heap.items[0].key.UserKey) != 0 {
+			return true
 		}
 	}
-
-	// Special handling for the current iterator because we were using its key
-	// above.
-	if reheap {
-		cur.PrevUserKey()
-		m.initMaxHeap()
-	} else if cur.PrevUserKey() {
-		m.heap.items[0].key = cur.Key()
-		m.heap.fix(0)
-	} else {
-		m.heap.pop()
-	}
-	return m.heap.len() > 0
 }
 
 func (m *mergingIter) Key() db.InternalKey {
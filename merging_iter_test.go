@@ -128,6 +128,64 @@ func TestMergingIterNextPrev(t *testing.T) {
 	}
 }
 
+func TestMergingIterUserKey(t *testing.T) {
+	// Distribute several versions of each user key across many iterators and
+	// verify that NextUserKey and PrevUserKey visit each user key exactly once,
+	// at its newest version.
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	const numKeys = 100
+	iters := make([]*fakeIter, 20)
+	for i := range iters {
+		iters[i] = &fakeIter{}
+	}
+	for k := 0; k < numKeys; k++ {
+		key := []byte(fmt.Sprintf("%03d", k))
+		for seqNum := uint64(1 + rng.Intn(4)); seqNum > 0; seqNum-- {
+			f := iters[rng.Intn(len(iters))]
+			f.keys = append(f.keys, db.MakeInternalKey(key, seqNum, db.InternalKeyKindSet))
+			f.vals = append(f.vals, nil)
+		}
+	}
+	// Each fakeIter must be sorted in internal key order, which the above
+	// construction guarantees as keys and decreasing sequence numbers are
+	// appended in order.
+	inputs := make([]db.InternalIterator, len(iters))
+	for i := range iters {
+		inputs[i] = iters[i]
+	}
+	m := newMergingIter(db.DefaultComparer.Compare, inputs...)
+	defer m.Close()
+
+	check := func(k int) {
+		t.Helper()
+		if !m.Valid() {
+			t.Fatalf("%d: expected a valid iterator", k)
+		}
+		key := m.Key()
+		if expected := fmt.Sprintf("%03d", k); string(key.UserKey) != expected {
+			t.Fatalf("expected %s, but found %s", expected, key.UserKey)
+		}
+	}
+
+	m.First()
+	for k := 0; k < numKeys; k++ {
+		check(k)
+		m.NextUserKey()
+	}
+	if m.Valid() {
+		t.Fatalf("expected an exhausted iterator, but found %s", m.Key())
+	}
+
+	m.Last()
+	for k := numKeys - 1; k >= 0; k-- {
+		check(k)
+		m.PrevUserKey()
+	}
+	if m.Valid() {
+		t.Fatalf("expected an exhausted iterator, but found %s", m.Key())
+	}
+}
+
 func buildMergingIterTables(
 	b *testing.B, blockSize, restartInterval, count int,
 ) ([]*sstable.Reader, [][]byte) {
@@ -197,7 +255,7 @@ func BenchmarkMergingIterSeekGE(b *testing.B) {
 	for _, restartInterval := range []int{16} {
 		b.Run(fmt.Sprintf("restart=%d", restartInterval),
 			func(b *testing.B) {
-				for _, count := range []int{1, 2, 3, 4, 5} {
+				for _, count := range []int{1, 2, 3, 4, 5, 10, 20} {
 					b.Run(fmt.Sprintf("count=%d", count),
 						func(b *testing.B) {
 							readers, keys := buildMergingIterTables(b, blockSize, restartInterval, count)
@@ -224,7 +282,7 @@ func BenchmarkMergingIterNext(b *testing.B) {
 	for _, restartInterval := range []int{16} {
 		b.Run(fmt.Sprintf("restart=%d", restartInterval),
 			func(b *testing.B) {
-				for _, count := range []int{1, 2, 3, 4, 5} {
+				for _, count := range []int{1, 2, 3, 4, 5, 10, 20} {
 					b.Run(fmt.Sprintf("count=%d", count),
 						func(b *testing.B) {
 							readers, _ := buildMergingIterTables(b, blockSize, restartInterval, count)
@@ -247,13 +305,42 @@ func BenchmarkMergingIterNext(b *testing.B) {
 	}
 }
 
+func BenchmarkMergingIterNextUserKey(b *testing.B) {
+	const blockSize = 32 << 10
+
+	for _, restartInterval := range []int{16} {
+		b.Run(fmt.Sprintf("restart=%d", restartInterval),
+			func(b *testing.B) {
+				for _, count := range []int{1, 2, 3, 4, 5, 10, 20} {
+					b.Run(fmt.Sprintf("count=%d", count),
+						func(b *testing.B) {
+							readers, _ := buildMergingIterTables(b, blockSize, restartInterval, count)
+							iters := make([]db.InternalIterator, len(readers))
+							for i := range readers {
+								iters[i] = readers[i].NewIter(nil)
+							}
+							m := newMergingIter(db.DefaultComparer.Compare, iters...)
+
+							b.ResetTimer()
+							for i := 0; i < b.N; i++ {
+								if !m.Valid() {
+									m.First()
+								}
+								m.NextUserKey()
+							}
+						})
+				}
+			})
+	}
+}
+
 func BenchmarkMergingIterPrev(b *testing.B) {
 	const blockSize = 32 << 10
 
 	for _, restartInterval := range []int{16} {
 		b.Run(fmt.Sprintf("restart=%d", restartInterval),
 			func(b *testing.B) {
-				for _, count := range []int{1, 2, 3, 4, 5} {
+				for _, count := range []int{1, 2, 3, 4, 5, 10, 20} {
 					b.Run(fmt.Sprintf("count=%d", count),
 						func(b *testing.B) {
 							readers, _ := buildMergingIterTables(b, blockSize, restartInterval, count)
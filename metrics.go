@@ -0,0 +1,259 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/petermattis/pebble/cache"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/histogram"
+	"github.com/petermattis/pebble/sstable"
+)
+
+// Metrics holds metrics for various subsystems of the DB such as the
+// background flushes and compactions.
+type Metrics struct {
+	Flush struct {
+		// The total number of flushes.
+		Count int64
+	}
+	Compact struct {
+		// The total number of compactions, including trivial moves.
+		Count int64
+	}
+	// DeletePrefix holds statistics about the prefix deletions performed by
+	// DB.DeletePrefix.
+	DeletePrefix struct {
+		// The total number of prefix deletions.
+		Count int64
+		// The number of tables lying entirely within a deleted prefix, which were
+		// dropped without being read.
+		TablesDropped int64
+		// The number of virtual tables replacing the tables which straddled the
+		// boundary of a deleted prefix, which were marked for compaction.
+		TablesMarked int64
+	}
+	// Disk holds the latency statistics for the writes and syncs of the files
+	// written by the DB. They are only gathered if Options.DiskSlowThreshold is
+	// set.
+	Disk struct {
+		// The maximum latency of a single write since the DB was opened.
+		MaxWriteLatency time.Duration
+		// The maximum latency of a single sync since the DB was opened.
+		MaxSyncLatency time.Duration
+		// The number of writes and syncs which took longer than
+		// Options.DiskSlowThreshold.
+		SlowCount int64
+	}
+	// Levels holds the options used when writing the sstables of each level:
+	// flushes write level 0 and compactions write their output level. These
+	// are the configured per-level options with defaults applied, the options
+	// of the last configured level extended to the subsequent levels, and
+	// table features not permitted by the current format major version
+	// disabled.
+	Levels [numLevels]db.LevelOptions
+	// Garbage holds the estimated size of the dead data in each level, which
+	// a full compaction would reclaim. Estimating the garbage requires opening
+	// every table in the LSM, and the estimates are recomputed only when the
+	// set of tables changes. See TableGarbage.
+	Garbage [numLevels]TableGarbage
+	// Tables holds the number and total size of the tables in each level.
+	Tables [numLevels]struct {
+		Count int64
+		Size  uint64
+	}
+	// ReadAmp is the read amplification of the LSM: the number of tables in
+	// level 0 plus the number of non-empty levels below it, which is the
+	// maximum number of tables a point lookup may need to read.
+	ReadAmp int
+	// Read holds the number of bytes read from the tables of each level by
+	// each kind of read.
+	Read ReadMetrics
+	// Filter holds the outcome of the table filter checks performed by point
+	// lookups, which use the filters to avoid reading data blocks.
+	Filter sstable.FilterMetrics
+	// Cache holds the statistics of the block cache, which may be shared with
+	// other DBs. The statistics are empty if the DB has no cache.
+	Cache cache.Metrics
+	// CompressedCache holds the statistics of the compressed block cache. The
+	// statistics are empty if Options.CompressedCache is not set.
+	CompressedCache cache.Metrics
+	// WAL holds the statistics of the syncs of the WAL performed by commits.
+	WAL struct {
+		// The number of syncs.
+		Syncs int64
+		// The total latency of the syncs.
+		SyncDuration time.Duration
+		// The maximum latency of a single sync.
+		MaxSyncLatency time.Duration
+		// The distribution of the latencies of the syncs of the WAL files
+		// themselves. Unlike SyncDuration, it excludes the time spent writing
+		// out the data buffered by the WAL before a sync.
+		FsyncLatency histogram.Snapshot
+		// The number of live WAL files: the current WAL, and the older WALs
+		// holding batches whose memtables are not yet flushed. A growing count
+		// indicates that flushes are falling behind, and that recovery will
+		// replay more data.
+		Files int64
+		// The size of the current WAL, including the records buffered but not
+		// yet written to the file.
+		Size uint64
+		// The total size of the live WAL files, including the current WAL.
+		LiveSize uint64
+		// The number and total size of the obsolete WAL files which are
+		// pending deletion.
+		ObsoleteFiles int64
+		ObsoleteSize  uint64
+		// The total size of the batches replayed from the WALs when the DB was
+		// opened, and when a secondary DB caught up with its primary.
+		ReplayedBytes uint64
+	}
+	// Commit holds the distribution of the latencies of the stages of the
+	// commits of batches, allowing a regression in the tail latency of commits
+	// to be attributed to a stage.
+	Commit CommitMetrics
+	// Memory holds the memory used by the DB, and the actions taken to keep it
+	// within Options.MemoryBudget.
+	Memory MemoryMetrics
+	// Corruption holds the statistics of the corrupted blocks found by the
+	// reads of the tables, and of the rewrites of the tables holding them.
+	Corruption CorruptionMetrics
+	// Stall holds the statistics of the writes delayed because flushes and
+	// compactions are falling behind: a write is slowed down while level 0 has
+	// more than Options.L0SlowdownWritesThreshold tables, and stopped while
+	// there are too many memtables or level 0 tables.
+	Stall struct {
+		// The number of times a write was slowed down or stopped.
+		Count int64
+		// The total time writes spent slowed down or stopped.
+		Duration time.Duration
+	}
+	// The total number of errors encountered by background flushes and
+	// compactions.
+	BackgroundErrors int64
+	// The number of consecutive errors encountered by background flushes, or
+	// by background compactions, whichever is larger. The errors of flushes
+	// and compactions are counted separately, so a successful compaction does
+	// not reset a run of failing flushes. A non-zero value indicates a
+	// persistent problem, such as a full disk.
+	ConsecutiveBackgroundErrors int64
+	// The most recent background error, or nil if no background error has
+	// occurred.
+	LastBackgroundError error
+}
+
+// CommitMetrics holds the distribution of the latencies of the stages a batch
+// passes through when committed by DB.Apply. The latency of syncing the WAL is
+// included in Publish for batches which requested a sync; the syncs
+// themselves are measured by Metrics.WAL.
+type CommitMetrics struct {
+	// Wait is the time a commit waits before its batch is written to the WAL:
+	// for a slot in the sync queue if the batch requested a sync, for the
+	// commit rate limiter and for the commits ahead of it.
+	Wait histogram.Snapshot
+	// WALAppend is the time spent writing the batch to the WAL, which copies
+	// it into the buffers of the WAL. It includes the time spent throttling
+	// the write and switching out a full memtable.
+	WALAppend histogram.Snapshot
+	// Apply is the time spent applying the batch to the memtable.
+	Apply histogram.Snapshot
+	// Publish is the time spent waiting for the batch to become visible after
+	// being applied, which waits for the batches ahead of it to be applied
+	// and, if requested, for the WAL to be synced.
+	Publish histogram.Snapshot
+}
+
+// ReadMetrics holds the number of bytes of the data and filter blocks read
+// from the tables of each level, by point lookups performed by DB.Get, by
+// iterators, and by compactions. The bytes found in the block cache, found in
+// the compressed block cache and read from the table files are counted
+// separately: a level from which lookups read many bytes from the files may
+// benefit from a filter or a larger cache. The blocks read when a table is
+// opened are not counted.
+type ReadMetrics struct {
+	Get        [numLevels]sstable.ReadStats
+	Iter       [numLevels]sstable.ReadStats
+	Compaction [numLevels]sstable.ReadStats
+}
+
+func (m *ReadMetrics) load(src *ReadMetrics) {
+	for _, x := range []struct {
+		dst, src *[numLevels]sstable.ReadStats
+	}{
+		{&m.Get, &src.Get},
+		{&m.Iter, &src.Iter},
+		{&m.Compaction, &src.Compaction},
+	} {
+		for level := range x.src {
+			x.dst[level].CacheBytes = atomic.LoadInt64(&x.src[level].CacheBytes)
+			x.dst[level].CompressedCacheBytes = atomic.LoadInt64(&x.src[level].CompressedCacheBytes)
+			x.dst[level].FileBytes = atomic.LoadInt64(&x.src[level].FileBytes)
+		}
+	}
+}
+
+// Metrics returns metrics about the database.
+func (d *DB) Metrics() *Metrics {
+	metrics := &Metrics{}
+	d.mu.Lock()
+	*metrics = d.mu.metrics
+	current := d.mu.versions.currentVersion()
+	for level := range current.files {
+		metrics.Tables[level].Count = int64(len(current.files[level]))
+		metrics.Tables[level].Size = totalSize(current.files[level])
+	}
+	memory := d.memoryUsage()
+	memory.EarlyFlushes = metrics.Memory.EarlyFlushes
+	memory.CacheShrinks = metrics.Memory.CacheShrinks
+	metrics.Memory = memory
+	for _, f := range d.mu.log.retired {
+		metrics.WAL.Files++
+		metrics.WAL.LiveSize += f.size
+	}
+	if d.mu.log.LogWriter != nil {
+		metrics.WAL.Files++
+		metrics.WAL.Size = uint64(d.mu.log.Size())
+		metrics.WAL.LiveSize += metrics.WAL.Size
+	}
+	metrics.WAL.ReplayedBytes = d.mu.log.replayedBytes
+	metrics.ReadAmp = len(current.files[0])
+	for level := 1; level < numLevels; level++ {
+		if len(current.files[level]) > 0 {
+			metrics.ReadAmp++
+		}
+	}
+	d.mu.Unlock()
+	metrics.Cache = d.opts.Cache.Metrics()
+	metrics.CompressedCache = d.opts.CompressedCache.Metrics()
+	metrics.Memory.Cache = metrics.Cache.Size
+	metrics.Memory.CacheCapacity = d.opts.Cache.Capacity()
+	metrics.Read.load(&d.readStats)
+	metrics.Corruption = d.corruptionMetrics()
+	metrics.WAL.FsyncLatency = d.walSyncLatency.Snapshot()
+	if d.deleter != nil {
+		metrics.WAL.ObsoleteFiles, metrics.WAL.ObsoleteSize = d.deleter.obsoleteLogs()
+	}
+	metrics.Commit.Wait = d.commit.latency.wait.Snapshot()
+	metrics.Commit.WALAppend = d.commit.latency.walAppend.Snapshot()
+	metrics.Commit.Apply = d.commit.latency.apply.Snapshot()
+	metrics.Commit.Publish = d.commit.latency.publish.Snapshot()
+	metrics.Filter.Hits = atomic.LoadInt64(&d.tableCache.filterMetrics.Hits)
+	metrics.Filter.Misses = atomic.LoadInt64(&d.tableCache.filterMetrics.Misses)
+	metrics.Filter.FalsePositives = atomic.LoadInt64(&d.tableCache.filterMetrics.FalsePositives)
+	vers := d.FormatMajorVersion()
+	for level := range metrics.Levels {
+		metrics.Levels[level] = tableLevelOptions(d.opts, level, vers)
+	}
+	metrics.Garbage = d.levelGarbage()
+	if d.diskHealth != nil {
+		stats := d.diskHealth.Stats()
+		metrics.Disk.MaxWriteLatency = stats.MaxWriteLatency
+		metrics.Disk.MaxSyncLatency = stats.MaxSyncLatency
+		metrics.Disk.SlowCount = stats.SlowOps
+	}
+	return metrics
+}
@@ -6,11 +6,14 @@ package pebble
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
+	"time"
 
 	"github.com/petermattis/pebble/arenaskl"
 	"github.com/petermattis/pebble/db"
@@ -25,6 +28,19 @@ func createDB(dirname string, opts *db.Options) (retErr error) {
 		comparatorName: opts.Comparer.Name,
 		nextFileNumber: manifestFileNum + 1,
 	}
+	if opts.FormatMajorVersion > db.FormatMostCompatible {
+		ve.formatMajorVersion = uint64(opts.FormatMajorVersion)
+	}
+	if opts.FormatMajorVersion >= db.FormatDBID {
+		id, err := newDBID()
+		if err != nil {
+			return err
+		}
+		ve.dbID = id
+	}
+	if opts.FormatMajorVersion >= db.FormatMergerName {
+		ve.mergerName = opts.Merger.Name()
+	}
 	manifestFilename := dbFilename(dirname, fileTypeManifest, manifestFileNum)
 	f, err := opts.Storage.Create(manifestFilename)
 	if err != nil {
@@ -50,21 +66,60 @@ func createDB(dirname string, opts *db.Options) (retErr error) {
 	if err != nil {
 		return err
 	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
 	return setCurrentFile(dirname, opts.Storage, manifestFileNum)
 }
 
 // Open opens a LevelDB whose files live in the given directory.
 func Open(dirname string, opts *db.Options) (*DB, error) {
+	return open(dirname, opts, nil, "")
+}
+
+// open opens the DB in the given directory. If parent is non-nil, the DB
+// stores the entries of the named keyspace of parent, and has no WAL of its
+// own.
+func open(dirname string, opts *db.Options, parent *DB, keyspaceName string) (_ *DB, retErr error) {
 	const defaultRateLimit = rate.Limit(50 << 20) // 50 MB/sec
 	const defaultBurst = 1 << 20                  // 1 MB
 
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
 	opts = opts.EnsureDefaults()
+	opts.EnsureLevelDefaults()
+	if len(opts.Levels) > numLevels {
+		return nil, fmt.Errorf("pebble: options specified for %d levels, but only %d levels exist",
+			len(opts.Levels), numLevels)
+	}
+	if opts.FormatMajorVersion > db.FormatNewest {
+		return nil, fmt.Errorf("pebble: FormatMajorVersion (%d) must be <= %d",
+			opts.FormatMajorVersion, db.FormatNewest)
+	}
+	var diskHealth *storage.DiskHealthChecker
+	if opts.DiskSlowThreshold > 0 {
+		// Wrap a copy of the options, leaving the caller's Storage unchanged.
+		o := *opts
+		diskHealth = storage.NewDiskHealthChecker(opts.Storage, opts.DiskSlowThreshold,
+			func(name, op string, duration time.Duration) {
+				o.Logger.Infof("disk slowness detected: %s of %s has taken %s", op, name, duration)
+				if fn := o.EventListener.DiskSlow; fn != nil {
+					fn(db.DiskSlowInfo{Path: name, Op: op, Duration: duration})
+				}
+			})
+		o.Storage = diskHealth
+		opts = &o
+	}
 	d := &DB{
 		dirname:           dirname,
 		opts:              opts,
 		cmp:               opts.Comparer.Compare,
-		merge:             opts.Merger.Merge,
+		merge:             opts.Merger,
 		inlineKey:         opts.Comparer.InlineKey,
+		diskHealth:        diskHealth,
+		parent:            parent,
+		keyspaceName:      keyspaceName,
 		commitController:  newController(rate.NewLimiter(defaultRateLimit, defaultBurst)),
 		compactController: newController(rate.NewLimiter(defaultRateLimit, defaultBurst)),
 		flushController:   newController(rate.NewLimiter(rate.Inf, defaultBurst)),
@@ -74,6 +129,7 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		tableCacheSize = minTableCacheSize
 	}
 	d.tableCache.init(dirname, opts.Storage, d.opts, tableCacheSize)
+	d.tableCache.corruptionReporter = d.reportTableCorruption
 	d.newIter = d.tableCache.newIter
 	d.commit = newCommitPipeline(commitEnv{
 		mu:            &d.mu.Mutex,
@@ -89,21 +145,47 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	d.mu.mem.queue = append(d.mu.mem.queue, d.mu.mem.mutable)
 	d.mu.compact.cond.L = &d.mu.Mutex
 	d.mu.compact.pendingOutputs = make(map[uint64]struct{})
+	d.mu.memory.cacheCapacity = d.opts.Cache.Capacity()
+	d.mu.snapshots.init()
+	d.mu.prepared = make(map[string][]byte)
 	// TODO(peter): This initialization is funky.
 	d.mu.versions.versions.mu = &d.mu.Mutex
 
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	defer func() {
+		if retErr != nil {
+			for _, k := range d.mu.keyspaces {
+				k.d.Close()
+			}
+		}
+	}()
 
-	// Lock the database directory.
 	fs := opts.Storage
-	err := fs.MkdirAll(dirname, 0755)
-	if err != nil {
-		return nil, err
+	currentFilename := dbFilename(dirname, fileTypeCurrent, 0)
+	mustExist := opts.ReadOnly || opts.ErrorIfNotExists
+	if mustExist {
+		// Check for the DB before creating the directory and the lock file, so
+		// that nothing is written to a directory which does not hold a DB.
+		if _, err := fs.Stat(currentFilename); os.IsNotExist(err) {
+			return nil, fmt.Errorf("pebble: database %q does not exist", dirname)
+		} else if err != nil {
+			return nil, fmt.Errorf("pebble: database %q: %v", dirname, err)
+		}
 	}
-	fileLock, err := fs.Lock(dbFilename(dirname, fileTypeLock, 0))
-	if err != nil {
-		return nil, err
+
+	// Lock the database directory. A read-only DB does not take the lock,
+	// allowing a DB that is in use by another process to be inspected.
+	var fileLock io.Closer
+	if !opts.ReadOnly {
+		err := fs.MkdirAll(dirname, 0755)
+		if err != nil {
+			return nil, err
+		}
+		fileLock, err = fs.Lock(dbFilename(dirname, fileTypeLock, 0))
+		if err != nil {
+			return nil, err
+		}
 	}
 	defer func() {
 		if fileLock != nil {
@@ -111,7 +193,9 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		}
 	}()
 
-	if _, err := fs.Stat(dbFilename(dirname, fileTypeCurrent, 0)); os.IsNotExist(err) {
+	if _, err := fs.Stat(currentFilename); os.IsNotExist(err) && mustExist {
+		return nil, fmt.Errorf("pebble: database %q does not exist", dirname)
+	} else if os.IsNotExist(err) {
 		// Create the DB if it did not already exist.
 		if err := createDB(dirname, opts); err != nil {
 			return nil, err
@@ -123,12 +207,19 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	}
 
 	// Load the version set.
-	err = d.mu.versions.load(dirname, opts)
-	if err != nil {
+	if err := d.mu.versions.load(dirname, opts); err != nil {
 		return nil, err
 	}
 
-	// Replay any newer log files than the ones named in the manifest.
+	if parent == nil {
+		if err := d.openKeyspaces(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Replay any newer log files than the ones named in the manifest. The
+	// older logs which remain hold entries of keyspaces which may not have
+	// been flushed.
 	var ve versionEdit
 	ls, err := fs.List(dirname)
 	if err != nil {
@@ -140,50 +231,226 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		name string
 	}
 	var logFiles []fileNumAndName
+	var optionsFile fileNumAndName
+	var orphanedTables []uint64
+	liveFileNums := map[uint64]struct{}{}
+	d.mu.versions.addLiveFileNums(liveFileNums)
 	for _, filename := range ls {
 		ft, fn, ok := parseDBFilename(filename)
-		if ok && ft == fileTypeLog && (fn >= d.mu.versions.logNumber || fn == d.mu.versions.prevLogNumber) {
-			logFiles = append(logFiles, fileNumAndName{fn, filename})
+		if !ok {
+			continue
+		}
+		switch ft {
+		case fileTypeLog:
+			if fn >= d.mu.versions.logNumber || fn == d.mu.versions.prevLogNumber ||
+				len(d.mu.keyspaces) > 0 {
+				logFiles = append(logFiles, fileNumAndName{fn, filename})
+			}
+		case fileTypeOptions:
+			if optionsFile.num <= fn {
+				optionsFile = fileNumAndName{fn, filename}
+			}
+			d.mu.versions.markFileNumUsed(fn)
+		case fileTypeTable:
+			if _, ok := liveFileNums[fn]; !ok {
+				orphanedTables = append(orphanedTables, fn)
+			}
+			d.mu.versions.markFileNumUsed(fn)
+		}
+	}
+	if !opts.ReadOnly {
+		if err := d.removeOrphanedTables(orphanedTables); err != nil {
+			return nil, err
+		}
+	}
+	if optionsFile.name != "" {
+		if err := checkOptions(opts, filepath.Join(dirname, optionsFile.name)); err != nil {
+			return nil, err
 		}
 	}
 	sort.Slice(logFiles, func(i, j int) bool {
 		return logFiles[i].num < logFiles[j].num
 	})
 	for _, lf := range logFiles {
-		maxSeqNum, err := d.replayWAL(&ve, fs, filepath.Join(dirname, lf.name))
+		d.mu.versions.markFileNumUsed(lf.num)
+	}
+	logs := make([]walFile, len(logFiles))
+	for i, lf := range logFiles {
+		logs[i].fileNum = lf.num
+		if info, err := fs.Stat(filepath.Join(dirname, lf.name)); err == nil {
+			logs[i].size = uint64(info.Size())
+		}
+	}
+	replay := d.newWALReplay(logs)
+	for _, lf := range logFiles {
+		keyspacesOnly := lf.num < d.mu.versions.logNumber && lf.num != d.mu.versions.prevLogNumber
+		maxSeqNum, stop, err := d.replayWAL(&ve, fs, filepath.Join(dirname, lf.name), keyspacesOnly, replay)
 		if err != nil {
-			return nil, err
+			return nil, replay.end(err)
 		}
-		d.mu.versions.markFileNumUsed(lf.num)
+		replay.progress(true)
 		if d.mu.versions.logSeqNum < maxSeqNum {
 			d.mu.versions.logSeqNum = maxSeqNum
 		}
+		if stop {
+			// Recovery stopped at a corrupted record. Any subsequent logs are
+			// discarded.
+			break
+		}
+	}
+	if err := replay.end(nil); err != nil {
+		return nil, err
+	}
+	// The replayed logs remain live until they are found to be obsolete by
+	// deleteObsoleteFiles.
+	d.mu.log.retired = append(d.mu.log.retired, logs...)
+	// Sequence number 0 is never assigned, so that every snapshot, including
+	// one of an empty DB, has a largest visible sequence number.
+	if d.mu.versions.logSeqNum == 0 {
+		d.mu.versions.logSeqNum = 1
 	}
 	d.mu.versions.visibleSeqNum = d.mu.versions.logSeqNum
 
-	// Create an empty .log file.
+	if err := d.prewarmTableCache(); err != nil {
+		d.tableCache.Close()
+		return nil, err
+	}
+
+	if opts.ReadOnly {
+		// The contents of the logs have been recovered into memtables which are
+		// never flushed. Nothing is written to the DB directory.
+		return d, nil
+	}
+
+	// Create an empty .log file. A keyspace has no log, but its log number
+	// still advances so that the log number persisted by its flushes is
+	// valid.
 	ve.logNumber = d.mu.versions.nextFileNum()
 	d.mu.log.number = ve.logNumber
-	logFile, err := fs.Create(dbFilename(dirname, fileTypeLog, ve.logNumber))
-	if err != nil {
-		return nil, err
+	if parent == nil {
+		d.mu.mem.mutable.logNum = ve.logNumber
+		logFile, err := fs.Create(dbFilename(dirname, fileTypeLog, ve.logNumber))
+		if err != nil {
+			return nil, err
+		}
+		d.mu.log.LogWriter = d.newLogWriter(logFile)
+		// The recovered logs are deleted once the new manifest is written, so
+		// the transactions which are still prepared are carried over to the new
+		// log.
+		if err := d.writePrepared(); err != nil {
+			return nil, err
+		}
+	}
+	d.optionsFileNum = d.mu.versions.nextFileNum()
+	if uint64(opts.FormatMajorVersion) > d.mu.versions.formatMajorVersion {
+		ve.formatMajorVersion = uint64(opts.FormatMajorVersion)
+	}
+	if opts.FormatMajorVersion >= db.FormatDBID && d.mu.versions.id() == "" {
+		id, err := newDBID()
+		if err != nil {
+			return nil, err
+		}
+		ve.dbID = id
+	}
+	if opts.FormatMajorVersion >= db.FormatMergerName {
+		ve.mergerName = opts.Merger.Name()
 	}
-	d.mu.log.LogWriter = record.NewLogWriter(logFile)
 
 	// Write a new manifest to disk.
 	if err := d.mu.versions.logAndApply(d.opts, dirname, &ve); err != nil {
 		return nil, err
 	}
 
+	// Write the current options to disk. Older OPTIONS files are removed by
+	// deleteObsoleteFiles.
+	if err := writeOptions(opts, dbFilename(dirname, fileTypeOptions, d.optionsFileNum)); err != nil {
+		return nil, err
+	}
+
+	d.deleter = newFileDeleter(opts)
 	d.deleteObsoleteFiles()
 	d.maybeScheduleFlush()
 	d.maybeScheduleCompaction()
+	if opts.ScrubInterval > 0 {
+		d.scrubber = newScrubber(d)
+		d.scrubber.start()
+	}
 
 	d.fileLock, fileLock = fileLock, nil
 	return d, nil
 }
 
-// replayWAL replays the edits in the specified log file.
+// removeOrphanedTables removes sstables which are present in the DB directory
+// but are not referenced by the MANIFEST. Such tables are the outputs of a
+// flush or compaction that was interrupted by a crash before the MANIFEST was
+// updated. If ParanoidChecks is set, the tables are moved into the "lost"
+// subdirectory rather than being removed.
+func (d *DB) removeOrphanedTables(fileNums []uint64) error {
+	fs := d.opts.Storage
+	for _, fileNum := range fileNums {
+		filename := dbFilename(d.dirname, fileTypeTable, fileNum)
+		var size int64
+		if info, err := fs.Stat(filename); err == nil {
+			size = info.Size()
+		}
+		if d.opts.ParanoidChecks {
+			lostDir := filepath.Join(d.dirname, lostDirname)
+			if err := fs.MkdirAll(lostDir, 0755); err != nil {
+				return err
+			}
+			if err := fs.Rename(filename, filepath.Join(lostDir, filepath.Base(filename))); err != nil {
+				return err
+			}
+			d.opts.Logger.Infof("moved orphaned table %06d (%d bytes) to %s", fileNum, size, lostDir)
+			continue
+		}
+		if err := fs.Remove(filename); err != nil {
+			return err
+		}
+		d.opts.Logger.Infof("removed orphaned table %06d (%d bytes)", fileNum, size)
+	}
+	return nil
+}
+
+// checkOptions checks that the options persisted in the specified OPTIONS
+// file are compatible with opts.
+func checkOptions(opts *db.Options, filename string) error {
+	f, err := opts.Storage.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	return opts.Check(string(data))
+}
+
+// writeOptions writes opts to the specified OPTIONS file.
+func writeOptions(opts *db.Options, filename string) error {
+	f, err := opts.Storage.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, opts.String()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replayWAL replays the edits in the specified log file. Corrupted or
+// incomplete records are handled according to Options.WALRecoveryMode. If
+// stop is true, replay stopped at a corrupted record and no subsequent logs
+// should be replayed. If keyspacesOnly is true, only the entries of
+// keyspaces are replayed, as the log predates the DB's last flush. If replay
+// is non-nil, the progress of the replay is reported to it, and the
+// memtables filled by the replay are flushed by it in the background.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
@@ -191,59 +458,158 @@ func (d *DB) replayWAL(
 	ve *versionEdit,
 	fs storage.Storage,
 	filename string,
-) (maxSeqNum uint64, err error) {
+	keyspacesOnly bool,
+	replay *walReplay,
+) (maxSeqNum uint64, stop bool, err error) {
 	file, err := fs.Open(filename)
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
 	defer file.Close()
+	_, fileNum, _ := parseDBFilename(filename)
 
+	var recordOpts []record.Option
+	if d.opts.WALRecoveryMode == db.SkipAnyCorruptedRecords {
+		recordOpts = append(recordOpts, record.SkipCorruptChunks())
+	}
 	var (
 		b   Batch
 		buf bytes.Buffer
 		mem *memTable
-		rr  = record.NewReader(file)
+		rr  *record.Reader
 	)
+	if replay != nil {
+		rr = record.NewReader(replay.reader(file, fileNum), recordOpts...)
+	} else {
+		rr = record.NewReader(file, recordOpts...)
+	}
+	defer func() {
+		if n := rr.Dropped(); n > 0 {
+			d.opts.Logger.Infof("WAL %06d: skipped %d bytes of corrupted records", fileNum, n)
+		}
+	}()
+
+	// flushMem writes the recovered contents of mem to level-0 tables. A
+	// read-only DB instead keeps mem in memory, ordered before the mutable
+	// memtable which is always last in the queue.
+	flushMem := func() error {
+		if d.opts.ReadOnly {
+			n := len(d.mu.mem.queue)
+			d.mu.mem.queue = append(d.mu.mem.queue[:n-1], mem, d.mu.mem.mutable)
+			return nil
+		}
+		if replay != nil {
+			return replay.flush(ve, fs, mem)
+		}
+		metas, err := d.writeLevel0Table(fs, mem.NewIter(nil), nil)
+		if err != nil {
+			return err
+		}
+		for _, meta := range metas {
+			ve.newFiles = append(ve.newFiles, newFileEntry{level: 0, meta: meta})
+			// Strictly speaking, it's too early to delete meta.fileNum from d.pendingOutputs,
+			// but we are replaying the log file, which happens before Open returns, so there
+			// is no possibility of deleteObsoleteFiles being called concurrently here.
+			delete(d.mu.compact.pendingOutputs, meta.fileNum)
+		}
+		return nil
+	}
+
+loop:
 	for {
+		// Release d.mu while reading the next record if memtables are being
+		// flushed, as the flushes need it to make progress.
+		unlocked := replay != nil && replay.flushing()
+		if unlocked {
+			d.mu.Unlock()
+		}
 		r, err := rr.Next()
+		if err == nil {
+			_, err = io.Copy(&buf, r)
+		}
+		if unlocked {
+			d.mu.Lock()
+		}
 		if err == io.EOF {
 			break
 		}
-		if err != nil {
-			return 0, err
+		if err == nil && buf.Len() < batchHeaderLen {
+			err = errors.New("pebble: invalid batch (too short)")
 		}
-		_, err = io.Copy(&buf, r)
 		if err != nil {
-			return 0, err
+			buf.Reset()
+			err = &db.CorruptionError{
+				FileType: db.FileTypeLog,
+				Path:     filename,
+				FileNum:  fileNum,
+				Offset:   -1,
+				Err:      err,
+			}
+			switch d.opts.WALRecoveryMode {
+			case db.AbsoluteConsistency:
+				return 0, false, err
+			case db.PointInTime:
+				stop = true
+				break loop
+			case db.SkipAnyCorruptedRecords:
+				rr.Recover()
+				continue
+			default:
+				// The corruption is tolerated only if there are no further
+				// records in the log.
+				rr.Recover()
+				if _, err1 := rr.Next(); err1 != io.EOF && err1 != io.ErrUnexpectedEOF {
+					return 0, false, err
+				}
+				break loop
+			}
 		}
 
-		if buf.Len() < batchHeaderLen {
-			return 0, fmt.Errorf("pebble: corrupt log file %q", filename)
+		d.mu.log.replayedBytes += uint64(buf.Len())
+		if replay != nil {
+			replay.progress(false)
 		}
 		b = Batch{}
 		b.data = buf.Bytes()
+		if d.replayPrepared(&b) {
+			buf.Reset()
+			continue
+		}
 		b.refreshMemTableSize()
 		seqNum := b.seqNum()
 		maxSeqNum = seqNum + uint64(b.count())
 
+		if len(b.keyspaces) > 0 {
+			if err := d.replayKeyspaces(&b, fileNum); err != nil {
+				return 0, false, err
+			}
+		}
+		if keyspacesOnly {
+			buf.Reset()
+			continue
+		}
+
 		if mem == nil {
 			mem = newMemTable(d.opts)
 		}
 
 		for {
 			err := mem.prepare(&b)
-			if err == arenaskl.ErrArenaFull {
-				// TODO(peter): write the memtable to disk.
-				panic(err)
+			if err == arenaskl.ErrArenaFull && !mem.Empty() {
+				if err := flushMem(); err != nil {
+					return 0, false, err
+				}
+				mem = newMemTable(d.opts)
+				continue
 			}
 			if err != nil {
-				return 0, err
+				return 0, false, err
 			}
 			break
 		}
 
 		if err := mem.apply(&b, seqNum); err != nil {
-			return 0, err
+			return 0, false, err
 		}
 		if mem.unref() {
 			d.maybeScheduleFlush()
@@ -253,16 +619,27 @@ func (d *DB) replayWAL(
 	}
 
 	if mem != nil && !mem.Empty() {
-		meta, err := d.writeLevel0Table(fs, mem.NewIter(nil))
-		if err != nil {
-			return 0, err
+		if err := flushMem(); err != nil {
+			return 0, false, err
 		}
-		ve.newFiles = append(ve.newFiles, newFileEntry{level: 0, meta: meta})
-		// Strictly speaking, it's too early to delete meta.fileNum from d.pendingOutputs,
-		// but we are replaying the log file, which happens before Open returns, so there
-		// is no possibility of deleteObsoleteFiles being called concurrently here.
-		delete(d.mu.compact.pendingOutputs, meta.fileNum)
 	}
+	return maxSeqNum, stop, nil
+}
 
-	return maxSeqNum, nil
+// prewarmTableCache opens the tables of the levels selected by
+// Options.PrewarmLevels, returning an error if a table cannot be opened.
+//
+// d.mu must be held when calling this.
+func (d *DB) prewarmTableCache() error {
+	var metas []*fileMetadata
+	current := d.mu.versions.currentVersion()
+	for level := 0; level < d.opts.PrewarmLevels && level < numLevels; level++ {
+		for i := range current.files[level] {
+			metas = append(metas, &current.files[level][i])
+		}
+	}
+	if len(metas) == 0 {
+		return nil
+	}
+	return d.tableCache.prewarm(metas)
 }
@@ -5,6 +5,10 @@
 package pebble
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
@@ -13,6 +17,7 @@ import (
 	"testing"
 
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/record"
 	"github.com/petermattis/pebble/storage"
 )
 
@@ -45,6 +50,50 @@ func TestErrorIfDBExists(t *testing.T) {
 	}
 }
 
+func TestErrorIfNotExists(t *testing.T) {
+	fs := storage.NewMem()
+	if _, err := Open("db", &db.Options{
+		ErrorIfNotExists: true,
+		Storage:          fs,
+	}); err == nil {
+		t.Fatalf("expected an error opening a DB which does not exist")
+	}
+	// Nothing was created.
+	if _, err := fs.Stat("db"); !os.IsNotExist(err) {
+		t.Fatalf("expected the DB directory not to exist, but found %v", err)
+	}
+
+	d, err := Open("db", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d, err = Open("db", &db.Options{
+		ErrorIfNotExists: true,
+		Storage:          fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The options which can never succeed are rejected.
+	for _, opts := range []*db.Options{
+		{ErrorIfDBExists: true, ErrorIfNotExists: true, Storage: fs},
+		{ErrorIfDBExists: true, ReadOnly: true, Storage: fs},
+	} {
+		if d, err := Open("db", opts); err == nil {
+			d.Close()
+			t.Fatalf("expected an error for ErrorIfDBExists=%t ErrorIfNotExists=%t ReadOnly=%t",
+				opts.ErrorIfDBExists, opts.ErrorIfNotExists, opts.ReadOnly)
+		}
+	}
+}
+
 func TestNewDBFilenames(t *testing.T) {
 	fooBar := filepath.Join("foo", "bar")
 	fs := storage.NewMem()
@@ -67,12 +116,35 @@ func TestNewDBFilenames(t *testing.T) {
 		"000003.log",
 		"CURRENT",
 		"MANIFEST-000002",
+		"OPTIONS-000004",
 	}
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("\ngot  %v\nwant %v", got, want)
 	}
 }
 
+func TestOpenInvalidOptions(t *testing.T) {
+	testCases := []struct {
+		levels   []db.LevelOptions
+		expected string
+	}{
+		{[]db.LevelOptions{{Compression: -1}}, "unknown compression"},
+		{[]db.LevelOptions{{}, {Compression: 99}}, "level 1: unknown compression"},
+		{[]db.LevelOptions{{FilterType: 99}}, "unknown filter type"},
+		{[]db.LevelOptions{{BlockSizeThreshold: 101}}, "BlockSizeThreshold"},
+		{make([]db.LevelOptions, numLevels+1), "only 7 levels exist"},
+	}
+	for _, c := range testCases {
+		_, err := Open("", &db.Options{
+			Storage: storage.NewMem(),
+			Levels:  c.levels,
+		})
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("expected error containing %q, but found %v", c.expected, err)
+		}
+	}
+}
+
 func TestOpenCloseOpenClose(t *testing.T) {
 	opts := &db.Options{
 		Storage: storage.NewMem(),
@@ -146,3 +218,733 @@ func TestOpenCloseOpenClose(t *testing.T) {
 		}
 	}
 }
+
+func TestOpenWALRecoveryMode(t *testing.T) {
+	// Create a log containing 3 records, each of which spans multiple blocks.
+	var buf bytes.Buffer
+	w := record.NewWriter(&buf)
+	var offsets []int64
+	var offset int64
+	for i, k := range []string{"a", "b", "c"} {
+		var b Batch
+		if err := b.Set([]byte(k), bytes.Repeat([]byte(k), 40000), nil); err != nil {
+			t.Fatal(err)
+		}
+		b.setSeqNum(uint64(i + 1))
+		offsets = append(offsets, offset)
+		var err error
+		if offset, err = w.WriteRecord(b.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	log := buf.Bytes()
+
+	corruptions := map[string]func() []byte{
+		// A partially written final record.
+		"tail": func() []byte {
+			return append([]byte(nil), log[:len(log)-10]...)
+		},
+		// A checksum mismatch in the first chunk of the middle record.
+		"middle": func() []byte {
+			data := append([]byte(nil), log...)
+			data[offsets[1]+20] ^= 0xff
+			return data
+		},
+	}
+
+	testCases := []struct {
+		mode       db.WALRecoveryMode
+		corruption string
+		expected   string
+	}{
+		{db.TolerateCorruptedTailRecords, "tail", "ab"},
+		{db.TolerateCorruptedTailRecords, "middle", "error"},
+		{db.AbsoluteConsistency, "tail", "error"},
+		{db.AbsoluteConsistency, "middle", "error"},
+		{db.PointInTime, "tail", "ab"},
+		{db.PointInTime, "middle", "a"},
+		{db.SkipAnyCorruptedRecords, "tail", "ab"},
+		{db.SkipAnyCorruptedRecords, "middle", "ac"},
+	}
+	for _, c := range testCases {
+		t.Run(c.mode.String()+"/"+c.corruption, func(t *testing.T) {
+			mem := storage.NewMem()
+			d, err := Open("", &db.Options{
+				Storage: mem,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Replace the (empty) log with the corrupted log.
+			ls, err := mem.List("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, filename := range ls {
+				if ft, _, ok := parseDBFilename(filename); ok && ft == fileTypeLog {
+					f, err := mem.Create(filename)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if _, err := f.Write(corruptions[c.corruption]()); err != nil {
+						t.Fatal(err)
+					}
+					if err := f.Close(); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			d, err = Open("", &db.Options{
+				Storage:         mem,
+				WALRecoveryMode: c.mode,
+			})
+			if err != nil {
+				if c.expected != "error" {
+					t.Fatal(err)
+				}
+				if !errors.Is(err, db.ErrCorruption) {
+					t.Fatalf("expected corruption error, but found %v", err)
+				}
+				return
+			}
+			if c.expected == "error" {
+				t.Fatalf("expected error, but Open succeeded")
+			}
+			var found string
+			for _, k := range []string{"a", "b", "c"} {
+				if _, err := d.Get([]byte(k)); err == nil {
+					found += k
+				} else if err != db.ErrNotFound {
+					t.Fatal(err)
+				}
+			}
+			if found != c.expected {
+				t.Fatalf("expected %q, but found %q", c.expected, found)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestOpenRemovesOrphanedTables(t *testing.T) {
+	for _, paranoid := range []bool{false, true} {
+		t.Run(strconv.FormatBool(paranoid), func(t *testing.T) {
+			mem := storage.NewMem()
+			opts := &db.Options{
+				Logger:         discardLogger{},
+				ParanoidChecks: paranoid,
+				Storage:        mem,
+			}
+			d, err := Open("", opts)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			tables, err := d.SSTables()
+			if err != nil {
+				t.Fatal(err)
+			}
+			live := tables[maxFlushLevel][0].FileNum
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Simulate the output of a compaction that was interrupted before the
+			// MANIFEST was updated.
+			const orphan = 1000
+			orphanName := dbFilename("", fileTypeTable, orphan)
+			f, err := mem.Create(orphanName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write([]byte("orphaned")); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			d, err = Open("", opts)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			if _, err := mem.Stat(orphanName); err == nil {
+				t.Fatalf("expected %s to be removed", orphanName)
+			}
+			_, err = mem.Stat(filepath.Join(lostDirname, orphanName))
+			if paranoid && err != nil {
+				t.Fatalf("expected %s to be quarantined: %v", orphanName, err)
+			} else if !paranoid && err == nil {
+				t.Fatalf("expected %s to be removed, but it was quarantined", orphanName)
+			}
+			if _, err := mem.Stat(dbFilename("", fileTypeTable, live)); err != nil {
+				t.Fatalf("live table removed: %v", err)
+			}
+			if v, err := d.Get([]byte("a")); err != nil || string(v) != "1" {
+				t.Fatalf("expected 1, but found %s (%v)", v, err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestOpenPrewarm(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		FlushToL0: true,
+		Storage:   mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if err := d.Set([]byte(k), []byte("1"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tables, err := d.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables[0]) != 2 {
+		t.Fatalf("expected 2 tables in L0, but found %d", len(tables[0]))
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &db.Options{
+		Logger:        discardLogger{},
+		PrewarmLevels: numLevels,
+		Storage:       mem,
+	}
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.tableCache.mu.Lock()
+	n := len(d.tableCache.nodes)
+	d.tableCache.mu.Unlock()
+	if n != 2 {
+		t.Fatalf("expected 2 tables to be opened, but found %d", n)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A table which cannot be read fails Open.
+	name := dbFilename("", fileTypeTable, tables[0][1].FileNum)
+	f, err := mem.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("corrupt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open("", opts)
+	if expected := fmt.Sprintf("table %06d", tables[0][1].FileNum); err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Fatalf("expected an error for %s, but found %v", expected, err)
+	}
+	opts.PrewarmLevels = 0
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	mem := storage.NewMem()
+	if _, err := Open("", &db.Options{
+		ReadOnly: true,
+		Storage:  mem,
+	}); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected non-existent DB error, but found %v", err)
+	}
+
+	d, err := Open("", &db.Options{
+		Logger:  discardLogger{},
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// "b" is only present in the WAL.
+	if err := d.Set([]byte("b"), []byte("2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	waitForBackgroundWork(d)
+
+	before, err := mem.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(before)
+
+	// The DB is still open, but a read-only DB does not take the lock.
+	ro, err := Open("", &db.Options{
+		ReadOnly: true,
+		Storage:  mem,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for k, v := range map[string]string{"a": "1", "b": "2"} {
+		if value, err := ro.Get([]byte(k)); err != nil || string(value) != v {
+			t.Fatalf("%s: expected %s, but found %s (%v)", k, v, value, err)
+		}
+	}
+	if err := ro.Set([]byte("c"), []byte("3"), nil); err != ErrReadOnly {
+		t.Fatalf("expected %v, but found %v", ErrReadOnly, err)
+	}
+	if err := ro.Flush(); err != ErrReadOnly {
+		t.Fatalf("expected %v, but found %v", ErrReadOnly, err)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := mem.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(after)
+	if !reflect.DeepEqual(before, after) {
+		t.Fatalf("expected files\n%s\nbut found\n%s", before, after)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenWALReplayMemTableFull(t *testing.T) {
+	for _, readOnly := range []bool{false, true} {
+		t.Run(strconv.FormatBool(readOnly), func(t *testing.T) {
+			mem := storage.NewMem()
+			d, err := Open("", &db.Options{
+				Logger:       discardLogger{},
+				MemTableSize: 1 << 20,
+				Storage:      mem,
+			})
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			value := bytes.Repeat([]byte("x"), 1000)
+			for i := 0; i < 200; i++ {
+				if err := d.Set([]byte(strconv.Itoa(i)), value, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Reopen with a memtable too small to hold the contents of the WAL.
+			d, err = Open("", &db.Options{
+				Logger:       discardLogger{},
+				MemTableSize: 64 << 10,
+				ReadOnly:     readOnly,
+				Storage:      mem,
+			})
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			for i := 0; i < 200; i++ {
+				if v, err := d.Get([]byte(strconv.Itoa(i))); err != nil || !bytes.Equal(v, value) {
+					t.Fatalf("%d: unexpected value (%v)", i, err)
+				}
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestOpenWALCompression(t *testing.T) {
+	for _, vers := range []db.FormatMajorVersion{db.FormatMostCompatible, db.FormatCompressedWAL} {
+		t.Run(fmt.Sprint(vers), func(t *testing.T) {
+			mem := storage.NewMem()
+			d, err := Open("", &db.Options{
+				FormatMajorVersion: vers,
+				Logger:             discardLogger{},
+				MemTableSize:       1 << 20,
+				Storage:            mem,
+				WALCompression:     db.SnappyCompression,
+			})
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			value := bytes.Repeat([]byte("x"), 1000)
+			for i := 0; i < 200; i++ {
+				if err := d.Set([]byte(strconv.Itoa(i)), value, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The WAL is only compressed at FormatCompressedWAL.
+			var size int64
+			ls, err := mem.List("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, filename := range ls {
+				if ft, _, ok := parseDBFilename(filename); ok && ft == fileTypeLog {
+					info, err := mem.Stat(filename)
+					if err != nil {
+						t.Fatal(err)
+					}
+					size += info.Size()
+				}
+			}
+			if compressed := size < 200*int64(len(value)); compressed != (vers >= db.FormatCompressedWAL) {
+				t.Fatalf("format major version %d: unexpected WAL size %d", vers, size)
+			}
+
+			// The WAL is decompressed when it is replayed, regardless of the
+			// WALCompression option.
+			d, err = Open("", &db.Options{
+				Logger:  discardLogger{},
+				Storage: mem,
+			})
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			for i := 0; i < 200; i++ {
+				if v, err := d.Get([]byte(strconv.Itoa(i))); err != nil || !bytes.Equal(v, value) {
+					t.Fatalf("%d: unexpected value (%v)", i, err)
+				}
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestOpenWALReplayEvents(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Logger:       discardLogger{},
+		MemTableSize: 1 << 20,
+		Storage:      mem,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	// The rounds overwrite the same keys, so the memtables filled by the
+	// replay overlap, followed by keys which fill disjoint memtables.
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%04d", i))
+	}
+	for round := 0; round < 3; round++ {
+		value := bytes.Repeat([]byte{byte('a' + round)}, 1000)
+		for i := 0; i < 100; i++ {
+			if err := d.Set(key(i), value, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 100; i < 500; i++ {
+		if err := d.Set(key(i), []byte("z"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var begin, end db.WALReplayInfo
+	var progress []db.WALReplayInfo
+	d, err = Open("", &db.Options{
+		EventListener: db.EventListener{
+			WALReplayBegin: func(info db.WALReplayInfo) {
+				begin = info
+			},
+			WALReplayProgress: func(info db.WALReplayInfo) {
+				progress = append(progress, info)
+			},
+			WALReplayEnd: func(info db.WALReplayInfo) {
+				end = info
+			},
+		},
+		// The replayed tables are left in L0.
+		L0CompactionThreshold: 100,
+		Logger:                discardLogger{},
+		MemTableSize:          64 << 10,
+		Storage:               mem,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer d.Close()
+
+	if begin.Files != 1 || begin.Size == 0 || begin.BytesReplayed != 0 {
+		t.Fatalf("unexpected WALReplayBegin: %+v", begin)
+	}
+	if len(progress) != 1 || progress[0].BytesReplayed != begin.Size || progress[0].FileNum == 0 {
+		t.Fatalf("unexpected WALReplayProgress: %+v", progress)
+	}
+	if end.Err != nil || end.BytesReplayed != begin.Size || end.Files != 1 {
+		t.Fatalf("unexpected WALReplayEnd: %+v", end)
+	}
+
+	// The memtables filled by the replay were flushed to several tables,
+	// which hold the latest values of the overwritten keys.
+	if n := d.Metrics().Tables[0].Count; n < 2 {
+		t.Fatalf("expected several L0 tables, but found %d", n)
+	}
+	want := bytes.Repeat([]byte{'c'}, 1000)
+	for i := 0; i < 500; i++ {
+		if i == 100 {
+			want = []byte("z")
+		}
+		if v, err := d.Get(key(i)); err != nil || !bytes.Equal(v, want) {
+			t.Fatalf("%s: unexpected value of %d bytes (%v)", key(i), len(v), err)
+		}
+	}
+}
+
+func TestOpenRemoteStorage(t *testing.T) {
+	local := storage.NewMem()
+	store := storage.NewMemObjectStore()
+	fs, err := storage.NewRemote(local, store, &storage.RemoteOptions{
+		CacheBlockSize: 512,
+		CacheDir:       "cache",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func() *DB {
+		d, err := Open("db", &db.Options{
+			L0CompactionThreshold: 2,
+			Logger:                discardLogger{},
+			Storage:               fs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	d := open()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 100; j++ {
+			key := []byte(strconv.Itoa(j))
+			if err := d.Set(key, []byte(strconv.Itoa(i)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.mu.Lock()
+	for d.mu.compact.compacting || len(d.mu.versions.currentVersion().files[0]) >= 2 {
+		d.mu.compact.cond.Wait()
+	}
+	d.mu.Unlock()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sstables are held in the object store, and everything else is held
+	// locally.
+	objects, err := store.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) == 0 {
+		t.Fatalf("expected sstables in the object store")
+	}
+	for _, name := range objects {
+		if filepath.Ext(name) != ".sst" {
+			t.Fatalf("unexpected object %s", name)
+		}
+	}
+	names, err := local.List("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if filepath.Ext(name) == ".sst" {
+			t.Fatalf("unexpected local sstable %s", name)
+		}
+	}
+
+	d = open()
+	defer d.Close()
+	for j := 0; j < 100; j++ {
+		v, err := d.Get([]byte(strconv.Itoa(j)))
+		if err != nil || string(v) != "2" {
+			t.Fatalf("%d: expected 2, but found %s (%v)", j, v, err)
+		}
+	}
+}
+
+func TestOpenCrashRecovery(t *testing.T) {
+	fs := storage.NewStrictMem()
+	if err := fs.MkdirAll("db", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The DB directory itself must survive the crash.
+	if dir, err := fs.OpenDir(""); err != nil {
+		t.Fatal(err)
+	} else if err := dir.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := dir.Close(); err != nil {
+		t.Fatal(err)
+	}
+	open := func() *DB {
+		d, err := Open("db", &db.Options{
+			Logger:       discardLogger{},
+			MemTableSize: 1 << 14,
+			Storage:      fs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	d := open()
+	// Write enough to switch logs and flush memtables, so that the synced
+	// state includes sstables, log switches and manifest updates.
+	value := bytes.Repeat([]byte("x"), 1024)
+	for i := 0; i < 100; i++ {
+		if err := d.Set([]byte(strconv.Itoa(i)), value, db.Sync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < 110; i++ {
+		if err := d.Set([]byte(strconv.Itoa(i)), value, db.Sync); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate a crash: nothing written from here on is durable.
+	fs.SetIgnoreSyncs(true)
+	for i := 110; i < 120; i++ {
+		if err := d.Set([]byte(strconv.Itoa(i)), value, db.Sync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs.ResetToSyncedState()
+	fs.SetIgnoreSyncs(false)
+
+	d = open()
+	defer d.Close()
+	for i := 0; i < 120; i++ {
+		v, err := d.Get([]byte(strconv.Itoa(i)))
+		if i < 110 {
+			if err != nil || !bytes.Equal(v, value) {
+				t.Fatalf("%d: expected synced value, but found %d bytes (%v)", i, len(v), err)
+			}
+		} else if err != db.ErrNotFound {
+			t.Fatalf("%d: expected not found, but found %d bytes (%v)", i, len(v), err)
+		}
+	}
+}
+
+func TestFlushLogNumber(t *testing.T) {
+	mem := storage.NewMem()
+	opts := &db.Options{
+		Logger:                      discardLogger{},
+		MemTableStopWritesThreshold: 4,
+		Storage:                     mem,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Switch out two memtables, holding a reference to each so that neither is
+	// ready for flushing, as if a commit into it were in progress.
+	var mems []*memTable
+	for _, k := range []string{"a", "b"} {
+		if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+		d.mu.Lock()
+		m := d.mu.mem.mutable
+		m.ref()
+		if err := d.makeRoomForWrite(nil); err != nil {
+			t.Fatal(err)
+		}
+		mems = append(mems, m)
+		d.mu.Unlock()
+	}
+
+	// Only the first memtable is flushed. The WAL of the second must be
+	// retained, even though a newer WAL has been created since.
+	d.mu.Lock()
+	mems[0].unref()
+	d.maybeScheduleFlush()
+	for d.mu.compact.flushing {
+		d.mu.compact.cond.Wait()
+	}
+	if len(d.mu.mem.queue) != 2 {
+		t.Fatalf("expected 2 memtables, but found %d", len(d.mu.mem.queue))
+	}
+	if logNum := d.mu.versions.logNumber; logNum != mems[1].logNum {
+		t.Fatalf("expected log number %d, but found %d", mems[1].logNum, logNum)
+	}
+	d.mu.Unlock()
+
+	// The second memtable is never flushed, and its entries are recovered from
+	// its WAL.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for _, k := range []string{"a", "b"} {
+		if v, err := d.Get([]byte(k)); err != nil || string(v) != k {
+			t.Fatalf("%s: expected %s, but found %s (%v)", k, k, v, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// scanCursorVersion is the version of the encoding of a scan cursor, which is
+// the first byte of the cursor. It is followed by the sequence number of the
+// scan as a uvarint, and the last key returned.
+const scanCursorVersion = 1
+
+// ErrInvalidCursor is returned by ScanPage when the cursor was not returned
+// by a previous page of a scan.
+var ErrInvalidCursor = errors.New("pebble: invalid scan cursor")
+
+// Page is a page of the key/value pairs returned by ScanPage.
+type Page struct {
+	// Keys and Values are the key/value pairs of the page, in key order. They
+	// are copies and may be retained by the caller.
+	Keys   [][]byte
+	Values [][]byte
+	// Cursor resumes the scan after the last key of the page, or is nil if the
+	// scan is complete. The cursor is opaque, and may be persisted or returned
+	// to a client.
+	Cursor []byte
+}
+
+// ScanPage returns up to limit key/value pairs of the range [o.LowerBound,
+// o.UpperBound), starting after the position encoded by cursor. The first
+// page of a scan is requested with a nil cursor, and subsequent pages with
+// the Cursor of the previous page, until it is nil.
+//
+// Every page of a scan is read as of the sequence number at which its first
+// page was read, which is encoded in the cursor, so that the writes committed
+// while the scan is in progress are not visible to it. As with NewIterAt, the
+// view of the later pages is only exact if the entries visible at that
+// sequence number are retained, such as by an open Snapshot; Snapshot.ScanPage
+// scans a snapshot.
+func (d *DB) ScanPage(cursor []byte, limit int, o *db.IterOptions) (*Page, error) {
+	seqNum := d.LatestSeqNum()
+	if cursor != nil {
+		var err error
+		if seqNum, _, err = decodeScanCursor(cursor); err != nil {
+			return nil, err
+		}
+	}
+	return d.scanPage(seqNum, cursor, limit, o)
+}
+
+// ScanPage returns up to limit key/value pairs of the range [o.LowerBound,
+// o.UpperBound) as of the snapshot, starting after the position encoded by
+// cursor. See DB.ScanPage. A cursor returned by a different snapshot is
+// rejected with ErrInvalidCursor.
+func (s *Snapshot) ScanPage(cursor []byte, limit int, o *db.IterOptions) (*Page, error) {
+	if s.db == nil {
+		return nil, ErrSnapshotClosed
+	}
+	if cursor != nil {
+		seqNum, _, err := decodeScanCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if seqNum != s.seqNum {
+			return nil, ErrInvalidCursor
+		}
+	}
+	return s.db.scanPage(s.seqNum, cursor, limit, o)
+}
+
+func (d *DB) scanPage(seqNum uint64, cursor []byte, limit int, o *db.IterOptions) (*Page, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("pebble: invalid page limit %d", limit)
+	}
+	iter := d.NewIterAt(seqNum, o)
+	if cursor == nil {
+		iter.First()
+	} else {
+		_, last, _ := decodeScanCursor(cursor)
+		iter.SeekGE(last)
+		// The cursor's key was returned by the previous page.
+		if iter.Valid() && d.cmp(iter.Key(), last) == 0 {
+			iter.Next()
+		}
+	}
+
+	p := &Page{}
+	var buf []byte
+	var offsets []int
+	for ; iter.Valid() && len(p.Keys) < limit; iter.Next() {
+		buf = append(buf, iter.Key()...)
+		offsets = append(offsets, len(buf))
+		buf = append(buf, iter.Value()...)
+		offsets = append(offsets, len(buf))
+		p.Keys = append(p.Keys, nil)
+	}
+	// There are more pairs to scan if the iterator stopped at the limit.
+	more := iter.Valid()
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	// The pairs are copied into a single buffer, which is only sliced once it
+	// is no longer grown.
+	p.Values = make([][]byte, len(p.Keys))
+	start := 0
+	for i := range p.Keys {
+		p.Keys[i] = buf[start:offsets[2*i]:offsets[2*i]]
+		p.Values[i] = buf[offsets[2*i]:offsets[2*i+1]:offsets[2*i+1]]
+		start = offsets[2*i+1]
+	}
+	if more {
+		p.Cursor = encodeScanCursor(seqNum, p.Keys[len(p.Keys)-1])
+	}
+	return p, nil
+}
+
+func encodeScanCursor(seqNum uint64, key []byte) []byte {
+	buf := make([]byte, 1+binary.MaxVarintLen64+len(key))
+	buf[0] = scanCursorVersion
+	n := 1 + binary.PutUvarint(buf[1:], seqNum)
+	return append(buf[:n], key...)
+}
+
+func decodeScanCursor(cursor []byte) (seqNum uint64, key []byte, err error) {
+	if len(cursor) == 0 || cursor[0] != scanCursorVersion {
+		return 0, nil, ErrInvalidCursor
+	}
+	seqNum, n := binary.Uvarint(cursor[1:])
+	if n <= 0 {
+		return 0, nil, ErrInvalidCursor
+	}
+	return seqNum, cursor[1+n:], nil
+}
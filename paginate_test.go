@@ -0,0 +1,116 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestScanPage(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Logger:  discardLogger{},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for i := 0; i < 25; i++ {
+		k := fmt.Sprintf("%02d", i)
+		if err := d.Set([]byte(k), []byte("v"+k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// scan returns the keys of the pages of the scan, with the pairs whose
+	// value does not match their key marked.
+	type scanner func(cursor []byte, limit int, o *db.IterOptions) (*Page, error)
+	scan := func(fn scanner, limit int, o *db.IterOptions, between func()) string {
+		var pages []string
+		var cursor []byte
+		for {
+			p, err := fn(cursor, limit, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for i := range p.Keys {
+				k := string(p.Keys[i])
+				if string(p.Values[i]) != "v"+k {
+					k += "!"
+				}
+				keys = append(keys, k)
+			}
+			pages = append(pages, strings.Join(keys, ","))
+			if p.Cursor == nil {
+				return strings.Join(pages, " ")
+			}
+			cursor = p.Cursor
+			if between != nil {
+				between()
+			}
+		}
+	}
+
+	// The writes committed during the scan are not visible to it.
+	i := 0
+	s := scan(d.ScanPage, 10, nil, func() {
+		i++
+		if err := d.Set([]byte(fmt.Sprintf("%02d.%d", 10*i, i)), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Delete([]byte(fmt.Sprintf("%02d", 10*i+5)), nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	const expected = "00,01,02,03,04,05,06,07,08,09 10,11,12,13,14,15,16,17,18,19 20,21,22,23,24"
+	if s != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, s)
+	}
+
+	// A scan which ends at the limit does not return a final empty page.
+	o := &db.IterOptions{LowerBound: []byte("03"), UpperBound: []byte("07")}
+	if s := scan(d.ScanPage, 2, o, nil); s != "03,04 05,06" {
+		t.Fatalf("unexpected pages %q", s)
+	}
+
+	snap := d.NewSnapshot()
+	defer snap.Close()
+	if s := scan(snap.ScanPage, 100, o, nil); s != "03,04,05,06" {
+		t.Fatalf("unexpected pages %q", s)
+	}
+
+	// A cursor is only accepted by the snapshot which returned it.
+	p, err := snap.ScanPage(nil, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("x"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	other := d.NewSnapshot()
+	defer other.Close()
+	if _, err := other.ScanPage(p.Cursor, 1, nil); err != ErrInvalidCursor {
+		t.Fatalf("expected %v, but found %v", ErrInvalidCursor, err)
+	}
+	if _, err := d.ScanPage(p.Cursor, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cursor := range [][]byte{{}, {0}, {scanCursorVersion, 0x80}} {
+		if _, err := d.ScanPage(cursor, 1, nil); err != ErrInvalidCursor {
+			t.Fatalf("%x: expected %v, but found %v", cursor, ErrInvalidCursor, err)
+		}
+	}
+	if _, err := d.ScanPage(nil, 0, nil); err == nil {
+		t.Fatal("expected an error for a zero limit")
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// ErrNotPrepared is returned by CommitPrepared and RollbackPrepared if the
+// transaction has not been prepared, or has already been committed or rolled
+// back.
+var ErrNotPrepared = errors.New("pebble: transaction is not prepared")
+
+// Prepare performs the first phase of a two-phase commit of the batch as the
+// transaction xid. The batch is written to the WAL, making it durable if
+// opts requests a sync, but is not applied: its writes become visible only
+// when CommitPrepared is called, and are discarded by RollbackPrepared.
+//
+// Prepared transactions survive a crash. Open recovers the set of
+// transactions which were prepared but not committed or rolled back, which is
+// returned by PreparedTransactions, so that a transaction coordinator can
+// resolve them. A prepared transaction holds on to its batch in memory, and
+// its prepare record is rewritten to every new WAL until it is resolved.
+//
+// The batch must not be committed or modified after it is prepared. It is
+// safe to modify the contents of xid after Prepare returns.
+func (d *DB) Prepare(xid []byte, batch *Batch, opts *db.WriteOptions) error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	b := newBatch(d)
+	defer b.release()
+	b.appendMarker(db.InternalKeyKindBeginPrepareXID, xid)
+	if len(batch.data) > batchHeaderLen {
+		b.data = append(b.data, batch.data[batchHeaderLen:]...)
+	}
+
+	// The transaction is registered before its prepare record is written so
+	// that a concurrent switch to a new WAL carries it over. Replaying a
+	// duplicated prepare record is harmless.
+	d.mu.Lock()
+	if _, ok := d.mu.prepared[string(xid)]; ok {
+		d.mu.Unlock()
+		return fmt.Errorf("pebble: transaction %q is already prepared", xid)
+	}
+	d.mu.prepared[string(xid)] = append([]byte(nil), b.data...)
+	d.mu.Unlock()
+
+	if err := d.Apply(b, opts); err != nil {
+		d.mu.Lock()
+		delete(d.mu.prepared, string(xid))
+		d.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// CommitPrepared performs the second phase of a two-phase commit, atomically
+// applying the batch prepared as the transaction xid. It returns
+// ErrNotPrepared if there is no such prepared transaction.
+//
+// The commit record written to the WAL contains the batch's entries, so
+// recovery does not depend on the prepare record once the commit is durable.
+// If CommitPrepared returns an error the transaction remains prepared.
+func (d *DB) CommitPrepared(xid []byte, opts *db.WriteOptions) error {
+	record, err := d.resolvePrepared(xid)
+	if err != nil {
+		return err
+	}
+	b := newBatch(d)
+	defer b.release()
+	b.appendMarker(db.InternalKeyKindCommitXID, xid)
+
+	// Skip the header and marker of the prepare record.
+	entries := batchReader(record[batchHeaderLen:])
+	entries.next()
+	b.data = append(b.data, entries...)
+	var count uint32
+	for iter := entries; ; {
+		kind, _, _, ok := iter.next()
+		if !ok {
+			break
+		}
+		if kind != db.InternalKeyKindLogData {
+			count++
+		}
+	}
+	b.setCount(count)
+	b.refreshMemTableSize()
+
+	if err := d.Apply(b, opts); err != nil {
+		d.unresolvePrepared(xid, record)
+		return err
+	}
+	return nil
+}
+
+// RollbackPrepared discards the batch prepared as the transaction xid. It
+// returns ErrNotPrepared if there is no such prepared transaction. If
+// RollbackPrepared returns an error the transaction remains prepared.
+func (d *DB) RollbackPrepared(xid []byte, opts *db.WriteOptions) error {
+	record, err := d.resolvePrepared(xid)
+	if err != nil {
+		return err
+	}
+	b := newBatch(d)
+	defer b.release()
+	b.appendMarker(db.InternalKeyKindRollbackXID, xid)
+	if err := d.Apply(b, opts); err != nil {
+		d.unresolvePrepared(xid, record)
+		return err
+	}
+	return nil
+}
+
+// PreparedTransactions returns the IDs of the transactions which have been
+// prepared but not yet committed or rolled back, including those recovered
+// by Open, in sorted order.
+func (d *DB) PreparedTransactions() [][]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	xids := make([][]byte, 0, len(d.mu.prepared))
+	for xid := range d.mu.prepared {
+		xids = append(xids, []byte(xid))
+	}
+	sort.Slice(xids, func(i, j int) bool {
+		return bytes.Compare(xids[i], xids[j]) < 0
+	})
+	return xids
+}
+
+// resolvePrepared removes the transaction xid from the prepared set, returning
+// its prepare record. The transaction is removed before its commit or
+// rollback record is written so that a concurrent switch to a new WAL does not
+// carry it over, and so that it cannot be resolved twice.
+func (d *DB) resolvePrepared(xid []byte) ([]byte, error) {
+	if d.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	record, ok := d.mu.prepared[string(xid)]
+	if !ok {
+		return nil, ErrNotPrepared
+	}
+	delete(d.mu.prepared, string(xid))
+	return record, nil
+}
+
+// unresolvePrepared returns the transaction xid to the prepared set after its
+// commit or rollback failed.
+func (d *DB) unresolvePrepared(xid, record []byte) {
+	d.mu.Lock()
+	d.mu.prepared[string(xid)] = record
+	d.mu.Unlock()
+}
+
+// replayPrepared updates the prepared set for a batch read from the WAL. It
+// returns true if the batch is a prepare record, whose entries must not be
+// applied until the transaction commits.
+//
+// d.mu must be held when calling this.
+func (d *DB) replayPrepared(b *Batch) bool {
+	iter := b.iter()
+	kind, xid, _, ok := iter.next()
+	if !ok {
+		return false
+	}
+	switch kind {
+	case db.InternalKeyKindBeginPrepareXID:
+		d.mu.prepared[string(xid)] = append([]byte(nil), b.data...)
+		return true
+	case db.InternalKeyKindCommitXID, db.InternalKeyKindRollbackXID:
+		delete(d.mu.prepared, string(xid))
+	}
+	return false
+}
+
+// writePrepared writes the prepare records of the prepared transactions to
+// the current WAL and syncs it, so that the transactions survive the deletion
+// of the older WALs which contain their original prepare records.
+//
+// d.mu must be held when calling this.
+func (d *DB) writePrepared() error {
+	if len(d.mu.prepared) == 0 {
+		return nil
+	}
+	for _, record := range d.mu.prepared {
+		if _, err := d.mu.log.WriteRecord(record); err != nil {
+			return err
+		}
+	}
+	return d.mu.log.Sync()
+}
@@ -0,0 +1,252 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func preparedString(d *DB) string {
+	var xids []string
+	for _, xid := range d.PreparedTransactions() {
+		xids = append(xids, string(xid))
+	}
+	return strings.Join(xids, " ")
+}
+
+func scanString(t *testing.T, d *DB) string {
+	t.Helper()
+	iter := d.NewIter(nil)
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(keys, " ")
+}
+
+func prepareBatch(t *testing.T, d *DB, xid string, keys ...string) {
+	t.Helper()
+	b := d.NewBatch()
+	for _, key := range keys {
+		if err := b.Set([]byte(key), []byte(xid), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Prepare([]byte(xid), b, db.Sync); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	seqNum := atomic.LoadUint64(&d.mu.versions.logSeqNum)
+	prepareBatch(t, d, "tx1", "a", "b")
+	prepareBatch(t, d, "tx2", "c")
+
+	// Prepared batches do not consume sequence numbers and are not visible.
+	if s := atomic.LoadUint64(&d.mu.versions.logSeqNum); s != seqNum {
+		t.Fatalf("expected sequence number %d, but found %d", seqNum, s)
+	}
+	if s := scanString(t, d); s != "" {
+		t.Fatalf("expected no keys, but found %s", s)
+	}
+	if s := preparedString(d); s != "tx1 tx2" {
+		t.Fatalf("expected tx1 tx2, but found %s", s)
+	}
+	if err := d.Prepare([]byte("tx1"), d.NewBatch(), nil); err == nil {
+		t.Fatalf("expected an error preparing tx1 twice")
+	}
+
+	if err := d.CommitPrepared([]byte("tx1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := scanString(t, d); s != "a:tx1 b:tx1" {
+		t.Fatalf("expected a:tx1 b:tx1, but found %s", s)
+	}
+	if s := atomic.LoadUint64(&d.mu.versions.logSeqNum); s != seqNum+2 {
+		t.Fatalf("expected sequence number %d, but found %d", seqNum+2, s)
+	}
+
+	if err := d.RollbackPrepared([]byte("tx2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := scanString(t, d); s != "a:tx1 b:tx1" {
+		t.Fatalf("expected a:tx1 b:tx1, but found %s", s)
+	}
+	if s := preparedString(d); s != "" {
+		t.Fatalf("expected no prepared transactions, but found %s", s)
+	}
+
+	for _, xid := range []string{"tx1", "tx2", "tx3"} {
+		if err := d.CommitPrepared([]byte(xid), nil); err != ErrNotPrepared {
+			t.Fatalf("%s: expected %v, but found %v", xid, ErrNotPrepared, err)
+		}
+		if err := d.RollbackPrepared([]byte(xid), nil); err != ErrNotPrepared {
+			t.Fatalf("%s: expected %v, but found %v", xid, ErrNotPrepared, err)
+		}
+	}
+}
+
+func TestPrepareRecovery(t *testing.T) {
+	opts := &db.Options{
+		Storage: storage.NewMem(),
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prepareBatch(t, d, "tx1", "a")
+	prepareBatch(t, d, "tx2", "b")
+	prepareBatch(t, d, "tx3", "c")
+	if err := d.CommitPrepared([]byte("tx2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RollbackPrepared([]byte("tx3"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("d"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	logNum := d.mu.log.number
+	d.mu.Unlock()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := DumpWAL(&buf, dbFilename("", fileTypeLog, logNum), opts); err != nil {
+		t.Fatal(err)
+	}
+	expected := `record 0: seqnum=1 count=0 len=24
+    BEGINPREPARE("tx1")
+    SET("a", "tx1")
+record 1: seqnum=1 count=0 len=24
+    BEGINPREPARE("tx2")
+    SET("b", "tx2")
+record 2: seqnum=1 count=0 len=24
+    BEGINPREPARE("tx3")
+    SET("c", "tx3")
+record 3: seqnum=1 count=1 len=24
+    COMMIT("tx2")
+    SET("b", "tx2") #1
+record 4: seqnum=2 count=0 len=17
+    ROLLBACK("tx3")
+record 5: seqnum=2 count=1 len=17
+    SET("d", "1") #2
+`
+	if s := buf.String(); s != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, s)
+	}
+
+	// Recovery restores the transaction which was prepared but not resolved,
+	// without applying it.
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := preparedString(d); s != "tx1" {
+		t.Fatalf("expected tx1, but found %s", s)
+	}
+	if s := scanString(t, d); s != "b:tx2 d:1" {
+		t.Fatalf("expected b:tx2 d:1, but found %s", s)
+	}
+	if err := d.Set([]byte("e"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CommitPrepared([]byte("tx1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := scanString(t, d); s != "a:tx1 b:tx2 d:1 e:1" {
+		t.Fatalf("expected a:tx1 b:tx2 d:1 e:1, but found %s", s)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := preparedString(d); s != "" {
+		t.Fatalf("expected no prepared transactions, but found %s", s)
+	}
+	if s := scanString(t, d); s != "a:tx1 b:tx2 d:1 e:1" {
+		t.Fatalf("expected a:tx1 b:tx2 d:1 e:1, but found %s", s)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrepareLogSwitch(t *testing.T) {
+	mem := storage.NewMem()
+	opts := &db.Options{
+		Storage: mem,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prepareBatch(t, d, "tx1", "a")
+	d.mu.Lock()
+	logNum := d.mu.log.number
+	d.mu.Unlock()
+
+	// Flushing switches to a new WAL and deletes the WAL containing the
+	// original prepare record.
+	for i := 0; i < 2; i++ {
+		if err := d.Set([]byte("b"), []byte(fmt.Sprint(i)), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.deleter.wait()
+	if _, err := mem.Stat(dbFilename("", fileTypeLog, logNum)); err == nil {
+		t.Fatalf("expected log %d to be deleted", logNum)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := preparedString(d); s != "tx1" {
+		t.Fatalf("expected tx1, but found %s", s)
+	}
+	if err := d.CommitPrepared([]byte("tx1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := scanString(t, d); s != "a:tx1 b:1" {
+		t.Fatalf("expected a:tx1 b:1, but found %s", s)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import "fmt"
+
+// ProtectedTable is a table protected from deletion by DB.ProtectRange.
+type ProtectedTable struct {
+	SSTableInfo
+	// Level is the level of the table when it was protected.
+	Level int
+	// Path is the path of the file holding the table. A virtual table shares
+	// the file of the table it was created from, and only the part of the file
+	// within its Smallest and Largest keys belongs to it.
+	Path string
+}
+
+// RangeProtection is a reference to the tables of a key range, returned by
+// DB.ProtectRange. The files of the tables are not deleted until the
+// reference is released, even if the tables are superseded by compactions.
+type RangeProtection struct {
+	d *DB
+	// Tables are the tables which overlapped the key range when it was
+	// protected, ordered by level. Within L0 tables are ordered from oldest to
+	// newest. Within the other levels tables are ordered by key.
+	Tables   []ProtectedTable
+	fileNums []uint64
+}
+
+// ProtectRange protects the files of the tables which currently overlap the
+// key range [span.Start, span.Limit) from deletion until the returned
+// reference is released. This allows the files to be read, such as by a
+// backup stream or an export of the range, without racing the deletion of
+// the files which a compaction makes obsolete. The writes which have not yet
+// been flushed are not held in any table, and should be flushed first if they
+// are needed.
+//
+// The files of a protected range continue to use disk space after being
+// compacted, so a reference should only be held while the files are read.
+func (d *DB) ProtectRange(span Range) (*RangeProtection, error) {
+	if d.cmp(span.Start, span.Limit) >= 0 {
+		return nil, fmt.Errorf("pebble: invalid range [%q, %q)", span.Start, span.Limit)
+	}
+	p := &RangeProtection{d: d}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	current := d.mu.versions.currentVersion()
+	for level := range current.files {
+		for i := range current.files[level] {
+			f := &current.files[level][i]
+			if d.cmp(f.largest.UserKey, span.Start) < 0 || d.cmp(f.smallest.UserKey, span.Limit) >= 0 {
+				continue
+			}
+			fileNum := f.diskFileNum()
+			p.Tables = append(p.Tables, ProtectedTable{
+				SSTableInfo: SSTableInfo{
+					FileNum:        f.fileNum,
+					Size:           f.size,
+					Smallest:       f.smallest.Clone(),
+					Largest:        f.largest.Clone(),
+					SmallestSeqNum: f.smallestSeqNum,
+					LargestSeqNum:  f.largestSeqNum,
+				},
+				Level: level,
+				Path:  dbFilename(d.dirname, fileTypeTable, fileNum),
+			})
+			p.fileNums = append(p.fileNums, fileNum)
+		}
+	}
+	if d.mu.protected == nil {
+		d.mu.protected = make(map[uint64]int)
+	}
+	for _, fileNum := range p.fileNums {
+		d.mu.protected[fileNum]++
+	}
+	return p, nil
+}
+
+// Release releases the reference to the protected tables, deleting the files
+// which have become obsolete in the meantime. It is valid to call Release
+// multiple times.
+func (p *RangeProtection) Release() {
+	d := p.d
+	if d == nil {
+		return
+	}
+	p.d = nil
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, fileNum := range p.fileNums {
+		if d.mu.protected[fileNum]--; d.mu.protected[fileNum] == 0 {
+			delete(d.mu.protected, fileNum)
+		}
+	}
+	if !d.mu.closed {
+		d.deleteObsoleteFiles()
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestProtectRange(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		FlushToL0:             true,
+		L0CompactionThreshold: 2,
+		Logger:                discardLogger{},
+		Storage:               mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	flush := func(keys ...string) {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(path string) bool {
+		d.deleter.wait()
+		_, err := mem.Stat(path)
+		return err == nil
+	}
+
+	flush("a", "b")
+	if _, err := d.ProtectRange(Range{Start: []byte("b"), Limit: []byte("b")}); err == nil {
+		t.Fatal("expected an error for an empty range")
+	}
+	none, err := d.ProtectRange(Range{Start: []byte("c"), Limit: []byte("d")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer none.Release()
+	if len(none.Tables) != 0 {
+		t.Fatalf("expected no tables, but found %+v", none.Tables)
+	}
+
+	p, err := d.ProtectRange(Range{Start: []byte("b"), Limit: []byte("c")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Tables) != 1 || p.Tables[0].Level != 0 {
+		t.Fatalf("expected 1 table in L0, but found %+v", p.Tables)
+	}
+	path := p.Tables[0].Path
+
+	// The compaction of the protected table does not delete its file.
+	flush("a", "c")
+	d.mu.Lock()
+	for (len(d.mu.versions.currentVersion().files[0]) > 0 || d.mu.compact.compacting) &&
+		d.mu.metrics.BackgroundErrors == 0 {
+		d.mu.compact.cond.Wait()
+	}
+	bgErr := d.mu.metrics.LastBackgroundError
+	d.mu.Unlock()
+	if bgErr != nil {
+		t.Fatal(bgErr)
+	}
+	tables, err := d.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for level := range tables {
+		for _, info := range tables[level] {
+			if info.FileNum == p.Tables[0].FileNum {
+				t.Fatalf("expected table %06d to be compacted", info.FileNum)
+			}
+		}
+	}
+	if !exists(path) {
+		t.Fatalf("expected %s to be protected", path)
+	}
+
+	// The file is deleted once released.
+	p.Release()
+	p.Release()
+	if exists(path) {
+		t.Fatalf("expected %s to be deleted", path)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import "github.com/petermattis/pebble/db"
+
+// CorruptionMetrics holds the statistics of the corrupted blocks found by the
+// reads of the tables, and of the quarantine of the tables they belong to.
+type CorruptionMetrics struct {
+	// Reads is the number of reads which found a corrupted block.
+	Reads int64
+	// SuspectTables is the number of table files in which a corrupted block
+	// was found, and which are yet to be rewritten.
+	SuspectTables int64
+	// Rewrites is the number of suspect table files which were rewritten by a
+	// compaction, dropping their corrupted blocks.
+	Rewrites int64
+}
+
+// reportTableCorruption is the sstable.CorruptionReporter of the tables of
+// the DB. The first corruption found in a table file marks the file as
+// suspect and is reported via EventListener.TableCorruption. A suspect table
+// is rewritten by the next compaction, ahead of the compactions picked by
+// size, which skips its corrupted blocks. The keys held by those blocks are
+// lost. A suspect table in the bottommost level is not rewritten, since there
+// is no level to compact it into.
+//
+// It is invoked by reads which may hold d.mu, which is why d.suspect has its
+// own mutex, and why the compaction is scheduled asynchronously.
+func (d *DB) reportTableCorruption(err *db.CorruptionError) {
+	d.suspect.Lock()
+	d.suspect.metrics.Reads++
+	_, ok := d.suspect.tables[err.FileNum]
+	if !ok {
+		if d.suspect.tables == nil {
+			d.suspect.tables = make(map[uint64]*db.CorruptionError)
+		}
+		d.suspect.tables[err.FileNum] = err
+	}
+	d.suspect.Unlock()
+	if ok {
+		return
+	}
+
+	d.opts.Logger.Infof("table %06d is suspect: %v", err.FileNum, err)
+	if fn := d.opts.EventListener.TableCorruption; fn != nil {
+		var offset uint64
+		if err.Offset > 0 {
+			offset = uint64(err.Offset)
+		}
+		fn(db.TableCorruptionInfo{
+			FileNum: err.FileNum,
+			Offset:  offset,
+			Err:     err,
+		})
+	}
+	go func() {
+		d.mu.Lock()
+		d.maybeScheduleCompaction()
+		d.mu.Unlock()
+	}()
+}
+
+// isSuspect returns whether a corrupted block was found in the table file
+// with the given disk file number.
+func (d *DB) isSuspect(fileNum uint64) bool {
+	d.suspect.Lock()
+	_, ok := d.suspect.tables[fileNum]
+	d.suspect.Unlock()
+	return ok
+}
+
+// pruneSuspectTables forgets the suspect table files which are no longer
+// referenced by the current version, counting them as rewritten.
+//
+// d.mu must be held when calling this.
+func (d *DB) pruneSuspectTables() {
+	d.suspect.Lock()
+	defer d.suspect.Unlock()
+	if len(d.suspect.tables) == 0 {
+		return
+	}
+	live := make(map[uint64]bool)
+	current := d.mu.versions.currentVersion()
+	for level := range current.files {
+		for i := range current.files[level] {
+			live[current.files[level][i].diskFileNum()] = true
+		}
+	}
+	for fileNum := range d.suspect.tables {
+		if !live[fileNum] {
+			delete(d.suspect.tables, fileNum)
+			d.suspect.metrics.Rewrites++
+			d.opts.Logger.Infof("suspect table %06d was rewritten", fileNum)
+		}
+	}
+}
+
+// corruptionMetrics returns the statistics of the corrupted blocks found by
+// the reads of the tables.
+func (d *DB) corruptionMetrics() CorruptionMetrics {
+	d.suspect.Lock()
+	defer d.suspect.Unlock()
+	m := d.suspect.metrics
+	m.SuspectTables = int64(len(d.suspect.tables))
+	return m
+}
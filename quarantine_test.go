@@ -0,0 +1,125 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestSuspectTableRewrite(t *testing.T) {
+	mem := storage.NewMem()
+	corruptions := make(chan db.TableCorruptionInfo, 10)
+	d, err := Open("", &db.Options{
+		EventListener: db.EventListener{
+			TableCorruption: func(info db.TableCorruptionInfo) {
+				corruptions <- info
+			},
+		},
+		FlushToL0: true,
+		Levels:    []db.LevelOptions{{BlockSize: 64}},
+		Logger:    discardLogger{},
+		Storage:   mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		if err := d.Set([]byte(fmt.Sprintf("%03d", i)), []byte("value"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	tables, err := d.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables[0]) != 1 {
+		t.Fatalf("expected 1 table in L0, but found\n%s", tables)
+	}
+	fileNum := tables[0][0].FileNum
+
+	// Corrupt the first data block of the table.
+	corruptTable(t, mem, fileNum, 0)
+	d.tableCache.evict(fileNum)
+
+	// The read fails with a typed error, and the table becomes suspect.
+	_, err = d.Get([]byte("000"))
+	if _, ok := err.(*db.CorruptionError); !ok {
+		t.Fatalf("expected a corruption error, but found %v", err)
+	}
+	select {
+	case info := <-corruptions:
+		if info.FileNum != fileNum {
+			t.Fatalf("expected a corruption of table %d, but found %+v", fileNum, info)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected a corruption to be reported")
+	}
+
+	// A compaction rewrites the suspect table without its corrupted block.
+	deadline := time.Now().Add(10 * time.Second)
+	for d.Metrics().Corruption.Rewrites == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the suspect table to be rewritten, but found %+v",
+				d.Metrics().Corruption)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	m := d.Metrics().Corruption
+	if m.Reads == 0 || m.SuspectTables != 0 {
+		t.Fatalf("unexpected corruption metrics: %+v", m)
+	}
+	if _, err := d.Get([]byte("000")); err != db.ErrNotFound {
+		t.Fatalf("expected the key of the corrupted block to be lost, but found %v", err)
+	}
+	if v, err := d.Get([]byte(fmt.Sprintf("%03d", n-1))); err != nil || string(v) != "value" {
+		t.Fatalf("expected the last key to be readable, but found %q, %v", v, err)
+	}
+	select {
+	case info := <-corruptions:
+		t.Fatalf("unexpected corruption: %+v", info)
+	default:
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// corruptTable flips the bits of the byte at the given offset of a table.
+func corruptTable(t *testing.T, mem storage.Storage, fileNum uint64, offset int) {
+	filename := dbFilename("", fileTypeTable, fileNum)
+	f, err := mem.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	data[offset] ^= 0xff
+	f, err = mem.Create("tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := mem.Rename("tmp", filename); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -10,16 +10,19 @@ import (
 	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/crc"
+	"github.com/petermattis/pebble/histogram"
 )
 
 type block struct {
 	// buf[:written] has already been filled with fragments. Updated atomically.
 	written int32
-	// buf[:flushed] has already been flushed to w.
+	// buf[:flushed] has already been flushed to w. Updated atomically.
 	flushed int32
-	buf     [blockSize]byte
+	buf     []byte
 }
 
 // LogWriter writes records to an underlying io.Writer.
@@ -32,6 +35,18 @@ type LogWriter struct {
 	f flusher
 	// s is w as a syncer.
 	s syncer
+	// syncLatency, if non-nil, records the latency of the syncs of s.
+	syncLatency *histogram.Histogram
+	// format is the format of the records, and headerSize the size of its
+	// chunk headers.
+	format     format
+	headerSize int32
+	// flushBytes and flushInterval are the thresholds at which the flusher
+	// writes the records of the current block. See SetFlushThresholds.
+	flushBytes    int32
+	flushInterval time.Duration
+	// compressedBuf is the destination buffer for the compression of records.
+	compressedBuf []byte
 	// blockNumber is the zero based block number for the current block.
 	blockNumber int64
 	// err is any accumulated error. TODO(peter): This needs to be protected in
@@ -58,23 +73,30 @@ type LogWriter struct {
 		// Accumulated flush error.
 		err     error
 		pending []*block
+		// timer wakes the flusher once the flush interval of the records of
+		// the current block elapses, if timerArmed is true.
+		timer      *time.Timer
+		timerArmed bool
 	}
 }
 
 // NewLogWriter returns a new LogWriter.
-func NewLogWriter(w io.Writer) *LogWriter {
+func NewLogWriter(w io.Writer, opts ...Option) *LogWriter {
 	c, _ := w.(io.Closer)
 	f, _ := w.(flusher)
 	s, _ := w.(syncer)
+	format := makeFormat(opts)
 	r := &LogWriter{
-		w:    w,
-		c:    c,
-		f:    f,
-		s:    s,
-		free: make(chan *block, 4),
+		w:          w,
+		c:          c,
+		f:          f,
+		s:          s,
+		format:     format,
+		headerSize: int32(format.headerSize()),
+		free:       make(chan *block, 4),
 	}
 	for i := 0; i < cap(r.free); i++ {
-		r.free <- &block{}
+		r.free <- &block{buf: make([]byte, format.blockSize)}
 	}
 	r.block = <-r.free
 	r.flusher.ready.L = &r.flusher.Mutex
@@ -88,25 +110,41 @@ func (w *LogWriter) flushLoop() {
 	f.Lock()
 	defer f.Unlock()
 
+	// unflushedSince is the time at which the flusher first found records in
+	// the current block which are yet to be written, or zero if there are
+	// none.
+	var unflushedSince time.Time
 	for {
 		for {
 			if f.closed {
+				if f.timer != nil {
+					f.timer.Stop()
+				}
 				return
 			}
 			if f.flushing {
 				f.done.Wait()
 				continue
 			}
-			if len(f.pending) == 0 {
-				f.ready.Wait()
-				continue
+			if len(f.pending) > 0 || w.shouldFlushCurrent(&unflushedSince) {
+				break
 			}
-			break
+			f.ready.Wait()
 		}
 
 		pending := f.pending
 		f.pending = nil
 		f.flushing = true
+		// The records of the current block are written along with the full
+		// blocks if background flushing of partial blocks is enabled. Writes
+		// may continue to fill the block past written while it is flushed.
+		var data []byte
+		if w.flushBytes > 0 {
+			written := atomic.LoadInt32(&w.block.written)
+			data = w.block.buf[w.block.flushed:written]
+			atomic.StoreInt32(&w.block.flushed, written)
+		}
+		unflushedSince = time.Time{}
 
 		f.Unlock()
 
@@ -116,6 +154,9 @@ func (w *LogWriter) flushLoop() {
 				break
 			}
 		}
+		if err == nil && len(data) > 0 {
+			_, err = w.w.Write(data)
+		}
 
 		f.Lock()
 		f.err = err
@@ -127,12 +168,62 @@ func (w *LogWriter) flushLoop() {
 	}
 }
 
+// shouldFlushCurrent returns whether the records of the current block are to
+// be written by the flusher: once they amount to flushBytes, or once
+// flushInterval has elapsed since they were first found by the flusher, in
+// which case the timer is armed to wake the flusher.
+//
+// w.flusher.Mutex must be held when calling this.
+func (w *LogWriter) shouldFlushCurrent(unflushedSince *time.Time) bool {
+	if w.flushBytes <= 0 {
+		return false
+	}
+	n := atomic.LoadInt32(&w.block.written) - atomic.LoadInt32(&w.block.flushed)
+	if n == 0 {
+		*unflushedSince = time.Time{}
+		return false
+	}
+	if n >= w.flushBytes {
+		return true
+	}
+	now := time.Now()
+	if unflushedSince.IsZero() {
+		*unflushedSince = now
+	}
+	remaining := w.flushInterval - now.Sub(*unflushedSince)
+	if remaining <= 0 {
+		return true
+	}
+	f := &w.flusher
+	if !f.timerArmed {
+		f.timerArmed = true
+		if f.timer == nil {
+			f.timer = time.AfterFunc(remaining, func() {
+				f.Lock()
+				f.timerArmed = false
+				f.ready.Signal()
+				f.Unlock()
+			})
+		} else {
+			f.timer.Reset(remaining)
+		}
+	}
+	return false
+}
+
+// signalFlusher wakes the flusher.
+func (w *LogWriter) signalFlusher() {
+	w.flusher.Lock()
+	w.flusher.ready.Signal()
+	w.flusher.Unlock()
+}
+
 func (w *LogWriter) flushBlock(b *block) error {
 	if _, err := w.w.Write(b.buf[b.flushed:]); err != nil {
 		return err
 	}
-	b.written = 0
-	b.flushed = 0
+	atomic.StoreInt32(&b.written, 0)
+	atomic.StoreInt32(&b.flushed, 0)
 	w.free <- b
 	return nil
 }
@@ -212,7 +303,7 @@ func (w *LogWriter) flushLocked() error {
 	// the flusher lock, but it won't be part of pending.
 	written := atomic.LoadInt32(&w.block.written)
 	data := w.block.buf[w.block.flushed:written]
-	w.block.flushed = written
+	atomic.StoreInt32(&w.block.flushed, written)
 	w.flusher.Unlock()
 
 	// Flush any pending blocks.
@@ -241,6 +332,31 @@ func (w *LogWriter) flushLocked() error {
 	return nil
 }
 
+// SetFlushThresholds enables the background writing of the records of the
+// current block, which are otherwise written once the block is full or when
+// Flush or Sync is called. The flusher goroutine writes the records once they
+// amount to bytes, or once interval has elapsed since they were written,
+// keeping the syscalls off the path of WriteRecord while bounding the time the
+// records stay in memory. A non-positive bytes disables it, the default. It
+// must be called before the LogWriter is used.
+func (w *LogWriter) SetFlushThresholds(bytes int, interval time.Duration) {
+	if bytes > len(w.block.buf) {
+		bytes = len(w.block.buf)
+	}
+	// The thresholds are read by the flusher goroutine under its mutex.
+	w.flusher.Lock()
+	w.flushBytes = int32(bytes)
+	w.flushInterval = interval
+	w.flusher.Unlock()
+}
+
+// SetSyncLatencyHistogram sets the histogram recording the latency of each
+// sync of the underlying file. Syncs are not timed if it is nil, the default.
+// It must be called before the LogWriter is used.
+func (w *LogWriter) SetSyncLatencyHistogram(h *histogram.Histogram) {
+	w.syncLatency = h
+}
+
 // Sync flushes unwritten data and synchronizes the underlying file. May be
 // called concurrently with Write, Flush and itself.
 func (w *LogWriter) Sync() error {
@@ -255,7 +371,13 @@ func (w *LogWriter) Sync() error {
 	}
 
 	if w.s != nil {
-		w.err = w.s.Sync()
+		if w.syncLatency != nil {
+			start := time.Now()
+			w.err = w.s.Sync()
+			w.syncLatency.Since(start)
+		} else {
+			w.err = w.s.Sync()
+		}
 		if w.err != nil {
 			if w.closed() {
 				return nil
@@ -273,41 +395,67 @@ func (w *LogWriter) WriteRecord(p []byte) (int64, error) {
 		return -1, w.err
 	}
 
+	b := w.block
+	var unflushed int32
+	if w.flushBytes > 0 {
+		unflushed = atomic.LoadInt32(&b.written) - atomic.LoadInt32(&b.flushed)
+	}
+
+	var compression Compression
+	if w.format.compression != NoCompression {
+		w.compressedBuf = snappy.Encode(w.compressedBuf[:cap(w.compressedBuf)], p)
+		if len(w.compressedBuf) < len(p)-len(p)/8 {
+			p, compression = w.compressedBuf, w.format.compression
+		}
+	}
+
 	for i := 0; len(p) > 0; i++ {
-		p = w.emitFragment(i, p)
+		p = w.emitFragment(i, p, compression)
+	}
+
+	// Wake the flusher if the block held no unflushed records, so that it
+	// starts the flush interval, or if the records now reach the flush
+	// threshold. A full block has woken it already.
+	if w.flushBytes > 0 && w.block == b {
+		n := atomic.LoadInt32(&b.written) - atomic.LoadInt32(&b.flushed)
+		if unflushed == 0 || (unflushed < w.flushBytes && n >= w.flushBytes) {
+			w.signalFlusher()
+		}
 	}
 
-	offset := w.blockNumber*blockSize + int64(w.block.written)
-	return offset, w.err
+	return w.Size(), w.err
+}
+
+// Size returns the number of bytes of the records written so far, including
+// those which are buffered and not yet written to the underlying writer. It
+// must not be called concurrently with WriteRecord.
+func (w *LogWriter) Size() int64 {
+	return w.blockNumber*int64(w.format.blockSize) + int64(atomic.LoadInt32(&w.block.written))
 }
 
-func (w *LogWriter) emitFragment(n int, p []byte) []byte {
+func (w *LogWriter) emitFragment(n int, p []byte, compression Compression) []byte {
 	b := w.block
 	i := b.written
+	blockSize := int32(len(b.buf))
 	first := n == 0
-	last := blockSize-i-headerSize >= int32(len(p))
+	avail := blockSize - i - w.headerSize
+	if avail > maxChunkLen {
+		avail = maxChunkLen
+	}
+	last := avail >= int32(len(p))
 
-	if last {
-		if first {
-			b.buf[i+6] = fullChunkType
-		} else {
-			b.buf[i+6] = lastChunkType
-		}
-	} else {
-		if first {
-			b.buf[i+6] = firstChunkType
-		} else {
-			b.buf[i+6] = middleChunkType
-		}
+	b.buf[i+6] = chunkType(first, last, w.format.recyclable) | byte(compression)<<compressionShift
+	if w.format.recyclable {
+		binary.LittleEndian.PutUint32(b.buf[i+7:i+11], w.format.logNum)
 	}
 
-	r := copy(b.buf[i+headerSize:], p)
-	j := i + int32(headerSize+r)
+	r := copy(b.buf[i+w.headerSize:i+w.headerSize+avail], p)
+	j := i + w.headerSize + int32(r)
 	binary.LittleEndian.PutUint32(b.buf[i+0:i+4], crc.New(b.buf[i+6:j]).Value())
 	binary.LittleEndian.PutUint16(b.buf[i+4:i+6], uint16(r))
 	atomic.StoreInt32(&b.written, j)
 
-	if blockSize-b.written <= headerSize {
+	if blockSize-b.written <= w.headerSize {
 		// There is no room for another fragment in the block, so fill the
 		// remaining bytes with zeros and queue the block for flushing.
 		for i := b.written; i < blockSize; i++ {
@@ -73,6 +73,29 @@
 // The wire format allows for limited recovery in the face of data corruption:
 // on a format error (such as a checksum mismatch), the reader moves to the
 // next block and looks for the next full or first chunk.
+//
+// Writers configured with the LogNum option use the recyclable format, which
+// allows a log file to be reused without zeroing it first. Each chunk header
+// is extended to 11 bytes by a 4 byte little-endian log number, the chunk
+// types are numbered from 5 to 8, and the checksum is over the chunk type, the
+// log number and the payload. A reader detects the format of each chunk, and
+// stops at the first chunk left over from a previous use of the file: a chunk
+// with a different log number, or a chunk in the legacy format following a
+// chunk in the recyclable format. Since the records of the previous use
+// follow the last record at an arbitrary offset, a chunk with an invalid
+// length or checksum following a chunk in the recyclable format also ends the
+// log, rather than being reported as corruption.
+//
+// Writers configured with the Compress option compress the payload of
+// each record whose size it reduces, and record the compression algorithm in
+// the upper 4 bits of the type of each of the record's chunks. A reader
+// decompresses such records transparently, once the whole record is read.
+//
+// The BlockSize option selects a larger block size, which must be agreed upon
+// by the writer and the reader. The length of a chunk is limited to 65535
+// bytes, so a chunk does not fill a block larger than 64 KiB: a record is
+// split into as many chunks as needed, and a block may hold several chunks of
+// the same record.
 package record // import "github.com/petermattis/pebble/record"
 
 // The C++ Level-DB code calls this the log, but it has been renamed to record
@@ -81,10 +104,12 @@ package record // import "github.com/petermattis/pebble/record"
 // instead of "chunk", but "chunk" is shorter and less confusing.
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
 
+	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/crc"
 )
 
@@ -94,12 +119,41 @@ const (
 	firstChunkType  = 2
 	middleChunkType = 3
 	lastChunkType   = 4
+
+	// The chunk types of the recyclable format, whose header holds the log
+	// number.
+	recyclableFullChunkType   = 5
+	recyclableFirstChunkType  = 6
+	recyclableMiddleChunkType = 7
+	recyclableLastChunkType   = 8
+
+	// compressionMask selects the bits of the chunk type which hold the
+	// Compression of the record.
+	compressionMask  = 0xf0
+	compressionShift = 4
+)
+
+// Compression is the algorithm used to compress the payloads of records.
+type Compression uint8
+
+// The available compression algorithms. These values are part of the wire
+// format and should not be changed.
+const (
+	NoCompression     Compression = 0
+	SnappyCompression Compression = 1
 )
 
 const (
-	blockSize     = 32 * 1024
-	blockSizeMask = blockSize - 1
-	headerSize    = 7
+	// blockSize is the default block size, and the smallest allowed.
+	blockSize = 32 * 1024
+	// maxBlockSize is the largest block size allowed.
+	maxBlockSize = 1 << 20
+	// headerSize is the size of a chunk header in the legacy format, and
+	// recyclableHeaderSize in the recyclable format.
+	headerSize           = 7
+	recyclableHeaderSize = 11
+	// maxChunkLen is the maximum length of the payload of a chunk.
+	maxChunkLen = 1<<16 - 1
 )
 
 var (
@@ -110,10 +164,117 @@ var (
 	ErrNoLastRecord = errors.New("pebble/record: no last record exists")
 )
 
+// The errors returned for corrupted chunks.
+var (
+	errInvalidChunk     = errors.New("pebble/record: invalid chunk")
+	errHeaderOverflow   = errors.New("pebble/record: invalid chunk (header overflows block)")
+	errLengthOverflow   = errors.New("pebble/record: invalid chunk (length overflows block)")
+	errChecksumMismatch = errors.New("pebble/record: invalid chunk (checksum mismatch)")
+
+	errUnknownCompression = errors.New("pebble/record: unknown record compression")
+	errCorruptCompressed  = errors.New("pebble/record: invalid compressed record")
+)
+
+// isCorruption returns whether err is returned for a corrupted chunk.
+func isCorruption(err error) bool {
+	switch err {
+	case errInvalidChunk, errHeaderOverflow, errLengthOverflow, errChecksumMismatch,
+		errCorruptCompressed:
+		return true
+	}
+	return false
+}
+
 type flusher interface {
 	Flush() error
 }
 
+// format holds the parameters of the wire format set by the Options, and
+// whether a reader skips corrupted chunks.
+type format struct {
+	blockSize   int
+	logNum      uint32
+	recyclable  bool
+	skipCorrupt bool
+	compression Compression
+}
+
+func makeFormat(opts []Option) format {
+	f := format{blockSize: blockSize}
+	for _, opt := range opts {
+		opt(&f)
+	}
+	if f.blockSize < blockSize || f.blockSize > maxBlockSize || f.blockSize&(f.blockSize-1) != 0 {
+		panic("pebble/record: invalid block size")
+	}
+	if f.compression > SnappyCompression {
+		panic("pebble/record: unknown compression")
+	}
+	return f
+}
+
+// headerSize returns the size of the chunk headers written in the format.
+func (f *format) headerSize() int {
+	if f.recyclable {
+		return recyclableHeaderSize
+	}
+	return headerSize
+}
+
+// An Option configures the wire format read or written by a Reader, Writer
+// or LogWriter.
+type Option func(*format)
+
+// BlockSize sets the size of the blocks, which must be a power of two between
+// 32 KiB, the default, and 1 MiB. A reader must use the block size the records
+// were written with.
+func BlockSize(n int) Option {
+	return func(f *format) {
+		f.blockSize = n
+	}
+}
+
+// LogNum sets the log number of the records. A writer writes the records in
+// the recyclable format, recording logNum in each chunk. A reader stops at the
+// first chunk with another log number, which was left over from a previous use
+// of the file. A reader without a log number uses the log number of the first
+// chunk it reads, if that chunk is in the recyclable format.
+func LogNum(logNum uint32) Option {
+	return func(f *format) {
+		f.logNum = logNum
+		f.recyclable = true
+	}
+}
+
+// SkipCorruptChunks makes a reader resume reading at the next block when it
+// finds a corrupted chunk, as if Recover was called, rather than returning
+// the error from Next. A record whose chunks after the first are corrupted is
+// still reported by an error from the io.Reader returned by Next, after which
+// the next call to Next resumes. The number of bytes skipped is returned by
+// Reader.Dropped. It has no effect on a writer.
+func SkipCorruptChunks() Option {
+	return func(f *format) {
+		f.skipCorrupt = true
+	}
+}
+
+// Compress makes a LogWriter compress the payload of each record with
+// the algorithm c, unless compression does not reduce its size by at least
+// 1/8th. It has no effect on a Writer, whose records are written as they are
+// streamed, or on a Reader, which decompresses the records it finds
+// compressed.
+func Compress(c Compression) Option {
+	return func(f *format) {
+		f.compression = c
+	}
+}
+
+// isRecyclableChunkType returns whether t is a chunk type of the recyclable
+// format.
+func isRecyclableChunkType(t byte) bool {
+	return t >= recyclableFullChunkType && t <= recyclableLastChunkType
+}
+
 type syncer interface {
 	Sync() error
 }
@@ -138,14 +299,35 @@ type Reader struct {
 	last bool
 	// err is any accumulated error.
 	err error
-	// buf is the buffer.
-	buf [blockSize]byte
+	// format is the format of the records. format.recyclable is set once a
+	// chunk in the recyclable format has been read, along with format.logNum
+	// unless the LogNum option was given.
+	format format
+	// logNumSet is whether format.logNum is known.
+	logNumSet bool
+	// begin is the offset in buf of the chunk being read, and dropped is the
+	// number of bytes skipped because of corrupted chunks. See Dropped.
+	begin   int
+	dropped int64
+	// compression is the compression of the current record. The payload of a
+	// compressed record is accumulated in compressed and decompressed into
+	// decompressed by the first read of the record.
+	compression  Compression
+	compressed   bytes.Buffer
+	decompressed []byte
+	// buf is the buffer, which holds a block.
+	buf []byte
 }
 
-// NewReader returns a new reader.
-func NewReader(r io.Reader) *Reader {
+// NewReader returns a new reader. The reader reads both the legacy and the
+// recyclable formats.
+func NewReader(r io.Reader, opts ...Option) *Reader {
+	f := makeFormat(opts)
 	return &Reader{
-		r: r,
+		r:         r,
+		format:    f,
+		logNumSet: f.recyclable,
+		buf:       make([]byte, f.blockSize),
 	}
 }
 
@@ -153,7 +335,8 @@ func NewReader(r io.Reader) *Reader {
 // next block into the buffer if necessary.
 func (r *Reader) nextChunk(wantFirst bool) error {
 	for {
-		if r.j+headerSize <= r.n {
+		r.begin = r.j
+		if r.j+r.format.headerSize() <= r.n {
 			checksum := binary.LittleEndian.Uint32(r.buf[r.j+0 : r.j+4])
 			length := binary.LittleEndian.Uint16(r.buf[r.j+4 : r.j+6])
 			chunkType := r.buf[r.j+6]
@@ -165,45 +348,91 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 					// via mmap.
 					//
 					// Set r.err to be an error so r.Recover actually recovers.
+					// The zeroes are not counted as dropped.
 					r.err = errors.New("pebble/record: block appears to be zeroed")
+					r.begin = r.n
 					r.Recover()
 					continue
 				}
-				return errors.New("pebble/record: invalid chunk")
+				if r.format.recyclable {
+					return r.staleChunk(wantFirst)
+				}
+				return errInvalidChunk
 			}
 
-			r.i = r.j + headerSize
-			r.j = r.j + headerSize + int(length)
+			compression := Compression(chunkType >> compressionShift)
+			chunkType &^= compressionMask
+
+			hs := headerSize
+			if isRecyclableChunkType(chunkType) {
+				hs = recyclableHeaderSize
+				if r.j+hs > r.n {
+					if r.recovering {
+						r.dropBlock()
+						continue
+					}
+					return errHeaderOverflow
+				}
+			}
+			r.i = r.j + hs
+			r.j = r.j + hs + int(length)
 			if r.j > r.n {
 				if r.recovering {
-					r.Recover()
+					r.dropBlock()
 					continue
 				}
-				return errors.New("pebble/record: invalid chunk (length overflows block)")
+				if r.format.recyclable {
+					return r.staleChunk(wantFirst)
+				}
+				return errLengthOverflow
 			}
-			if checksum != crc.New(r.buf[r.i-1:r.j]).Value() {
+			if checksum != crc.New(r.buf[r.i-hs+6:r.j]).Value() {
 				if r.recovering {
-					r.Recover()
+					r.dropBlock()
 					continue
 				}
-				return errors.New("pebble/record: invalid chunk (checksum mismatch)")
+				if r.format.recyclable {
+					return r.staleChunk(wantFirst)
+				}
+				return errChecksumMismatch
+			}
+			if isRecyclableChunkType(chunkType) {
+				logNum := binary.LittleEndian.Uint32(r.buf[r.i-4 : r.i])
+				if !r.logNumSet {
+					r.format.logNum, r.logNumSet = logNum, true
+				}
+				if logNum != r.format.logNum {
+					// The chunk was written by a previous use of the file.
+					return r.staleChunk(wantFirst)
+				}
+				r.format.recyclable = true
+				chunkType -= recyclableFullChunkType - fullChunkType
+			} else if r.format.recyclable {
+				return r.staleChunk(wantFirst)
 			}
 			if wantFirst {
 				if chunkType != fullChunkType && chunkType != firstChunkType {
+					// The chunk belongs to a record whose first chunk was
+					// skipped.
+					r.dropped += int64(r.j - r.begin)
 					continue
 				}
+				if compression > SnappyCompression {
+					return errUnknownCompression
+				}
+				r.compression = compression
 			}
 			r.last = chunkType == fullChunkType || chunkType == lastChunkType
 			r.recovering = false
 			return nil
 		}
-		if r.n < blockSize && r.started {
+		if r.n < r.format.blockSize && r.started {
 			if r.j != r.n {
 				return io.ErrUnexpectedEOF
 			}
 			return io.EOF
 		}
-		n, err := io.ReadFull(r.r, r.buf[:])
+		n, err := io.ReadFull(r.r, r.buf)
 		if err != nil && err != io.ErrUnexpectedEOF {
 			return err
 		}
@@ -211,25 +440,55 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 	}
 }
 
+// dropBlock discards the rest of the current block, starting with the chunk
+// being read, and counts the bytes as dropped.
+func (r *Reader) dropBlock() {
+	if r.begin < r.n {
+		r.dropped += int64(r.n - r.begin)
+	}
+	r.i, r.j = r.n, r.n
+}
+
+// staleChunk returns the error for a chunk left over from a previous use of a
+// recycled log file, which ends the records of the log: io.EOF between two
+// records, and io.ErrUnexpectedEOF within a record. See the package comment.
+func (r *Reader) staleChunk(wantFirst bool) error {
+	r.i, r.j = r.n, r.n
+	if wantFirst {
+		return io.EOF
+	}
+	return io.ErrUnexpectedEOF
+}
+
 // Next returns a reader for the next record. It returns io.EOF if there are no
 // more records. The reader returned becomes stale after the next Next call,
 // and should no longer be used.
 func (r *Reader) Next() (io.Reader, error) {
 	r.seq++
 	if r.err != nil {
-		return nil, r.err
+		if !r.format.skipCorrupt || !isCorruption(r.err) {
+			return nil, r.err
+		}
+		r.Recover()
 	}
 	r.i = r.j
 	r.err = r.nextChunk(true)
+	for r.format.skipCorrupt && isCorruption(r.err) {
+		r.Recover()
+		r.err = r.nextChunk(true)
+	}
 	if r.err != nil {
 		return nil, r.err
 	}
 	r.started = true
+	if r.compression != NoCompression {
+		return &compressedReader{singleReader: singleReader{r, r.seq}}, nil
+	}
 	return singleReader{r, r.seq}, nil
 }
 
 // Recover clears any errors read so far, so that calling Next will start
-// reading from the next good 32KiB block. If there are no such blocks, Next
+// reading from the next good block. If there are no such blocks, Next
 // will return io.EOF. Recover also marks the current reader, the one most
 // recently returned by Next, as stale. If Recover is called without any
 // prior error, then Recover is a no-op.
@@ -240,12 +499,21 @@ func (r *Reader) Recover() {
 	r.recovering = true
 	r.err = nil
 	// Discard the rest of the current block.
-	r.i, r.j, r.last = r.n, r.n, false
+	r.dropBlock()
+	r.last = false
 	// Invalidate any outstanding singleReader.
 	r.seq++
 	return
 }
 
+// Dropped returns the number of bytes skipped by Recover, or because of the
+// SkipCorruptChunks option: the bytes of the blocks from each corrupted chunk
+// to the end of its block, and the chunks of the records whose first chunk was
+// skipped. The zeroed blocks left by preallocating a file are not counted.
+func (r *Reader) Dropped() int64 {
+	return r.dropped
+}
+
 // SeekRecord seeks in the underlying io.Reader such that calling r.Next
 // returns the record whose first chunk header starts at the provided offset.
 // Its behavior is undefined if the argument given is not such an offset, as
@@ -258,9 +526,9 @@ func (r *Reader) Recover() {
 // encountered an error, including io.EOF. Such errors can be cleared by
 // calling Recover. Calling SeekRecord after Recover will make calling Next
 // return the record at the given offset, instead of the record at the next
-// good 32KiB block as Recover normally would. Calling SeekRecord before
+// good block as Recover normally would. Calling SeekRecord before
 // Recover has no effect on Recover's semantics other than changing the
-// starting point for determining the next good 32KiB block.
+// starting point for determining the next good block.
 //
 // The offset is always relative to the start of the underlying io.Reader, so
 // negative values will result in an error as per io.Seeker.
@@ -276,8 +544,9 @@ func (r *Reader) SeekRecord(offset int64) error {
 	}
 
 	// Only seek to an exact block offset.
-	c := int(offset & blockSizeMask)
-	if _, r.err = s.Seek(offset&^blockSizeMask, io.SeekStart); r.err != nil {
+	mask := int64(r.format.blockSize - 1)
+	c := int(offset & mask)
+	if _, r.err = s.Seek(offset&^mask, io.SeekStart); r.err != nil {
 		return r.err
 	}
 
@@ -321,6 +590,48 @@ func (x singleReader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+// compressedReader reads a compressed record, which is read in full and
+// decompressed by the first call to Read.
+type compressedReader struct {
+	singleReader
+	// buf is the unread portion of the decompressed record, once read is set.
+	buf  []byte
+	read bool
+}
+
+func (x *compressedReader) Read(p []byte) (int, error) {
+	r := x.r
+	if r.seq != x.seq {
+		return 0, errors.New("pebble/record: stale reader")
+	}
+	if !x.read {
+		r.compressed.Reset()
+		if _, err := r.compressed.ReadFrom(x.singleReader); err != nil {
+			return 0, err
+		}
+		n, err := snappy.DecodedLen(r.compressed.Bytes())
+		if err != nil {
+			r.err = errCorruptCompressed
+			return 0, r.err
+		}
+		if cap(r.decompressed) < n {
+			r.decompressed = make([]byte, n)
+		}
+		x.buf, err = snappy.Decode(r.decompressed[:n], r.compressed.Bytes())
+		if err != nil {
+			r.err = errCorruptCompressed
+			return 0, r.err
+		}
+		x.read = true
+	}
+	if len(x.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, x.buf)
+	x.buf = x.buf[n:]
+	return n, nil
+}
+
 // Writer writes records to an underlying io.Writer.
 type Writer struct {
 	// w is the underlying writer.
@@ -351,13 +662,18 @@ type Writer struct {
 	pending bool
 	// err is any accumulated error.
 	err error
-	// buf is the buffer.
-	buf [blockSize]byte
+	// format is the format of the records, and headerSize the size of its
+	// chunk headers.
+	format     format
+	headerSize int
+	// buf is the buffer, which holds a block.
+	buf []byte
 }
 
 // NewWriter returns a new Writer.
-func NewWriter(w io.Writer) *Writer {
+func NewWriter(w io.Writer, opts ...Option) *Writer {
 	f, _ := w.(flusher)
+	format := makeFormat(opts)
 
 	var o int64
 	if s, ok := w.(io.Seeker); ok {
@@ -371,29 +687,43 @@ func NewWriter(w io.Writer) *Writer {
 		f:                f,
 		baseOffset:       o,
 		lastRecordOffset: -1,
+		format:           format,
+		headerSize:       format.headerSize(),
+		buf:              make([]byte, format.blockSize),
 	}
 }
 
 // fillHeader fills in the header for the pending chunk.
 func (w *Writer) fillHeader(last bool) {
-	if w.i+headerSize > w.j || w.j > blockSize {
+	if w.i+w.headerSize > w.j || w.j > len(w.buf) {
 		panic("pebble/record: bad writer state")
 	}
-	if last {
-		if w.first {
-			w.buf[w.i+6] = fullChunkType
-		} else {
-			w.buf[w.i+6] = lastChunkType
-		}
-	} else {
-		if w.first {
-			w.buf[w.i+6] = firstChunkType
-		} else {
-			w.buf[w.i+6] = middleChunkType
-		}
+	w.buf[w.i+6] = chunkType(w.first, last, w.format.recyclable)
+	if w.format.recyclable {
+		binary.LittleEndian.PutUint32(w.buf[w.i+7:w.i+11], w.format.logNum)
 	}
 	binary.LittleEndian.PutUint32(w.buf[w.i+0:w.i+4], crc.New(w.buf[w.i+6:w.j]).Value())
-	binary.LittleEndian.PutUint16(w.buf[w.i+4:w.i+6], uint16(w.j-w.i-headerSize))
+	binary.LittleEndian.PutUint16(w.buf[w.i+4:w.i+6], uint16(w.j-w.i-w.headerSize))
+}
+
+// chunkType returns the type of a chunk, given whether it is the first and
+// the last chunk of its record.
+func chunkType(first, last, recyclable bool) byte {
+	var t byte
+	switch {
+	case first && last:
+		t = fullChunkType
+	case first:
+		t = firstChunkType
+	case last:
+		t = lastChunkType
+	default:
+		t = middleChunkType
+	}
+	if recyclable {
+		t += recyclableFullChunkType - fullChunkType
+	}
+	return t
 }
 
 // writeBlock writes the buffered block to the underlying writer, and reserves
@@ -401,11 +731,26 @@ func (w *Writer) fillHeader(last bool) {
 func (w *Writer) writeBlock() {
 	_, w.err = w.w.Write(w.buf[w.written:])
 	w.i = 0
-	w.j = headerSize
+	w.j = w.headerSize
 	w.written = 0
 	w.blockNumber++
 }
 
+// startChunk reserves space for the header of a new chunk after the current
+// chunk, writing the buffered block if there is no room left for the header.
+func (w *Writer) startChunk() {
+	w.i = w.j
+	w.j = w.j + w.headerSize
+	// Check if there is room in the block for the header.
+	if w.j > len(w.buf) {
+		// Fill in the rest of the block with zeroes.
+		for k := w.i; k < len(w.buf); k++ {
+			w.buf[k] = 0
+		}
+		w.writeBlock()
+	}
+}
+
 // writePending finishes the current record and writes the buffer to the
 // underlying writer.
 func (w *Writer) writePending() {
@@ -456,20 +801,11 @@ func (w *Writer) Next() (io.Writer, error) {
 	if w.pending {
 		w.fillHeader(true)
 	}
-	w.i = w.j
-	w.j = w.j + headerSize
-	// Check if there is room in the block for the header.
-	if w.j > blockSize {
-		// Fill in the rest of the block with zeroes.
-		for k := w.i; k < blockSize; k++ {
-			w.buf[k] = 0
-		}
-		w.writeBlock()
-		if w.err != nil {
-			return nil, w.err
-		}
+	w.startChunk()
+	if w.err != nil {
+		return nil, w.err
 	}
-	w.lastRecordOffset = w.baseOffset + w.blockNumber*blockSize + int64(w.i)
+	w.lastRecordOffset = w.baseOffset + w.blockNumber*int64(len(w.buf)) + int64(w.i)
 	w.first = true
 	w.pending = true
 	return singleWriter{w, w.seq}, nil
@@ -489,10 +825,17 @@ func (w *Writer) WriteRecord(p []byte) (int64, error) {
 		return -1, err
 	}
 	w.writePending()
-	offset := w.blockNumber*blockSize + int64(w.j)
+	offset := w.blockNumber*int64(len(w.buf)) + int64(w.j)
 	return offset, w.err
 }
 
+// Size returns the number of bytes of records written so far, relative to
+// the offset at which writing started. This includes data that has been
+// buffered but not yet written to the underlying io.Writer.
+func (w *Writer) Size() int64 {
+	return w.blockNumber*int64(len(w.buf)) + int64(w.j)
+}
+
 // LastRecordOffset returns the offset in the underlying io.Writer of the last
 // record so far - the one created by the most recent Next call. It is the
 // offset of the first chunk header, suitable to pass to Reader.SeekRecord.
@@ -530,17 +873,29 @@ func (x singleWriter) Write(p []byte) (int, error) {
 	}
 	n0 := len(p)
 	for len(p) > 0 {
-		// Write a block, if it is full.
-		if w.j == blockSize {
+		// Write a block, if it is full, or start a new chunk, if the chunk is
+		// full.
+		if w.j == len(w.buf) {
 			w.fillHeader(false)
 			w.writeBlock()
 			if w.err != nil {
 				return 0, w.err
 			}
 			w.first = false
+		} else if w.j-w.i-w.headerSize == maxChunkLen {
+			w.fillHeader(false)
+			w.startChunk()
+			if w.err != nil {
+				return 0, w.err
+			}
+			w.first = false
 		}
 		// Copy bytes into the buffer.
-		n := copy(w.buf[w.j:], p)
+		end := w.i + w.headerSize + maxChunkLen
+		if end > len(w.buf) {
+			end = len(w.buf)
+		}
+		n := copy(w.buf[w.j:end], p)
 		w.j += n
 		p = p[n:]
 	}
@@ -6,6 +6,7 @@ package record
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -13,7 +14,11 @@ import (
 	"math/rand"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/crc"
 )
 
 func short(s string) string {
@@ -39,11 +44,11 @@ func TestZeroBlocks(t *testing.T) {
 	}
 }
 
-func testGenerator(t *testing.T, reset func(), gen func() (string, bool)) {
+func testGenerator(t *testing.T, reset func(), gen func() (string, bool), opts ...Option) {
 	buf := new(bytes.Buffer)
 
 	reset()
-	w := NewWriter(buf)
+	w := NewWriter(buf, opts...)
 	for {
 		s, ok := gen()
 		if !ok {
@@ -58,7 +63,7 @@ func testGenerator(t *testing.T, reset func(), gen func() (string, bool)) {
 	}
 
 	reset()
-	r := NewReader(buf)
+	r := NewReader(buf, opts...)
 	for {
 		s, ok := gen()
 		if !ok {
@@ -131,6 +136,30 @@ func TestRandom(t *testing.T) {
 	testGenerator(t, reset, gen)
 }
 
+func TestRecyclable(t *testing.T) {
+	const n = 1e2
+	var (
+		i int
+		r *rand.Rand
+	)
+	reset := func() {
+		i, r = 0, rand.New(rand.NewSource(0))
+	}
+	gen := func() (string, bool) {
+		if i == n {
+			return "", false
+		}
+		i++
+		return strings.Repeat(string(uint8(i)), r.Intn(3*maxChunkLen)), true
+	}
+	for _, size := range []int{blockSize, 64 << 10, maxBlockSize} {
+		t.Run(fmt.Sprintf("block-size=%d", size), func(t *testing.T) {
+			testGenerator(t, reset, gen, BlockSize(size))
+			testGenerator(t, reset, gen, BlockSize(size), LogNum(7))
+		})
+	}
+}
+
 func TestBasic(t *testing.T) {
 	testLiterals(t, []string{
 		strings.Repeat("a", 1000),
@@ -576,6 +605,76 @@ func verifyLastBlockRecover(recs *testRecords) error {
 	return nil
 }
 
+func TestSkipCorruptChunks(t *testing.T) {
+	read := func(buf []byte) (records [][]byte, errs int, dropped int64) {
+		r := NewReader(bytes.NewReader(buf), SkipCorruptChunks())
+		for {
+			rec, err := r.Next()
+			if err == io.EOF {
+				return records, errs, r.Dropped()
+			}
+			if err != nil {
+				t.Fatalf("Next: %v", err)
+			}
+			data, err := ioutil.ReadAll(rec)
+			if err != nil {
+				errs++
+				continue
+			}
+			records = append(records, data)
+		}
+	}
+
+	for _, c := range []struct {
+		block   int
+		want    []int
+		errs    int
+		dropped int64
+	}{
+		// The first chunk of the third record is corrupted, and the rest of its
+		// block is skipped.
+		{block: 4, want: []int{0, 1, 3, 4}, dropped: blockSize},
+		// A middle chunk of the first record is corrupted: reading the record
+		// fails, and its remaining chunks are skipped.
+		{block: 1, want: []int{1, 2, 3, 4}, errs: 1, dropped: 2*blockSize + 4*headerSize},
+	} {
+		t.Run(fmt.Sprintf("block=%d", c.block), func(t *testing.T) {
+			recs, err := makeTestRecords(
+				// The first record will consume 3 entire blocks but a fraction of the 4th.
+				blockSize*3,
+				// The second record will completely fill the remainder of the 4th block.
+				3*(blockSize-headerSize)-2*blockSize-2*headerSize,
+				// Consume the entirety of the 5th block.
+				blockSize-headerSize,
+				// Consume the entirety of the 6th block.
+				blockSize-headerSize,
+				// Consume roughly half of the 7th block.
+				blockSize/2,
+			)
+			if err != nil {
+				t.Fatalf("makeTestRecords: %v", err)
+			}
+			corruptBlock(recs.buf, c.block)
+
+			records, errs, dropped := read(recs.buf)
+			if len(records) != len(c.want) {
+				t.Fatalf("got %d records, want %d", len(records), len(c.want))
+			}
+			for i, j := range c.want {
+				if !bytes.Equal(records[i], recs.records[j]) {
+					t.Fatalf("record #%d: got %d bytes, want record #%d", i, len(records[i]), j)
+				}
+			}
+			if errs != c.errs {
+				t.Fatalf("got %d errors, want %d", errs, c.errs)
+			}
+			if dropped != c.dropped {
+				t.Fatalf("got %d bytes dropped, want %d", dropped, c.dropped)
+			}
+		})
+	}
+}
+
 func TestRecoverLastPartialBlock(t *testing.T) {
 	recs, err := makeTestRecords(
 		// The first record will consume 3 entire blocks but a fraction of the 4th.
@@ -781,3 +880,324 @@ func BenchmarkRecordWrite(b *testing.B) {
 		})
 	}
 }
+
+func TestLogWriterFormats(t *testing.T) {
+	records := []string{
+		strings.Repeat("a", 1000),
+		strings.Repeat("b", 3*maxChunkLen),
+		"",
+		strings.Repeat("c", 8000),
+	}
+	for _, opts := range [][]Option{
+		nil,
+		{LogNum(3)},
+		{BlockSize(maxBlockSize)},
+		{BlockSize(maxBlockSize), LogNum(3)},
+		{Compress(SnappyCompression)},
+		{LogNum(3), Compress(SnappyCompression)},
+	} {
+		buf := new(bytes.Buffer)
+		w := NewLogWriter(buf, opts...)
+		for _, rec := range records {
+			if _, err := w.WriteRecord([]byte(rec)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The reader detects the format, but must be given the block size.
+		var readerOpts []Option
+		for _, opt := range opts {
+			var f format
+			opt(&f)
+			if f.blockSize != 0 {
+				readerOpts = append(readerOpts, opt)
+			}
+		}
+		r := NewReader(buf, readerOpts...)
+		for _, rec := range records {
+			if rec == "" {
+				// LogWriter does not write empty records.
+				continue
+			}
+			rr, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			x, err := ioutil.ReadAll(rr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(x) != rec {
+				t.Fatalf("got %q, want %q", short(string(x)), short(rec))
+			}
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Fatalf("got %v, want %v", err, io.EOF)
+		}
+	}
+}
+
+func TestCompressedRecords(t *testing.T) {
+	incompressible := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+	records := [][]byte{
+		[]byte(big("compressible", 4*maxChunkLen)),
+		incompressible,
+		[]byte("x"),
+	}
+
+	buf := new(bytes.Buffer)
+	w := NewLogWriter(buf, Compress(SnappyCompression))
+	var offsets []int64
+	for _, rec := range records {
+		if _, err := w.WriteRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, w.blockNumber*blockSize+int64(w.block.written))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first record fits in a single chunk once compressed, while the
+	// other records are written uncompressed.
+	if n := offsets[0]; n >= maxChunkLen {
+		t.Fatalf("compressed record is %d bytes", n)
+	}
+	for i, off := range []int64{0, offsets[0], offsets[1]} {
+		c := Compression(buf.Bytes()[off+6] >> compressionShift)
+		if want := []Compression{SnappyCompression, NoCompression, NoCompression}[i]; c != want {
+			t.Fatalf("record %d: got compression %d, want %d", i, c, want)
+		}
+	}
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	for i, rec := range records {
+		rr, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, err := ioutil.ReadAll(rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(x, rec) {
+			t.Fatalf("record %d: got %q, want %q", i, short(string(x)), short(string(rec)))
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("got %v, want %v", err, io.EOF)
+	}
+
+	// A record flagged as compressed whose payload cannot be decompressed is
+	// reported as corrupted, even though its checksum is valid.
+	buf.Reset()
+	ww := NewWriter(buf)
+	rec, _ := ww.Next()
+	rec.Write([]byte("not snappy"))
+	if err := ww.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	b[6] |= byte(SnappyCompression) << compressionShift
+	binary.LittleEndian.PutUint32(b[0:4], crc.New(b[6:]).Value())
+	r = NewReader(bytes.NewReader(b))
+	rr, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(rr); err != errCorruptCompressed {
+		t.Fatalf("got %v, want %v", err, errCorruptCompressed)
+	}
+}
+
+// syncBuffer is a bytes.Buffer which may be written and read concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+func TestLogWriterFlushThresholds(t *testing.T) {
+	record := make([]byte, 100)
+	size := int(headerSize) + len(record)
+	waitFor := func(buf *syncBuffer, n int) {
+		deadline := time.Now().Add(10 * time.Second)
+		for buf.Len() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d bytes to be written, but found %d", n, buf.Len())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Without thresholds, a partial block is only written by Flush or Sync.
+	buf := &syncBuffer{}
+	w := NewLogWriter(buf)
+	if _, err := w.WriteRecord(record); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := buf.Len(); n != 0 {
+		t.Fatalf("expected no bytes to be written, but found %d", n)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The records are written once they reach the byte threshold.
+	buf = &syncBuffer{}
+	w = NewLogWriter(buf)
+	w.SetFlushThresholds(2*size, time.Hour)
+	if _, err := w.WriteRecord(record); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := buf.Len(); n != 0 {
+		t.Fatalf("expected no bytes to be written, but found %d", n)
+	}
+	if _, err := w.WriteRecord(record); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(buf, 2*size)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Or once the interval elapses.
+	buf = &syncBuffer{}
+	w = NewLogWriter(buf)
+	w.SetFlushThresholds(blockSize, time.Millisecond)
+	for i := 1; i <= 3; i++ {
+		if _, err := w.WriteRecord(record); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(buf, i*size)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The records written in the background, the full blocks and those
+	// written by Close make up the log.
+	buf = &syncBuffer{}
+	w = NewLogWriter(buf)
+	w.SetFlushThresholds(1000, time.Millisecond)
+	var records []string
+	for i := 0; i < 2000; i++ {
+		rec := big(fmt.Sprint(i), 1+i%300)
+		records = append(records, rec)
+		if _, err := w.WriteRecord([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(&buf.buf)
+	for _, rec := range records {
+		rr, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, err := ioutil.ReadAll(rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(x) != rec {
+			t.Fatalf("got %q, want %q", short(string(x)), short(rec))
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("got %v, want %v", err, io.EOF)
+	}
+}
+
+// TestRecycledLog tests that the records left over from a previous use of a
+// recycled log file are not read.
+func TestRecycledLog(t *testing.T) {
+	write := func(buf []byte, opts []Option, records ...string) []byte {
+		// The records are written over buf, reusing its storage.
+		out := bytes.NewBuffer(buf[:0])
+		w := NewWriter(out, opts...)
+		for _, rec := range records {
+			if _, err := w.WriteRecord([]byte(rec)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return out.Bytes()
+	}
+	read := func(buf []byte, opts ...Option) ([]string, error) {
+		r := NewReader(bytes.NewReader(buf), opts...)
+		var records []string
+		for {
+			rr, err := r.Next()
+			if err == io.EOF {
+				return records, nil
+			}
+			if err != nil {
+				return records, err
+			}
+			x, err := ioutil.ReadAll(rr)
+			if err != nil {
+				return records, err
+			}
+			records = append(records, string(x))
+		}
+	}
+
+	for _, prev := range [][]Option{nil, {LogNum(1)}} {
+		// The file previously held a long log, which is overwritten by a short
+		// one, leaving its later records in place.
+		old := make([]string, 20)
+		for i := range old {
+			old[i] = big(fmt.Sprint(i), blockSize/4)
+		}
+		buf := write(make([]byte, 0, 8*blockSize), prev, old...)
+		size := len(buf)
+		buf = write(buf, []Option{LogNum(2)}, "x", big("y", blockSize), "z")
+		buf = buf[:size]
+
+		for _, opts := range [][]Option{nil, {LogNum(2)}} {
+			records, err := read(buf, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 3 || records[0] != "x" || records[2] != "z" {
+				t.Fatalf("expected the records of log 2, but found %d records", len(records))
+			}
+		}
+
+		// A reader expecting another log number reads nothing.
+		if records, err := read(buf, LogNum(3)); err != nil || len(records) != 0 {
+			t.Fatalf("expected no records, but found %d records, %v", len(records), err)
+		}
+	}
+
+	// A record which is cut short by a chunk of a previous use of the file is
+	// incomplete: only the first block of the record of log 2 was written over
+	// the record of log 1.
+	buf := write(make([]byte, 0, 8*blockSize), []Option{LogNum(1)}, big("a", 4*blockSize))
+	cur := write(make([]byte, 0, 8*blockSize), []Option{LogNum(2)}, big("b", 2*blockSize))
+	copy(buf, cur[:blockSize])
+	if _, err := read(buf); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
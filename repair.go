@@ -0,0 +1,510 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/petermattis/pebble/arenaskl"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/record"
+	"github.com/petermattis/pebble/sstable"
+)
+
+// lostDirname is the name of the subdirectory of the DB directory that Repair
+// moves files it can no longer use into.
+const lostDirname = "lost"
+
+// Repair attempts to recover as much data as possible from the DB in the
+// specified directory. It is the recovery path for a DB whose CURRENT or
+// MANIFEST file is corrupt or missing, and should only be used when Open
+// fails. Repair:
+//
+//   - converts the salvageable records of every WAL into sstables, skipping
+//     over corrupted records,
+//   - scans every sstable to recover its key range and sequence numbers,
+//     using the sequence numbers recorded by the old MANIFESTs for ingested
+//     sstables,
+//   - re-creates the virtual sstables recorded by the old MANIFESTs in place
+//     of the sstables backing them,
+//   - writes a fresh MANIFEST which places all of the recovered sstables in
+//     L0, and points CURRENT at it.
+//
+// The old WALs and MANIFESTs, along with any sstables that could not be read,
+// are moved into a "lost" subdirectory rather than being deleted. Some data
+// may be lost or resurrected: a corrupted WAL record is dropped, and deleted
+// keys may reappear if the tombstone that deleted them was in a table that
+// could not be read.
+//
+// The format major version of the old DB is not recovered. The fresh MANIFEST
+// records opts.FormatMajorVersion, which must be at least the version the DB
+// was at in order for the DB to be safe to open with older versions of pebble.
+// The identifier of the DB is recovered from the properties of its sstables,
+// and a new identifier is generated if none of them record one. The sstables
+// converted from WALs are not marked with the identifier.
+//
+// The keys of an ingested sstable are written with a sequence number of zero,
+// and the sequence number assigned by Ingest is only recorded in the MANIFEST
+// (or in the global sequence number property of a table ingested by RocksDB).
+// It is recovered from the records of the old MANIFESTs which can still be
+// read. The keys of an ingested sstable whose sequence number cannot be
+// recovered appear older than they should.
+//
+// A virtual sstable references part of a backing sstable, the rest of whose
+// data was removed by IngestAndExcise or DeletePrefix. The virtual sstables
+// referencing a backing sstable are recovered from the last of the old
+// MANIFESTs which can still be read and which records them, and the backing
+// sstable is archived if no virtual sstable references it any longer. If the
+// virtual sstables cannot be recovered, the whole of the backing sstable is
+// recovered and the removed data reappears.
+func Repair(dirname string, opts *db.Options) error {
+	opts = opts.EnsureDefaults()
+	fs := opts.Storage
+
+	fileLock, err := fs.Lock(dbFilename(dirname, fileTypeLock, 0))
+	if err != nil {
+		return err
+	}
+	defer fileLock.Close()
+
+	r := &repairer{
+		dirname: dirname,
+		opts:    opts,
+	}
+	if err := r.findFiles(); err != nil {
+		return err
+	}
+	r.readManifests()
+	for _, fileNum := range r.logs {
+		if err := r.convertLog(fileNum); err != nil {
+			return err
+		}
+	}
+	for _, fileNum := range r.tables {
+		r.scanTable(fileNum)
+	}
+	return r.writeManifest()
+}
+
+type repairer struct {
+	dirname string
+	opts    *db.Options
+
+	nextFileNumber uint64
+	lastSequence   uint64
+
+	logs      []uint64
+	manifests []uint64
+	tables    []uint64
+	metas     []fileMetadata
+
+	// globalSeqNums maps the file number of each table recorded by the old
+	// MANIFESTs with a single sequence number to that sequence number. See
+	// readManifests.
+	globalSeqNums map[uint64]uint64
+	// virtualTables maps the file number of each backing table recorded by the
+	// old MANIFESTs to the virtual tables referencing it. A backing table
+	// which is no longer referenced maps to an empty slice. See readManifests.
+	virtualTables map[uint64][]fileMetadata
+
+	// dbID is the identifier of the DB recovered from the sstables.
+	dbID string
+}
+
+func (r *repairer) nextFileNum() uint64 {
+	x := r.nextFileNumber
+	r.nextFileNumber++
+	return x
+}
+
+func (r *repairer) markFileNumUsed(fileNum uint64) {
+	if r.nextFileNumber <= fileNum {
+		r.nextFileNumber = fileNum + 1
+	}
+}
+
+// findFiles lists the DB directory, finding the WALs, MANIFESTs and sstables
+// in it.
+func (r *repairer) findFiles() error {
+	ls, err := r.opts.Storage.List(r.dirname)
+	if err != nil {
+		return err
+	}
+	for _, filename := range ls {
+		ft, fileNum, ok := parseDBFilename(filename)
+		if !ok {
+			continue
+		}
+		r.markFileNumUsed(fileNum)
+		switch ft {
+		case fileTypeLog:
+			r.logs = append(r.logs, fileNum)
+		case fileTypeManifest:
+			r.manifests = append(r.manifests, fileNum)
+		case fileTypeTable:
+			r.tables = append(r.tables, fileNum)
+		}
+	}
+	sortFileNums := func(s []uint64) {
+		sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	}
+	sortFileNums(r.logs)
+	sortFileNums(r.manifests)
+	sortFileNums(r.tables)
+	return nil
+}
+
+// readManifests reads the salvageable records of the old MANIFESTs, finding
+// the tables which were recorded with a single sequence number. An ingested
+// table is recorded with the sequence number assigned by Ingest, which is
+// applied to all of its keys when the table is loaded. Corrupted records are
+// skipped.
+//
+// The records of each MANIFEST are also replayed to find the virtual tables
+// which remain at its end. A MANIFEST starts with a snapshot of the version
+// it was created from, so the virtual tables referencing a backing table are
+// taken from the last MANIFEST which records any virtual table referencing
+// it.
+func (r *repairer) readManifests() {
+	r.globalSeqNums = make(map[uint64]uint64)
+	r.virtualTables = make(map[uint64][]fileMetadata)
+	for _, fileNum := range r.manifests {
+		file, err := r.opts.Storage.Open(dbFilename(r.dirname, fileTypeManifest, fileNum))
+		if err != nil {
+			continue
+		}
+		live := make(map[uint64]fileMetadata)
+		backings := make(map[uint64]bool)
+		rr := record.NewReader(file)
+		for {
+			rec, err := rr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// Skip the corrupted portion of the MANIFEST.
+				rr.Recover()
+				continue
+			}
+			var ve versionEdit
+			if err := ve.decode(rec); err != nil {
+				continue
+			}
+			for df := range ve.deletedFiles {
+				delete(live, df.fileNum)
+			}
+			for _, nf := range ve.newFiles {
+				m := &nf.meta
+				if m.backingFileNum == 0 && m.smallestSeqNum == m.largestSeqNum {
+					r.globalSeqNums[m.fileNum] = m.largestSeqNum
+				}
+				if m.backingFileNum != 0 {
+					live[m.fileNum] = *m
+					backings[m.backingFileNum] = true
+				}
+			}
+		}
+		file.Close()
+
+		for backingFileNum := range backings {
+			r.virtualTables[backingFileNum] = []fileMetadata{}
+		}
+		for _, m := range live {
+			r.virtualTables[m.backingFileNum] = append(r.virtualTables[m.backingFileNum], m)
+		}
+	}
+	for _, metas := range r.virtualTables {
+		sort.Slice(metas, func(i, j int) bool { return metas[i].fileNum < metas[j].fileNum })
+	}
+}
+
+// convertLog converts the salvageable records in a WAL into one or more
+// sstables, which are added to r.tables. Corrupted records are skipped.
+func (r *repairer) convertLog(fileNum uint64) error {
+	filename := dbFilename(r.dirname, fileTypeLog, fileNum)
+	file, err := r.opts.Storage.Open(filename)
+	if err != nil {
+		// The log is unreadable. Leave it to be archived.
+		return nil
+	}
+	defer file.Close()
+
+	var (
+		b   Batch
+		buf bytes.Buffer
+		mem *memTable
+		rr  = record.NewReader(file)
+	)
+	for {
+		rec, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			_, err = io.Copy(&buf, rec)
+		}
+		if err != nil {
+			// Skip the corrupted portion of the log.
+			buf.Reset()
+			rr.Recover()
+			continue
+		}
+		if buf.Len() < batchHeaderLen {
+			buf.Reset()
+			continue
+		}
+
+		b = Batch{}
+		b.data = buf.Bytes()
+		b.refreshMemTableSize()
+		seqNum := b.seqNum()
+		if maxSeqNum := seqNum + uint64(b.count()); r.lastSequence < maxSeqNum {
+			r.lastSequence = maxSeqNum
+		}
+
+		if mem == nil {
+			mem = newMemTable(r.opts)
+		}
+		err = mem.prepare(&b)
+		if err == arenaskl.ErrArenaFull && !mem.Empty() {
+			// Write out the full memtable and retry with a new one.
+			if err := r.writeMemTable(mem); err != nil {
+				return err
+			}
+			mem = newMemTable(r.opts)
+			err = mem.prepare(&b)
+		}
+		if err == nil {
+			err = mem.apply(&b, seqNum)
+			mem.unref()
+		}
+		if err != nil {
+			// The batch is corrupt or too large to apply. Skip it.
+			buf.Reset()
+			continue
+		}
+		buf.Reset()
+	}
+
+	if mem != nil && !mem.Empty() {
+		return r.writeMemTable(mem)
+	}
+	return nil
+}
+
+// writeMemTable writes the contents of a memtable to a new sstable.
+func (r *repairer) writeMemTable(mem *memTable) (err error) {
+	fileNum := r.nextFileNum()
+	filename := dbFilename(r.dirname, fileTypeTable, fileNum)
+	file, err := r.opts.Storage.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			r.opts.Storage.Remove(filename)
+		}
+	}()
+
+	tw := sstable.NewWriter(file, r.opts, tableLevelOptions(r.opts, 0, r.opts.FormatMajorVersion))
+	iter := mem.NewIter(nil)
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := tw.Add(iter.Key(), iter.Value()); err != nil {
+			iter.Close()
+			tw.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		tw.Close()
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	r.tables = append(r.tables, fileNum)
+	return nil
+}
+
+// scanTable reads an sstable to recover its key range and sequence numbers.
+// Tables that cannot be read are archived. A backing table is replaced by the
+// virtual tables referencing it, and is archived if there are none.
+func (r *repairer) scanTable(fileNum uint64) {
+	filename := dbFilename(r.dirname, fileTypeTable, fileNum)
+	f, err := r.opts.Storage.Open(filename)
+	if err != nil {
+		r.archive(filename)
+		return
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		r.archive(filename)
+		return
+	}
+
+	tr := sstable.NewReader(f, fileNum, r.opts)
+	meta := fileMetadata{
+		fileNum:        fileNum,
+		size:           uint64(stat.Size()),
+		smallestSeqNum: db.InternalKeySeqNumMax,
+	}
+	iter := tr.NewIter(nil)
+	n := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if n == 0 {
+			meta.smallest = key.Clone()
+		}
+		meta.largest = key
+		meta.updateSeqNum(key.SeqNum())
+		n++
+	}
+	meta.largest = meta.largest.Clone()
+	if seqNum, ok := r.globalSeqNums[fileNum]; ok {
+		// The table was recorded with a single sequence number, which is
+		// applied to all of its keys as by ingestUpdateSeqNum.
+		meta.smallest.SetSeqNum(seqNum)
+		meta.largest.SetSeqNum(seqNum)
+		meta.smallestSeqNum = seqNum
+		meta.largestSeqNum = seqNum
+	}
+	dbID := tr.Properties.DBID
+	err = iter.Close()
+	err = firstError(err, tr.Close())
+	if err != nil || n == 0 {
+		r.archive(filename)
+		return
+	}
+
+	if r.dbID == "" {
+		r.dbID = dbID
+	}
+	metas := []fileMetadata{meta}
+	if virtuals, ok := r.virtualTables[fileNum]; ok {
+		if len(virtuals) == 0 {
+			r.archive(filename)
+			return
+		}
+		metas = virtuals
+	}
+	for _, m := range metas {
+		if r.lastSequence <= m.largestSeqNum {
+			r.lastSequence = m.largestSeqNum + 1
+		}
+	}
+	r.metas = append(r.metas, metas...)
+}
+
+// writeManifest renumbers the recovered tables, writes a new MANIFEST
+// containing them and points CURRENT at it. The old WALs and MANIFESTs are
+// archived.
+func (r *repairer) writeManifest() error {
+	fs := r.opts.Storage
+
+	// All of the recovered tables are placed in L0, where newer tables must
+	// have larger file numbers than older tables. Tables produced by
+	// compactions can have a larger file number than a newer L0 table, so
+	// renumber the tables in order of increasing sequence number. A backing
+	// table is renamed once, along with the first virtual table referencing
+	// it.
+	sort.SliceStable(r.metas, func(i, j int) bool {
+		return r.metas[i].largestSeqNum < r.metas[j].largestSeqNum
+	})
+	renamed := make(map[uint64]uint64)
+	for i := range r.metas {
+		m := &r.metas[i]
+		fileNum := r.nextFileNum()
+		diskFileNum, ok := renamed[m.diskFileNum()]
+		if !ok {
+			diskFileNum = fileNum
+			if m.backingFileNum != 0 {
+				diskFileNum = r.nextFileNum()
+			}
+			if err := fs.Rename(dbFilename(r.dirname, fileTypeTable, m.diskFileNum()),
+				dbFilename(r.dirname, fileTypeTable, diskFileNum)); err != nil {
+				return err
+			}
+			renamed[m.diskFileNum()] = diskFileNum
+		}
+		if m.backingFileNum != 0 {
+			m.backingFileNum = diskFileNum
+		}
+		m.fileNum = fileNum
+	}
+
+	manifestFileNum := r.nextFileNum()
+	ve := versionEdit{
+		comparatorName: r.opts.Comparer.Name,
+		// There is no log with this number. The old logs have been converted to
+		// tables and must not be replayed.
+		logNumber:    r.nextFileNum(),
+		lastSequence: r.lastSequence,
+	}
+	ve.nextFileNumber = r.nextFileNumber
+	if r.opts.FormatMajorVersion > db.FormatMostCompatible {
+		ve.formatMajorVersion = uint64(r.opts.FormatMajorVersion)
+	}
+	ve.dbID = r.dbID
+	if ve.dbID == "" && r.opts.FormatMajorVersion >= db.FormatDBID {
+		id, err := newDBID()
+		if err != nil {
+			return err
+		}
+		ve.dbID = id
+	}
+	if r.opts.FormatMajorVersion >= db.FormatMergerName {
+		ve.mergerName = r.opts.Merger.Name()
+	}
+	for i := range r.metas {
+		ve.newFiles = append(ve.newFiles, newFileEntry{level: 0, meta: r.metas[i]})
+	}
+
+	manifestFilename := dbFilename(r.dirname, fileTypeManifest, manifestFileNum)
+	f, err := fs.Create(manifestFilename)
+	if err != nil {
+		return fmt.Errorf("pebble: could not create %q: %v", manifestFilename, err)
+	}
+	recWriter := record.NewWriter(f)
+	w, err := recWriter.Next()
+	if err == nil {
+		err = ve.encode(w)
+	}
+	err = firstError(err, recWriter.Close())
+	if err == nil {
+		err = f.Sync()
+	}
+	err = firstError(err, f.Close())
+	if err == nil {
+		err = setCurrentFile(r.dirname, fs, manifestFileNum)
+	}
+	if err != nil {
+		fs.Remove(manifestFilename)
+		return err
+	}
+
+	for _, fileNum := range r.logs {
+		r.archive(dbFilename(r.dirname, fileTypeLog, fileNum))
+	}
+	for _, fileNum := range r.manifests {
+		r.archive(dbFilename(r.dirname, fileTypeManifest, fileNum))
+	}
+	return nil
+}
+
+// archive moves a file into the lost subdirectory. Errors are ignored: the
+// file is left in place.
+func (r *repairer) archive(filename string) {
+	fs := r.opts.Storage
+	lostDir := filepath.Join(r.dirname, lostDirname)
+	if err := fs.MkdirAll(lostDir, 0755); err != nil {
+		return
+	}
+	fs.Rename(filename, filepath.Join(lostDir, filepath.Base(filename)))
+}
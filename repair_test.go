@@ -0,0 +1,227 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestRepair(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	// Write several versions of "a", leaving the last one in the WAL.
+	for i, v := range []string{"1", "2", "3"} {
+		if err := d.Set([]byte("a"), []byte(v), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Set([]byte("b"+v), []byte(v), nil); err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 {
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose the MANIFEST.
+	ls, err := mem.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range ls {
+		ft, _, ok := parseDBFilename(filename)
+		if ok && ft == fileTypeManifest {
+			if err := mem.Remove(filename); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := Open("", &db.Options{Storage: mem}); err == nil {
+		t.Fatalf("expected Open to fail after MANIFEST loss")
+	}
+
+	if err := Repair("", &db.Options{Storage: mem}); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open("", &db.Options{
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	expected := map[string]string{
+		"a":  "3",
+		"b1": "1",
+		"b2": "2",
+		"b3": "3",
+	}
+	for k, v := range expected {
+		value, err := d.Get([]byte(k))
+		if err != nil {
+			t.Fatalf("%s: %v", k, err)
+		}
+		if string(value) != v {
+			t.Fatalf("%s: expected %s, but found %s", k, v, value)
+		}
+	}
+	if err := d.CheckLevels(); err != nil {
+		t.Fatal(err)
+	}
+
+	// New writes must not reuse a recovered sequence number.
+	if err := d.Set([]byte("a"), []byte("4"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := d.Get([]byte("a")); err != nil || string(value) != "4" {
+		t.Fatalf("expected 4, but found %s (%v)", value, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairIngestedTable(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ingest a newer version of "a", whose key is written with a sequence
+	// number of zero.
+	f, err := mem.Create("ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sstable.NewWriter(f, nil, db.LevelOptions{})
+	if err := w.Add(db.MakeInternalKey([]byte("a"), 0, db.InternalKeyKindSet), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ingest([]string{"ext"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose the CURRENT file. The sequence number of the ingested table is
+	// recovered from the MANIFEST.
+	if err := mem.Remove(dbFilename("", fileTypeCurrent, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Repair("", &db.Options{Storage: mem}); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open("", &db.Options{
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if value, err := d.Get([]byte("a")); err != nil || string(value) != "2" {
+		t.Fatalf("expected 2, but found %s (%v)", value, err)
+	}
+	if err := d.CheckLevels(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairVirtualTables(t *testing.T) {
+	mem := storage.NewMem()
+	opts := &db.Options{
+		FormatMajorVersion:    db.FormatVirtualSSTables,
+		L0CompactionThreshold: 100,
+		Logger:                discardLogger{},
+		Storage:               mem,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for _, k := range []string{"a", "b1", "b2", "c"} {
+		if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Excise the middle of the table, which is replaced by two virtual tables
+	// referencing it.
+	if err := d.IngestAndExcise(nil, Range{Start: []byte("b"), Limit: []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	if s := scanString(t, d); s != "a:a c:c" {
+		t.Fatalf("expected a:a c:c, but found %s", s)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose the CURRENT file. The virtual tables are recovered from the
+	// MANIFEST, so the excised keys do not reappear.
+	if err := mem.Remove(dbFilename("", fileTypeCurrent, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Repair("", opts); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if s := scanString(t, d); s != "a:a c:c" {
+		t.Fatalf("expected a:a c:c, but found %s", s)
+	}
+	var virtual int
+	for _, files := range d.mu.versions.currentVersion().files {
+		for _, f := range files {
+			if f.backingFileNum != 0 {
+				virtual++
+			}
+		}
+	}
+	if virtual != 2 {
+		t.Fatalf("expected 2 virtual tables, but found %d", virtual)
+	}
+	if err := d.CheckLevels(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/rate"
+	"github.com/petermattis/pebble/sstable"
+)
+
+var errScrubStopped = errors.New("pebble: scrubber stopped")
+
+// scrubBurst is the maximum number of bytes the scrubber reads in a burst.
+const scrubBurst = 64 << 10 // 64 KB
+
+// scrubber periodically reads every block of every live sstable, verifying
+// checksums, in order to find latent on-disk corruption. Corrupted tables are
+// reported via EventListener.TableCorruption.
+type scrubber struct {
+	d       *DB
+	limiter *rate.Limiter
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+// VerifyChecksums verifies the checksums of every block of the tables in the
+// current version which overlap the user key range [start, end). A nil start
+// or end leaves the range unbounded on that side. The tables are read from
+// disk, bypassing the caches, but their keys are not decoded, which makes it
+// much cheaper than a full scan to validate a store after a suspicious event.
+// A table holding a corrupted block becomes suspect, as when a read finds the
+// corruption, and the first corruption found is returned as a
+// *db.CorruptionError.
+func (d *DB) VerifyChecksums(start, end []byte) error {
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	current.ref()
+	d.mu.Unlock()
+	defer current.unref()
+
+	verified := make(map[uint64]bool)
+	for level := range current.files {
+		for i := range current.files[level] {
+			f := &current.files[level][i]
+			if (start != nil && d.cmp(f.largest.UserKey, start) < 0) ||
+				(end != nil && d.cmp(f.smallest.UserKey, end) >= 0) {
+				continue
+			}
+			// The virtual tables sharing a backing table are verified once.
+			if verified[f.diskFileNum()] {
+				continue
+			}
+			verified[f.diskFileNum()] = true
+			err := d.tableCache.withReader(f, func(r *sstable.Reader) error {
+				return r.VerifyChecksums()
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newScrubber(d *DB) *scrubber {
+	return &scrubber{
+		d:       d,
+		limiter: rate.NewLimiter(rate.Limit(d.opts.ScrubBytesPerSec), scrubBurst),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+}
+
+func (s *scrubber) start() {
+	go s.run()
+}
+
+// stop stops the scrubber and waits for the background goroutine to exit.
+func (s *scrubber) stop() {
+	close(s.stopCh)
+	<-s.doneCh
+}
+
+func (s *scrubber) run() {
+	defer close(s.doneCh)
+
+	interval := s.d.opts.ScrubInterval
+	for {
+		start := time.Now()
+		if err := s.scrubVersion(); err == errScrubStopped {
+			return
+		}
+		timer := time.NewTimer(interval - time.Since(start))
+		select {
+		case <-s.stopCh:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// scrubVersion scrubs every table in the current version. Each table is
+// scrubbed while referencing the version current at that time, and is skipped
+// if it is no longer live, so that the tables compacted away during the pass
+// are neither pinned nor scrubbed.
+func (s *scrubber) scrubVersion() error {
+	d := s.d
+	d.mu.Lock()
+	live := diskFileNums(d.mu.versions.currentVersion())
+	d.mu.Unlock()
+
+	fileNums := make([]uint64, 0, len(live))
+	for fileNum := range live {
+		fileNums = append(fileNums, fileNum)
+	}
+	sort.Slice(fileNums, func(i, j int) bool {
+		return fileNums[i] < fileNums[j]
+	})
+
+	var liveVersion *version
+	for _, fileNum := range fileNums {
+		d.mu.Lock()
+		// Reference the current version to prevent the table from being deleted
+		// while it is being scrubbed.
+		current := d.mu.versions.currentVersion()
+		if current != liveVersion {
+			live, liveVersion = diskFileNums(current), current
+		}
+		if !live[fileNum] {
+			d.mu.Unlock()
+			continue
+		}
+		current.ref()
+		d.mu.Unlock()
+
+		err := s.scrubTable(fileNum)
+		current.unref()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diskFileNums returns the numbers of the table files referenced by the
+// version. A backing table shared by several virtual tables is included once.
+func diskFileNums(v *version) map[uint64]bool {
+	m := make(map[uint64]bool)
+	for level := range v.files {
+		for i := range v.files[level] {
+			m[v.files[level][i].diskFileNum()] = true
+		}
+	}
+	return m
+}
+
+// scrubTable scrubs a single table, reporting any corruption that is found.
+// Only errScrubStopped is returned.
+func (s *scrubber) scrubTable(fileNum uint64) error {
+	d := s.d
+	f, err := d.opts.Storage.Open(dbFilename(d.dirname, fileTypeTable, fileNum))
+	if err != nil {
+		s.report(fileNum, 0, err)
+		return nil
+	}
+	r := sstable.NewReader(f, fileNum, d.opts)
+	offset, err := r.ScrubBlocks(s.wait)
+	r.Close()
+	if err == errScrubStopped {
+		return err
+	}
+	if err != nil {
+		s.report(fileNum, offset, err)
+	}
+	return nil
+}
+
+// wait blocks until the rate limiter allows n bytes to be read, or the
+// scrubber is stopped.
+func (s *scrubber) wait(n int) error {
+	for n > 0 {
+		k := n
+		if k > scrubBurst {
+			k = scrubBurst
+		}
+		n -= k
+
+		timer := time.NewTimer(s.limiter.ReserveN(time.Now(), k).Delay())
+		select {
+		case <-s.stopCh:
+			timer.Stop()
+			return errScrubStopped
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+func (s *scrubber) report(fileNum, offset uint64, err error) {
+	if fn := s.d.opts.EventListener.TableCorruption; fn != nil {
+		fn(db.TableCorruptionInfo{
+			FileNum: fileNum,
+			Offset:  offset,
+			Err:     err,
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestScrubber(t *testing.T) {
+	mem := storage.NewMem()
+	corruptions := make(chan db.TableCorruptionInfo, 10)
+	d, err := Open("", &db.Options{
+		EventListener: db.EventListener{
+			TableCorruption: func(info db.TableCorruptionInfo) {
+				select {
+				case corruptions <- info:
+				default:
+				}
+			},
+		},
+		Storage:       mem,
+		ScrubInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	tables, err := d.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileNum := tables[maxFlushLevel][0].FileNum
+
+	// Let the scrubber run over the uncorrupted table.
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case info := <-corruptions:
+		t.Fatalf("unexpected corruption: %+v", info)
+	default:
+	}
+
+	// Corrupt the first data block of the table.
+	filename := dbFilename("", fileTypeTable, fileNum)
+	f, err := mem.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	data[0] ^= 0xff
+	f, err = mem.Create("tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := mem.Rename("tmp", filename); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case info := <-corruptions:
+		if info.FileNum != fileNum || info.Offset != 0 ||
+			!strings.Contains(info.Err.Error(), "checksum mismatch") {
+			t.Fatalf("unexpected corruption: %+v", info)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("corruption not detected")
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Logger:  discardLogger{},
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "z"} {
+		if err := d.Set([]byte(key), []byte("value"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tables, err := d.SSTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fileNum uint64
+	for _, level := range tables {
+		for _, f := range level {
+			if string(f.Smallest.UserKey) == "z" {
+				fileNum = f.FileNum
+			}
+		}
+	}
+	if fileNum == 0 {
+		t.Fatalf("expected a table holding only \"z\", but found\n%s", tables)
+	}
+	if err := d.VerifyChecksums(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the data block of the table holding "z".
+	corruptTable(t, mem, fileNum, 0)
+	d.tableCache.evict(fileNum)
+
+	// The ranges which do not overlap the table are not affected.
+	for _, r := range [][2]string{{"a", "b"}, {"a", "z"}, {"", "z"}} {
+		var start []byte
+		if r[0] != "" {
+			start = []byte(r[0])
+		}
+		if err := d.VerifyChecksums(start, []byte(r[1])); err != nil {
+			t.Fatalf("[%s, %s): %v", r[0], r[1], err)
+		}
+	}
+	err = d.VerifyChecksums([]byte("b"), nil)
+	if ce, ok := err.(*db.CorruptionError); !ok || ce.FileNum != fileNum {
+		t.Fatalf("expected a corruption of table %d, but found %v", fileNum, err)
+	}
+
+	// The corrupted table became suspect, and is rewritten by a compaction.
+	deadline := time.Now().Add(10 * time.Second)
+	for d.Metrics().Corruption.Rewrites == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the suspect table to be rewritten, but found %+v",
+				d.Metrics().Corruption)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := d.VerifyChecksums(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
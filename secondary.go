@@ -0,0 +1,156 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// ErrNotSecondary is returned by TryCatchUpWithPrimary when the DB was not
+// opened by OpenAsSecondary.
+var ErrNotSecondary = errors.New("pebble: not a secondary instance")
+
+// maxCatchUpAttempts is the number of times TryCatchUpWithPrimary retries when
+// a log file is removed by the primary while it is being replayed.
+const maxCatchUpAttempts = 3
+
+// OpenAsSecondary opens the DB in the given directory as a secondary instance
+// of a DB which is concurrently in use by a primary instance, either in
+// another process or through another handle in the same process. The
+// secondary instance is opened with Options.ReadOnly: it does not lock the DB
+// directory and never writes to it.
+//
+// The secondary instance exposes a consistent view of the DB as of the time it
+// was opened, or as of its most recent call to TryCatchUpWithPrimary. The view
+// does not change on its own, so it is typical to call TryCatchUpWithPrimary
+// periodically to keep the secondary close behind the primary.
+func OpenAsSecondary(dirname string, opts *db.Options) (*DB, error) {
+	var o db.Options
+	if opts != nil {
+		o = *opts
+	}
+	o.ReadOnly = true
+	d, err := Open(dirname, &o)
+	if err != nil {
+		return nil, err
+	}
+	d.secondary = true
+	return d, nil
+}
+
+// TryCatchUpWithPrimary brings a secondary instance up to date with the
+// primary by reloading the MANIFEST and replaying the WAL files which have
+// not yet been flushed. It is not supported for a DB with keyspaces.
+// Iterators and snapshots created before the call are unaffected and continue
+// to see the older view.
+//
+// The primary may delete sstables which are still referenced by the view of
+// the secondary. Reading such a table returns an error, after which calling
+// TryCatchUpWithPrimary again will install a view which no longer references
+// it.
+func (d *DB) TryCatchUpWithPrimary() error {
+	if !d.secondary {
+		return ErrNotSecondary
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.mu.keyspaces) > 0 {
+		return errors.New("pebble: cannot catch up a secondary instance with keyspaces")
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := d.catchUpWithPrimary()
+		if err == nil || !os.IsNotExist(err) || attempt == maxCatchUpAttempts {
+			return err
+		}
+		// A file named by the MANIFEST was removed by the primary before it
+		// could be read, which implies the MANIFEST has since been updated.
+	}
+}
+
+// catchUpWithPrimary performs a single attempt at catching up with the
+// primary. The current view is left unchanged if an error is returned.
+//
+// d.mu must be held when calling this.
+func (d *DB) catchUpWithPrimary() error {
+	var vs versionSet
+	if err := vs.load(d.dirname, d.opts); err != nil {
+		return err
+	}
+
+	fs := d.opts.Storage
+	ls, err := fs.List(d.dirname)
+	if err != nil {
+		return err
+	}
+	var logNums []uint64
+	for _, filename := range ls {
+		ft, fn, ok := parseDBFilename(filename)
+		if ok && ft == fileTypeLog && (fn >= vs.logNumber || fn == vs.prevLogNumber) {
+			logNums = append(logNums, fn)
+		}
+	}
+	sort.Slice(logNums, func(i, j int) bool {
+		return logNums[i] < logNums[j]
+	})
+
+	// Replay the logs into a new set of memtables and prepared transactions,
+	// restoring the existing ones if the replay fails.
+	mutable, queue, prepared := d.mu.mem.mutable, d.mu.mem.queue, d.mu.prepared
+	d.mu.mem.mutable = newMemTable(d.opts)
+	d.mu.mem.queue = []*memTable{d.mu.mem.mutable}
+	d.mu.prepared = make(map[string][]byte)
+	logSeqNum := vs.logSeqNum
+	for _, fn := range logNums {
+		var ve versionEdit
+		maxSeqNum, stop, err := d.replayWAL(&ve, fs, dbFilename(d.dirname, fileTypeLog, fn), false, nil)
+		if err != nil {
+			d.mu.mem.mutable, d.mu.mem.queue, d.mu.prepared = mutable, queue, prepared
+			return err
+		}
+		if logSeqNum < maxSeqNum {
+			logSeqNum = maxSeqNum
+		}
+		if stop {
+			break
+		}
+	}
+
+	// Install the new version. The version is copied as its links belong to
+	// the list in vs.
+	v := vs.currentVersion()
+	prev := d.mu.versions.currentVersion()
+	d.mu.versions.append(&version{
+		files:           v.files,
+		compactionScore: v.compactionScore,
+		compactionLevel: v.compactionLevel,
+	})
+	d.mu.versions.logNumber = vs.logNumber
+	d.mu.versions.prevLogNumber = vs.prevLogNumber
+	d.mu.versions.markFileNumUsed(vs.nextFileNumber - 1)
+	atomic.StoreUint64(&d.mu.versions.formatMajorVersion, vs.formatMajorVersion)
+	if logSeqNum > atomic.LoadUint64(&d.mu.versions.logSeqNum) {
+		atomic.StoreUint64(&d.mu.versions.logSeqNum, logSeqNum)
+		atomic.StoreUint64(&d.mu.versions.visibleSeqNum, logSeqNum)
+	}
+
+	// Close the readers for the tables which are no longer referenced by any
+	// version.
+	live := make(map[uint64]struct{})
+	d.mu.versions.addLiveFileNums(live)
+	for _, files := range prev.files {
+		for i := range files {
+			if _, ok := live[files[i].fileNum]; !ok {
+				d.tableCache.evict(files[i].fileNum)
+			}
+		}
+	}
+	return nil
+}
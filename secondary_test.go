@@ -0,0 +1,113 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestOpenAsSecondary(t *testing.T) {
+	mem := storage.NewMem()
+	primary, err := Open("", &db.Options{
+		L0CompactionThreshold: 2,
+		Logger:                discardLogger{},
+		Storage:               mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+
+	set := func(keys ...string) {
+		for _, k := range keys {
+			if err := primary.Set([]byte(k), []byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	flush := func() {
+		if err := primary.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scan := func(iter db.Iterator) string {
+		var buf bytes.Buffer
+		for iter.First(); iter.Valid(); iter.Next() {
+			fmt.Fprintf(&buf, "%s ", iter.Key())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	set("a", "b")
+	flush()
+	set("c")
+
+	secondary, err := OpenAsSecondary("", &db.Options{
+		Logger:  discardLogger{},
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Close()
+
+	if s := scan(secondary.NewIter(nil)); s != "a b c " {
+		t.Fatalf("expected a b c, but found %s", s)
+	}
+	if err := secondary.Set([]byte("d"), nil, nil); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, but found %v", err)
+	}
+	if err := primary.TryCatchUpWithPrimary(); err != ErrNotSecondary {
+		t.Fatalf("expected ErrNotSecondary, but found %v", err)
+	}
+
+	// Changes made by the primary are not visible until the secondary catches
+	// up, and iterators created before the catch up continue to see the older
+	// view.
+	set("d")
+	primary.Delete([]byte("a"), nil)
+	if _, err := secondary.Get([]byte("d")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %v", err)
+	}
+	iter := secondary.NewIter(nil)
+	if err := secondary.TryCatchUpWithPrimary(); err != nil {
+		t.Fatal(err)
+	}
+	if s := scan(iter); s != "a b c " {
+		t.Fatalf("expected a b c, but found %s", s)
+	}
+	if s := scan(secondary.NewIter(nil)); s != "b c d " {
+		t.Fatalf("expected b c d, but found %s", s)
+	}
+
+	// The secondary follows the primary through flushes and compactions.
+	flush()
+	set("e")
+	flush()
+	primary.mu.Lock()
+	for primary.mu.compact.compacting || len(primary.mu.versions.currentVersion().files[0]) >= 2 {
+		primary.mu.compact.cond.Wait()
+	}
+	expected := primary.mu.versions.currentVersion().String()
+	primary.mu.Unlock()
+	set("f")
+	if err := secondary.TryCatchUpWithPrimary(); err != nil {
+		t.Fatal(err)
+	}
+	if s := scan(secondary.NewIter(nil)); s != "b c d e f " {
+		t.Fatalf("expected b c d e f, but found %s", s)
+	}
+	if v := secondary.mu.versions.currentVersion().String(); v != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, v)
+	}
+}
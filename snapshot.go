@@ -0,0 +1,139 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// ErrSnapshotClosed is returned by the methods of a Snapshot which has been
+// closed.
+var ErrSnapshotClosed = errors.New("pebble: snapshot is closed")
+
+// Snapshot provides a read-only point-in-time view of the DB state. Reads
+// from a snapshot see exactly the writes which had been committed when the
+// snapshot was created, regardless of any subsequent writes, flushes or
+// compactions. Creating a snapshot does not block writers, but the entries
+// which are visible to an open snapshot are retained by compactions until the
+// snapshot is closed.
+type Snapshot struct {
+	db *DB
+	// The largest sequence number visible to the snapshot.
+	seqNum uint64
+
+	// The list the snapshot is linked into, and its neighbours in that list.
+	// Protected by db.mu.
+	list       *snapshotList
+	prev, next *Snapshot
+}
+
+var _ Reader = (*Snapshot)(nil)
+
+// NewSnapshot returns a point-in-time view of the current DB state. The
+// snapshot must be closed when it is no longer needed.
+func (d *DB) NewSnapshot() *Snapshot {
+	d.mu.Lock()
+	s := &Snapshot{
+		db:     d,
+		seqNum: d.lastVisibleSeqNum(),
+	}
+	d.mu.snapshots.pushBack(s)
+	d.mu.Unlock()
+	return s
+}
+
+// Get gets the value for the given key as of the snapshot. It returns
+// ErrNotFound if the key was not present when the snapshot was created.
+//
+// The caller should not modify the contents of the returned slice, but
+// it is safe to modify the contents of the argument after Get returns.
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if s.db == nil {
+		return nil, ErrSnapshotClosed
+	}
+	value, current, err := s.db.getInternal(key, s, nil)
+	current.unref()
+	return value, err
+}
+
+// NewIter returns an iterator over the DB state as of the snapshot. The
+// iterator is unpositioned (Iterator.Valid() will return false), and can be
+// positioned via a call to SeekGE, SeekLT, First or Last.
+func (s *Snapshot) NewIter(o *db.IterOptions) db.Iterator {
+	if s.db == nil {
+		return &dbIter{err: ErrSnapshotClosed}
+	}
+	return s.db.newIterInternal(nil, s, o)
+}
+
+// Close closes the snapshot, allowing the entries which are only visible to
+// it to be dropped by subsequent compactions. It is valid to call Close
+// multiple times. Other methods should not be called after the snapshot has
+// been closed.
+func (s *Snapshot) Close() error {
+	d := s.db
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	d.mu.snapshots.remove(s)
+	d.mu.Unlock()
+	s.db = nil
+	return nil
+}
+
+// snapshotList is a doubly-linked list of the open snapshots, ordered by
+// increasing sequence number.
+type snapshotList struct {
+	root Snapshot
+}
+
+func (l *snapshotList) init() {
+	l.root.next = &l.root
+	l.root.prev = &l.root
+}
+
+func (l *snapshotList) empty() bool {
+	return l.root.next == &l.root
+}
+
+func (l *snapshotList) pushBack(s *Snapshot) {
+	if s.list != nil || s.prev != nil || s.next != nil {
+		panic("pebble: snapshot list is inconsistent")
+	}
+	s.prev = l.root.prev
+	s.prev.next = s
+	s.next = &l.root
+	s.next.prev = s
+	s.list = l
+}
+
+func (l *snapshotList) remove(s *Snapshot) {
+	if s == &l.root {
+		panic("pebble: cannot remove snapshot list root node")
+	}
+	if s.list != l {
+		panic("pebble: snapshot list is inconsistent")
+	}
+	s.prev.next = s.next
+	s.next.prev = s.prev
+	s.next = nil // avoid memory leaks
+	s.prev = nil // avoid memory leaks
+	s.list = nil // avoid memory leaks
+}
+
+// toSlice returns the sequence numbers of the snapshots in increasing order.
+func (l *snapshotList) toSlice() []uint64 {
+	if l.empty() {
+		return nil
+	}
+	var results []uint64
+	for s := l.root.next; s != &l.root; s = s.next {
+		results = append(results, s.seqNum)
+	}
+	return results
+}
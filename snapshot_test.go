@@ -0,0 +1,196 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestSnapshot(t *testing.T) {
+	d, err := Open("", &db.Options{
+		L0CompactionThreshold: 2,
+		Logger:                discardLogger{},
+		Storage:               storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	scan := func(r Reader) string {
+		iter := r.NewIter(nil)
+		var b bytes.Buffer
+		for iter.First(); iter.Valid(); iter.Next() {
+			fmt.Fprintf(&b, "%s:%s ", iter.Key(), iter.Value())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+	get := func(r Reader, key string) string {
+		v, err := r.Get([]byte(key))
+		if err != nil {
+			return err.Error()
+		}
+		return string(v)
+	}
+	set := func(key, value string) {
+		if err := d.Set([]byte(key), []byte(value), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flush := func() {
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set("a", "1")
+	set("b", "1")
+	s1 := d.NewSnapshot()
+	set("a", "2")
+	if err := d.Delete([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	set("c", "2")
+	flush()
+	s2 := d.NewSnapshot()
+	set("a", "3")
+
+	check := func() {
+		t.Helper()
+		for _, c := range []struct {
+			r        Reader
+			expected string
+			a, b     string
+		}{
+			{s1, "a:1 b:1 ", "1", "1"},
+			{s2, "a:2 c:2 ", "2", "pebble/db: not found"},
+			{d, "a:3 c:2 ", "3", "pebble/db: not found"},
+		} {
+			if s := scan(c.r); s != c.expected {
+				t.Fatalf("expected %q, but found %q", c.expected, s)
+			}
+			if s := get(c.r, "a"); s != c.a {
+				t.Fatalf("a: expected %q, but found %q", c.a, s)
+			}
+			if s := get(c.r, "b"); s != c.b {
+				t.Fatalf("b: expected %q, but found %q", c.b, s)
+			}
+		}
+	}
+	check()
+
+	// A compaction retains the entries visible to the open snapshots.
+	flush()
+	d.mu.Lock()
+	for d.mu.compact.compacting || len(d.mu.versions.currentVersion().files[0]) >= 2 {
+		d.mu.compact.cond.Wait()
+	}
+	if n := len(d.mu.versions.currentVersion().files[0]); n != 0 {
+		t.Fatalf("expected the L0 tables to be compacted, but found %d", n)
+	}
+	d.mu.Unlock()
+	check()
+
+	if err := s1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.Get([]byte("a")); err != ErrSnapshotClosed {
+		t.Fatalf("expected %v, but found %v", ErrSnapshotClosed, err)
+	}
+	if iter := s1.NewIter(nil); iter.Close() != ErrSnapshotClosed {
+		t.Fatalf("expected %v", ErrSnapshotClosed)
+	}
+	if err := s2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	empty := d.mu.snapshots.empty()
+	d.mu.Unlock()
+	if !empty {
+		t.Fatalf("expected no open snapshots")
+	}
+}
+
+func TestNewIterAt(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	scan := func(seqNum uint64) string {
+		iter := d.NewIterAt(seqNum, nil)
+		var b bytes.Buffer
+		for iter.First(); iter.Valid(); iter.Next() {
+			fmt.Fprintf(&b, "%s:%s ", iter.Key(), iter.Value())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	seqNums := []uint64{d.LatestSeqNum()}
+	expected := []string{""}
+	write := func(fn func(b *Batch), scan string) {
+		b := d.NewBatch()
+		fn(b)
+		count := uint64(b.Count())
+		if err := b.Commit(nil); err != nil {
+			t.Fatal(err)
+		}
+		// LatestSeqNum advances by the number of entries in the batch.
+		latest := d.LatestSeqNum()
+		if prev := seqNums[len(seqNums)-1]; latest != prev+count {
+			t.Fatalf("expected latest sequence number %d, but found %d", prev+count, latest)
+		}
+		seqNums = append(seqNums, latest)
+		expected = append(expected, scan)
+	}
+
+	write(func(b *Batch) {
+		_ = b.Set([]byte("a"), []byte("1"), nil)
+		_ = b.Set([]byte("b"), []byte("1"), nil)
+	}, "a:1 b:1 ")
+	write(func(b *Batch) {
+		_ = b.Set([]byte("a"), []byte("2"), nil)
+	}, "a:2 b:1 ")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	write(func(b *Batch) {
+		_ = b.Delete([]byte("b"), nil)
+		_ = b.Set([]byte("c"), []byte("3"), nil)
+	}, "a:2 c:3 ")
+
+	for i := range seqNums {
+		if s := scan(seqNums[i]); s != expected[i] {
+			t.Fatalf("%d: expected %q, but found %q", seqNums[i], expected[i], s)
+		}
+	}
+	// A sequence number between those of two writes sees the first write.
+	if s := scan(seqNums[1] - 1); s != "a:1 " {
+		t.Fatalf("expected %q, but found %q", "a:1 ", s)
+	}
+
+	iter := d.NewIterAt(d.LatestSeqNum()+1, nil)
+	if err := iter.Close(); err == nil || !strings.Contains(err.Error(), "newer than the latest") {
+		t.Fatalf("expected error, but found %v", err)
+	}
+}
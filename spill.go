@@ -0,0 +1,141 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/petermattis/pebble/batchskl"
+	"github.com/petermattis/pebble/db"
+)
+
+// spillable returns true if the batch can be committed by DB.spillBatch. The
+// entries of keyspaces and the markers of two-phase commits must be written
+// to the WAL, and the batch of a transaction must be validated in the commit
+// pipeline, so such batches are always applied to the memtable.
+func (b *Batch) spillable() bool {
+	if len(b.keyspaces) > 0 || b.validate != nil || len(b.data) <= batchHeaderLen {
+		return false
+	}
+	for iter := b.iter(); ; {
+		kind, _, _, ok := iter.next()
+		if !ok {
+			return true
+		}
+		switch kind {
+		case db.InternalKeyKindKeyspace, db.InternalKeyKindBeginPrepareXID,
+			db.InternalKeyKindCommitXID, db.InternalKeyKindRollbackXID:
+			return false
+		}
+	}
+}
+
+// spillBatch commits a batch whose entries need more memtable space than
+// Options.BatchSpillThreshold by writing them to an sstable which is ingested
+// into the DB, rather than writing the batch to the WAL and applying it to the
+// memtable. The ingested entries share a single sequence number, which
+// becomes the batch's sequence number, so the entries for each key are first
+// collapsed as by a compaction: the newest entry is kept, merge operands are
+// merged, and the entries hidden by a newer range deletion in the batch are
+// dropped. The range deletions are written as non-overlapping tombstones. The
+// log data of the batch is not written anywhere.
+//
+// spillBatch returns an error, and commits nothing, if the merge operands of a
+// key cannot be combined into a single entry.
+func (d *DB) spillBatch(b *Batch) error {
+	// Index the entries of the batch, without copying them, to read them in
+	// key order.
+	s := &Batch{batchStorage: batchStorage{
+		data:      b.data,
+		cmp:       d.cmp,
+		inlineKey: d.opts.Comparer.InlineKey,
+	}}
+	s.index = batchskl.NewSkiplist(&s.batchStorage, 0)
+	s.rangeDelIndex = batchskl.NewSkiplist(&s.batchStorage, 0)
+	for iter := s.iter(); len(iter) > 0; {
+		offset := uintptr(unsafe.Pointer(&iter[0])) - uintptr(unsafe.Pointer(&s.data[0]))
+		kind, _, _, ok := iter.next()
+		if !ok {
+			break
+		}
+		index := s.index
+		switch kind {
+		case db.InternalKeyKindLogData:
+			continue
+		case db.InternalKeyKindRangeDelete:
+			index = s.rangeDelIndex
+		}
+		if err := index.Add(uint64(offset)); err != nil {
+			return err
+		}
+	}
+	s.fragmentRangeDels()
+
+	d.mu.Lock()
+	fileNum := d.mu.versions.nextFileNum()
+	d.mu.compact.pendingOutputs[fileNum] = struct{}{}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.mu.compact.pendingOutputs, fileNum)
+		d.mu.Unlock()
+	}()
+
+	// The sstable is written to the DB directory, which Ingest requires, and
+	// is removed once Ingest has linked it in under a file number of its own.
+	filename := dbFilename(d.dirname, fileTypeTable, fileNum)
+	file, err := d.opts.Storage.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer d.opts.Storage.Remove(filename)
+
+	tw := d.newTableWriter(file, 0)
+	iter := &compactionIter{
+		cmp:   d.cmp,
+		merge: d.merge,
+		iter:  s.newInternalIter(nil),
+	}
+	frags := s.rangeDelFrags
+	addTombstones := func(limit []byte) {
+		for ; len(frags) > 0 && (limit == nil || d.cmp(frags[0].start, limit) <= 0); frags = frags[1:] {
+			if err == nil {
+				key := db.MakeInternalKey(frags[0].start, 0, db.InternalKeyKindRangeDelete)
+				err = tw.Add(key, frags[0].end)
+			}
+		}
+	}
+	var prevKey []byte
+	var havePrev bool
+	for iter.First(); err == nil && iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if havePrev && d.cmp(prevKey, key.UserKey) == 0 {
+			err = fmt.Errorf("pebble: cannot spill batch: merge operands of key %q cannot be combined",
+				key.UserKey)
+			break
+		}
+		prevKey, havePrev = append(prevKey[:0], key.UserKey...), true
+		addTombstones(key.UserKey)
+		if err == nil {
+			err = tw.Add(db.MakeInternalKey(key.UserKey, 0, key.Kind()), iter.Value())
+		}
+	}
+	addTombstones(nil)
+	err = firstError(err, iter.Close())
+	if err = firstError(err, tw.Close()); err != nil {
+		return err
+	}
+
+	var seqNum uint64
+	err = d.Ingest([]string{filename}, func(o *ingestOptions) {
+		o.seqNum = &seqNum
+	})
+	if err != nil {
+		return err
+	}
+	b.setSeqNum(seqNum)
+	return nil
+}
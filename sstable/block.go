@@ -94,6 +94,12 @@ func (w *blockWriter) estimatedSize() int {
 	return len(w.buf) + 4*(len(w.restarts)+1)
 }
 
+// bufferedSize returns the memory allocated for the buffers of the block,
+// which may exceed its estimated size as the buffers are reused.
+func (w *blockWriter) bufferedSize() int {
+	return cap(w.buf) + 4*cap(w.restarts) + cap(w.curKey) + cap(w.prevKey)
+}
+
 type blockEntry struct {
 	offset int
 	key    []byte
@@ -130,6 +136,11 @@ func (i *blockIter) init(cmp db.Compare, block block, globalSeqNum uint64) error
 	if numRestarts == 0 {
 		return errors.New("pebble/table: invalid table (block has no restart points)")
 	}
+	if 4*(1+numRestarts) > len(block) {
+		// NB: RocksDB data blocks with a hash index set the high bit of the
+		// restart count, and are not supported.
+		return errors.New("pebble/table: invalid table (bad restart count)")
+	}
 	i.cmp = cmp
 	i.restarts = len(block) - 4*(1+numRestarts)
 	i.numRestarts = numRestarts
@@ -146,13 +157,24 @@ func (i *blockIter) init(cmp db.Compare, block block, globalSeqNum uint64) error
 	return nil
 }
 
+// reset returns the iterator to its zero state while retaining its buffers,
+// allowing them to be reused by a subsequent call to init.
+func (i *blockIter) reset() {
+	*i = blockIter{
+		key:       i.key[:0],
+		cached:    i.cached[:0],
+		cachedBuf: i.cachedBuf[:0],
+	}
+}
+
 func (i *blockIter) readEntry() {
 	ptr := unsafe.Pointer(uintptr(i.ptr) + uintptr(i.offset))
 	shared, ptr := decodeVarint(ptr)
 	unshared, ptr := decodeVarint(ptr)
 	value, ptr := decodeVarint(ptr)
+	// NB: i.key is owned by the iterator and is never aliased by the cache (see
+	// Prev), so its capacity can be reused across entries without allocating.
 	i.key = append(i.key[:shared], getBytes(ptr, int(unshared))...)
-	i.key = i.key[:len(i.key):len(i.key)]
 	ptr = unsafe.Pointer(uintptr(ptr) + uintptr(unshared))
 	i.val = getBytes(ptr, int(value))
 	i.nextOffset = int(uintptr(ptr)-uintptr(i.ptr)) + int(value)
@@ -184,6 +206,23 @@ func (i *blockIter) cacheEntry() {
 	})
 }
 
+// cacheRun advances from the current entry to the last entry before
+// endOffset, caching the entries along the way so that they can be returned
+// by subsequent calls to Prev. If the current entry is the only one before
+// endOffset (which is always the case with a restart interval of 1) nothing is
+// cached, as a cache containing a single entry can never satisfy Prev.
+func (i *blockIter) cacheRun(endOffset int) {
+	if i.nextOffset >= endOffset {
+		return
+	}
+	i.cacheEntry()
+	for i.nextOffset < endOffset {
+		i.offset = i.nextOffset
+		i.readEntry()
+		i.cacheEntry()
+	}
+}
+
 // SeekGE implements InternalIterator.SeekGE, as documented in the pebble/db
 // package.
 func (i *blockIter) SeekGE(key []byte) {
@@ -221,6 +260,12 @@ func (i *blockIter) SeekGE(key []byte) {
 	}
 }
 
+// SeekPrefixGE implements InternalIterator.SeekPrefixGE, as documented in the
+// pebble/db package.
+func (i *blockIter) SeekPrefixGE(prefix, key []byte) {
+	i.SeekGE(key)
+}
+
 // SeekLT implements InternalIterator.SeekLT, as documented in the pebble/db
 // package.
 func (i *blockIter) SeekLT(key []byte) {
@@ -266,7 +311,10 @@ func (i *blockIter) SeekLT(key []byte) {
 
 		if db.InternalCompare(i.cmp, i.ikey, ikey) >= 0 {
 			// The current key is greater than or equal to our search key. Back up to
-			// the previous key which was less than our search key.
+			// the previous key which was less than our search key. Caching the
+			// current entry allows Prev to be satisfied from the cache rather than
+			// re-scanning from the restart point.
+			i.cacheEntry()
 			i.Prev()
 			return
 		}
@@ -293,13 +341,7 @@ func (i *blockIter) Last() {
 
 	i.readEntry()
 	i.clearCache()
-	i.cacheEntry()
-
-	for i.nextOffset < i.restarts {
-		i.offset = i.nextOffset
-		i.readEntry()
-		i.cacheEntry()
-	}
+	i.cacheRun(i.restarts)
 
 	i.decodeInternalKey()
 }
@@ -330,7 +372,7 @@ func (i *blockIter) Prev() bool {
 		i.nextOffset = i.offset
 		e := &i.cached[n-1]
 		i.offset = e.offset
-		i.key = e.key
+		i.key = append(i.key[:0], e.key...)
 		i.val = e.val
 		i.decodeInternalKey()
 		i.cached = i.cached[:n]
@@ -355,13 +397,7 @@ func (i *blockIter) Prev() bool {
 
 	i.readEntry()
 	i.clearCache()
-	i.cacheEntry()
-
-	for i.nextOffset < targetOffset {
-		i.offset = i.nextOffset
-		i.readEntry()
-		i.cacheEntry()
-	}
+	i.cacheRun(targetOffset)
 
 	i.decodeInternalKey()
 	return true
@@ -113,6 +113,63 @@ func TestBlockIter(t *testing.T) {
 	}
 }
 
+func TestRawBlockIterSeekLT(t *testing.T) {
+	keys := []string{"apple", "apricot", "banana", "blueberry", "cherry", "date", "fig"}
+	seeks := []string{"", "a", "apple", "applf", "apricot", "b", "banana", "bz", "cherry", "dat",
+		"date", "e", "fig", "fig\x00", "z"}
+
+	for _, r := range []int{1, 2, 3, 16} {
+		t.Run(fmt.Sprintf("restart=%d", r), func(t *testing.T) {
+			w := &rawBlockWriter{
+				blockWriter: blockWriter{restartInterval: r},
+			}
+			for _, k := range keys {
+				w.add(db.InternalKey{UserKey: []byte(k)}, nil)
+			}
+			block := w.finish()
+
+			for _, seek := range seeks {
+				i, err := newRawBlockIter(bytes.Compare, block)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The entries < seek, in reverse order.
+				var expected []string
+				for j := len(keys) - 1; j >= 0; j-- {
+					if keys[j] < seek {
+						expected = append(expected, keys[j])
+					}
+				}
+				var found []string
+				for i.SeekLT([]byte(seek)); i.Valid(); i.Prev() {
+					found = append(found, string(i.Key().UserKey))
+				}
+				if fmt.Sprint(expected) != fmt.Sprint(found) {
+					t.Fatalf("seek-lt %q: expected %q, but found %q", seek, expected, found)
+				}
+
+				// Switching direction after SeekLT returns the entry >= seek.
+				i.SeekLT([]byte(seek))
+				i.Next()
+				var next string
+				if i.Valid() {
+					next = string(i.Key().UserKey)
+				}
+				var expectedNext string
+				if n := len(expected); n < len(keys) {
+					expectedNext = keys[n]
+				}
+				if next != expectedNext {
+					t.Fatalf("seek-lt %q, next: expected %q, but found %q", seek, expectedNext, next)
+				}
+				if err := i.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func TestBlockIter2(t *testing.T) {
 	makeIkey := func(s string) db.InternalKey {
 		j := strings.Index(s, ":")
@@ -204,10 +261,57 @@ func TestBlockIter2(t *testing.T) {
 	}
 }
 
+func TestBlockIterNoAllocs(t *testing.T) {
+	for _, restartInterval := range []int{1, 4, 16} {
+		t.Run(fmt.Sprintf("restart=%d", restartInterval), func(t *testing.T) {
+			w := &blockWriter{
+				restartInterval: restartInterval,
+			}
+
+			// Use keys of varying length so that the key buffer has to grow and
+			// shrink as the iterator is repositioned.
+			var ikey db.InternalKey
+			var keys [][]byte
+			for i := 0; i < 100; i++ {
+				key := []byte(strings.Repeat(fmt.Sprintf("%03d", i), 1+i%7))
+				keys = append(keys, key)
+				ikey.UserKey = key
+				w.add(ikey, nil)
+			}
+
+			it, err := newBlockIter(bytes.Compare, w.finish())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Warm up the iterator's buffers.
+			it.Last()
+			for it.Prev() {
+			}
+
+			allocs := testing.AllocsPerRun(10, func() {
+				for it.First(); it.Valid(); it.Next() {
+				}
+				for it.Last(); it.Valid(); it.Prev() {
+				}
+				for j := range keys {
+					it.SeekGE(keys[j])
+					it.Next()
+					it.SeekLT(keys[j])
+					it.Prev()
+					it.Next()
+				}
+			})
+			if allocs != 0 {
+				t.Fatalf("expected 0 allocations, but found %.1f", allocs)
+			}
+		})
+	}
+}
+
 func BenchmarkBlockIterSeekGE(b *testing.B) {
 	const blockSize = 32 << 10
 
-	for _, restartInterval := range []int{16} {
+	for _, restartInterval := range []int{1, 16} {
 		b.Run(fmt.Sprintf("restart=%d", restartInterval),
 			func(b *testing.B) {
 				w := &blockWriter{
@@ -249,7 +353,7 @@ func BenchmarkBlockIterSeekGE(b *testing.B) {
 func BenchmarkBlockIterSeekLT(b *testing.B) {
 	const blockSize = 32 << 10
 
-	for _, restartInterval := range []int{16} {
+	for _, restartInterval := range []int{1, 16} {
 		b.Run(fmt.Sprintf("restart=%d", restartInterval),
 			func(b *testing.B) {
 				w := &blockWriter{
@@ -298,7 +402,7 @@ func BenchmarkBlockIterSeekLT(b *testing.B) {
 func BenchmarkBlockIterNext(b *testing.B) {
 	const blockSize = 32 << 10
 
-	for _, restartInterval := range []int{16} {
+	for _, restartInterval := range []int{1, 16} {
 		b.Run(fmt.Sprintf("restart=%d", restartInterval),
 			func(b *testing.B) {
 				w := &blockWriter{
@@ -330,7 +434,7 @@ func BenchmarkBlockIterNext(b *testing.B) {
 func BenchmarkBlockIterPrev(b *testing.B) {
 	const blockSize = 32 << 10
 
-	for _, restartInterval := range []int{16} {
+	for _, restartInterval := range []int{1, 16} {
 		b.Run(fmt.Sprintf("restart=%d", restartInterval),
 			func(b *testing.B) {
 				w := &blockWriter{
@@ -7,10 +7,79 @@ package sstable
 import (
 	"encoding/binary"
 	"errors"
+	"sync/atomic"
 
 	"github.com/petermattis/pebble/db"
 )
 
+// FilterMetrics holds metrics for the filter policy. The counters are updated
+// atomically and may be shared by several readers. See ReaderOption.
+type FilterMetrics struct {
+	// The number of hits for the filter policy. This is the number of times
+	// the filter policy was successfully used to avoid access of a data block.
+	Hits int64
+	// The number of misses for the filter policy. This is the number of times
+	// the filter policy was checked but was unable to filter an access of a
+	// data block.
+	Misses int64
+	// The number of misses for which the key was not found in the table. The
+	// false positive rate of the filter is FalsePositives/(Hits+FalsePositives).
+	FalsePositives int64
+}
+
+func (m *FilterMetrics) readerApply(r *Reader) {
+	r.filterMetrics = m
+}
+
+func (m *FilterMetrics) hit() {
+	if m != nil {
+		atomic.AddInt64(&m.Hits, 1)
+	}
+}
+
+func (m *FilterMetrics) miss(found bool) {
+	if m != nil {
+		atomic.AddInt64(&m.Misses, 1)
+		if !found {
+			atomic.AddInt64(&m.FalsePositives, 1)
+		}
+	}
+}
+
+// ReadStats holds the number of bytes of the blocks read by iterators, as
+// accounted by Iter.SetReadStats. The counters are updated atomically and may
+// be shared by several iterators.
+type ReadStats struct {
+	// The number of bytes of the blocks found in the block cache. Blocks are
+	// cached decompressed, so these are the decompressed sizes of the blocks.
+	CacheBytes int64
+	// The number of bytes of the blocks found in the compressed block cache,
+	// which are the sizes of the blocks as stored. See
+	// db.Options.CompressedCache.
+	CompressedCacheBytes int64
+	// The number of bytes of the blocks read from the table files: the sizes
+	// of the blocks as stored, which may be compressed, and their trailers.
+	FileBytes int64
+}
+
+func (s *ReadStats) cacheRead(n int) {
+	if s != nil {
+		atomic.AddInt64(&s.CacheBytes, int64(n))
+	}
+}
+
+func (s *ReadStats) compressedCacheRead(n int) {
+	if s != nil {
+		atomic.AddInt64(&s.CompressedCacheBytes, int64(n))
+	}
+}
+
+func (s *ReadStats) fileRead(n uint64) {
+	if s != nil {
+		atomic.AddInt64(&s.FileBytes, int64(n))
+	}
+}
+
 type filterWriter interface {
 	addKey(key []byte)
 	finishBlock(blockOffset uint64) error
@@ -204,3 +273,152 @@ func (f *tableFilterWriter) metaName() string {
 func (f *tableFilterWriter) policyName() string {
 	return f.policy.Name()
 }
+
+type partitionedFilterReader struct {
+	reader *Reader
+	policy db.FilterPolicy
+	// index maps the last key of each partition to the handle of the
+	// partition's filter block.
+	index block
+}
+
+func newPartitionedFilterReader(
+	r *Reader, index block, policy db.FilterPolicy,
+) *partitionedFilterReader {
+	if len(index) < 4 {
+		return nil
+	}
+	return &partitionedFilterReader{
+		reader: r,
+		policy: policy,
+		index:  index,
+	}
+}
+
+// mayContain checks the partition covering key, recording the bytes read in
+// stats if it is non-nil. Errors encountered while reading the partition are
+// treated as a positive result, leaving it to the subsequent read of the data
+// block to surface the error.
+func (f *partitionedFilterReader) mayContain(key []byte, stats *ReadStats) bool {
+	i, err := newRawBlockIter(f.reader.compare, f.index)
+	if err != nil {
+		return true
+	}
+	defer i.Close()
+	i.SeekGE(key)
+	if !i.Valid() {
+		// The key is larger than the last key in the table.
+		return false
+	}
+	bh, n := decodeBlockHandle(i.Value())
+	if n == 0 {
+		return true
+	}
+	data, err := f.reader.readBlock(bh, stats, true /* fillCache */)
+	if err != nil {
+		return true
+	}
+	return f.policy.MayContain(db.TableFilter, data, key)
+}
+
+// partitions returns the handles of the filter partitions.
+func (f *partitionedFilterReader) partitions() ([]blockHandle, error) {
+	i, err := newRawBlockIter(f.reader.compare, f.index)
+	if err != nil {
+		return nil, err
+	}
+	var handles []blockHandle
+	for i.First(); i.Valid(); i.Next() {
+		bh, n := decodeBlockHandle(i.Value())
+		if n == 0 {
+			return nil, errors.New("pebble/table: invalid table (bad filter partition handle)")
+		}
+		handles = append(handles, bh)
+	}
+	return handles, i.Close()
+}
+
+// partitionedFilterWriter writes a table-level filter which is split into
+// partitions. A partition is finished at the first data block boundary after
+// partitionSize bytes of data blocks have been written since the start of the
+// partition, which keeps a user key whose versions span several data blocks
+// in the partition in which it first appears. The partitions are buffered and
+// written as separate blocks when the table is finished, and the filter block
+// itself is an index from the last key of each partition to the handle of its
+// block.
+type partitionedFilterWriter struct {
+	policy        db.FilterPolicy
+	writer        db.FilterWriter
+	partitionSize uint64
+	writeBlock    func(b []byte) (blockHandle, error)
+	// count is the count of the number of keys added to the current partition.
+	count int
+	// start is the offset of the first data block in the current partition.
+	start uint64
+	// lastKey is the last key added to the current partition.
+	lastKey []byte
+	// keys and data are the last keys and filters of the finished partitions.
+	keys [][]byte
+	data [][]byte
+	// size is the total size of the partition blocks written.
+	size uint64
+}
+
+func newPartitionedFilterWriter(
+	policy db.FilterPolicy, partitionSize int, writeBlock func(b []byte) (blockHandle, error),
+) *partitionedFilterWriter {
+	return &partitionedFilterWriter{
+		policy:        policy,
+		writer:        policy.NewWriter(db.TableFilter),
+		partitionSize: uint64(partitionSize),
+		writeBlock:    writeBlock,
+	}
+}
+
+func (f *partitionedFilterWriter) addKey(key []byte) {
+	f.count++
+	f.writer.AddKey(key)
+	f.lastKey = append(f.lastKey[:0], key...)
+}
+
+func (f *partitionedFilterWriter) finishPartition() {
+	f.keys = append(f.keys, append([]byte(nil), f.lastKey...))
+	f.data = append(f.data, f.writer.Finish(nil))
+	f.count = 0
+}
+
+func (f *partitionedFilterWriter) finishBlock(blockOffset uint64) error {
+	if f.count > 0 && blockOffset-f.start >= f.partitionSize {
+		f.finishPartition()
+		f.start = blockOffset
+	}
+	return nil
+}
+
+func (f *partitionedFilterWriter) finish() ([]byte, error) {
+	if f.count > 0 {
+		f.finishPartition()
+	}
+	var index rawBlockWriter
+	index.restartInterval = 1
+	var tmp [2 * binary.MaxVarintLen64]byte
+	for i := range f.data {
+		bh, err := f.writeBlock(f.data[i])
+		if err != nil {
+			return nil, err
+		}
+		f.size += bh.length
+		n := encodeBlockHandle(tmp[:], bh)
+		index.add(db.InternalKey{UserKey: f.keys[i]}, tmp[:n])
+	}
+	f.keys, f.data = nil, nil
+	return index.finish(), nil
+}
+
+func (f *partitionedFilterWriter) metaName() string {
+	return "partitionedfilter." + f.policy.Name()
+}
+
+func (f *partitionedFilterWriter) policyName() string {
+	return f.policy.Name()
+}
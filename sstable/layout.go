@@ -0,0 +1,169 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// BlockHandle is the file offset and length of a block.
+type BlockHandle struct {
+	Offset, Length uint64
+}
+
+// Layout describes the block organization of an sstable.
+type Layout struct {
+	Data  []BlockHandle
+	Index BlockHandle
+	// Filter is the filter block. For a partitioned filter it is the index of
+	// the partitions, and the partitions themselves are listed in
+	// FilterPartitions.
+	Filter           BlockHandle
+	FilterPartitions []BlockHandle
+	Properties       BlockHandle
+	MetaIndex        BlockHandle
+	Footer           BlockHandle
+}
+
+// BlockInfo summarizes the contents of a single data or index block.
+type BlockInfo struct {
+	BlockHandle
+	// Entries is the number of key/value entries in the block.
+	Entries int
+	// Restarts is the number of restart points in the block. Every restart
+	// point begins an entry whose key is stored without prefix compression, so
+	// Entries/Restarts approximates the restart interval the block was written
+	// with.
+	Restarts int
+	// First and Last are the first and last keys in the block.
+	First, Last db.InternalKey
+}
+
+// Describe returns a description of the layout, listing each block in file
+// order along with its offset and length. A block's length does not include
+// its trailer. If verbose is true, the number of entries, the number of
+// restart points and the key bounds of every data and index block are
+// printed as well, which requires reading the blocks from r.
+func (l *Layout) Describe(w io.Writer, verbose bool, r *Reader) {
+	type block struct {
+		BlockHandle
+		name string
+	}
+	var blocks []block
+	for i := range l.Data {
+		blocks = append(blocks, block{l.Data[i], "data"})
+	}
+	if l.Index.Length != 0 {
+		blocks = append(blocks, block{l.Index, "index"})
+	}
+	for i := range l.FilterPartitions {
+		blocks = append(blocks, block{l.FilterPartitions[i], "filter-partition"})
+	}
+	if l.Filter.Length != 0 {
+		blocks = append(blocks, block{l.Filter, "filter"})
+	}
+	if l.Properties.Length != 0 {
+		blocks = append(blocks, block{l.Properties, "properties"})
+	}
+	if l.MetaIndex.Length != 0 {
+		blocks = append(blocks, block{l.MetaIndex, "meta-index"})
+	}
+	if l.Footer.Length != 0 {
+		blocks = append(blocks, block{l.Footer, "footer"})
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Offset < blocks[j].Offset
+	})
+	for _, b := range blocks {
+		fmt.Fprintf(w, "%10d  %s (%d)\n", b.Offset, b.name, b.Length)
+		if !verbose || r == nil || (b.name != "data" && b.name != "index") {
+			continue
+		}
+		info, err := r.BlockInfo(b.BlockHandle)
+		if err != nil {
+			fmt.Fprintf(w, "            error: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(w, "            entries: %d, restarts: %d\n", info.Entries, info.Restarts)
+		fmt.Fprintf(w, "            first: %s\n", info.First)
+		fmt.Fprintf(w, "            last:  %s\n", info.Last)
+	}
+}
+
+// Layout returns the layout (block organization) for an sstable.
+func (r *Reader) Layout() (*Layout, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	l := &Layout{
+		Index:      BlockHandle{r.indexBH.offset, r.indexBH.length},
+		Filter:     BlockHandle{r.filterBH.offset, r.filterBH.length},
+		Properties: BlockHandle{r.propertiesBH.offset, r.propertiesBH.length},
+		MetaIndex:  BlockHandle{r.metaindexBH.offset, r.metaindexBH.length},
+		Footer:     BlockHandle{uint64(r.size - footerLen), footerLen},
+	}
+	i, err := r.newIndexIter()
+	if err != nil {
+		return nil, err
+	}
+	for i.First(); i.Valid(); i.Next() {
+		v := i.Value()
+		bh, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			return nil, r.corruptionError(int64(r.indexBH.offset),
+				errors.New("pebble/table: invalid table (bad index entry)"))
+		}
+		l.Data = append(l.Data, BlockHandle{bh.offset, bh.length})
+	}
+	if err := i.Close(); err != nil {
+		return nil, err
+	}
+	if r.partFilter != nil {
+		handles, err := r.partFilter.partitions()
+		if err != nil {
+			return nil, r.corruptionError(int64(r.filterBH.offset), err)
+		}
+		for _, bh := range handles {
+			l.FilterPartitions = append(l.FilterPartitions, BlockHandle{bh.offset, bh.length})
+		}
+	}
+	return l, nil
+}
+
+// BlockInfo reads the data or index block identified by bh and returns a
+// summary of its contents. The handle is usually taken from the Layout
+// returned by Reader.Layout.
+func (r *Reader) BlockInfo(bh BlockHandle) (BlockInfo, error) {
+	if r.err != nil {
+		return BlockInfo{}, r.err
+	}
+	b, err := r.readBlock(blockHandle{bh.Offset, bh.Length}, nil, true /* fillCache */)
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	i, err := newBlockIter(r.compare, b)
+	if err != nil {
+		return BlockInfo{}, r.corruptionError(int64(bh.Offset), err)
+	}
+	info := BlockInfo{
+		BlockHandle: bh,
+		Restarts:    i.numRestarts,
+	}
+	for i.First(); i.Valid(); i.Next() {
+		if info.Entries == 0 {
+			info.First = i.Key().Clone()
+		}
+		info.Entries++
+	}
+	if i.Last(); i.Valid() {
+		info.Last = i.Key().Clone()
+	}
+	return info, i.Close()
+}
@@ -64,6 +64,9 @@ type Properties struct {
 	// The time when the SST file was created. Since SST files are immutable,
 	// this is equivalent to last modified time.
 	CreationTime uint64 `prop:"rocksdb.creation.time"`
+	// The unique identifier of the DB the table was written for. Empty if the
+	// table was not written for a particular DB.
+	DBID string `prop:"pebble.db.id"`
 	// The total size of all data blocks.
 	DataSize uint64 `prop:"rocksdb.data.size"`
 	// The name of the filter policy used in this table. Empty if no filter
@@ -86,13 +89,20 @@ type Properties struct {
 	IndexSize uint64 `prop:"rocksdb.index.size"`
 	// The index type. TODO(peter): add a more detailed description.
 	IndexType uint32 `prop:"rocksdb.block.based.table.index.type"`
+	// Whether delta encoding is used to encode the index values.
+	IndexValueIsDeltaEncoded uint64 `prop:"rocksdb.index.value.is.delta.encoded"`
 	// The name of the merge operator used in this table. Empty if no merge
 	// operator is used.
 	MergeOperatorName string `prop:"rocksdb.merge.operator"`
 	// The number of blocks in this table.
 	NumDataBlocks uint64 `prop:"rocksdb.num.data.blocks"`
+	// The number of deletion entries in this table, including range
+	// deletions.
+	NumDeletions uint64 `prop:"rocksdb.deleted.keys"`
 	// the number of entries in this table.
 	NumEntries uint64 `prop:"rocksdb.num.entries"`
+	// The number of merge operands in this table.
+	NumMergeOperands uint64 `prop:"rocksdb.merge.operands"`
 	// the number of range deletions in this table.
 	NumRangeDeletions uint64 `prop:"rocksdb.num.range-deletions"`
 	// Timestamp of the earliest key. 0 if unknown.
@@ -158,7 +168,7 @@ func (p *Properties) String() string {
 	}
 	sort.Strings(keys)
 	for _, key := range keys {
-		fmt.Fprintf(&buf, "%s: %s\n", keys, p.UserProperties[key])
+		fmt.Fprintf(&buf, "%s: %s\n", key, p.UserProperties[key])
 	}
 	return buf.String()
 }
@@ -251,6 +261,9 @@ func (p *Properties) save(w *rawBlockWriter) {
 		p.saveString(m, unsafe.Offsetof(p.CompressionName), p.CompressionName)
 	}
 	p.saveUvarint(m, unsafe.Offsetof(p.CreationTime), p.CreationTime)
+	if p.DBID != "" {
+		p.saveString(m, unsafe.Offsetof(p.DBID), p.DBID)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.DataSize), p.DataSize)
 	if p.FilterPolicyName != "" {
 		p.saveString(m, unsafe.Offsetof(p.FilterPolicyName), p.FilterPolicyName)
@@ -268,11 +281,20 @@ func (p *Properties) save(w *rawBlockWriter) {
 	}
 	p.saveUvarint(m, unsafe.Offsetof(p.IndexSize), p.IndexSize)
 	p.saveUint32(m, unsafe.Offsetof(p.IndexType), p.IndexType)
+	if p.IndexValueIsDeltaEncoded != 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.IndexValueIsDeltaEncoded), p.IndexValueIsDeltaEncoded)
+	}
 	if p.MergeOperatorName != "" {
 		p.saveString(m, unsafe.Offsetof(p.MergeOperatorName), p.MergeOperatorName)
 	}
 	p.saveUvarint(m, unsafe.Offsetof(p.NumDataBlocks), p.NumDataBlocks)
+	if p.NumDeletions != 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.NumDeletions), p.NumDeletions)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.NumEntries), p.NumEntries)
+	if p.NumMergeOperands != 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.NumMergeOperands), p.NumMergeOperands)
+	}
 	if p.NumRangeDeletions != 0 {
 		p.saveUvarint(m, unsafe.Offsetof(p.NumRangeDeletions), p.NumRangeDeletions)
 	}
@@ -77,34 +77,37 @@ func TestPropertiesLoad(t *testing.T) {
 
 func TestPropertiesSave(t *testing.T) {
 	expected := &Properties{
-		ColumnFamilyID:         1,
-		ColumnFamilyName:       "column family name",
-		ComparatorName:         "comparator name",
-		CompressionName:        "compression name",
-		CreationTime:           2,
-		DataSize:               3,
-		FilterPolicyName:       "filter policy name",
-		FilterSize:             4,
-		FixedKeyLen:            5,
-		FormatVersion:          6,
-		GlobalSeqNum:           7,
-		IndexKeyIsUserKey:      8,
-		IndexPartitions:        9,
-		IndexSize:              10,
-		IndexType:              11,
-		MergeOperatorName:      "merge operator name",
-		NumDataBlocks:          12,
-		NumEntries:             13,
-		NumRangeDeletions:      14,
-		OldestKeyTime:          15,
-		PrefixExtractorName:    "prefix extractor name",
-		PrefixFiltering:        true,
-		PropertyCollectorNames: "prefix collector names",
-		RawKeySize:             16,
-		RawValueSize:           17,
-		TopLevelIndexSize:      18,
-		Version:                19,
-		WholeKeyFiltering:      true,
+		ColumnFamilyID:           1,
+		ColumnFamilyName:         "column family name",
+		ComparatorName:           "comparator name",
+		CompressionName:          "compression name",
+		CreationTime:             2,
+		DataSize:                 3,
+		FilterPolicyName:         "filter policy name",
+		FilterSize:               4,
+		FixedKeyLen:              5,
+		FormatVersion:            6,
+		GlobalSeqNum:             7,
+		IndexKeyIsUserKey:        8,
+		IndexPartitions:          9,
+		IndexSize:                10,
+		IndexType:                11,
+		IndexValueIsDeltaEncoded: 22,
+		MergeOperatorName:        "merge operator name",
+		NumDataBlocks:            12,
+		NumDeletions:             20,
+		NumEntries:               13,
+		NumMergeOperands:         21,
+		NumRangeDeletions:        14,
+		OldestKeyTime:            15,
+		PrefixExtractorName:      "prefix extractor name",
+		PrefixFiltering:          true,
+		PropertyCollectorNames:   "prefix collector names",
+		RawKeySize:               16,
+		RawValueSize:             17,
+		TopLevelIndexSize:        18,
+		Version:                  19,
+		WholeKeyFiltering:        true,
 		UserProperties: map[string]string{
 			"user-prop-a": "1",
 			"user-prop-b": "2",
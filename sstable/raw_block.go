@@ -63,6 +63,9 @@ func (i *rawBlockIter) init(cmp db.Compare, block block) error {
 	if numRestarts == 0 {
 		return errors.New("pebble/table: invalid table (block has no restart points)")
 	}
+	if 4*(1+numRestarts) > len(block) {
+		return errors.New("pebble/table: invalid table (bad restart count)")
+	}
 	i.cmp = cmp
 	i.restarts = len(block) - 4*(1+numRestarts)
 	i.numRestarts = numRestarts
@@ -144,10 +147,69 @@ func (i *rawBlockIter) SeekGE(key []byte) {
 	}
 }
 
+// SeekPrefixGE implements InternalIterator.SeekPrefixGE, as documented in the
+// pebble/db package.
+func (i *rawBlockIter) SeekPrefixGE(prefix, key []byte) {
+	i.SeekGE(key)
+}
+
 // SeekLT implements InternalIterator.SeekLT, as documented in the pebble/db
 // package.
 func (i *rawBlockIter) SeekLT(key []byte) {
-	panic("pebble/table: SeekLT unimplemented")
+	// Find the index of the smallest restart point whose key is >= the key
+	// sought; index will be numRestarts if there is no such restart point.
+	i.offset = 0
+	index := sort.Search(i.numRestarts, func(j int) bool {
+		offset := int(binary.LittleEndian.Uint32(i.data[i.restarts+4*j:]))
+		// For a restart point, there are 0 bytes shared with the previous key.
+		// The varint encoding of 0 occupies 1 byte.
+		ptr := unsafe.Pointer(uintptr(i.ptr) + uintptr(offset+1))
+		// Decode the key at that restart point, and compare it to the key sought.
+		v1, ptr := decodeVarint(ptr)
+		_, ptr = decodeVarint(ptr)
+		s := getBytes(ptr, int(v1))
+		return i.cmp(key, s) <= 0
+	})
+
+	// Since keys are strictly increasing, if index > 0 then the restart point at
+	// index-1 will be the largest whose key is < the key sought.
+	if index > 0 {
+		i.offset = int(binary.LittleEndian.Uint32(i.data[i.restarts+4*(index-1):]))
+	} else if index == 0 {
+		// If index == 0 then all keys in this block are larger than the key
+		// sought.
+		i.offset = -1
+		i.nextOffset = 0
+		return
+	}
+
+	// Iterate from that restart point to somewhere >= the key sought, then back
+	// up to the previous entry. The expectation is that we'll be performing
+	// reverse iteration, so we cache the entries as we advance forward.
+	i.clearCache()
+	i.nextOffset = i.offset
+
+	for {
+		i.offset = i.nextOffset
+		i.readEntry()
+		i.ikey.UserKey = i.key
+
+		if i.cmp(i.key, key) >= 0 {
+			// The current key is greater than or equal to our search key. Back up to
+			// the previous key which was less than our search key. The entry at the
+			// restart point is less than the search key, so the cache contains the
+			// previous entry and Prev does not need to search the restart points.
+			i.cacheEntry()
+			i.Prev()
+			return
+		}
+
+		i.cacheEntry()
+		if i.nextOffset >= i.restarts {
+			// We've reached the end of the block. Return the current key.
+			break
+		}
+	}
 }
 
 // First implements InternalIterator.First, as documented in the pebble/db
@@ -6,10 +6,12 @@ package sstable
 
 import (
 	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/cache"
@@ -28,8 +30,11 @@ type blockHandle struct {
 // input.
 func decodeBlockHandle(src []byte) (blockHandle, int) {
 	offset, n := binary.Uvarint(src)
+	if n <= 0 {
+		return blockHandle{}, 0
+	}
 	length, m := binary.Uvarint(src[n:])
-	if n == 0 || m == 0 {
+	if m <= 0 {
 		return blockHandle{}, 0
 	}
 	return blockHandle{offset, length}, n + m
@@ -53,6 +58,23 @@ type Iter struct {
 	index  blockIter
 	data   blockIter
 	err    error
+	keyBuf []byte
+	// The timestamp the iterator reads at, if any. The data blocks which only
+	// hold keys with newer timestamps are skipped. See db.IterOptions.Timestamp.
+	timestamp []byte
+	// The stats accumulating the bytes of the blocks read by the iterator, if
+	// any. See SetReadStats.
+	stats *ReadStats
+	// If true, the blocks read from the file are not added to the caches. See
+	// SetFillCache.
+	noFillCache bool
+	// If true, the data blocks are always read from the file and have their
+	// checksums verified. See SetVerifyChecksums.
+	verifyChecksums bool
+	// If true, corrupted data blocks are skipped. See SetSkipCorruptBlocks.
+	skipCorrupt bool
+	// Whether index has been initialized. See loadIndex.
+	indexLoaded bool
 }
 
 // Iter implements the db.InternalIterator interface.
@@ -60,13 +82,106 @@ var _ db.InternalIterator = (*Iter)(nil)
 
 func (i *Iter) init(r *Reader) error {
 	i.reader = r
-	i.err = i.index.init(r.compare, r.index, r.Properties.GlobalSeqNum)
+	i.indexLoaded = false
+	if !r.lazyIndex {
+		i.loadIndex()
+	}
 	return i.err
 }
 
+// loadIndex initializes the iterator over the index block, reading the block
+// if the reader reads its index lazily, and returns false if the index could
+// not be read. The index of a table is only read once the table is
+// positioned, so that a point lookup ruled out by the table's filter does not
+// read it.
+func (i *Iter) loadIndex() bool {
+	if i.indexLoaded {
+		return true
+	}
+	r := i.reader
+	index, err := r.loadIndex()
+	if err == nil {
+		err = i.index.init(r.compare, index, r.Properties.GlobalSeqNum)
+	}
+	if err != nil {
+		i.err = r.corruptionError(-1, err)
+		return false
+	}
+	i.indexLoaded = true
+	return true
+}
+
+// Init initializes the iterator for reading from the table, retaining the
+// buffers allocated by any previous use of the iterator. An iterator which was
+// previously in use must have been closed. Init allows callers to reuse an
+// iterator across tables; most callers should use Reader.NewIter instead.
+func (i *Iter) Init(r *Reader) error {
+	i.index.reset()
+	i.data.reset()
+	i.keyBuf = i.keyBuf[:0]
+	i.timestamp = nil
+	i.stats = nil
+	i.noFillCache = false
+	i.verifyChecksums = false
+	i.skipCorrupt = false
+	i.err = nil
+	if r.err != nil {
+		i.reader = nil
+		i.err = r.err
+		return i.err
+	}
+	return i.init(r)
+}
+
+// SetTimestamp sets the timestamp the iterator reads at, allowing it to skip
+// the data blocks which only hold keys with newer timestamps. The entries of
+// the blocks which are read are not filtered. The timestamp is cleared by
+// Init.
+func (i *Iter) SetTimestamp(ts []byte) {
+	i.timestamp = ts
+}
+
+// SetReadStats sets the stats accumulating the bytes of the data and filter
+// blocks read by the iterator, which may be shared by several iterators. The
+// stats are cleared by Init.
+func (i *Iter) SetReadStats(stats *ReadStats) {
+	i.stats = stats
+}
+
+// SetFillCache sets whether the blocks the iterator reads from the file are
+// added to the block cache and the compressed block cache, which is the
+// default. Blocks found in the caches are used either way. An iterator which
+// reads a large part of a table once, such as the iterator of a compaction,
+// should not fill the caches, so as not to evict the blocks used by other
+// reads. The policy is reset by Init.
+func (i *Iter) SetFillCache(fill bool) {
+	i.noFillCache = !fill
+}
+
+// SetVerifyChecksums sets whether the data blocks read by the iterator are
+// always read from the file and have their checksums verified, bypassing the
+// block cache and the compressed block cache, as if the reader's
+// Options.VerifyChecksums were set. The policy is reset by Init.
+func (i *Iter) SetVerifyChecksums(verify bool) {
+	i.verifyChecksums = verify
+}
+
+// SetSkipCorruptBlocks sets whether the iterator skips the data blocks which
+// are found to be corrupted, as if they held no keys, rather than failing
+// with the corruption error. It allows the readable part of a damaged table
+// to be salvaged. The corruptions are still reported to the reader's
+// CorruptionReporter. The policy is reset by Init.
+func (i *Iter) SetSkipCorruptBlocks(skip bool) {
+	i.skipCorrupt = skip
+}
+
 // loadBlock loads the block at the current index position and leaves i.data
 // unpositioned. If unsuccessful, it sets i.err to any error encountered, which
-// may be nil if we have simply exhausted the entire table.
+// may be nil if we have simply exhausted the entire table, or if the block
+// was skipped because it only holds keys newer than the iterator's timestamp
+// or is corrupted and the iterator skips corrupted blocks. In the latter
+// cases the index remains valid, which skipForward and skipBackward use to
+// move on to the adjacent blocks.
 func (i *Iter) loadBlock() bool {
 	if !i.index.Valid() {
 		i.err = i.index.err
@@ -76,16 +191,25 @@ func (i *Iter) loadBlock() bool {
 	v := i.index.Value()
 	h, n := decodeBlockHandle(v)
 	if n == 0 || n != len(v) {
-		i.err = errors.New("pebble/table: corrupt index entry")
+		i.err = i.reader.corruptionError(-1, errors.New("pebble/table: corrupt index entry"))
 		return false
 	}
-	block, err := i.reader.readBlock(h)
-	if err != nil {
-		i.err = err
+	if i.timestamp != nil && i.reader.skipBlock(h.offset, i.timestamp) {
+		i.data.reset()
 		return false
 	}
-	i.err = i.data.init(i.reader.compare, block, i.reader.Properties.GlobalSeqNum)
-	if i.err != nil {
+	block, err := i.reader.readDataBlock(h, i.stats, !i.noFillCache, i.verifyChecksums)
+	if err == nil {
+		if err = i.data.init(i.reader.compare, block, i.reader.Properties.GlobalSeqNum); err != nil {
+			err = i.reader.reportCorruption(i.reader.corruptionError(int64(h.offset), err))
+		}
+	}
+	if err != nil {
+		if _, ok := err.(*db.CorruptionError); ok && i.skipCorrupt {
+			i.data.reset()
+			return false
+		}
+		i.err = err
 		return false
 	}
 	return true
@@ -96,11 +220,11 @@ func (i *Iter) loadBlock() bool {
 // it sets i.err to any error encountered, which may be nil if we have simply
 // exhausted the entire table.
 //
-// If f is non-nil, the caller is presumably looking for one specific key, as
-// opposed to iterating over a range of keys (where the minimum of that range
-// isn't necessarily in the table). In that case, i.err will be set to
-// db.ErrNotFound if f does not contain the key.
-func (i *Iter) seekBlock(key []byte, f *blockFilterReader) bool {
+// If f is non-nil, the caller is presumably looking for one specific key or
+// prefix, filterKey, as opposed to iterating over a range of keys (where the
+// minimum of that range isn't necessarily in the table). In that case, i.err
+// will be set to db.ErrNotFound if f does not contain filterKey.
+func (i *Iter) seekBlock(key, filterKey []byte, f *blockFilterReader) bool {
 	if !i.index.Valid() {
 		i.err = i.index.err
 		return false
@@ -109,20 +233,27 @@ func (i *Iter) seekBlock(key []byte, f *blockFilterReader) bool {
 	v := i.index.Value()
 	h, n := decodeBlockHandle(v)
 	if n == 0 || n != len(v) {
-		i.err = errors.New("pebble/table: corrupt index entry")
+		i.err = i.reader.corruptionError(-1, errors.New("pebble/table: corrupt index entry"))
 		return false
 	}
-	if f != nil && !f.mayContain(h.offset, key) {
+	if f != nil && !f.mayContain(h.offset, filterKey) {
 		i.err = db.ErrNotFound
 		return false
 	}
-	block, err := i.reader.readBlock(h)
+	if i.timestamp != nil && i.reader.skipBlock(h.offset, i.timestamp) {
+		// The following blocks may hold older versions of the key.
+		i.data.reset()
+		i.skipForward()
+		return true
+	}
+	block, err := i.reader.readDataBlock(h, i.stats, !i.noFillCache, i.verifyChecksums)
 	if err != nil {
 		i.err = err
 		return false
 	}
 	i.err = i.data.init(i.reader.compare, block, i.reader.Properties.GlobalSeqNum)
 	if i.err != nil {
+		i.err = i.reader.reportCorruption(i.reader.corruptionError(int64(h.offset), i.err))
 		return false
 	}
 	// Look for the key inside that block.
@@ -133,20 +264,151 @@ func (i *Iter) seekBlock(key []byte, f *blockFilterReader) bool {
 // SeekGE implements InternalIterator.SeekGE, as documented in the pebble/db
 // package.
 func (i *Iter) SeekGE(key []byte) {
-	if i.err != nil {
+	if i.err != nil || !i.loadIndex() {
 		return
 	}
 
 	i.index.SeekGE(key)
 	if i.loadBlock() {
 		i.data.SeekGE(key)
+	} else {
+		i.skipForward()
+	}
+}
+
+// skipForward positions the iterator at the first entry of the first block
+// following the current index position which is not skipped, if loadBlock
+// skipped the block at the current index position.
+func (i *Iter) skipForward() {
+	for i.err == nil && i.index.Valid() {
+		i.index.Next()
+		if i.loadBlock() {
+			i.data.First()
+			return
+		}
+	}
+}
+
+// skipBackward positions the iterator at the last entry of the last block
+// preceding the current index position which is not skipped, if loadBlock
+// skipped the block at the current index position.
+func (i *Iter) skipBackward() {
+	for i.err == nil && i.index.Valid() {
+		i.index.Prev()
+		if i.loadBlock() {
+			i.data.Last()
+			return
+		}
+	}
+}
+
+// SeekGEFiltered is a variant of SeekGE for point lookups, which are only
+// interested in the entries for the specified user key. The table's filter, if
+// any, is consulted first, and if it indicates that the table does not contain
+// the key the iterator is left exhausted without reading a data block.
+// Otherwise the iterator is positioned as by SeekGE. The outcome of the filter
+// check is recorded in the reader's FilterMetrics.
+func (i *Iter) SeekGEFiltered(key []byte) {
+	if i.err != nil {
+		return
+	}
+
+	r := i.reader
+	filterKey := key
+	if r.Properties.PrefixFiltering {
+		filterKey = nil
+		if r.split != nil {
+			filterKey = key[:r.split(key)]
+		}
+	}
+	if i.seekFiltered(key, filterKey) {
+		r.filterMetrics.miss(i.Valid() && r.compare(key, i.Key().UserKey) == 0)
+	}
+}
+
+// SeekPrefixGE implements InternalIterator.SeekPrefixGE, as documented in the
+// pebble/db package. The table's filter, if any, is consulted as by
+// SeekGEFiltered. A filter built over whole keys can only be used if the
+// prefix is the entire key.
+func (i *Iter) SeekPrefixGE(prefix, key []byte) {
+	if i.err != nil {
+		return
+	}
+
+	r := i.reader
+	var filterKey []byte
+	switch {
+	case r.Properties.PrefixFiltering:
+		if r.split != nil {
+			filterKey = prefix
+		}
+	case len(prefix) == len(key):
+		filterKey = key
+	}
+	if i.seekFiltered(key, filterKey) {
+		found := false
+		if i.Valid() {
+			ukey := i.Key().UserKey
+			found = r.compare(prefix, r.prefix(ukey)) == 0
+		}
+		r.filterMetrics.miss(found)
+	}
+}
+
+// seekFiltered positions the iterator as by SeekGE, unless the table's filter
+// indicates that the table does not contain filterKey, in which case the
+// filter hit is recorded and the iterator is left exhausted without reading a
+// data block. A nil filterKey indicates that the filter cannot be used. It
+// returns true if a filter was consulted but did not rule out filterKey, in
+// which case the caller records the miss.
+func (i *Iter) seekFiltered(key, filterKey []byte) bool {
+	if filterKey == nil {
+		i.SeekGE(key)
+		return false
+	}
+
+	r := i.reader
+	var filtered bool
+	switch {
+	case r.tableFilter != nil:
+		if !r.tableFilter.mayContain(filterKey) {
+			r.filterMetrics.hit()
+			i.data.reset()
+			return false
+		}
+		filtered = true
+	case r.partFilter != nil:
+		if !r.partFilter.mayContain(filterKey, i.stats) {
+			r.filterMetrics.hit()
+			i.data.reset()
+			return false
+		}
+		filtered = true
+	}
+
+	if !i.loadIndex() {
+		i.data.reset()
+		return false
 	}
+	i.index.SeekGE(key)
+	if !i.seekBlock(key, filterKey, r.blockFilter) {
+		if i.err == db.ErrNotFound {
+			// The block filter ruled out the key, which is not an error.
+			r.filterMetrics.hit()
+			i.err = nil
+			i.data.reset()
+			return false
+		}
+		i.data.reset()
+		return filtered && i.err == nil
+	}
+	return filtered || r.blockFilter != nil
 }
 
 // SeekLT implements InternalIterator.SeekLT, as documented in the pebble/db
 // package.
 func (i *Iter) SeekLT(key []byte) {
-	if i.err != nil {
+	if i.err != nil || !i.loadIndex() {
 		return
 	}
 
@@ -154,7 +416,9 @@ func (i *Iter) SeekLT(key []byte) {
 	if !i.index.Valid() {
 		i.index.Last()
 	}
-	if i.loadBlock() {
+	if !i.loadBlock() {
+		i.skipBackward()
+	} else {
 		i.data.SeekLT(key)
 		if !i.data.Valid() {
 			// The index contains separator keys which may between
@@ -171,6 +435,8 @@ func (i *Iter) SeekLT(key []byte) {
 			i.index.Prev()
 			if i.loadBlock() {
 				i.data.Last()
+			} else {
+				i.skipBackward()
 			}
 		}
 	}
@@ -179,26 +445,30 @@ func (i *Iter) SeekLT(key []byte) {
 // First implements InternalIterator.First, as documented in the pebble/db
 // package.
 func (i *Iter) First() {
-	if i.err != nil {
+	if i.err != nil || !i.loadIndex() {
 		return
 	}
 
 	i.index.First()
 	if i.loadBlock() {
 		i.data.First()
+	} else {
+		i.skipForward()
 	}
 }
 
 // Last implements InternalIterator.Last, as documented in the pebble/db
 // package.
 func (i *Iter) Last() {
-	if i.err != nil {
+	if i.err != nil || !i.loadIndex() {
 		return
 	}
 
 	i.index.Last()
 	if i.loadBlock() {
 		i.data.Last()
+	} else {
+		i.skipBackward()
 	}
 }
 
@@ -223,6 +493,9 @@ func (i *Iter) Next() bool {
 			i.data.First()
 			return true
 		}
+		if i.err != nil {
+			break
+		}
 	}
 	return false
 }
@@ -230,7 +503,18 @@ func (i *Iter) Next() bool {
 // NextUserKey implements InternalIterator.NextUserKey, as documented in the
 // pebble/db package.
 func (i *Iter) NextUserKey() bool {
-	return i.Next()
+	if !i.Valid() {
+		return i.Next()
+	}
+	// A table may contain multiple versions of the same user key, which may
+	// span data blocks.
+	i.keyBuf = append(i.keyBuf[:0], i.Key().UserKey...)
+	for i.Next() {
+		if i.reader.compare(i.keyBuf, i.Key().UserKey) != 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // Prev implements InternalIterator.Prev, as documented in the pebble/db
@@ -254,6 +538,9 @@ func (i *Iter) Prev() bool {
 			i.data.Last()
 			return true
 		}
+		if i.err != nil {
+			break
+		}
 	}
 	return false
 }
@@ -261,7 +548,16 @@ func (i *Iter) Prev() bool {
 // PrevUserKey implements InternalIterator.PrevUserKey, as documented in the
 // pebble/db package.
 func (i *Iter) PrevUserKey() bool {
-	return i.Prev()
+	if !i.Valid() {
+		return i.Prev()
+	}
+	i.keyBuf = append(i.keyBuf[:0], i.Key().UserKey...)
+	for i.Prev() {
+		if i.reader.compare(i.keyBuf, i.Key().UserKey) != 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // Key implements InternalIterator.Key, as documented in the pebble/db package.
@@ -302,16 +598,51 @@ func (i *Iter) Close() error {
 // Reader is a table reader. It implements the DB interface, as documented
 // in the pebble/db package.
 type Reader struct {
-	file        storage.File
-	fileNum     uint64
-	err         error
-	index       block
-	opts        *db.Options
-	cache       *cache.Cache
-	compare     db.Compare
-	blockFilter *blockFilterReader
-	tableFilter *tableFilterReader
-	Properties  Properties
+	file    storage.File
+	path    string
+	fileNum uint64
+	err     error
+	opts    *db.Options
+	cache   *cache.Cache
+	// The index block, which is read by NewReader, or by the first call to
+	// loadIndex if lazyIndex is set. An error reading the index lazily is
+	// recorded in indexErr rather than err, and returned by the operations
+	// needing the index. See db.Options.LazyTableIndex.
+	index     block
+	indexErr  error
+	indexOnce sync.Once
+	lazyIndex bool
+	// compressedCache holds the blocks as stored in the file, followed by the
+	// byte holding their compression type. See db.Options.CompressedCache.
+	compressedCache *cache.Cache
+	compare         db.Compare
+	split           db.Split
+	blockFilter     *blockFilterReader
+	tableFilter     *tableFilterReader
+	partFilter      *partitionedFilterReader
+	Properties      Properties
+
+	// The range of the timestamps of the keys in each data block, sorted by
+	// block offset. See Iter.SetTimestamp.
+	blockTimestamps []blockTimestamps
+
+	filterMetrics *FilterMetrics
+	// corruptionReporter, if non-nil, is invoked with the corrupted blocks
+	// found by readBlock. See CorruptionReporter.
+	corruptionReporter CorruptionReporter
+
+	// The RocksDB format version of the table and the checksum type of its
+	// blocks.
+	formatVersion uint32
+	checksumType  byte
+
+	// The handles of the table's blocks and the file size, recorded for use by
+	// Layout.
+	size         int64
+	metaindexBH  blockHandle
+	indexBH      blockHandle
+	propertiesBH blockHandle
+	filterBH     blockHandle
 }
 
 // Close implements DB.Close, as documented in the pebble/db package.
@@ -335,21 +666,24 @@ func (r *Reader) Close() error {
 	return nil
 }
 
+// Err returns the error encountered when opening the table, if any: a table
+// whose footer, index or metaindex could not be read or failed the paranoid
+// checks. Every other method of such a reader fails with the same error.
+func (r *Reader) Err() error {
+	return r.err
+}
+
 func (r *Reader) get(key []byte, o *db.IterOptions) (value []byte, err error) {
 	if r.err != nil {
 		return nil, r.err
 	}
 
-	if r.tableFilter != nil {
-		if !r.tableFilter.mayContain(key) {
-			return nil, db.ErrNotFound
-		}
-	}
-
 	i := &Iter{}
+	if o != nil {
+		i.verifyChecksums = o.VerifyChecksums
+	}
 	if err := i.init(r); err == nil {
-		i.index.SeekGE(key)
-		i.seekBlock(key, r.blockFilter)
+		i.SeekGEFiltered(key)
 	}
 
 	if !i.Valid() || r.compare(key, i.Key().UserKey) != 0 {
@@ -362,6 +696,14 @@ func (r *Reader) get(key []byte, o *db.IterOptions) (value []byte, err error) {
 	return i.Value(), i.Close()
 }
 
+// prefix returns the prefix of the user key, as defined by Comparer.Split.
+func (r *Reader) prefix(key []byte) []byte {
+	if r.split == nil {
+		return key
+	}
+	return key[:r.split(key)]
+}
+
 // NewIter implements DB.NewIter, as documented in the pebble/db package.
 func (r *Reader) NewIter(o *db.IterOptions) db.InternalIterator {
 	// NB: pebble.tableCache wraps the returned iterator with one which performs
@@ -372,55 +714,319 @@ func (r *Reader) NewIter(o *db.IterOptions) db.InternalIterator {
 	}
 	i := &Iter{}
 	_ = i.init(r)
+	if o != nil {
+		i.timestamp = o.Timestamp
+		i.verifyChecksums = o.VerifyChecksums
+	}
 	return i
 }
 
-// readBlock reads and decompresses a block from disk into memory.
-func (r *Reader) readBlock(bh blockHandle) (block, error) {
-	if b := r.cache.Get(r.fileNum, bh.offset); b != nil {
+// ApproximateOffsetOf returns the approximate offset within the table of the
+// data for the specified key: the offset of the data block which would
+// contain the key. If the key is past the last key in the table, the offset
+// of the metaindex block, which is close to the size of the table, is
+// returned.
+func (r *Reader) ApproximateOffsetOf(key []byte) (uint64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	i, err := r.newIndexIter()
+	if err != nil {
+		return 0, err
+	}
+	i.SeekGE(key)
+	if !i.Valid() {
+		return r.metaindexBH.offset, i.Close()
+	}
+	v := i.Value()
+	bh, n := decodeBlockHandle(v)
+	if n == 0 || n != len(v) {
+		i.Close()
+		return 0, r.corruptionError(int64(r.indexBH.offset),
+			errors.New("pebble/table: invalid table (bad index entry)"))
+	}
+	return bh.offset, i.Close()
+}
+
+// Prefetch reads the data block which would contain the specified key into the
+// block cache, unless it is already cached, so that a subsequent seek to the
+// key does not wait for the block to be read from disk. A nil key prefetches
+// the first data block. The bytes read are recorded in stats if it is
+// non-nil. Prefetch does nothing if the key is past the last key in the table
+// or the reader has no cache.
+func (r *Reader) Prefetch(key []byte, stats *ReadStats) error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.cache == nil {
+		return nil
+	}
+	i, err := r.newIndexIter()
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		i.First()
+	} else {
+		i.SeekGE(key)
+	}
+	if !i.Valid() {
+		return i.Close()
+	}
+	v := i.Value()
+	bh, n := decodeBlockHandle(v)
+	if n == 0 || n != len(v) {
+		i.Close()
+		return r.corruptionError(int64(r.indexBH.offset),
+			errors.New("pebble/table: invalid table (bad index entry)"))
+	}
+	if _, err := r.readBlock(bh, stats, true /* fillCache */); err != nil {
+		i.Close()
+		return err
+	}
+	return i.Close()
+}
+
+// EstimateDiskUsage returns the total size of the data blocks which overlap
+// the inclusive key range [start, end].
+func (r *Reader) EstimateDiskUsage(start, end []byte) (uint64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	i, err := r.newIndexIter()
+	if err != nil {
+		return 0, err
+	}
+	decode := func() (blockHandle, error) {
+		v := i.Value()
+		bh, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			return blockHandle{}, r.corruptionError(int64(r.indexBH.offset),
+				errors.New("pebble/table: invalid table (bad index entry)"))
+		}
+		return bh, nil
+	}
+
+	i.SeekGE(start)
+	if !i.Valid() {
+		// The range is past the last key in the table.
+		return 0, i.Close()
+	}
+	startBH, err := decode()
+	if err != nil {
+		i.Close()
+		return 0, err
+	}
+	i.SeekGE(end)
+	if !i.Valid() {
+		i.Last()
+	}
+	endBH, err := decode()
+	if err != nil {
+		i.Close()
+		return 0, err
+	}
+	return endBH.offset + endBH.length + blockTrailerLen - startBH.offset, i.Close()
+}
+
+// readBlock reads and decompresses a block from disk into memory, recording
+// the bytes read in stats if it is non-nil. The block is looked up in the
+// cache and then the compressed block cache before it is read from disk. A
+// block read from disk is added to the caches if fillCache is true.
+func (r *Reader) readBlock(bh blockHandle, stats *ReadStats, fillCache bool) (block, error) {
+	return r.readDataBlock(bh, stats, fillCache, false /* verifyChecksums */)
+}
+
+// readDataBlock is like readBlock, but the caches are bypassed and the block
+// is read from disk if verifyChecksums is true, or if the reader's
+// Options.VerifyChecksums is set.
+func (r *Reader) readDataBlock(
+	bh blockHandle, stats *ReadStats, fillCache, verifyChecksums bool,
+) (block, error) {
+	if !verifyChecksums && !r.opts.VerifyChecksums {
+		if b := r.cache.Get(r.fileNum, bh.offset); b != nil {
+			stats.cacheRead(len(b))
+			return b, nil
+		}
+		if raw := r.compressedCache.Get(r.fileNum, bh.offset); raw != nil {
+			b, err := r.decodeBlock(bh, raw)
+			if err != nil {
+				return nil, r.reportCorruption(err)
+			}
+			stats.compressedCacheRead(int(bh.length))
+			if fillCache {
+				r.cache.Set(r.fileNum, bh.offset, b)
+			}
+			return b, nil
+		}
+	}
+
+	raw, err := r.readRawBlock(bh)
+	if err != nil {
+		return nil, r.reportCorruption(err)
+	}
+	b, err := r.decodeBlock(bh, raw)
+	if err != nil {
+		return nil, r.reportCorruption(err)
+	}
+	stats.fileRead(bh.length + blockTrailerLen)
+	if !fillCache {
 		return b, nil
 	}
+	if raw[bh.length] != noCompressionBlockType {
+		r.compressedCache.Set(r.fileNum, bh.offset, raw)
+	}
+	r.cache.Set(r.fileNum, bh.offset, b)
+	return b, nil
+}
+
+// reportCorruption invokes the reader's CorruptionReporter if err is a
+// corruption error, and returns err.
+func (r *Reader) reportCorruption(err error) error {
+	if e, ok := err.(*db.CorruptionError); ok && r.corruptionReporter != nil {
+		r.corruptionReporter(e)
+	}
+	return err
+}
+
+// readBlockFromFile reads, verifies and decompresses a block from disk
+// without consulting or populating the cache.
+func (r *Reader) readBlockFromFile(bh blockHandle) (block, error) {
+	raw, err := r.readRawBlock(bh)
+	if err != nil {
+		return nil, err
+	}
+	return r.decodeBlock(bh, raw)
+}
 
+// readRawBlock reads a block from disk and verifies its checksum. It returns
+// the block as stored, followed by the byte holding its compression type.
+func (r *Reader) readRawBlock(bh blockHandle) ([]byte, error) {
 	b := make([]byte, bh.length+blockTrailerLen)
 	if _, err := r.file.ReadAt(b, int64(bh.offset)); err != nil {
 		return nil, err
 	}
 	checksum0 := binary.LittleEndian.Uint32(b[bh.length+1:])
-	checksum1 := crc.New(b[:bh.length+1]).Value()
+	var checksum1 uint32
+	if r.checksumType == checksumXXHash {
+		checksum1 = xxhash32(b[:bh.length+1])
+	} else {
+		checksum1 = crc.New(b[:bh.length+1]).Value()
+	}
 	if checksum0 != checksum1 {
-		return nil, errors.New("pebble/table: invalid table (checksum mismatch)")
+		return nil, r.corruptionError(int64(bh.offset),
+			errors.New("pebble/table: invalid table (checksum mismatch)"))
 	}
-	switch b[bh.length] {
+	return b[:bh.length+1], nil
+}
+
+// decodeBlock decompresses a block returned by readRawBlock.
+func (r *Reader) decodeBlock(bh blockHandle, raw []byte) (block, error) {
+	switch raw[bh.length] {
 	case noCompressionBlockType:
-		b = b[:bh.length]
-		r.cache.Set(r.fileNum, bh.offset, b)
-		return b, nil
+		return raw[:bh.length], nil
 	case snappyCompressionBlockType:
-		b, err := snappy.Decode(nil, b[:bh.length])
+		b, err := snappy.Decode(nil, raw[:bh.length])
 		if err != nil {
-			return nil, err
+			return nil, r.corruptionError(int64(bh.offset), err)
+		}
+		return b, nil
+	case zlibCompressionBlockType:
+		b, err := decodeZlib(raw[:bh.length], r.formatVersion >= 2)
+		if err != nil {
+			return nil, r.corruptionError(int64(bh.offset), err)
 		}
-		r.cache.Set(r.fileNum, bh.offset, b)
 		return b, nil
 	}
-	return nil, fmt.Errorf("pebble/table: unknown block compression: %d", b[bh.length])
+	return nil, r.corruptionError(int64(bh.offset),
+		fmt.Errorf("pebble/table: unknown block compression: %d", raw[bh.length]))
+}
+
+// corruptionError returns a db.CorruptionError identifying the table and the
+// offset of the corrupted block, or -1 if the offset is not known.
+func (r *Reader) corruptionError(offset int64, err error) error {
+	return &db.CorruptionError{
+		FileType: db.FileTypeTable,
+		Path:     r.path,
+		FileNum:  r.fileNum,
+		Offset:   offset,
+		Err:      err,
+	}
+}
+
+// ScrubBlocks reads every data block in the table from disk, bypassing the
+// cache, and verifies its checksum. If wait is non-nil, it is invoked with the
+// size of each block before the block is read and can be used to rate limit
+// the scrub; if wait returns an error the scrub is aborted and that error is
+// returned. If a corrupted block is found, the offset of the block is
+// returned along with the error.
+func (r *Reader) ScrubBlocks(wait func(n int) error) (offset uint64, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	i, err := r.newIndexIter()
+	if err != nil {
+		return 0, err
+	}
+	for i.First(); i.Valid(); i.Next() {
+		v := i.Value()
+		bh, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			return 0, r.corruptionError(-1, errors.New("pebble/table: invalid table (bad index entry)"))
+		}
+		if wait != nil {
+			if err := wait(int(bh.length + blockTrailerLen)); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := r.readBlockFromFile(bh); err != nil {
+			return bh.offset, err
+		}
+	}
+	return 0, i.Close()
+}
+
+// VerifyChecksums reads every block of the table from disk, bypassing the
+// caches, and verifies its checksum. Unlike a scan, it neither decompresses
+// the blocks nor decodes their entries. The first corrupted block found is
+// reported to the reader's CorruptionReporter, and returned as a
+// *db.CorruptionError.
+func (r *Reader) VerifyChecksums() error {
+	l, err := r.Layout()
+	if err != nil {
+		return err
+	}
+	handles := append([]BlockHandle(nil), l.Data...)
+	handles = append(handles, l.Index, l.Filter, l.Properties, l.MetaIndex)
+	handles = append(handles, l.FilterPartitions...)
+	for _, bh := range handles {
+		if bh.Length == 0 && bh.Offset == 0 {
+			// The table does not have the block.
+			continue
+		}
+		if _, err := r.readRawBlock(blockHandle{bh.Offset, bh.Length}); err != nil {
+			return r.reportCorruption(err)
+		}
+	}
+	return nil
 }
 
 func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
-	b, err := r.readBlock(metaindexBH)
+	b, err := r.readBlock(metaindexBH, nil, true /* fillCache */)
 	if err != nil {
 		return err
 	}
 	i, err := newRawBlockIter(bytes.Compare, b)
 	if err != nil {
-		return err
+		return r.corruptionError(int64(metaindexBH.offset), err)
 	}
 
 	meta := map[string]blockHandle{}
 	for i.First(); i.Valid(); i.Next() {
 		bh, n := decodeBlockHandle(i.Value())
 		if n == 0 {
-			return errors.New("pebble/table: invalid table (bad filter block handle)")
+			return r.corruptionError(int64(metaindexBH.offset),
+				errors.New("pebble/table: invalid table (bad filter block handle)"))
 		}
 		meta[string(i.Key().UserKey)] = bh
 	}
@@ -429,13 +1035,40 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 	}
 
 	if bh, ok := meta["rocksdb.properties"]; ok {
-		b, err = r.readBlock(bh)
+		r.propertiesBH = bh
+		b, err = r.readBlock(bh, nil, true /* fillCache */)
 		if err != nil {
 			return err
 		}
 		if err := r.Properties.load(b, bh.offset); err != nil {
+			return r.corruptionError(int64(bh.offset), err)
+		}
+	} else if o.ParanoidChecks && r.formatVersion != 0 {
+		// NB: LevelDB tables, which use format version 0, have no properties.
+		return r.corruptionError(int64(metaindexBH.offset),
+			errors.New("pebble/table: invalid table (missing properties block)"))
+	}
+	if r.Properties.Version < 2 {
+		// RocksDB only records a global sequence number in the properties of
+		// ingested tables as of version 2 of its external file format.
+		r.Properties.GlobalSeqNum = 0
+	}
+
+	if bh, ok := meta[timestampsBlockName]; ok && r.opts.Comparer.CompareTimestamps != nil {
+		b, err = r.readBlock(bh, nil, true /* fillCache */)
+		if err != nil {
 			return err
 		}
+		r.blockTimestamps, err = decodeTimestampsBlock(b)
+		if err != nil {
+			return r.corruptionError(int64(bh.offset), err)
+		}
+	}
+
+	if r.formatVersion >= 5 {
+		// Format version 5 changed the encoding of bloom filters. The filters
+		// are ignored, which only affects performance.
+		return nil
 	}
 
 	for level := range r.opts.Levels {
@@ -449,11 +1082,13 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 		}{
 			{db.BlockFilter, "filter."},
 			{db.TableFilter, "fullfilter."},
+			{db.PartitionedFilter, "partitionedfilter."},
 		}
 		var done bool
 		for _, t := range types {
 			if bh, ok := meta[t.prefix+fp.Name()]; ok {
-				b, err = r.readBlock(bh)
+				r.filterBH = bh
+				b, err = r.readBlock(bh, nil, true /* fillCache */)
 				if err != nil {
 					return err
 				}
@@ -462,12 +1097,20 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 				case db.BlockFilter:
 					r.blockFilter = newBlockFilterReader(b, fp)
 					if r.blockFilter == nil {
-						return errors.New("pebble/table: invalid table (bad filter block)")
+						return r.corruptionError(int64(bh.offset),
+							errors.New("pebble/table: invalid table (bad filter block)"))
 					}
 				case db.TableFilter:
 					r.tableFilter = newTableFilterReader(b, fp)
 					if r.tableFilter == nil {
-						return errors.New("pebble/table: invalid table (bad filter block)")
+						return r.corruptionError(int64(bh.offset),
+							errors.New("pebble/table: invalid table (bad filter block)"))
+					}
+				case db.PartitionedFilter:
+					r.partFilter = newPartitionedFilterReader(r, b, fp)
+					if r.partFilter == nil {
+						return r.corruptionError(int64(bh.offset),
+							errors.New("pebble/table: invalid table (bad filter block)"))
 					}
 				default:
 					panic(fmt.Sprintf("unknown filter type: %v", t.ftype))
@@ -484,21 +1127,76 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 	return nil
 }
 
+// paranoidCheck performs the additional validation of the table enabled by
+// Options.ParanoidChecks.
+func (r *Reader) paranoidCheck(size int64, metaindexBH, indexBH blockHandle) error {
+	inBounds := func(bh blockHandle) bool {
+		end := bh.offset + bh.length + blockTrailerLen
+		return end >= bh.offset && end <= uint64(size)-footerLen
+	}
+	if !inBounds(metaindexBH) || !inBounds(indexBH) {
+		return r.corruptionError(size-footerLen,
+			errors.New("pebble/table: invalid table (block handle out of bounds)"))
+	}
+	i, err := r.newIndexIter()
+	if err != nil {
+		return r.corruptionError(int64(indexBH.offset), err)
+	}
+	for i.First(); i.Valid(); i.Next() {
+		v := i.Value()
+		bh, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			return r.corruptionError(int64(indexBH.offset),
+				errors.New("pebble/table: invalid table (bad index entry)"))
+		}
+		if !inBounds(bh) {
+			return r.corruptionError(int64(indexBH.offset),
+				errors.New("pebble/table: invalid table (index entry out of bounds)"))
+		}
+	}
+	return i.Close()
+}
+
+// ReaderOption provides an interface to configure a Reader beyond the
+// options in db.Options. *FilterMetrics implements ReaderOption, directing
+// the reader to record the outcome of filter checks.
+type ReaderOption interface {
+	readerApply(*Reader)
+}
+
+// CorruptionReporter is a ReaderOption which is invoked each time the reader
+// finds a corrupted block: a block whose checksum does not match, or which
+// cannot be decompressed or decoded. The corruption is also returned by the
+// read. The reporter may be invoked concurrently by the readers sharing it.
+type CorruptionReporter func(err *db.CorruptionError)
+
+func (f CorruptionReporter) readerApply(r *Reader) {
+	r.corruptionReporter = f
+}
+
 // NewReader returns a new table reader for the file. Closing the reader will
 // close the file.
-func NewReader(f storage.File, fileNum uint64, o *db.Options) *Reader {
+func NewReader(f storage.File, fileNum uint64, o *db.Options, extraOpts ...ReaderOption) *Reader {
 	o = o.EnsureDefaults()
 	r := &Reader{
-		file:    f,
-		fileNum: fileNum,
-		opts:    o,
-		cache:   o.Cache,
-		compare: o.Comparer.Compare,
+		file:            f,
+		fileNum:         fileNum,
+		opts:            o,
+		cache:           o.Cache,
+		compressedCache: o.CompressedCache,
+		compare:         o.Comparer.Compare,
+		split:           o.Comparer.Split,
+	}
+	for _, opt := range extraOpts {
+		opt.readerApply(r)
 	}
 	if f == nil {
 		r.err = errors.New("pebble/table: nil file")
 		return r
 	}
+	if n, ok := f.(interface{ Name() string }); ok {
+		r.path = n.Name()
+	}
 	stat, err := f.Stat()
 	if err != nil {
 		r.err = fmt.Errorf("pebble/table: invalid table (could not stat file): %v", err)
@@ -518,36 +1216,51 @@ func NewReader(f storage.File, fileNum uint64, o *db.Options) *Reader {
 	//    footer version (4 bytes)
 	//    table_magic_number (8 bytes)
 	footer := make([]byte, footerLen)
-	if stat.Size() < int64(len(footer)) {
-		r.err = errors.New("pebble/table: invalid table (file size is too small)")
+	if stat.Size() < levelDBFooterLen {
+		r.err = r.corruptionError(0, errors.New("pebble/table: invalid table (file size is too small)"))
 		return r
 	}
-	_, err = f.ReadAt(footer, stat.Size()-int64(len(footer)))
+	if stat.Size() < footerLen {
+		footer = footer[:stat.Size()]
+	}
+	footerOffset := stat.Size() - int64(len(footer))
+	_, err = f.ReadAt(footer, footerOffset)
 	if err != nil && err != io.EOF {
 		r.err = fmt.Errorf("pebble/table: invalid table (could not read footer): %v", err)
 		return r
 	}
-	if string(footer[magicOffset:footerLen]) != magic {
-		r.err = errors.New("pebble/table: invalid table (bad magic number)")
-		return r
-	}
 
-	version := binary.LittleEndian.Uint32(footer[versionOffset:magicOffset])
-	if version != formatVersion {
-		r.err = fmt.Errorf("pebble/table: unsupported format version %d", version)
-		return r
-	}
+	switch magicStart := len(footer) - len(magic); {
+	case string(footer[magicStart:]) == levelDBMagic:
+		// The legacy LevelDB footer is shorter than the RocksDB footer and has
+		// no version or checksum type.
+		footer = footer[len(footer)-levelDBFooterLen:]
+		footerOffset = stat.Size() - levelDBFooterLen
+		r.formatVersion = 0
+		r.checksumType = checksumCRC32c
+
+	case string(footer[magicStart:]) == magic && len(footer) == footerLen:
+		r.formatVersion = binary.LittleEndian.Uint32(footer[versionOffset:magicOffset])
+		if r.formatVersion < 1 || r.formatVersion > maxFormatVersion {
+			r.err = fmt.Errorf("pebble/table: unsupported format version %d", r.formatVersion)
+			return r
+		}
+		r.checksumType = footer[0]
+		if r.checksumType != checksumCRC32c && r.checksumType != checksumXXHash {
+			r.err = fmt.Errorf("pebble/table: unsupported checksum type %d", r.checksumType)
+			return r
+		}
+		footer = footer[1:]
 
-	if footer[0] != checksumCRC32c {
-		r.err = fmt.Errorf("pebble/table: unsupported checksum type %d", footer[0])
+	default:
+		r.err = r.corruptionError(footerOffset, errors.New("pebble/table: invalid table (bad magic number)"))
 		return r
 	}
-	footer = footer[1:]
 
 	// Read the metaindex.
 	metaindexBH, n := decodeBlockHandle(footer)
 	if n == 0 {
-		r.err = errors.New("pebble/table: invalid table (bad metaindex block handle)")
+		r.err = r.corruptionError(footerOffset, errors.New("pebble/table: invalid table (bad metaindex block handle)"))
 		return r
 	}
 	footer = footer[n:]
@@ -561,12 +1274,22 @@ func NewReader(f storage.File, fileNum uint64, o *db.Options) *Reader {
 	// TODO(peter): Allow the index block to be placed in the block cache.
 	indexBH, n := decodeBlockHandle(footer)
 	if n == 0 {
-		r.err = errors.New("pebble/table: invalid table (bad index block handle)")
+		r.err = r.corruptionError(footerOffset, errors.New("pebble/table: invalid table (bad index block handle)"))
 		return r
 	}
 
 	footer = footer[n:]
-	r.index, r.err = r.readBlock(indexBH)
+	r.size = stat.Size()
+	r.metaindexBH = metaindexBH
+	r.indexBH = indexBH
+	if o.LazyTableIndex {
+		r.lazyIndex = true
+	} else {
+		r.index, r.err = r.readIndex(indexBH)
+	}
+	if r.err == nil && o.ParanoidChecks {
+		r.err = r.paranoidCheck(stat.Size(), metaindexBH, indexBH)
+	}
 
 	// iter, _ := newBlockIter(r.compare, r.index)
 	// for iter.First(); iter.Valid(); iter.Next() {
@@ -574,3 +1297,192 @@ func NewReader(f storage.File, fileNum uint64, o *db.Options) *Reader {
 	// }
 	return r
 }
+
+// loadIndex returns the index block, reading it if the reader reads its index
+// lazily and the index has not been read yet.
+func (r *Reader) loadIndex() (block, error) {
+	if !r.lazyIndex {
+		return r.index, nil
+	}
+	r.indexOnce.Do(func() {
+		r.index, r.indexErr = r.readIndex(r.indexBH)
+	})
+	return r.index, r.indexErr
+}
+
+// newIndexIter returns an iterator over the index block, reading it if
+// necessary.
+func (r *Reader) newIndexIter() (*blockIter, error) {
+	index, err := r.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	return newBlockIter(r.compare, index)
+}
+
+// decodeZlib decompresses a zlib compressed block written by RocksDB, which
+// writes raw deflate streams. Blocks in format version 2 and later are
+// prefixed by their varint-encoded decompressed length.
+func decodeZlib(b []byte, sizePrefix bool) ([]byte, error) {
+	var size uint64
+	if sizePrefix {
+		var n int
+		size, n = binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("pebble/table: invalid zlib block (bad size prefix)")
+		}
+		b = b[n:]
+	}
+	var buf bytes.Buffer
+	if size < 64<<20 {
+		buf.Grow(int(size))
+	}
+	rd := flate.NewReader(bytes.NewReader(b))
+	if _, err := io.Copy(&buf, rd); err != nil {
+		return nil, err
+	}
+	if err := rd.Close(); err != nil {
+		return nil, err
+	}
+	if sizePrefix && uint64(buf.Len()) != size {
+		return nil, fmt.Errorf("pebble/table: invalid zlib block (decompressed %d bytes, expected %d)",
+			buf.Len(), size)
+	}
+	return buf.Bytes(), nil
+}
+
+// readIndex reads the index block into memory. Index blocks written by
+// RocksDB with user keys, delta-encoded values or partitions are converted
+// into the format written by Writer: a single block, with a restart interval
+// of 1, mapping internal keys to block handles.
+func (r *Reader) readIndex(indexBH blockHandle) (block, error) {
+	b, err := r.readBlock(indexBH, nil, true /* fillCache */)
+	if err != nil {
+		return nil, err
+	}
+	p := &r.Properties
+	switch p.IndexType {
+	case binarySearchIndex, hashSearchIndex, twoLevelIndexSearch:
+	default:
+		return nil, fmt.Errorf("pebble/table: unsupported index type %d", p.IndexType)
+	}
+	if p.IndexKeyIsUserKey == 0 && p.IndexValueIsDeltaEncoded == 0 &&
+		p.IndexType != twoLevelIndexSearch {
+		return b, nil
+	}
+
+	var w blockWriter
+	w.restartInterval = 1
+	var tmp [2 * binary.MaxVarintLen64]byte
+	add := func(key []byte, bh blockHandle) error {
+		var ikey db.InternalKey
+		if p.IndexKeyIsUserKey != 0 {
+			// A user key separator is >= every user key in the preceding block,
+			// and every version of that user key, which the smallest possible
+			// trailer preserves.
+			ikey = db.MakeInternalKey(key, 0, db.InternalKeyKindDelete)
+		} else {
+			ikey = db.DecodeInternalKey(key)
+		}
+		n := encodeBlockHandle(tmp[:], bh)
+		w.add(ikey, tmp[:n])
+		return nil
+	}
+
+	deltaEncoded := p.IndexValueIsDeltaEncoded != 0
+	if p.IndexType != twoLevelIndexSearch {
+		err = decodeIndexBlock(b, deltaEncoded, add)
+	} else {
+		err = decodeIndexBlock(b, deltaEncoded, func(_ []byte, bh blockHandle) error {
+			partition, err := r.readBlock(bh, nil, true /* fillCache */)
+			if err != nil {
+				return err
+			}
+			return decodeIndexBlock(partition, deltaEncoded, add)
+		})
+	}
+	if err != nil {
+		return nil, r.corruptionError(int64(indexBH.offset), err)
+	}
+	return w.finish(), nil
+}
+
+// decodeIndexBlock invokes fn with the key and block handle of each entry of
+// an index block written by RocksDB. If the values are delta-encoded, entries
+// do not store the length of their value, and an entry which shares a key
+// prefix with the previous entry stores only the signed difference between
+// its block length and the length of the previous block. The key passed to fn
+// is only valid for the duration of the call.
+func decodeIndexBlock(
+	b block, deltaEncoded bool, fn func(key []byte, bh blockHandle) error,
+) error {
+	errBadIndex := errors.New("pebble/table: invalid table (bad index block)")
+	if len(b) < 4 {
+		return errBadIndex
+	}
+	numRestarts := int(binary.LittleEndian.Uint32(b[len(b)-4:]))
+	end := len(b) - 4*(1+numRestarts)
+	if numRestarts == 0 || end < 0 {
+		return errBadIndex
+	}
+
+	var key []byte
+	var prev blockHandle
+	for offset := 0; offset < end; {
+		shared, n := binary.Uvarint(b[offset:end])
+		if n <= 0 {
+			return errBadIndex
+		}
+		offset += n
+		unshared, n := binary.Uvarint(b[offset:end])
+		if n <= 0 {
+			return errBadIndex
+		}
+		offset += n
+		var valueLen uint64
+		if !deltaEncoded {
+			valueLen, n = binary.Uvarint(b[offset:end])
+			if n <= 0 {
+				return errBadIndex
+			}
+			offset += n
+		}
+		if shared > uint64(len(key)) || unshared > uint64(end-offset) {
+			return errBadIndex
+		}
+		key = append(key[:shared], b[offset:offset+int(unshared)]...)
+		offset += int(unshared)
+
+		var bh blockHandle
+		switch {
+		case !deltaEncoded:
+			if valueLen > uint64(end-offset) {
+				return errBadIndex
+			}
+			bh, n = decodeBlockHandle(b[offset : offset+int(valueLen)])
+			if n <= 0 {
+				return errBadIndex
+			}
+			offset += int(valueLen)
+		case shared == 0:
+			bh, n = decodeBlockHandle(b[offset:end])
+			if n <= 0 {
+				return errBadIndex
+			}
+			offset += n
+		default:
+			delta, n := binary.Varint(b[offset:end])
+			if n <= 0 {
+				return errBadIndex
+			}
+			offset += n
+			bh.offset = prev.offset + prev.length + blockTrailerLen
+			bh.length = uint64(int64(prev.length) + delta)
+		}
+		if err := fn(key, bh); err != nil {
+			return err
+		}
+		prev = bh
+	}
+	return nil
+}
@@ -119,6 +119,32 @@ The table footer is exactly 48 bytes long:
 A block handle is an offset and a length; the length does not include the 5
 byte trailer. Both numbers are varint-encoded, with no padding between the two
 values. The maximum size of an encoded block handle is therefore 20 bytes.
+
+The footer described above is the legacy LevelDB footer. Tables written by
+RocksDB, and by this package, use a 53 byte footer which additionally records
+the checksum type (1 byte, before the block handles) and the format version
+(4 bytes, before the magic string), and uses a different magic string. The
+reader supports the following RocksDB format versions:
+
+  - 0 and 1: the original block-based table format, with the legacy and the
+    extended footer respectively.
+  - 2: changes the encoding of zlib (and other non-snappy) compressed blocks
+    to be prefixed by the varint-encoded decompressed length. This is the
+    version written by this package.
+  - 3: allows index keys to be user keys rather than internal keys, as
+    indicated by the "rocksdb.index.key.is.user.key" property.
+  - 4: allows index values to be delta-encoded, as indicated by the
+    "rocksdb.index.value.is.delta.encoded" property. An index entry which
+    shares a key prefix with the previous entry stores only the difference
+    between its block length and the previous block length, the offset being
+    implied by the previous block handle.
+  - 5: changes the encoding of bloom filters. Filters in such tables are
+    ignored.
+
+RocksDB may also write a two-level index, in which the index block refers to
+index partitions instead of data blocks. The reader flattens the partitions,
+and converts user key and delta-encoded index entries, into a single index
+block in the format written by this package when the table is opened.
 */
 
 const (
@@ -130,12 +156,27 @@ const (
 
 	magic = "\xf7\xcf\xf4\x85\xb7\x41\xe2\x88"
 
+	levelDBFooterLen   = 2*blockHandleMaxLen + 8
+	levelDBMagicOffset = levelDBFooterLen - len(levelDBMagic)
+
+	levelDBMagic = "\x57\xfb\x80\x8b\x24\x75\x47\xdb"
+
 	noChecksum     = 0
 	checksumCRC32c = 1
 	checksumXXHash = 2
 
 	formatVersion = 2
 
+	// maxFormatVersion is the newest RocksDB format version that can be read.
+	maxFormatVersion = 5
+
+	// The index types recorded in the "rocksdb.block.based.table.index.type"
+	// property. A hash search index is a binary search index accompanied by
+	// additional meta blocks, which are ignored.
+	binarySearchIndex   = 0
+	hashSearchIndex     = 1
+	twoLevelIndexSearch = 2
+
 	// The block type gives the per-block compression format.
 	// These constants are part of the file format and should not be changed.
 	// They are different from the db.Compression constants because the latter
@@ -143,4 +184,5 @@ const (
 	// use the default compression (which is snappy).
 	noCompressionBlockType     = 0
 	snappyCompressionBlockType = 1
+	zlibCompressionBlockType   = 2
 )
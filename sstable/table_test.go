@@ -7,6 +7,7 @@ package sstable
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -18,6 +19,8 @@ import (
 	"testing"
 
 	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/cache"
+	"github.com/petermattis/pebble/crc"
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/storage"
 )
@@ -232,6 +235,16 @@ var (
 	tmpFileCount  int
 )
 
+// nullptrMerger mimics the merge operator name RocksDB records for tables
+// written without a merge operator.
+type nullptrMerger struct {
+	db.MergeOperator
+}
+
+func (nullptrMerger) Name() string {
+	return "nullptr"
+}
+
 func build(
 	compression db.Compression,
 	fp db.FilterPolicy,
@@ -255,9 +268,7 @@ func build(
 	defer f0.Close()
 	tmpFileCount++
 	w := NewWriter(f0, &db.Options{
-		Merger: &db.Merger{
-			Name: "nullptr",
-		},
+		Merger: nullptrMerger{db.DefaultMerger},
 	}, db.LevelOptions{
 		Compression:  compression,
 		FilterPolicy: fp,
@@ -573,3 +584,1363 @@ func TestReaderGlobalSeqNum(t *testing.T) {
 		}
 	}
 }
+
+func TestReaderCorruptBlocks(t *testing.T) {
+	mem := storage.NewMem()
+	f0, err := mem.Create("table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, nil, db.LevelOptions{BlockSize: 100, Compression: db.NoCompression})
+	for i := 0; i < 100; i++ {
+		key := db.MakeInternalKey([]byte(fmt.Sprintf("%03d", i)), 0, db.InternalKeyKindSet)
+		if err := w.Add(key, make([]byte, 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var reported []*db.CorruptionError
+	open := func() *Reader {
+		f, err := mem.Open("table")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewReader(f, 1, nil, CorruptionReporter(func(err *db.CorruptionError) {
+			reported = append(reported, err)
+		}))
+	}
+	r := open()
+	layout, err := r.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if len(layout.Data) < 3 {
+		t.Fatalf("expected at least 3 data blocks, but found %d", len(layout.Data))
+	}
+
+	// Corrupt the second data block.
+	f, err := mem.Open("table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	bh := layout.Data[1]
+	data[bh.Offset] ^= 0xff
+	f, err = mem.Create("table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	scan := func(skip bool) (int, error) {
+		r := open()
+		defer r.Close()
+		i := r.NewIter(nil).(*Iter)
+		i.SetSkipCorruptBlocks(skip)
+		var n int
+		for i.First(); i.Valid(); i.Next() {
+			n++
+		}
+		return n, i.Close()
+	}
+
+	// An iterator stops at the corrupted block.
+	n, err := scan(false)
+	if ce, ok := err.(*db.CorruptionError); !ok || ce.Offset != int64(bh.Offset) {
+		t.Fatalf("expected a corruption at offset %d, but found %v", bh.Offset, err)
+	}
+	if n == 0 || n >= 100 {
+		t.Fatalf("expected the keys before the corrupted block, but found %d keys", n)
+	}
+	if len(reported) != 1 || reported[0].Offset != int64(bh.Offset) {
+		t.Fatalf("expected the corruption to be reported, but found %v", reported)
+	}
+
+	// An iterator which skips corrupted blocks returns the other keys.
+	before := n
+	n, err = scan(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n <= before || n >= 100 {
+		t.Fatalf("expected the keys of the uncorrupted blocks, but found %d keys", n)
+	}
+	if len(reported) != 2 {
+		t.Fatalf("expected the corruption to be reported again, but found %v", reported)
+	}
+}
+
+func TestReaderVerifyChecksums(t *testing.T) {
+	mem := storage.NewMem()
+	f0, err := mem.Create("orig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, nil, db.LevelOptions{Compression: db.NoCompression})
+	if err := w.Add(db.MakeInternalKey([]byte("a"), 0, db.InternalKeyKindSet), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a copy of the table with a corrupted data block. The first data
+	// block is at the start of the file.
+	f0, err = mem.Open("orig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 0xff
+	f1, err := mem.Create("corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f1.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := cache.New(1 << 20)
+	open := func(name string, verify bool) *Reader {
+		f, err := mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewReader(f, 1, &db.Options{
+			Cache:           c,
+			ParanoidChecks:  true,
+			VerifyChecksums: verify,
+		})
+	}
+
+	// Populate the cache using the uncorrupted table.
+	r := open("orig", false)
+	if _, err := r.get([]byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	// Reading the corrupted table is served from the cache.
+	r = open("corrupt", false)
+	if _, err := r.get([]byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	// Unless checksum verification is forced.
+	r = open("corrupt", true)
+	if _, err := r.get([]byte("a"), nil); err == nil ||
+		!strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, but found %v", err)
+	} else if ce, ok := err.(*db.CorruptionError); !ok ||
+		ce.FileType != db.FileTypeTable || ce.FileNum != 1 || ce.Offset != 0 {
+		t.Fatalf("expected table corruption at offset 0, but found %#v", err)
+	}
+	r.Close()
+
+	// Or requested by the read.
+	r = open("corrupt", false)
+	if _, err := r.get([]byte("a"), &db.IterOptions{VerifyChecksums: true}); err == nil ||
+		!strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, but found %v", err)
+	}
+	i := r.NewIter(&db.IterOptions{VerifyChecksums: true})
+	if i.First(); i.Valid() {
+		t.Fatalf("expected no entries, but found %s", i.Key())
+	}
+	if err := i.Close(); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, but found %v", err)
+	}
+	r.Close()
+
+	// Scrubbing always reads from disk.
+	r = open("orig", false)
+	if _, err := r.ScrubBlocks(nil); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	r = open("corrupt", false)
+	var scrubbed int
+	offset, err := r.ScrubBlocks(func(n int) error {
+		scrubbed += n
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, but found %v", err)
+	}
+	if offset != 0 || scrubbed == 0 {
+		t.Fatalf("expected corruption at offset 0 after scrubbing, but found %d after %d bytes",
+			offset, scrubbed)
+	}
+	r.Close()
+
+	// As does verifying the checksums of every block.
+	r = open("orig", false)
+	if err := r.VerifyChecksums(); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	r = open("corrupt", false)
+	if err := r.VerifyChecksums(); err == nil {
+		t.Fatal("expected checksum mismatch, but found success")
+	} else if ce, ok := err.(*db.CorruptionError); !ok || ce.Offset != 0 {
+		t.Fatalf("expected table corruption at offset 0, but found %#v", err)
+	}
+	r.Close()
+}
+
+func TestReaderLayout(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("testdata/h.table-bloom.no-compression.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, &db.Options{
+		Levels: []db.LevelOptions{{
+			FilterPolicy: bloom.FilterPolicy(10),
+		}},
+	})
+	defer r.Close()
+
+	l, err := r.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(l.Data)) != r.Properties.NumDataBlocks {
+		t.Fatalf("expected %d data blocks, but found %d", r.Properties.NumDataBlocks, len(l.Data))
+	}
+	if l.Filter.Length == 0 {
+		t.Fatalf("expected a filter block")
+	}
+
+	// The blocks, each followed by its trailer, must tile the file.
+	blocks := append([]BlockHandle(nil), l.Data...)
+	blocks = append(blocks, l.Filter, l.Properties, l.MetaIndex, l.Index)
+	var offset uint64
+	for _, bh := range blocks {
+		if bh.Offset != offset {
+			t.Fatalf("expected block at offset %d, but found %d", offset, bh.Offset)
+		}
+		offset += bh.Length + blockTrailerLen
+	}
+	if offset != l.Footer.Offset || offset+l.Footer.Length != uint64(stat.Size()) {
+		t.Fatalf("expected footer at offset %d, but found %d", offset, l.Footer.Offset)
+	}
+}
+
+func TestReaderReadStats(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("testdata/h.no-compression.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, &db.Options{Cache: cache.New(1 << 20)})
+	defer r.Close()
+
+	l, err := r.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fileBytes, cacheBytes int64
+	for _, bh := range l.Data {
+		fileBytes += int64(bh.Length + blockTrailerLen)
+		cacheBytes += int64(bh.Length)
+	}
+
+	scan := func(stats *ReadStats) {
+		i := r.NewIter(nil).(*Iter)
+		i.SetReadStats(stats)
+		for i.First(); i.Valid(); i.Next() {
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first scan reads the data blocks from the file, and the second finds
+	// them in the cache.
+	var stats ReadStats
+	scan(&stats)
+	if stats.FileBytes != fileBytes || stats.CacheBytes != 0 {
+		t.Fatalf("expected %d file bytes, but found %+v", fileBytes, stats)
+	}
+	scan(&stats)
+	if stats.FileBytes != fileBytes || stats.CacheBytes != cacheBytes {
+		t.Fatalf("expected %d file bytes and %d cache bytes, but found %+v",
+			fileBytes, cacheBytes, stats)
+	}
+
+	// Iterators without stats are not accounted.
+	scan(nil)
+	if stats.FileBytes != fileBytes || stats.CacheBytes != cacheBytes {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestReaderFillCache(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("testdata/h.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.New(1 << 20)
+	cc := cache.New(1 << 20)
+	r := NewReader(f, 0, &db.Options{Cache: c, CompressedCache: cc})
+	defer r.Close()
+
+	scan := func(fill bool, stats *ReadStats) {
+		i := r.NewIter(nil).(*Iter)
+		i.SetFillCache(fill)
+		i.SetReadStats(stats)
+		for i.First(); i.Valid(); i.Next() {
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An iterator which does not fill the caches reads every block from the
+	// file, and leaves the caches as they were.
+	size, compressedSize := c.Metrics().Size, cc.Metrics().Size
+	var stats ReadStats
+	scan(false, &stats)
+	fileBytes := stats.FileBytes
+	scan(false, &stats)
+	if fileBytes == 0 || stats.FileBytes != 2*fileBytes {
+		t.Fatalf("expected the blocks to be read from the file twice, but found %+v", stats)
+	}
+	if c.Metrics().Size != size || cc.Metrics().Size != compressedSize {
+		t.Fatalf("expected the caches not to be filled")
+	}
+
+	// Once the blocks are cached by an iterator which fills the caches, they
+	// are used by iterators which do not.
+	scan(true, nil)
+	stats = ReadStats{}
+	scan(false, &stats)
+	if stats.FileBytes != 0 || stats.CacheBytes == 0 {
+		t.Fatalf("expected the blocks to be found in the cache, but found %+v", stats)
+	}
+
+	// The policy is reset by Init.
+	i := r.NewIter(nil).(*Iter)
+	i.SetFillCache(false)
+	if err := i.Init(r); err != nil {
+		t.Fatal(err)
+	}
+	if i.noFillCache {
+		t.Fatalf("expected Init to reset the cache policy")
+	}
+}
+
+func TestReaderPrefetch(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("testdata/h.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, &db.Options{Cache: cache.New(1 << 20)})
+	defer r.Close()
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var stats ReadStats
+	if err := r.Prefetch(nil, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.FileBytes == 0 {
+		t.Fatalf("expected the first block to be read from the file, but found %+v", stats)
+	}
+	if err := r.Prefetch([]byte("\xff\xff\xff"), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	// The prefetched block is found in the cache by an iterator.
+	prefetched := stats
+	i := r.NewIter(nil).(*Iter)
+	i.SetReadStats(&stats)
+	i.First()
+	if !i.Valid() {
+		t.Fatalf("expected a key")
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stats.FileBytes != prefetched.FileBytes || stats.CacheBytes == 0 {
+		t.Fatalf("expected the first block to be found in the cache, but found %+v", stats)
+	}
+}
+
+func TestReaderLazyIndex(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("testdata/h.table-bloom.no-compression.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, &db.Options{
+		LazyTableIndex: true,
+		Levels: []db.LevelOptions{{
+			FilterPolicy: bloom.FilterPolicy(10),
+		}},
+	})
+	defer r.Close()
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if r.index != nil {
+		t.Fatalf("expected the index not to be read when the table is opened")
+	}
+
+	// A lookup ruled out by the filter does not read the index.
+	if _, err := r.get([]byte("\x00"), nil); err != db.ErrNotFound {
+		t.Fatalf("expected %v, but found %v", db.ErrNotFound, err)
+	}
+	if r.index != nil {
+		t.Fatalf("expected the index not to be read by a filtered lookup")
+	}
+
+	if v, err := r.get([]byte("aboard"), nil); err != nil || string(v) != "2" {
+		t.Fatalf("expected 2, but found %q (%v)", v, err)
+	}
+	if r.index == nil {
+		t.Fatalf("expected the index to be read by the lookup")
+	}
+	i := r.NewIter(nil)
+	var n int
+	for i.First(); i.Valid(); i.Next() {
+		n++
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatalf("expected the table to be scanned")
+	}
+}
+
+func TestReaderCompressedCache(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("testdata/h.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, &db.Options{CompressedCache: cache.New(1 << 20)})
+	defer r.Close()
+
+	scan := func(stats *ReadStats) []string {
+		i := r.NewIter(nil).(*Iter)
+		i.SetReadStats(stats)
+		var kvs []string
+		for i.First(); i.Valid(); i.Next() {
+			kvs = append(kvs, fmt.Sprintf("%s:%s", i.Key().UserKey, i.Value()))
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return kvs
+	}
+
+	// Without a block cache, the second scan decompresses the blocks found in
+	// the compressed block cache.
+	var stats ReadStats
+	expected := scan(&stats)
+	fileBytes := stats.FileBytes
+	if fileBytes == 0 || stats.CompressedCacheBytes != 0 {
+		t.Fatalf("expected the blocks to be read from the file, but found %+v", stats)
+	}
+	if kvs := scan(&stats); fmt.Sprint(kvs) != fmt.Sprint(expected) {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, kvs)
+	}
+	if stats.FileBytes != fileBytes || stats.CompressedCacheBytes == 0 || stats.CacheBytes != 0 {
+		t.Fatalf("expected the blocks to be found in the compressed cache, but found %+v", stats)
+	}
+	if m := r.compressedCache.Metrics(); m.Hits == 0 {
+		t.Fatalf("expected compressed cache hits, but found %+v", m)
+	}
+
+	// With a block cache, the decompressed blocks are added to it.
+	r.cache = cache.New(1 << 20)
+	stats = ReadStats{}
+	scan(&stats)
+	scan(&stats)
+	if stats.FileBytes != 0 || stats.CompressedCacheBytes == 0 || stats.CacheBytes == 0 {
+		t.Fatalf("expected the blocks to be found in both caches, but found %+v", stats)
+	}
+	if m := r.cache.Metrics(); m.Hits == 0 {
+		t.Fatalf("expected cache hits, but found %+v", m)
+	}
+}
+
+func TestReaderBlockInfo(t *testing.T) {
+	mem := storage.NewMem()
+	f0, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, nil, db.LevelOptions{
+		BlockRestartInterval: 4,
+		BlockSize:            512,
+		Compression:          db.NoCompression,
+	})
+	const count = 1000
+	for i := 0; i < count; i++ {
+		key := db.MakeInternalKey([]byte(fmt.Sprintf("%05d", i)), 0, db.InternalKeyKindSet)
+		if err := w.Add(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, 0, nil)
+	defer r.Close()
+
+	l, err := r.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Data) < 2 {
+		t.Fatalf("expected multiple data blocks, but found %d", len(l.Data))
+	}
+
+	var entries int
+	var prev db.InternalKey
+	for i, bh := range l.Data {
+		info, err := r.BlockInfo(bh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The block size is checked before each key is added, so a block may
+		// exceed the target by a single entry.
+		if info.Length > 512+64 {
+			t.Fatalf("%d: expected block length <= %d, but found %d", i, 512+64, info.Length)
+		}
+		if expected := (info.Entries + 3) / 4; info.Restarts != expected {
+			t.Fatalf("%d: expected %d restarts for %d entries, but found %d",
+				i, expected, info.Entries, info.Restarts)
+		}
+		if i > 0 && db.InternalCompare(bytes.Compare, prev, info.First) >= 0 {
+			t.Fatalf("%d: expected %s < %s", i, prev, info.First)
+		}
+		prev = info.Last
+		entries += info.Entries
+	}
+	if entries != count {
+		t.Fatalf("expected %d entries, but found %d", count, entries)
+	}
+
+	info, err := r.BlockInfo(l.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Entries != len(l.Data) {
+		t.Fatalf("expected %d index entries, but found %d", len(l.Data), info.Entries)
+	}
+}
+
+func TestWriterIndexSeparators(t *testing.T) {
+	// Keys that differ early but carry a long common suffix. Without separator
+	// shortening every index entry would contain the full suffix.
+	suffix := strings.Repeat("x", 100)
+	const count = 1000
+
+	build := func(comparer *db.Comparer) *Reader {
+		mem := storage.NewMem()
+		f0, err := mem.Create("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f0, &db.Options{Comparer: comparer}, db.LevelOptions{
+			BlockSize:   1024,
+			Compression: db.NoCompression,
+		})
+		for i := 0; i < count; i++ {
+			key := db.MakeInternalKey([]byte(fmt.Sprintf("%05d%s", i, suffix)), 0, db.InternalKeyKindSet)
+			if err := w.Add(key, []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f1, err := mem.Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewReader(f1, 0, &db.Options{Comparer: comparer})
+	}
+
+	// A comparer without Separator and Successor stores the full last key of
+	// each block in the index.
+	full := build(&db.Comparer{
+		Compare:   db.DefaultComparer.Compare,
+		InlineKey: db.DefaultComparer.InlineKey,
+		Name:      db.DefaultComparer.Name,
+	})
+	defer full.Close()
+	short := build(db.DefaultComparer)
+	defer short.Close()
+
+	fullLayout, err := full.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortLayout, err := short.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fullLayout.Data) != len(shortLayout.Data) {
+		t.Fatalf("expected %d data blocks, but found %d", len(fullLayout.Data), len(shortLayout.Data))
+	}
+	if shortLayout.Index.Length*2 > fullLayout.Index.Length {
+		t.Fatalf("expected index block to shrink by at least half: %d vs %d",
+			shortLayout.Index.Length, fullLayout.Index.Length)
+	}
+
+	// Every key must still be found via the shortened index.
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("%05d%s", i, suffix))
+		if _, err := short.get(key, nil); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+	}
+	iter := short.NewIter(nil)
+	var n int
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != count {
+		t.Fatalf("expected %d keys, but found %d", count, n)
+	}
+}
+
+func TestWriterBlockSize(t *testing.T) {
+	for _, restartInterval := range []int{1, 5, 16} {
+		for _, threshold := range []int{10, 50, 90} {
+			name := fmt.Sprintf("restart=%d,threshold=%d", restartInterval, threshold)
+			t.Run(name, func(t *testing.T) {
+				const blockSize = 1024
+				mem := storage.NewMem()
+				f0, err := mem.Create("test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				w := NewWriter(f0, nil, db.LevelOptions{
+					BlockRestartInterval: restartInterval,
+					BlockSize:            blockSize,
+					BlockSizeThreshold:   threshold,
+					Compression:          db.NoCompression,
+				})
+				for i := 0; i < 2000; i++ {
+					key := db.MakeInternalKey([]byte(fmt.Sprintf("%06d", i)), 0, db.InternalKeyKindSet)
+					if err := w.Add(key, []byte(strings.Repeat("v", i%17))); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				f1, err := mem.Open("test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := NewReader(f1, 0, nil)
+				defer r.Close()
+				l, err := r.Layout()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, bh := range l.Data {
+					info, err := r.BlockInfo(bh)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if expected := (info.Entries + restartInterval - 1) / restartInterval; info.Restarts != expected {
+						t.Fatalf("%d: expected %d restarts, but found %d", i, expected, info.Restarts)
+					}
+					if bh.Length > blockSize {
+						t.Fatalf("%d: expected block length <= %d, but found %d", i, blockSize, bh.Length)
+					}
+					// Every block but the last is finished only once it exceeds the
+					// threshold.
+					if i < len(l.Data)-1 && int(bh.Length) <= blockSize*threshold/100 {
+						t.Fatalf("%d: expected block length > %d, but found %d",
+							i, blockSize*threshold/100, bh.Length)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestPartitionedFilter(t *testing.T) {
+	keys := make([]string, 0, len(wordCount))
+	for k := range wordCount {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	write := func() storage.File {
+		mem := storage.NewMem()
+		f0, err := mem.Create("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f0, nil, db.LevelOptions{
+			Compression:         db.NoCompression,
+			FilterPartitionSize: 8 << 10,
+			FilterPolicy:        bloom.FilterPolicy(10),
+			FilterType:          db.PartitionedFilter,
+		})
+		for _, k := range keys {
+			ikey := db.MakeInternalKey([]byte(k), 0, db.InternalKeyKindSet)
+			if err := w.Add(ikey, []byte(wordCount[k])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f1, err := mem.Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f1
+	}
+
+	// The table must be readable with and without the filter.
+	if err := check(write(), nil); err != nil {
+		t.Fatal(err)
+	}
+	c := &countingFilterPolicy{FilterPolicy: bloom.FilterPolicy(10)}
+	if err := check(write(), c); err != nil {
+		t.Fatal(err)
+	}
+	if c.truePositives != len(wordCount) || c.falseNegatives != 0 {
+		t.Fatalf("true positives: got %d, want %d; false negatives: got %d, want 0",
+			c.truePositives, len(wordCount), c.falseNegatives)
+	}
+	if c.trueNegatives == 0 {
+		t.Fatalf("expected the filter to reject nonsense words")
+	}
+
+	f := write()
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m FilterMetrics
+	r := NewReader(f, 0, &db.Options{
+		Levels: []db.LevelOptions{{
+			FilterPolicy: bloom.FilterPolicy(10),
+		}},
+	}, &m)
+	defer r.Close()
+
+	// The partitions, the partition index and the other blocks must tile the
+	// file.
+	l, err := r.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.FilterPartitions) < 2 {
+		t.Fatalf("expected multiple filter partitions, but found %d", len(l.FilterPartitions))
+	}
+	blocks := append([]BlockHandle(nil), l.Data...)
+	blocks = append(blocks, l.FilterPartitions...)
+	blocks = append(blocks, l.Filter, l.Properties, l.MetaIndex, l.Index)
+	var offset, filterSize uint64
+	for _, bh := range blocks {
+		if bh.Offset != offset {
+			t.Fatalf("expected block at offset %d, but found %d", offset, bh.Offset)
+		}
+		offset += bh.Length + blockTrailerLen
+	}
+	if offset != l.Footer.Offset || offset+l.Footer.Length != uint64(stat.Size()) {
+		t.Fatalf("expected footer at offset %d, but found %d", offset, l.Footer.Offset)
+	}
+	for _, bh := range l.FilterPartitions {
+		filterSize += bh.Length
+	}
+	filterSize += l.Filter.Length
+	if r.Properties.FilterSize != filterSize {
+		t.Fatalf("expected filter size %d, but found %d", filterSize, r.Properties.FilterSize)
+	}
+
+	// Present keys are filter misses which are not false positives.
+	for _, k := range keys {
+		if _, err := r.get([]byte(k), nil); err != nil {
+			t.Fatalf("%s: %v", k, err)
+		}
+	}
+	if m.Hits != 0 || m.Misses != int64(len(keys)) || m.FalsePositives != 0 {
+		t.Fatalf("unexpected metrics: %+v", m)
+	}
+
+	// Absent keys are either filter hits or false positives.
+	m = FilterMetrics{}
+	const n = 10000
+	key := []byte("m!....")
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint32(key[2:6], uint32(i))
+		if _, err := r.get(key, nil); err != db.ErrNotFound {
+			t.Fatalf("%q: expected not found, but found %v", key, err)
+		}
+	}
+	if m.Hits+m.FalsePositives != n || m.Misses != m.FalsePositives {
+		t.Fatalf("unexpected metrics: %+v", m)
+	}
+	if rate := float64(100*m.FalsePositives) / n; rate < 0.2 || 5 < rate {
+		t.Fatalf("false positive rate: got %v%%, want approximately 1%%", rate)
+	}
+}
+
+func TestWriterOperationCounts(t *testing.T) {
+	mem := storage.NewMem()
+	f0, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, nil, db.LevelOptions{})
+	keys := []db.InternalKey{
+		db.MakeInternalKey([]byte("a"), 5, db.InternalKeyKindSet),
+		db.MakeInternalKey([]byte("b"), 4, db.InternalKeyKindMerge),
+		db.MakeInternalKey([]byte("b"), 3, db.InternalKeyKindMerge),
+		db.MakeInternalKey([]byte("c"), 2, db.InternalKeyKindDelete),
+		db.MakeInternalKey([]byte("d"), 1, db.InternalKeyKindRangeDelete),
+	}
+	for _, key := range keys {
+		value := []byte("value")
+		if key.Kind() == db.InternalKeyKindRangeDelete {
+			value = []byte("e")
+		}
+		if err := w.Add(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, 0, nil)
+	defer r.Close()
+
+	p := &r.Properties
+	if p.NumEntries != 5 || p.NumDeletions != 2 || p.NumRangeDeletions != 1 ||
+		p.NumMergeOperands != 2 {
+		t.Fatalf("unexpected properties:\n%s", p)
+	}
+}
+
+func TestXXHash32(t *testing.T) {
+	testCases := []struct {
+		data     string
+		expected uint32
+	}{
+		{"", 0x02cc5d05},
+		{"a", 0x550d7456},
+		{"abc", 0x32d153ff},
+		{"Nobody inspects the spammish repetition", 0xe2293b2f},
+	}
+	for _, c := range testCases {
+		if v := xxhash32([]byte(c.data)); v != c.expected {
+			t.Errorf("%q: expected %08x, but found %08x", c.data, c.expected, v)
+		}
+	}
+}
+
+func TestDecodeZlib(t *testing.T) {
+	data := []byte(strings.Repeat("hello world ", 100))
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Format versions before 2 do not prefix the block with its size.
+	got, err := decodeZlib(buf.Bytes(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatalf("expected %q, but found %q", data, got)
+	}
+
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(data)))
+	got, err = decodeZlib(append(tmp[:n:n], buf.Bytes()...), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatalf("expected %q, but found %q", data, got)
+	}
+
+	n = binary.PutUvarint(tmp[:], uint64(len(data)+1))
+	if _, err := decodeZlib(append(tmp[:n:n], buf.Bytes()...), true); err == nil {
+		t.Fatalf("expected error for mismatched size prefix")
+	}
+}
+
+type rocksDBTableOptions struct {
+	formatVersion uint32
+	checksumType  byte
+	userKeyIndex  bool
+	deltaIndex    bool
+	twoLevelIndex bool
+}
+
+// encodeRocksDBIndexBlock encodes an index block in the format written by
+// RocksDB, which stores user keys if userKeys is true and delta-encodes the
+// block handles if delta is true.
+func encodeRocksDBIndexBlock(
+	keys [][]byte, handles []blockHandle, restartInterval int, delta bool,
+) []byte {
+	var buf, prevKey []byte
+	var restarts []uint32
+	var tmp [3 * binary.MaxVarintLen64]byte
+	for i := range keys {
+		shared := 0
+		if i%restartInterval == 0 {
+			restarts = append(restarts, uint32(len(buf)))
+		} else {
+			shared = db.SharedPrefixLen(prevKey, keys[i])
+		}
+		var value []byte
+		if delta && shared != 0 {
+			n := binary.PutVarint(tmp[:], int64(handles[i].length)-int64(handles[i-1].length))
+			value = append(value, tmp[:n]...)
+		} else {
+			n := encodeBlockHandle(tmp[:], handles[i])
+			value = append(value, tmp[:n]...)
+		}
+		n := binary.PutUvarint(tmp[:], uint64(shared))
+		n += binary.PutUvarint(tmp[n:], uint64(len(keys[i])-shared))
+		if !delta {
+			n += binary.PutUvarint(tmp[n:], uint64(len(value)))
+		}
+		buf = append(buf, tmp[:n]...)
+		buf = append(buf, keys[i][shared:]...)
+		buf = append(buf, value...)
+		prevKey = keys[i]
+	}
+	for _, x := range restarts {
+		buf = append(buf, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(buf[len(buf)-4:], x)
+	}
+	buf = append(buf, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(buf[len(buf)-4:], uint32(len(restarts)))
+	return buf
+}
+
+// rewriteAsRocksDB rewrites a table written by Writer to use the specified
+// RocksDB format features. The data blocks are retained, while the filter is
+// dropped and the index, properties, metaindex and footer are regenerated.
+func rewriteAsRocksDB(t *testing.T, orig []byte, o rocksDBTableOptions) []byte {
+	mem := storage.NewMem()
+	f, err := mem.Create("orig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(orig); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = mem.Open("orig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	defer r.Close()
+	l, err := r.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checksum := func(b []byte) uint32 {
+		if o.checksumType == checksumXXHash {
+			return xxhash32(b)
+		}
+		return crc.New(b).Value()
+	}
+	last := l.Data[len(l.Data)-1]
+	out := append([]byte(nil), orig[:last.Offset+last.Length+blockTrailerLen]...)
+	for _, bh := range l.Data {
+		end := bh.Offset + bh.Length
+		binary.LittleEndian.PutUint32(out[end+1:], checksum(out[bh.Offset:end+1]))
+	}
+	writeBlock := func(b []byte) blockHandle {
+		bh := blockHandle{uint64(len(out)), uint64(len(b))}
+		out = append(out, b...)
+		out = append(out, noCompressionBlockType, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(out[len(out)-4:], checksum(out[bh.offset:bh.offset+bh.length+1]))
+		return bh
+	}
+
+	var keys [][]byte
+	var handles []blockHandle
+	iter, err := newBlockIter(r.compare, r.index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if o.userKeyIndex {
+			keys = append(keys, append([]byte(nil), key.UserKey...))
+		} else {
+			buf := make([]byte, key.Size())
+			key.Encode(buf)
+			keys = append(keys, buf)
+		}
+		bh, _ := decodeBlockHandle(iter.Value())
+		handles = append(handles, bh)
+	}
+
+	const restartInterval = 4
+	var indexBH blockHandle
+	if o.twoLevelIndex {
+		var topKeys [][]byte
+		var topHandles []blockHandle
+		for i := 0; i < len(keys); i += 3 {
+			j := i + 3
+			if j > len(keys) {
+				j = len(keys)
+			}
+			b := encodeRocksDBIndexBlock(keys[i:j], handles[i:j], restartInterval, o.deltaIndex)
+			topKeys = append(topKeys, keys[j-1])
+			topHandles = append(topHandles, writeBlock(b))
+		}
+		indexBH = writeBlock(encodeRocksDBIndexBlock(topKeys, topHandles, restartInterval, o.deltaIndex))
+	} else {
+		indexBH = writeBlock(encodeRocksDBIndexBlock(keys, handles, restartInterval, o.deltaIndex))
+	}
+
+	props := r.Properties
+	props.FilterPolicyName = ""
+	props.FilterSize = 0
+	props.ValueOffsets = nil
+	if o.userKeyIndex {
+		props.IndexKeyIsUserKey = 1
+	}
+	if o.deltaIndex {
+		props.IndexValueIsDeltaEncoded = 1
+	}
+	if o.twoLevelIndex {
+		props.IndexType = twoLevelIndexSearch
+	}
+	var raw rawBlockWriter
+	raw.restartInterval = 1
+	props.save(&raw)
+	propsBH := writeBlock(raw.finish())
+
+	var metaindex rawBlockWriter
+	metaindex.restartInterval = 1
+	var tmp [2 * binary.MaxVarintLen64]byte
+	n := encodeBlockHandle(tmp[:], propsBH)
+	metaindex.add(db.InternalKey{UserKey: []byte("rocksdb.properties")}, tmp[:n])
+	metaindexBH := writeBlock(metaindex.finish())
+
+	if o.formatVersion == 0 {
+		footer := make([]byte, levelDBFooterLen)
+		n := encodeBlockHandle(footer, metaindexBH)
+		encodeBlockHandle(footer[n:], indexBH)
+		copy(footer[levelDBMagicOffset:], levelDBMagic)
+		return append(out, footer...)
+	}
+	footer := make([]byte, footerLen)
+	footer[0] = o.checksumType
+	n = 1
+	n += encodeBlockHandle(footer[n:], metaindexBH)
+	encodeBlockHandle(footer[n:], indexBH)
+	binary.LittleEndian.PutUint32(footer[versionOffset:], o.formatVersion)
+	copy(footer[magicOffset:], magic)
+	return append(out, footer...)
+}
+
+func TestReaderRocksDBFormats(t *testing.T) {
+	f, err := build(db.NoCompression, bloom.FilterPolicy(10), db.TableFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []rocksDBTableOptions{
+		{formatVersion: 0},
+		{formatVersion: 1, checksumType: checksumCRC32c},
+		{formatVersion: 2, checksumType: checksumXXHash},
+		{formatVersion: 3, checksumType: checksumCRC32c, userKeyIndex: true},
+		{formatVersion: 4, checksumType: checksumCRC32c, userKeyIndex: true, deltaIndex: true},
+		{formatVersion: 4, checksumType: checksumCRC32c, deltaIndex: true, twoLevelIndex: true},
+		{formatVersion: 5, checksumType: checksumXXHash, userKeyIndex: true, deltaIndex: true,
+			twoLevelIndex: true},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("%+v", c), func(t *testing.T) {
+			data := rewriteAsRocksDB(t, orig, c)
+			name := fmt.Sprintf("rocksdb-%d", tmpFileCount)
+			tmpFileCount++
+			f0, err := memFileSystem.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f0.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := f0.Close(); err != nil {
+				t.Fatal(err)
+			}
+			f1, err := memFileSystem.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := check(f1, nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// Unsupported format versions and checksum types are rejected.
+	for _, c := range []rocksDBTableOptions{
+		{formatVersion: 6, checksumType: checksumCRC32c},
+		{formatVersion: 2, checksumType: 3},
+	} {
+		data := rewriteAsRocksDB(t, orig, c)
+		mem := storage.NewMem()
+		f0, err := mem.Create("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f0.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := f0.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f1, err := mem.Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f1, 0, nil)
+		if _, err := r.Layout(); err == nil {
+			t.Fatalf("%+v: expected error", c)
+		}
+		r.Close()
+	}
+}
+
+func TestReaderApproximateOffsetOf(t *testing.T) {
+	mem := storage.NewMem()
+	f0, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, nil, db.LevelOptions{
+		BlockSize:   512,
+		Compression: db.NoCompression,
+	})
+	const count = 1000
+	for i := 0; i < count; i++ {
+		key := db.MakeInternalKey([]byte(fmt.Sprintf("%05d", i)), 0, db.InternalKeyKindSet)
+		if err := w.Add(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, 0, nil)
+	defer r.Close()
+
+	l, err := r.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectOffset := func(key string, expected uint64) {
+		t.Helper()
+		offset, err := r.ApproximateOffsetOf([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != expected {
+			t.Fatalf("%q: expected offset %d, but found %d", key, expected, offset)
+		}
+	}
+
+	expectOffset("", 0)
+	for _, bh := range l.Data {
+		info, err := r.BlockInfo(bh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectOffset(string(info.First.UserKey), bh.Offset)
+		expectOffset(string(info.Last.UserKey), bh.Offset)
+	}
+	expectOffset("\xff", l.MetaIndex.Offset)
+}
+
+// timestampComparer orders keys bytewise, treating the suffix starting at an
+// '@' as a timestamp.
+var timestampComparer = &db.Comparer{
+	Compare:   db.DefaultComparer.Compare,
+	InlineKey: db.DefaultComparer.InlineKey,
+	Split: func(a []byte) int {
+		if i := bytes.IndexByte(a, '@'); i >= 0 {
+			return i
+		}
+		return len(a)
+	},
+	CompareTimestamps: func(a, b []byte) int {
+		return bytes.Compare(a, b)
+	},
+	Name: "test-timestamps",
+}
+
+type countingCollector struct {
+	count int
+}
+
+func (c *countingCollector) Add(key db.InternalKey, value []byte) error {
+	c.count++
+	return nil
+}
+
+func (c *countingCollector) Finish(userProps map[string]string) error {
+	userProps["test.count"] = fmt.Sprint(c.count)
+	return nil
+}
+
+func (c *countingCollector) Name() string {
+	return "countingCollector"
+}
+
+func TestWriterTimestamps(t *testing.T) {
+	opts := &db.Options{
+		Comparer: timestampComparer,
+		TablePropertyCollectors: []func() db.TablePropertyCollector{
+			func() db.TablePropertyCollector { return &countingCollector{} },
+		},
+	}
+	mem := storage.NewMem()
+	f0, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every key is written to its own data block.
+	w := NewWriter(f0, opts, db.LevelOptions{BlockSize: 10})
+	for _, k := range []string{"a", "a@1", "a@5", "b@2", "b@7", "c@9"} {
+		if err := w.Add(db.MakeInternalKey([]byte(k), 0, db.InternalKeyKindSet), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, 0, opts)
+	defer r.Close()
+
+	props := r.Properties
+	if s := props.PropertyCollectorNames; s != "[pebble.timestamps,countingCollector]" {
+		t.Fatalf("unexpected property collector names: %s", s)
+	}
+	for key, expected := range map[string]string{
+		minTimestampProperty: "@1",
+		maxTimestampProperty: "@9",
+		"test.count":         "6",
+	} {
+		if v := props.UserProperties[key]; v != expected {
+			t.Fatalf("%s: expected %s, but found %s", key, expected, v)
+		}
+	}
+	if n := props.NumDataBlocks; n != 6 {
+		t.Fatalf("expected 6 data blocks, but found %d", n)
+	}
+	if n := len(r.blockTimestamps); n != 5 {
+		t.Fatalf("expected 5 blocks with timestamps, but found %d", n)
+	}
+
+	// The blocks which only hold keys newer than the timestamp are skipped.
+	iter := r.NewIter(&db.IterOptions{Timestamp: []byte("@5")})
+	defer iter.Close()
+	keys := func(positioned bool, next func() bool) string {
+		var buf bytes.Buffer
+		for ok := positioned; ok; ok = next() {
+			fmt.Fprintf(&buf, "%s ", iter.Key().UserKey)
+		}
+		return strings.TrimSpace(buf.String())
+	}
+	testCases := []struct {
+		position func()
+		reverse  bool
+		expected string
+	}{
+		{iter.First, false, "a a@1 a@5 b@2"},
+		{iter.Last, true, "b@2 a@5 a@1 a"},
+		{func() { iter.SeekGE([]byte("b@3")) }, false, ""},
+		{func() { iter.SeekGE([]byte("a@5")) }, false, "a@5 b@2"},
+		{func() { iter.SeekLT([]byte("c")) }, true, "b@2 a@5 a@1 a"},
+		{func() { iter.SeekLT([]byte("b@7")) }, true, "b@2 a@5 a@1 a"},
+	}
+	for i, c := range testCases {
+		c.position()
+		next := iter.Next
+		if c.reverse {
+			next = iter.Prev
+		}
+		if s := keys(iter.Valid(), next); s != c.expected {
+			t.Fatalf("%d: expected %q, but found %q", i, c.expected, s)
+		}
+	}
+}
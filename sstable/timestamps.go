@@ -0,0 +1,171 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/petermattis/pebble/db"
+)
+
+const (
+	// timestampsBlockName is the name of the meta block holding the range of
+	// the timestamps of the keys in each data block.
+	timestampsBlockName = "pebble.timestamps"
+
+	// The user properties holding the range of the timestamps of the keys in
+	// a table.
+	minTimestampProperty = "pebble.timestamp.min"
+	maxTimestampProperty = "pebble.timestamp.max"
+)
+
+// timestampsWriter collects the range of the timestamps of the keys in each
+// data block of a table, and in the table as a whole. A block is only given a
+// range if all of its entries are point entries whose keys have a timestamp,
+// as only such a block may be skipped by a read at a timestamp.
+//
+// The timestamps block is a sequence of entries, one per data block which has
+// a range, in file order:
+//
+//	block offset (varint64)
+//	min timestamp length (varint64), min timestamp
+//	max timestamp length (varint64), max timestamp
+type timestampsWriter struct {
+	compare db.CompareTimestamps
+	split   db.Split
+
+	// The range of the timestamps of the current data block. bounded is false
+	// if the block has an entry without a timestamp.
+	blockMin, blockMax []byte
+	bounded            bool
+	empty              bool
+
+	// The range of the timestamps of the table, ignoring the keys without a
+	// timestamp.
+	tableMin, tableMax []byte
+
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func newTimestampsWriter(c *db.Comparer) *timestampsWriter {
+	if c.CompareTimestamps == nil || c.Split == nil {
+		return nil
+	}
+	return &timestampsWriter{
+		compare: c.CompareTimestamps,
+		split:   c.Split,
+		bounded: true,
+		empty:   true,
+	}
+}
+
+func (w *timestampsWriter) add(key db.InternalKey) {
+	w.empty = false
+	ts := key.UserKey[w.split(key.UserKey):]
+	if len(ts) == 0 || key.Kind() == db.InternalKeyKindRangeDelete {
+		// A range deletion may cover keys at any timestamp.
+		w.bounded = false
+	}
+	if len(ts) == 0 {
+		return
+	}
+	if w.bounded {
+		if len(w.blockMin) == 0 || w.compare(ts, w.blockMin) < 0 {
+			w.blockMin = append(w.blockMin[:0], ts...)
+		}
+		if len(w.blockMax) == 0 || w.compare(ts, w.blockMax) > 0 {
+			w.blockMax = append(w.blockMax[:0], ts...)
+		}
+	}
+	if len(w.tableMin) == 0 || w.compare(ts, w.tableMin) < 0 {
+		w.tableMin = append(w.tableMin[:0], ts...)
+	}
+	if len(w.tableMax) == 0 || w.compare(ts, w.tableMax) > 0 {
+		w.tableMax = append(w.tableMax[:0], ts...)
+	}
+}
+
+func (w *timestampsWriter) appendBytes(b []byte) {
+	n := binary.PutUvarint(w.tmp[:], uint64(len(b)))
+	w.buf = append(w.buf, w.tmp[:n]...)
+	w.buf = append(w.buf, b...)
+}
+
+// finishBlock records the range of the timestamps of the data block at the
+// specified offset, and resets the per-block state.
+func (w *timestampsWriter) finishBlock(offset uint64) {
+	if w.bounded && !w.empty {
+		n := binary.PutUvarint(w.tmp[:], offset)
+		w.buf = append(w.buf, w.tmp[:n]...)
+		w.appendBytes(w.blockMin)
+		w.appendBytes(w.blockMax)
+	}
+	w.blockMin = w.blockMin[:0]
+	w.blockMax = w.blockMax[:0]
+	w.bounded = true
+	w.empty = true
+}
+
+// finish returns the contents of the timestamps block, and adds the range of
+// the timestamps of the table to userProps.
+func (w *timestampsWriter) finish(userProps map[string]string) []byte {
+	if len(w.tableMin) > 0 {
+		userProps[minTimestampProperty] = string(w.tableMin)
+		userProps[maxTimestampProperty] = string(w.tableMax)
+	}
+	return w.buf
+}
+
+// blockTimestamps is the range of the timestamps of the keys in a data block.
+type blockTimestamps struct {
+	offset   uint64
+	min, max []byte
+}
+
+// decodeTimestampsBlock decodes the contents of a timestamps block.
+func decodeTimestampsBlock(b []byte) ([]blockTimestamps, error) {
+	var result []blockTimestamps
+	readBytes := func() ([]byte, bool) {
+		n, m := binary.Uvarint(b)
+		if m <= 0 || uint64(len(b)-m) < n {
+			return nil, false
+		}
+		v := b[m : m+int(n)]
+		b = b[m+int(n):]
+		return v, true
+	}
+	for len(b) > 0 {
+		var t blockTimestamps
+		var n int
+		t.offset, n = binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("pebble/table: invalid timestamps block")
+		}
+		b = b[n:]
+		var ok1, ok2 bool
+		t.min, ok1 = readBytes()
+		t.max, ok2 = readBytes()
+		if !ok1 || !ok2 {
+			return nil, errors.New("pebble/table: invalid timestamps block")
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+// skipBlock returns true if every key of the data block at the specified
+// offset has a timestamp newer than ts, in which case the block need not be
+// read by an iterator reading at ts.
+func (r *Reader) skipBlock(offset uint64, ts []byte) bool {
+	t := r.blockTimestamps
+	i := sort.Search(len(t), func(i int) bool {
+		return t[i].offset >= offset
+	})
+	return i < len(t) && t[i].offset == offset &&
+		r.opts.Comparer.CompareTimestamps(t[i].min, ts) > 0
+}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"math"
 	"os"
+	"strings"
 
 	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/crc"
@@ -37,13 +38,14 @@ type Writer struct {
 	file      storage.File
 	stat      os.FileInfo
 	err       error
-	// The next give fields are copied from a db.Options.
+	// The next fields are copied from a db.Options.
 	blockSize          int
 	blockSizeThreshold int
 	bytesPerSync       int
 	compare            db.Compare
 	compression        db.Compression
 	separator          db.Separator
+	split              db.Split
 	successor          db.Successor
 	// A table is a series of blocks and a block's index entry contains a
 	// separator key between one block and the next. Thus, a finished block
@@ -65,6 +67,11 @@ type Writer struct {
 	compressedBuf []byte
 	// filter accumulates the filter block.
 	filter filterWriter
+	// timestamps accumulates the timestamps block, if the comparer supports
+	// timestamps.
+	timestamps *timestampsWriter
+	// collectors collect the user-defined properties of the table.
+	collectors []db.TablePropertyCollector
 	// tmp is a scratch buffer, large enough to hold either footerLen bytes,
 	// blockTrailerLen bytes, or (5 * binary.MaxVarintLen64) bytes.
 	tmp [footerLen]byte
@@ -87,7 +94,30 @@ func (w *Writer) Add(key db.InternalKey, value []byte) error {
 	}
 
 	if w.filter != nil {
-		w.filter.addKey(key.UserKey)
+		if w.split != nil {
+			w.filter.addKey(key.UserKey[:w.split(key.UserKey)])
+		} else {
+			w.filter.addKey(key.UserKey)
+		}
+	}
+	if w.timestamps != nil {
+		w.timestamps.add(key)
+	}
+	for _, c := range w.collectors {
+		if err := c.Add(key, value); err != nil {
+			w.err = err
+			return err
+		}
+	}
+	switch key.Kind() {
+	case db.InternalKeyKindDelete:
+		w.props.NumDeletions++
+	case db.InternalKeyKindRangeDelete:
+		// Like RocksDB, range deletions are counted as deletions as well.
+		w.props.NumDeletions++
+		w.props.NumRangeDeletions++
+	case db.InternalKeyKindMerge:
+		w.props.NumMergeOperands++
 	}
 	w.props.NumEntries++
 	w.props.RawKeySize += uint64(key.Size())
@@ -105,10 +135,12 @@ func (w *Writer) maybeFlush(key db.InternalKey, value []byte) error {
 			return nil
 		}
 		newSize := size + key.Size() + len(value)
-		if w.block.nEntries&w.block.restartInterval == 0 {
+		if w.block.nEntries%w.block.restartInterval == 0 {
 			newSize += 4
 		}
-		// TODO(peter): newSize += 4                              // varint for shared key bytes
+		// Assume no prefix is shared with the previous key, which bounds the
+		// size of the new entry from above.
+		newSize += uvarintLen(0)                  // varint for shared key bytes
 		newSize += uvarintLen(uint32(key.Size())) // varint for unshared key bytes
 		newSize += uvarintLen(uint32(len(value))) // varint for value size
 		if newSize <= w.blockSize {
@@ -117,7 +149,7 @@ func (w *Writer) maybeFlush(key db.InternalKey, value []byte) error {
 		}
 	}
 
-	bh, err := w.finishBlock(&w.block)
+	bh, err := w.finishDataBlock()
 	if err != nil {
 		w.err = err
 		return w.err
@@ -127,6 +159,16 @@ func (w *Writer) maybeFlush(key db.InternalKey, value []byte) error {
 	return nil
 }
 
+// finishDataBlock finishes the current data block and returns its block
+// handle.
+func (w *Writer) finishDataBlock() (blockHandle, error) {
+	bh, err := w.finishBlock(&w.block)
+	if err == nil && w.timestamps != nil {
+		w.timestamps.finishBlock(bh.offset)
+	}
+	return bh, err
+}
+
 // flushPendingBH adds any pending block handle to the index entries.
 func (w *Writer) flushPendingBH(key db.InternalKey) {
 	if w.pendingBH.length == 0 {
@@ -164,8 +206,8 @@ func (w *Writer) finishBlock(block *blockWriter) (blockHandle, error) {
 	bh, err := w.writeRawBlock(b, blockType)
 
 	// Calculate filters.
-	if w.filter != nil {
-		w.filter.finishBlock(w.offset)
+	if w.filter != nil && err == nil {
+		err = w.filter.finishBlock(w.offset)
 	}
 
 	// Reset the per-block state.
@@ -226,7 +268,7 @@ func (w *Writer) Close() (err error) {
 	// aren't any data blocks at all.
 	w.flushPendingBH(db.InternalKey{})
 	if w.block.nEntries > 0 || w.indexBlock.nEntries == 0 {
-		bh, err := w.finishBlock(&w.block)
+		bh, err := w.finishDataBlock()
 		if err != nil {
 			w.err = err
 			return w.err
@@ -255,6 +297,31 @@ func (w *Writer) Close() (err error) {
 		metaindex.add(db.InternalKey{UserKey: []byte(w.filter.metaName())}, w.tmp[:n])
 		w.props.FilterPolicyName = w.filter.policyName()
 		w.props.FilterSize = bh.length
+		if f, ok := w.filter.(*partitionedFilterWriter); ok {
+			w.props.FilterSize += f.size
+		}
+	}
+
+	userProps := make(map[string]string)
+	if w.timestamps != nil {
+		if b := w.timestamps.finish(userProps); len(b) > 0 {
+			bh, err := w.writeRawBlock(b, noCompressionBlockType)
+			if err != nil {
+				w.err = err
+				return w.err
+			}
+			n := encodeBlockHandle(w.tmp[:], bh)
+			metaindex.add(db.InternalKey{UserKey: []byte(timestampsBlockName)}, w.tmp[:n])
+		}
+	}
+	for _, c := range w.collectors {
+		if err := c.Finish(userProps); err != nil {
+			w.err = err
+			return w.err
+		}
+	}
+	if len(userProps) > 0 {
+		w.props.UserProperties = userProps
 	}
 
 	// TODO(peter): write the range-del block.
@@ -338,6 +405,23 @@ func (w *Writer) EstimatedSize() uint64 {
 	return w.offset + uint64(w.block.estimatedSize()+w.indexBlock.estimatedSize())
 }
 
+// BufferedSize returns the memory used by the buffers of the writer: the data
+// and index blocks being built, the compression buffer and the write buffer.
+func (w *Writer) BufferedSize() uint64 {
+	n := w.block.bufferedSize() + w.indexBlock.bufferedSize() + cap(w.compressedBuf)
+	if w.bufWriter != nil {
+		n += w.bufWriter.Size()
+	}
+	return uint64(n)
+}
+
+// SetDBID records the unique identifier of the DB the sstable is written for
+// in the table properties. DB.Ingest rejects an sstable whose identifier does
+// not match that of the DB. Must be called before Close.
+func (w *Writer) SetDBID(id string) {
+	w.props.DBID = id
+}
+
 // Stat returns the file info for the finished sstable. Only valid to call
 // after the sstable has been finished.
 func (w *Writer) Stat() (os.FileInfo, error) {
@@ -360,6 +444,7 @@ func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
 		compare:            o.Comparer.Compare,
 		compression:        lo.Compression,
 		separator:          o.Comparer.Separator,
+		split:              o.Comparer.Split,
 		successor:          o.Comparer.Successor,
 		block: blockWriter{
 			restartInterval: lo.BlockRestartInterval,
@@ -368,6 +453,16 @@ func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
 			restartInterval: 1,
 		},
 	}
+	if w.separator == nil {
+		w.separator = func(dst, a, b []byte) []byte {
+			return append(dst, a...)
+		}
+	}
+	if w.successor == nil {
+		w.successor = func(dst, a []byte) []byte {
+			return append(dst, a...)
+		}
+	}
 	if f == nil {
 		w.err = errors.New("pebble/table: nil file")
 		return w
@@ -379,6 +474,11 @@ func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
 			w.filter = newBlockFilterWriter(lo.FilterPolicy)
 		case db.TableFilter:
 			w.filter = newTableFilterWriter(lo.FilterPolicy)
+		case db.PartitionedFilter:
+			w.filter = newPartitionedFilterWriter(lo.FilterPolicy, lo.FilterPartitionSize,
+				func(b []byte) (blockHandle, error) {
+					return w.writeRawBlock(b, noCompressionBlockType)
+				})
 		default:
 			panic(fmt.Sprintf("unknown filter type: %v", lo.FilterType))
 		}
@@ -387,10 +487,27 @@ func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
 	w.props.ColumnFamilyID = math.MaxInt32
 	w.props.ComparatorName = o.Comparer.Name
 	w.props.CompressionName = lo.Compression.String()
-	w.props.MergeOperatorName = o.Merger.Name
+	w.props.MergeOperatorName = o.Merger.Name()
 	w.props.PrefixExtractorName = "nullptr"
-	w.props.PropertyCollectorNames = "[]"
+	w.timestamps = newTimestampsWriter(o.Comparer)
+	var names []string
+	if w.timestamps != nil {
+		names = append(names, timestampsBlockName)
+	}
+	for _, fn := range o.TablePropertyCollectors {
+		c := fn()
+		w.collectors = append(w.collectors, c)
+		names = append(names, c.Name())
+	}
+	w.props.PropertyCollectorNames = "[" + strings.Join(names, ",") + "]"
 	w.props.WholeKeyFiltering = true
+	if w.split != nil {
+		// The filter is built over the prefixes of the keys, as defined by the
+		// comparer's Split function.
+		w.props.PrefixExtractorName = o.Comparer.Name
+		w.props.PrefixFiltering = true
+		w.props.WholeKeyFiltering = false
+	}
 	w.props.Version = 2 // TODO(peter): what is this?
 
 	// If f does not have a Flush method, do our own buffering.
@@ -0,0 +1,65 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	xxPrime32_1 uint32 = 2654435761
+	xxPrime32_2 uint32 = 2246822519
+	xxPrime32_3 uint32 = 3266489917
+	xxPrime32_4 uint32 = 668265263
+	xxPrime32_5 uint32 = 374761393
+)
+
+func xxRound32(acc, input uint32) uint32 {
+	acc += input * xxPrime32_2
+	acc = bits.RotateLeft32(acc, 13)
+	return acc * xxPrime32_1
+}
+
+// xxhash32 returns the 32-bit xxHash of b with a seed of 0. RocksDB tables
+// may use it as the block checksum instead of CRC-32C.
+func xxhash32(b []byte) uint32 {
+	n := len(b)
+	var h uint32
+	if n >= 16 {
+		// NB: the seeds wrap around, which is not permitted for constant
+		// expressions.
+		v1, v2, v3, v4 := xxPrime32_1, xxPrime32_2, uint32(0), uint32(0)
+		v1 += xxPrime32_2
+		v4 -= xxPrime32_1
+		for ; len(b) >= 16; b = b[16:] {
+			v1 = xxRound32(v1, binary.LittleEndian.Uint32(b[0:]))
+			v2 = xxRound32(v2, binary.LittleEndian.Uint32(b[4:]))
+			v3 = xxRound32(v3, binary.LittleEndian.Uint32(b[8:]))
+			v4 = xxRound32(v4, binary.LittleEndian.Uint32(b[12:]))
+		}
+		h = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) +
+			bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h = xxPrime32_5
+	}
+	h += uint32(n)
+
+	for ; len(b) >= 4; b = b[4:] {
+		h += binary.LittleEndian.Uint32(b) * xxPrime32_3
+		h = bits.RotateLeft32(h, 17) * xxPrime32_4
+	}
+	for ; len(b) > 0; b = b[1:] {
+		h += uint32(b[0]) * xxPrime32_5
+		h = bits.RotateLeft32(h, 11) * xxPrime32_1
+	}
+
+	h ^= h >> 15
+	h *= xxPrime32_2
+	h ^= h >> 13
+	h *= xxPrime32_3
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,238 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// blockKey identifies a block of an object.
+type blockKey struct {
+	name  string
+	index int64
+}
+
+// blockEntry is a block held in a file in the cache directory.
+type blockEntry struct {
+	key      blockKey
+	filename string
+	size     int64
+	// done is closed once the block has been written to the file, or has
+	// failed to be, in which case err is set.
+	done       chan struct{}
+	err        error
+	prev, next *blockEntry
+}
+
+// blockCache caches blocks of the objects in an ObjectStore in files in a
+// directory of a local Storage, evicting the least recently used blocks once
+// the total size of the blocks exceeds the capacity.
+type blockCache struct {
+	fs       Storage
+	dir      string
+	capacity int64
+
+	mu      sync.Mutex
+	entries map[blockKey]*blockEntry
+	size    int64
+	seq     uint64
+	// dummy is the head of the LRU list, ordered from most to least recently
+	// used.
+	dummy blockEntry
+}
+
+func newBlockCache(fs Storage, dir string, capacity int64) (*blockCache, error) {
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// The cache does not persist across restarts.
+	names, err := fs.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err := fs.Remove(filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	c := &blockCache{
+		fs:       fs,
+		dir:      dir,
+		capacity: capacity,
+		entries:  make(map[blockKey]*blockEntry),
+	}
+	c.dummy.next = &c.dummy
+	c.dummy.prev = &c.dummy
+	return c, nil
+}
+
+// readAt copies the data in the block at offset off into p, returning the
+// number of bytes copied. If the block is not cached, fetch is called to read
+// the size bytes of the block, which are then cached.
+func (c *blockCache) readAt(
+	key blockKey, size int64, p []byte, off int64, fetch func(buf []byte) error,
+) (int, error) {
+	if n := size - off; int64(len(p)) > n {
+		p = p[:n]
+	}
+
+	c.mu.Lock()
+	e := c.entries[key]
+	if e != nil {
+		c.unlink(e)
+		c.pushFront(e)
+		c.mu.Unlock()
+		<-e.done
+		if e.err == nil {
+			if n, err := c.readFile(e, p, off); err == nil {
+				return n, nil
+			}
+		}
+		// The block could not be read from the cache. Read it directly from the
+		// object store instead.
+		buf := make([]byte, size)
+		if err := fetch(buf); err != nil {
+			return 0, err
+		}
+		return copy(p, buf[off:]), nil
+	}
+
+	c.seq++
+	e = &blockEntry{
+		key:      key,
+		filename: filepath.Join(c.dir, fmt.Sprintf("%06d.blk", c.seq)),
+		size:     size,
+		done:     make(chan struct{}),
+	}
+	c.entries[key] = e
+	c.pushFront(e)
+	c.size += size
+	c.evictLocked()
+	c.mu.Unlock()
+
+	buf := make([]byte, size)
+	if err := fetch(buf); err != nil {
+		c.fail(e, err)
+		return 0, err
+	}
+	if err := c.writeFile(e.filename, buf); err != nil {
+		// The block was fetched successfully, even though it couldn't be cached.
+		c.fail(e, err)
+	} else {
+		close(e.done)
+	}
+	return copy(p, buf[off:]), nil
+}
+
+// fail removes e, whose block could not be fetched or written, from the cache.
+func (c *blockCache) fail(e *blockEntry, err error) {
+	e.err = err
+	c.mu.Lock()
+	if c.entries[e.key] == e {
+		c.removeLocked(e)
+	}
+	c.mu.Unlock()
+	close(e.done)
+}
+
+func (c *blockCache) writeFile(filename string, buf []byte) error {
+	f, err := c.fs.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		c.fs.Remove(filename)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		c.fs.Remove(filename)
+		return err
+	}
+	return nil
+}
+
+func (c *blockCache) readFile(e *blockEntry, p []byte, off int64) (int, error) {
+	f, err := c.fs.Open(e.filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.ReadAt(p, off)
+	if n == len(p) {
+		return n, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("pebble/storage: short read of cached block %s", e.filename)
+	}
+	return 0, err
+}
+
+// evictObject evicts all of the cached blocks of the named object.
+func (c *blockCache) evictObject(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, e := range c.entries {
+		if key.name == name {
+			c.removeLocked(e)
+		}
+	}
+}
+
+// evictLocked evicts the least recently used blocks until the size of the
+// cache is within its capacity. Blocks which are still being fetched are not
+// evicted.
+//
+// c.mu must be held when calling this.
+func (c *blockCache) evictLocked() {
+	for e := c.dummy.prev; c.size > c.capacity && e != &c.dummy; {
+		prev := e.prev
+		select {
+		case <-e.done:
+			c.removeLocked(e)
+		default:
+		}
+		e = prev
+	}
+}
+
+// removeLocked removes e from the cache, and removes its file.
+//
+// c.mu must be held when calling this.
+func (c *blockCache) removeLocked(e *blockEntry) {
+	delete(c.entries, e.key)
+	c.unlink(e)
+	c.size -= e.size
+	select {
+	case <-e.done:
+		if e.err == nil {
+			c.fs.Remove(e.filename)
+		}
+	default:
+		// The block is still being fetched. Its file is removed once the fetch
+		// completes.
+		go func() {
+			<-e.done
+			if e.err == nil {
+				c.fs.Remove(e.filename)
+			}
+		}()
+	}
+}
+
+func (c *blockCache) unlink(e *blockEntry) {
+	e.next.prev = e.prev
+	e.prev.next = e.next
+}
+
+func (c *blockCache) pushFront(e *blockEntry) {
+	e.next = c.dummy.next
+	e.prev = &c.dummy
+	e.next.prev = e
+	e.prev.next = e
+}
@@ -0,0 +1,187 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	diskOpWrite = iota + 1
+	diskOpSync
+)
+
+var diskOpNames = [...]string{
+	diskOpWrite: "write",
+	diskOpSync:  "sync",
+}
+
+// DiskHealthStats holds the latency statistics gathered by a
+// DiskHealthChecker.
+type DiskHealthStats struct {
+	// The maximum latency of a single write.
+	MaxWriteLatency time.Duration
+	// The maximum latency of a single sync.
+	MaxSyncLatency time.Duration
+	// The number of writes and syncs which took longer than the threshold.
+	SlowOps int64
+}
+
+// DiskHealthChecker is a Storage which measures the latency of the writes and
+// syncs of the files it creates, reporting those which take longer than a
+// threshold. An operation is reported while it is still in progress once it
+// has exceeded the threshold, so a disk which has stopped responding
+// altogether is detected.
+type DiskHealthChecker struct {
+	Storage
+	threshold time.Duration
+	onSlow    func(name, op string, duration time.Duration)
+
+	// The statistics are updated atomically.
+	maxWriteNanos int64
+	maxSyncNanos  int64
+	slowOps       int64
+}
+
+// NewDiskHealthChecker returns a DiskHealthChecker wrapping fs, which invokes
+// onSlow for each write or sync which takes longer than threshold. The op
+// passed to onSlow is either "write" or "sync", and duration is the time the
+// operation had taken when it was reported.
+func NewDiskHealthChecker(
+	fs Storage, threshold time.Duration, onSlow func(name, op string, duration time.Duration),
+) *DiskHealthChecker {
+	return &DiskHealthChecker{
+		Storage:   fs,
+		threshold: threshold,
+		onSlow:    onSlow,
+	}
+}
+
+// Create implements Storage.Create.
+func (c *DiskHealthChecker) Create(name string) (File, error) {
+	f, err := c.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	hf := &diskHealthFile{
+		File:    f,
+		c:       c,
+		name:    name,
+		stopper: make(chan struct{}),
+	}
+	go hf.monitor()
+	return hf, nil
+}
+
+// Stats returns the latency statistics for the writes and syncs performed
+// since the DiskHealthChecker was created.
+func (c *DiskHealthChecker) Stats() DiskHealthStats {
+	return DiskHealthStats{
+		MaxWriteLatency: time.Duration(atomic.LoadInt64(&c.maxWriteNanos)),
+		MaxSyncLatency:  time.Duration(atomic.LoadInt64(&c.maxSyncNanos)),
+		SlowOps:         atomic.LoadInt64(&c.slowOps),
+	}
+}
+
+func (c *DiskHealthChecker) record(op int32, duration time.Duration) {
+	max := &c.maxWriteNanos
+	if op == diskOpSync {
+		max = &c.maxSyncNanos
+	}
+	for {
+		old := atomic.LoadInt64(max)
+		if int64(duration) <= old || atomic.CompareAndSwapInt64(max, old, int64(duration)) {
+			return
+		}
+	}
+}
+
+// diskHealthFile tracks the operation in progress on a file created by a
+// DiskHealthChecker, and implements File.
+type diskHealthFile struct {
+	File
+	c        *DiskHealthChecker
+	name     string
+	stopper  chan struct{}
+	stopOnce sync.Once
+
+	// The kind and start time, in nanoseconds since the epoch, of the
+	// operation in progress. The start time is 0 if no operation is in
+	// progress. reported is the start time of the last operation reported as
+	// slow, which ensures that an operation is reported at most once. The
+	// fields are accessed atomically.
+	op       int32
+	start    int64
+	reported int64
+}
+
+// monitor periodically checks whether the operation in progress has exceeded
+// the threshold.
+func (f *diskHealthFile) monitor() {
+	interval := f.c.threshold / 2
+	if interval <= 0 {
+		interval = f.c.threshold
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stopper:
+			return
+		case now := <-ticker.C:
+			start := atomic.LoadInt64(&f.start)
+			if start == 0 {
+				continue
+			}
+			if duration := now.Sub(time.Unix(0, start)); duration >= f.c.threshold {
+				f.maybeReport(atomic.LoadInt32(&f.op), start, duration)
+			}
+		}
+	}
+}
+
+func (f *diskHealthFile) maybeReport(op int32, start int64, duration time.Duration) {
+	if atomic.SwapInt64(&f.reported, start) == start {
+		return
+	}
+	atomic.AddInt64(&f.c.slowOps, 1)
+	f.c.onSlow(f.name, diskOpNames[op], duration)
+}
+
+func (f *diskHealthFile) timeOp(op int32, fn func()) {
+	start := time.Now()
+	atomic.StoreInt32(&f.op, op)
+	atomic.StoreInt64(&f.start, start.UnixNano())
+	fn()
+	duration := time.Since(start)
+	atomic.StoreInt64(&f.start, 0)
+	f.c.record(op, duration)
+	if duration >= f.c.threshold {
+		f.maybeReport(op, start.UnixNano(), duration)
+	}
+}
+
+func (f *diskHealthFile) Write(p []byte) (n int, err error) {
+	f.timeOp(diskOpWrite, func() {
+		n, err = f.File.Write(p)
+	})
+	return n, err
+}
+
+func (f *diskHealthFile) Sync() (err error) {
+	f.timeOp(diskOpSync, func() {
+		err = f.File.Sync()
+	})
+	return err
+}
+
+func (f *diskHealthFile) Close() error {
+	f.stopOnce.Do(func() {
+		close(f.stopper)
+	})
+	return f.File.Close()
+}
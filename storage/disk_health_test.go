@@ -0,0 +1,93 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// blockingStorage creates files whose syncs block until released.
+type blockingStorage struct {
+	Storage
+	release chan struct{}
+}
+
+func (s *blockingStorage) Create(name string) (File, error) {
+	f, err := s.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &blockingFile{File: f, release: s.release}, nil
+}
+
+type blockingFile struct {
+	File
+	release chan struct{}
+}
+
+func (f *blockingFile) Sync() error {
+	<-f.release
+	return f.File.Sync()
+}
+
+func TestDiskHealthChecker(t *testing.T) {
+	type event struct {
+		name, op string
+		duration time.Duration
+	}
+	events := make(chan event, 10)
+	const threshold = 10 * time.Millisecond
+	fs := &blockingStorage{Storage: NewMem(), release: make(chan struct{})}
+	c := NewDiskHealthChecker(fs, threshold, func(name, op string, duration time.Duration) {
+		events <- event{name, op, duration}
+	})
+
+	f, err := c.Create("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A sync which is stuck is reported while it is still in progress.
+	done := make(chan error)
+	go func() {
+		done <- f.Sync()
+	}()
+	select {
+	case e := <-events:
+		if e.name != "foo" || e.op != "sync" || e.duration < threshold {
+			t.Fatalf("unexpected event: %+v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected slow sync to be reported")
+	}
+	close(fs.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sync is reported only once.
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event: %+v", e)
+	default:
+	}
+	stats := c.Stats()
+	if stats.SlowOps != 1 {
+		t.Fatalf("expected 1 slow op, but found %d", stats.SlowOps)
+	}
+	if stats.MaxSyncLatency < threshold {
+		t.Fatalf("expected max sync latency >= %s, but found %s", threshold, stats.MaxSyncLatency)
+	}
+	if stats.MaxWriteLatency >= threshold {
+		t.Fatalf("expected max write latency < %s, but found %s", threshold, stats.MaxWriteLatency)
+	}
+}
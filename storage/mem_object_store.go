@@ -0,0 +1,123 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// NewMemObjectStore returns a new memory-backed ObjectStore implementation.
+//
+// It can be useful for tests of the Storage returned by NewRemote.
+func NewMemObjectStore() ObjectStore {
+	return &memObjectStore{
+		objects: make(map[string][]byte),
+	}
+}
+
+// memObjectStore implements ObjectStore.
+type memObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *memObjectStore) get(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[name]
+	if !ok {
+		return nil, &os.PathError{
+			Op:   "open",
+			Path: name,
+			Err:  os.ErrNotExist,
+		}
+	}
+	return data, nil
+}
+
+func (s *memObjectStore) Create(name string) (ObjectWriter, error) {
+	return &memObjectWriter{s: s, name: name}, nil
+}
+
+func (s *memObjectStore) ReadAt(name string, p []byte, off int64) (int, error) {
+	data, err := s.get(name)
+	if err != nil {
+		return 0, err
+	}
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *memObjectStore) Size(name string) (int64, error) {
+	data, err := s.get(name)
+	return int64(len(data)), err
+}
+
+func (s *memObjectStore) Delete(name string) error {
+	if _, err := s.get(name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *memObjectStore) List(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// memObjectWriter buffers the data for an object until it is published, and
+// implements ObjectWriter.
+type memObjectWriter struct {
+	s    *memObjectStore
+	name string
+	buf  bytes.Buffer
+	done bool
+}
+
+func (w *memObjectWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, errors.New("pebble/storage: object writer is closed")
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memObjectWriter) Close() error {
+	if w.done {
+		return errors.New("pebble/storage: object writer is closed")
+	}
+	w.done = true
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	w.s.objects[w.name] = w.buf.Bytes()
+	return nil
+}
+
+func (w *memObjectWriter) Abort() error {
+	w.done = true
+	return nil
+}
@@ -30,18 +30,64 @@ func (nopCloser) Close() error {
 
 // NewMem returns a new memory-backed Storage implementation.
 func NewMem() Storage {
+	return newMem(false)
+}
+
+// NewStrictMem returns a new memory-backed Storage implementation which
+// tracks the data which has been synced, and can simulate a crash by
+// discarding the data which has not. The contents of a file survive a crash
+// once the file has been synced, and the creation, removal or renaming of a
+// file survives once its directory has been synced (see Storage.OpenDir).
+//
+// It can be useful for tests of crash recovery.
+func NewStrictMem() *StrictMem {
+	return &StrictMem{memStorage: newMem(true)}
+}
+
+func newMem(strict bool) *memStorage {
 	return &memStorage{
 		root: &node{
 			children: make(map[string]*node),
 			isDir:    true,
 		},
+		strict: strict,
 	}
 }
 
+// StrictMem is a memory-backed Storage which simulates the loss of unsynced
+// data on a crash. It is created by NewStrictMem.
+type StrictMem struct {
+	*memStorage
+}
+
+// SetIgnoreSyncs sets whether syncs are ignored. While syncs are ignored,
+// they succeed without making any data durable, which simulates a crash at
+// the point at which SetIgnoreSyncs(true) was called.
+func (y *StrictMem) SetIgnoreSyncs(ignore bool) {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	y.ignoreSyncs = ignore
+}
+
+// ResetToSyncedState discards all data which has not been synced, restoring
+// the state which would be found after a crash. Files which are open when the
+// storage is reset must not be used afterwards.
+func (y *StrictMem) ResetToSyncedState() {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	y.root.resetToSyncedState()
+}
+
 // memStorage implements Storage
 type memStorage struct {
 	mu   sync.Mutex
 	root *node
+
+	// strict is set if the synced state of each node is tracked, and
+	// ignoreSyncs is set if syncs should not update it. Both are only used by
+	// StrictMem.
+	strict      bool
+	ignoreSyncs bool
 }
 
 func (y *memStorage) String() string {
@@ -119,6 +165,7 @@ func (y *memStorage) Create(fullname string) (File, error) {
 			n := &node{name: frag}
 			dir.children[frag] = n
 			ret = &file{
+				fs:    y,
 				n:     n,
 				write: true,
 			}
@@ -168,6 +215,7 @@ func (y *memStorage) Open(fullname string) (File, error) {
 			}
 			if n := dir.children[frag]; n != nil {
 				ret = &file{
+					fs:   y,
 					n:    n,
 					read: true,
 				}
@@ -188,6 +236,30 @@ func (y *memStorage) Open(fullname string) (File, error) {
 	return ret, nil
 }
 
+func (y *memStorage) OpenDir(dirname string) (File, error) {
+	if !strings.HasSuffix(dirname, sep) {
+		dirname += sep
+	}
+	var ret *file
+	err := y.walk(dirname, func(dir *node, frag string, final bool) error {
+		if final {
+			if frag != "" {
+				panic("unreachable")
+			}
+			ret = &file{
+				fs:   y,
+				n:    dir,
+				read: true,
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
 func (y *memStorage) Remove(fullname string) error {
 	return y.walk(fullname, func(dir *node, frag string, final bool) error {
 		if final {
@@ -302,6 +374,11 @@ type node struct {
 	modTime  time.Time
 	children map[string]*node
 	isDir    bool
+
+	// syncedData and syncedChildren hold the data or children as of the last
+	// sync of the node. They are only maintained by StrictMem.
+	syncedData     []byte
+	syncedChildren map[string]*node
 }
 
 func (f *node) IsDir() bool {
@@ -331,6 +408,20 @@ func (f *node) Sys() interface{} {
 	return nil
 }
 
+// resetToSyncedState discards the unsynced changes to the node and, for a
+// directory, to the nodes it holds.
+func (f *node) resetToSyncedState() {
+	if !f.isDir {
+		f.data = append([]byte(nil), f.syncedData...)
+		return
+	}
+	f.children = make(map[string]*node, len(f.syncedChildren))
+	for name, child := range f.syncedChildren {
+		f.children[name] = child
+		child.resetToSyncedState()
+	}
+}
+
 func (f *node) dump(w *bytes.Buffer, level int) {
 	if f.isDir {
 		w.WriteString("          ")
@@ -359,6 +450,7 @@ func (f *node) dump(w *bytes.Buffer, level int) {
 
 // file is a reader or writer of a node's data, and implements File.
 type file struct {
+	fs          *memStorage
 	n           *node
 	rpos        int
 	read, write bool
@@ -413,5 +505,22 @@ func (f *file) Stat() (os.FileInfo, error) {
 }
 
 func (f *file) Sync() error {
+	y := f.fs
+	if y == nil || !y.strict {
+		return nil
+	}
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	if y.ignoreSyncs {
+		return nil
+	}
+	if f.n.isDir {
+		f.n.syncedChildren = make(map[string]*node, len(f.n.children))
+		for name, child := range f.n.children {
+			f.n.syncedChildren[name] = child
+		}
+	} else {
+		f.n.syncedData = append(f.n.syncedData[:0], f.n.data...)
+	}
 	return nil
 }
@@ -6,6 +6,7 @@ package storage
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
 	"sort"
 	"strconv"
@@ -238,3 +239,121 @@ func TestList(t *testing.T) {
 		}
 	}
 }
+
+func TestStrictMem(t *testing.T) {
+	fs := NewStrictMem()
+	if err := fs.MkdirAll("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, data string, sync bool) {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(f, data); err != nil {
+			t.Fatal(err)
+		}
+		if sync {
+			if err := f.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	syncDir := func(name string) {
+		f, err := fs.OpenDir(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func(name string) string {
+		names, err := fs.List(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+	read := func(name string) string {
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	syncDir("")
+	write("dir/a", "synced", true)
+	write("dir/b", "unsynced", false)
+	syncDir("dir")
+	f, err := fs.Create("dir/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, "partial"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	syncDir("dir")
+	if _, err := io.WriteString(f, " write"); err != nil {
+		t.Fatal(err)
+	}
+	// A synced file whose directory has not been synced since its creation
+	// does not survive.
+	write("dir/c", "unlinked", true)
+
+	// Syncs are ignored once SetIgnoreSyncs(true) is called.
+	fs.SetIgnoreSyncs(true)
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	syncDir("dir")
+	if s := list("dir"); s != "b c d" {
+		t.Fatalf("unexpected listing: %s", s)
+	}
+
+	// Only the synced data survives a reset.
+	fs.ResetToSyncedState()
+	fs.SetIgnoreSyncs(false)
+	if s := list("dir"); s != "a b d" {
+		t.Fatalf("unexpected listing: %s", s)
+	}
+	for _, c := range []struct{ name, data string }{
+		{"dir/a", "synced"},
+		{"dir/b", ""},
+		{"dir/d", "partial"},
+	} {
+		if s := read(c.name); s != c.data {
+			t.Fatalf("%s: expected %q, but found %q", c.name, c.data, s)
+		}
+	}
+
+	// A directory which has not been synced is lost along with its contents.
+	if err := fs.MkdirAll("other", 0755); err != nil {
+		t.Fatal(err)
+	}
+	write("other/e", "lost", true)
+	syncDir("other")
+	fs.ResetToSyncedState()
+	if s := list(""); s != "dir" {
+		t.Fatalf("unexpected listing: %s", s)
+	}
+}
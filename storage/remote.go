@@ -0,0 +1,464 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ObjectStore is the interface to a blob store, such as S3 or GCS, which
+// holds immutable objects addressed by name.
+type ObjectStore interface {
+	// Create returns a writer for a new object with the given name. The data
+	// written is streamed to the store, but the object does not become visible
+	// until the writer is closed, at which point it atomically replaces any
+	// existing object with the same name.
+	Create(name string) (ObjectWriter, error)
+
+	// ReadAt reads len(p) bytes from the named object starting at offset off,
+	// with the same semantics as io.ReaderAt.
+	ReadAt(name string, p []byte, off int64) (int, error)
+
+	// Size returns the size of the named object. An error satisfying
+	// os.IsNotExist is returned if the object does not exist.
+	Size(name string) (int64, error)
+
+	// Delete deletes the named object.
+	Delete(name string) error
+
+	// List returns the names of the objects whose names begin with prefix.
+	List(prefix string) ([]string, error)
+}
+
+// ObjectWriter writes a new object to an ObjectStore.
+type ObjectWriter interface {
+	io.Writer
+
+	// Close publishes the object, making it visible to readers.
+	Close() error
+
+	// Abort discards the object. The object never becomes visible.
+	Abort() error
+}
+
+// RemoteOptions holds the optional parameters for NewRemote.
+type RemoteOptions struct {
+	// CacheBlockSize is the size of the blocks in which data read from the
+	// object store is fetched and cached.
+	//
+	// The default value is 1MB.
+	CacheBlockSize int64
+
+	// CacheDir is the directory in the local Storage in which blocks read from
+	// the object store are cached. Any existing contents of the directory are
+	// removed. If empty, blocks are not cached, and every read is sent to the
+	// object store.
+	//
+	// The default value is empty.
+	CacheDir string
+
+	// CacheSize is the maximum number of bytes of blocks held in the cache.
+	//
+	// The default value is 1GB.
+	CacheSize int64
+
+	// IsRemote returns true if the named file is held in the object store
+	// rather than the local Storage. Only files which are written once and
+	// never modified, such as sstables, may be held in the object store.
+	//
+	// The default places files with the ".sst" extension in the object store.
+	IsRemote func(name string) bool
+
+	// MaxRetries is the number of times a failed request to the object store
+	// is retried before the error is returned.
+	//
+	// The default value is 3.
+	MaxRetries int
+
+	// RetryBackoff is the time to wait before the first retry of a failed
+	// request. The time is doubled for each subsequent retry.
+	//
+	// The default value is 100ms.
+	RetryBackoff time.Duration
+}
+
+func (o *RemoteOptions) ensureDefaults() RemoteOptions {
+	var r RemoteOptions
+	if o != nil {
+		r = *o
+	}
+	if r.CacheBlockSize <= 0 {
+		r.CacheBlockSize = 1 << 20
+	}
+	if r.CacheSize <= 0 {
+		r.CacheSize = 1 << 30
+	}
+	if r.IsRemote == nil {
+		r.IsRemote = func(name string) bool {
+			return filepath.Ext(name) == ".sst"
+		}
+	}
+	if r.MaxRetries <= 0 {
+		r.MaxRetries = 3
+	}
+	if r.RetryBackoff <= 0 {
+		r.RetryBackoff = 100 * time.Millisecond
+	}
+	return r
+}
+
+// NewRemote returns a Storage implementation which holds the files selected
+// by RemoteOptions.IsRemote in an object store, and all other files in the
+// local Storage. Directories and locks are always held in the local Storage.
+//
+// Files in the object store are created by streaming their contents to the
+// store, and become visible atomically when they are closed: Sync is a no-op.
+// Opening a file requires only a request for its size, and reads are served
+// in ranges of RemoteOptions.CacheBlockSize bytes, which are retried if they
+// fail and are cached in the local Storage if RemoteOptions.CacheDir is set.
+// Since the footer, index and filter of an sstable are adjacent, the cache
+// allows a table to be opened with a single request in the common case.
+//
+// Link and Rename are performed by copying when either file is in the object
+// store, and are not atomic.
+func NewRemote(local Storage, store ObjectStore, opts *RemoteOptions) (Storage, error) {
+	s := &remoteStorage{
+		local: local,
+		store: store,
+		opts:  opts.ensureDefaults(),
+	}
+	if s.opts.CacheDir != "" {
+		c, err := newBlockCache(local, s.opts.CacheDir, s.opts.CacheSize)
+		if err != nil {
+			return nil, err
+		}
+		s.cache = c
+	}
+	return s, nil
+}
+
+// remoteStorage implements Storage.
+type remoteStorage struct {
+	local Storage
+	store ObjectStore
+	opts  RemoteOptions
+	cache *blockCache
+}
+
+// retry invokes fn until it succeeds, returns an error satisfying
+// os.IsNotExist, or has been retried RemoteOptions.MaxRetries times.
+func (s *remoteStorage) retry(fn func() error) error {
+	backoff := s.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || os.IsNotExist(err) || attempt == s.opts.MaxRetries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// read reads len(p) bytes from the named object at offset off, which must
+// lie within the object.
+func (s *remoteStorage) read(name string, p []byte, off int64) error {
+	return s.retry(func() error {
+		n, err := s.store.ReadAt(name, p, off)
+		if n == len(p) {
+			return nil
+		}
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	})
+}
+
+func (s *remoteStorage) Create(name string) (File, error) {
+	if !s.opts.IsRemote(name) {
+		return s.local.Create(name)
+	}
+	var w ObjectWriter
+	err := s.retry(func() (err error) {
+		w, err = s.store.Create(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.cache != nil {
+		s.cache.evictObject(name)
+	}
+	return &remoteWriter{name: name, w: w}, nil
+}
+
+func (s *remoteStorage) Link(oldname, newname string) error {
+	if !s.opts.IsRemote(oldname) && !s.opts.IsRemote(newname) {
+		return s.local.Link(oldname, newname)
+	}
+	return s.copy(oldname, newname)
+}
+
+// copy copies the contents of oldname to newname.
+func (s *remoteStorage) copy(oldname, newname string) (err error) {
+	src, err := s.Open(oldname)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := s.Create(newname)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		if w, ok := dst.(*remoteWriter); ok {
+			w.abort()
+		} else {
+			dst.Close()
+		}
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+func (s *remoteStorage) Open(name string) (File, error) {
+	if !s.opts.IsRemote(name) {
+		return s.local.Open(name)
+	}
+	var size int64
+	err := s.retry(func() (err error) {
+		size, err = s.store.Size(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &remoteReader{s: s, name: name, size: size}, nil
+}
+
+func (s *remoteStorage) OpenDir(name string) (File, error) {
+	return s.local.OpenDir(name)
+}
+
+func (s *remoteStorage) Remove(name string) error {
+	if !s.opts.IsRemote(name) {
+		return s.local.Remove(name)
+	}
+	if s.cache != nil {
+		s.cache.evictObject(name)
+	}
+	return s.retry(func() error {
+		return s.store.Delete(name)
+	})
+}
+
+func (s *remoteStorage) Rename(oldname, newname string) error {
+	if !s.opts.IsRemote(oldname) && !s.opts.IsRemote(newname) {
+		return s.local.Rename(oldname, newname)
+	}
+	if err := s.copy(oldname, newname); err != nil {
+		return err
+	}
+	return s.Remove(oldname)
+}
+
+func (s *remoteStorage) MkdirAll(dir string, perm os.FileMode) error {
+	return s.local.MkdirAll(dir, perm)
+}
+
+func (s *remoteStorage) Lock(name string) (io.Closer, error) {
+	return s.local.Lock(name)
+}
+
+func (s *remoteStorage) List(dir string) ([]string, error) {
+	names, err := s.local.List(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	prefix := dir
+	if prefix != "" && !strings.HasSuffix(prefix, sep) {
+		prefix += sep
+	}
+	var objects []string
+	err = s.retry(func() (err error) {
+		objects, err = s.store.List(prefix)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range objects {
+		// Only the objects immediately within dir are listed.
+		if name = strings.TrimPrefix(name, prefix); !strings.Contains(name, sep) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s *remoteStorage) Stat(name string) (os.FileInfo, error) {
+	if !s.opts.IsRemote(name) {
+		return s.local.Stat(name)
+	}
+	var size int64
+	err := s.retry(func() (err error) {
+		size, err = s.store.Size(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objectInfo{name: filepath.Base(name), size: size}, nil
+}
+
+// objectInfo describes an object, and implements os.FileInfo.
+type objectInfo struct {
+	name string
+	size int64
+}
+
+func (o objectInfo) Name() string       { return o.name }
+func (o objectInfo) Size() int64        { return o.size }
+func (o objectInfo) Mode() os.FileMode  { return 0644 }
+func (o objectInfo) ModTime() time.Time { return time.Time{} }
+func (o objectInfo) IsDir() bool        { return false }
+func (o objectInfo) Sys() interface{}   { return nil }
+
+// remoteWriter streams the data written to it to a new object, and implements
+// File.
+type remoteWriter struct {
+	name string
+	w    ObjectWriter
+	size int64
+	err  error
+}
+
+func (f *remoteWriter) Close() error {
+	if f.w == nil {
+		return f.err
+	}
+	if f.err != nil {
+		// Don't publish an object which is missing data.
+		f.abort()
+		return f.err
+	}
+	f.err = f.w.Close()
+	f.w = nil
+	return f.err
+}
+
+func (f *remoteWriter) abort() {
+	if f.w != nil {
+		f.w.Abort()
+		f.w = nil
+	}
+}
+
+func (f *remoteWriter) Read(p []byte) (int, error) {
+	return 0, errors.New("pebble/storage: file was not opened for reading")
+}
+
+func (f *remoteWriter) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("pebble/storage: file was not opened for reading")
+}
+
+func (f *remoteWriter) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if f.w == nil {
+		return 0, errors.New("pebble/storage: file is closed")
+	}
+	n, err := f.w.Write(p)
+	f.size += int64(n)
+	f.err = err
+	return n, err
+}
+
+func (f *remoteWriter) Stat() (os.FileInfo, error) {
+	return objectInfo{name: filepath.Base(f.name), size: f.size}, nil
+}
+
+func (f *remoteWriter) Sync() error {
+	// The object is made durable when it is published by Close.
+	return f.err
+}
+
+// remoteReader reads an object, and implements File.
+type remoteReader struct {
+	s    *remoteStorage
+	name string
+	size int64
+	rpos int64
+}
+
+func (f *remoteReader) Close() error {
+	return nil
+}
+
+func (f *remoteReader) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.rpos)
+	f.rpos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *remoteReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if n := f.size - off; int64(len(p)) > n {
+		p, eof = p[:n], io.EOF
+	}
+	c := f.s.cache
+	if c == nil {
+		if err := f.s.read(f.name, p, off); err != nil {
+			return 0, err
+		}
+		return len(p), eof
+	}
+	blockSize := f.s.opts.CacheBlockSize
+	for n := 0; n < len(p); {
+		pos := off + int64(n)
+		key := blockKey{name: f.name, index: pos / blockSize}
+		start := key.index * blockSize
+		size := blockSize
+		if start+size > f.size {
+			size = f.size - start
+		}
+		m, err := c.readAt(key, size, p[n:], pos-start, func(buf []byte) error {
+			return f.s.read(f.name, buf, start)
+		})
+		if err != nil {
+			return n, err
+		}
+		n += m
+	}
+	return len(p), eof
+}
+
+func (f *remoteReader) Write(p []byte) (int, error) {
+	return 0, errors.New("pebble/storage: file was not created for writing")
+}
+
+func (f *remoteReader) Stat() (os.FileInfo, error) {
+	return objectInfo{name: filepath.Base(f.name), size: f.size}, nil
+}
+
+func (f *remoteReader) Sync() error {
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// flakyObjectStore wraps an ObjectStore, counting the reads and failing the
+// specified number of subsequent reads.
+type flakyObjectStore struct {
+	ObjectStore
+	mu       sync.Mutex
+	reads    int
+	failures int
+}
+
+func (s *flakyObjectStore) ReadAt(name string, p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	s.reads++
+	fail := s.failures > 0
+	if fail {
+		s.failures--
+	}
+	s.mu.Unlock()
+	if fail {
+		return 0, errors.New("injected failure")
+	}
+	return s.ObjectStore.ReadAt(name, p, off)
+}
+
+func (s *flakyObjectStore) stats() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
+
+func TestRemote(t *testing.T) {
+	local := NewMem()
+	store := &flakyObjectStore{ObjectStore: NewMemObjectStore()}
+	fs, err := NewRemote(local, store, &RemoteOptions{
+		CacheBlockSize: 4,
+		CacheDir:       "cache",
+		CacheSize:      8,
+		MaxRetries:     2,
+		RetryBackoff:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.MkdirAll("db", 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, data string) {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(f, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) string {
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// An sstable is not visible in the object store until it is closed.
+	f, err := fs.Create("db/000001.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, "hello world!"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("db/000001.sst"); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, but found %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := fs.Stat("db/000001.sst"); err != nil || info.Size() != 12 {
+		t.Fatalf("expected size 12, but found %v (%v)", info, err)
+	}
+	write("db/CURRENT", "MANIFEST-000002\n")
+	if _, err := local.Stat("db/CURRENT"); err != nil {
+		t.Fatalf("expected CURRENT to be held locally: %v", err)
+	}
+	if _, err := local.Stat("db/000001.sst"); !os.IsNotExist(err) {
+		t.Fatalf("expected the sstable to be held remotely, but found %v", err)
+	}
+	names, err := fs.List("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if s := strings.Join(names, " "); s != "000001.sst CURRENT" {
+		t.Fatalf("unexpected listing: %s", s)
+	}
+
+	// Reads are served in blocks, which are cached.
+	r, err := fs.Open("db/000001.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if n, err := r.ReadAt(buf, 3); err != nil || string(buf[:n]) != "lo wo" {
+		t.Fatalf("expected \"lo wo\", but found %q (%v)", buf[:n], err)
+	}
+	if n := store.stats(); n != 2 {
+		t.Fatalf("expected 2 reads, but found %d", n)
+	}
+	if n, err := r.ReadAt(buf[:4], 4); err != nil || string(buf[:n]) != "o wo" {
+		t.Fatalf("expected \"o wo\", but found %q (%v)", buf[:n], err)
+	}
+	if n := store.stats(); n != 2 {
+		t.Fatalf("expected 2 reads, but found %d", n)
+	}
+	if n, err := r.ReadAt(buf, 9); err != io.EOF || string(buf[:n]) != "ld!" {
+		t.Fatalf("expected \"ld!\" and EOF, but found %q (%v)", buf[:n], err)
+	}
+
+	// The cache is bounded by its capacity.
+	if s := read("db/000001.sst"); s != "hello world!" {
+		t.Fatalf("expected \"hello world!\", but found %q", s)
+	}
+	if names, err := local.List("cache"); err != nil || len(names) > 2 {
+		t.Fatalf("expected at most 2 cached blocks, but found %d (%v)", len(names), err)
+	}
+
+	// Failed reads are retried.
+	write("db/000002.sst", "abc")
+	store.failures = 2
+	if s := read("db/000002.sst"); s != "abc" {
+		t.Fatalf("expected \"abc\", but found %q", s)
+	}
+	write("db/000003.sst", "def")
+	store.failures = 3
+	if f, err := fs.Open("db/000003.sst"); err != nil {
+		t.Fatal(err)
+	} else if _, err := f.ReadAt(buf, 0); err == nil || err.Error() != "injected failure" {
+		t.Fatalf("expected injected failure, but found %v", err)
+	}
+
+	// Linking and renaming to or from the object store copies the file.
+	write("ext", "external")
+	if err := fs.Link("ext", "db/000004.sst"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename("db/000004.sst", "db/000005.sst"); err != nil {
+		t.Fatal(err)
+	}
+	if s := read("db/000005.sst"); s != "external" {
+		t.Fatalf("expected \"external\", but found %q", s)
+	}
+	if _, err := fs.Stat("db/000004.sst"); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, but found %v", err)
+	}
+
+	// Overwriting or removing an sstable evicts its cached blocks.
+	write("db/000005.sst", "internal")
+	if s := read("db/000005.sst"); s != "internal" {
+		t.Fatalf("expected \"internal\", but found %q", s)
+	}
+	if err := fs.Remove("db/000005.sst"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open("db/000005.sst"); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, but found %v", err)
+	}
+}
@@ -37,6 +37,10 @@ type Storage interface {
 	// Open opens the named file for reading.
 	Open(name string) (File, error)
 
+	// OpenDir opens the named directory for syncing. Syncing the directory
+	// makes the creation, removal and renaming of the files within it durable.
+	OpenDir(name string) (File, error)
+
 	// Remove removes the named file or directory.
 	Remove(name string) error
 
@@ -95,6 +99,10 @@ func (defaultFS) Open(name string) (File, error) {
 	return os.Open(name)
 }
 
+func (defaultFS) OpenDir(name string) (File, error) {
+	return os.OpenFile(name, os.O_RDONLY, 0)
+}
+
 func (defaultFS) Remove(name string) error {
 	return os.Remove(name)
 }
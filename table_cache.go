@@ -5,6 +5,7 @@
 package pebble
 
 import (
+	"fmt"
 	"sync"
 
 	"github.com/petermattis/pebble/db"
@@ -12,12 +13,28 @@ import (
 	"github.com/petermattis/pebble/storage"
 )
 
+// tableIterPool holds closed sstable iterators for reuse, avoiding the
+// allocation of a new iterator and its buffers each time a table is opened for
+// iteration, such as when a levelIter moves between adjacent files.
+var tableIterPool = sync.Pool{
+	New: func() interface{} {
+		return &sstable.Iter{}
+	},
+}
+
 type tableCache struct {
 	dirname string
 	fs      storage.Storage
 	opts    *db.Options
 	size    int
 
+	// The outcome of the filter checks of the cached tables, which are updated
+	// atomically.
+	filterMetrics sstable.FilterMetrics
+	// corruptionReporter, if non-nil, is invoked with the corrupted blocks
+	// found by the reads of the cached tables.
+	corruptionReporter sstable.CorruptionReporter
+
 	mu    sync.Mutex
 	nodes map[uint64]*tableCacheNode
 	dummy tableCacheNode
@@ -26,7 +43,7 @@ type tableCache struct {
 func (c *tableCache) init(dirname string, fs storage.Storage, opts *db.Options, size int) {
 	c.dirname = dirname
 	c.fs = fs
-	c.opts = opts
+	c.opts = opts.EnsureDefaults()
 	c.size = size
 	c.nodes = make(map[uint64]*tableCacheNode)
 	c.dummy.next = &c.dummy
@@ -53,13 +70,83 @@ func (c *tableCache) newIter(meta *fileMetadata) (db.InternalIterator, error) {
 		return nil, x.err
 	}
 	n.result <- x
+	tableIter := tableIterPool.Get().(*sstable.Iter)
+	_ = tableIter.Init(x.reader)
+	var iter db.InternalIterator = tableIter
+	if meta.backingFileNum != 0 {
+		iter = newBoundedIter(c.opts.Comparer.Compare, iter, meta.smallest, meta.largest)
+	}
 	return &tableCacheIter{
-		InternalIterator: x.reader.NewIter(nil),
+		InternalIterator: iter,
+		tableIter:        tableIter,
 		cache:            c,
 		node:             n,
 	}, nil
 }
 
+// withReader invokes fn with the reader for the table. The reader must not be
+// retained after fn returns.
+func (c *tableCache) withReader(meta *fileMetadata, fn func(r *sstable.Reader) error) error {
+	n := c.findNode(meta)
+	x := <-n.result
+	if x.err != nil {
+		c.mu.Lock()
+		n.refCount--
+		if n.refCount == 0 {
+			go n.release()
+		}
+		c.mu.Unlock()
+
+		// Try loading the table again; the error may be transient.
+		go n.load(c)
+		return x.err
+	}
+	n.result <- x
+	err := fn(x.reader)
+
+	c.mu.Lock()
+	n.refCount--
+	if n.refCount == 0 {
+		go n.release()
+	}
+	c.mu.Unlock()
+	return err
+}
+
+// prewarm opens the specified tables, up to the capacity of the cache, and
+// returns the first error encountered by a table which could not be opened.
+// The tables are opened concurrently.
+func (c *tableCache) prewarm(metas []*fileMetadata) error {
+	if len(metas) > c.size {
+		metas = metas[:c.size]
+	}
+	nodes := make([]*tableCacheNode, len(metas))
+	for i, meta := range metas {
+		nodes[i] = c.findNode(meta)
+	}
+	var err error
+	for _, n := range nodes {
+		x := <-n.result
+		n.result <- x
+		if err == nil {
+			if err = x.err; err == nil {
+				err = x.reader.Err()
+			}
+			if err != nil {
+				err = fmt.Errorf("pebble: table %06d: %v", n.meta.fileNum, err)
+			}
+		}
+
+		c.mu.Lock()
+		n.refCount--
+		if n.refCount == 0 {
+			go n.release()
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
 // releaseNode releases a node from the tableCache.
 //
 // c.mu must be held when calling this.
@@ -117,6 +204,20 @@ func (c *tableCache) evict(fileNum uint64) {
 	}
 }
 
+// evictVirtual evicts the nodes for virtual tables which are not present in
+// the set of live file numbers. Virtual tables do not have a file of their
+// own, so they are not evicted when obsolete files are deleted.
+func (c *tableCache) evictVirtual(live map[uint64]struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for fileNum, n := range c.nodes {
+		if _, ok := live[fileNum]; !ok && n.meta.backingFileNum != 0 {
+			c.releaseNode(n)
+		}
+	}
+}
+
 func (c *tableCache) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -149,13 +250,26 @@ type tableCacheNode struct {
 }
 
 func (n *tableCacheNode) load(c *tableCache) {
-	// Try opening the fileTypeTable first.
-	f, err := c.fs.Open(dbFilename(c.dirname, fileTypeTable, n.meta.fileNum))
+	// Try opening the fileTypeTable first. A virtual table reads from its
+	// backing table, sharing the backing table's blocks in the block cache.
+	f, err := c.fs.Open(dbFilename(c.dirname, fileTypeTable, n.meta.diskFileNum()))
 	if err != nil {
 		n.result <- tableReaderOrError{err: err}
 		return
 	}
-	r := sstable.NewReader(f, n.meta.fileNum, c.opts)
+	r := sstable.NewReader(f, n.meta.diskFileNum(), c.opts, &c.filterMetrics, c.corruptionReporter)
+	// Open checks the merge operator name recorded in the OPTIONS file and
+	// the manifest, but a DB may have neither, so the name recorded by each
+	// table is checked as well. Tables written by RocksDB without a merge
+	// operator record the merge operator name as "nullptr".
+	if name := r.Properties.MergeOperatorName; name != "" && name != "nullptr" &&
+		c.opts.Merger != nil && name != c.opts.Merger.Name() {
+		r.Close()
+		n.result <- tableReaderOrError{err: fmt.Errorf(
+			"pebble: table %d: merge operator name from file %q != merge operator name from db.Options %q",
+			n.meta.fileNum, name, c.opts.Merger.Name())}
+		return
+	}
 	if n.meta.smallestSeqNum == n.meta.largestSeqNum {
 		r.Properties.GlobalSeqNum = n.meta.largestSeqNum
 	}
@@ -170,12 +284,43 @@ func (n *tableCacheNode) release() {
 	x.reader.Close()
 }
 
+// setReadStats sets the stats accumulating the bytes read by iter, if iter is
+// an iterator over a cached table. See sstable.Iter.SetReadStats.
+func setReadStats(iter db.InternalIterator, stats *sstable.ReadStats) {
+	if t, ok := iter.(*tableCacheIter); ok {
+		t.tableIter.SetReadStats(stats)
+	}
+}
+
+// setVerifyChecksums forces the data blocks read by iter to be verified, if
+// iter is an iterator over a cached table. See
+// sstable.Iter.SetVerifyChecksums.
+func setVerifyChecksums(iter db.InternalIterator) {
+	if t, ok := iter.(*tableCacheIter); ok {
+		t.tableIter.SetVerifyChecksums(true)
+	}
+}
+
 type tableCacheIter struct {
 	db.InternalIterator
-	cache    *tableCache
-	node     *tableCacheNode
-	closeErr error
-	closed   bool
+	// The pooled sstable iterator underlying InternalIterator, which is
+	// returned to tableIterPool when the iterator is closed.
+	tableIter *sstable.Iter
+	cache     *tableCache
+	node      *tableCacheNode
+	closeErr  error
+	closed    bool
+}
+
+// SeekGEFiltered implements filteredSeeker, consulting the table's filter
+// unless the table's iterator is wrapped to restrict it to the bounds of a
+// virtual table.
+func (i *tableCacheIter) SeekGEFiltered(key []byte) {
+	if f, ok := i.InternalIterator.(filteredSeeker); ok {
+		f.SeekGEFiltered(key)
+		return
+	}
+	i.InternalIterator.SeekGE(key)
 }
 
 func (i *tableCacheIter) Close() error {
@@ -192,5 +337,7 @@ func (i *tableCacheIter) Close() error {
 	i.cache.mu.Unlock()
 
 	i.closeErr = i.InternalIterator.Close()
+	tableIterPool.Put(i.tableIter)
+	i.tableIter = nil
 	return i.closeErr
 }
@@ -0,0 +1,146 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import "github.com/petermattis/pebble/db"
+
+// timestampIter wraps an iterator, hiding the point entries whose keys have a
+// timestamp newer than the timestamp the iterator reads at. Keys without a
+// timestamp are always visible, as are range deletions, which may cover keys
+// at any timestamp. See db.IterOptions.Timestamp.
+type timestampIter struct {
+	comparer  *db.Comparer
+	iter      db.InternalIterator
+	timestamp []byte
+}
+
+var _ db.InternalIterator = (*timestampIter)(nil)
+
+func newTimestampIter(
+	comparer *db.Comparer, iter db.InternalIterator, timestamp []byte,
+) *timestampIter {
+	return &timestampIter{
+		comparer:  comparer,
+		iter:      iter,
+		timestamp: timestamp,
+	}
+}
+
+// hidden returns true if the entry at the current position is newer than the
+// iterator's timestamp.
+func (i *timestampIter) hidden() bool {
+	key := i.iter.Key()
+	if key.Kind() == db.InternalKeyKindRangeDelete {
+		return false
+	}
+	ts := i.comparer.Timestamp(key.UserKey)
+	return len(ts) > 0 && i.comparer.CompareTimestamps(ts, i.timestamp) > 0
+}
+
+func (i *timestampIter) skipForward() bool {
+	for i.iter.Valid() && i.hidden() {
+		i.iter.Next()
+	}
+	return i.iter.Valid()
+}
+
+func (i *timestampIter) skipBackward() bool {
+	for i.iter.Valid() && i.hidden() {
+		i.iter.Prev()
+	}
+	return i.iter.Valid()
+}
+
+// SeekGE implements InternalIterator.SeekGE, as documented in the pebble/db
+// package.
+func (i *timestampIter) SeekGE(key []byte) {
+	i.iter.SeekGE(key)
+	i.skipForward()
+}
+
+// SeekPrefixGE implements InternalIterator.SeekPrefixGE, as documented in the
+// pebble/db package.
+func (i *timestampIter) SeekPrefixGE(prefix, key []byte) {
+	i.iter.SeekPrefixGE(prefix, key)
+	i.skipForward()
+}
+
+// SeekLT implements InternalIterator.SeekLT, as documented in the pebble/db
+// package.
+func (i *timestampIter) SeekLT(key []byte) {
+	i.iter.SeekLT(key)
+	i.skipBackward()
+}
+
+// First implements InternalIterator.First, as documented in the pebble/db
+// package.
+func (i *timestampIter) First() {
+	i.iter.First()
+	i.skipForward()
+}
+
+// Last implements InternalIterator.Last, as documented in the pebble/db
+// package.
+func (i *timestampIter) Last() {
+	i.iter.Last()
+	i.skipBackward()
+}
+
+// Next implements InternalIterator.Next, as documented in the pebble/db
+// package.
+func (i *timestampIter) Next() bool {
+	i.iter.Next()
+	return i.skipForward()
+}
+
+// NextUserKey implements InternalIterator.NextUserKey, as documented in the
+// pebble/db package.
+func (i *timestampIter) NextUserKey() bool {
+	i.iter.NextUserKey()
+	return i.skipForward()
+}
+
+// Prev implements InternalIterator.Prev, as documented in the pebble/db
+// package.
+func (i *timestampIter) Prev() bool {
+	i.iter.Prev()
+	return i.skipBackward()
+}
+
+// PrevUserKey implements InternalIterator.PrevUserKey, as documented in the
+// pebble/db package.
+func (i *timestampIter) PrevUserKey() bool {
+	i.iter.PrevUserKey()
+	return i.skipBackward()
+}
+
+// Key implements InternalIterator.Key, as documented in the pebble/db package.
+func (i *timestampIter) Key() db.InternalKey {
+	return i.iter.Key()
+}
+
+// Value implements InternalIterator.Value, as documented in the pebble/db
+// package.
+func (i *timestampIter) Value() []byte {
+	return i.iter.Value()
+}
+
+// Valid implements InternalIterator.Valid, as documented in the pebble/db
+// package.
+func (i *timestampIter) Valid() bool {
+	return i.iter.Valid()
+}
+
+// Error implements InternalIterator.Error, as documented in the pebble/db
+// package.
+func (i *timestampIter) Error() error {
+	return i.iter.Error()
+}
+
+// Close implements InternalIterator.Close, as documented in the pebble/db
+// package.
+func (i *timestampIter) Close() error {
+	return i.iter.Close()
+}
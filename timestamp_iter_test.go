@@ -0,0 +1,137 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestTimestampReads(t *testing.T) {
+	comparer := &db.Comparer{
+		Compare:   db.DefaultComparer.Compare,
+		InlineKey: db.DefaultComparer.InlineKey,
+		Split: func(a []byte) int {
+			if i := bytes.IndexByte(a, '@'); i >= 0 {
+				return i
+			}
+			return len(a)
+		},
+		CompareTimestamps: func(a, b []byte) int {
+			return bytes.Compare(a, b)
+		},
+		Name: "test-timestamps",
+	}
+	d, err := Open("", &db.Options{
+		Comparer: comparer,
+		Storage:  storage.NewMem(),
+		Levels:   []db.LevelOptions{{BlockSize: 10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Some of the versions are flushed to an sstable, whose data blocks hold
+	// one key each, and the others remain in the memtable.
+	for _, k := range []string{"a", "a@1", "a@5", "b@2", "b@7", "c@9"} {
+		if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a@3", "c@4", "d@8"} {
+		if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scan := func(ts string, reverse bool) string {
+		iter := d.NewIter(&db.IterOptions{Timestamp: []byte(ts)})
+		var keys []string
+		if reverse {
+			for iter.Last(); iter.Valid(); iter.Prev() {
+				keys = append(keys, string(iter.Key()))
+			}
+		} else {
+			for iter.First(); iter.Valid(); iter.Next() {
+				keys = append(keys, string(iter.Key()))
+			}
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, " ")
+	}
+	testCases := []struct {
+		ts       string
+		expected string
+	}{
+		{"@0", "a"},
+		{"@2", "a a@1 b@2"},
+		{"@4", "a a@1 a@3 b@2 c@4"},
+		{"@9", "a a@1 a@3 a@5 b@2 b@7 c@4 c@9 d@8"},
+	}
+	for _, c := range testCases {
+		if s := scan(c.ts, false); s != c.expected {
+			t.Fatalf("%s: expected %q, but found %q", c.ts, c.expected, s)
+		}
+		var keys []string
+		for _, k := range strings.Fields(c.expected) {
+			keys = append([]string{k}, keys...)
+		}
+		if s, expected := scan(c.ts, true), strings.Join(keys, " "); s != expected {
+			t.Fatalf("%s: expected %q, but found %q", c.ts, expected, s)
+		}
+	}
+
+	getCases := []struct {
+		key, ts  string
+		expected string
+	}{
+		{"a", "@0", "a"},
+		{"a", "@4", "a@3"},
+		{"a", "@9", "a@5"},
+		{"b", "@1", ""},
+		{"b", "@6", "b@2"},
+		{"c", "@9", "c@9"},
+		{"d", "@7", ""},
+		{"e", "@9", ""},
+	}
+	for _, c := range getCases {
+		v, err := d.GetAtTimestamp([]byte(c.key), []byte(c.ts))
+		if c.expected == "" {
+			if err != db.ErrNotFound {
+				t.Fatalf("%s%s: expected not found, but found %q, %v", c.key, c.ts, v, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != c.expected {
+			t.Fatalf("%s%s: expected %q, but found %q", c.key, c.ts, c.expected, v)
+		}
+	}
+}
+
+func TestGetAtTimestampUnsupported(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err := d.GetAtTimestamp([]byte("a"), []byte("1")); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
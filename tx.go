@@ -0,0 +1,359 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"container/heap"
+	"errors"
+	"sync/atomic"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// ErrConflict is returned by Tx.Commit if a key read by the transaction was
+// written by another transaction or writer after the transaction started.
+var ErrConflict = errors.New("pebble: transaction conflict")
+
+// errTxClosed is returned by the methods of a Tx which has been committed or
+// closed.
+var errTxClosed = errors.New("pebble: transaction is closed")
+
+// Tx is an optimistic transaction. Reads are served from the transaction's
+// own writes and a snapshot of the DB taken when the transaction started.
+// Writes are buffered in an indexed batch and are not visible to other
+// readers until the transaction commits.
+//
+// The transaction records every key read via Get in its read-set. Commit
+// checks that none of those keys has been written since the snapshot was
+// taken and, if so, applies the batch atomically; otherwise the batch is
+// discarded and ErrConflict is returned. Reads performed through NewIter are
+// not recorded, so range reads are not protected against concurrent writes.
+//
+// While a transaction is open the DB tracks the keys written by every commit
+// and ingestion, and the read-set is validated against them in the commit
+// pipeline, immediately before the transaction's batch is assigned a sequence
+// number. No write can be committed between the validation and the
+// application of the batch. The writes which precede the snapshots of all of
+// the open transactions are discarded.
+//
+// A Tx is not safe for concurrent use. It must be committed or closed when it
+// is no longer needed.
+type Tx struct {
+	db       *DB
+	snapshot *Snapshot
+	batch    *Batch
+	// The user keys read by the transaction. Every key was read at
+	// snapshot.seqNum.
+	reads map[string]struct{}
+	// The sequence number from which the writes are tracked for the
+	// transaction, which is at most snapshot.seqNum.
+	trackedSeqNum uint64
+}
+
+// NewTx starts a new optimistic transaction reading the current DB state.
+func (d *DB) NewTx() *Tx {
+	d.mu.Lock()
+	seqNum := atomic.LoadUint64(&d.mu.versions.logSeqNum) - 1
+	heap.Push(&d.mu.tx.open, seqNum)
+	d.mu.Unlock()
+
+	// The writes of the batches which were assigned a sequence number before
+	// the transaction opened are not tracked, so wait for them to become
+	// visible to the transaction's snapshot.
+	d.commit.waitForVisible(seqNum + 1)
+	return &Tx{
+		db:            d,
+		snapshot:      d.NewSnapshot(),
+		batch:         newIndexedBatch(d, d.opts.Comparer),
+		reads:         make(map[string]struct{}),
+		trackedSeqNum: seqNum,
+	}
+}
+
+// SeqNum returns the sequence number of the snapshot the transaction reads
+// from.
+func (t *Tx) SeqNum() uint64 {
+	if t.snapshot == nil {
+		return 0
+	}
+	return t.snapshot.seqNum
+}
+
+// Get gets the value for the given key, taking into account the writes made
+// by the transaction. It returns ErrNotFound if the key is not present. The
+// key is added to the transaction's read-set.
+//
+// It is safe to modify the contents of the argument and of the returned slice
+// after Get returns.
+func (t *Tx) Get(key []byte) ([]byte, error) {
+	if t.db == nil {
+		return nil, errTxClosed
+	}
+	t.reads[string(key)] = struct{}{}
+
+	iter := t.db.newIterInternal(t.batch, t.snapshot, nil)
+	iter.SeekPrefixGE(key)
+	var value []byte
+	var err error
+	if iter.Valid() && t.db.cmp(key, iter.Key()) == 0 {
+		value = append([]byte(nil), iter.Value()...)
+	} else {
+		err = db.ErrNotFound
+	}
+	if cerr := iter.Close(); cerr != nil {
+		return nil, cerr
+	}
+	return value, err
+}
+
+// NewIter returns an iterator over the transaction's writes merged with the
+// DB state as of the transaction's snapshot. The keys returned by the
+// iterator are not added to the transaction's read-set.
+func (t *Tx) NewIter(o *db.IterOptions) db.Iterator {
+	if t.db == nil {
+		return &dbIter{err: errTxClosed}
+	}
+	return t.db.newIterInternal(t.batch, t.snapshot, o)
+}
+
+// Set sets the value for the given key when the transaction commits.
+//
+// It is safe to modify the contents of the arguments after Set returns.
+func (t *Tx) Set(key, value []byte, opts *db.WriteOptions) error {
+	if t.db == nil {
+		return errTxClosed
+	}
+	return t.batch.Set(key, value, opts)
+}
+
+// Merge merges the value for the given key when the transaction commits.
+//
+// It is safe to modify the contents of the arguments after Merge returns.
+func (t *Tx) Merge(key, value []byte, opts *db.WriteOptions) error {
+	if t.db == nil {
+		return errTxClosed
+	}
+	return t.batch.Merge(key, value, opts)
+}
+
+// Delete deletes the value for the given key when the transaction commits.
+//
+// It is safe to modify the contents of the arguments after Delete returns.
+func (t *Tx) Delete(key []byte, opts *db.WriteOptions) error {
+	if t.db == nil {
+		return errTxClosed
+	}
+	return t.batch.Delete(key, opts)
+}
+
+// DeleteRange deletes all of the keys (and values) in the range [start,end)
+// when the transaction commits.
+//
+// It is safe to modify the contents of the arguments after DeleteRange
+// returns.
+func (t *Tx) DeleteRange(start, end []byte, opts *db.WriteOptions) error {
+	if t.db == nil {
+		return errTxClosed
+	}
+	return t.batch.DeleteRange(start, end, opts)
+}
+
+// Commit validates the transaction's read-set and applies its writes
+// atomically. It returns ErrConflict, and applies nothing, if any key read by
+// the transaction has been written since the transaction's snapshot was
+// taken. The transaction is closed when Commit returns, regardless of the
+// outcome.
+func (t *Tx) Commit(opts *db.WriteOptions) error {
+	d := t.db
+	if d == nil {
+		return errTxClosed
+	}
+	defer t.Close()
+
+	if t.batch.Empty() {
+		d.mu.Lock()
+		err := t.validate()
+		d.mu.Unlock()
+		return err
+	}
+	t.batch.validate = t.validate
+	return d.Apply(t.batch, opts)
+}
+
+// validate returns ErrConflict if a key read by the transaction has been
+// written since the transaction's snapshot was taken.
+//
+// DB.mu must be held when calling this.
+func (t *Tx) validate() error {
+	w := &t.db.mu.tx
+	for key := range t.reads {
+		if w.written([]byte(key), t.db.cmp, t.snapshot.seqNum) {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+// Close discards the transaction's writes and releases its snapshot. It is
+// valid to call Close multiple times, and after Commit.
+func (t *Tx) Close() error {
+	d := t.db
+	if d == nil {
+		return nil
+	}
+	err := t.snapshot.Close()
+	t.batch.release()
+	t.db = nil
+	t.snapshot = nil
+	t.batch = nil
+	t.reads = nil
+
+	d.mu.Lock()
+	d.mu.tx.close(t.trackedSeqNum)
+	d.mu.Unlock()
+	return err
+}
+
+// txWrites tracks the writes committed while transactions are open. A write
+// is retained until it precedes the snapshots of all of the open
+// transactions, as it can then no longer conflict with their reads.
+type txWrites struct {
+	// The sequence numbers from which the writes are tracked for the open
+	// transactions. See Tx.trackedSeqNum.
+	open txSeqNums
+	// The sequence number of the newest write of each key.
+	keys map[string]uint64
+	// The writes of keys in increasing sequence number order, from which the
+	// writes preceding every open transaction are pruned.
+	log []txKeyWrite
+	// The key spans written by range deletions and ingestions, in increasing
+	// sequence number order.
+	spans []txSpan
+}
+
+// txKeyWrite is a write of key at seqNum.
+type txKeyWrite struct {
+	key    string
+	seqNum uint64
+}
+
+// txSpan is a key span written at seqNum. The span is [start, end), or
+// [start, end] if endInclusive is true.
+type txSpan struct {
+	start, end   []byte
+	endInclusive bool
+	seqNum       uint64
+}
+
+// txSeqNums is a min-heap of sequence numbers, implementing heap.Interface.
+type txSeqNums []uint64
+
+func (h txSeqNums) Len() int           { return len(h) }
+func (h txSeqNums) Less(i, j int) bool { return h[i] < h[j] }
+func (h txSeqNums) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *txSeqNums) Push(x interface{}) {
+	*h = append(*h, x.(uint64))
+}
+
+func (h *txSeqNums) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// close removes a transaction whose writes are tracked from seqNum, and
+// prunes the writes which precede all of the remaining open transactions.
+func (w *txWrites) close(seqNum uint64) {
+	for i, s := range w.open {
+		if s == seqNum {
+			heap.Remove(&w.open, i)
+			break
+		}
+	}
+	if len(w.open) == 0 {
+		*w = txWrites{}
+		return
+	}
+	oldest := w.open[0]
+	for len(w.log) > 0 && w.log[0].seqNum <= oldest {
+		if kw := w.log[0]; w.keys[kw.key] == kw.seqNum {
+			delete(w.keys, kw.key)
+		}
+		w.log = w.log[1:]
+	}
+	for len(w.spans) > 0 && w.spans[0].seqNum <= oldest {
+		w.spans = w.spans[1:]
+	}
+}
+
+// addBatch records the writes of a batch which has been assigned a sequence
+// number. The entries of the batch's keyspaces are not recorded, as a
+// transaction only reads the default keyspace.
+func (w *txWrites) addBatch(b *Batch) {
+	if w.keys == nil {
+		w.keys = make(map[string]uint64)
+	}
+	seqNum := b.seqNum()
+	skip := false
+	for iter := b.iter(); ; {
+		kind, ukey, value, ok := iter.next()
+		if !ok {
+			break
+		}
+		switch kind {
+		case db.InternalKeyKindLogData, db.InternalKeyKindCommitXID, db.InternalKeyKindRollbackXID:
+			continue
+		case db.InternalKeyKindBeginPrepareXID:
+			// The entries of a prepared batch are written when the transaction
+			// commits.
+			return
+		case db.InternalKeyKindKeyspace:
+			skip = len(ukey) > 0
+			continue
+		}
+		if !skip {
+			if kind == db.InternalKeyKindRangeDelete {
+				w.addSpan(ukey, value, false, seqNum)
+			} else {
+				key := string(ukey)
+				w.keys[key] = seqNum
+				w.log = append(w.log, txKeyWrite{key: key, seqNum: seqNum})
+			}
+		}
+		seqNum++
+	}
+}
+
+// addSpan records a write of the span of keys [start, end), or [start, end]
+// if endInclusive is true.
+func (w *txWrites) addSpan(start, end []byte, endInclusive bool, seqNum uint64) {
+	w.spans = append(w.spans, txSpan{
+		start:        append([]byte(nil), start...),
+		end:          append([]byte(nil), end...),
+		endInclusive: endInclusive,
+		seqNum:       seqNum,
+	})
+}
+
+// written returns true if key has been written at a sequence number larger
+// than seqNum.
+func (w *txWrites) written(key []byte, cmp db.Compare, seqNum uint64) bool {
+	if s, ok := w.keys[string(key)]; ok && s > seqNum {
+		return true
+	}
+	for i := range w.spans {
+		sp := &w.spans[i]
+		if sp.seqNum <= seqNum || cmp(key, sp.start) < 0 {
+			continue
+		}
+		if c := cmp(key, sp.end); c < 0 || (c == 0 && sp.endInclusive) {
+			return true
+		}
+	}
+	return false
+}
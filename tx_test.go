@@ -0,0 +1,344 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestTx(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Logger:  discardLogger{},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	get := func(r interface {
+		Get(key []byte) ([]byte, error)
+	}, key string) string {
+		v, err := r.Get([]byte(key))
+		if err == db.ErrNotFound {
+			return "<not found>"
+		} else if err != nil {
+			return err.Error()
+		}
+		return string(v)
+	}
+
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("b"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction sees its own writes, and the DB does not see them until
+	// the transaction commits.
+	tx := d.NewTx()
+	if err := tx.Set([]byte("a"), []byte("2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if v := get(tx, "a"); v != "2" {
+		t.Fatalf("expected 2, but found %s", v)
+	}
+	if v := get(tx, "b"); v != "<not found>" {
+		t.Fatalf("expected <not found>, but found %s", v)
+	}
+	if v := get(d, "a"); v != "1" {
+		t.Fatalf("expected 1, but found %s", v)
+	}
+
+	// Writes made after the transaction started are not visible to it.
+	if err := d.Set([]byte("c"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if v := get(tx, "c"); v != "<not found>" {
+		t.Fatalf("expected <not found>, but found %s", v)
+	}
+
+	iter := tx.NewIter(nil)
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key())+":"+string(iter.Value()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "a:2" {
+		t.Fatalf("expected [a:2], but found %v", keys)
+	}
+
+	// The write to "c" happened after the transaction read it, so the
+	// transaction conflicts and none of its writes are applied.
+	if err := tx.Commit(nil); err != ErrConflict {
+		t.Fatalf("expected %v, but found %v", ErrConflict, err)
+	}
+	if v := get(d, "a"); v != "1" {
+		t.Fatalf("expected 1, but found %s", v)
+	}
+	if v := get(d, "b"); v != "1" {
+		t.Fatalf("expected 1, but found %s", v)
+	}
+	if _, err := tx.Get([]byte("a")); err != errTxClosed {
+		t.Fatalf("expected %v, but found %v", errTxClosed, err)
+	}
+
+	// A transaction which only read keys that have not been written since it
+	// started commits successfully.
+	tx = d.NewTx()
+	if v := get(tx, "a"); v != "1" {
+		t.Fatalf("expected 1, but found %s", v)
+	}
+	if err := tx.Set([]byte("a"), []byte("3"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("b"), []byte("2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	if v := get(d, "a"); v != "3" {
+		t.Fatalf("expected 3, but found %s", v)
+	}
+	if err := tx.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	empty := d.mu.snapshots.empty()
+	d.mu.Unlock()
+	if !empty {
+		t.Fatalf("expected the transactions' snapshots to be released")
+	}
+}
+
+func TestTxConflict(t *testing.T) {
+	testCases := []struct {
+		name  string
+		write func(d *DB) error
+	}{
+		{"set", func(d *DB) error {
+			return d.Set([]byte("a"), []byte("2"), nil)
+		}},
+		{"delete", func(d *DB) error {
+			return d.Delete([]byte("a"), nil)
+		}},
+		{"set-missing", func(d *DB) error {
+			return d.Set([]byte("z"), []byte("1"), nil)
+		}},
+		{"flush", func(d *DB) error {
+			if err := d.Set([]byte("a"), []byte("2"), nil); err != nil {
+				return err
+			}
+			return d.Flush()
+		}},
+		{"tx", func(d *DB) error {
+			tx := d.NewTx()
+			if err := tx.Set([]byte("a"), []byte("2"), nil); err != nil {
+				return err
+			}
+			return tx.Commit(nil)
+		}},
+		{"delete-range", func(d *DB) error {
+			return d.DeleteRange([]byte("0"), []byte("b"), nil)
+		}},
+		{"ingest", func(d *DB) error {
+			f, err := d.opts.Storage.Create("ext")
+			if err != nil {
+				return err
+			}
+			w := sstable.NewWriter(f, nil, db.LevelOptions{})
+			if err := w.Add(db.MakeInternalKey([]byte("z"), 0, db.InternalKeyKindSet), nil); err != nil {
+				return err
+			}
+			if err := w.Close(); err != nil {
+				return err
+			}
+			return d.Ingest([]string{"ext"})
+		}},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			d, err := Open("", &db.Options{
+				Logger:  discardLogger{},
+				Storage: storage.NewMem(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			tx := d.NewTx()
+			tx.Get([]byte("a"))
+			tx.Get([]byte("z"))
+			if err := tx.Set([]byte("b"), []byte("1"), nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.write(d); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Commit(db.Sync); err != ErrConflict {
+				t.Fatalf("expected %v, but found %v", ErrConflict, err)
+			}
+			if _, err := d.Get([]byte("b")); err != db.ErrNotFound {
+				t.Fatalf("expected %v, but found %v", db.ErrNotFound, err)
+			}
+
+			// The rejected batch released its sync slot.
+			d.commit.syncer.Lock()
+			reserved := d.commit.syncer.reserved
+			d.commit.syncer.Unlock()
+			if reserved != 0 {
+				t.Fatalf("expected no reserved sync slots, but found %d", reserved)
+			}
+		})
+	}
+}
+
+func TestTxConcurrentIncrement(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Logger:  discardLogger{},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	key := []byte("counter")
+	increment := func() error {
+		for {
+			tx := d.NewTx()
+			var n int
+			v, err := tx.Get(key)
+			if err == nil {
+				if n, err = strconv.Atoi(string(v)); err != nil {
+					tx.Close()
+					return err
+				}
+			} else if err != db.ErrNotFound {
+				tx.Close()
+				return err
+			}
+			if err := tx.Set(key, []byte(strconv.Itoa(n+1)), nil); err != nil {
+				tx.Close()
+				return err
+			}
+			switch err := tx.Commit(nil); err {
+			case nil:
+				return nil
+			case ErrConflict:
+			default:
+				return err
+			}
+		}
+	}
+
+	const workers = 8
+	const perWorker = 50
+	var wg sync.WaitGroup
+	errCh := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				if err := increment(); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	v, err := d.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := strconv.Atoi(string(v)); n != workers*perWorker {
+		t.Fatalf("expected %d, but found %d", workers*perWorker, n)
+	}
+}
+
+func TestTxPruneWrites(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Logger:  discardLogger{},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	tracked := func() (keys, spans int) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.mu.tx.keys), len(d.mu.tx.spans)
+	}
+	set := func(key string) {
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The writes are tracked while a transaction which may conflict with them
+	// is open.
+	tx1 := d.NewTx()
+	set("a")
+	set("b")
+	if err := d.DeleteRange([]byte("c"), []byte("d"), nil); err != nil {
+		t.Fatal(err)
+	}
+	tx2 := d.NewTx()
+	set("b")
+	set("e")
+	if keys, spans := tracked(); keys != 3 || spans != 1 {
+		t.Fatalf("expected 3 keys and 1 span, but found %d and %d", keys, spans)
+	}
+
+	// Closing the oldest transaction prunes the writes which precede the
+	// remaining transaction, which still conflicts with the newer writes.
+	if err := tx1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if keys, spans := tracked(); keys != 2 || spans != 0 {
+		t.Fatalf("expected 2 keys and 0 spans, but found %d and %d", keys, spans)
+	}
+	if _, err := tx2.Get([]byte("e")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %v", err)
+	}
+	_ = tx2.Set([]byte("f"), []byte("f"), nil)
+	if err := tx2.Commit(nil); err != ErrConflict {
+		t.Fatalf("expected %v, but found %v", ErrConflict, err)
+	}
+	if keys, spans := tracked(); keys != 0 || spans != 0 {
+		t.Fatalf("expected no tracked writes, but found %d keys and %d spans", keys, spans)
+	}
+}
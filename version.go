@@ -12,12 +12,20 @@ import (
 	"sync/atomic"
 
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
 )
 
 // fileMetadata holds the metadata for an on-disk table.
 type fileMetadata struct {
 	// fileNum is the file number.
 	fileNum uint64
+	// backingFileNum is the file number of the on-disk table holding the data
+	// for a virtual table, or 0 if the table is not virtual. A virtual table
+	// references the portion of its backing table within [smallest, largest],
+	// which may be tighter than the bounds of the backing table, and does not
+	// have a file of its own. A backing table may be shared by several virtual
+	// tables.
+	backingFileNum uint64
 	// size is the size of the file, in bytes.
 	size uint64
 	// smallest and largest are the inclusive bounds for the internal keys
@@ -31,6 +39,27 @@ type fileMetadata struct {
 	markedForCompaction bool
 }
 
+// diskFileNum returns the file number of the on-disk table holding the data
+// for the table.
+func (m *fileMetadata) diskFileNum() uint64 {
+	if m.backingFileNum != 0 {
+		return m.backingFileNum
+	}
+	return m.fileNum
+}
+
+// updateSeqNum widens the sequence number range of the file to include
+// seqNum. The range must be initialized with smallestSeqNum set to
+// db.InternalKeySeqNumMax.
+func (m *fileMetadata) updateSeqNum(seqNum uint64) {
+	if m.smallestSeqNum > seqNum {
+		m.smallestSeqNum = seqNum
+	}
+	if m.largestSeqNum < seqNum {
+		m.largestSeqNum = seqNum
+	}
+}
+
 // totalSize returns the total size of all the files in f.
 func totalSize(f []fileMetadata) (size uint64) {
 	for _, x := range f {
@@ -140,9 +169,10 @@ func (v *version) ref() {
 
 func (v *version) unref() {
 	if atomic.AddInt32(&v.refs, -1) == 0 {
-		v.list.mu.Lock()
-		v.list.remove(v)
-		v.list.mu.Unlock()
+		l := v.list
+		l.mu.Lock()
+		l.remove(v)
+		l.mu.Unlock()
 	}
 }
 
@@ -176,6 +206,37 @@ func (v *version) updateCompactionScore(opts *db.Options) {
 	}
 }
 
+// markedForCompaction returns a table which is marked for compaction, and its
+// level, or nil if there is no such table. The tables in the bottommost level
+// cannot be compacted into a lower level, and are not returned.
+func (v *version) markedForCompaction() (int, *fileMetadata) {
+	for level := 0; level < numLevels-1; level++ {
+		for i := range v.files[level] {
+			if f := &v.files[level][i]; f.markedForCompaction {
+				return level, f
+			}
+		}
+	}
+	return 0, nil
+}
+
+// suspectTable returns a table whose file is suspect, and its level, or nil
+// if there is no such table or suspect is nil. Like markedForCompaction, it
+// does not return the tables in the bottommost level.
+func (v *version) suspectTable(suspect func(fileNum uint64) bool) (int, *fileMetadata) {
+	if suspect == nil {
+		return 0, nil
+	}
+	for level := 0; level < numLevels-1; level++ {
+		for i := range v.files[level] {
+			if f := &v.files[level][i]; suspect(f.diskFileNum()) {
+				return level, f
+			}
+		}
+	}
+	return 0, nil
+}
+
 // overlaps returns all elements of v.files[level] whose user key range
 // intersects the inclusive range [ukey0, ukey1]. If level is non-zero then the
 // user key ranges of v.files[level] are assumed to not overlap (although they
@@ -227,6 +288,32 @@ loop:
 	}
 }
 
+// pickLevelForOutput returns the deepest level, from level up to maxLevel, at
+// which a new table spanning the user keys [smallest, largest] can be placed
+// instead of level. The table is moved down a level only if it overlaps no
+// table in the level below, and the data it overlaps two levels below is small
+// enough that compacting it later will not be too expensive. The table must
+// not overlap any table in level itself, nor any newer data.
+func (v *version) pickLevelForOutput(
+	opts *db.Options, cmp db.Compare, level, maxLevel int, smallest, largest []byte,
+) int {
+	if level == 0 && len(v.overlaps(0, cmp, smallest, largest)) != 0 {
+		return 0
+	}
+	for ; level < maxLevel; level++ {
+		if len(v.overlaps(level+1, cmp, smallest, largest)) != 0 {
+			break
+		}
+		if level+2 < numLevels {
+			overlaps := v.overlaps(level+2, cmp, smallest, largest)
+			if totalSize(overlaps) > maxGrandparentOverlapBytes(opts, level+1) {
+				break
+			}
+		}
+	}
+	return level
+}
+
 // checkOrdering checks that the files are consistent with respect to
 // increasing file numbers (for level 0 files) and increasing and non-
 // overlapping internal key ranges (for level non-0 files).
@@ -266,8 +353,16 @@ type tableNewIter func(meta *fileMetadata) (db.InternalIterator, error)
 // If ikey0's kind is set, the value for that previous set action is returned.
 // If ikey0's kind is delete, the db.ErrNotFound error is returned.
 // If there is no such ikey0, the db.ErrNotFound error is returned.
+//
+// The bytes read from the tables of each level are accumulated in stats, if
+// it is non-nil. The checksums of the data blocks read are verified if
+// ro.VerifyChecksums is set.
 func (v *version) get(
-	ikey db.InternalKey, newIter tableNewIter, cmp db.Compare, ro *db.IterOptions,
+	ikey db.InternalKey,
+	newIter tableNewIter,
+	cmp db.Compare,
+	ro *db.IterOptions,
+	stats *[numLevels]sstable.ReadStats,
 ) ([]byte, error) {
 	ukey := ikey.UserKey
 	// Iterate through v's tables, calling internalGet if the table's bounds
@@ -295,6 +390,12 @@ func (v *version) get(
 		if err != nil {
 			return nil, fmt.Errorf("pebble: could not open table %d: %v", f.fileNum, err)
 		}
+		if stats != nil {
+			setReadStats(iter, &stats[0])
+		}
+		if ro != nil && ro.VerifyChecksums {
+			setVerifyChecksums(iter)
+		}
 		value, conclusive, err := internalGet(iter, cmp, ikey)
 		if conclusive {
 			return value, err
@@ -322,6 +423,12 @@ func (v *version) get(
 		if err != nil {
 			return nil, fmt.Errorf("pebble: could not open table %d: %v", f.fileNum, err)
 		}
+		if stats != nil {
+			setReadStats(iter, &stats[level])
+		}
+		if ro != nil && ro.VerifyChecksums {
+			setVerifyChecksums(iter)
+		}
 		value, conclusive, err := internalGet(iter, cmp, ikey)
 		if conclusive {
 			return value, err
@@ -330,6 +437,13 @@ func (v *version) get(
 	return nil, db.ErrNotFound
 }
 
+// filteredSeeker is implemented by iterators which can consult a filter to
+// avoid reading any data when seeking for a point lookup of a user key which
+// is not present. See sstable.Iter.SeekGEFiltered.
+type filteredSeeker interface {
+	SeekGEFiltered(key []byte)
+}
+
 // internalGet looks up the first key/value pair whose (internal) key is >=
 // ikey, according to the internal key ordering, and also returns whether or
 // not that search was conclusive.
@@ -343,7 +457,12 @@ func (v *version) get(
 func internalGet(
 	t db.InternalIterator, cmp db.Compare, key db.InternalKey,
 ) (value []byte, conclusive bool, err error) {
-	for t.SeekGE(key.UserKey); t.Valid(); t.Next() {
+	if f, ok := t.(filteredSeeker); ok {
+		f.SeekGEFiltered(key.UserKey)
+	} else {
+		t.SeekGE(key.UserKey)
+	}
+	for ; t.Valid(); t.Next() {
 		ikey0 := t.Key()
 		if !ikey0.Valid() {
 			t.Close()
@@ -48,10 +48,18 @@ const (
 	tagColumnFamilyDrop = 202
 	tagMaxColumnFamily  = 203
 
+	// Pebble tags. Versions of pebble which do not understand a tag treat the
+	// manifest as corrupt, which is the desired behavior for a DB whose format
+	// is newer than they support.
+	tagFormatMajorVersion = 1000
+	tagDBID               = 1001
+	tagMergerName         = 1002
+
 	// The custom tags sub-format used by tagNewFile4.
 	customTagTerminate         = 1
 	customTagNeedsCompaction   = 2
 	customTagPathID            = 65
+	customTagBackingFileNum    = 66
 	customTagNonSafeIgnoreMask = 1 << 6
 )
 
@@ -73,6 +81,16 @@ type versionEdit struct {
 	lastSequence   uint64
 	deletedFiles   map[deletedFileEntry]bool // A set of deletedFileEntry values.
 	newFiles       []newFileEntry
+
+	// formatMajorVersion is the db.FormatMajorVersion of the DB. A value of 0
+	// leaves the format major version unchanged.
+	formatMajorVersion uint64
+	// dbID is the unique identifier of the DB. An empty value leaves the
+	// identifier unchanged.
+	dbID string
+	// mergerName is the name of the merge operator of the DB. It is only
+	// recorded at db.FormatMergerName and newer format major versions.
+	mergerName string
 }
 
 func (v *versionEdit) decode(r io.Reader) error {
@@ -182,6 +200,7 @@ func (v *versionEdit) decode(r io.Reader) error {
 				}
 			}
 			var markedForCompaction bool
+			var backingFileNum uint64
 			if tag == tagNewFile4 {
 				for {
 					customTag, err := d.readUvarint()
@@ -205,6 +224,13 @@ func (v *versionEdit) decode(r io.Reader) error {
 					case customTagPathID:
 						return fmt.Errorf("new-file4: path-id field not supported")
 
+					case customTagBackingFileNum:
+						n, m := binary.Uvarint(field)
+						if m <= 0 || m != len(field) {
+							return fmt.Errorf("new-file4: backing-file-num field invalid")
+						}
+						backingFileNum = n
+
 					default:
 						if (customTag & customTagNonSafeIgnoreMask) != 0 {
 							return fmt.Errorf("new-file4: custom field not supported: %d", customTag)
@@ -216,6 +242,7 @@ func (v *versionEdit) decode(r io.Reader) error {
 				level: level,
 				meta: fileMetadata{
 					fileNum:             fileNum,
+					backingFileNum:      backingFileNum,
 					size:                size,
 					smallest:            db.DecodeInternalKey(smallest),
 					largest:             db.DecodeInternalKey(largest),
@@ -232,6 +259,27 @@ func (v *versionEdit) decode(r io.Reader) error {
 			}
 			v.prevLogNumber = n
 
+		case tagFormatMajorVersion:
+			n, err := d.readUvarint()
+			if err != nil {
+				return err
+			}
+			v.formatMajorVersion = n
+
+		case tagDBID:
+			s, err := d.readBytes()
+			if err != nil {
+				return err
+			}
+			v.dbID = string(s)
+
+		case tagMergerName:
+			s, err := d.readBytes()
+			if err != nil {
+				return err
+			}
+			v.mergerName = string(s)
+
 		case tagColumnFamily, tagColumnFamilyAdd, tagColumnFamilyDrop, tagMaxColumnFamily:
 			return fmt.Errorf("column families are not supported")
 
@@ -264,6 +312,18 @@ func (v *versionEdit) encode(w io.Writer) error {
 		e.writeUvarint(tagLastSequence)
 		e.writeUvarint(v.lastSequence)
 	}
+	if v.formatMajorVersion != 0 {
+		e.writeUvarint(tagFormatMajorVersion)
+		e.writeUvarint(v.formatMajorVersion)
+	}
+	if v.dbID != "" {
+		e.writeUvarint(tagDBID)
+		e.writeString(v.dbID)
+	}
+	if v.mergerName != "" {
+		e.writeUvarint(tagMergerName)
+		e.writeString(v.mergerName)
+	}
 	for x := range v.deletedFiles {
 		e.writeUvarint(tagDeletedFile)
 		e.writeUvarint(uint64(x.level))
@@ -271,7 +331,7 @@ func (v *versionEdit) encode(w io.Writer) error {
 	}
 	for _, x := range v.newFiles {
 		var customFields bool
-		if x.meta.markedForCompaction {
+		if x.meta.markedForCompaction || x.meta.backingFileNum != 0 {
 			customFields = true
 			e.writeUvarint(tagNewFile4)
 		} else {
@@ -289,6 +349,12 @@ func (v *versionEdit) encode(w io.Writer) error {
 				e.writeUvarint(customTagNeedsCompaction)
 				e.writeBytes([]byte{1})
 			}
+			if x.meta.backingFileNum != 0 {
+				var buf [binary.MaxVarintLen64]byte
+				n := binary.PutUvarint(buf[:], x.meta.backingFileNum)
+				e.writeUvarint(customTagBackingFileNum)
+				e.writeBytes(buf[:n])
+			}
 			e.writeUvarint(customTagTerminate)
 		}
 	}
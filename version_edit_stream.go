@@ -0,0 +1,138 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sort"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// VersionEdit describes a change to the LSM applied by the DB, as recorded in
+// the MANIFEST: the tables added to and deleted from each level, and the
+// updated log and file numbers. A zero field is unchanged by the edit.
+type VersionEdit struct {
+	// Snapshot is true for the first edit delivered to a subscriber, which
+	// adds every table in the LSM at the time of the subscription rather than
+	// describing a change.
+	Snapshot bool
+	// LogNumber is the number of the oldest WAL which must be replayed to
+	// recover the DB. PrevLogNumber is only set by DBs created by older
+	// versions of LevelDB.
+	LogNumber     uint64
+	PrevLogNumber uint64
+	// NextFileNumber is the next file number to be allocated by the DB.
+	NextFileNumber uint64
+	// LastSequence is the last sequence number written to a WAL.
+	LastSequence uint64
+	// FormatMajorVersion is the format major version the DB was ratcheted to.
+	FormatMajorVersion db.FormatMajorVersion
+	// DeletedFiles are the tables removed from the LSM, ordered by level and
+	// file number.
+	DeletedFiles []DeletedFileEntry
+	// NewFiles are the tables added to the LSM.
+	NewFiles []NewFileEntry
+}
+
+// DeletedFileEntry is a table deleted from a level of the LSM by a VersionEdit.
+type DeletedFileEntry struct {
+	Level   int
+	FileNum uint64
+}
+
+// NewFileEntry is a table added to a level of the LSM by a VersionEdit.
+type NewFileEntry struct {
+	Level   int
+	FileNum uint64
+	// BackingFileNum is the file number of the on-disk table holding the data
+	// of a virtual table, or 0 if the table is not virtual.
+	BackingFileNum uint64
+	// Size is the size of the table, in bytes.
+	Size uint64
+	// Smallest and Largest are the inclusive bounds for the internal keys
+	// stored in the table.
+	Smallest db.InternalKey
+	Largest  db.InternalKey
+	// SmallestSeqNum and LargestSeqNum are the smallest and largest sequence
+	// numbers stored in the table.
+	SmallestSeqNum uint64
+	LargestSeqNum  uint64
+}
+
+// versionEditSubscriber is a subscription to the versionEdits applied by a
+// versionSet.
+type versionEditSubscriber struct {
+	fn func(VersionEdit)
+}
+
+// SubscribeVersionEdits subscribes fn to the changes to the LSM, allowing a
+// system which layers its own catalog on top of the DB, or replicates it, to
+// mirror the state of the LSM without parsing the MANIFEST. fn is first
+// invoked with a snapshot of the current LSM, and then with every subsequent
+// VersionEdit, in the order they are applied, until the returned function is
+// called to end the subscription. Applying the edits to the snapshot in order
+// reproduces the LSM returned by SSTables.
+//
+// fn is invoked synchronously while holding the DB mutex: it must return
+// quickly and must not call methods of the DB. The edit passed to fn may be
+// retained.
+func (d *DB) SubscribeVersionEdits(fn func(VersionEdit)) (unsubscribe func()) {
+	sub := &versionEditSubscriber{fn: fn}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	snapshot := d.mu.versions.snapshot()
+	fn(makeVersionEdit(&snapshot, true))
+	d.mu.versions.subscribers = append(d.mu.versions.subscribers, sub)
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		subs := d.mu.versions.subscribers
+		for i := range subs {
+			if subs[i] == sub {
+				d.mu.versions.subscribers = append(subs[:i:i], subs[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// makeVersionEdit returns the exported form of ve.
+func makeVersionEdit(ve *versionEdit, snapshot bool) VersionEdit {
+	e := VersionEdit{
+		Snapshot:           snapshot,
+		LogNumber:          ve.logNumber,
+		PrevLogNumber:      ve.prevLogNumber,
+		NextFileNumber:     ve.nextFileNumber,
+		LastSequence:       ve.lastSequence,
+		FormatMajorVersion: db.FormatMajorVersion(ve.formatMajorVersion),
+	}
+	for df := range ve.deletedFiles {
+		e.DeletedFiles = append(e.DeletedFiles, DeletedFileEntry{
+			Level:   df.level,
+			FileNum: df.fileNum,
+		})
+	}
+	sort.Slice(e.DeletedFiles, func(i, j int) bool {
+		a, b := e.DeletedFiles[i], e.DeletedFiles[j]
+		if a.Level != b.Level {
+			return a.Level < b.Level
+		}
+		return a.FileNum < b.FileNum
+	})
+	for _, nf := range ve.newFiles {
+		m := &nf.meta
+		e.NewFiles = append(e.NewFiles, NewFileEntry{
+			Level:          nf.level,
+			FileNum:        m.fileNum,
+			BackingFileNum: m.backingFileNum,
+			Size:           m.size,
+			Smallest:       m.smallest.Clone(),
+			Largest:        m.largest.Clone(),
+			SmallestSeqNum: m.smallestSeqNum,
+			LargestSeqNum:  m.largestSeqNum,
+		})
+	}
+	return e
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestSubscribeVersionEdits(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Logger:  discardLogger{},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	flush := func(keys ...string) {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flush("a", "b")
+
+	// The mirror of the LSM maintained by applying the edits, keyed by level
+	// and file number.
+	mirror := make(map[string]bool)
+	var edits []VersionEdit
+	unsubscribe := d.SubscribeVersionEdits(func(ve VersionEdit) {
+		edits = append(edits, ve)
+		for _, df := range ve.DeletedFiles {
+			delete(mirror, fmt.Sprintf("L%d.%06d", df.Level, df.FileNum))
+		}
+		for _, nf := range ve.NewFiles {
+			mirror[fmt.Sprintf("L%d.%06d", nf.Level, nf.FileNum)] = true
+		}
+	})
+	check := func() {
+		t.Helper()
+		tables, err := d.SSTables()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected, actual []string
+		for level := range tables {
+			for _, info := range tables[level] {
+				expected = append(expected, fmt.Sprintf("L%d.%06d", level, info.FileNum))
+			}
+		}
+		for k := range mirror {
+			actual = append(actual, k)
+		}
+		sort.Strings(expected)
+		sort.Strings(actual)
+		if !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("expected %v, but found %v", expected, actual)
+		}
+	}
+
+	if len(edits) != 1 || !edits[0].Snapshot || len(edits[0].NewFiles) != 1 {
+		t.Fatalf("expected a snapshot containing 1 table, but found %+v", edits)
+	}
+	check()
+
+	flush("c")
+	last := edits[len(edits)-1]
+	if last.Snapshot || len(last.NewFiles) != 1 || last.LogNumber == 0 {
+		t.Fatalf("unexpected flush edit %+v", last)
+	}
+	check()
+
+	d.mu.Lock()
+	deleted := last.NewFiles[0]
+	err = d.mu.versions.logAndApply(d.opts, d.dirname, &versionEdit{
+		deletedFiles: map[deletedFileEntry]bool{
+			{level: deleted.Level, fileNum: deleted.FileNum}: true,
+		},
+	})
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last = edits[len(edits)-1]
+	if expected := []DeletedFileEntry{{deleted.Level, deleted.FileNum}}; !reflect.DeepEqual(expected, last.DeletedFiles) {
+		t.Fatalf("expected deleted files %v, but found %v", expected, last.DeletedFiles)
+	}
+	check()
+
+	// No edits are delivered once unsubscribed.
+	unsubscribe()
+	n := len(edits)
+	flush("d")
+	if len(edits) != n {
+		t.Fatalf("expected no edits after unsubscribing, but found %d", len(edits)-n)
+	}
+}
@@ -77,7 +77,22 @@ func TestVersionEditRoundTrip(t *testing.T) {
 						markedForCompaction: true,
 					},
 				},
+				{
+					level: 6,
+					meta: fileMetadata{
+						fileNum:        807,
+						backingFileNum: 806,
+						size:           4030,
+						smallest:       db.DecodeInternalKey([]byte("B\x00\x01\x02\x03\x04\x05\x06\x07")),
+						largest:        db.DecodeInternalKey([]byte("Y\x01\xff\xfe\xfd\xfc\xfb\xfa\xf9")),
+						smallestSeqNum: 3,
+						largestSeqNum:  5,
+					},
+				},
 			},
+			formatMajorVersion: 66,
+			dbID:               "2a3ec0b2-0d5e-4a7c-9f1b-6c8d1e0f4b3a",
+			mergerName:         "pebble.concatenate",
 		},
 	}
 	for _, tc := range testCases {
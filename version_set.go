@@ -23,6 +23,9 @@ type versionSet struct {
 	fs      storage.Storage
 	cmp     db.Compare
 	cmpName string
+	// The name of the merge operator, which is recorded in the manifest at
+	// db.FormatMergerName and newer format major versions.
+	mergerName string
 
 	// Mutable fields.
 	versions versionList
@@ -34,6 +37,18 @@ type versionSet struct {
 	visibleSeqNum      uint64 // visible seqNum (< logSeqNum)
 	manifestFileNumber uint64
 
+	// formatMajorVersion is the db.FormatMajorVersion of the DB. It is read
+	// atomically, and updated atomically while holding DB.mu.
+	formatMajorVersion uint64
+	// dbID holds the unique identifier of the DB as a string, or nil if the DB
+	// has no identifier. It is read atomically, and updated while holding
+	// DB.mu.
+	dbID atomic.Value
+
+	// subscribers are notified of each versionEdit applied. Protected by
+	// DB.mu.
+	subscribers []*versionEditSubscriber
+
 	manifestFile storage.File
 	manifest     *record.Writer
 }
@@ -45,9 +60,13 @@ func (vs *versionSet) load(dirname string, opts *db.Options) error {
 	vs.fs = opts.Storage
 	vs.cmp = opts.Comparer.Compare
 	vs.cmpName = opts.Comparer.Name
+	vs.mergerName = opts.Merger.Name()
 	vs.versions.init()
 	// For historical reasons, the next file number is initialized to 2.
 	vs.nextFileNumber = 2
+	// A manifest which does not record a format major version was written by
+	// a version of pebble which predates format major versions.
+	vs.formatMajorVersion = uint64(db.FormatMostCompatible)
 
 	// Read the CURRENT file to find the current manifest file.
 	current, err := vs.fs.Open(dbFilename(dirname, fileTypeCurrent, 0))
@@ -78,11 +97,22 @@ func (vs *versionSet) load(dirname string, opts *db.Options) error {
 
 	// Read the versionEdits in the manifest file.
 	var bve bulkVersionEdit
-	manifest, err := vs.fs.Open(dirname + string(os.PathSeparator) + string(b))
+	manifestPath := dirname + string(os.PathSeparator) + string(b)
+	manifest, err := vs.fs.Open(manifestPath)
 	if err != nil {
 		return fmt.Errorf("pebble: could not open manifest file %q for DB %q: %v", b, dirname, err)
 	}
 	defer manifest.Close()
+	_, manifestFileNum, _ := parseDBFilename(manifestPath)
+	corruptionError := func(err error) error {
+		return &db.CorruptionError{
+			FileType: db.FileTypeManifest,
+			Path:     manifestPath,
+			FileNum:  manifestFileNum,
+			Offset:   -1,
+			Err:      err,
+		}
+	}
 	rr := record.NewReader(manifest)
 	for {
 		r, err := rr.Next()
@@ -90,12 +120,12 @@ func (vs *versionSet) load(dirname string, opts *db.Options) error {
 			break
 		}
 		if err != nil {
-			return err
+			return corruptionError(err)
 		}
 		var ve versionEdit
 		err = ve.decode(r)
 		if err != nil {
-			return err
+			return corruptionError(err)
 		}
 		if ve.comparatorName != "" {
 			if ve.comparatorName != vs.cmpName {
@@ -104,6 +134,11 @@ func (vs *versionSet) load(dirname string, opts *db.Options) error {
 					b, dirname, ve.comparatorName, vs.cmpName)
 			}
 		}
+		if ve.mergerName != "" && ve.mergerName != vs.mergerName {
+			return fmt.Errorf("pebble: manifest file %q for DB %q: "+
+				"merger name from file %q != merger name from db.Options %q",
+				b, dirname, ve.mergerName, vs.mergerName)
+		}
 		bve.accumulate(&ve)
 		if ve.logNumber != 0 {
 			vs.logNumber = ve.logNumber
@@ -117,6 +152,17 @@ func (vs *versionSet) load(dirname string, opts *db.Options) error {
 		if ve.lastSequence != 0 {
 			vs.logSeqNum = ve.lastSequence
 		}
+		if ve.formatMajorVersion != 0 {
+			vs.formatMajorVersion = ve.formatMajorVersion
+		}
+		if ve.dbID != "" {
+			vs.dbID.Store(ve.dbID)
+		}
+	}
+	if vs.formatMajorVersion > uint64(db.FormatNewest) {
+		return fmt.Errorf("pebble: manifest file %q for DB %q: "+
+			"format major version %d is newer than the newest supported version %d",
+			b, dirname, vs.formatMajorVersion, db.FormatNewest)
 	}
 	if vs.logNumber == 0 || vs.nextFileNumber == 0 {
 		if vs.nextFileNumber == 2 {
@@ -149,6 +195,34 @@ func (vs *versionSet) logAndApply(opts *db.Options, dirname string, ve *versionE
 			panic(fmt.Sprintf("pebble: inconsistent versionEdit logNumber %d", ve.logNumber))
 		}
 	}
+	if ve.formatMajorVersion != 0 && ve.formatMajorVersion < vs.formatMajorVersion {
+		panic(fmt.Sprintf("pebble: inconsistent versionEdit formatMajorVersion %d",
+			ve.formatMajorVersion))
+	}
+	if ve.dbID != "" && vs.id() != "" && ve.dbID != vs.id() {
+		panic(fmt.Sprintf("pebble: inconsistent versionEdit dbID %s", ve.dbID))
+	}
+
+	// Switch to a new manifest if the current one has grown too large. The new
+	// manifest starts with a snapshot of the current version, so the old
+	// manifest can be deleted once CURRENT points at the new one.
+	var obsoleteManifestFileNum uint64
+	if vs.manifest == nil {
+		if err := vs.createManifest(dirname, vs.manifestFileNumber); err != nil {
+			return err
+		}
+	} else if vs.manifest.Size() >= opts.MaxManifestFileSize {
+		manifestFileNum := vs.nextFileNum()
+		manifest, manifestFile := vs.manifest, vs.manifestFile
+		if err := vs.createManifest(dirname, manifestFileNum); err != nil {
+			return err
+		}
+		manifest.Close()
+		manifestFile.Close()
+		obsoleteManifestFileNum = vs.manifestFileNumber
+		vs.manifestFileNumber = manifestFileNum
+	}
+
 	ve.nextFileNumber = vs.nextFileNumber
 	ve.lastSequence = atomic.LoadUint64(&vs.logSeqNum)
 
@@ -159,8 +233,10 @@ func (vs *versionSet) logAndApply(opts *db.Options, dirname string, ve *versionE
 		return err
 	}
 
-	if vs.manifest == nil {
-		if err := vs.createManifest(dirname); err != nil {
+	// The sstables added by the edit must survive a crash before the manifest
+	// which refers to them.
+	if len(ve.newFiles) > 0 {
+		if err := syncDir(vs.fs, dirname); err != nil {
 			return err
 		}
 	}
@@ -181,6 +257,11 @@ func (vs *versionSet) logAndApply(opts *db.Options, dirname string, ve *versionE
 	if err := setCurrentFile(dirname, vs.opts.Storage, vs.manifestFileNumber); err != nil {
 		return err
 	}
+	if obsoleteManifestFileNum != 0 {
+		// Ignore any file system errors. The old manifest will be deleted by a
+		// subsequent call to DB.deleteObsoleteFiles.
+		vs.fs.Remove(dbFilename(dirname, fileTypeManifest, obsoleteManifestFileNum))
+	}
 
 	// Install the new version.
 	vs.append(newVersion)
@@ -190,13 +271,61 @@ func (vs *versionSet) logAndApply(opts *db.Options, dirname string, ve *versionE
 	if ve.prevLogNumber != 0 {
 		vs.prevLogNumber = ve.prevLogNumber
 	}
+	if ve.formatMajorVersion != 0 {
+		atomic.StoreUint64(&vs.formatMajorVersion, ve.formatMajorVersion)
+	}
+	if ve.dbID != "" {
+		vs.dbID.Store(ve.dbID)
+	}
+	for _, sub := range vs.subscribers {
+		sub.fn(makeVersionEdit(ve, false))
+	}
 	return nil
 }
 
+// id returns the unique identifier of the DB, or the empty string if the DB
+// has no identifier.
+func (vs *versionSet) id() string {
+	id, _ := vs.dbID.Load().(string)
+	return id
+}
+
+// snapshot returns a versionEdit which recreates the current state of vs when
+// applied to an empty DB.
+func (vs *versionSet) snapshot() versionEdit {
+	snapshot := versionEdit{
+		comparatorName: vs.cmpName,
+		logNumber:      vs.logNumber,
+		prevLogNumber:  vs.prevLogNumber,
+		nextFileNumber: vs.nextFileNumber,
+		lastSequence:   atomic.LoadUint64(&vs.logSeqNum),
+	}
+	// The format major version is omitted for FormatMostCompatible, keeping the
+	// manifest readable by versions of pebble which predate format major
+	// versions.
+	if vs.formatMajorVersion > uint64(db.FormatMostCompatible) {
+		snapshot.formatMajorVersion = vs.formatMajorVersion
+	}
+	snapshot.dbID = vs.id()
+	if vs.formatMajorVersion >= uint64(db.FormatMergerName) {
+		snapshot.mergerName = vs.mergerName
+	}
+	// TODO(peter): save compaction pointers.
+	for level, fileMetadata := range vs.currentVersion().files {
+		for _, meta := range fileMetadata {
+			snapshot.newFiles = append(snapshot.newFiles, newFileEntry{
+				level: level,
+				meta:  meta,
+			})
+		}
+	}
+	return snapshot
+}
+
 // createManifest creates a manifest file that contains a snapshot of vs.
-func (vs *versionSet) createManifest(dirname string) (err error) {
+func (vs *versionSet) createManifest(dirname string, fileNum uint64) (err error) {
 	var (
-		filename     = dbFilename(dirname, fileTypeManifest, vs.manifestFileNumber)
+		filename     = dbFilename(dirname, fileTypeManifest, fileNum)
 		manifestFile storage.File
 		manifest     *record.Writer
 	)
@@ -218,19 +347,7 @@ func (vs *versionSet) createManifest(dirname string) (err error) {
 	}
 	manifest = record.NewWriter(manifestFile)
 
-	snapshot := versionEdit{
-		comparatorName: vs.cmpName,
-	}
-	// TODO(peter): save compaction pointers.
-	for level, fileMetadata := range vs.currentVersion().files {
-		for _, meta := range fileMetadata {
-			snapshot.newFiles = append(snapshot.newFiles, newFileEntry{
-				level: level,
-				meta:  meta,
-			})
-		}
-	}
-
+	snapshot := vs.snapshot()
 	w, err1 := manifest.Next()
 	if err1 != nil {
 		return err1
@@ -276,6 +393,9 @@ func (vs *versionSet) addLiveFileNums(m map[uint64]struct{}) {
 		for _, ff := range v.files {
 			for _, f := range ff {
 				m[f.fileNum] = struct{}{}
+				if f.backingFileNum != 0 {
+					m[f.backingFileNum] = struct{}{}
+				}
 			}
 		}
 	}
@@ -0,0 +1,78 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestManifestRotation(t *testing.T) {
+	mem := storage.NewMem()
+	opts := &db.Options{
+		MaxManifestFileSize: 1,
+		Storage:             mem,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	manifests := func() []uint64 {
+		ls, err := mem.List("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []uint64
+		for _, filename := range ls {
+			if ft, fileNum, ok := parseDBFilename(filename); ok && ft == fileTypeManifest {
+				result = append(result, fileNum)
+			}
+		}
+		return result
+	}
+
+	var prev uint64
+	for i := 0; i < 5; i++ {
+		if err := d.Set([]byte(strconv.Itoa(i)), []byte("v"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		waitForBackgroundWork(d)
+		m := manifests()
+		if len(m) != 1 {
+			t.Fatalf("expected 1 manifest, but found %d", len(m))
+		}
+		if m[0] <= prev {
+			t.Fatalf("expected manifest %d to be rotated, but found %d", prev, m[0])
+		}
+		prev = m[0]
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotated manifest must contain the full state of the DB.
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := d.Get([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+	if err := d.CheckLevels(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -548,7 +548,7 @@ func TestVersion(t *testing.T) {
 		for _, query := range tc.queries {
 			s := strings.Split(query, " ")
 			ikey := db.ParseInternalKey(s[0])
-			value, err := v.get(ikey, newIter, cmp, nil)
+			value, err := v.get(ikey, newIter, cmp, nil, nil)
 			got, want := "", s[1]
 			if err != nil {
 				if err != db.ErrNotFound {
@@ -738,3 +738,50 @@ func TestOverlaps(t *testing.T) {
 		}
 	}
 }
+
+func TestPickLevelForOutput(t *testing.T) {
+	newMeta := func(fileNum, size uint64, smallest, largest string) fileMetadata {
+		return fileMetadata{
+			fileNum:  fileNum,
+			size:     size,
+			smallest: db.ParseInternalKey(smallest),
+			largest:  db.ParseInternalKey(largest),
+		}
+	}
+	v := version{
+		files: [numLevels][]fileMetadata{
+			0: {newMeta(1, 1, "c.SET.18", "d.SET.19")},
+			1: {newMeta(2, 1, "f.SET.16", "g.SET.17")},
+			3: {newMeta(3, 1<<30, "m.SET.14", "n.SET.15")},
+			4: {newMeta(4, 1, "p.SET.12", "q.SET.13")},
+		},
+	}
+	opts := (&db.Options{}).EnsureDefaults()
+
+	testCases := []struct {
+		level, maxLevel int
+		ukey0, ukey1    string
+		want            int
+	}{
+		// Flushes, which are written at most to L2.
+		{0, 2, "a", "b", 2},
+		{0, 2, "c", "c", 0},
+		{0, 2, "a", "f", 0},
+		{0, 2, "h", "k", 2},
+		// The table would overlap too much data in L3 if it were in L2.
+		{0, 2, "h", "m", 1},
+		// Trivial moves, which may reach the bottom level.
+		{1, numLevels - 1, "a", "b", numLevels - 1},
+		{1, numLevels - 1, "h", "m", 1},
+		{1, numLevels - 1, "o", "p", 3},
+		{1, numLevels - 1, "r", "s", numLevels - 1},
+	}
+	for _, tc := range testCases {
+		got := v.pickLevelForOutput(opts, db.DefaultComparer.Compare, tc.level, tc.maxLevel,
+			[]byte(tc.ukey0), []byte(tc.ukey1))
+		if got != tc.want {
+			t.Errorf("level=%d max=%d range=%s-%s: got %d, want %d",
+				tc.level, tc.maxLevel, tc.ukey0, tc.ukey1, got, tc.want)
+		}
+	}
+}
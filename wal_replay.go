@@ -0,0 +1,205 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+// walReplayProgressBytes is the number of bytes of a WAL replayed between two
+// WALReplayProgress events.
+const walReplayProgressBytes = 64 << 20
+
+// maxReplayFlushes is the maximum number of memtables filled by the replay of
+// the WALs which are flushed concurrently.
+const maxReplayFlushes = 4
+
+// walReplay tracks the replay of the WALs by Open. The progress of the replay
+// is reported to the EventListener, and the memtables filled by the replay are
+// written to level 0 in the background while the replay continues.
+//
+// Level 0 tables are ordered by file number, and the file numbers of the
+// tables written by concurrent flushes interleave. A memtable is therefore
+// only flushed concurrently with the flushes in progress if its keys do not
+// overlap with the keys of their memtables, in which case the order of the
+// tables does not matter. Otherwise the replay waits for those flushes to
+// complete first.
+type walReplay struct {
+	d     *DB
+	info  db.WALReplayInfo
+	start time.Time
+	// reported is info.BytesReplayed when the progress was last reported.
+	reported uint64
+
+	// The flushes in progress, and the first error of a flush. Protected by
+	// d.mu. cond is signalled when a flush completes.
+	cond    sync.Cond
+	flushes []*replayFlush
+	err     error
+}
+
+// replayFlush is the flush of a memtable filled by the replay of the WALs,
+// whose entries span the user keys [smallest, largest].
+type replayFlush struct {
+	smallest, largest []byte
+}
+
+// newWALReplay returns a walReplay for the replay of logs, reporting the
+// beginning of the replay.
+func (d *DB) newWALReplay(logs []walFile) *walReplay {
+	r := &walReplay{
+		d:     d,
+		start: time.Now(),
+	}
+	r.cond.L = &d.mu.Mutex
+	r.info.Files = len(logs)
+	for _, f := range logs {
+		r.info.Size += f.size
+	}
+	if fn := d.opts.EventListener.WALReplayBegin; fn != nil && len(logs) > 0 {
+		fn(r.info)
+	}
+	return r
+}
+
+// reader returns a reader for the WAL fileNum which counts the bytes replayed.
+func (r *walReplay) reader(f io.Reader, fileNum uint64) io.Reader {
+	r.info.FileNum = fileNum
+	return countingReader{f, &r.info.BytesReplayed}
+}
+
+// progress reports the progress of the replay, if another
+// walReplayProgressBytes have been replayed since it was last reported, or if
+// force is true.
+func (r *walReplay) progress(force bool) {
+	if !force && r.info.BytesReplayed-r.reported < walReplayProgressBytes {
+		return
+	}
+	r.reported = r.info.BytesReplayed
+	r.info.Duration = time.Since(r.start)
+	if fn := r.d.opts.EventListener.WALReplayProgress; fn != nil {
+		fn(r.info)
+	}
+}
+
+// end waits for the flushes in progress to complete and reports the end of
+// the replay, returning err or the first error of a flush.
+//
+// d.mu must be held when calling this.
+func (r *walReplay) end(err error) error {
+	for len(r.flushes) > 0 {
+		r.cond.Wait()
+	}
+	if err == nil {
+		err = r.err
+	}
+	r.info.Duration = time.Since(r.start)
+	r.info.Err = err
+	if fn := r.d.opts.EventListener.WALReplayEnd; fn != nil && r.info.Files > 0 {
+		fn(r.info)
+	}
+	return err
+}
+
+// flushing returns whether any flushes are in progress.
+//
+// d.mu must be held when calling this.
+func (r *walReplay) flushing() bool {
+	return len(r.flushes) > 0
+}
+
+// flush writes mem to level-0 tables in the background, adding them to ve
+// once written. It first waits for the flushes in progress whose memtables
+// overlap with mem, and for a flush to complete if there are
+// maxReplayFlushes in progress. The error of a previous flush is returned.
+//
+// d.mu must be held when calling this.
+func (r *walReplay) flush(ve *versionEdit, fs storage.Storage, mem *memTable) error {
+	d := r.d
+	f := &replayFlush{}
+	f.smallest, f.largest = memTableBounds(d.cmp, mem)
+	for r.err == nil && (len(r.flushes) >= maxReplayFlushes || r.overlaps(f)) {
+		r.cond.Wait()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	r.flushes = append(r.flushes, f)
+
+	go func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		metas, err := d.writeLevel0Table(fs, mem.NewIter(nil), nil)
+		if err != nil && r.err == nil {
+			r.err = err
+		}
+		for _, meta := range metas {
+			ve.newFiles = append(ve.newFiles, newFileEntry{level: 0, meta: meta})
+			// Strictly speaking, it's too early to delete meta.fileNum from
+			// d.pendingOutputs, but we are replaying the log file, which happens
+			// before Open returns, so there is no possibility of
+			// deleteObsoleteFiles being called concurrently here.
+			delete(d.mu.compact.pendingOutputs, meta.fileNum)
+		}
+		for i := range r.flushes {
+			if r.flushes[i] == f {
+				r.flushes = append(r.flushes[:i], r.flushes[i+1:]...)
+				break
+			}
+		}
+		r.cond.Broadcast()
+	}()
+	return nil
+}
+
+// overlaps returns whether the keys of the memtable of f overlap with those of
+// the memtables being flushed.
+func (r *walReplay) overlaps(f *replayFlush) bool {
+	cmp := r.d.cmp
+	for _, g := range r.flushes {
+		if cmp(f.smallest, g.largest) <= 0 && cmp(g.smallest, f.largest) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// memTableBounds returns the smallest and largest user keys of the entries of
+// mem, including the end keys of its range deletions.
+func memTableBounds(cmp db.Compare, mem *memTable) (smallest, largest []byte) {
+	iter := mem.NewIter(nil)
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if smallest == nil {
+			smallest = append([]byte(nil), key.UserKey...)
+		}
+		end := key.UserKey
+		if key.Kind() == db.InternalKeyKindRangeDelete {
+			end = iter.Value()
+		}
+		if largest == nil || cmp(largest, end) < 0 {
+			largest = append(largest[:0], end...)
+		}
+	}
+	return smallest, largest
+}
+
+// countingReader counts the bytes read from an io.Reader into n.
+type countingReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += uint64(n)
+	return n, err
+}